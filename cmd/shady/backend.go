@@ -0,0 +1,29 @@
+package main
+
+import (
+	"flag"
+
+	"github.com/polyfloyd/shady/renderer"
+)
+
+type backendFlags struct {
+	backend *string
+	device  *string
+}
+
+func registerBackendFlags(fs *flag.FlagSet) backendFlags {
+	return backendFlags{
+		backend: fs.String("backend", "auto", "How the OpenGL context for off-screen rendering is created: glfw, egl for a GPU without a display server, software or auto to try them in that order"),
+		device:  fs.String("egl-device", "", "The DRM device or render node of the GPU that -backend egl renders with, e.g. /dev/dri/renderD128. By default, the first GPU that works is used"),
+	}
+}
+
+// apply selects the backend, it must be called before any shader is created.
+func (f backendFlags) apply() error {
+	backend, err := renderer.ParseBackend(*f.backend)
+	if err != nil {
+		return err
+	}
+	renderer.SetBackend(backend, *f.device)
+	return nil
+}
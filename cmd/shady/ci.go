@@ -0,0 +1,103 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// ciStartDate is the date of the first frame in CI mode, so shaders that use
+// the date render the same every time.
+var ciStartDate = time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC)
+
+// ciEnvironment returns the environment variables that select software
+// rendering and disable vsync. Variables that are already set are left alone
+// so they can still be overridden.
+func ciEnvironment(getenv func(string) string, needsDisplay bool) map[string]string {
+	vars := map[string]string{
+		// Mesa: use llvmpipe instead of a GPU.
+		"LIBGL_ALWAYS_SOFTWARE": "1",
+		// Mesa and NVIDIA: do not wait for the vertical blank.
+		"vblank_mode":         "0",
+		"__GL_SYNC_TO_VBLANK": "0",
+	}
+	if !needsDisplay && getenv("DISPLAY") == "" && getenv("WAYLAND_DISPLAY") == "" {
+		// Mesa: render offscreen without connecting to a display server.
+		vars["EGL_PLATFORM"] = "surfaceless"
+	}
+	for name := range vars {
+		if getenv(name) != "" {
+			delete(vars, name)
+		}
+	}
+	return vars
+}
+
+// setupCI prepares the process for rendering on machines without a GPU or a
+// display, like CI runners. If a window is required and no display is
+// available, a virtual display is started. The returned function stops it.
+func setupCI(needsDisplay bool) (func(), error) {
+	for name, value := range ciEnvironment(os.Getenv, needsDisplay) {
+		os.Setenv(name, value)
+	}
+	if !needsDisplay || os.Getenv("DISPLAY") != "" {
+		return func() {}, nil
+	}
+	display, stop, err := startXvfb()
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("Started a virtual display on %s", display)
+	os.Setenv("DISPLAY", display)
+	return stop, nil
+}
+
+// startXvfb starts a virtual X server on the first free display.
+func startXvfb() (string, func(), error) {
+	path, err := exec.LookPath("Xvfb")
+	if err != nil {
+		return "", nil, fmt.Errorf("no display is available and Xvfb is not installed, please install it or render to a file")
+	}
+	r, w, err := os.Pipe()
+	if err != nil {
+		return "", nil, err
+	}
+	defer r.Close()
+	// Xvfb picks a free display and writes its number to the file
+	// descriptor passed with -displayfd.
+	cmd := exec.Command(path, "-displayfd", "3", "-screen", "0", "1920x1080x24", "-nolisten", "tcp")
+	cmd.ExtraFiles = []*os.File{w}
+	// Do not leave the server running if shady exits without cleaning up.
+	cmd.SysProcAttr = &syscall.SysProcAttr{Pdeathsig: syscall.SIGTERM}
+	if err := cmd.Start(); err != nil {
+		w.Close()
+		return "", nil, err
+	}
+	w.Close()
+	stop := func() {
+		cmd.Process.Signal(syscall.SIGTERM)
+		cmd.Wait()
+	}
+
+	lines := make(chan string, 1)
+	go func() {
+		line, _ := bufio.NewReader(r).ReadString('\n')
+		lines <- strings.TrimSpace(line)
+	}()
+	select {
+	case num := <-lines:
+		if num == "" {
+			stop()
+			return "", nil, fmt.Errorf("Xvfb exited before reporting its display")
+		}
+		return ":" + num, stop, nil
+	case <-time.After(10 * time.Second):
+		stop()
+		return "", nil, fmt.Errorf("timeout while waiting for Xvfb to start")
+	}
+}
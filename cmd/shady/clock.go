@@ -0,0 +1,129 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/polyfloyd/shady/renderer"
+)
+
+// clockSpec is a clock defined on the command line as
+// "<name>[,rate=<factor>][,reset=load]".
+type clockSpec struct {
+	name string
+	rate float64
+	// resetOnLoad resets the clock to 0 when a different shader is loaded.
+	resetOnLoad bool
+}
+
+func parseClockSpec(s string) (clockSpec, error) {
+	fields := strings.Split(s, ",")
+	spec := clockSpec{name: fields[0], rate: 1}
+	for _, field := range fields[1:] {
+		kv := strings.SplitN(field, "=", 2)
+		if len(kv) != 2 {
+			return clockSpec{}, fmt.Errorf("invalid clock option %q, expected key=value", field)
+		}
+		switch kv[0] {
+		case "rate":
+			rate, err := strconv.ParseFloat(kv[1], 64)
+			if err != nil {
+				return clockSpec{}, fmt.Errorf("invalid clock rate %q", kv[1])
+			}
+			spec.rate = rate
+		case "reset":
+			if kv[1] != "load" {
+				return clockSpec{}, fmt.Errorf("invalid clock reset %q, expected \"load\"", kv[1])
+			}
+			spec.resetOnLoad = true
+		default:
+			return clockSpec{}, fmt.Errorf("unknown clock option %q", kv[0])
+		}
+	}
+	return spec, nil
+}
+
+// newClocks creates the clocks of the specs. The names of the clocks that are
+// reset when a shader is loaded are returned separately.
+func newClocks(specs []string) (*renderer.Clocks, []string, error) {
+	clocks := &renderer.Clocks{}
+	var resetOnLoad []string
+	for _, s := range specs {
+		spec, err := parseClockSpec(s)
+		if err != nil {
+			return nil, nil, err
+		}
+		if err := clocks.Add(spec.name); err != nil {
+			return nil, nil, err
+		}
+		if err := clocks.SetRate(spec.name, spec.rate); err != nil {
+			return nil, nil, err
+		}
+		if spec.resetOnLoad {
+			resetOnLoad = append(resetOnLoad, spec.name)
+		}
+	}
+	return clocks, resetOnLoad, nil
+}
+
+// clockCommand executes a control command for a clock and returns the reply
+// without the "ok" prefix:
+//
+//	clock <name>                  print the value in seconds
+//	clock <name> set <seconds>
+//	clock <name> reset
+//	clock <name> pause|resume
+//	clock <name> rate <factor>
+func clockCommand(clocks *renderer.Clocks, args []string) (string, error) {
+	usage := fmt.Errorf("usage: clock <name> [set <seconds>|reset|pause|resume|rate <factor>]")
+	if len(args) == 0 {
+		return "", usage
+	}
+	name := args[0]
+	if len(args) == 1 {
+		t, err := clocks.Get(name)
+		if err != nil {
+			return "", err
+		}
+		return formatSeconds(t), nil
+	}
+	switch {
+	case args[1] == "set" && len(args) == 3:
+		seconds, err := strconv.ParseFloat(args[2], 64)
+		if err != nil {
+			return "", fmt.Errorf("invalid time %q", args[2])
+		}
+		return "", clocks.Set(name, time.Duration(seconds*float64(time.Second)))
+	case args[1] == "reset" && len(args) == 2:
+		return "", clocks.Set(name, 0)
+	case args[1] == "pause" && len(args) == 2:
+		return "", clocks.SetPaused(name, true)
+	case args[1] == "resume" && len(args) == 2:
+		return "", clocks.SetPaused(name, false)
+	case args[1] == "rate" && len(args) == 3:
+		rate, err := strconv.ParseFloat(args[2], 64)
+		if err != nil {
+			return "", fmt.Errorf("invalid rate %q", args[2])
+		}
+		return "", clocks.SetRate(name, rate)
+	}
+	return "", usage
+}
+
+// listClocks returns the values of all clocks as space separated
+// name=seconds pairs.
+func listClocks(clocks *renderer.Clocks) string {
+	var pairs []string
+	for _, name := range clocks.Names() {
+		if t, err := clocks.Get(name); err == nil {
+			pairs = append(pairs, name+"="+formatSeconds(t))
+		}
+	}
+	return strings.Join(pairs, " ")
+}
+
+func formatSeconds(t time.Duration) string {
+	return strconv.FormatFloat(t.Seconds(), 'f', 3, 64)
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/polyfloyd/shady/renderer"
+)
+
+type colorFlags struct {
+	file *string
+}
+
+func registerColorFlags(fs *flag.FlagSet) colorFlags {
+	return colorFlags{
+		file: fs.String("color-calibration", "", "Correct the colors of the output with the matrix and curves of a calibration file, so outputs of different batches match"),
+	}
+}
+
+func (f colorFlags) enabled() bool {
+	return *f.file != ""
+}
+
+func (f colorFlags) load() (renderer.ColorCalibration, error) {
+	data, err := os.ReadFile(*f.file)
+	if err != nil {
+		return renderer.ColorCalibration{}, err
+	}
+	c, err := parseColorCalibration(data)
+	if err != nil {
+		return renderer.ColorCalibration{}, fmt.Errorf("%s: %v", *f.file, err)
+	}
+	return c, nil
+}
+
+// colorFile is the JSON encoding of a renderer.ColorCalibration.
+type colorFile struct {
+	Matrix *[3][3]float64 `json:"matrix,omitempty"`
+	Curves struct {
+		// All is used for the channels that do not have a curve of their
+		// own.
+		All   []float64 `json:"all,omitempty"`
+		Red   []float64 `json:"red,omitempty"`
+		Green []float64 `json:"green,omitempty"`
+		Blue  []float64 `json:"blue,omitempty"`
+	} `json:"curves"`
+}
+
+func parseColorCalibration(data []byte) (renderer.ColorCalibration, error) {
+	var file colorFile
+	if err := json.Unmarshal(data, &file); err != nil {
+		return renderer.ColorCalibration{}, fmt.Errorf("invalid color calibration: %v", err)
+	}
+	var c renderer.ColorCalibration
+	if file.Matrix != nil {
+		c.Matrix = *file.Matrix
+	}
+	for i, curve := range [][]float64{file.Curves.Red, file.Curves.Green, file.Curves.Blue} {
+		if curve == nil {
+			curve = file.Curves.All
+		}
+		c.Curves[i] = curve
+	}
+	return c, c.Validate()
+}
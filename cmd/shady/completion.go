@@ -0,0 +1,161 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+)
+
+// subcommands are the commands that can be passed as the first argument.
+var subcommands = []string{"completion", "daemon", "gallery", "import", "info", "list", "multi", "new", "repl", "worker"}
+
+// fileFlags are completed with filenames.
+var fileFlags = map[string]bool{
+	"color-calibration": true,
+	"dump-passes":       true,
+	"error-json":        true,
+	"events-out":        true,
+	"i":                 true,
+	"latency":           true,
+	"load-state":        true,
+	"o":                 true,
+	"overlay":           true,
+	"save-state":        true,
+	"screenshot-dir":    true,
+	"sound":             true,
+	"sound-out":         true,
+	"subtitles":         true,
+	"sync-audio":        true,
+	"vaapi-device":      true,
+	"warp":              true,
+}
+
+// runCompletion prints a completion script for the specified shell that
+// completes the flags of the main command.
+func runCompletion(args []string, flags *flag.FlagSet) {
+	if len(args) != 1 {
+		fmt.Fprintf(os.Stderr, "Usage: shady completion bash|zsh|fish\n")
+		os.Exit(2)
+	}
+	var err error
+	switch args[0] {
+	case "bash":
+		err = writeBashCompletion(os.Stdout, flags)
+	case "zsh":
+		// Zsh can load Bash completions, which saves having to maintain
+		// another script.
+		fmt.Fprintln(os.Stdout, "#compdef shady")
+		fmt.Fprintln(os.Stdout, "autoload -U +X bashcompinit && bashcompinit")
+		err = writeBashCompletion(os.Stdout, flags)
+	case "fish":
+		err = writeFishCompletion(os.Stdout, flags)
+	default:
+		fmt.Fprintf(os.Stderr, "Unsupported shell: %q\n", args[0])
+		os.Exit(2)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+func flagNames(flags *flag.FlagSet) []string {
+	var names []string
+	flags.VisitAll(func(f *flag.Flag) {
+		names = append(names, f.Name)
+	})
+	sort.Strings(names)
+	return names
+}
+
+// isBoolFlag reports whether the flag can be set without a value.
+func isBoolFlag(f *flag.Flag) bool {
+	b, ok := f.Value.(interface{ IsBoolFlag() bool })
+	return ok && b.IsBoolFlag()
+}
+
+func writeBashCompletion(w io.Writer, flags *flag.FlagSet) error {
+	names := flagNames(flags)
+	for i, name := range names {
+		names[i] = "-" + name
+	}
+	var files []string
+	for name := range fileFlags {
+		files = append(files, "-"+name)
+	}
+	sort.Strings(files)
+	_, err := fmt.Fprintf(w, `_shady() {
+	local cur="${COMP_WORDS[COMP_CWORD]}"
+	local prev="${COMP_WORDS[COMP_CWORD-1]}"
+	if [ "$COMP_CWORD" -eq 1 ] && [[ "$cur" != -* ]]; then
+		COMPREPLY=($(compgen -W "%s" -- "$cur"))
+		return
+	fi
+	case "${COMP_WORDS[1]}" in
+	list)
+		COMPREPLY=($(compgen -W "inputs outputs sources environments devices" -- "$cur"))
+		return;;
+	completion)
+		COMPREPLY=($(compgen -W "bash zsh fish" -- "$cur"))
+		return;;
+	new)
+		COMPREPLY=($(compgen -W "simulation" -- "$cur"))
+		return;;
+	esac
+	case "$prev" in
+	-ofmt)
+		COMPREPLY=($(compgen -W "$(shady list outputs 2>/dev/null)" -- "$cur"))
+		return;;
+	-source)
+		COMPREPLY=($(compgen -W "$(shady list sources 2>/dev/null | cut -f1)" -- "$cur"))
+		return;;
+	%s)
+		COMPREPLY=($(compgen -f -- "$cur"))
+		return;;
+	esac
+	COMPREPLY=($(compgen -W "%s" -- "$cur"))
+}
+complete -o default -F _shady shady
+`, strings.Join(subcommands, " "), strings.Join(files, "|"), strings.Join(names, " "))
+	return err
+}
+
+func writeFishCompletion(w io.Writer, flags *flag.FlagSet) error {
+	lines := []string{
+		"complete -c shady -f",
+		fmt.Sprintf("complete -c shady -n __fish_use_subcommand -a '%s'", strings.Join(subcommands, " ")),
+		"complete -c shady -n '__fish_seen_subcommand_from list' -a 'inputs outputs sources environments devices'",
+		"complete -c shady -n '__fish_seen_subcommand_from completion' -a 'bash zsh fish'",
+		"complete -c shady -n '__fish_seen_subcommand_from new' -a 'simulation'",
+	}
+	flags.VisitAll(func(f *flag.Flag) {
+		line := fmt.Sprintf("complete -c shady -o %s -d %s", f.Name, fishQuote(firstSentence(f.Usage)))
+		switch {
+		case f.Name == "ofmt":
+			line += " -x -a '(shady list outputs 2>/dev/null)'"
+		case f.Name == "source":
+			line += " -x -a '(shady list sources 2>/dev/null)'"
+		case fileFlags[f.Name]:
+			line += " -r -F"
+		case !isBoolFlag(f):
+			line += " -x"
+		}
+		lines = append(lines, line)
+	})
+	_, err := fmt.Fprintln(w, strings.Join(lines, "\n"))
+	return err
+}
+
+func firstSentence(s string) string {
+	if i := strings.Index(s, ". "); i >= 0 {
+		return s[:i]
+	}
+	return strings.TrimSuffix(s, ".")
+}
+
+func fishQuote(s string) string {
+	return "'" + strings.NewReplacer(`\`, `\\`, `'`, `\'`).Replace(s) + "'"
+}
@@ -0,0 +1,240 @@
+package main
+
+import (
+	"encoding/binary"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"net"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/polyfloyd/shady/renderer"
+)
+
+// midiMaxController is the highest MIDI controller number that is not a
+// channel mode message.
+const midiMaxController = 119
+
+// A controlSink sends values that were computed by a shader to another
+// program or device.
+type controlSink interface {
+	send(values []float32) error
+	io.Closer
+}
+
+// midiSink sends values as MIDI control changes to a raw MIDI device, like
+// /dev/snd/midiC1D0 of ALSA. Values are sent only when their 7-bit value
+// changes.
+type midiSink struct {
+	w          io.WriteCloser
+	channel    byte
+	controller int
+	last       []int
+}
+
+func (s *midiSink) send(values []float32) error {
+	if len(s.last) != len(values) {
+		// Everything is sent when the buffer changes size.
+		s.last = make([]int, len(values))
+		for i := range s.last {
+			s.last[i] = -1
+		}
+	}
+	var msg []byte
+	for i, v := range values {
+		controller := s.controller + i
+		if controller > midiMaxController {
+			break
+		}
+		value := int(math.Round(clamp01(float64(v)) * 127))
+		if s.last[i] == value {
+			continue
+		}
+		msg = append(msg, 0xb0|s.channel, byte(controller), byte(value))
+		s.last[i] = value
+	}
+	if len(msg) == 0 {
+		return nil
+	}
+	_, err := s.w.Write(msg)
+	return err
+}
+
+func (s *midiSink) Close() error {
+	return s.w.Close()
+}
+
+// oscSink sends values as OSC messages over UDP, with a message with a single
+// float for every value that changed. The address of a value is the prefix
+// followed by its index.
+type oscSink struct {
+	conn   net.Conn
+	prefix string
+	last   []float32
+}
+
+func (s *oscSink) send(values []float32) error {
+	for i, v := range values {
+		if len(s.last) == len(values) && s.last[i] == v {
+			continue
+		}
+		if _, err := s.conn.Write(oscMessage(fmt.Sprintf("%s/%d", s.prefix, i), v)); err != nil {
+			return err
+		}
+	}
+	s.last = append(s.last[:0], values...)
+	return nil
+}
+
+func (s *oscSink) Close() error {
+	return s.conn.Close()
+}
+
+// oscMessage encodes an OSC message with a single float argument.
+func oscMessage(address string, value float32) []byte {
+	var b []byte
+	b = appendOSCString(b, address)
+	b = appendOSCString(b, ",f")
+	var arg [4]byte
+	binary.BigEndian.PutUint32(arg[:], math.Float32bits(value))
+	return append(b, arg[:]...)
+}
+
+// appendOSCString appends a string terminated by at least one zero byte and
+// padded to a multiple of 4 bytes.
+func appendOSCString(b []byte, s string) []byte {
+	b = append(b, s...)
+	return append(b, make([]byte, 4-len(s)%4)...)
+}
+
+func clamp01(v float64) float64 {
+	return math.Max(0, math.Min(1, v))
+}
+
+// controlOutput sends the contents of a buffer to a sink each time it has been
+// rendered. Sending happens in the background, so a slow sink does not hold
+// up rendering. If the sink can not keep up, only the most recent values are
+// sent.
+type controlOutput struct {
+	buffer string
+	sink   controlSink
+
+	lock    sync.Mutex
+	values  []float32
+	pending chan struct{}
+}
+
+func newControlOutput(buffer string, sink controlSink) *controlOutput {
+	return &controlOutput{buffer: buffer, sink: sink, pending: make(chan struct{}, 1)}
+}
+
+// update is called with the contents of the buffer. The values of the pixels
+// are read left to right and top to bottom, 4 channels for every pixel.
+func (c *controlOutput) update(data renderer.PixelData) {
+	c.lock.Lock()
+	c.values = append(c.values[:0], data.Pix...)
+	c.lock.Unlock()
+	select {
+	case c.pending <- struct{}{}:
+	default:
+	}
+}
+
+// run sends updates until done is closed.
+func (c *controlOutput) run(done <-chan struct{}) {
+	var values []float32
+	failed := false
+	for {
+		select {
+		case <-c.pending:
+		case <-done:
+			return
+		}
+		c.lock.Lock()
+		values = append(values[:0], c.values...)
+		c.lock.Unlock()
+		if err := c.sink.send(values); err != nil {
+			if !failed {
+				log.Printf("Could not send the values of %s: %v", c.buffer, err)
+			}
+			failed = true
+		} else {
+			failed = false
+		}
+	}
+}
+
+type controlOutputFlags struct {
+	midi           *string
+	midiChannel    *int
+	midiController *int
+	osc            *string
+	oscPrefix      *string
+}
+
+func registerControlOutputFlags(fs *flag.FlagSet) controlOutputFlags {
+	return controlOutputFlags{
+		midi:           fs.String("midi-out", "", "Send the values that the shader writes to a buffer as MIDI control changes, as <buffer name>=<raw MIDI device>, e.g. ctl=/dev/snd/midiC1D0"),
+		midiChannel:    fs.Int("midi-channel", 1, "The MIDI channel of -midi-out, from 1 to 16"),
+		midiController: fs.Int("midi-cc", 20, "The controller number of the first value of -midi-out, the next values use the next numbers"),
+		osc:            fs.String("osc-out", "", "Send the values that the shader writes to a buffer as OSC messages, as <buffer name>=<host>:<port>, e.g. ctl=localhost:9000"),
+		oscPrefix:      fs.String("osc-prefix", "/shady", "The address prefix of -osc-out messages, values are sent to <prefix>/<index>"),
+	}
+}
+
+// parseControlTarget parses a buffer name and a target separated by a '='.
+func parseControlTarget(s string) (buffer, target string, err error) {
+	i := strings.IndexByte(s, '=')
+	if i <= 0 || i == len(s)-1 {
+		return "", "", fmt.Errorf("invalid value %q, expected <buffer name>=<target>", s)
+	}
+	return s[:i], s[i+1:], nil
+}
+
+// outputs opens the configured sinks.
+func (f controlOutputFlags) outputs() ([]*controlOutput, error) {
+	var outputs []*controlOutput
+	if *f.midi != "" {
+		buffer, device, err := parseControlTarget(*f.midi)
+		if err != nil {
+			return nil, fmt.Errorf("-midi-out: %w", err)
+		}
+		if *f.midiChannel < 1 || *f.midiChannel > 16 {
+			return nil, fmt.Errorf("-midi-channel must be between 1 and 16")
+		}
+		if *f.midiController < 0 || *f.midiController > midiMaxController {
+			return nil, fmt.Errorf("-midi-cc must be between 0 and %d", midiMaxController)
+		}
+		w, err := os.OpenFile(device, os.O_WRONLY, 0)
+		if err != nil {
+			return nil, fmt.Errorf("-midi-out: %w", err)
+		}
+		outputs = append(outputs, newControlOutput(buffer, &midiSink{
+			w:          w,
+			channel:    byte(*f.midiChannel - 1),
+			controller: *f.midiController,
+		}))
+	}
+	if *f.osc != "" {
+		buffer, addr, err := parseControlTarget(*f.osc)
+		if err != nil {
+			return nil, fmt.Errorf("-osc-out: %w", err)
+		}
+		if !strings.HasPrefix(*f.oscPrefix, "/") {
+			return nil, fmt.Errorf("-osc-prefix must start with a '/'")
+		}
+		conn, err := net.Dial("udp", addr)
+		if err != nil {
+			return nil, fmt.Errorf("-osc-out: %w", err)
+		}
+		outputs = append(outputs, newControlOutput(buffer, &oscSink{
+			conn:   conn,
+			prefix: strings.TrimSuffix(*f.oscPrefix, "/"),
+		}))
+	}
+	return outputs, nil
+}
@@ -0,0 +1,485 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/polyfloyd/shady/renderer"
+)
+
+// listenFDsStart is the first file descriptor passed by systemd socket
+// activation, see sd_listen_fds(3).
+const listenFDsStart = 3
+
+// runDaemon runs shady as a long running process that renders to a window and
+// is controlled through commands sent over a Unix socket.
+func runDaemon(args []string) {
+	fs := flag.NewFlagSet("daemon", flag.ExitOnError)
+	var inputFiles arrayFlags
+	fs.Var(&inputFiles, "i", "The shader file(s) to load on startup")
+	playlistFile := fs.String("playlist", "", "Cycle through the shaders of a playlist file instead of loading -i")
+	socketPath := fs.String("socket", defaultSocketPath(), "The path of the Unix socket to listen on. Ignored when started through socket activation")
+	glslVersion := fs.String("glsl", "330", "The GLSL version to use")
+	openGLVersionStr := fs.String("opengl", "glsl", "The OpenGL version to use. If \"glsl\", the version is inferred from the requested GLSL version")
+	var shadertoyMappings arrayFlags
+	fs.Var(&shadertoyMappings, "map", "Specify or override ShaderToy input mappings")
+	throttleOpts := registerThrottleFlags(fs)
+	presenceOpts := registerPresenceFlags(fs)
+	var presenceFiles arrayFlags
+	fs.Var(&presenceFiles, "presence-shader", "The shader file(s) to show instead of -i or the playlist while someone is present, see -presence")
+	suspendOpts := registerSuspendFlags(fs)
+	screenshotDir := fs.String("screenshot-dir", ".", "The directory to save screenshots to when receiving SIGUSR1")
+	supervisorOpts := registerSupervisorFlags(fs)
+	seed := fs.Int64("seed", 0, "The seed for random sources like builtin noise textures. Use different values to render variations")
+	snapshot := fs.String("snapshot", "", "Save snapshots on a schedule while rendering, e.g. \"every=1h\" or \"at=06:00,dir=/srv/www\"")
+	var clockSpecs arrayFlags
+	fs.Var(&clockSpecs, "clock", "Add a named clock that is exposed as a float uniform and controlled with the clock command, as <name>[,rate=<factor>][,reset=load]. With reset=load, it starts at 0 for every loaded shader")
+	syncOpts := registerSyncFlags(fs)
+	memoryOpts := registerMemoryFlags(fs)
+	canary := fs.Bool("canary", true, "Test render new shaders off-screen and keep showing the current one if they fail or render NaN or a black frame")
+	fs.Parse(args)
+
+	openGLVersion, err := parseOpenGLVersion(*openGLVersionStr, *glslVersion)
+	if err != nil {
+		log.Fatal(err)
+	}
+	throttle, err := throttleOpts.newThrottle()
+	if err != nil {
+		log.Fatal(err)
+	}
+	presence, err := presenceOpts.newPresence()
+	if err != nil {
+		log.Fatal(err)
+	}
+	if len(presenceFiles) > 0 && presence == nil {
+		log.Fatalf("-presence-shader requires -presence")
+	}
+	if err := suspendOpts.validate(); err != nil {
+		log.Fatal(err)
+	}
+	if err := memoryOpts.apply(); err != nil {
+		log.Fatalf("-gpu-memory: %v", err)
+	}
+	var snapshotSched *snapshotSchedule
+	if *snapshot != "" {
+		sched, err := parseSnapshotSchedule(*snapshot)
+		if err != nil {
+			log.Fatalf("-snapshot: %v", err)
+		}
+		snapshotSched = &sched
+	}
+
+	if *playlistFile != "" && len(inputFiles) > 0 {
+		log.Fatalf("-playlist and -i are mutually exclusive")
+	}
+	var remote *syncer
+	if syncOpts.enabled() {
+		self, err := os.Executable()
+		if err != nil {
+			log.Fatal(err)
+		}
+		// The paths are relative to the synced files, updates are
+		// validated before they become the current files.
+		relPlaylist, relInputs := *playlistFile, inputFiles
+		remote, err = syncOpts.newSyncer(func(ctx context.Context, dir string) error {
+			return validateSynced(ctx, self, dir, relPlaylist, relInputs, shadertoyMappings, *glslVersion)
+		})
+		if err != nil {
+			log.Fatalf("-sync: %v", err)
+		}
+		// Kiosks keep showing the files of the previous run when the
+		// source can not be reached at startup.
+		if _, err := remote.update(context.Background()); err != nil {
+			if !remote.hasRelease() {
+				log.Fatalf("-sync: %v", err)
+			}
+			log.Printf("Could not sync, using the previous files: %v", err)
+		}
+		inputFiles = resolvePaths(inputFiles, remote.current())
+		presenceFiles = resolvePaths(presenceFiles, remote.current())
+		if *playlistFile != "" {
+			*playlistFile = resolvePaths([]string{*playlistFile}, remote.current())[0]
+		}
+	}
+
+	var pl *playlist
+	if *playlistFile != "" {
+		if pl, err = loadPlaylist(*playlistFile); err != nil {
+			log.Fatalf("-playlist: %v", err)
+		}
+	}
+	clocks, resetOnLoad, err := newClocks(clockSpecs)
+	if err != nil {
+		log.Fatalf("-clock: %v", err)
+	}
+
+	listener, err := daemonListener(*socketPath)
+	if err != nil {
+		log.Fatalf("Could not listen on control socket: %v", err)
+	}
+	defer listener.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	engine, err := renderer.NewOnScreenEngine(openGLVersion)
+	if err != nil {
+		log.Fatalf("Could initialize engine: %v", err)
+	}
+	defer engine.Close()
+	engine.SetSeed(*seed)
+	engine.SetCanary(*canary)
+	engine.SetClocks(clocks)
+	pause := newPauser(engine.SetPaused)
+	if throttle != nil {
+		go throttle.Run(ctx, func(paused bool, interval time.Duration) {
+			pause.Set("throttle", paused)
+			engine.SetFrameInterval(interval)
+		})
+	}
+
+	d := &daemon{
+		engine:        engine,
+		mappings:      shadertoyMappings,
+		glslVersion:   *glslVersion,
+		clocks:        clocks,
+		resetOnLoad:   resetOnLoad,
+		presenceFiles: presenceFiles,
+		quit:          cancel,
+	}
+	if len(inputFiles) > 0 {
+		if err := d.load(inputFiles); err != nil {
+			log.Printf("Could not load %s: %v", strings.Join(inputFiles, ", "), err)
+		}
+	}
+	if presence != nil {
+		control, err := presenceOpts.newControl(pause, engine.FadeTo)
+		if err != nil {
+			log.Fatal(err)
+		}
+		go presence.Run(ctx, func(present bool) {
+			if err := d.setPresent(present); err != nil {
+				log.Printf("Could not switch shaders: %v", err)
+			}
+			control.Apply(present)
+		})
+	}
+	stopPlaylist := func() {}
+	startPlaylist := func(pl *playlist) {
+		plCtx, plCancel := context.WithCancel(ctx)
+		go runPlaylist(plCtx, pl, time.Now().UnixNano(), d.load)
+		stopPlaylist = plCancel
+	}
+	if pl != nil {
+		startPlaylist(pl)
+	}
+	if remote != nil {
+		go remote.run(ctx, *syncOpts.interval, func() {
+			if pl == nil {
+				if err := d.reload(); err != nil {
+					log.Printf("Could not reload synced shader: %v", err)
+				}
+				return
+			}
+			newPl, err := loadPlaylist(*playlistFile)
+			if err != nil {
+				log.Printf("Could not load synced playlist: %v", err)
+				return
+			}
+			stopPlaylist()
+			startPlaylist(newPl)
+		})
+	}
+
+	go func() {
+		sig := make(chan os.Signal, 1)
+		signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+		defer signal.Stop(sig)
+		select {
+		case <-sig:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	controls := signalControls{
+		screenshot:    engine.Screenshot,
+		screenshotDir: *screenshotDir,
+		pause:         pause,
+		reload:        d.reload,
+	}
+	go handleControlSignals(ctx, controls)
+	if snapshotSched != nil {
+		go runSnapshots(ctx, *snapshotSched, controls)
+	}
+	go supervisorOpts.supervise(ctx, cancel, engine.Health(), pause.Paused)
+	go d.serve(ctx, listener)
+	go suspendOpts.handleResume(ctx, engine.AdvanceTime, engine.Resume, d.reload)
+
+	if err := engine.Animate(ctx); errors.Is(err, renderer.ErrWindowClosed) || errors.Is(err, context.Canceled) {
+		return
+	} else if err != nil {
+		log.Fatal(err)
+	}
+}
+
+// defaultSocketPath returns the socket in the runtime directory of the user,
+// or in a directory of the user in the temporary directory if there is none.
+func defaultSocketPath() string {
+	if dir := os.Getenv("XDG_RUNTIME_DIR"); dir != "" {
+		return filepath.Join(dir, "shady.sock")
+	}
+	return filepath.Join(fallbackSocketDir(), "shady.sock")
+}
+
+func fallbackSocketDir() string {
+	return filepath.Join(os.TempDir(), fmt.Sprintf("shady-%d", os.Getuid()))
+}
+
+// checkSocketDir ensures that only the user can create the socket in dir, so
+// nobody else can pose as the daemon. The fallback directory is created if it
+// does not exist.
+func checkSocketDir(dir string) error {
+	if dir == fallbackSocketDir() {
+		if err := os.Mkdir(dir, 0700); err != nil && !os.IsExist(err) {
+			return err
+		}
+	}
+	info, err := os.Lstat(dir)
+	if err != nil {
+		return err
+	}
+	if !info.IsDir() {
+		return fmt.Errorf("%s is not a directory", dir)
+	}
+	if st, ok := info.Sys().(*syscall.Stat_t); ok && int(st.Uid) != os.Getuid() && st.Uid != 0 {
+		return fmt.Errorf("%s belongs to another user", dir)
+	}
+	return nil
+}
+
+// daemonListener returns the socket passed by systemd if the process was
+// started through socket activation, or creates a new Unix socket otherwise.
+func daemonListener(socketPath string) (net.Listener, error) {
+	if pid, _ := strconv.Atoi(os.Getenv("LISTEN_PID")); pid == os.Getpid() {
+		n, _ := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+		if n < 1 {
+			return nil, fmt.Errorf("socket activation without any file descriptors")
+		}
+		os.Unsetenv("LISTEN_PID")
+		os.Unsetenv("LISTEN_FDS")
+		os.Unsetenv("LISTEN_FDNAMES")
+		f := os.NewFile(listenFDsStart, "systemd-socket")
+		defer f.Close()
+		return net.FileListener(f)
+	}
+
+	if err := checkSocketDir(filepath.Dir(socketPath)); err != nil {
+		return nil, err
+	}
+	// Remove stale sockets from previous runs.
+	if info, err := os.Lstat(socketPath); err == nil && info.Mode()&os.ModeSocket != 0 {
+		os.Remove(socketPath)
+	}
+	ln, err := net.Listen("unix", socketPath)
+	if err != nil {
+		return nil, err
+	}
+	// Commands can load any file the daemon can read, so only the user may
+	// connect.
+	if err := os.Chmod(socketPath, 0600); err != nil {
+		ln.Close()
+		return nil, err
+	}
+	return ln, nil
+}
+
+type daemon struct {
+	engine      *renderer.OnScreenEngine
+	mappings    []string
+	glslVersion string
+	clocks      *renderer.Clocks
+	// resetOnLoad are the names of the clocks that are reset when a shader
+	// is loaded.
+	resetOnLoad []string
+	// presenceFiles is the shader that is shown instead of the loaded one
+	// while someone is present.
+	presenceFiles []string
+	quit          func()
+
+	lock       sync.Mutex
+	inputFiles []string
+	// selected is the shader that was loaded last, which is shown while
+	// nobody is present.
+	selected []string
+	present  bool
+}
+
+// load shows the shader, or remembers it to be shown after the shader of
+// -presence-shader while someone is present.
+func (d *daemon) load(inputFiles []string) error {
+	d.lock.Lock()
+	d.selected = inputFiles
+	deferred := d.present && len(d.presenceFiles) > 0
+	d.lock.Unlock()
+	if deferred {
+		return nil
+	}
+	return d.show(inputFiles)
+}
+
+// setPresent switches between the shader of -presence-shader and the loaded
+// shader.
+func (d *daemon) setPresent(present bool) error {
+	d.lock.Lock()
+	changed := present != d.present
+	d.present = present
+	selected := d.selected
+	d.lock.Unlock()
+	if !changed || len(d.presenceFiles) == 0 {
+		return nil
+	}
+	if present {
+		return d.show(d.presenceFiles)
+	}
+	if len(selected) == 0 {
+		return nil
+	}
+	return d.show(selected)
+}
+
+func (d *daemon) show(inputFiles []string) error {
+	if err := d.setEnvironment(inputFiles); err != nil {
+		return err
+	}
+	// Clocks of the scene start over for every loaded shader, but not when
+	// the same shader is reloaded.
+	for _, name := range d.resetOnLoad {
+		d.clocks.Set(name, 0)
+	}
+	return nil
+}
+
+func (d *daemon) setEnvironment(inputFiles []string) error {
+	d.lock.Lock()
+	env, _, err := environmentLoader(inputFiles, d.mappings, d.glslVersion, nil)()
+	if err != nil {
+		d.lock.Unlock()
+		return err
+	}
+	d.inputFiles = inputFiles
+	d.lock.Unlock()
+	// Passing the environment blocks until the render loop takes it, which
+	// must not hold up other commands.
+	d.engine.SetEnvironment(env)
+	return nil
+}
+
+func (d *daemon) reload() error {
+	d.lock.Lock()
+	inputFiles := d.inputFiles
+	d.lock.Unlock()
+	if len(inputFiles) == 0 {
+		return fmt.Errorf("no shader loaded")
+	}
+	return d.setEnvironment(inputFiles)
+}
+
+func (d *daemon) serve(ctx context.Context, listener net.Listener) {
+	go func() {
+		<-ctx.Done()
+		listener.Close()
+	}()
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if ctx.Err() == nil {
+				log.Printf("Error accepting control connection: %v", err)
+			}
+			return
+		}
+		go d.handle(conn)
+	}
+}
+
+// handle executes newline separated commands read from a connection. Every
+// command is answered with a line starting with either "ok" or "error".
+//
+// Supported commands are:
+//
+//	load <file> [<file>...]  (relative to the working directory of the daemon)
+//	reload
+//	status
+//	clocks
+//	clock <name> [set <seconds>|reset|pause|resume|rate <factor>]
+//	passes
+//	pass <name> on|off
+//	solo [<name>]
+//	quit
+func (d *daemon) handle(conn net.Conn) {
+	defer conn.Close()
+	scanner := bufio.NewScanner(conn)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 {
+			continue
+		}
+		var err error
+		reply := "ok"
+		switch fields[0] {
+		case "load":
+			if len(fields) < 2 {
+				err = fmt.Errorf("usage: load <file> [<file>...]")
+				break
+			}
+			err = d.load(fields[1:])
+		case "reload":
+			err = d.reload()
+		case "status":
+			d.lock.Lock()
+			reply = fmt.Sprintf("ok %s", strings.Join(d.inputFiles, " "))
+			d.lock.Unlock()
+		case "clocks":
+			reply = strings.TrimSpace("ok " + listClocks(d.clocks))
+		case "clock":
+			var value string
+			if value, err = clockCommand(d.clocks, fields[1:]); value != "" {
+				reply = "ok " + value
+			}
+		case "passes":
+			reply = strings.TrimSpace("ok " + listPasses(d.engine))
+		case "pass":
+			err = passCommand(d.engine, fields[1:])
+		case "solo":
+			if len(fields) > 2 {
+				err = fmt.Errorf("usage: solo [<name>]")
+				break
+			}
+			err = d.engine.SetSoloPass(strings.Join(fields[1:], ""))
+		case "quit":
+			fmt.Fprintln(conn, reply)
+			d.quit()
+			return
+		default:
+			err = fmt.Errorf("unknown command %q", fields[0])
+		}
+		if err != nil {
+			reply = "error " + strings.ReplaceAll(err.Error(), "\n", " ")
+		}
+		if _, err := fmt.Fprintln(conn, reply); err != nil {
+			return
+		}
+	}
+}
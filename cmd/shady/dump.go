@@ -0,0 +1,106 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/polyfloyd/shady/encode"
+	"github.com/polyfloyd/shady/renderer"
+	"github.com/polyfloyd/shady/sink"
+)
+
+// finalPassName is the name of the final image in files written by
+// -dump-passes, which is what Shadertoy calls it.
+const finalPassName = "image"
+
+// passDump writes the output of every pass and the final image as separate
+// images named after the pass, for debugging shaders with multiple passes.
+type passDump struct {
+	pattern  string
+	vars     outputVars
+	interval time.Duration
+	format   encode.Format
+	limit    uint64
+}
+
+// newPassDump creates a dump for the specified number of frames, if limit is
+// 0, all frames are dumped. The pattern must contain {pass}.
+func newPassDump(pattern string, vars outputVars, interval time.Duration, limit uint) (*passDump, error) {
+	if !hasTemplateVar(pattern, "pass") {
+		return nil, fmt.Errorf("%q does not contain {pass}", pattern)
+	}
+	if err := validateTemplate(pattern); err != nil {
+		return nil, err
+	}
+	format, ok := encode.DetectFormat(pattern)
+	if !ok {
+		return nil, fmt.Errorf("could not detect the image format of %q", pattern)
+	}
+	if limit != 1 && !isSequencePattern(pattern) {
+		return nil, fmt.Errorf("dumping multiple frames to %q requires a sequence pattern, e.g. {frame:04d}-{pass}.png", pattern)
+	}
+	return &passDump{pattern: pattern, vars: vars, interval: interval, format: format, limit: uint64(limit)}, nil
+}
+
+// WritePass writes the raw contents of a pass. Unless the format stores more
+// than 8 bits per channel, the image is made opaque so the colors of passes
+// that keep other data in the alpha channel are visible.
+func (d *passDump) WritePass(name string, data renderer.PixelData) error {
+	frame := &encode.FloatFrame{
+		Rect: image.Rect(0, 0, int(data.Width), int(data.Height)),
+		Pix:  make([]float32, len(data.Pix)),
+	}
+	copy(frame.Pix, data.Pix)
+	if _, ok := d.format.(encode.PrecisionFormat); !ok {
+		for i := 3; i < len(frame.Pix); i += 4 {
+			frame.Pix[i] = 1
+		}
+	}
+	return d.write(name, data.Frame, frame)
+}
+
+func (d *passDump) write(pass string, frame uint64, img image.Image) error {
+	if d.limit != 0 && frame >= d.limit {
+		return nil
+	}
+	vars := d.vars
+	vars.pass = pass
+	filename, err := sequenceNamer(d.pattern, vars, d.interval)(frame)
+	if err != nil {
+		return err
+	}
+	var buf bytes.Buffer
+	if err := d.format.Encode(&buf, img); err != nil {
+		return err
+	}
+	if sink.IsRemote(filename) {
+		return sink.Put(filename, buf.Bytes())
+	}
+	if err := os.MkdirAll(filepath.Dir(filename), 0o755); err != nil {
+		return err
+	}
+	return os.WriteFile(filename, buf.Bytes(), 0o644)
+}
+
+// stream writes the frames of the stream as the final image before passing
+// them on. Frames are numbered starting at 0, like those of the passes.
+func (d *passDump) stream(in <-chan image.Image) <-chan image.Image {
+	out := make(chan image.Image)
+	go func() {
+		defer close(out)
+		frame := uint64(0)
+		for img := range in {
+			if err := d.write(finalPassName, frame, img); err != nil {
+				log.Fatalf("Could not dump the final image: %v", err)
+			}
+			frame++
+			out <- img
+		}
+	}()
+	return out
+}
@@ -0,0 +1,265 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"image"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"log"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/polyfloyd/shady/renderer"
+)
+
+// loadReport is the result of loading a shader as written by -error-json, one
+// JSON object per line.
+type loadReport struct {
+	Time        time.Time          `json:"time"`
+	OK          bool               `json:"ok"`
+	Diagnostics []reportDiagnostic `json:"diagnostics"`
+}
+
+type reportDiagnostic struct {
+	// File is the absolute path of the source, it is omitted for errors that
+	// are not about a line of a file.
+	File     string `json:"file,omitempty"`
+	Line     int    `json:"line,omitempty"`
+	Severity string `json:"severity"`
+	Message  string `json:"message"`
+}
+
+func newLoadReport(err error) loadReport {
+	report := loadReport{Time: time.Now(), OK: err == nil, Diagnostics: []reportDiagnostic{}}
+	if err == nil {
+		return report
+	}
+	var cerr renderer.CompileError
+	if errors.As(err, &cerr) {
+		for _, d := range cerr.Diagnostics() {
+			severity, message := "error", d.Message
+			if s := strings.SplitN(message, ": ", 2); len(s) == 2 && (s[0] == "error" || s[0] == "warning") {
+				severity, message = s[0], s[1]
+			}
+			report.Diagnostics = append(report.Diagnostics, reportDiagnostic{
+				File:     d.File,
+				Line:     d.Line,
+				Severity: severity,
+				Message:  message,
+			})
+		}
+	}
+	if len(report.Diagnostics) == 0 {
+		report.Diagnostics = append(report.Diagnostics, reportDiagnostic{Severity: "error", Message: err.Error()})
+	}
+	return report
+}
+
+// errorFeed reports the result of every load of the shader so editors can
+// show the errors next to the code.
+type errorFeed struct {
+	lock sync.Mutex
+	w    io.Writer
+	last *loadReport
+}
+
+// Report records the result of loading the shader, err is nil if it was
+// loaded successfully.
+func (f *errorFeed) Report(err error) {
+	report := newLoadReport(err)
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.last = &report
+	if f.w == nil {
+		return
+	}
+	if err := json.NewEncoder(f.w).Encode(report); err != nil {
+		log.Printf("Could not write -error-json: %v", err)
+	}
+}
+
+// Last returns the most recent report, or nil if the shader was not loaded
+// yet.
+func (f *errorFeed) Last() *loadReport {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return f.last
+}
+
+// wrapLoader reports the errors of loading the sources of an environment,
+// like missing includes, which happen before the renderer gets to compile it.
+func (f *errorFeed) wrapLoader(newFn func() (renderer.Environment, []string, error)) func() (renderer.Environment, []string, error) {
+	return func() (renderer.Environment, []string, error) {
+		env, files, err := newFn()
+		if err != nil {
+			f.Report(err)
+		}
+		return env, files, err
+	}
+}
+
+// previewRate is the default number of frames per second of the preview
+// stream.
+const previewRate = 15
+
+// sharedJPEG encodes frames for all clients of the preview stream at once, so
+// watching with more clients does not encode every frame more often.
+type sharedJPEG struct {
+	screenshot func(context.Context) (image.Image, error)
+
+	lock sync.Mutex
+	data []byte
+	at   time.Time
+}
+
+// get returns the current frame as JPEG. It is only encoded again if the
+// previous encoding is older than maxAge.
+func (s *sharedJPEG) get(ctx context.Context, maxAge time.Duration) ([]byte, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.data != nil && time.Since(s.at) < maxAge {
+		return s.data, nil
+	}
+	img, err := s.screenshot(ctx)
+	if err != nil || img == nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, img, &jpeg.Options{Quality: 85}); err != nil {
+		return nil, err
+	}
+	s.data, s.at = buf.Bytes(), time.Now()
+	return s.data, nil
+}
+
+// servePreview serves a live preview of the rendering and the errors of the
+// shader until the context is canceled:
+//
+//	/             a page that shows the stream and the errors
+//	/stream.mjpeg the frames as a Motion JPEG stream, the rate can be set with
+//	              ?fps=N
+//	/frame.png    the current frame
+//	/errors       the result of the last load of the shader as JSON, like the
+//	              lines of -error-json
+func servePreview(ctx context.Context, addr string, screenshot func(context.Context) (image.Image, error), feed *errorFeed) {
+	frames := &sharedJPEG{screenshot: screenshot}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		io.WriteString(w, previewPage)
+	})
+	mux.HandleFunc("/frame.png", func(w http.ResponseWriter, r *http.Request) {
+		img, err := screenshot(r.Context())
+		if err != nil || img == nil {
+			http.Error(w, "no frame has been rendered yet", http.StatusServiceUnavailable)
+			return
+		}
+		w.Header().Set("Content-Type", "image/png")
+		w.Header().Set("Cache-Control", "no-store")
+		png.Encode(w, img)
+	})
+	mux.HandleFunc("/stream.mjpeg", func(w http.ResponseWriter, r *http.Request) {
+		rate := previewRate
+		if s := r.URL.Query().Get("fps"); s != "" {
+			n, err := strconv.Atoi(s)
+			if err != nil || n <= 0 {
+				http.Error(w, "invalid fps", http.StatusBadRequest)
+				return
+			}
+			rate = n
+		}
+		mw := multipart.NewWriter(w)
+		w.Header().Set("Content-Type", "multipart/x-mixed-replace; boundary="+mw.Boundary())
+		w.Header().Set("Cache-Control", "no-store")
+		interval := time.Second / time.Duration(rate)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-r.Context().Done():
+				return
+			case <-ticker.C:
+			}
+			// Clients at the same rate share the frames that are encoded
+			// for the first of them.
+			data, err := frames.get(r.Context(), interval/2)
+			if err != nil || data == nil {
+				continue
+			}
+			part, err := mw.CreatePart(textproto.MIMEHeader{"Content-Type": {"image/jpeg"}})
+			if err != nil {
+				return
+			}
+			if _, err := part.Write(data); err != nil {
+				return
+			}
+			if f, ok := w.(http.Flusher); ok {
+				f.Flush()
+			}
+		}
+	})
+	mux.HandleFunc("/errors", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "no-store")
+		report := feed.Last()
+		if report == nil {
+			fmt.Fprintln(w, "null")
+			return
+		}
+		json.NewEncoder(w).Encode(report)
+	})
+
+	server := &http.Server{Addr: addr, Handler: mux}
+	go func() {
+		<-ctx.Done()
+		server.Close()
+	}()
+	if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		log.Fatalf("Could not serve preview: %v", err)
+	}
+}
+
+const previewPage = `<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>Shady</title>
+<style>
+body { margin: 0; background: #000; color: #eee; font-family: monospace; }
+img { display: block; width: 100%; height: 100vh; object-fit: contain; }
+#errors { position: fixed; left: 0; right: 0; bottom: 0; margin: 0; padding: 0.5em; background: rgba(128, 0, 0, 0.85); white-space: pre-wrap; }
+#errors:empty { display: none; }
+</style>
+</head>
+<body>
+<img src="stream.mjpeg" alt="">
+<pre id="errors"></pre>
+<script>
+async function poll() {
+	try {
+		const report = await (await fetch("errors")).json();
+		document.getElementById("errors").textContent = report && !report.ok
+			? report.diagnostics.map(d => (d.file ? d.file + ":" + d.line + ": " : "") + d.severity + ": " + d.message).join("\n")
+			: "";
+	} catch (e) {}
+	setTimeout(poll, 500);
+}
+poll();
+</script>
+</body>
+</html>
+`
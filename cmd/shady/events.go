@@ -0,0 +1,58 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"log"
+	"time"
+
+	"github.com/polyfloyd/shady/renderer"
+)
+
+// shaderEvent is an event that a shader signaled with -events, written as one
+// JSON object per line.
+type shaderEvent struct {
+	Time   time.Time  `json:"time"`
+	Frame  uint64     `json:"frame"`
+	Buffer string     `json:"buffer"`
+	Value  [4]float32 `json:"value"`
+}
+
+// eventEmitter turns the first pixel of a buffer into events, so shaders can
+// signal things like beats or scene changes to other programs. An event is
+// written every time the pixel changes to a value other than zero, so a shader
+// can mark a beat by writing a non-zero value for a single frame, or hold the
+// number of the current scene.
+type eventEmitter struct {
+	buffer string
+	w      io.Writer
+
+	last   [4]float32
+	failed bool
+}
+
+// update is called with the contents of the buffer each time it has been
+// rendered.
+func (e *eventEmitter) update(data renderer.PixelData) {
+	if len(data.Pix) < 4 {
+		return
+	}
+	var value [4]float32
+	copy(value[:], data.Pix)
+	if value == e.last {
+		return
+	}
+	e.last = value
+	if value == ([4]float32{}) {
+		return
+	}
+	event := shaderEvent{Time: time.Now(), Frame: data.Frame, Buffer: e.buffer, Value: value}
+	if err := json.NewEncoder(e.w).Encode(event); err != nil {
+		if !e.failed {
+			log.Printf("Could not write the events of %s: %v", e.buffer, err)
+		}
+		e.failed = true
+	} else {
+		e.failed = false
+	}
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/polyfloyd/shady/encode"
+	"github.com/polyfloyd/shady/renderer"
+	"github.com/polyfloyd/shady/sink"
+)
+
+// parseExportTarget parses the value of -export, which is the name of a buffer
+// mapping and a filename separated by a '='.
+func parseExportTarget(s string) (name, filename string, err error) {
+	i := strings.IndexByte(s, '=')
+	if i <= 0 || i == len(s)-1 {
+		return "", "", fmt.Errorf("invalid export %q, expected <buffer name>=<file>", s)
+	}
+	return s[:i], s[i+1:], nil
+}
+
+// bufferExport writes the raw contents of a buffer pass for every frame.
+//
+// Files ending in .npy are written as NumPy arrays with a shape of (height,
+// width, 4), other files receive the values without any header. If the
+// filename is a sequence pattern, a file is written for every frame, otherwise
+// all frames are concatenated into a single stream.
+type bufferExport struct {
+	dtype encode.DataType
+	npy   bool
+	limit uint64
+	name  func(frame uint64) (string, error)
+	w     io.WriteCloser
+}
+
+// newBufferExport creates an export for the specified number of frames, if
+// limit is 0, all frames are exported.
+func newBufferExport(pattern string, dtype encode.DataType, vars outputVars, interval time.Duration, limit uint) (*bufferExport, error) {
+	if err := validateTemplate(pattern); err != nil {
+		return nil, err
+	}
+	e := &bufferExport{
+		dtype: dtype,
+		npy:   strings.EqualFold(filepath.Ext(pattern), ".npy"),
+		limit: uint64(limit),
+	}
+	if isSequencePattern(pattern) {
+		e.name = sequenceNamer(pattern, vars, interval)
+		return e, nil
+	}
+	if e.npy && limit != 1 {
+		return nil, fmt.Errorf("exporting multiple frames to %q requires a sequence pattern, e.g. state-{frame:04d}.npy", pattern)
+	}
+	v := vars
+	v.date = time.Now()
+	filename, err := expandTemplate(pattern, v)
+	if err != nil {
+		return nil, err
+	}
+	if e.w, err = openWriter(filename); err != nil {
+		return nil, err
+	}
+	return e, nil
+}
+
+func (e *bufferExport) encode(w io.Writer, data renderer.PixelData) error {
+	if e.npy {
+		return encode.EncodeNPY(w, data.Pix, e.dtype, int(data.Height), int(data.Width), 4)
+	}
+	return encode.EncodeRawData(w, data.Pix, e.dtype)
+}
+
+// Write exports a single frame.
+func (e *bufferExport) Write(data renderer.PixelData) error {
+	if e.limit != 0 && data.Frame >= e.limit {
+		return nil
+	}
+	if e.w != nil {
+		return e.encode(e.w, data)
+	}
+	filename, err := e.name(data.Frame)
+	if err != nil {
+		return err
+	}
+	var buf bytes.Buffer
+	if err := e.encode(&buf, data); err != nil {
+		return err
+	}
+	if sink.IsRemote(filename) {
+		return sink.Put(filename, buf.Bytes())
+	}
+	if err := os.MkdirAll(filepath.Dir(filename), 0o755); err != nil {
+		return err
+	}
+	return os.WriteFile(filename, buf.Bytes(), 0o644)
+}
+
+func (e *bufferExport) Close() error {
+	if e.w != nil {
+		return e.w.Close()
+	}
+	return nil
+}
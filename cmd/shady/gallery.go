@@ -0,0 +1,249 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"flag"
+	"fmt"
+	"html/template"
+	"io"
+	"log"
+	"math"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	mainImageRe = regexp.MustCompile(`\bmainImage\s*\(`)
+	// shaderRefRe matches the files that a shader renders as part of itself,
+	// which are not shown on their own.
+	shaderRefRe = regexp.MustCompile(`#pragma\s+(?:use|buffer)\s+"([^"]+)"|=buffer:([^;\s]+)`)
+)
+
+// galleryItem is a shader of the gallery.
+type galleryItem struct {
+	// Name is the path of the shader relative to the directory.
+	Name  string
+	Thumb string
+	Loop  string
+	// Error is the last line of the output of a failed render.
+	Error string
+}
+
+// runGallery renders a thumbnail and a looping preview of every shader in a
+// directory to a static site.
+func runGallery(args []string) {
+	fs := flag.NewFlagSet("gallery", flag.ExitOnError)
+	outDir := fs.String("o", "gallery", "The directory to write the site to")
+	geometry := fs.String("g", "320x180", "The geometry of the thumbnails and previews")
+	framerate := fs.Float64("f", 15, "The number of frames per second of the previews")
+	duration := fs.Float64("d", 3, "The duration of the previews in seconds")
+	thumbTime := fs.Float64("thumb-time", 1, "The time in seconds of the frame that is used as thumbnail")
+	timeout := fs.Duration("timeout", time.Minute, "The maximum time to render a single thumbnail or preview")
+	ci := fs.Bool("ci", false, "Render with -ci, for machines without a GPU or display")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: shady gallery <directory> [flags]\n\nFlags:\n")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() < 1 {
+		fs.Usage()
+		os.Exit(2)
+	}
+	dir := fs.Arg(0)
+	// Flags may also follow the directory, like shady gallery shaders/ -o site/.
+	fs.Parse(fs.Args()[1:])
+	if fs.NArg() > 0 {
+		fs.Usage()
+		os.Exit(2)
+	}
+	if *framerate <= 0 || *duration <= 0 {
+		log.Fatalf("-f and -d must be positive")
+	}
+
+	shaders, err := galleryShaders(dir)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if len(shaders) == 0 {
+		log.Fatalf("No shaders with a mainImage function found in %s", dir)
+	}
+	self, err := os.Executable()
+	if err != nil {
+		log.Fatal(err)
+	}
+	for _, sub := range []string{"thumbs", "loops"} {
+		if err := os.MkdirAll(filepath.Join(*outDir, sub), 0o755); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	renderArgs := func(input string, args ...string) []string {
+		common := []string{"-i", input, "-g", *geometry, "-f", strconv.FormatFloat(*framerate, 'f', -1, 64)}
+		if *ci {
+			common = append(common, "-ci")
+		}
+		return append(common, args...)
+	}
+	thumbFrame := strconv.Itoa(int(math.Round(*thumbTime * *framerate)))
+	items := make([]galleryItem, 0, len(shaders))
+	for i, name := range shaders {
+		log.Printf("Rendering %s (%d/%d)", name, i+1, len(shaders))
+		slug := gallerySlug(name)
+		item := galleryItem{
+			Name:  name,
+			Thumb: "thumbs/" + slug + ".png",
+			Loop:  "loops/" + slug + ".gif",
+		}
+		input := filepath.Join(dir, name)
+		renders := [][]string{
+			renderArgs(input, "-start", thumbFrame, "-n", "1", "-o", filepath.Join(*outDir, filepath.FromSlash(item.Thumb))),
+			renderArgs(input, "-d", strconv.FormatFloat(*duration, 'f', -1, 64), "-o", filepath.Join(*outDir, filepath.FromSlash(item.Loop))),
+		}
+		for _, args := range renders {
+			if output, err := renderGalleryItem(self, args, *timeout); err != nil {
+				item.Error = lastLine(output, err)
+				log.Printf("Could not render %s: %s", name, item.Error)
+				break
+			}
+		}
+		items = append(items, item)
+	}
+
+	f, err := os.Create(filepath.Join(*outDir, "index.html"))
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := writeGalleryIndex(f, filepath.Base(filepath.Clean(dir)), items); err != nil {
+		f.Close()
+		log.Fatal(err)
+	}
+	if err := f.Close(); err != nil {
+		log.Fatal(err)
+	}
+	log.Printf("Wrote the gallery of %d shaders to %s", len(items), filepath.Join(*outDir, "index.html"))
+}
+
+// galleryShaders returns the paths relative to dir of the shaders that define
+// mainImage. Shaders that are used by others, like buffers, are left out.
+func galleryShaders(dir string) ([]string, error) {
+	var candidates []string
+	used := map[string]bool{}
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() || filepath.Ext(path) != ".glsl" {
+			return err
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		for _, m := range shaderRefRe.FindAllStringSubmatch(string(data), -1) {
+			ref := m[1] + m[2]
+			used[filepath.Clean(filepath.Join(filepath.Dir(path), ref))] = true
+		}
+		if mainImageRe.Match(data) {
+			candidates = append(candidates, path)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	var shaders []string
+	for _, path := range candidates {
+		if used[filepath.Clean(path)] {
+			continue
+		}
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return nil, err
+		}
+		shaders = append(shaders, filepath.ToSlash(rel))
+	}
+	sort.Strings(shaders)
+	return shaders, nil
+}
+
+// gallerySlug returns the name of the files of a shader in the site.
+func gallerySlug(name string) string {
+	return strings.ReplaceAll(strings.TrimSuffix(name, filepath.Ext(name)), "/", "-")
+}
+
+// renderGalleryItem renders in a separate process, so a shader that crashes
+// the driver does not stop the gallery.
+func renderGalleryItem(self string, args []string, timeout time.Duration) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	var output bytes.Buffer
+	cmd := exec.CommandContext(ctx, self, args...)
+	cmd.Stdout = &output
+	cmd.Stderr = &output
+	err := cmd.Run()
+	if ctx.Err() != nil {
+		err = fmt.Errorf("timed out after %v", timeout)
+	}
+	return output.Bytes(), err
+}
+
+// lastLine returns the last line of the output of a failed render, which is
+// usually the error.
+func lastLine(output []byte, err error) string {
+	lines := strings.Split(strings.TrimSpace(string(output)), "\n")
+	if line := strings.TrimSpace(lines[len(lines)-1]); line != "" {
+		return line
+	}
+	return err.Error()
+}
+
+func writeGalleryIndex(w io.Writer, title string, items []galleryItem) error {
+	return galleryTemplate.Execute(w, struct {
+		Title string
+		Items []galleryItem
+	}{title, items})
+}
+
+var galleryTemplate = template.Must(template.New("gallery").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>{{.Title}}</title>
+<style>
+body { margin: 1em; background: #111; color: #eee; font-family: sans-serif; }
+main { display: grid; grid-template-columns: repeat(auto-fill, minmax(320px, 1fr)); gap: 1em; }
+figure { margin: 0; }
+img { display: block; width: 100%; background: #000; }
+figcaption { padding: 0.25em 0; font-family: monospace; }
+.error { color: #f66; font-family: monospace; white-space: pre-wrap; }
+</style>
+</head>
+<body>
+<h1>{{.Title}}</h1>
+<main>
+{{- range .Items}}
+<figure>
+{{- if .Error}}
+<div class="error">{{.Error}}</div>
+{{- else}}
+<img src="{{.Thumb}}" data-loop="{{.Loop}}" alt="{{.Name}}" loading="lazy">
+{{- end}}
+<figcaption>{{.Name}}</figcaption>
+</figure>
+{{- end}}
+</main>
+<script>
+// The previews play while the mouse is over a thumbnail.
+for (const img of document.querySelectorAll("img[data-loop]")) {
+	const thumb = img.src;
+	img.addEventListener("mouseenter", () => { img.src = img.dataset.loop; });
+	img.addEventListener("mouseleave", () => { img.src = thumb; });
+}
+</script>
+</body>
+</html>
+`))
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/polyfloyd/shady/encode"
+)
+
+// geometryPresets map names of common resolutions to their height. The width
+// is derived from the aspect ratio.
+var geometryPresets = map[string]uint{
+	"360p":  360,
+	"480p":  480,
+	"720p":  720,
+	"1080p": 1080,
+	"1440p": 1440,
+	"2160p": 2160,
+	"4k":    2160,
+	"8k":    4320,
+}
+
+var geometryRe = regexp.MustCompile(`^(\d+|\?)x(\d+|\?)$`)
+
+// parseAspect parses an aspect ratio as either W:H or a decimal number.
+func parseAspect(s string) (float64, error) {
+	var aspect float64
+	if i := strings.IndexByte(s, ':'); i >= 0 {
+		w, err1 := strconv.ParseFloat(s[:i], 64)
+		h, err2 := strconv.ParseFloat(s[i+1:], 64)
+		if err1 != nil || err2 != nil || h == 0 {
+			return 0, fmt.Errorf("invalid aspect ratio: %q", s)
+		}
+		aspect = w / h
+	} else {
+		var err error
+		if aspect, err = strconv.ParseFloat(s, 64); err != nil {
+			return 0, fmt.Errorf("invalid aspect ratio: %q", s)
+		}
+	}
+	if aspect <= 0 || math.IsInf(aspect, 0) || math.IsNaN(aspect) {
+		return 0, fmt.Errorf("invalid aspect ratio: %q", s)
+	}
+	return aspect, nil
+}
+
+// geometryFromEnv returns the geometry set by SHADY_GEOMETRY, or by
+// LEDCAT_GEOMETRY if the former is not set.
+func geometryFromEnv() (string, error) {
+	for _, name := range []string{"SHADY_GEOMETRY", "LEDCAT_GEOMETRY"} {
+		if geom := os.Getenv(name); geom != "" {
+			return geom, nil
+		}
+	}
+	return "", fmt.Errorf("SHADY_GEOMETRY and LEDCAT_GEOMETRY are empty while instructed to load the display geometry from the environment")
+}
+
+// parseGeometry parses a geometry in WIDTHxHEIGHT format. Either dimension may
+// be "?" to derive it from the aspect ratio. Presets like "1080p" and "4k" are
+// also accepted. If geom is "env", the geometry is read from the environment.
+func parseGeometry(geom string, aspect float64) (uint, uint, error) {
+	if geom == "env" {
+		var err error
+		if geom, err = geometryFromEnv(); err != nil {
+			return 0, 0, err
+		}
+	}
+
+	if h, ok := geometryPresets[strings.ToLower(geom)]; ok {
+		return deriveDimension(float64(h) * aspect), h, nil
+	}
+
+	matches := geometryRe.FindStringSubmatch(geom)
+	if matches == nil {
+		return 0, 0, fmt.Errorf("invalid geometry: %q", geom)
+	}
+	if matches[1] == "?" && matches[2] == "?" {
+		return 0, 0, fmt.Errorf("only one geometry dimension can be derived, got %q", geom)
+	}
+	w, _ := strconv.ParseUint(matches[1], 10, 32)
+	h, _ := strconv.ParseUint(matches[2], 10, 32)
+	if matches[1] == "?" {
+		w = uint64(deriveDimension(float64(h) * aspect))
+	} else if matches[2] == "?" {
+		h = uint64(deriveDimension(float64(w) / aspect))
+	}
+	if w == 0 || h == 0 {
+		return 0, 0, fmt.Errorf("no geometry dimension can be 0, got (%d, %d)", w, h)
+	}
+	return uint(w), uint(h), nil
+}
+
+// deriveDimension rounds a dimension computed from the aspect ratio to an even
+// number, which most video codecs require.
+func deriveDimension(v float64) uint {
+	d := uint(math.Round(v/2) * 2)
+	if d == 0 {
+		d = 2
+	}
+	return d
+}
+
+// checkLEDGeometry returns an error if raw pixels are written to stdout with a
+// geometry that differs from LEDCAT_GEOMETRY. Ledcat reads the same variable,
+// so it would interpret the frames with the wrong dimensions.
+func checkLEDGeometry(format encode.Format, outputFile string, width, height uint) error {
+	switch format.(type) {
+	case encode.RGB24Format, encode.RGBA32Format:
+	default:
+		return nil
+	}
+	ledGeom := os.Getenv("LEDCAT_GEOMETRY")
+	if outputFile != "-" || ledGeom == "" {
+		return nil
+	}
+	w, h, err := parseGeometry(ledGeom, 1)
+	if err != nil {
+		return fmt.Errorf("LEDCAT_GEOMETRY: %v", err)
+	}
+	if w != width || h != height {
+		return fmt.Errorf("the geometry %dx%d does not match LEDCAT_GEOMETRY=%s used by ledcat, use -g env or unset LEDCAT_GEOMETRY", width, height, ledGeom)
+	}
+	return nil
+}
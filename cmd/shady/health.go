@@ -0,0 +1,91 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/polyfloyd/shady/renderer"
+)
+
+type supervisorFlags struct {
+	maxConsecutiveErrors *int
+	exitAfter            *time.Duration
+	healthAddr           *string
+	healthTimeout        *time.Duration
+}
+
+func registerSupervisorFlags(fs *flag.FlagSet) supervisorFlags {
+	return supervisorFlags{
+		maxConsecutiveErrors: fs.Int("max-consecutive-errors", 0, "Exit with a non-zero status after this many errors without rendering a frame in between. Disabled if 0"),
+		exitAfter:            fs.Duration("exit-after", 0, "Exit after running for the specified duration, e.g. 24h. Disabled if 0"),
+		healthAddr:           fs.String("health-addr", "", "Serve a /healthz endpoint on the specified address, e.g. localhost:8080"),
+		healthTimeout:        fs.Duration("health-timeout", 30*time.Second, "Report as unhealthy if no frame was rendered for this long while not paused"),
+	}
+}
+
+// supervise enforces the exit conditions and serves the health endpoint until
+// the context is canceled. Exit conditions that indicate success cancel the
+// context, failures exit the process.
+func (f supervisorFlags) supervise(ctx context.Context, cancel func(), health *renderer.Health, paused func() bool) {
+	started := time.Now()
+	if *f.healthAddr != "" {
+		mux := http.NewServeMux()
+		mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+			if err := f.checkHealth(health.Status(), started, paused()); err != nil {
+				http.Error(w, err.Error(), http.StatusServiceUnavailable)
+				return
+			}
+			fmt.Fprintln(w, "ok")
+		})
+		server := &http.Server{Addr: *f.healthAddr, Handler: mux}
+		go func() {
+			<-ctx.Done()
+			server.Close()
+		}()
+		go func() {
+			if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+				log.Fatalf("Could not serve health endpoint: %v", err)
+			}
+		}()
+	}
+
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+		status := health.Status()
+		if max := *f.maxConsecutiveErrors; max > 0 && status.ConsecutiveErrors >= max {
+			log.Fatalf("Exiting after %d consecutive errors, the last one was: %v", status.ConsecutiveErrors, status.LastError)
+		}
+		if *f.exitAfter > 0 && time.Since(started) >= *f.exitAfter {
+			log.Printf("Exiting after running for %v", *f.exitAfter)
+			cancel()
+			return
+		}
+	}
+}
+
+func (f supervisorFlags) checkHealth(status renderer.HealthStatus, started time.Time, paused bool) error {
+	if status.LastError != nil {
+		return fmt.Errorf("error: %v", status.LastError)
+	}
+	if paused {
+		return nil
+	}
+	lastFrame := status.LastFrame
+	if lastFrame.IsZero() {
+		lastFrame = started
+	}
+	if since := time.Since(lastFrame); since > *f.healthTimeout {
+		return fmt.Errorf("no frame rendered in %v", since.Round(time.Second))
+	}
+	return nil
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/polyfloyd/shady/shadertoy/importer"
+)
+
+// shadertoyKeyEnv is the environment variable that holds the Shadertoy API
+// key.
+const shadertoyKeyEnv = "SHADERTOY_API_KEY"
+
+// runImport fetches a shader from Shadertoy and writes it to a directory.
+func runImport(args []string) {
+	fs := flag.NewFlagSet("import", flag.ExitOnError)
+	key := fs.String("key", os.Getenv(shadertoyKeyEnv), "The Shadertoy API key, defaults to $"+shadertoyKeyEnv)
+	force := fs.Bool("force", false, "Overwrite existing files")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: shady import [flags] <shader ID or URL> [directory]\n\nFlags:\n")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() < 1 || fs.NArg() > 2 {
+		fs.Usage()
+		os.Exit(2)
+	}
+	id, err := importer.ParseID(fs.Arg(0))
+	if err != nil {
+		log.Fatal(err)
+	}
+	dir := id
+	if fs.NArg() == 2 {
+		dir = fs.Arg(1)
+	}
+
+	proj, err := importShadertoy(context.Background(), id, *key, dir, *force)
+	if err != nil {
+		log.Fatal(err)
+	}
+	log.Printf("Imported %s to %s, run it with:", id, dir)
+	log.Printf("  shady -i %s", filepath.Join(dir, proj.Image))
+	if proj.Sound != "" {
+		log.Printf("Render the sound along with it with -sound %s -sound-out <file.wav>", filepath.Join(dir, proj.Sound))
+	}
+}
+
+// importShadertoy fetches a shader and writes it to the directory. Existing
+// files are only overwritten if force is set.
+func importShadertoy(ctx context.Context, id, key, dir string, force bool) (*importer.Project, error) {
+	sh, err := importer.Fetch(ctx, nil, id, key)
+	if err != nil {
+		return nil, err
+	}
+	proj, err := importer.Convert(sh)
+	if err != nil {
+		return nil, err
+	}
+	for _, w := range proj.Warnings {
+		log.Printf("Warning: %s", w)
+	}
+	if !force {
+		for name := range proj.Files {
+			if _, err := os.Stat(filepath.Join(dir, name)); err == nil {
+				return nil, fmt.Errorf("%s already exists, use -force to overwrite it", filepath.Join(dir, name))
+			}
+		}
+	}
+	if err := proj.Write(ctx, nil, dir); err != nil {
+		return nil, err
+	}
+	return proj, nil
+}
+
+// resolveShadertoyInputs replaces shadertoy://<id> inputs by the image of the
+// imported shader. Shaders are imported to the cache directory once and are
+// rendered from there afterwards.
+func resolveShadertoyInputs(inputFiles []string) ([]string, error) {
+	resolved := make([]string, len(inputFiles))
+	for i, f := range inputFiles {
+		resolved[i] = f
+		if !strings.HasPrefix(f, "shadertoy://") {
+			continue
+		}
+		id, err := importer.ParseID(f)
+		if err != nil {
+			return nil, err
+		}
+		cache, err := os.UserCacheDir()
+		if err != nil {
+			return nil, err
+		}
+		dir := filepath.Join(cache, "shady", "shadertoy", id)
+		image := filepath.Join(dir, "image.glsl")
+		if _, err := os.Stat(image); err != nil {
+			log.Printf("Importing %s from Shadertoy", id)
+			proj, err := importShadertoy(context.Background(), id, os.Getenv(shadertoyKeyEnv), dir, true)
+			if err != nil {
+				return nil, err
+			}
+			image = filepath.Join(dir, proj.Image)
+		}
+		resolved[i] = image
+	}
+	return resolved, nil
+}
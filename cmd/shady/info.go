@@ -0,0 +1,129 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/polyfloyd/shady/renderer"
+)
+
+// capabilityReport is printed by "shady info" so frontends can adapt to the
+// features that are available.
+type capabilityReport struct {
+	OpenGL *renderer.ContextInfo `json:"opengl"`
+	// OpenGLError is set if no OpenGL context could be created.
+	OpenGLError   string       `json:"opengl_error,omitempty"`
+	OutputFormats []string     `json:"output_formats"`
+	Inputs        []string     `json:"inputs"`
+	GPUs          []gpuInfo    `json:"gpus"`
+	Devices       []deviceInfo `json:"devices"`
+}
+
+type gpuInfo struct {
+	Card   string `json:"card"`
+	PCIID  string `json:"pci_id"`
+	Driver string `json:"driver"`
+}
+
+type deviceInfo struct {
+	Kind   string `json:"kind"`
+	Device string `json:"device"`
+	Name   string `json:"name"`
+}
+
+// runInfo prints a report of the capabilities of the system.
+func runInfo(args []string) {
+	fs := flag.NewFlagSet("info", flag.ExitOnError)
+	asJSON := fs.Bool("json", false, "Print the report as JSON")
+	glslVersion := fs.String("glsl", "330", "The GLSL version to use")
+	openGLVersionStr := fs.String("opengl", "glsl", "The OpenGL version to use. If \"glsl\", the version is inferred from the requested GLSL version")
+	backendOpts := registerBackendFlags(fs)
+	fs.Parse(args)
+
+	openGLVersion, err := parseOpenGLVersion(*openGLVersionStr, *glslVersion)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := backendOpts.apply(); err != nil {
+		log.Fatalf("-backend: %v", err)
+	}
+	report, err := newCapabilityReport("/sys", "/proc")
+	if err != nil {
+		log.Fatal(err)
+	}
+	if info, err := renderer.QueryContextInfo(openGLVersion); err != nil {
+		report.OpenGLError = err.Error()
+	} else {
+		report.OpenGL = &info
+	}
+
+	if *asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(report); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+	report.writeText(os.Stdout)
+}
+
+// newCapabilityReport collects everything but the OpenGL capabilities, which
+// require a context.
+func newCapabilityReport(sysRoot, procRoot string) (capabilityReport, error) {
+	report := capabilityReport{
+		OutputFormats: []string{},
+		Inputs:        []string{},
+		GPUs:          []gpuInfo{},
+		Devices:       []deviceInfo{},
+	}
+	for _, item := range listOutputs() {
+		report.OutputFormats = append(report.OutputFormats, item[0])
+	}
+	for _, item := range listInputs() {
+		report.Inputs = append(report.Inputs, item[0])
+	}
+	gpus, err := listGPUs(sysRoot)
+	if err != nil {
+		return report, err
+	}
+	for _, item := range gpus {
+		report.GPUs = append(report.GPUs, gpuInfo{Card: item[0], PCIID: item[1], Driver: item[2]})
+	}
+	devices, err := listDevices(sysRoot, procRoot)
+	if err != nil {
+		return report, err
+	}
+	for _, item := range devices {
+		report.Devices = append(report.Devices, deviceInfo{Kind: item[0], Device: item[1], Name: item[2]})
+	}
+	return report, nil
+}
+
+func (report capabilityReport) writeText(w io.Writer) {
+	if report.OpenGL != nil {
+		gl := report.OpenGL
+		fmt.Fprintf(w, "OpenGL:         %s\n", gl.Version)
+		fmt.Fprintf(w, "GLSL:           %s\n", gl.ShadingLanguageVersion)
+		fmt.Fprintf(w, "Renderer:       %s (%s)\n", gl.Renderer, gl.Vendor)
+		fmt.Fprintf(w, "Backend:        %s\n", gl.Backend)
+		fmt.Fprintf(w, "Texture size:   %d\n", gl.MaxTextureSize)
+		fmt.Fprintf(w, "Texture units:  %d\n", gl.MaxTextureImageUnits)
+		fmt.Fprintf(w, "Extensions:     %d, use -json to list them\n", len(gl.Extensions))
+	} else {
+		fmt.Fprintf(w, "OpenGL:         unavailable: %s\n", report.OpenGLError)
+	}
+	fmt.Fprintf(w, "Output formats: %s\n", strings.Join(report.OutputFormats, ", "))
+	fmt.Fprintf(w, "Inputs:         %s\n", strings.Join(report.Inputs, ", "))
+	for _, gpu := range report.GPUs {
+		fmt.Fprintf(w, "GPU:            %s %s (%s)\n", gpu.Card, gpu.PCIID, gpu.Driver)
+	}
+	for _, dev := range report.Devices {
+		fmt.Fprintf(w, "Device:         %s %s (%s)\n", dev.Kind, dev.Device, dev.Name)
+	}
+}
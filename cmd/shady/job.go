@@ -0,0 +1,200 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+)
+
+// renderJob describes a render that is run by "shady worker". Relative paths
+// are resolved against the directory of the job.
+type renderJob struct {
+	// ID identifies the job in the queue. Jobs from a directory use the
+	// name of the file if it is not set.
+	ID        string      `json:"id"`
+	Shaders   []string    `json:"shaders"`
+	Mappings  []string    `json:"mappings,omitempty"`
+	Geometry  string      `json:"geometry"`
+	GLSL      string      `json:"glsl,omitempty"`
+	Seed      int64       `json:"seed,omitempty"`
+	Framerate float64     `json:"framerate,omitempty"`
+	Frames    *jobFrames  `json:"frames,omitempty"`
+	Outputs   []jobOutput `json:"outputs"`
+	Assets    []jobAsset  `json:"assets,omitempty"`
+	// Args are passed to shady as is for options that have no field.
+	Args []string `json:"args,omitempty"`
+}
+
+// jobFrames is an inclusive range of frames. Splitting an animation over
+// multiple jobs allows rendering it on multiple workers.
+type jobFrames struct {
+	First uint `json:"first"`
+	Last  uint `json:"last"`
+}
+
+// jobOutput is a file written by a job. If Buffer is set, the raw contents of
+// that buffer are exported instead of the rendered image.
+type jobOutput struct {
+	File   string `json:"file"`
+	Format string `json:"format,omitempty"`
+	Buffer string `json:"buffer,omitempty"`
+}
+
+// jobAsset is a file required by a job, like a texture. If URL is set, the
+// file is downloaded if it does not exist yet. If SHA256 is set, the contents
+// are verified before rendering.
+type jobAsset struct {
+	Path   string `json:"path"`
+	URL    string `json:"url,omitempty"`
+	SHA256 string `json:"sha256,omitempty"`
+}
+
+func parseRenderJob(data []byte) (renderJob, error) {
+	var job renderJob
+	if err := json.Unmarshal(data, &job); err != nil {
+		return job, fmt.Errorf("invalid job: %v", err)
+	}
+	return job, job.validate()
+}
+
+func (job renderJob) validate() error {
+	if len(job.Shaders) == 0 {
+		return fmt.Errorf("job %q has no shaders", job.ID)
+	}
+	if job.Geometry == "" {
+		return fmt.Errorf("job %q has no geometry", job.ID)
+	}
+	if job.Frames != nil {
+		if job.Framerate <= 0 {
+			return fmt.Errorf("job %q has frames but no framerate", job.ID)
+		}
+		if job.Frames.Last < job.Frames.First {
+			return fmt.Errorf("job %q ends at frame %d before starting at %d", job.ID, job.Frames.Last, job.Frames.First)
+		}
+	}
+	images := 0
+	for _, out := range job.Outputs {
+		if out.File == "" {
+			return fmt.Errorf("job %q has an output without a file", job.ID)
+		}
+		if out.Buffer == "" {
+			images++
+		}
+	}
+	if images != 1 {
+		return fmt.Errorf("job %q must have exactly one output that is not a buffer, got %d", job.ID, images)
+	}
+	for _, asset := range job.Assets {
+		if asset.Path == "" {
+			return fmt.Errorf("job %q has an asset without a path", job.ID)
+		}
+	}
+	return nil
+}
+
+// args returns the arguments for running the job with shady.
+func (job renderJob) args() []string {
+	var args []string
+	for _, shader := range job.Shaders {
+		args = append(args, "-i", shader)
+	}
+	for _, m := range job.Mappings {
+		args = append(args, "-map", m)
+	}
+	args = append(args, "-g", job.Geometry)
+	if job.GLSL != "" {
+		args = append(args, "-glsl", job.GLSL)
+	}
+	if job.Seed != 0 {
+		args = append(args, "-seed", strconv.FormatInt(job.Seed, 10))
+	}
+	if job.Framerate > 0 {
+		args = append(args, "-f", strconv.FormatFloat(job.Framerate, 'g', -1, 64))
+	}
+	if job.Frames != nil {
+		args = append(args,
+			"-start", strconv.FormatUint(uint64(job.Frames.First), 10),
+			"-n", strconv.FormatUint(uint64(job.Frames.Last-job.Frames.First+1), 10))
+	}
+	for _, out := range job.Outputs {
+		if out.Buffer != "" {
+			args = append(args, "-export", out.Buffer+"="+out.File)
+			continue
+		}
+		args = append(args, "-o", out.File)
+		if out.Format != "" {
+			args = append(args, "-ofmt", out.Format)
+		}
+	}
+	return append(args, job.Args...)
+}
+
+// fetchAssets downloads the assets of the job that are missing from dir and
+// verifies their checksums.
+func (job renderJob) fetchAssets(dir string) error {
+	for _, asset := range job.Assets {
+		path := asset.Path
+		if !filepath.IsAbs(path) {
+			path = filepath.Join(dir, path)
+		}
+		if _, err := os.Stat(path); os.IsNotExist(err) && asset.URL != "" {
+			if err := download(path, asset.URL); err != nil {
+				return fmt.Errorf("could not download %s: %v", asset.Path, err)
+			}
+		}
+		if asset.SHA256 == "" {
+			continue
+		}
+		sum, err := fileSHA256(path)
+		if err != nil {
+			return err
+		}
+		if sum != asset.SHA256 {
+			return fmt.Errorf("the checksum of %s is %s, expected %s", asset.Path, sum, asset.SHA256)
+		}
+	}
+	return nil
+}
+
+func download(path, url string) error {
+	resp, err := http.Get(url)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status: %s", resp.Status)
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return err
+	}
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(f, resp.Body); err != nil {
+		f.Close()
+		os.Remove(path)
+		return err
+	}
+	return f.Close()
+}
+
+func fileSHA256(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
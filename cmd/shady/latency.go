@@ -0,0 +1,247 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"image"
+	"io"
+	"log"
+	"math/bits"
+	"os/exec"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// latencyCodeBits is the number of bits of the frame number that are
+	// encoded by the test:latency pattern.
+	latencyCodeBits = 13
+	// latencyPeriod is the number of frames after which the code repeats.
+	latencyPeriod = 1 << latencyCodeBits
+	// latencyGrid is the number of cells along each side of the pattern.
+	latencyGrid = 4
+	// latencyCaptureSize is the size camera frames are scaled to before they
+	// are decoded.
+	latencyCaptureSize = 64
+	// latencyReportInterval is how often the measurements are logged.
+	latencyReportInterval = 5 * time.Second
+)
+
+type latencyFlags struct {
+	camera      *string
+	inputFormat *string
+}
+
+func registerLatencyFlags(fs *flag.FlagSet) latencyFlags {
+	return latencyFlags{
+		camera:      fs.String("latency", "", "Measure the end-to-end latency of the output using a camera that looks at the display, e.g. /dev/video0. Renders -source test:latency, which the camera should fill its view with"),
+		inputFormat: fs.String("latency-format", "", "The ffmpeg input format of the -latency camera. If empty, v4l2 is used for devices in /dev and ffmpeg detects the format of anything else"),
+	}
+}
+
+func (f latencyFlags) enabled() bool {
+	return *f.camera != ""
+}
+
+// ffmpegArgs returns the arguments for capturing grayscale frames from the
+// camera.
+func (f latencyFlags) ffmpegArgs() []string {
+	args := []string{"-loglevel", "error", "-fflags", "nobuffer", "-flags", "low_delay"}
+	if format := *f.inputFormat; format != "" {
+		args = append(args, "-f", format)
+	} else if strings.HasPrefix(*f.camera, "/dev/") {
+		args = append(args, "-f", "v4l2")
+	}
+	return append(args,
+		"-i", *f.camera,
+		"-vf", fmt.Sprintf("scale=%d:%d:flags=area", latencyCaptureSize, latencyCaptureSize),
+		"-pix_fmt", "gray",
+		"-f", "rawvideo",
+		"-",
+	)
+}
+
+// measure decodes the frames captured by the camera and records them with the
+// meter until the context is canceled.
+func (f latencyFlags) measure(ctx context.Context, meter *latencyMeter) error {
+	cmd := exec.CommandContext(ctx, "ffmpeg", f.ffmpegArgs()...)
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("could not start ffmpeg: %v", err)
+	}
+	defer cmd.Wait()
+
+	lastReport := time.Now()
+	buf := make([]byte, latencyCaptureSize*latencyCaptureSize)
+	for {
+		if _, err := io.ReadFull(stdout, buf); err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return fmt.Errorf("could not read from the camera: %v", err)
+		}
+		capturedAt := time.Now()
+		img := &image.Gray{
+			Pix:    buf,
+			Stride: latencyCaptureSize,
+			Rect:   image.Rect(0, 0, latencyCaptureSize, latencyCaptureSize),
+		}
+		if frame, ok := decodeLatencyCode(img); ok {
+			meter.Seen(frame, capturedAt)
+		}
+		if time.Since(lastReport) >= latencyReportInterval {
+			lastReport = time.Now()
+			if summary := meter.Summary(); summary != "" {
+				log.Printf("Latency: %s", summary)
+			}
+		}
+	}
+}
+
+// latencyCells returns which cells of the test:latency pattern are lit for the
+// frame, in the same order as the shader.
+func latencyCells(frame uint64) [latencyGrid * latencyGrid]bool {
+	var cells [latencyGrid * latencyGrid]bool
+	code := grayCode(frame % latencyPeriod)
+	cells[0] = true
+	for i := 0; i < latencyCodeBits; i++ {
+		cells[1+i] = code>>i&1 == 1
+	}
+	cells[1+latencyCodeBits] = bits.OnesCount64(code)%2 == 1
+	return cells
+}
+
+// decodeLatencyCode reads the frame number from an image of the test:latency
+// pattern that fills it. Images in which the reference cells can not be told
+// apart or the parity does not match are rejected. The frame number is
+// returned modulo latencyPeriod.
+func decodeLatencyCode(img *image.Gray) (uint64, bool) {
+	var levels [latencyGrid * latencyGrid]float64
+	size := img.Rect.Size()
+	for i := range levels {
+		// Average the center of the cell, away from the gaps.
+		col, row := i%latencyGrid, i/latencyGrid
+		x0 := img.Rect.Min.X + (col*10+3)*size.X/(latencyGrid*10)
+		x1 := img.Rect.Min.X + (col*10+7)*size.X/(latencyGrid*10)
+		y0 := img.Rect.Min.Y + (row*10+3)*size.Y/(latencyGrid*10)
+		y1 := img.Rect.Min.Y + (row*10+7)*size.Y/(latencyGrid*10)
+		if x1 <= x0 {
+			x1 = x0 + 1
+		}
+		if y1 <= y0 {
+			y1 = y0 + 1
+		}
+		sum := 0
+		for y := y0; y < y1; y++ {
+			for x := x0; x < x1; x++ {
+				sum += int(img.GrayAt(x, y).Y)
+			}
+		}
+		levels[i] = float64(sum) / float64((x1-x0)*(y1-y0))
+	}
+
+	white, black := levels[0], levels[len(levels)-1]
+	if white-black < 32 {
+		return 0, false
+	}
+	threshold := (white + black) / 2
+	var code uint64
+	for i := 0; i < latencyCodeBits; i++ {
+		if levels[1+i] > threshold {
+			code |= 1 << i
+		}
+	}
+	if parity := levels[1+latencyCodeBits] > threshold; parity != (bits.OnesCount64(code)%2 == 1) {
+		return 0, false
+	}
+	return fromGrayCode(code), true
+}
+
+func grayCode(n uint64) uint64 {
+	return n ^ n>>1
+}
+
+func fromGrayCode(code uint64) uint64 {
+	n := code
+	for shift := code >> 1; shift != 0; shift >>= 1 {
+		n ^= shift
+	}
+	return n
+}
+
+// latencyMeter matches the times at which frames were shown with the times at
+// which the camera saw them. It is safe for concurrent use.
+type latencyMeter struct {
+	lock    sync.Mutex
+	shown   [latencyPeriod]time.Time
+	samples []time.Duration
+
+	last    uint64
+	hasLast bool
+}
+
+// Shown records that the frame was handed to the output.
+func (m *latencyMeter) Shown(frame uint64) {
+	now := time.Now()
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.shown[frame%latencyPeriod] = now
+}
+
+// Seen records that the camera captured the frame. Only the first capture of
+// every frame is measured, since the camera keeps seeing it until the next
+// one is shown.
+func (m *latencyMeter) Seen(frame uint64, capturedAt time.Time) (time.Duration, bool) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	frame %= latencyPeriod
+	if m.hasLast && frame == m.last {
+		return 0, false
+	}
+	m.last, m.hasLast = frame, true
+	shownAt := m.shown[frame]
+	if shownAt.IsZero() || capturedAt.Before(shownAt) {
+		// The camera saw something that was not shown by this process or
+		// the entry has been overwritten by a later period of the code.
+		return 0, false
+	}
+	latency := capturedAt.Sub(shownAt)
+	m.samples = append(m.samples, latency)
+	return latency, true
+}
+
+// Summary describes the measurements, or returns an empty string if nothing
+// was measured.
+func (m *latencyMeter) Summary() string {
+	m.lock.Lock()
+	samples := append([]time.Duration(nil), m.samples...)
+	m.lock.Unlock()
+	if len(samples) == 0 {
+		return ""
+	}
+	sort.Slice(samples, func(i, j int) bool { return samples[i] < samples[j] })
+	round := func(d time.Duration) time.Duration { return d.Round(time.Millisecond / 10) }
+	return fmt.Sprintf("median=%v min=%v max=%v samples=%d",
+		round(samples[len(samples)/2]), round(samples[0]), round(samples[len(samples)-1]), len(samples))
+}
+
+// stream records every frame as shown when the next stage receives it.
+func (m *latencyMeter) stream(in <-chan image.Image) <-chan image.Image {
+	out := make(chan image.Image)
+	go func() {
+		defer close(out)
+		frame := uint64(0)
+		for img := range in {
+			out <- img
+			m.Shown(frame)
+			frame++
+		}
+	}()
+	return out
+}
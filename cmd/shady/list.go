@@ -0,0 +1,193 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/polyfloyd/shady/encode"
+	"github.com/polyfloyd/shady/shadertoy"
+)
+
+// listItem is a single line of the output of "shady list". Columns are
+// separated by tabs so the output can be used by scripts.
+type listItem []string
+
+// runList prints the inputs, outputs, sources, environments or devices that are
+// available on this system.
+func runList(args []string) {
+	fs := flag.NewFlagSet("list", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), `Usage: shady list <kind>
+
+Kinds:
+  inputs        the loaders that can be used in mappings
+  outputs       the formats that can be set with -ofmt
+  sources       the builtin shaders that can be set with -source
+  environments  the GPUs that can be rendered with
+  devices       webcams and audio capture devices
+`)
+	}
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	var items []listItem
+	var err error
+	switch fs.Arg(0) {
+	case "inputs":
+		items = listInputs()
+	case "outputs":
+		items = listOutputs()
+	case "sources":
+		items = listSources()
+	case "environments":
+		items, err = listGPUs("/sys")
+	case "devices":
+		items, err = listDevices("/sys", "/proc")
+	default:
+		fs.Usage()
+		os.Exit(2)
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+	for _, item := range items {
+		fmt.Println(strings.Join(item, "\t"))
+	}
+}
+
+func listInputs() []listItem {
+	var items []listItem
+	for _, name := range shadertoy.ResourceTypes() {
+		items = append(items, listItem{name})
+	}
+	return items
+}
+
+func listSources() []listItem {
+	var items []listItem
+	for _, name := range testPatternNames() {
+		items = append(items, listItem{name, testPatterns[strings.TrimPrefix(name, "test:")].description})
+	}
+	return items
+}
+
+func listOutputs() []listItem {
+	names := []string{"x11"}
+	for name := range encode.Formats {
+		names = append(names, name)
+	}
+	for name := range encode.SegmentedFormats {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	items := make([]listItem, len(names))
+	for i, name := range names {
+		items[i] = listItem{name}
+	}
+	return items
+}
+
+// listGPUs lists the DRM devices with their PCI IDs and the kernel driver.
+func listGPUs(sysRoot string) ([]listItem, error) {
+	cards, err := filepath.Glob(filepath.Join(sysRoot, "class/drm/card[0-9]*"))
+	if err != nil {
+		return nil, err
+	}
+	var items []listItem
+	for _, card := range cards {
+		name := filepath.Base(card)
+		if strings.Contains(name, "-") {
+			// Connectors like card0-HDMI-A-1.
+			continue
+		}
+		vendor := readSysfsAttr(filepath.Join(card, "device/vendor"))
+		device := readSysfsAttr(filepath.Join(card, "device/device"))
+		driver := "unknown"
+		if target, err := os.Readlink(filepath.Join(card, "device/driver")); err == nil {
+			driver = filepath.Base(target)
+		}
+		items = append(items, listItem{name, vendor + ":" + device, driver})
+	}
+	return items, nil
+}
+
+// listDevices lists webcams that can be mapped with the video loader and
+// audio capture devices.
+func listDevices(sysRoot, procRoot string) ([]listItem, error) {
+	var items []listItem
+	cams, err := filepath.Glob(filepath.Join(sysRoot, "class/video4linux/video[0-9]*"))
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(cams, func(i, j int) bool {
+		a, _ := strconv.Atoi(strings.TrimPrefix(filepath.Base(cams[i]), "video"))
+		b, _ := strconv.Atoi(strings.TrimPrefix(filepath.Base(cams[j]), "video"))
+		return a < b
+	})
+	for _, cam := range cams {
+		dev := "/dev/" + filepath.Base(cam)
+		items = append(items, listItem{"webcam", dev, readSysfsAttr(filepath.Join(cam, "name"))})
+	}
+
+	fd, err := os.Open(filepath.Join(procRoot, "asound/pcm"))
+	if os.IsNotExist(err) {
+		return items, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer fd.Close()
+	audio, err := parseALSAPCMs(fd)
+	if err != nil {
+		return nil, err
+	}
+	return append(items, audio...), nil
+}
+
+// parseALSAPCMs parses the capture devices from /proc/asound/pcm, which has
+// lines like:
+//
+//	00-00: ALC892 Analog : ALC892 Analog : playback 1 : capture 1
+func parseALSAPCMs(r io.Reader) ([]listItem, error) {
+	var items []listItem
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		fields := strings.Split(scanner.Text(), ":")
+		if len(fields) < 3 {
+			continue
+		}
+		capture := false
+		for _, f := range fields[3:] {
+			if strings.HasPrefix(strings.TrimSpace(f), "capture") {
+				capture = true
+			}
+		}
+		if !capture {
+			continue
+		}
+		var card, device int
+		if _, err := fmt.Sscanf(fields[0], "%d-%d", &card, &device); err != nil {
+			continue
+		}
+		items = append(items, listItem{"audio", fmt.Sprintf("hw:%d,%d", card, device), strings.TrimSpace(fields[1])})
+	}
+	return items, scanner.Err()
+}
+
+func readSysfsAttr(path string) string {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return "unknown"
+	}
+	return strings.TrimSpace(string(b))
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"image"
+	"image/draw"
+
+	"github.com/polyfloyd/shady/encode"
+)
+
+// crossfadeLoop turns an animation of loopFrames+fadeFrames frames into a
+// seamless loop of loopFrames frames. The first fadeFrames frames are held
+// back and blended into the frames that follow the loop, so the last frame
+// flows into the first. The loop therefore starts at frame fadeFrames.
+func crossfadeLoop(in <-chan image.Image, loopFrames, fadeFrames uint) <-chan image.Image {
+	if fadeFrames == 0 {
+		return in
+	}
+	out := make(chan image.Image)
+	go func() {
+		defer close(out)
+		head := make([]image.Image, 0, fadeFrames)
+		defer func() {
+			for _, img := range head {
+				if img != nil {
+					encode.ReleaseFrame(img)
+				}
+			}
+		}()
+		frame := uint(0)
+		for img := range in {
+			switch {
+			case frame < fadeFrames:
+				head = append(head, img)
+			case frame < loopFrames:
+				out <- img
+			default:
+				j := frame - loopFrames
+				if j >= uint(len(head)) {
+					encode.ReleaseFrame(img)
+					break
+				}
+				// The weight of the head rises towards the frame that
+				// comes after it in the loop.
+				mixed := mixFrames(img, head[j], float64(j+1)/float64(fadeFrames+1))
+				encode.ReleaseFrame(img)
+				encode.ReleaseFrame(head[j])
+				head[j] = nil
+				out <- mixed
+			}
+			frame++
+		}
+	}()
+	return out
+}
+
+// mixFrames returns a new frame that blends from a to b by the weight w.
+// Frames of different types are blended at 16 bits per channel.
+func mixFrames(a, b image.Image, w float64) image.Image {
+	switch a := a.(type) {
+	case *image.RGBA:
+		if b, ok := b.(*image.RGBA); ok && a.Rect == b.Rect {
+			mixed := encode.NewFrame(a.Rect)
+			wb := int(w*256 + 0.5)
+			for i := range mixed.Pix {
+				mixed.Pix[i] = uint8((int(a.Pix[i])*(256-wb) + int(b.Pix[i])*wb + 128) >> 8)
+			}
+			return mixed
+		}
+	case *encode.FloatFrame:
+		if b, ok := b.(*encode.FloatFrame); ok && a.Rect == b.Rect {
+			mixed := encode.NewFloatFrame(a.Rect)
+			wb := float32(w)
+			for i := range mixed.Pix {
+				mixed.Pix[i] = a.Pix[i]*(1-wb) + b.Pix[i]*wb
+			}
+			return mixed
+		}
+	}
+	r := a.Bounds()
+	ca, cb := image.NewRGBA64(r), image.NewRGBA64(r)
+	draw.Draw(ca, r, a, r.Min, draw.Src)
+	draw.Draw(cb, r, b, b.Bounds().Min, draw.Src)
+	wb := int(w*65536 + 0.5)
+	for i := 0; i < len(ca.Pix); i += 2 {
+		va := int(ca.Pix[i])<<8 | int(ca.Pix[i+1])
+		vb := int(cb.Pix[i])<<8 | int(cb.Pix[i+1])
+		v := (va*(65536-wb) + vb*wb + 32768) >> 16
+		ca.Pix[i], ca.Pix[i+1] = uint8(v>>8), uint8(v)
+	}
+	return ca
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"bytes"
 	"context"
 	"errors"
 	"flag"
@@ -11,11 +12,11 @@ import (
 	_ "image/png"
 	"io"
 	"log"
+	"math"
 	"os"
 	"os/signal"
-	"regexp"
+	"path/filepath"
 	"runtime"
-	"strconv"
 	"strings"
 	"time"
 
@@ -25,9 +26,17 @@ import (
 	"github.com/polyfloyd/shady/renderer"
 	"github.com/polyfloyd/shady/shadertoy"
 	_ "github.com/polyfloyd/shady/shadertoy/audio"
+	_ "github.com/polyfloyd/shady/shadertoy/dmx"
+	_ "github.com/polyfloyd/shady/shadertoy/gpio"
 	_ "github.com/polyfloyd/shady/shadertoy/image"
+	_ "github.com/polyfloyd/shady/shadertoy/midi"
+	_ "github.com/polyfloyd/shady/shadertoy/nowplaying"
+	_ "github.com/polyfloyd/shady/shadertoy/params"
 	_ "github.com/polyfloyd/shady/shadertoy/peripheral"
+	_ "github.com/polyfloyd/shady/shadertoy/pointcloud"
+	_ "github.com/polyfloyd/shady/shadertoy/touch"
 	_ "github.com/polyfloyd/shady/shadertoy/video"
+	"github.com/polyfloyd/shady/sink"
 )
 
 func main() {
@@ -36,33 +45,178 @@ func main() {
 	// OpenGL contexts are bounds to threads.
 	runtime.LockOSThread()
 
-	formatNames := make([]string, 0, len(encode.Formats))
+	if len(os.Args) > 1 && os.Args[1] == "daemon" {
+		runDaemon(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "new" {
+		runNew(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "import" {
+		runImport(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "repl" {
+		runREPL(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "list" {
+		runList(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "info" {
+		runInfo(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "worker" {
+		runWorker(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "gallery" {
+		runGallery(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "multi" {
+		runMulti(os.Args[2:])
+		return
+	}
+
+	formatNames := make([]string, 0, len(encode.Formats)+len(encode.SegmentedFormats))
 	for name := range encode.Formats {
 		formatNames = append(formatNames, name)
 	}
+	for name := range encode.SegmentedFormats {
+		formatNames = append(formatNames, name)
+	}
 
 	var inputFiles arrayFlags
-	flag.Var(&inputFiles, "i", "The shader file(s) to use")
+	flag.Var(&inputFiles, "i", "The shader file(s) to use. shadertoy://<id> imports a shader from Shadertoy")
+	var includeDirs arrayFlags
+	flag.Var(&includeDirs, "I", "Add a directory to search for files included with #pragma use that are not found relative to the including file")
+	source := flag.String("source", "", "Render a builtin shader instead of -i. Valid values are: "+strings.Join(testPatternNames(), ", "))
+	syncAudio := flag.String("sync-audio", "", "Write a WAV file with a beep at every flash of -source test:sync")
+	soundSource := flag.String("sound", "", "A Shadertoy sound shader, which defines vec2 mainSound(int samp, float time), to render to -sound-out")
+	soundOut := flag.String("sound-out", "", "Write the samples of -sound to a stereo WAV file that lasts as long as the animation")
+	soundRate := flag.Int("sound-rate", 44100, "The sample rate of -sound-out")
 	outputFile := flag.String("o", "-", "The file to write the rendered image to")
-	geometry := flag.String("g", "env", "The geometry of the rendered image in WIDTHxHEIGHT format. If \"env\", look for the LEDCAT_GEOMETRY variable")
-	outputFormat := flag.String("ofmt", "x11", "The encoding format to use to output the image. Valid values are: "+strings.Join(append(formatNames, "x11"), ", "))
+	geometry := flag.String("g", "env", "The geometry of the rendered image in WIDTHxHEIGHT format or a preset like 1080p or 4k. Either dimension may be \"?\" to derive it from -aspect. If \"env\", look for the SHADY_GEOMETRY or LEDCAT_GEOMETRY variables")
+	aspectStr := flag.String("aspect", "16:9", "The aspect ratio used to derive dimensions of -g as W:H or a decimal number")
+	outputFormat := flag.String("ofmt", "", "The encoding format to use to output the image. If empty, the format is detected from the output filename or x11 is used if no output file is set. Valid values are: "+strings.Join(append(formatNames, "x11"), ", "))
+	gifPalette := flag.String("gif-palette", "global", "How the colors of gif output are chosen: global shares a palette between all frames, frame chooses one for every frame")
+	gifDither := flag.Bool("gif-dither", true, "Dither the colors of gif output, which hides the banding of gradients at the cost of a larger file")
+	history := flag.Int("history", 0, "When rendering to a window, keep the specified number of most recent frames and the outputs of their passes, which can be stepped through with the left and right arrow keys")
+	window := flag.Bool("window", false, "Render to a resizable window that passes the mouse to iMouse and the keyboard to builtin:Keyboard mappings. The same as -ofmt x11")
 	framerate := flag.Float64("f", 0, "Whether to animate using the specified number of frames per second")
 	numFrames := flag.Uint("n", 0, "Limit the number of frames in the animation. No limit is set by default")
 	duration := flag.Float64("d", 0.0, "Limit the animation to the specified number of seconds. No limit is set by default")
+	loop := flag.Float64("loop", 0, "Render a seamless loop of the specified number of seconds, of which the end is crossfaded into the start. Shaders can loop natively with iLoopTime, which runs from 0 to 1. Requires -f")
+	loopFade := flag.Float64("loop-fade", 0.5, "The number of seconds of -loop that are crossfaded. If 0, the loop is not crossfaded, for shaders that loop with iLoopTime")
+	startFrame := flag.Uint("start", 0, "The number of the first frame to render, so animations can be rendered in parts. Requires -f")
+	startTime := flag.Float64("start-time", 0, "The time in seconds of the first frame to render, like -start. It must be a whole number of frames")
+	saveState := flag.String("save-state", "", "Save the contents of all buffers, the frame number and the time to the file when rendering stops and on SIGUSR1, so a simulation can be resumed with -load-state")
+	loadState := flag.String("load-state", "", "Resume from a file that was written by -save-state. Buffers that were renamed or resized start over")
 	framerateOld := flag.Float64("framerate", 0, "Whether to animate using the specified number of frames per second")
 	numFramesOld := flag.Uint("numframes", 0, "Limit the number of frames in the animation. No limit is set by default")
 	durationOld := flag.Float64("duration", 0.0, "Limit the animation to the specified number of seconds. No limit is set by default")
 	realtime := flag.Bool("rt", false, "Render at the actual number of frames per second set by -framerate")
+	skipIdle := flag.Bool("skip-idle", false, "Do not output frames that are identical to the previous one because nothing that the shader uses changed, e.g. for still images on signage. Outputs then no longer have a frame for every interval")
+	skipUnchanged := flag.Bool("skip-unchanged", false, "Do not output frames of which all pixels are equal to those of the previous frame, e.g. to save bandwidth of LED displays over slow links")
 	verbose := flag.Bool("v", false, "Show verbose output about rendering")
 	watch := flag.Bool("w", false, "Watch the shader source files for changes")
+	keepOnError := flag.Bool("keep-on-error", true, "With -w, keep rendering the current shader if a changed one fails to compile. The changed shader is loaded while the current one is still running, disable this for inputs that can only be opened once, like cameras")
+	tweak := flag.Bool("tweak", true, "With -w, lift numeric literals marked with /*tweak*/ to uniforms, so changing their values does not recompile the shader")
+	eventBuffer := flag.String("events", "", "Write a line of JSON to -events-out every time the shader changes the first pixel of the named buffer to a value other than zero, e.g. to signal beats or scene changes")
+	eventsOut := flag.String("events-out", "-", "The file to write the events of -events to")
+	metricsBuffer := flag.String("metrics", "", "Append the values that the shader writes to the bottom row of the named buffer to -metrics-out as a line of CSV for every frame, e.g. to log measurements of a simulation. Requires -f")
+	metricsOut := flag.String("metrics-out", "-", "The CSV file to write the values of -metrics to")
+	metricsColumns := flag.String("metrics-columns", "", "The comma separated names of the values of -metrics, e.g. energy,mass. Only as many values are written. By default, all channels of the row are written")
+	errorJSON := flag.String("error-json", "", "Write the result of every load of the shader as a line of JSON with the locations of compile errors to the file, for editor integrations")
+	previewAddr := flag.String("preview-addr", "", "Serve a live preview of the rendering and the compile errors over HTTP on the specified address, e.g. localhost:8081")
+	httpAddr := flag.String("http", "", "Serve the rendered output as a Motion JPEG stream at /stream.mjpeg and the current frame at /frame.png on the specified address, e.g. :8080. The same as -preview-addr")
+	canary := flag.Bool("canary", false, "With -w, test render changed shaders off-screen and keep the current one if they fail or render NaN or a black frame")
+	samples := flag.Uint("samples", 1, "The number of samples to accumulate for each frame. If 0, accumulate a still image until interrupted")
+	denoise := flag.Float64("denoise", 0, "Apply a bilateral denoising filter to the accumulated samples. The value sets the strength, e.g. 0.1")
+	noiseThreshold := flag.Float64("noise-threshold", 0, "Stop accumulating samples when the estimated RMS noise drops below this value. -samples sets the upper limit")
+	overlaySpec := flag.String("overlay", "", "Draw an image like a logo on top of every frame as FILE[@POSITION[:OPACITY]], e.g. logo.png@bottom-right:0.8. The position is one of top-left, top, top-right, left, center, right, bottom-left, bottom or bottom-right")
+	tileSize := flag.Uint("tile", 0, "Render a still image in square tiles of this many pixels, so it can be larger than the GPU is able to render at once")
 	glslVersion := flag.String("glsl", "330", "The GLSL version to use")
 	openGLVersionStr := flag.String("opengl", "glsl", "The OpenGL version to use. If \"glsl\", the version is inferred from the requested GLSL version")
+	backendOpts := registerBackendFlags(flag.CommandLine)
 	var shadertoyMappings arrayFlags
 	flag.Var(&shadertoyMappings, "map", "Specify or override ShaderToy input mappings")
+	midiPort := flag.String("midi", "", "Map the controllers and notes of a MIDI port like hw:1,0 or /dev/snd/midiC1D0 to the midiCC and midiNote uniform arrays. The same as -map midi=midi:<port>")
+	var defineFlags arrayFlags
+	flag.Var(&defineFlags, "define", "Define a preprocessor macro as NAME=VALUE, or NAME to define it as 1. Overrides the default of a #pragma option")
+	throttleOpts := registerThrottleFlags(flag.CommandLine)
+	presenceOpts := registerPresenceFlags(flag.CommandLine)
+	controlOutputOpts := registerControlOutputFlags(flag.CommandLine)
+	uniformOpts := registerUniformFlags(flag.CommandLine)
+	suspendOpts := registerSuspendFlags(flag.CommandLine)
+	screenshotDir := flag.String("screenshot-dir", ".", "The directory to save screenshots to when receiving SIGUSR1")
+	supervisorOpts := registerSupervisorFlags(flag.CommandLine)
+	execPerFrame := flag.String("exec-per-frame", "", "Run a shell command for every frame of an image sequence. {frame} and {file} are replaced by the frame number and filename")
+	execJobs := flag.Int("exec-jobs", runtime.NumCPU(), "The maximum number of -exec-per-frame commands to run at the same time")
+	startDateStr := flag.String("start-date", "", "The date of the first frame in RFC 3339 format, e.g. 2000-01-01T00:00:00Z, so renders that use iDate can be reproduced. The current time is used by default")
+	seed := flag.Int64("seed", 0, "The seed for random sources like builtin noise textures. Use different values to render variations")
+	snapshot := flag.String("snapshot", "", "Save snapshots on a schedule while rendering, e.g. \"every=1h\" or \"at=06:00,dir=/srv/www\"")
+	readbackDepth := flag.Int("readback-depth", renderer.DefaultReadbackDepth, "The number of frames that are rendered ahead on the GPU while the oldest is read back and encoded. Higher values raise the throughput of fast outputs at the cost of latency and GPU memory")
+	readback := flag.String("readback", "", "The format frames are read back in: rgba8, rgba16f, rgba32f or rgb10a2. By default, the precision of the output format is used, e.g. rgba16f for exr")
+	gpuConvert := flag.Bool("gpu-convert", false, "Convert frames to the layout of raw output formats like rgb24 and yuv420p on the GPU before reading them back, which saves CPU time at high resolutions")
+	frameHeader := flag.Bool("frame-header", false, "Prefix every frame written to the output with a header containing the resolution, format and timestamp")
+	frameDelta := flag.Bool("frame-delta", false, "With -frame-header, only write the pixels that changed since the previous frame and skip frames that did not change. Requires a raw format like rgb24")
+	keyframeInterval := flag.Duration("keyframe-interval", time.Second, "With -frame-delta, the interval at which full frames are written so consumers can join a running stream. If 0, full frames are only written when the resolution changes")
+	segmentDuration := flag.Duration("segment-duration", 4*time.Second, "The duration of each segment of HLS and DASH output")
+	var exports arrayFlags
+	flag.Var(&exports, "export", "Write the raw contents of a buffer mapping for every frame as <buffer name>=<file>, e.g. state=state-{frame:04d}.npy")
+	dumpPasses := flag.String("dump-passes", "", "Write the output of every buffer pass and the final image as separate images for debugging. The filename must contain {pass}, e.g. debug/{pass}.png")
+	exportDtype := flag.String("export-dtype", "f32", "The data type of values written by -export. Valid values are: f32, f16, u8, u16")
+	segmentListSize := flag.Int("segment-list-size", 6, "The number of segments to keep in HLS and DASH playlists. If 0, all segments are kept")
+	latencyOpts := registerLatencyFlags(flag.CommandLine)
+	warpOpts := registerWarpFlags(flag.CommandLine)
+	colorOpts := registerColorFlags(flag.CommandLine)
+	memoryOpts := registerMemoryFlags(flag.CommandLine)
+	videoOpts := registerVideoFlags(flag.CommandLine)
+	ci := flag.Bool("ci", false, "Render deterministically on machines without a GPU or display. Selects software rendering, starts a virtual display if needed and disables vsync")
+	if len(os.Args) > 1 && os.Args[1] == "completion" {
+		runCompletion(os.Args[2:], flag.CommandLine)
+		return
+	}
 	flag.Parse()
 
+	if *httpAddr != "" {
+		if *previewAddr != "" && *previewAddr != *httpAddr {
+			log.Fatalf("-http and -preview-addr are the same server and can not listen on different addresses")
+		}
+		*previewAddr = *httpAddr
+	}
+	if latencyOpts.enabled() {
+		if len(inputFiles) > 0 || (*source != "" && *source != "test:latency") {
+			log.Fatalf("-latency renders -source test:latency and can not be used with other shaders")
+		}
+		*source = "test:latency"
+	}
+	if *source != "" {
+		if len(inputFiles) > 0 {
+			log.Fatalf("-i and -source are mutually exclusive")
+		}
+		dir, err := os.MkdirTemp("", "shady-source")
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer os.RemoveAll(dir)
+		filename, err := writeSource(dir, *source)
+		if err != nil {
+			log.Fatalf("-source: %v", err)
+		}
+		inputFiles = append(inputFiles, filename)
+	}
 	if len(inputFiles) == 0 {
-		log.Fatalf("Please specify at least one GLSL file with -i")
+		log.Fatalf("Please specify at least one GLSL file with -i or a builtin shader with -source")
+	}
+	inputFiles, err := resolveShadertoyInputs(inputFiles)
+	if err != nil {
+		log.Fatalf("-i: %v", err)
 	}
 	if *framerateOld != 0 {
 		log.Println("-framerate is deprecated, please use -f")
@@ -74,7 +228,7 @@ func main() {
 	}
 	if *durationOld != 0.0 {
 		log.Println("-duration is deprecated, please use -d")
-		*framerate = *framerateOld
+		*duration = *durationOld
 	}
 
 	if *duration != 0.0 && *numFrames != 0 {
@@ -91,78 +245,463 @@ func main() {
 		if *framerate == 0 {
 			log.Fatalf("-duration is set while -framerate is not set")
 		}
-		animateNumFrames = uint(*duration * *framerate)
+		animateNumFrames = framesIn(*duration, *framerate)
+	}
+	var loopFrames, loopFadeFrames uint
+	if *loop != 0 {
+		if *duration != 0.0 || *numFrames != 0 {
+			log.Fatalf("-loop can not be used with -d or -n")
+		}
+		if *framerate == 0 {
+			log.Fatalf("-loop is set while -framerate is not set")
+		}
+		if *loopFade < 0 {
+			log.Fatalf("-loop-fade must not be negative")
+		}
+		loopFrames = framesIn(*loop, *framerate)
+		loopFadeFrames = framesIn(*loopFade, *framerate)
+		if loopFrames == 0 || loopFadeFrames >= loopFrames {
+			log.Fatalf("-loop must be at least a frame and longer than -loop-fade")
+		}
+		// The frames after the loop are blended into the first.
+		animateNumFrames = loopFrames + loopFadeFrames
 	}
 	if *framerate <= 0 {
 		animateNumFrames = 1
 	}
+	var startDate time.Time
+	if *startDateStr != "" {
+		if startDate, err = time.Parse(time.RFC3339, *startDateStr); err != nil {
+			log.Fatalf("-start-date: %v", err)
+		}
+	} else if *ci {
+		startDate = ciStartDate
+	}
+	if *startTime != 0 {
+		if *startFrame != 0 {
+			log.Fatalf("-start and -start-time are mutually exclusive")
+		}
+		if *framerate == 0 {
+			log.Fatalf("-start-time is set while -framerate is not set")
+		}
+		frame, err := frameAt(*startTime, *framerate)
+		if err != nil {
+			log.Fatalf("-start-time: %v", err)
+		}
+		*startFrame = frame
+	}
+	if *startFrame != 0 && *framerate == 0 {
+		log.Fatalf("-start is set while -framerate is not set")
+	}
+	var initialState *renderer.State
+	if *loadState != "" {
+		if *startFrame != 0 {
+			log.Fatalf("-load-state can not be used with -start")
+		}
+		if initialState, err = readStateFile(*loadState); err != nil {
+			log.Fatalf("-load-state: %v", err)
+		}
+	}
+	if *startFrame != 0 && latencyOpts.enabled() {
+		log.Fatalf("-start can not be used with -latency")
+	}
 	if *realtime && *framerate == 0 {
 		log.Fatalf("-rt is set while -framerate is not set")
 	}
+	if *noiseThreshold > 0 && *samples == 1 {
+		// Only stop when converged if no sample limit is set.
+		*samples = 0
+	}
+	accumulateUntilInterrupted := *samples == 0 && *noiseThreshold == 0
+	if accumulateUntilInterrupted && animateNumFrames != 1 {
+		log.Fatalf("-samples 0 can only be used to render still images")
+	}
+	if *tileSize > 0 {
+		if animateNumFrames != 1 {
+			log.Fatalf("-tile can only be used to render still images")
+		}
+		if *watch || *gpuConvert {
+			log.Fatalf("-tile can not be used with -watch or -gpu-convert")
+		}
+	}
 	interval := time.Duration(float64(time.Second) / *framerate)
+	loopDuration := time.Duration(loopFrames) * interval
+	if *syncAudio != "" {
+		if *framerate <= 0 || animateNumFrames == 0 {
+			log.Fatalf("-sync-audio requires -f and either -n or -d")
+		}
+		if err := writeSyncAudioFile(*syncAudio, time.Duration(*startFrame)*interval, time.Duration(animateNumFrames)*interval, interval); err != nil {
+			log.Fatalf("-sync-audio: %v", err)
+		}
+	}
+	throttle, err := throttleOpts.newThrottle()
+	if err != nil {
+		log.Fatal(err)
+	}
+	presence, err := presenceOpts.newPresence()
+	if err != nil {
+		log.Fatal(err)
+	}
+	controlOutputs, err := controlOutputOpts.outputs()
+	if err != nil {
+		log.Fatal(err)
+	}
+	for _, c := range controlOutputs {
+		defer c.sink.Close()
+	}
+	if err := suspendOpts.validate(); err != nil {
+		log.Fatal(err)
+	}
+	if *ci {
+		if *realtime {
+			log.Fatalf("-rt depends on the speed of the machine and can not be used with -ci")
+		}
+		if throttle != nil {
+			log.Fatalf("-on-battery and -on-idle can not be used with -ci")
+		}
+		if presence != nil {
+			log.Fatalf("-presence can not be used with -ci")
+		}
+		// The time of the animation must only depend on the frame number.
+		*suspendOpts.timePolicy = "continue"
+		*suspendOpts.reload = false
+	}
+	if *outputFile != "-" {
+		if err := validateTemplate(*outputFile); err != nil {
+			log.Fatalf("-o: %v", err)
+		}
+		if hasTemplateVar(*outputFile, "pass") {
+			log.Fatalf("-o: {pass} can only be used with -dump-passes")
+		}
+	}
+	outputVars := outputVars{
+		shader: shaderName(inputFiles[0]),
+		seed:   *seed,
+	}
+	var snapshotSched *snapshotSchedule
+	if *snapshot != "" {
+		sched, err := parseSnapshotSchedule(*snapshot)
+		if err != nil {
+			log.Fatalf("-snapshot: %v", err)
+		}
+		snapshotSched = &sched
+	}
+	if err := memoryOpts.apply(); err != nil {
+		log.Fatalf("-gpu-memory: %v", err)
+	}
+
+	if *window {
+		if *outputFormat != "" && *outputFormat != "x11" {
+			log.Fatalf("-window can not be combined with -ofmt %s", *outputFormat)
+		}
+		if *outputFile != "-" {
+			log.Fatalf("-window can not be combined with -o")
+		}
+		*outputFormat = "x11"
+	}
+	if *outputFormat == "" && *outputFile == "-" {
+		*outputFormat = "x11"
+	}
+	var warp *renderer.Warp
+	if *warpOpts.calibrate {
+		if *warpOpts.file == "" {
+			log.Fatalf("-warp-calibrate requires a -warp file to save to")
+		}
+		if *outputFormat != "x11" {
+			log.Fatalf("-warp-calibrate requires rendering to a window")
+		}
+	}
+	if *history != 0 && *outputFormat != "x11" {
+		log.Fatalf("-history requires rendering to a window")
+	}
+	if warpOpts.enabled() {
+		if warp, err = warpOpts.load(); err != nil {
+			log.Fatalf("-warp: %v", err)
+		}
+	}
+	if colorOpts.enabled() {
+		color, err := colorOpts.load()
+		if err != nil {
+			log.Fatalf("-color-calibration: %v", err)
+		}
+		// Colors are corrected in the same pass as the warp.
+		if warp == nil {
+			warp = renderer.NewWarp(2, 2)
+		}
+		warp.Color = color
+	}
+	var format encode.Format
+	var segmented encode.SegmentedFormat
+	var isSegmented bool
+	if *outputFormat != "x11" {
+		if format, segmented, isSegmented, err = selectOutputFormat(*outputFormat, *outputFile); err != nil {
+			log.Fatal(err)
+		}
+	}
+	var events *eventEmitter
+	if *eventBuffer != "" {
+		if *eventsOut == "-" && *outputFile == "-" && *outputFormat != "x11" {
+			log.Fatalf("-events can not be written to stdout while the image is, set -events-out or -o")
+		}
+		w, err := openWriter(*eventsOut)
+		if err != nil {
+			log.Fatalf("-events-out: %v", err)
+		}
+		defer w.Close()
+		events = &eventEmitter{buffer: *eventBuffer, w: w}
+	}
+	var metrics *metricsWriter
+	if *metricsBuffer != "" {
+		if *framerate <= 0 {
+			log.Fatalf("-metrics is set while -framerate is not set")
+		}
+		if *metricsOut == "-" && (*outputFile == "-" && *outputFormat != "x11" || *eventBuffer != "" && *eventsOut == "-") {
+			log.Fatalf("-metrics can not be written to stdout while the image or the events are, set -metrics-out")
+		}
+		columns, err := parseMetricsColumns(*metricsColumns)
+		if err != nil {
+			log.Fatalf("-metrics-columns: %v", err)
+		}
+		w, err := openWriter(*metricsOut)
+		if err != nil {
+			log.Fatalf("-metrics-out: %v", err)
+		}
+		defer w.Close()
+		metrics = newMetricsWriter(*metricsBuffer, w, columns, interval)
+	}
+	if (*soundSource == "") != (*soundOut == "") {
+		log.Fatalf("-sound and -sound-out must be used together")
+	}
+	if *soundOut != "" {
+		if *outputFormat == "x11" || *framerate <= 0 || animateNumFrames == 0 {
+			log.Fatalf("-sound-out requires an output file, -f and either -n or -d")
+		}
+		if *soundRate <= 0 {
+			log.Fatalf("-sound-rate must be positive")
+		}
+	}
+	if _, isVideo := format.(encode.VideoFormat); *videoOpts.subtitles != "" && !isVideo && !isSegmented {
+		log.Fatalf("-subtitles requires a video, HLS or DASH output")
+	}
+	if g, ok := format.(encode.GIFFormat); ok {
+		if g.Palette, err = encode.ParseGIFPalette(*gifPalette); err != nil {
+			log.Fatalf("-gif-palette: %v", err)
+		}
+		g.Dither = *gifDither
+		format = g
+	}
+	if video, ok := format.(encode.VideoFormat); ok {
+		if video.Encoder, err = videoOpts.encoder(time.Duration(*startFrame) * interval); err != nil {
+			log.Fatalf("%v", err)
+		}
+		if err := video.Validate(); err != nil {
+			log.Fatalf("%v", err)
+		}
+		if *skipIdle || *skipUnchanged {
+			log.Fatalf("-skip-idle and -skip-unchanged can not be used with %s output, every frame of a video lasts the interval set by -f", video.Extension)
+		}
+		format = video
+	}
+
+	if *ci {
+		stopCI, err := setupCI(*outputFormat == "x11")
+		if err != nil {
+			log.Fatalf("-ci: %v", err)
+		}
+		defer stopCI()
+	}
 
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
+	userUniforms, err := uniformOpts.start(ctx.Done())
+	if err != nil {
+		log.Fatal(err)
+	}
+	stopAccumulating := make(chan struct{})
 	go func() {
 		sig := make(chan os.Signal, 1)
 		signal.Notify(sig, os.Interrupt)
+		if accumulateUntilInterrupted {
+			<-sig
+			log.Println("Finishing accumulation, interrupt again to abort")
+			close(stopAccumulating)
+		}
 		<-sig
 		signal.Stop(sig)
 		cancel()
 	}()
 
-	var openGLVersion renderer.OpenGLVersion
-	if *openGLVersionStr == "glsl" {
-		var err error
-		openGLVersion, err = renderer.OpenGLVersionFromGLSLVersion(*glslVersion)
-		if err != nil {
-			log.Fatal(err)
-		}
-	} else {
-		var err error
-		openGLVersion, err = renderer.ParseOpenGLVersion(*openGLVersionStr)
-		if err != nil {
-			log.Fatal(err)
-		}
+	openGLVersion, err := parseOpenGLVersion(*openGLVersionStr, *glslVersion)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := backendOpts.apply(); err != nil {
+		log.Fatalf("-backend: %v", err)
 	}
 	if *verbose {
 		log.Printf("OpenGL version: %s", openGLVersion)
 		log.Printf("GLSL version: %s", *glslVersion)
 	}
 
-	newFn := func() (renderer.Environment, []string, error) {
-		sources, err := renderer.Includes([]string(inputFiles)...)
+	var latency *latencyMeter
+	if latencyOpts.enabled() {
+		if *outputFormat != "x11" && *framerate <= 0 {
+			log.Fatalf("-latency requires -f unless rendering to a window")
+		}
+		latency = &latencyMeter{}
+		go func() {
+			if err := latencyOpts.measure(ctx, latency); err != nil {
+				log.Fatalf("-latency: %v", err)
+			}
+		}()
+		defer func() {
+			if summary := latency.Summary(); summary != "" {
+				log.Printf("Latency: %s", summary)
+			} else {
+				log.Printf("No latency was measured, make sure the camera sees the whole pattern")
+			}
+		}()
+	}
+
+	defines := map[string]string{}
+	for _, d := range defineFlags {
+		name, value, err := renderer.ParseDefine(d)
 		if err != nil {
-			return nil, sources, err
+			log.Fatalf("-define: %v", err)
 		}
+		defines[name] = value
+	}
 
-		mappings := make([]shadertoy.Mapping, 0, len(shadertoyMappings))
-		for _, str := range shadertoyMappings {
-			m, err := shadertoy.ParseMapping(str, ".")
+	if *midiPort != "" {
+		shadertoyMappings = append(shadertoyMappings, "midi=midi:"+*midiPort)
+	}
+	newFn := environmentLoader(inputFiles, shadertoyMappings, *glslVersion, includeDirs)
+	var feed *errorFeed
+	if *errorJSON != "" || *previewAddr != "" {
+		feed = &errorFeed{}
+		if *errorJSON != "" {
+			w, err := openWriter(*errorJSON)
 			if err != nil {
-				return nil, sources, err
+				log.Fatalf("-error-json: %v", err)
 			}
-			mappings = append(mappings, m)
+			defer w.Close()
+			feed.w = w
+		}
+		newFn = feed.wrapLoader(newFn)
+	}
+	reloadFn := func(engine interface{ SetEnvironment(renderer.Environment) }) func() error {
+		return func() error {
+			env, _, err := newFn()
+			if err != nil {
+				return err
+			}
+			engine.SetEnvironment(env)
+			return nil
 		}
-		env, err := shadertoy.NewShaderToy(
-			renderer.SourceFiles(sources...),
-			mappings,
-			*glslVersion,
-		)
-		return env, sources, err
 	}
 
 	// Check whether we should render directly to an onscreen window. This is a
 	// separate rendering path.
 	if *outputFormat == "x11" {
+		if *samples != 1 || *noiseThreshold != 0 || *denoise != 0 {
+			log.Fatalf("-samples, -noise-threshold and -denoise are not supported when rendering to a window")
+		}
+		if *tileSize > 0 || *overlaySpec != "" {
+			log.Fatalf("-tile and -overlay are not supported when rendering to a window")
+		}
+		if len(exports) > 0 || *dumpPasses != "" {
+			log.Fatalf("-export and -dump-passes are not supported when rendering to a window")
+		}
+		if *startFrame != 0 {
+			log.Fatalf("-start is not supported when rendering to a window")
+		}
+		if *history < 0 {
+			log.Fatalf("-history must not be negative")
+		}
 		engine, err := renderer.NewOnScreenEngine(openGLVersion)
 		if err != nil {
 			log.Fatalf("Could initialize engine: %v", err)
 		}
 		defer engine.Close()
+		engine.SetSeed(*seed)
+		engine.SetCanary(*canary)
+		engine.SetKeepOnError(*keepOnError)
+		engine.SetTweaks(*watch && *tweak)
+		engine.SetDefines(defines)
+		engine.SetUserUniforms(userUniforms)
+		if feed != nil {
+			engine.SetLoadCallback(feed.Report)
+		}
+		for _, c := range controlOutputs {
+			engine.ExportBuffer(c.buffer, c.update)
+			go c.run(ctx.Done())
+		}
+		if events != nil {
+			engine.ExportBuffer(events.buffer, events.update)
+		}
+		if metrics != nil {
+			engine.ExportBuffer(metrics.buffer, metrics.update)
+		}
+		engine.SetStartDate(startDate)
+		engine.SetLoop(loopDuration)
+		engine.SetHistory(*history)
+		if initialState != nil {
+			engine.SetInitialState(initialState)
+		}
+		if *ci {
+			engine.SetVSync(false)
+		}
+		if latency != nil {
+			engine.SetPresentCallback(latency.Shown)
+		}
+		if warp != nil {
+			if err := engine.SetWarp(warp); err != nil {
+				log.Fatalf("-warp: %v", err)
+			}
+			if *warpOpts.calibrate {
+				save := func(w *renderer.Warp) error {
+					return saveWarp(*warpOpts.file, w)
+				}
+				if err := engine.SetWarpCalibration(save); err != nil {
+					log.Fatalf("-warp-calibrate: %v", err)
+				}
+			}
+		}
+		pause := newPauser(engine.SetPaused)
+		if throttle != nil {
+			go throttle.Run(ctx, func(paused bool, interval time.Duration) {
+				pause.Set("throttle", paused)
+				engine.SetFrameInterval(interval)
+			})
+		}
+		if presence != nil {
+			control, err := presenceOpts.newControl(pause, engine.FadeTo)
+			if err != nil {
+				log.Fatal(err)
+			}
+			go presence.Run(ctx, control.Apply)
+		}
+		go suspendOpts.handleResume(ctx, engine.AdvanceTime, engine.Resume, reloadFn(engine))
+		controls := signalControls{
+			screenshot:    engine.Screenshot,
+			screenshotDir: *screenshotDir,
+			pause:         pause,
+			reload:        reloadFn(engine),
+		}
+		if *saveState != "" {
+			controls.saveState = stateSaver(*saveState, engine.State)
+		}
+		go handleControlSignals(ctx, controls)
+		if snapshotSched != nil {
+			go runSnapshots(ctx, *snapshotSched, controls)
+		}
+		go supervisorOpts.supervise(ctx, cancel, engine.Health(), pause.Paused)
+		if *previewAddr != "" {
+			go servePreview(ctx, *previewAddr, engine.Screenshot, feed)
+		}
 
 		if *watch {
-			go watchEnvironment(ctx, engine, newFn)
+			go watchEnvironment(ctx, engine, newFn, *tweak)
 		} else {
 			env, _, err := newFn()
 			if err != nil {
@@ -171,7 +710,13 @@ func main() {
 			engine.SetEnvironment(env)
 		}
 
-		if err := engine.Animate(ctx); errors.Is(err, renderer.ErrWindowClosed) {
+		err = engine.Animate(ctx)
+		if *saveState != "" {
+			if err := writeStateFile(*saveState, engine.CaptureState()); err != nil {
+				log.Printf("-save-state: %v", err)
+			}
+		}
+		if errors.Is(err, renderer.ErrWindowClosed) || errors.Is(err, context.Canceled) {
 			return
 		} else if err != nil {
 			log.Fatal(err)
@@ -180,52 +725,314 @@ func main() {
 	}
 
 	// Figure out the dimensions of the display.
-	width, height, err := parseGeometry(*geometry)
+	aspect, err := parseAspect(*aspectStr)
+	if err != nil {
+		log.Fatalf("-aspect: %v", err)
+	}
+	width, height, err := parseGeometry(*geometry, aspect)
 	if err != nil {
 		log.Fatalf("%v", err)
 	}
+	if !*frameHeader {
+		// Framed output carries the geometry, so consumers do not rely on the
+		// environment.
+		if err := checkLEDGeometry(format, *outputFile, width, height); err != nil {
+			log.Fatal(err)
+		}
+	}
 
-	engine, err := renderer.NewShader(width, height, openGLVersion)
+	// The geometry is that of the output, which a rotated warp renders with
+	// its dimensions swapped.
+	canvasWidth, canvasHeight := width, height
+	if warp != nil && warp.Orientation.SwapsAxes() {
+		canvasWidth, canvasHeight = height, width
+	}
+	if *soundOut != "" {
+		opts := soundOptions{
+			source:      *soundSource,
+			includeDirs: includeDirs,
+			glslVersion: *glslVersion,
+			glVersion:   openGLVersion,
+			sampleRate:  *soundRate,
+		}
+		if err := renderSoundFile(*soundOut, opts, time.Duration(*startFrame)*interval, time.Duration(animateNumFrames)*interval); err != nil {
+			log.Fatalf("-sound: %v", err)
+		}
+	}
+	// Tiled images are rendered by a shader of the size of a tile.
+	shaderWidth, shaderHeight := canvasWidth, canvasHeight
+	if *tileSize > 0 {
+		if warp != nil {
+			log.Fatalf("-tile can not be used with -warp")
+		}
+		if shaderWidth > *tileSize {
+			shaderWidth = *tileSize
+		}
+		if shaderHeight > *tileSize {
+			shaderHeight = *tileSize
+		}
+	}
+	engine, err := renderer.NewShader(shaderWidth, shaderHeight, openGLVersion)
 	if err != nil {
 		log.Fatalf("Could initialize engine: %v", err)
 	}
 	defer engine.Close()
+	readbackFmt, err := readbackFormat(format, *readback)
+	if err != nil {
+		log.Fatalf("-readback: %v", err)
+	}
+	if err := engine.SetPixelFormat(readbackFmt); err != nil {
+		log.Fatalf("-readback: %v", err)
+	}
+	if err := engine.SetReadbackDepth(*readbackDepth); err != nil {
+		log.Fatalf("-readback-depth: %v", err)
+	}
+	engine.SetSeed(*seed)
+	engine.SetCanary(*canary)
+	engine.SetKeepOnError(*keepOnError)
+	engine.SetTweaks(*watch && *tweak)
+	engine.SetDefines(defines)
+	engine.SetUserUniforms(userUniforms)
+	if feed != nil {
+		engine.SetLoadCallback(feed.Report)
+	}
+	for _, c := range controlOutputs {
+		engine.ExportBuffer(c.buffer, c.update)
+		go c.run(ctx.Done())
+	}
+	if events != nil {
+		engine.ExportBuffer(events.buffer, events.update)
+	}
+	if metrics != nil {
+		engine.ExportBuffer(metrics.buffer, metrics.update)
+	}
+	engine.SetStartDate(startDate)
+	engine.SetStartFrame(uint64(*startFrame), interval)
+	if initialState != nil {
+		engine.SetInitialState(initialState)
+	}
+	engine.SetLoop(loopDuration)
+	if warp != nil {
+		if err := engine.SetWarp(warp); err != nil {
+			log.Fatalf("-warp: %v", err)
+		}
+	}
+	if err := engine.SetAccumulation(renderer.AccumulationOptions{
+		Samples:        *samples,
+		Stop:           stopAccumulating,
+		NoiseThreshold: *noiseThreshold,
+		Denoise:        *denoise,
+	}); err != nil {
+		log.Fatalf("Could not set up accumulation: %v", err)
+	}
+	go suspendOpts.handleResume(ctx, engine.AdvanceTime, engine.Resume, reloadFn(engine))
+	if len(exports) > 0 {
+		dtype, err := encode.ParseDataType(*exportDtype)
+		if err != nil {
+			log.Fatalf("-export-dtype: %v", err)
+		}
+		for _, spec := range exports {
+			name, filename, err := parseExportTarget(spec)
+			if err != nil {
+				log.Fatal(err)
+			}
+			export, err := newBufferExport(filename, dtype, outputVars, interval, animateNumFrames)
+			if err != nil {
+				log.Fatalf("-export: %v", err)
+			}
+			defer export.Close()
+			engine.ExportBuffer(name, func(data renderer.PixelData) {
+				if err := export.Write(data); err != nil {
+					log.Fatalf("Could not export %s: %v", name, err)
+				}
+			})
+		}
+	}
 
-	var format encode.Format
-	var ok bool
-	if format, ok = encode.Formats[*outputFormat]; !ok {
-		if format, ok = encode.DetectFormat(*outputFile); !ok {
-			log.Fatalf("Unable to detect output format. Please set the -ofmt flag")
+	var dump *passDump
+	if *dumpPasses != "" {
+		if dump, err = newPassDump(*dumpPasses, outputVars, interval, animateNumFrames); err != nil {
+			log.Fatalf("-dump-passes: %v", err)
+		}
+		engine.ExportPasses(func(name string, data renderer.PixelData) {
+			if err := dump.WritePass(name, data); err != nil {
+				log.Fatalf("Could not dump pass %s: %v", name, err)
+			}
+		})
+	}
+
+	if *gpuConvert {
+		layout, ok := renderer.OutputLayoutOf(formatName(format))
+		if _, isVideo := format.(encode.VideoFormat); isVideo || isSegmented {
+			// Video encoders take YUV, so FFmpeg is given that as is.
+			layout, ok = renderer.OutputLayoutI420, true
+		}
+		if !ok {
+			log.Fatalf("-gpu-convert requires a raw or video output format, e.g. -ofmt rgb24")
+		}
+		if loopFadeFrames > 0 {
+			log.Fatalf("-gpu-convert can not be used with -loop-fade")
+		}
+		if err := engine.SetOutputLayout(layout); err != nil {
+			log.Fatalf("-gpu-convert: %v", err)
 		}
 	}
+	var logo *overlay
+	if *overlaySpec != "" {
+		if *gpuConvert {
+			log.Fatalf("-overlay can not be used with -gpu-convert")
+		}
+		if logo, err = loadOverlay(*overlaySpec); err != nil {
+			log.Fatalf("-overlay: %v", err)
+		}
+	}
+	if *frameHeader {
+		if _, isVideo := format.(encode.VideoFormat); isVideo || isSegmented || isSequencePattern(*outputFile) {
+			log.Fatalf("-frame-header can only be used for single stream outputs")
+		}
+		framed := encode.FramedFormat{Format: format, PixelFormat: encode.FramePixelFormat(formatName(format))}
+		if *frameDelta {
+			if encode.FramePixelSize(framed.PixelFormat) == 0 {
+				log.Fatalf("-frame-delta requires a raw format with a fixed size per pixel: rgb24, bgr24, rgba32, rgb565 or x2rgb10le")
+			}
+			framed.Delta = true
+			framed.KeyframeInterval = *keyframeInterval
+		}
+		format = framed
+	} else if *frameDelta {
+		log.Fatalf("-frame-delta requires -frame-header")
+	}
 
 	// Open the output.
-	outWriter, err := openWriter(*outputFile)
-	if err != nil {
-		log.Fatalf("%v", err)
+	var encodeOutput func(<-chan image.Image) error
+	if isSegmented {
+		if *outputFile == "-" || sink.IsRemote(*outputFile) {
+			log.Fatalf("%s output must be written to a local playlist file", segmented.Muxer)
+		}
+		if *execPerFrame != "" {
+			log.Fatalf("-exec-per-frame requires an image sequence output, e.g. -o frame-%%04d.png")
+		}
+		vars := outputVars
+		vars.date = time.Now()
+		filename, err := expandTemplate(*outputFile, vars)
+		if err != nil {
+			log.Fatalf("%v", err)
+		}
+		encoder, err := videoOpts.encoder(time.Duration(*startFrame) * interval)
+		if err != nil {
+			log.Fatalf("%v", err)
+		}
+		encodeOutput = func(stream <-chan image.Image) error {
+			return segmented.EncodeSegments(filename, stream, interval, encode.SegmentOptions{
+				Duration: *segmentDuration,
+				ListSize: *segmentListSize,
+				Encoder:  encoder,
+			})
+		}
+	} else if isSequencePattern(*outputFile) {
+		hook := newFrameHook(*execPerFrame, *execJobs)
+		namer := sequenceNamer(*outputFile, outputVars, interval)
+		name := func(frame uint64) (string, error) {
+			return namer(uint64(*startFrame) + frame)
+		}
+		encodeOutput = func(stream <-chan image.Image) error {
+			return writeSequence(name, format, stream, hook)
+		}
+	} else {
+		if *execPerFrame != "" {
+			log.Fatalf("-exec-per-frame requires an image sequence output, e.g. -o frame-%%04d.png")
+		}
+		vars := outputVars
+		vars.date = time.Now()
+		filename, err := expandTemplate(*outputFile, vars)
+		if err != nil {
+			log.Fatalf("%v", err)
+		}
+		outWriter, err := openWriter(filename)
+		if err != nil {
+			log.Fatalf("%v", err)
+		}
+		defer outWriter.Close()
+		encodeOutput = func(stream <-chan image.Image) error {
+			return format.EncodeAnimation(outWriter, stream, interval)
+		}
 	}
-	defer outWriter.Close()
 
 	in := make(chan image.Image, 10)
 	out := (<-chan image.Image)(in)
 	if animateNumFrames > 0 {
 		out = limitNumFrames(out, animateNumFrames)
 	}
+	if loopFrames > 0 {
+		out = crossfadeLoop(out, loopFrames, loopFadeFrames)
+	}
+	if logo != nil {
+		out = logo.stream(out)
+	}
+	if dump != nil {
+		out = dump.stream(out)
+	}
 	if *realtime {
 		out = limitFramerate(out, interval)
 	}
+	if *skipIdle {
+		out = skipRepeatedFrames(out)
+	}
+	if *skipUnchanged {
+		out = skipUnchangedFrames(out)
+	}
+	pause := newPauser(nil)
+	if throttle != nil {
+		go throttle.Run(ctx, func(paused bool, _ time.Duration) {
+			pause.Set("throttle", paused)
+		})
+		out = throttleStream(out, throttle)
+	}
+	if presence != nil {
+		control, err := presenceOpts.newControl(pause, nil)
+		if err != nil {
+			log.Fatal(err)
+		}
+		go presence.Run(ctx, control.Apply)
+	}
+	out = pauseStream(out, pause)
+	out, last := recordLastFrame(out)
+	controls := signalControls{
+		screenshot:    last.Image,
+		screenshotDir: *screenshotDir,
+		pause:         pause,
+		reload:        reloadFn(engine),
+	}
+	if *saveState != "" {
+		controls.saveState = stateSaver(*saveState, engine.State)
+	}
+	go handleControlSignals(ctx, controls)
+	if snapshotSched != nil {
+		go runSnapshots(ctx, *snapshotSched, controls)
+	}
+	go supervisorOpts.supervise(ctx, cancel, engine.Health(), pause.Paused)
+	if *previewAddr != "" {
+		go servePreview(ctx, *previewAddr, last.Image, feed)
+	}
 	if *verbose {
-		out = printStats(out, interval, animateNumFrames)
+		total := animateNumFrames
+		if loopFrames > 0 {
+			total = loopFrames
+		}
+		out = printStats(out, interval, total)
+	}
+	if latency != nil {
+		out = latency.stream(out)
 	}
 	go func() {
-		if err := format.EncodeAnimation(outWriter, out, interval); err != nil {
+		if err := encodeOutput(out); err != nil {
 			log.Printf("Error animating: %v", err)
 		}
 		cancel()
 	}()
 
 	if *watch {
-		go watchEnvironment(ctx, engine, newFn)
+		go watchEnvironment(ctx, engine, newFn, *tweak)
 	} else {
 		env, _, err := newFn()
 		if err != nil {
@@ -234,19 +1041,112 @@ func main() {
 		engine.SetEnvironment(env)
 	}
 
+	if *tileSize > 0 {
+		img, err := engine.RenderTiles(canvasWidth, canvasHeight, interval)
+		if err != nil {
+			log.Fatalf("-tile: %v", err)
+		}
+		in <- img
+		// Wait for the image to be encoded.
+		<-ctx.Done()
+		return
+	}
 	engine.Animate(ctx, interval, in)
+	if *saveState != "" {
+		if err := writeStateFile(*saveState, engine.CaptureState()); err != nil {
+			log.Printf("-save-state: %v", err)
+		}
+	}
+}
+
+// environmentLoader returns a function that loads the specified shader files
+// into a new environment. The files that the environment was loaded from are
+// returned as well, even on error, so they can be watched for changes.
+//
+// Includes are resolved relative to the including file and then to the
+// directories of includeDirs. Shaders and includes may also be HTTP URLs.
+func environmentLoader(inputFiles, shadertoyMappings []string, glslVersion string, includeDirs []string) func() (renderer.Environment, []string, error) {
+	resolver := renderer.URLResolver{Next: renderer.FileResolver{SearchPath: includeDirs}}
+	return func() (renderer.Environment, []string, error) {
+		inputs := make([]renderer.Source, 0, len(inputFiles))
+		for _, f := range inputFiles {
+			if strings.HasPrefix(f, "http://") || strings.HasPrefix(f, "https://") {
+				inputs = append(inputs, renderer.SourceURL{URL: f})
+				continue
+			}
+			abs, err := filepath.Abs(f)
+			if err != nil {
+				return nil, nil, err
+			}
+			inputs = append(inputs, renderer.SourceFile{Filename: abs})
+		}
+		sources, err := renderer.IncludeSources(resolver, inputs...)
+		var files []string
+		for _, s := range sources {
+			if f, ok := renderer.OriginSource(s).(renderer.SourceFile); ok {
+				files = append(files, f.Filename)
+			}
+		}
+		if err != nil {
+			return nil, files, err
+		}
+
+		mappings := make([]shadertoy.Mapping, 0, len(shadertoyMappings))
+		for _, str := range shadertoyMappings {
+			m, err := shadertoy.ParseMapping(str, ".")
+			if err != nil {
+				return nil, files, err
+			}
+			mappings = append(mappings, m)
+		}
+		env, err := shadertoy.NewShaderToy(sources, mappings, glslVersion)
+		if err != nil {
+			return nil, files, err
+		}
+		env.SetResolver(resolver)
+		return env, files, nil
+	}
 }
 
-func watchEnvironment(ctx context.Context, engine interface{ SetEnvironment(renderer.Environment) }, newFn func() (renderer.Environment, []string, error)) {
+// framesIn returns the number of whole frames that fit in the duration in
+// seconds. Durations that are a whole number of frames are not rounded down
+// because of the imprecision of floats, e.g. 0.7s at 30 fps is 21 frames.
+func framesIn(duration, framerate float64) uint {
+	return uint(math.Floor(duration*framerate + 1e-6))
+}
+
+// frameAt returns the number of the frame at the time in seconds, which must
+// be the start of a frame.
+func frameAt(t, framerate float64) (uint, error) {
+	if t < 0 {
+		return 0, fmt.Errorf("the time must not be negative")
+	}
+	frame := math.Round(t * framerate)
+	if math.Abs(frame-t*framerate) > 1e-6 {
+		return 0, fmt.Errorf("%gs is not the start of a frame at %g fps", t, framerate)
+	}
+	return uint(frame), nil
+}
+
+func parseOpenGLVersion(openGLVersion, glslVersion string) (renderer.OpenGLVersion, error) {
+	if openGLVersion == "glsl" {
+		return renderer.OpenGLVersionFromGLSLVersion(glslVersion)
+	}
+	return renderer.ParseOpenGLVersion(openGLVersion)
+}
+
+func watchEnvironment(ctx context.Context, engine interface{ SetEnvironment(renderer.Environment) }, newFn func() (renderer.Environment, []string, error), tweak bool) {
 	for ctx.Err() == nil {
 		loopCtx, loopCancel := context.WithCancel(ctx)
 
+		var files []string
 		env, watcher, err := func() (renderer.Environment, *fsnotify.Watcher, error) {
 			watcher, err := fsnotify.NewWatcher()
 			if err != nil {
 				return nil, nil, err
 			}
-			env, files, err := newFn()
+			var env renderer.Environment
+			env, files, err = newFn()
 			for _, f := range files {
 				watcher.Add(f)
 			}
@@ -269,28 +1169,68 @@ func watchEnvironment(ctx context.Context, engine interface{ SetEnvironment(rend
 
 		// Load the new environment.
 		engine.SetEnvironment(env)
+		contents := readWatchedFiles(files)
 
-		select {
-		case <-watcher.Events:
-			t := time.NewTimer(time.Millisecond * 20)
-		outer:
-			for {
-				select {
-				case <-watcher.Events:
-				case <-t.C:
-					break outer
+		for changed := false; !changed; {
+			select {
+			case <-watcher.Events:
+				t := time.NewTimer(time.Millisecond * 20)
+			outer:
+				for {
+					select {
+					case <-watcher.Events:
+					case <-t.C:
+						break outer
+					}
+				}
+				changed = !tweak || !onlyTweaksChanged(contents, readWatchedFiles(files))
+				if !changed {
+					// The renderer reads the new values by itself. Editors
+					// that replace files break the watch, so it is renewed.
+					for _, f := range files {
+						watcher.Add(f)
+					}
 				}
+			case err := <-watcher.Errors:
+				log.Println(err)
+				changed = true
+			case <-loopCtx.Done():
+				changed = true
 			}
-			loopCancel()
-		case err := <-watcher.Errors:
-			log.Println(err)
-		case <-loopCtx.Done():
 		}
 		watcher.Close()
 		loopCancel()
 	}
 }
 
+// readWatchedFiles reads the contents of the files, files that can not be read
+// are left out.
+func readWatchedFiles(files []string) map[string][]byte {
+	contents := map[string][]byte{}
+	for _, f := range files {
+		if b, err := os.ReadFile(f); err == nil {
+			contents[f] = b
+		}
+	}
+	return contents
+}
+
+// onlyTweaksChanged reports whether the files of b differ from a only in the
+// values of tweakable literals, which do not require the shader to be
+// recompiled.
+func onlyTweaksChanged(a, b map[string][]byte) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for f, old := range a {
+		cur, ok := b[f]
+		if !ok || !renderer.TweakOnly(old, cur) {
+			return false
+		}
+	}
+	return true
+}
+
 func limitNumFrames(in <-chan image.Image, desiredTotalNumFrames uint) <-chan image.Image {
 	out := make(chan image.Image)
 	go func() {
@@ -324,6 +1264,81 @@ func limitFramerate(in <-chan image.Image, interval time.Duration) <-chan image.
 	return out
 }
 
+// skipRepeatedFrames drops the frames that the renderer repeats because they
+// would be identical to the previous one.
+func skipRepeatedFrames(in <-chan image.Image) <-chan image.Image {
+	out := make(chan image.Image)
+	go func() {
+		defer close(out)
+		var prev image.Image
+		for img := range in {
+			if img == prev {
+				encode.ReleaseFrame(img)
+				continue
+			}
+			prev = img
+			out <- img
+		}
+	}()
+	return out
+}
+
+// skipUnchangedFrames drops the frames of which all pixels are equal to those
+// of the previous frame that was passed on.
+func skipUnchangedFrames(in <-chan image.Image) <-chan image.Image {
+	out := make(chan image.Image)
+	go func() {
+		defer close(out)
+		var prev image.Image
+		defer func() {
+			if prev != nil {
+				encode.ReleaseFrame(prev)
+			}
+		}()
+		for img := range in {
+			if prev != nil && samePixels(prev, img) {
+				encode.ReleaseFrame(img)
+				continue
+			}
+			if prev != nil {
+				encode.ReleaseFrame(prev)
+			}
+			encode.RetainFrame(img)
+			prev = img
+			out <- img
+		}
+	}()
+	return out
+}
+
+// samePixels compares frames as rendered. Frames of different types are never
+// equal.
+func samePixels(a, b image.Image) bool {
+	if a.Bounds() != b.Bounds() {
+		return false
+	}
+	switch a := a.(type) {
+	case *image.RGBA:
+		b, ok := b.(*image.RGBA)
+		return ok && a.Stride == b.Stride && bytes.Equal(a.Pix, b.Pix)
+	case *encode.RawFrame:
+		b, ok := b.(*encode.RawFrame)
+		return ok && a.Layout == b.Layout && bytes.Equal(a.Pix, b.Pix)
+	case *encode.FloatFrame:
+		b, ok := b.(*encode.FloatFrame)
+		if !ok || len(a.Pix) != len(b.Pix) {
+			return false
+		}
+		for i, v := range a.Pix {
+			if v != b.Pix[i] {
+				return false
+			}
+		}
+		return true
+	}
+	return false
+}
+
 func printStats(in <-chan image.Image, desiredInterval time.Duration, desiredTotalNumFrames uint) <-chan image.Image {
 	out := make(chan image.Image)
 	go func() {
@@ -351,31 +1366,68 @@ func printStats(in <-chan image.Image, desiredInterval time.Duration, desiredTot
 	return out
 }
 
-func parseGeometry(geom string) (uint, uint, error) {
-	if geom == "env" {
-		geom = os.Getenv("LEDCAT_GEOMETRY")
-		if geom == "" {
-			return 0, 0, fmt.Errorf("LEDCAT_GEOMETRY is empty while instructed to load the display geometry from the environment")
+// selectOutputFormat looks up the format by name or detects it from the
+// extension of the output filename if the name is empty. An error is returned
+// if the extension does not match the format that was explicitly requested.
+func selectOutputFormat(name, filename string) (encode.Format, encode.SegmentedFormat, bool, error) {
+	detected, detectedOK := encode.DetectFormat(filename)
+	detectedSegmented, detectedSegmentedOK := encode.DetectSegmentedFormat(filename)
+	if name == "" {
+		switch {
+		case detectedSegmentedOK:
+			return nil, detectedSegmented, true, nil
+		case detectedOK:
+			return detected, encode.SegmentedFormat{}, false, nil
+		default:
+			return nil, encode.SegmentedFormat{}, false, fmt.Errorf("unable to detect the output format of %q, please set the -ofmt flag", filename)
 		}
 	}
 
-	re := regexp.MustCompile(`^(\d+)x(\d+)$`)
-	matches := re.FindStringSubmatch(geom)
-	if matches == nil {
-		return 0, 0, fmt.Errorf("invalid geometry: %q", geom)
+	if segmented, ok := encode.SegmentedFormats[name]; ok {
+		if detectedOK || (detectedSegmentedOK && detectedSegmented != segmented) {
+			return nil, segmented, true, fmt.Errorf("-ofmt %s does not match the extension of %q", name, filename)
+		}
+		return nil, segmented, true, nil
+	}
+	format, ok := encode.Formats[name]
+	if !ok {
+		return nil, encode.SegmentedFormat{}, false, fmt.Errorf("unknown output format %q", name)
+	}
+	if detectedSegmentedOK || (detectedOK && !encode.HasExtension(format, strings.TrimPrefix(filepath.Ext(filename), "."))) {
+		return nil, encode.SegmentedFormat{}, false, fmt.Errorf("-ofmt %s does not match the extension of %q", name, filename)
 	}
-	w, _ := strconv.ParseUint(matches[1], 10, 32)
-	h, _ := strconv.ParseUint(matches[2], 10, 32)
-	if w == 0 || h == 0 {
-		return 0, 0, fmt.Errorf("no geometry dimension can be 0, got (%d, %d)", w, h)
+	return format, encode.SegmentedFormat{}, false, nil
+}
+
+// formatName returns the name of the format in encode.Formats.
+func formatName(format encode.Format) string {
+	for name, f := range encode.Formats {
+		if f == format {
+			return name
+		}
 	}
-	return uint(w), uint(h), nil
+	return ""
+}
+
+// readbackFormat returns the format of the frames that are read back for the
+// output format. If override is empty, the precision of the format is used.
+func readbackFormat(format encode.Format, override string) (renderer.PixelFormat, error) {
+	if override != "" {
+		return renderer.ParsePixelFormat(override)
+	}
+	if f, ok := format.(encode.PrecisionFormat); ok {
+		return renderer.ParsePixelFormat(f.Precision())
+	}
+	return renderer.PixelFormatRGBA8, nil
 }
 
 func openWriter(filename string) (io.WriteCloser, error) {
 	if filename == "-" {
 		return nopCloseWriter{Writer: os.Stdout}, nil
 	}
+	if sink.IsRemote(filename) {
+		return sink.Open(filename)
+	}
 	return os.Create(filename)
 }
 
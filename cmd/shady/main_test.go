@@ -1,8 +1,29 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"image"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"net"
+	"net/url"
 	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
 	"testing"
+	"time"
+
+	"github.com/polyfloyd/shady/encode"
+	"github.com/polyfloyd/shady/renderer"
 )
 
 func TestParseGeometry(t *testing.T) {
@@ -10,15 +31,22 @@ func TestParseGeometry(t *testing.T) {
 		valid := map[string]struct {
 			w, h uint
 		}{
-			"1x2":   {w: 1, h: 2},
-			"2x1":   {w: 2, h: 1},
-			"30x90": {w: 30, h: 90},
-			"env":   {w: 150, h: 16},
+			"1x2":    {w: 1, h: 2},
+			"2x1":    {w: 2, h: 1},
+			"30x90":  {w: 30, h: 90},
+			"env":    {w: 150, h: 16},
+			"720p":   {w: 1280, h: 720},
+			"1080p":  {w: 1920, h: 1080},
+			"480p":   {w: 854, h: 480},
+			"4k":     {w: 3840, h: 2160},
+			"4K":     {w: 3840, h: 2160},
+			"1080x?": {w: 1080, h: 608},
+			"?x1080": {w: 1920, h: 1080},
 		}
 		os.Setenv("LEDCAT_GEOMETRY", "150x16")
 
 		for input, expected := range valid {
-			w, h, err := parseGeometry(input)
+			w, h, err := parseGeometry(input, 16.0/9.0)
 			if err != nil {
 				t.Errorf("error parsing valid geometry %q: %v", input, err)
 			}
@@ -39,13 +67,2098 @@ func TestParseGeometry(t *testing.T) {
 			"x",
 			"fooxbar",
 			"lalala",
+			"?x?",
+			"1080",
 		}
 
 		for _, input := range invalid {
-			_, _, err := parseGeometry(input)
+			_, _, err := parseGeometry(input, 16.0/9.0)
 			if err == nil {
 				t.Errorf("expected an error while parsing invalid geometry %q", input)
 			}
 		}
 	})
 }
+
+func TestParseAspect(t *testing.T) {
+	valid := map[string]float64{
+		"16:9": 16.0 / 9.0,
+		"4:3":  4.0 / 3.0,
+		"1":    1,
+		"2.35": 2.35,
+	}
+	for input, expected := range valid {
+		aspect, err := parseAspect(input)
+		if err != nil {
+			t.Errorf("error parsing valid aspect %q: %v", input, err)
+		}
+		if aspect != expected {
+			t.Errorf("mismatched aspect %v for %q, expected %v", aspect, input, expected)
+		}
+	}
+	for _, input := range []string{"", "16:0", "0", "-1", "a:b", "16/9"} {
+		if _, err := parseAspect(input); err == nil {
+			t.Errorf("expected an error while parsing invalid aspect %q", input)
+		}
+	}
+}
+
+func TestCheckLEDGeometry(t *testing.T) {
+	os.Setenv("LEDCAT_GEOMETRY", "150x16")
+	defer os.Unsetenv("LEDCAT_GEOMETRY")
+	if err := checkLEDGeometry(encode.RGB24Format{}, "-", 150, 16); err != nil {
+		t.Errorf("unexpected error for a matching geometry: %v", err)
+	}
+	if err := checkLEDGeometry(encode.RGB24Format{}, "-", 64, 64); err == nil {
+		t.Errorf("expected an error for a mismatching geometry")
+	}
+	if err := checkLEDGeometry(encode.RGB24Format{}, "out.bin", 64, 64); err != nil {
+		t.Errorf("unexpected error when writing to a file: %v", err)
+	}
+	if err := checkLEDGeometry(encode.PNGFormat{}, "-", 64, 64); err != nil {
+		t.Errorf("unexpected error for an image format: %v", err)
+	}
+}
+
+func TestParseThrottlePolicy(t *testing.T) {
+	valid := map[string]throttlePolicy{
+		"":      {},
+		"pause": {enabled: true, pause: true},
+		"10":    {enabled: true, fps: 10},
+		"0.5":   {enabled: true, fps: 0.5},
+	}
+	for input, expected := range valid {
+		p, err := parseThrottlePolicy(input)
+		if err != nil {
+			t.Errorf("error parsing valid throttle policy %q: %v", input, err)
+		}
+		if p != expected {
+			t.Errorf("mismatched result for %q: %+v, expected %+v", input, p, expected)
+		}
+	}
+
+	invalid := []string{"0", "-1", "stop", " "}
+	for _, input := range invalid {
+		if _, err := parseThrottlePolicy(input); err == nil {
+			t.Errorf("expected an error while parsing invalid throttle policy %q", input)
+		}
+	}
+}
+
+func TestPauser(t *testing.T) {
+	var applied []bool
+	p := newPauser(func(paused bool) { applied = append(applied, paused) })
+
+	p.Set("throttle", true)
+	if !p.Toggle("signal") || !p.Paused() {
+		t.Fatalf("expected to be paused")
+	}
+	p.Set("throttle", false)
+	if !p.Paused() {
+		t.Fatalf("resuming for one reason should not resume for another")
+	}
+	if p.Toggle("signal") || p.Paused() {
+		t.Fatalf("expected to be resumed")
+	}
+	if len(applied) != 2 || !applied[0] || applied[1] {
+		t.Fatalf("unexpected state changes: %v", applied)
+	}
+}
+
+func TestCheckHealth(t *testing.T) {
+	timeout := 10 * time.Second
+	f := supervisorFlags{healthTimeout: &timeout}
+	now := time.Now()
+
+	if err := f.checkHealth(renderer.HealthStatus{LastFrame: now}, now, false); err != nil {
+		t.Errorf("expected healthy after recent frame, got %v", err)
+	}
+	if err := f.checkHealth(renderer.HealthStatus{}, now, false); err != nil {
+		t.Errorf("expected healthy right after starting, got %v", err)
+	}
+	if err := f.checkHealth(renderer.HealthStatus{LastFrame: now.Add(-time.Minute)}, now, false); err == nil {
+		t.Errorf("expected unhealthy after stale frame")
+	}
+	if err := f.checkHealth(renderer.HealthStatus{LastFrame: now.Add(-time.Minute)}, now, true); err != nil {
+		t.Errorf("expected healthy while paused, got %v", err)
+	}
+	if err := f.checkHealth(renderer.HealthStatus{LastFrame: now, LastError: errors.New("oops")}, now, false); err == nil {
+		t.Errorf("expected unhealthy after error")
+	}
+}
+
+func TestSkipRepeatedFrames(t *testing.T) {
+	a := image.NewRGBA(image.Rect(0, 0, 1, 1))
+	b := image.NewRGBA(image.Rect(0, 0, 1, 1))
+	in := make(chan image.Image, 5)
+	for _, img := range []image.Image{a, a, b, b, a} {
+		in <- img
+	}
+	close(in)
+	var out []image.Image
+	for img := range skipRepeatedFrames(in) {
+		out = append(out, img)
+	}
+	if len(out) != 3 || out[0] != a || out[1] != b || out[2] != a {
+		t.Errorf("unexpected frames: %v", out)
+	}
+}
+
+func TestCrossfadeLoop(t *testing.T) {
+	frame := func(v uint8) *image.RGBA {
+		img := image.NewRGBA(image.Rect(0, 0, 1, 1))
+		img.Pix[0] = v
+		return img
+	}
+	in := make(chan image.Image, 6)
+	for _, v := range []uint8{0, 30, 60, 90, 120, 150} {
+		in <- frame(v)
+	}
+	close(in)
+	var out []uint8
+	for img := range crossfadeLoop(in, 4, 2) {
+		out = append(out, img.(*image.RGBA).Pix[0])
+	}
+	// The frames after the loop fade into the first two frames: 120 to 0
+	// and 150 to 30.
+	expected := []uint8{60, 90, 80, 70}
+	if !reflect.DeepEqual(out, expected) {
+		t.Errorf("frames = %v, expected %v", out, expected)
+	}
+}
+
+func TestMixFrames(t *testing.T) {
+	a := &encode.FloatFrame{Rect: image.Rect(0, 0, 1, 1), Pix: []float32{0, 1, 2, 1}}
+	b := &encode.FloatFrame{Rect: image.Rect(0, 0, 1, 1), Pix: []float32{1, 1, 0, 1}}
+	mixed := mixFrames(a, b, 0.25).(*encode.FloatFrame)
+	if expected := []float32{0.25, 1, 1.5, 1}; !reflect.DeepEqual(mixed.Pix, expected) {
+		t.Errorf("float frame = %v, expected %v", mixed.Pix, expected)
+	}
+
+	gray := image.NewGray(image.Rect(0, 0, 1, 1))
+	white := image.NewRGBA(image.Rect(0, 0, 1, 1))
+	copy(white.Pix, []uint8{255, 255, 255, 255})
+	r, g, _, a16 := mixFrames(gray, white, 0.5).At(0, 0).RGBA()
+	if r != 0x8000 || g != 0x8000 || a16 != 0xffff {
+		t.Errorf("mixed gray and white = %x %x %x, expected 8000 8000 ffff", r, g, a16)
+	}
+}
+
+func TestOverlay(t *testing.T) {
+	cases := []struct {
+		spec     string
+		file     string
+		position string
+		opacity  float64
+	}{
+		{"logo.png", "logo.png", "bottom-right", 1},
+		{"logo.png@top-left", "logo.png", "top-left", 1},
+		{"dir@2/logo.png@center:0.5", "dir@2/logo.png", "center", 0.5},
+	}
+	for _, c := range cases {
+		file, position, opacity, err := parseOverlay(c.spec)
+		if err != nil {
+			t.Fatalf("%q: %v", c.spec, err)
+		}
+		if file != c.file || position != c.position || opacity != c.opacity {
+			t.Errorf("%q: unexpected %q, %q, %v", c.spec, file, position, opacity)
+		}
+	}
+	for _, spec := range []string{"logo.png@middle", "logo.png@top:2", "logo.png@top:x"} {
+		if _, _, _, err := parseOverlay(spec); err == nil {
+			t.Errorf("expected an error for %q", spec)
+		}
+	}
+
+	logo := image.NewRGBA(image.Rect(0, 0, 4, 2))
+	for i := range logo.Pix {
+		logo.Pix[i] = 255
+	}
+	ov := newOverlay(logo, "bottom-right", 0.5)
+	frame := image.Rect(0, 0, 64, 32)
+	if r := ov.rect(frame); r != image.Rect(59, 29, 63, 31) {
+		t.Errorf("unexpected rect of the overlay: %v", r)
+	}
+	if r := newOverlay(logo, "center", 1).rect(frame); r != image.Rect(30, 15, 34, 17) {
+		t.Errorf("unexpected rect of a centered overlay: %v", r)
+	}
+
+	img := image.NewRGBA(frame)
+	in := make(chan image.Image, 2)
+	in <- img
+	in <- img
+	close(in)
+	for range ov.stream(in) {
+	}
+	if c := img.RGBAAt(60, 30); c.R != 128 || c.A != 128 {
+		t.Errorf("unexpected color under the overlay: %v", c)
+	}
+	if c := img.RGBAAt(58, 30); c.A != 0 {
+		t.Errorf("unexpected color next to the overlay: %v", c)
+	}
+}
+
+func TestSkipUnchangedFrames(t *testing.T) {
+	a := image.NewRGBA(image.Rect(0, 0, 1, 1))
+	b := image.NewRGBA(image.Rect(0, 0, 1, 1))
+	c := image.NewRGBA(image.Rect(0, 0, 1, 1))
+	c.Pix[0] = 1
+	in := make(chan image.Image, 4)
+	for _, img := range []image.Image{a, b, c, a} {
+		in <- img
+	}
+	close(in)
+	var out []image.Image
+	for img := range skipUnchangedFrames(in) {
+		out = append(out, img)
+	}
+	if len(out) != 3 || out[0] != a || out[1] != c || out[2] != a {
+		t.Errorf("unexpected frames: %v", out)
+	}
+}
+
+func TestIsSequencePattern(t *testing.T) {
+	cases := map[string]bool{
+		"out.png":           false,
+		"-":                 false,
+		"100%%.png":         false,
+		"frame-%d.png":      true,
+		"frame-%04d.png":    true,
+		"dir/%6d.jpg":       true,
+		"100%%-frame%d.png": true,
+	}
+	for input, expected := range cases {
+		if got := isSequencePattern(input); got != expected {
+			t.Errorf("isSequencePattern(%q) = %v, expected %v", input, got, expected)
+		}
+	}
+}
+
+func TestFrameHookExpand(t *testing.T) {
+	h := newFrameHook("upload {file} --name={frame}", 1)
+	expected := `upload 'it'\''s 1.png' --name=1`
+	if got := h.expand(1, "it's 1.png"); got != expected {
+		t.Errorf("unexpected expansion %q, expected %q", got, expected)
+	}
+}
+
+func TestSnapshotSchedule(t *testing.T) {
+	now := time.Date(2020, 3, 4, 13, 37, 0, 0, time.UTC)
+	cases := map[string]time.Time{
+		"every=1h":          time.Date(2020, 3, 4, 14, 0, 0, 0, time.UTC),
+		"every=15m,dir=out": time.Date(2020, 3, 4, 13, 45, 0, 0, time.UTC),
+		"at=18:00":          time.Date(2020, 3, 4, 18, 0, 0, 0, time.UTC),
+		"at=06:30":          time.Date(2020, 3, 5, 6, 30, 0, 0, time.UTC),
+	}
+	for input, expected := range cases {
+		sched, err := parseSnapshotSchedule(input)
+		if err != nil {
+			t.Errorf("error parsing valid schedule %q: %v", input, err)
+			continue
+		}
+		if next := sched.next(now); !next.Equal(expected) {
+			t.Errorf("next snapshot for %q is %v, expected %v", input, next, expected)
+		}
+	}
+
+	invalid := []string{"", "every", "every=1ms", "at=25:00", "dir=out", "every=1h,at=06:00", "foo=bar"}
+	for _, input := range invalid {
+		if _, err := parseSnapshotSchedule(input); err == nil {
+			t.Errorf("expected an error while parsing invalid schedule %q", input)
+		}
+	}
+}
+
+func TestExpandTemplate(t *testing.T) {
+	vars := outputVars{
+		frame:  42,
+		time:   1500 * time.Millisecond,
+		date:   time.Date(2020, 3, 4, 13, 37, 0, 0, time.UTC),
+		shader: "plasma",
+		seed:   7,
+	}
+	cases := map[string]string{
+		"out.png":                     "out.png",
+		"{shader}-{frame}.png":        "plasma-42.png",
+		"{frame:05d}.png":             "00042.png",
+		"t{time:.2f}.png":             "t1.50.png",
+		"{date}/{shader}.png":         "2020-03-04/plasma.png",
+		"{date:20060102-1504}.png":    "20200304-1337.png",
+		"{shader}-seed{seed:03d}.gif": "plasma-seed007.gif",
+	}
+	for input, expected := range cases {
+		got, err := expandTemplate(input, vars)
+		if err != nil {
+			t.Errorf("error expanding %q: %v", input, err)
+		} else if got != expected {
+			t.Errorf("expanded %q to %q, expected %q", input, got, expected)
+		}
+	}
+
+	for _, input := range []string{"{foo}.png", "{frame:%d}.png", "{frame:05}.png"} {
+		if err := validateTemplate(input); err == nil {
+			t.Errorf("expected an error for invalid template %q", input)
+		}
+	}
+}
+
+func TestSelectOutputFormat(t *testing.T) {
+	valid := []struct {
+		name, filename string
+		format         encode.Format
+		segmented      bool
+	}{
+		{"", "out.png", encode.PNGFormat{}, false},
+		{"", "out.jpeg", encode.JPGFormat{}, false},
+		{"", "frames/%04d.png", encode.PNGFormat{}, false},
+		{"", "live/stream.m3u8", nil, true},
+		{"rgb24", "-", encode.RGB24Format{}, false},
+		{"rgba32", "out.raw", encode.RGBA32Format{}, false},
+		{"gif", "out.gif", encode.GIFFormat{}, false},
+		{"dash", "live/stream.mpd", nil, true},
+		{"", "out.mp4", encode.Formats["mp4"], false},
+		{"webm", "-", encode.Formats["webm"], false},
+		{"png16", "out.png", encode.PNG16Format{}, false},
+		{"png16", "frames/%04d.png", encode.PNG16Format{}, false},
+		{"", "loop.apng", encode.APNGFormat{}, false},
+		{"apng", "loop.png", encode.APNGFormat{}, false},
+	}
+	for _, c := range valid {
+		format, _, segmented, err := selectOutputFormat(c.name, c.filename)
+		if err != nil {
+			t.Errorf("unexpected error for -ofmt %q -o %q: %v", c.name, c.filename, err)
+			continue
+		}
+		if format != c.format || segmented != c.segmented {
+			t.Errorf("unexpected format for -ofmt %q -o %q: %#v", c.name, c.filename, format)
+		}
+	}
+
+	invalid := [][2]string{
+		{"", "-"},
+		{"", "out.rgb"},
+		{"png", "out.gif"},
+		{"hls", "out.mpd"},
+		{"gif", "out.m3u8"},
+		{"mkv", "out.mp4"},
+		{"nope", "out.png"},
+		{"png16", "out.exr"},
+		{"apng", "loop.gif"},
+	}
+	for _, c := range invalid {
+		if _, _, _, err := selectOutputFormat(c[0], c[1]); err == nil {
+			t.Errorf("expected an error for -ofmt %q -o %q", c[0], c[1])
+		}
+	}
+}
+
+func TestReadbackFormat(t *testing.T) {
+	cases := []struct {
+		format   encode.Format
+		override string
+		expected renderer.PixelFormat
+	}{
+		{encode.PNGFormat{}, "", renderer.PixelFormatRGBA8},
+		{encode.EXRFormat{}, "", renderer.PixelFormatRGBA16F},
+		{encode.X2RGB10Format{}, "", renderer.PixelFormatRGB10A2},
+		{encode.PNG16Format{}, "", renderer.PixelFormatRGBA16F},
+		{encode.EXRFormat{}, "rgba32f", renderer.PixelFormatRGBA32F},
+		{encode.PNGFormat{}, "rgba16f", renderer.PixelFormatRGBA16F},
+		{nil, "", renderer.PixelFormatRGBA8},
+	}
+	for _, c := range cases {
+		format, err := readbackFormat(c.format, c.override)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if format != c.expected {
+			t.Errorf("readback of %T with %q = %s, expected %s", c.format, c.override, format, c.expected)
+		}
+	}
+	if _, err := readbackFormat(encode.PNGFormat{}, "rgb9"); err == nil {
+		t.Errorf("expected an error for an unknown format")
+	}
+}
+
+func TestBufferExport(t *testing.T) {
+	if _, _, err := parseExportTarget("state"); err == nil {
+		t.Errorf("expected an error for an export without a file")
+	}
+	name, filename, err := parseExportTarget("state=out/state-{frame:02d}.npy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if name != "state" || filename != "out/state-{frame:02d}.npy" {
+		t.Fatalf("unexpected export target: %q, %q", name, filename)
+	}
+
+	dir := t.TempDir()
+	if _, err := newBufferExport(filepath.Join(dir, "state.npy"), encode.DataFloat32, outputVars{}, time.Second, 0); err == nil {
+		t.Errorf("expected an error for exporting multiple frames to a single npy file")
+	}
+	export, err := newBufferExport(filepath.Join(dir, filename), encode.DataFloat16, outputVars{}, time.Second, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer export.Close()
+	for frame := uint64(0); frame < 3; frame++ {
+		data := renderer.PixelData{Width: 2, Height: 1, Frame: frame, Pix: make([]float32, 8)}
+		if err := export.Write(data); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for frame, exists := range []bool{true, true, false} {
+		_, err := os.Stat(filepath.Join(dir, fmt.Sprintf("out/state-%02d.npy", frame)))
+		if exists && err != nil {
+			t.Errorf("frame %d was not exported: %v", frame, err)
+		} else if !exists && err == nil {
+			t.Errorf("frame %d exceeds the limit but was exported", frame)
+		}
+	}
+}
+
+func TestMetricsWriter(t *testing.T) {
+	if _, err := parseMetricsColumns("energy,,mass"); err == nil {
+		t.Errorf("expected an error for an empty column name")
+	}
+	columns, err := parseMetricsColumns("energy, mass")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The bottom row of a 1x2 buffer is its last pixel.
+	data := func(frame uint64, values ...float32) renderer.PixelData {
+		return renderer.PixelData{Width: 1, Height: 2, Frame: frame, Pix: append([]float32{9, 9, 9, 9}, values...)}
+	}
+
+	var buf bytes.Buffer
+	m := newMetricsWriter("stats", &buf, columns, 500*time.Millisecond)
+	m.update(data(0, 1, 0.5, 0, 1))
+	m.update(data(1, 2, 0.25, 0, 1))
+	if expected := "frame,time,energy,mass\n0,0,1,0.5\n1,0.5,2,0.25\n"; buf.String() != expected {
+		t.Errorf("csv = %q, expected %q", buf.String(), expected)
+	}
+
+	buf.Reset()
+	m = newMetricsWriter("stats", &buf, nil, time.Second)
+	m.update(data(3, 1, 2, 3, 4))
+	if expected := "frame,time,0.r,0.g,0.b,0.a\n3,3,1,2,3,4\n"; buf.String() != expected {
+		t.Errorf("csv = %q, expected %q", buf.String(), expected)
+	}
+
+	m = newMetricsWriter("stats", io.Discard, []string{"a", "b", "c", "d", "e"}, time.Second)
+	if err := m.write(data(0, 1, 2, 3, 4)); err == nil {
+		t.Errorf("expected an error for more columns than values")
+	}
+}
+
+func TestPassDump(t *testing.T) {
+	dir := t.TempDir()
+	for _, pattern := range []string{"debug/image.png", "debug/{pass}.txt", "debug/{pass}.png"} {
+		if _, err := newPassDump(filepath.Join(dir, pattern), outputVars{}, time.Second, 0); err == nil {
+			t.Errorf("%q is accepted for multiple frames", pattern)
+		}
+	}
+	dump, err := newPassDump(filepath.Join(dir, "{frame}/{shader}-{pass}.png"), outputVars{shader: "sim"}, time.Second, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for frame := uint64(0); frame < 2; frame++ {
+		data := renderer.PixelData{Width: 2, Height: 1, Frame: frame, Pix: []float32{1, 0, 0, 0, 0, 1, 0, 0.5}}
+		if err := dump.WritePass("BufA", data); err != nil {
+			t.Fatal(err)
+		}
+	}
+	in := make(chan image.Image, 1)
+	in <- image.NewRGBA(image.Rect(0, 0, 2, 1))
+	close(in)
+	for range dump.stream(in) {
+	}
+
+	fd, err := os.Open(filepath.Join(dir, "0/sim-BufA.png"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fd.Close()
+	img, err := png.Decode(fd)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, _, a := img.At(0, 0).RGBA(); a != 0xffff {
+		t.Errorf("the alpha of the dumped pass is %#x, expected it to be opaque", a)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "0/sim-image.png")); err != nil {
+		t.Errorf("the final image was not dumped: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "1/sim-BufA.png")); err == nil {
+		t.Errorf("a frame past the limit was dumped")
+	}
+}
+
+func TestCreateProject(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "sim")
+	vars := projectVars{Width: 128, Height: 64, Format: "rgba16f"}
+	if err := createProject(dir, projectTemplates["simulation"], vars, false); err != nil {
+		t.Fatal(err)
+	}
+	display, err := os.ReadFile(filepath.Join(dir, "display.glsl"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(display), "#pragma map state=buffer:state.glsl;128x64;rgba16f") {
+		t.Errorf("the display pass does not map the state buffer:\n%s", display)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "state.glsl")); err != nil {
+		t.Errorf("the state pass was not created: %v", err)
+	}
+	if err := createProject(dir, projectTemplates["simulation"], vars, false); err == nil {
+		t.Errorf("expected an error when overwriting existing files")
+	}
+	if err := createProject(dir, projectTemplates["simulation"], vars, true); err != nil {
+		t.Errorf("unexpected error when overwriting with force: %v", err)
+	}
+}
+
+func TestGalleryShaders(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string]string{
+		"image.glsl":       "#pragma buffer \"buf.glsl\" as BufA\nvoid mainImage(out vec4 c, in vec2 p) {}\n",
+		"buf.glsl":         "void mainImage(out vec4 c, in vec2 p) {}\n",
+		"lib.glsl":         "float f(float x) { return x; }\n",
+		"sim/display.glsl": "#pragma map state=buffer:state.glsl;128x64\nvoid mainImage(out vec4 c, in vec2 p) {}\n",
+		"sim/state.glsl":   "void mainImage(out vec4 c, in vec2 p) {}\n",
+	}
+	for name, src := range files {
+		path := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(src), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	shaders, err := galleryShaders(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := []string{"image.glsl", "sim/display.glsl"}; !reflect.DeepEqual(shaders, expected) {
+		t.Errorf("unexpected shaders %q, expected %q", shaders, expected)
+	}
+	if slug := gallerySlug("sim/display.glsl"); slug != "sim-display" {
+		t.Errorf("unexpected slug %q", slug)
+	}
+}
+
+func TestWriteGalleryIndex(t *testing.T) {
+	var buf bytes.Buffer
+	items := []galleryItem{
+		{Name: "a.glsl", Thumb: "thumbs/a.png", Loop: "loops/a.gif"},
+		{Name: "b.glsl", Thumb: "thumbs/b.png", Loop: "loops/b.gif", Error: "0:1(1): error: <syntax>"},
+	}
+	if err := writeGalleryIndex(&buf, "shaders", items); err != nil {
+		t.Fatal(err)
+	}
+	html := buf.String()
+	if !strings.Contains(html, `<img src="thumbs/a.png" data-loop="loops/a.gif"`) {
+		t.Errorf("the thumbnail of a.glsl is missing:\n%s", html)
+	}
+	if strings.Contains(html, "thumbs/b.png") || !strings.Contains(html, "error: &lt;syntax&gt;") {
+		t.Errorf("the error of b.glsl is not shown instead of its thumbnail:\n%s", html)
+	}
+}
+
+func TestREPLShader(t *testing.T) {
+	cases := map[string]string{
+		"uv.x":                       "vec3 color = vec3(uv.x);",
+		"vec3(uv, 0.0);":             "vec3 color = vec3(vec3(uv, 0.0));",
+		"vec3 color = vec3(1, 0, 0)": "vec3 color = vec3(1, 0, 0);",
+		"float d = length(p); vec3 color = vec3(d);": "float d = length(p); vec3 color = vec3(d);",
+		"vec3(color == vec3(0))":                     "vec3 color = vec3(vec3(color == vec3(0)));",
+	}
+	for line, expected := range cases {
+		rs := &replShader{}
+		rs.setLine(line)
+		if rs.body != expected {
+			t.Errorf("unexpected body for %q: %q, expected %q", line, rs.body, expected)
+		}
+	}
+
+	rs := &replShader{decls: []string{"float f(float x) { return x; }"}}
+	rs.setLine("f(t)")
+	src := rs.source()
+	if !strings.HasPrefix(src, "float f(float x) { return x; }\n") {
+		t.Errorf("declarations are missing from the source:\n%s", src)
+	}
+	if !strings.Contains(src, "vec3 color = vec3(f(t));") {
+		t.Errorf("the body is missing from the source:\n%s", src)
+	}
+}
+
+func TestListDevices(t *testing.T) {
+	sys, proc := t.TempDir(), t.TempDir()
+	for _, cam := range []struct{ dev, name string }{{"video10", "Capture Card"}, {"video0", "Integrated Camera"}} {
+		dir := filepath.Join(sys, "class/video4linux", cam.dev)
+		os.MkdirAll(dir, 0o755)
+		os.WriteFile(filepath.Join(dir, "name"), []byte(cam.name+"\n"), 0o644)
+	}
+	os.MkdirAll(filepath.Join(proc, "asound"), 0o755)
+	os.WriteFile(filepath.Join(proc, "asound/pcm"), []byte(
+		"00-00: ALC892 Analog : ALC892 Analog : playback 1 : capture 1\n"+
+			"00-01: ALC892 Digital : ALC892 Digital : playback 1\n"+
+			"01-00: USB Audio : USB Audio : capture 1\n"), 0o644)
+
+	items, err := listDevices(sys, proc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []listItem{
+		{"webcam", "/dev/video0", "Integrated Camera"},
+		{"webcam", "/dev/video10", "Capture Card"},
+		{"audio", "hw:0,0", "ALC892 Analog"},
+		{"audio", "hw:1,0", "USB Audio"},
+	}
+	if fmt.Sprint(items) != fmt.Sprint(expected) {
+		t.Errorf("unexpected devices: %v, expected %v", items, expected)
+	}
+}
+
+func TestCompletion(t *testing.T) {
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	fs.String("ofmt", "", "The output format. More details")
+	fs.Bool("v", false, "Verbose")
+	fs.String("i", "", "Input's file")
+
+	var bash strings.Builder
+	if err := writeBashCompletion(&bash, fs); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(bash.String(), `compgen -W "-i -ofmt -v"`) {
+		t.Errorf("flags are missing from the bash completion:\n%s", bash.String())
+	}
+	var fish strings.Builder
+	if err := writeFishCompletion(&fish, fs); err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range []string{
+		`complete -c shady -o ofmt -d 'The output format' -x -a '(shady list outputs 2>/dev/null)'`,
+		`complete -c shady -o v -d 'Verbose'` + "\n",
+		`complete -c shady -o i -d 'Input\'s file' -r -F`,
+	} {
+		if !strings.Contains(fish.String(), line) {
+			t.Errorf("missing %q in the fish completion:\n%s", line, fish.String())
+		}
+	}
+}
+
+func TestCapabilityReport(t *testing.T) {
+	report, err := newCapabilityReport(t.TempDir(), t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := json.Marshal(report)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var decoded map[string]interface{}
+	if err := json.Unmarshal(b, &decoded); err != nil {
+		t.Fatal(err)
+	}
+	// Frontends should not have to deal with nulls for empty lists.
+	for _, key := range []string{"output_formats", "inputs", "gpus", "devices"} {
+		if _, ok := decoded[key].([]interface{}); !ok {
+			t.Errorf("%s is not a list: %s", key, b)
+		}
+	}
+	formats := decoded["output_formats"].([]interface{})
+	if len(formats) == 0 {
+		t.Errorf("no output formats reported")
+	}
+}
+
+func TestCIEnvironment(t *testing.T) {
+	env := map[string]string{
+		"vblank_mode": "1",
+	}
+	getenv := func(name string) string { return env[name] }
+
+	vars := ciEnvironment(getenv, false)
+	if vars["LIBGL_ALWAYS_SOFTWARE"] != "1" {
+		t.Errorf("software rendering is not selected: %v", vars)
+	}
+	if _, ok := vars["vblank_mode"]; ok {
+		t.Errorf("variables that are already set should not be overridden: %v", vars)
+	}
+	if vars["EGL_PLATFORM"] != "surfaceless" {
+		t.Errorf("offscreen rendering without a display should be surfaceless: %v", vars)
+	}
+	if vars := ciEnvironment(getenv, true); vars["EGL_PLATFORM"] != "" {
+		t.Errorf("rendering to a window should not be surfaceless: %v", vars)
+	}
+	env["DISPLAY"] = ":0"
+	if vars := ciEnvironment(getenv, false); vars["EGL_PLATFORM"] != "" {
+		t.Errorf("an existing display should be used: %v", vars)
+	}
+}
+
+func TestRenderJob(t *testing.T) {
+	job, err := parseRenderJob([]byte(`{
+		"id": "intro-2",
+		"shaders": ["intro.glsl"],
+		"geometry": "1080p",
+		"framerate": 30,
+		"frames": {"first": 100, "last": 199},
+		"outputs": [
+			{"file": "frames/{frame:04d}.png"},
+			{"file": "state-{frame:04d}.npy", "buffer": "state"}
+		]
+	}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{
+		"-i", "intro.glsl",
+		"-g", "1080p",
+		"-f", "30",
+		"-start", "100", "-n", "100",
+		"-o", "frames/{frame:04d}.png",
+		"-export", "state=state-{frame:04d}.npy",
+	}
+	if args := job.args(); !reflect.DeepEqual(args, expected) {
+		t.Errorf("unexpected args:\n got:  %q\n want: %q", args, expected)
+	}
+
+	invalid := []string{
+		`{"geometry": "1080p", "outputs": [{"file": "out.png"}]}`,
+		`{"shaders": ["a.glsl"], "geometry": "1080p", "outputs": []}`,
+		`{"shaders": ["a.glsl"], "geometry": "1080p", "frames": {"first": 0, "last": 9}, "outputs": [{"file": "out.png"}]}`,
+		`{"shaders": ["a.glsl"], "geometry": "1080p", "framerate": 30, "frames": {"first": 9, "last": 0}, "outputs": [{"file": "out.png"}]}`,
+	}
+	for _, data := range invalid {
+		if _, err := parseRenderJob([]byte(data)); err == nil {
+			t.Errorf("expected an error for %s", data)
+		}
+	}
+}
+
+func TestDirJobQueue(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name, data string) {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(data), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write("a.json", `{"shaders": ["a.glsl"], "geometry": "64x64", "outputs": [{"file": "a.png"}]}`)
+	write("b.json", `{"shaders": [], "geometry": "64x64", "outputs": [{"file": "b.png"}]}`)
+	write("c.json", `{"id": "c", "shaders": ["c.glsl"], "geometry": "64x64", "outputs": [{"file": "c.png"}]}`)
+	exists := func(name string) bool {
+		_, err := os.Stat(filepath.Join(dir, name))
+		return err == nil
+	}
+
+	q := newDirJobQueue(dir)
+	job, jobDir, err := q.Take(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if job.ID != "a" || jobDir != dir || !exists("a.json.running") {
+		t.Fatalf("unexpected job %q in %q", job.ID, jobDir)
+	}
+	if err := q.Finish(job, []byte("rendered\n"), nil); err != nil {
+		t.Fatal(err)
+	}
+	if !exists("a.json.done") || !exists("a.log") {
+		t.Errorf("a was not marked as done")
+	}
+
+	// b is invalid and skipped.
+	job, _, err = q.Take(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if job.ID != "c" || !exists("b.json.failed") {
+		t.Fatalf("unexpected job %q", job.ID)
+	}
+	if err := q.Finish(job, nil, context.Canceled); err != nil {
+		t.Fatal(err)
+	}
+	if !exists("c.json") {
+		t.Errorf("interrupted job was not returned to the queue")
+	}
+	job, _, _ = q.Take(context.Background())
+	if err := q.Finish(job, nil, errors.New("exit status 1")); err != nil {
+		t.Fatal(err)
+	}
+	if !exists("c.json.failed") {
+		t.Errorf("c was not marked as failed")
+	}
+	if _, _, err := q.Take(context.Background()); !errors.Is(err, errNoJob) {
+		t.Errorf("expected an empty queue, got %v", err)
+	}
+}
+
+func TestJobAssets(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "tex.png"), []byte("texture"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	job := renderJob{Assets: []jobAsset{{
+		Path:   "tex.png",
+		SHA256: strings.Repeat("0", 64),
+	}}}
+	if err := job.fetchAssets(dir); err == nil {
+		t.Errorf("expected a checksum mismatch")
+	}
+	job.Assets[0].SHA256, _ = fileSHA256(filepath.Join(dir, "tex.png"))
+	if err := job.fetchAssets(dir); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestProgressWriter(t *testing.T) {
+	var frames []uint
+	w := &progressWriter{fn: func(frame uint) {
+		frames = append(frames, frame)
+	}}
+	fmt.Fprint(w, "\rfps=30.00 frames=1/10 speed=1.00")
+	fmt.Fprint(w, "\rfps=30.00 frames=2/10 spe")
+	fmt.Fprint(w, "ed=1.00\rfps=30.00 frames=3/10 speed=1.00\n")
+	if !reflect.DeepEqual(frames, []uint{1, 3}) {
+		t.Errorf("unexpected progress: %v", frames)
+	}
+}
+
+// fakeRedis implements the list and pub/sub commands used by the job queue.
+type fakeRedis struct {
+	lists     map[string][]string
+	published map[string][]string
+}
+
+func (f *fakeRedis) serve(l net.Listener) {
+	conn, err := l.Accept()
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	for {
+		cmd, err := readRedisReply(r)
+		if err != nil {
+			return
+		}
+		var args []string
+		for _, arg := range cmd.([]interface{}) {
+			args = append(args, string(arg.([]byte)))
+		}
+		switch args[0] {
+		case "RPOPLPUSH":
+			src := f.lists[args[1]]
+			if len(src) == 0 {
+				fmt.Fprint(conn, "$-1\r\n")
+				continue
+			}
+			v := src[len(src)-1]
+			f.lists[args[1]] = src[:len(src)-1]
+			f.lists[args[2]] = append([]string{v}, f.lists[args[2]]...)
+			fmt.Fprintf(conn, "$%d\r\n%s\r\n", len(v), v)
+		case "LPUSH":
+			f.lists[args[1]] = append([]string{args[2]}, f.lists[args[1]]...)
+			fmt.Fprint(conn, ":1\r\n")
+		case "RPUSH":
+			f.lists[args[1]] = append(f.lists[args[1]], args[2])
+			fmt.Fprint(conn, ":1\r\n")
+		case "LREM":
+			var kept []string
+			for _, v := range f.lists[args[1]] {
+				if v != args[3] {
+					kept = append(kept, v)
+				}
+			}
+			f.lists[args[1]] = kept
+			fmt.Fprint(conn, ":1\r\n")
+		case "PUBLISH":
+			f.published[args[1]] = append(f.published[args[1]], args[2])
+			fmt.Fprint(conn, ":0\r\n")
+		default:
+			fmt.Fprintf(conn, "-ERR unknown command '%s'\r\n", args[0])
+		}
+	}
+}
+
+func TestRedisJobQueue(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	job := `{"id": "a", "shaders": ["a.glsl"], "geometry": "64x64", "outputs": [{"file": "s3://bucket/a.png"}]}`
+	server := &fakeRedis{
+		lists:     map[string][]string{"jobs": {job}},
+		published: map[string][]string{},
+	}
+	go server.serve(l)
+
+	u, _ := url.Parse("redis://" + l.Addr().String() + "?key=jobs")
+	q := newRedisJobQueue(u, "test")
+	taken, dir, err := q.Take(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if taken.ID != "a" || dir != "" {
+		t.Fatalf("unexpected job %q in %q", taken.ID, dir)
+	}
+	if running := server.lists["jobs:running"]; len(running) != 1 {
+		t.Errorf("job is not marked as running: %v", server.lists)
+	}
+	if err := q.Progress(taken, 5, 10); err != nil {
+		t.Fatal(err)
+	}
+	if err := q.Finish(taken, []byte("rendered\n"), nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := q.Take(context.Background()); !errors.Is(err, errNoJob) {
+		t.Errorf("expected an empty queue, got %v", err)
+	}
+
+	if running := server.lists["jobs:running"]; len(running) != 0 {
+		t.Errorf("finished job is still running: %v", running)
+	}
+	if results := server.lists["jobs:results"]; len(results) != 1 || !strings.Contains(results[0], `"event":"done"`) {
+		t.Errorf("unexpected results: %v", results)
+	}
+	var events []string
+	for _, data := range server.published["jobs:events"] {
+		var event jobEvent
+		if err := json.Unmarshal([]byte(data), &event); err != nil {
+			t.Fatal(err)
+		}
+		if event.ID != "a" || event.Worker != "test" {
+			t.Errorf("unexpected event: %s", data)
+		}
+		events = append(events, event.Event)
+	}
+	if !reflect.DeepEqual(events, []string{"started", "progress", "done"}) {
+		t.Errorf("unexpected events: %v", events)
+	}
+}
+
+func TestReadNATSMsg(t *testing.T) {
+	msg, err := readNATSMsg("MSG _INBOX.x.1 1 $JS.ACK.SHADY.workers.1.1.1.0.0 5", bufio.NewReader(strings.NewReader("hello\r\n")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msg.subject != "_INBOX.x.1" || msg.reply != "$JS.ACK.SHADY.workers.1.1.1.0.0" || string(msg.data) != "hello" || msg.status != "" {
+		t.Errorf("unexpected message: %+v", msg)
+	}
+
+	hdr := "NATS/1.0 404 No Messages\r\n\r\n"
+	line := fmt.Sprintf("HMSG _INBOX.x.2 1 %d %d", len(hdr), len(hdr))
+	msg, err = readNATSMsg(line, bufio.NewReader(strings.NewReader(hdr+"\r\n")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msg.status != "404" || len(msg.data) != 0 {
+		t.Errorf("unexpected message: %+v", msg)
+	}
+}
+
+func TestWriteSource(t *testing.T) {
+	dir := t.TempDir()
+	filename, err := writeSource(dir, "test:bars")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b, err := os.ReadFile(filename); err != nil || !strings.Contains(string(b), "mainImage") {
+		t.Errorf("unexpected source in %s: %v", filename, err)
+	}
+	for _, source := range []string{"bars", "test:nope", "file:bars"} {
+		if _, err := writeSource(dir, source); err == nil {
+			t.Errorf("expected an error for %q", source)
+		}
+	}
+}
+
+func TestSyncAudio(t *testing.T) {
+	interval := time.Second / 25
+	var buf strings.Builder
+	if err := writeSyncAudio(&buf, 0, 2*time.Second, interval); err != nil {
+		t.Fatal(err)
+	}
+	data := []byte(buf.String())
+	const headerSize = 44
+	if len(data) != headerSize+2*2*syncAudioSampleRate {
+		t.Fatalf("unexpected size: %d", len(data))
+	}
+	if string(data[:4]) != "RIFF" || string(data[8:12]) != "WAVE" {
+		t.Fatalf("invalid header: %q", data[:12])
+	}
+	loud := func(data []byte, from, to time.Duration) bool {
+		for i := int(from * syncAudioSampleRate / time.Second); i < int(to*syncAudioSampleRate/time.Second); i++ {
+			if data[headerSize+i*2] != 0 || data[headerSize+i*2+1] != 0 {
+				return true
+			}
+		}
+		return false
+	}
+	if !loud(data, 0, interval) || !loud(data, time.Second, time.Second+interval) {
+		t.Errorf("missing beeps")
+	}
+	if loud(data, interval, time.Second) {
+		t.Errorf("beep lasts longer than a frame")
+	}
+
+	// Starting halfway a second, the first beep is after half a second.
+	buf.Reset()
+	if err := writeSyncAudio(&buf, 1500*time.Millisecond, time.Second, interval); err != nil {
+		t.Fatal(err)
+	}
+	data = []byte(buf.String())
+	if loud(data, 0, 500*time.Millisecond) || !loud(data, 500*time.Millisecond, 500*time.Millisecond+interval) {
+		t.Errorf("beeps are not offset by the start")
+	}
+}
+
+func TestLatencyCode(t *testing.T) {
+	// Renders the pattern like a camera would see it: not quite black and
+	// white and offset by a few pixels.
+	render := func(frame uint64) *image.Gray {
+		const size = 64
+		img := image.NewGray(image.Rect(0, 0, size, size))
+		cells := latencyCells(frame)
+		for y := 0; y < size; y++ {
+			for x := 0; x < size; x++ {
+				col, row := (x+2)*latencyGrid/size, (y+1)*latencyGrid/size
+				if col >= latencyGrid {
+					col = latencyGrid - 1
+				}
+				if row >= latencyGrid {
+					row = latencyGrid - 1
+				}
+				level := uint8(40)
+				if cells[row*latencyGrid+col] {
+					level = 180
+				}
+				img.Pix[y*img.Stride+x] = level
+			}
+		}
+		return img
+	}
+	for _, frame := range []uint64{0, 1, 2, 3, 1000, latencyPeriod - 1, latencyPeriod + 5} {
+		img := render(frame)
+		if got, ok := decodeLatencyCode(img); !ok || got != frame%latencyPeriod {
+			t.Errorf("frame %d: decoded %d, %v", frame, got, ok)
+		}
+	}
+
+	img := render(1000)
+	// Flip a data bit the parity should catch.
+	for y := 0; y < 16; y++ {
+		for x := 16; x < 32; x++ {
+			img.Pix[y*img.Stride+x] = 220 - img.Pix[y*img.Stride+x]
+		}
+	}
+	if _, ok := decodeLatencyCode(img); ok {
+		t.Errorf("a flipped bit was not detected")
+	}
+	if _, ok := decodeLatencyCode(image.NewGray(image.Rect(0, 0, 64, 64))); ok {
+		t.Errorf("a black image was decoded")
+	}
+
+	for n := uint64(0); n < latencyPeriod; n++ {
+		if bits := grayCode(n) ^ grayCode(n+1); bits&(bits-1) != 0 && n+1 < latencyPeriod {
+			t.Fatalf("more than one bit changes after %d", n)
+		}
+		if fromGrayCode(grayCode(n)) != n {
+			t.Fatalf("%d does not round trip", n)
+		}
+	}
+}
+
+func TestLatencyMeter(t *testing.T) {
+	var m latencyMeter
+	m.Shown(latencyPeriod + 7)
+	shownAt := m.shown[7]
+
+	if _, ok := m.Seen(8, shownAt.Add(time.Second)); ok {
+		t.Errorf("measured a frame that was not shown")
+	}
+	if _, ok := m.Seen(7, shownAt.Add(-time.Millisecond)); ok {
+		t.Errorf("measured a frame before it was shown")
+	}
+	if d, ok := m.Seen(6, shownAt); ok {
+		t.Errorf("measured %v for a frame that was not shown", d)
+	}
+	if d, ok := m.Seen(7, shownAt.Add(50*time.Millisecond)); !ok || d != 50*time.Millisecond {
+		t.Errorf("unexpected latency: %v, %v", d, ok)
+	}
+	// The camera keeps seeing the same frame.
+	if _, ok := m.Seen(7, shownAt.Add(80*time.Millisecond)); ok {
+		t.Errorf("measured a frame twice")
+	}
+	if summary := m.Summary(); !strings.Contains(summary, "median=50ms") || !strings.Contains(summary, "samples=1") {
+		t.Errorf("unexpected summary: %q", summary)
+	}
+}
+
+func TestWarpFile(t *testing.T) {
+	w, err := parseWarp([]byte(`{
+		"cols": 2,
+		"rows": 2,
+		"interpolation": "bezier",
+		"points": [[0.1, 0], [1, 0], [0, 1], [1, 0.9]],
+		"source": [0, 0, 0.55, 1],
+		"blend": {"right": 0.2},
+		"keystone": [[0.05, 0], [1, 0], [0.95, 1], [0, 1]],
+		"lens": {"k1": 0.1},
+		"rotate": 270,
+		"flip": "v"
+	}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !w.Bezier || w.Points[0] != (renderer.WarpPoint{X: 0.1, Y: 0}) || w.Source[2] != 0.55 || w.Blend.Right != 0.2 ||
+		w.Keystone[2] != (renderer.WarpPoint{X: 0.95, Y: 1}) || w.Lens.K1 != 0.1 ||
+		w.Orientation != (renderer.Orientation{Rotate: 270, FlipY: true}) {
+		t.Fatalf("unexpected warp: %+v", w)
+	}
+
+	filename := filepath.Join(t.TempDir(), "warp.json")
+	if err := saveWarp(filename, w); err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := loadWarp(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(w, loaded) {
+		t.Errorf("warp changed after saving: %+v, %+v", w, loaded)
+	}
+
+	for _, invalid := range []string{
+		`{"cols": 2, "rows": 2, "points": [[0, 0]]}`,
+		`{"cols": 2, "rows": 2, "interpolation": "cubic", "points": [[0, 0], [1, 0], [0, 1], [1, 1]]}`,
+		`{"cols": 2, "rows": 2, "points": [[0, 0], [1, 0], [0, 1], [1, 1]], "keystone": [[0, 0], [1, 1], [1, 0], [0, 1]]}`,
+		`{"cols": 2, "rows": 2, "points": [[0, 0], [1, 0], [0, 1], [1, 1]], "rotate": 45}`,
+		`{"cols": 2, "rows": 2, "points": [[0, 0], [1, 0], [0, 1], [1, 1]], "flip": "x"}`,
+	} {
+		if _, err := parseWarp([]byte(invalid)); err == nil {
+			t.Errorf("expected an error for %s", invalid)
+		}
+	}
+
+	// Calibration starts with a new warp if the file does not exist yet.
+	missing := filepath.Join(t.TempDir(), "new.json")
+	calibrate, grid, keystone, lens, rotate, flip := true, "3x2", "", "", 0, ""
+	opts := warpFlags{file: &missing, calibrate: &calibrate, grid: &grid, keystone: &keystone, lens: &lens, rotate: &rotate, flip: &flip}
+	if w, err := opts.load(); err != nil || w.Cols != 3 || w.Rows != 2 {
+		t.Errorf("unexpected new warp: %+v, %v", w, err)
+	}
+
+	// Keystone and lens correction work without a warp file.
+	none, noCalibrate := "", false
+	keystone, lens = "0.1,0, 1,0, 1,1, 0,1", "0.05,0.01"
+	opts = warpFlags{file: &none, calibrate: &noCalibrate, grid: &grid, keystone: &keystone, lens: &lens, rotate: &rotate, flip: &flip}
+	if !opts.enabled() {
+		t.Errorf("expected -keystone and -lens to enable the warp")
+	}
+	if w, err := opts.load(); err != nil || w.Keystone[0] != (renderer.WarpPoint{X: 0.1, Y: 0}) || w.Lens.K2 != 0.01 {
+		t.Errorf("unexpected corrected warp: %+v, %v", w, err)
+	}
+	for _, invalid := range [][2]string{{"0,0,1,0,1,1", ""}, {"", "1,2,3"}, {"", "x"}} {
+		keystone, lens = invalid[0], invalid[1]
+		if _, err := opts.load(); err == nil {
+			t.Errorf("expected an error for -keystone %q -lens %q", keystone, lens)
+		}
+	}
+
+	// So does the orientation.
+	keystone, lens, rotate, flip = "", "", 90, "hv"
+	if !opts.enabled() {
+		t.Errorf("expected -rotate and -flip to enable the warp")
+	}
+	if w, err := opts.load(); err != nil || w.Orientation != (renderer.Orientation{Rotate: 90, FlipX: true, FlipY: true}) {
+		t.Errorf("unexpected oriented warp: %+v, %v", w, err)
+	}
+	for _, invalid := range []struct {
+		rotate int
+		flip   string
+	}{{45, ""}, {0, "x"}} {
+		rotate, flip = invalid.rotate, invalid.flip
+		if _, err := opts.load(); err == nil {
+			t.Errorf("expected an error for -rotate %d -flip %q", rotate, flip)
+		}
+	}
+}
+
+func TestColorCalibrationFile(t *testing.T) {
+	c, err := parseColorCalibration([]byte(`{
+		"matrix": [[0.95, 0.05, 0], [0, 1, 0], [0, 0, 0.9]],
+		"curves": {"all": [0, 0.2, 1], "blue": [0, 0.9]}
+	}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.Matrix[0][1] != 0.05 || c.Matrix[2][2] != 0.9 {
+		t.Errorf("unexpected matrix: %v", c.Matrix)
+	}
+	if !reflect.DeepEqual(c.Curves[0], []float64{0, 0.2, 1}) || !reflect.DeepEqual(c.Curves[1], c.Curves[0]) || !reflect.DeepEqual(c.Curves[2], []float64{0, 0.9}) {
+		t.Errorf("unexpected curves: %v", c.Curves)
+	}
+
+	c, err = parseColorCalibration([]byte(`{"matrix": [[1, 0, 0], [0, 1, 0], [0, 0, 1]]}`))
+	if err != nil || c.Curves[0] != nil || c.Curves[1] != nil || c.Curves[2] != nil {
+		t.Errorf("unexpected calibration without curves: %+v, %v", c, err)
+	}
+
+	for _, invalid := range []string{
+		`{"curves": {"red": [1]}}`,
+		`{"curves": {"green": [0, 2]}}`,
+		`{"matrix": [1, 0, 0]}`,
+	} {
+		if _, err := parseColorCalibration([]byte(invalid)); err == nil {
+			t.Errorf("expected an error for %s", invalid)
+		}
+	}
+}
+
+func TestClockCommand(t *testing.T) {
+	clocks, resetOnLoad, err := newClocks([]string{"sceneTime,reset=load", "slow,rate=0.5"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(resetOnLoad, []string{"sceneTime"}) {
+		t.Errorf("unexpected clocks to reset: %v", resetOnLoad)
+	}
+	for _, invalid := range []string{"x,rate", "x,rate=fast", "x,reset=never", "x,color=red", "2x"} {
+		if _, _, err := newClocks([]string{invalid}); err == nil {
+			t.Errorf("expected an error for %q", invalid)
+		}
+	}
+
+	for _, tt := range []struct {
+		command string
+		reply   string
+		err     bool
+	}{
+		{"sceneTime set 12.5", "", false},
+		{"sceneTime", "12.500", false},
+		{"slow pause", "", false},
+		{"slow rate 2", "", false},
+		{"slow reset", "", false},
+		{"slow", "0.000", false},
+		{"slow rate x", "", true},
+		{"missing reset", "", true},
+		{"sceneTime rewind", "", true},
+		{"", "", true},
+	} {
+		reply, err := clockCommand(clocks, strings.Fields(tt.command))
+		if (err != nil) != tt.err || reply != tt.reply {
+			t.Errorf("%q: unexpected reply %q, %v", tt.command, reply, err)
+		}
+	}
+	if list := listClocks(clocks); list != "sceneTime=12.500 slow=0.000" {
+		t.Errorf("unexpected clocks: %q", list)
+	}
+}
+
+// fakePasses records the pass commands it is given.
+type fakePasses struct {
+	states []renderer.PassState
+}
+
+func (f *fakePasses) Passes() []renderer.PassState {
+	return f.states
+}
+
+func (f *fakePasses) SetPassEnabled(name string, enabled bool) error {
+	for i := range f.states {
+		if f.states[i].Name == name {
+			f.states[i].Enabled = enabled
+			return nil
+		}
+	}
+	return fmt.Errorf("no such pass: %q", name)
+}
+
+func (f *fakePasses) SetSoloPass(name string) error {
+	for i := range f.states {
+		f.states[i].Solo = f.states[i].Name == name
+	}
+	return nil
+}
+
+func TestPassCommand(t *testing.T) {
+	passes := &fakePasses{states: []renderer.PassState{
+		{Name: "BufferA", Enabled: true},
+		{Name: "BufferB", Enabled: true},
+	}}
+	for _, tt := range []struct {
+		command string
+		err     bool
+	}{
+		{"BufferA off", false},
+		{"BufferB off", false},
+		{"BufferB on", false},
+		{"missing off", true},
+		{"BufferA toggle", true},
+		{"BufferA", true},
+	} {
+		if err := passCommand(passes, strings.Fields(tt.command)); (err != nil) != tt.err {
+			t.Errorf("%q: unexpected error %v", tt.command, err)
+		}
+	}
+	passes.SetSoloPass("BufferB")
+	if list := listPasses(passes); list != "BufferA=off BufferB=on,solo" {
+		t.Errorf("unexpected passes: %q", list)
+	}
+}
+
+func TestPlaylist(t *testing.T) {
+	pl, err := parsePlaylist([]byte(`{
+		"mode": "random",
+		"duration": "10m",
+		"no_repeat": 2,
+		"shaders": [
+			{"files": ["a.glsl"], "tags": ["calm"]},
+			{"files": ["b.glsl", "/abs/common.glsl"], "weight": 3, "duration": "1m"},
+			{"files": ["c.glsl"], "tags": ["calm", "dark"]},
+			{"files": ["d.glsl"]}
+		],
+		"filters": [{"from": "23:00", "until": "06:00", "tags": ["calm"]}]
+	}`), "/shaders")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(pl.entries[1].files, []string{"/shaders/b.glsl", "/abs/common.glsl"}) {
+		t.Errorf("unexpected files: %v", pl.entries[1].files)
+	}
+	if pl.entries[0].duration != 10*time.Minute || pl.entries[1].duration != time.Minute || pl.entries[0].weight != 1 {
+		t.Errorf("unexpected entry: %+v", pl.entries[0])
+	}
+
+	day := time.Date(2020, 3, 4, 13, 0, 0, 0, time.UTC)
+	night := time.Date(2020, 3, 4, 2, 0, 0, 0, time.UTC)
+	if e := pl.eligible(day); !reflect.DeepEqual(e, []int{0, 1, 2, 3}) {
+		t.Errorf("unexpected shaders at day: %v", e)
+	}
+	if e := pl.eligible(night); !reflect.DeepEqual(e, []int{0, 2}) {
+		t.Errorf("unexpected shaders at night: %v", e)
+	}
+
+	selector := newPlaylistSelector(pl, 1)
+	counts := map[int]int{}
+	var last []int
+	for i := 0; i < 1000; i++ {
+		next := selector.next(day)
+		for _, recent := range last {
+			if recent == next {
+				t.Fatalf("shader %d was repeated within %d shaders: %v", next, pl.noRepeat, last)
+			}
+		}
+		if last = append(last, next); len(last) > pl.noRepeat {
+			last = last[1:]
+		}
+		counts[next]++
+	}
+	if counts[1] <= counts[0] {
+		t.Errorf("expected the heavier shader to be shown more often: %v", counts)
+	}
+	// With fewer eligible shaders than no_repeat, they alternate.
+	for i := 0; i < 10; i++ {
+		if a, b := selector.next(night), selector.next(night); a == b || (a != 0 && a != 2) {
+			t.Fatalf("unexpected shaders at night: %d, %d", a, b)
+		}
+	}
+
+	pl.random = false
+	selector = newPlaylistSelector(pl, 1)
+	var order []int
+	for i := 0; i < 5; i++ {
+		order = append(order, selector.next(day))
+	}
+	if !reflect.DeepEqual(order, []int{0, 1, 2, 3, 0}) {
+		t.Errorf("unexpected sequential order: %v", order)
+	}
+
+	for _, invalid := range []string{
+		`{"shaders": []}`,
+		`{"mode": "shuffle", "shaders": [{"files": ["a.glsl"]}]}`,
+		`{"shaders": [{"files": []}]}`,
+		`{"shaders": [{"files": ["a.glsl"], "duration": "10ms"}]}`,
+		`{"shaders": [{"files": ["a.glsl"], "weight": -1}]}`,
+		`{"shaders": [{"files": ["a.glsl"]}], "filters": [{"from": "25:00", "until": "06:00", "tags": ["calm"]}]}`,
+		`{"shaders": [{"files": ["a.glsl"]}], "filters": [{"from": "22:00", "until": "06:00"}]}`,
+	} {
+		if _, err := parsePlaylist([]byte(invalid), "."); err == nil {
+			t.Errorf("expected an error for %s", invalid)
+		}
+	}
+}
+
+func TestPlaylistSchedule(t *testing.T) {
+	pl, err := parsePlaylist([]byte(`{
+		"shaders": [{"files": ["idle.glsl"]}],
+		"schedule": [
+			{"days": ["mon-fri"], "from": "09:00", "until": "17:00", "files": ["open.glsl"]},
+			{"days": ["fri", "sat"], "from": "22:00", "until": "02:00", "files": ["party.glsl"]}
+		]
+	}`), "/shaders")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 2020-03-06 is a friday.
+	at := func(day, hour, min int) time.Time {
+		return time.Date(2020, 3, day, hour, min, 0, 0, time.UTC)
+	}
+	for _, tt := range []struct {
+		t    time.Time
+		rule int
+	}{
+		{at(6, 8, 59), -1},
+		{at(6, 9, 0), 0},
+		{at(6, 16, 59), 0},
+		{at(6, 17, 0), -1},
+		{at(6, 23, 0), 1},
+		{at(7, 1, 0), 1},
+		{at(7, 12, 0), -1},
+		{at(8, 1, 0), 1},
+		{at(8, 12, 0), -1},
+		{at(9, 1, 0), -1},
+		{at(9, 10, 0), 0},
+	} {
+		if rule := pl.activeRule(tt.t); rule != tt.rule {
+			t.Errorf("%v: expected rule %d, got %d", tt.t, tt.rule, rule)
+		}
+	}
+	if pl.schedule[0].entry.files[0] != "/shaders/open.glsl" {
+		t.Errorf("unexpected files: %v", pl.schedule[0].entry.files)
+	}
+
+	for _, tt := range []struct {
+		t, next time.Time
+	}{
+		{at(6, 8, 0), at(6, 9, 0)},
+		{at(6, 12, 0), at(6, 17, 0)},
+		{at(6, 17, 0), at(6, 22, 0)},
+		{at(7, 1, 0), at(7, 2, 0)},
+		{at(8, 3, 0), at(9, 9, 0)},
+	} {
+		if next := pl.nextRuleChange(tt.t); !next.Equal(tt.next) {
+			t.Errorf("%v: expected the next change at %v, got %v", tt.t, tt.next, next)
+		}
+	}
+
+	for _, invalid := range []string{
+		`{"shaders": [{"files": ["a.glsl"]}], "schedule": [{"from": "09:00", "until": "17:00"}]}`,
+		`{"shaders": [{"files": ["a.glsl"]}], "schedule": [{"days": ["someday"], "from": "09:00", "until": "17:00", "files": ["b.glsl"]}]}`,
+		`{"shaders": [{"files": ["a.glsl"]}], "schedule": [{"from": "09:00", "until": "09:00", "files": ["b.glsl"]}]}`,
+	} {
+		if _, err := parsePlaylist([]byte(invalid), "."); err == nil {
+			t.Errorf("expected an error for %s", invalid)
+		}
+	}
+}
+
+func TestSyncer(t *testing.T) {
+	dir := t.TempDir()
+	source := t.TempDir()
+	writeFile := func(name, content string) {
+		if err := os.WriteFile(filepath.Join(source, name), []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	os.MkdirAll(filepath.Join(dir, "releases"), 0o755)
+	valid := true
+	s := &syncer{
+		dir: dir,
+		fetch: func(ctx context.Context, dst string) error {
+			os.RemoveAll(dst)
+			return copyTree(source, dst)
+		},
+		validate: func(ctx context.Context, dir string) error {
+			if !valid {
+				return fmt.Errorf("invalid")
+			}
+			return nil
+		},
+	}
+	read := func() string {
+		data, err := os.ReadFile(filepath.Join(s.current(), "a.glsl"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(data)
+	}
+
+	writeFile("a.glsl", "one")
+	if changed, err := s.update(context.Background()); err != nil || !changed {
+		t.Fatalf("expected a change, got %v, %v", changed, err)
+	}
+	if read() != "one" {
+		t.Fatalf("unexpected contents %q", read())
+	}
+	if changed, err := s.update(context.Background()); err != nil || changed {
+		t.Fatalf("expected no change, got %v, %v", changed, err)
+	}
+
+	writeFile("a.glsl", "two")
+	valid = false
+	if _, err := s.update(context.Background()); err == nil {
+		t.Fatalf("expected invalid files to be rejected")
+	}
+	if read() != "one" {
+		t.Fatalf("rejected files are in use: %q", read())
+	}
+
+	valid = true
+	if changed, err := s.update(context.Background()); err != nil || !changed {
+		t.Fatalf("expected a change, got %v, %v", changed, err)
+	}
+	if read() != "two" {
+		t.Fatalf("unexpected contents %q", read())
+	}
+	releases, _ := os.ReadDir(filepath.Join(dir, "releases"))
+	if len(releases) != 1 {
+		t.Fatalf("expected old releases to be pruned, got %d", len(releases))
+	}
+}
+
+func TestSyncFetcher(t *testing.T) {
+	for _, source := range []string{"s3://bucket/shaders", "https://example.com/shaders.git", "git+https://example.com/shaders", "rsync://host/shaders", "host:shaders"} {
+		if _, err := syncFetcher(source); err != nil {
+			t.Errorf("%s: %v", source, err)
+		}
+	}
+	if _, err := syncFetcher("shaders"); err == nil {
+		t.Errorf("expected an error for a local path")
+	}
+}
+
+func TestParseInstances(t *testing.T) {
+	specs, err := parseInstances([]byte(`{"instances": [
+		{"name": "left", "shaders": ["left.glsl"], "geometry": "64x32", "framerate": 30, "output": "left-{shader}.gif"},
+		{"name": "right", "shaders": ["/abs/right.glsl"], "geometry": "720p", "framerate": 25, "output": "-", "format": "rgba32", "seed": 3, "readback": "rgba32f"}
+	]}`), "/srv/signage")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(specs) != 2 {
+		t.Fatalf("expected 2 instances, got %d", len(specs))
+	}
+	left, right := specs[0], specs[1]
+	if left.shaders[0] != "/srv/signage/left.glsl" || left.output != "left-left.gif" || left.width != 64 || left.height != 32 || left.interval != time.Second/30 {
+		t.Errorf("unexpected left instance: %+v", left)
+	}
+	if right.shaders[0] != "/abs/right.glsl" || right.width != 1280 || right.seed != 3 || right.readback != renderer.PixelFormatRGBA32F {
+		t.Errorf("unexpected right instance: %+v", right)
+	}
+
+	for _, data := range []string{
+		`{"instances": []}`,
+		`{"instances": [{"shaders": ["a.glsl"], "geometry": "8x8", "framerate": 1, "output": "a.gif"}]}`,
+		`{"instances": [{"name": "a", "geometry": "8x8", "framerate": 1, "output": "a.gif"}]}`,
+		`{"instances": [{"name": "a", "shaders": ["a.glsl"], "geometry": "8x8", "output": "a.gif"}]}`,
+		`{"instances": [{"name": "a", "shaders": ["a.glsl"], "geometry": "8x8", "framerate": 1, "output": "a.gif", "format": "x11"}]}`,
+		`{"instances": [{"name": "a", "shaders": ["a.glsl"], "geometry": "8x8", "framerate": 1, "output": "a-%04d.png"}]}`,
+		`{"instances": [{"name": "a", "shaders": ["a.glsl"], "geometry": "8x8", "framerate": 1, "output": "a.gif", "readback": "rgb9"}]}`,
+		`{"instances": [
+			{"name": "a", "shaders": ["a.glsl"], "geometry": "8x8", "framerate": 1, "output": "a.gif"},
+			{"name": "a", "shaders": ["b.glsl"], "geometry": "8x8", "framerate": 1, "output": "b.gif"}
+		]}`,
+		`{"instances": [
+			{"name": "a", "shaders": ["a.glsl"], "geometry": "8x8", "framerate": 1, "output": "-", "format": "rgb24"},
+			{"name": "b", "shaders": ["b.glsl"], "geometry": "8x8", "framerate": 1, "output": "-", "format": "rgb24"}
+		]}`,
+	} {
+		if _, err := parseInstances([]byte(data), "."); err == nil {
+			t.Errorf("expected an error for %s", data)
+		}
+	}
+}
+
+func TestNextDeadline(t *testing.T) {
+	start := time.Unix(1000, 0)
+	interval := 100 * time.Millisecond
+	if next := nextDeadline(start, start.Add(10*time.Millisecond), interval); !next.Equal(start.Add(interval)) {
+		t.Errorf("unexpected deadline %v", next)
+	}
+	// A late frame is made up for by the next one.
+	if next := nextDeadline(start, start.Add(150*time.Millisecond), interval); !next.Equal(start.Add(interval)) {
+		t.Errorf("unexpected deadline %v", next)
+	}
+	// Frames that were missed entirely are skipped.
+	now := start.Add(time.Second)
+	if next := nextDeadline(start, now, interval); !next.Equal(now) {
+		t.Errorf("unexpected deadline %v", next)
+	}
+}
+
+func TestParseByteSize(t *testing.T) {
+	for s, expected := range map[string]int64{
+		"1024":   1024,
+		"512M":   512 << 20,
+		"1.5G":   3 << 29,
+		"256MiB": 256 << 20,
+		"64kb":   64 << 10,
+	} {
+		if n, err := parseByteSize(s); err != nil || n != expected {
+			t.Errorf("%s: expected %d, got %d, %v", s, expected, n, err)
+		}
+	}
+	for _, s := range []string{"", "M", "-1G", "lots"} {
+		if _, err := parseByteSize(s); err == nil {
+			t.Errorf("expected an error for %q", s)
+		}
+	}
+}
+
+func TestErrorFeed(t *testing.T) {
+	var buf strings.Builder
+	feed := &errorFeed{w: &buf}
+	if feed.Last() != nil {
+		t.Fatalf("a report exists before loading")
+	}
+	feed.Report(fmt.Errorf("keeping the current shader: %w", errors.New("could not open texture.png")))
+	feed.Report(nil)
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("got %d lines, expected 2", len(lines))
+	}
+	var failed, loaded loadReport
+	if err := json.Unmarshal([]byte(lines[0]), &failed); err != nil {
+		t.Fatal(err)
+	}
+	if err := json.Unmarshal([]byte(lines[1]), &loaded); err != nil {
+		t.Fatal(err)
+	}
+	if failed.OK || len(failed.Diagnostics) != 1 || failed.Diagnostics[0].Severity != "error" ||
+		failed.Diagnostics[0].Message != "keeping the current shader: could not open texture.png" {
+		t.Errorf("unexpected report of an error: %s", lines[0])
+	}
+	if !loaded.OK || len(loaded.Diagnostics) != 0 {
+		t.Errorf("unexpected report of a successful load: %s", lines[1])
+	}
+	if last := feed.Last(); last == nil || !last.OK {
+		t.Errorf("the last report is not that of the successful load")
+	}
+}
+
+func TestPresence(t *testing.T) {
+	start := time.Unix(1000, 0)
+	p := &presence{timeout: time.Minute}
+	if p.present(start) {
+		t.Fatalf("nobody should be present before any motion")
+	}
+	p.report(true, start)
+	p.report(true, start.Add(30*time.Second))
+	if !p.present(start.Add(10 * time.Minute)) {
+		t.Fatalf("someone should be present while there is motion")
+	}
+	p.report(false, start.Add(time.Hour))
+	if !p.present(start.Add(time.Hour + 59*time.Second)) {
+		t.Errorf("someone should be present until the timeout after the motion stopped")
+	}
+	if p.present(start.Add(time.Hour + time.Minute)) {
+		t.Errorf("nobody should be present after the timeout")
+	}
+	p.setFailed()
+	if !p.present(start.Add(2 * time.Hour)) {
+		t.Errorf("a failed sensor should count as present")
+	}
+}
+
+func TestPresenceControl(t *testing.T) {
+	var paused []bool
+	var fades []float64
+	pause := newPauser(func(p bool) { paused = append(paused, p) })
+	c := &presenceControl{
+		policy: "fade",
+		fade:   10 * time.Millisecond,
+		pause:  pause,
+		fadeTo: func(b float64, _ time.Duration) { fades = append(fades, b) },
+	}
+	c.Apply(false)
+	time.Sleep(50 * time.Millisecond)
+	if !pause.Paused() {
+		t.Fatalf("expected to be paused after fading out")
+	}
+	c.Apply(true)
+	c.Apply(false)
+	c.Apply(true)
+	time.Sleep(50 * time.Millisecond)
+	if pause.Paused() {
+		t.Errorf("a pause scheduled before someone arrived should be dropped")
+	}
+	if !reflect.DeepEqual(fades, []float64{0, 1, 0, 1}) {
+		t.Errorf("unexpected fades: %v", fades)
+	}
+}
+
+func TestParseMotionSensor(t *testing.T) {
+	valid := map[string]motionSensor{
+		"gpio:17":                 &gpioSensor{path: "/sys/class/gpio/gpio17/value"},
+		"gpio:/run/motion":        &gpioSensor{path: "/run/motion"},
+		"camera:/dev/video0":      &cameraSensor{device: "/dev/video0", threshold: 0.02},
+		"camera:/dev/video2;0.1":  &cameraSensor{device: "/dev/video2", threshold: 0.1},
+		"mqtt://broker/hall/pir":  &mqttSensor{url: &url.URL{Scheme: "mqtt", Host: "broker", Path: "/hall/pir"}, topic: "hall/pir"},
+		"mqtt://broker/sensors/#": &mqttSensor{url: &url.URL{Scheme: "mqtt", Host: "broker", Path: "/sensors/"}, topic: "sensors/#"},
+	}
+	for input, expected := range valid {
+		s, err := parseMotionSensor(input)
+		if err != nil {
+			t.Errorf("%q: %v", input, err)
+			continue
+		}
+		if !reflect.DeepEqual(s, expected) {
+			t.Errorf("%q: got %+v, expected %+v", input, s, expected)
+		}
+	}
+	for _, input := range []string{"pir:17", "gpio:", "camera:/dev/video0;2", "mqtt://broker"} {
+		if _, err := parseMotionSensor(input); err == nil {
+			t.Errorf("%q: expected an error", input)
+		}
+	}
+}
+
+func TestMotionPayload(t *testing.T) {
+	cases := map[string]bool{
+		"1":                       true,
+		"ON":                      true,
+		"detected":                true,
+		"0":                       false,
+		"off":                     false,
+		"":                        false,
+		`{"occupancy":true}`:      true,
+		`{"occupancy":false}`:     false,
+		`{"battery":97}`:          false,
+		`{"motion":true,"lux":3}`: true,
+	}
+	for payload, expected := range cases {
+		if motion := motionPayload([]byte(payload)); motion != expected {
+			t.Errorf("%q: got %v, expected %v", payload, motion, expected)
+		}
+	}
+}
+
+func TestMQTTSensor(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		br := bufio.NewReader(conn)
+		if typ, _, err := readMQTTPacket(br); err != nil || typ>>4 != mqttConnect {
+			return
+		}
+		writeMQTTPacket(conn, mqttConnack<<4, []byte{0, 0})
+		typ, body, err := readMQTTPacket(br)
+		if err != nil || typ>>4 != mqttSubscribe {
+			return
+		}
+		writeMQTTPacket(conn, mqttSuback<<4, []byte{body[0], body[1], 0})
+		for _, payload := range []string{"ON", "OFF"} {
+			publish := appendMQTTString(nil, "hall/pir")
+			writeMQTTPacket(conn, mqttPublish<<4, append(publish, payload...))
+		}
+		// A QoS 1 message has a packet identifier before the payload.
+		publish := append(appendMQTTString(nil, "hall/pir"), 0, 7)
+		writeMQTTPacket(conn, mqttPublish<<4|0x02, append(publish, `{"occupancy":true}`...))
+		time.Sleep(time.Second)
+	}()
+
+	sensor, err := newMQTTSensor("mqtt://" + listener.Addr().String() + "/hall/pir")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	var reports []bool
+	sensor.watch(ctx, func(motion bool) {
+		reports = append(reports, motion)
+		if len(reports) == 3 {
+			cancel()
+		}
+	})
+	if !reflect.DeepEqual(reports, []bool{true, false, true}) {
+		t.Errorf("unexpected reports: %v", reports)
+	}
+}
+
+func TestFrameDifference(t *testing.T) {
+	a := []byte{0, 0, 255, 255}
+	b := []byte{0, 255, 255, 0}
+	if d := frameDifference(a, b); d != 0.5 {
+		t.Errorf("got %v, expected 0.5", d)
+	}
+	if d := frameDifference(a, a); d != 0 {
+		t.Errorf("got %v for equal frames", d)
+	}
+}
+
+type closeBuffer struct {
+	bytes.Buffer
+}
+
+func (b *closeBuffer) Close() error { return nil }
+
+func TestMIDISink(t *testing.T) {
+	var out closeBuffer
+	s := &midiSink{w: &out, channel: 2, controller: 118}
+	if err := s.send([]float32{0, 0.5, 1}); err != nil {
+		t.Fatal(err)
+	}
+	// The third value would be a channel mode message and is dropped.
+	if expected := []byte{0xb2, 118, 0, 0xb2, 119, 64}; !bytes.Equal(out.Bytes(), expected) {
+		t.Fatalf("got % x, expected % x", out.Bytes(), expected)
+	}
+	out.Reset()
+	if err := s.send([]float32{0.001, 2, 1}); err != nil {
+		t.Fatal(err)
+	}
+	if expected := []byte{0xb2, 119, 127}; !bytes.Equal(out.Bytes(), expected) {
+		t.Fatalf("got % x after a change, expected % x", out.Bytes(), expected)
+	}
+}
+
+func TestOSCSink(t *testing.T) {
+	if msg, expected := oscMessage("/a/1", 1), []byte("/a/1\x00\x00\x00\x00,f\x00\x00\x3f\x80\x00\x00"); !bytes.Equal(msg, expected) {
+		t.Fatalf("got %q, expected %q", msg, expected)
+	}
+
+	ln, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	conn, err := net.Dial("udp", ln.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &oscSink{conn: conn, prefix: "/shady"}
+	defer s.Close()
+	if err := s.send([]float32{0.25, 0.5}); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.send([]float32{0.25, 0.75}); err != nil {
+		t.Fatal(err)
+	}
+
+	ln.SetReadDeadline(time.Now().Add(5 * time.Second))
+	buf := make([]byte, 64)
+	for _, expected := range [][]byte{oscMessage("/shady/0", 0.25), oscMessage("/shady/1", 0.5), oscMessage("/shady/1", 0.75)} {
+		n, _, err := ln.ReadFrom(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(buf[:n], expected) {
+			t.Fatalf("got %q, expected %q", buf[:n], expected)
+		}
+	}
+}
+
+func TestParseOSCPacket(t *testing.T) {
+	messages, err := parseOSCPacket(oscMessage("/shady/speed", 2.5))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(messages) != 1 || messages[0].address != "/shady/speed" || !reflect.DeepEqual(messages[0].args, []float32{2.5}) {
+		t.Errorf("unexpected messages %#v", messages)
+	}
+
+	var bundle []byte
+	bundle = append(bundle, "#bundle\x00\x00\x00\x00\x00\x00\x00\x00\x01"...)
+	for _, msg := range [][]byte{oscMessage("/a", 1), []byte("/b\x00\x00,ii\x00\x00\x00\x00\x03\xff\xff\xff\xff")} {
+		var size [4]byte
+		binary.BigEndian.PutUint32(size[:], uint32(len(msg)))
+		bundle = append(append(bundle, size[:]...), msg...)
+	}
+	messages, err = parseOSCPacket(bundle)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(messages) != 2 || messages[1].address != "/b" || !reflect.DeepEqual(messages[1].args, []float32{3, -1}) {
+		t.Errorf("unexpected messages of the bundle %#v", messages)
+	}
+
+	for _, packet := range [][]byte{[]byte("/a"), []byte("/a\x00\x00,f\x00\x00"), []byte("/a\x00\x00,s\x00\x00x\x00\x00\x00")} {
+		if _, err := parseOSCPacket(packet); err == nil {
+			t.Errorf("expected an error for %q", packet)
+		}
+	}
+}
+
+func TestReadUniforms(t *testing.T) {
+	uniforms := renderer.NewUserUniforms()
+	var out bytes.Buffer
+	readUniforms(strings.NewReader("speed=2.5\n# comment\ntint = 1, 0.5, 0\nlist\n"), &out, uniforms)
+	if v := uniforms.Value(renderer.UserUniform{Type: "vec3", Name: "tint", Default: []float32{1, 1, 1}}); !reflect.DeepEqual(v, []float32{1, 0.5, 0}) {
+		t.Errorf("unexpected value of tint: %v", v)
+	}
+	if v := uniforms.Value(renderer.UserUniform{Type: "float", Name: "speed", Default: []float32{1}}); !reflect.DeepEqual(v, []float32{2.5}) {
+		t.Errorf("unexpected value of speed: %v", v)
+	}
+	if err := setUniformLine(uniforms, "speed"); err == nil {
+		t.Errorf("expected an error for a line without a value")
+	}
+	if s := formatUniform(renderer.UserUniform{Type: "vec2", Name: "v", HasRange: true, Max: 1}, []float32{0.5, 1}); s != "vec2 v = 0.5, 1 range(0, 1)" {
+		t.Errorf("unexpected format %q", s)
+	}
+}
+
+func TestParseControlTarget(t *testing.T) {
+	buffer, target, err := parseControlTarget("ctl=localhost:9000")
+	if err != nil || buffer != "ctl" || target != "localhost:9000" {
+		t.Fatalf("got %q, %q, %v", buffer, target, err)
+	}
+	for _, s := range []string{"", "ctl", "=localhost:9000", "ctl="} {
+		if _, _, err := parseControlTarget(s); err == nil {
+			t.Errorf("%q: expected an error", s)
+		}
+	}
+}
+
+func TestSharedJPEG(t *testing.T) {
+	screenshots := 0
+	s := &sharedJPEG{screenshot: func(context.Context) (image.Image, error) {
+		screenshots++
+		return image.NewRGBA(image.Rect(0, 0, 4, 4)), nil
+	}}
+	a, err := s.get(context.Background(), time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := s.get(context.Background(), time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if screenshots != 1 || !bytes.Equal(a, b) {
+		t.Fatalf("expected the frame to be encoded once, got %d screenshots", screenshots)
+	}
+	if _, err := jpeg.Decode(bytes.NewReader(a)); err != nil {
+		t.Fatalf("invalid JPEG: %v", err)
+	}
+	if _, err := s.get(context.Background(), 0); err != nil || screenshots != 2 {
+		t.Fatalf("expected an outdated frame to be encoded again, got %d screenshots, %v", screenshots, err)
+	}
+
+	empty := &sharedJPEG{screenshot: func(context.Context) (image.Image, error) { return nil, nil }}
+	if data, err := empty.get(context.Background(), time.Hour); data != nil || err != nil {
+		t.Fatalf("expected no frame before one is rendered, got %d bytes, %v", len(data), err)
+	}
+}
+
+func TestEventEmitter(t *testing.T) {
+	var out bytes.Buffer
+	e := &eventEmitter{buffer: "Events", w: &out}
+	for i, pix := range [][]float32{
+		{0, 0, 0, 0},
+		{1, 0, 0, 0},
+		{1, 0, 0, 0},
+		{0, 0, 0, 0},
+		{2, 0.5, 0, 1},
+	} {
+		e.update(renderer.PixelData{Width: 1, Height: 1, Frame: uint64(i), Pix: pix})
+	}
+
+	var events []shaderEvent
+	dec := json.NewDecoder(&out)
+	for dec.More() {
+		var ev shaderEvent
+		if err := dec.Decode(&ev); err != nil {
+			t.Fatal(err)
+		}
+		events = append(events, ev)
+	}
+	if len(events) != 2 {
+		t.Fatalf("expected 2 events, got %+v", events)
+	}
+	if events[0].Frame != 1 || events[0].Buffer != "Events" || events[0].Value != [4]float32{1, 0, 0, 0} {
+		t.Errorf("unexpected first event %+v", events[0])
+	}
+	if events[1].Frame != 4 || events[1].Value != [4]float32{2, 0.5, 0, 1} {
+		t.Errorf("unexpected second event %+v", events[1])
+	}
+}
+
+func TestWriteSound(t *testing.T) {
+	blocks := 0
+	var out bytes.Buffer
+	err := writeSound(&out, 44100, 3, func() ([]float32, error) {
+		blocks++
+		return []float32{1, -1, 0, 1, 0.5, 2, 0, 1}, nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if blocks != 2 {
+		t.Errorf("expected 2 blocks to be rendered, got %d", blocks)
+	}
+	data := out.Bytes()
+	if len(data) != 44+3*4 || string(data[:4]) != "RIFF" || binary.LittleEndian.Uint16(data[22:]) != 2 {
+		t.Fatalf("unexpected header: % x", data[:44])
+	}
+	samples := make([]int16, 6)
+	binary.Read(bytes.NewReader(data[44:]), binary.LittleEndian, samples)
+	if expected := []int16{32767, -32767, 16384, 32767, 32767, -32767}; !reflect.DeepEqual(samples, expected) {
+		t.Errorf("got samples %v, expected %v", samples, expected)
+	}
+}
+
+func TestFramesIn(t *testing.T) {
+	for _, c := range []struct {
+		duration, framerate float64
+		expected            uint
+	}{
+		{0.7, 30, 21},
+		{10, 29.97, 299},
+		{1.01, 30, 30},
+		{2, 60, 120},
+	} {
+		if n := framesIn(c.duration, c.framerate); n != c.expected {
+			t.Errorf("%gs at %g fps: got %d frames, expected %d", c.duration, c.framerate, n, c.expected)
+		}
+	}
+}
+
+func TestFrameAt(t *testing.T) {
+	if frame, err := frameAt(0.7, 30); err != nil || frame != 21 {
+		t.Errorf("got frame %d, %v", frame, err)
+	}
+	if frame, err := frameAt(100.1, 10); err != nil || frame != 1001 {
+		t.Errorf("got frame %d, %v", frame, err)
+	}
+	for _, tm := range []float64{0.01, -1} {
+		if _, err := frameAt(tm, 30); err == nil {
+			t.Errorf("%g: expected an error", tm)
+		}
+	}
+}
+
+func TestDaemonListener(t *testing.T) {
+	dir, err := os.MkdirTemp("", "shady-daemon")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	socketPath := filepath.Join(dir, "shady.sock")
+	ln, err := daemonListener(socketPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	info, err := os.Stat(socketPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if perm := info.Mode().Perm(); perm != 0600 {
+		t.Errorf("the socket can be accessed by others: %v", perm)
+	}
+	if err := checkSocketDir(socketPath); err == nil {
+		t.Errorf("a socket is accepted as the directory")
+	}
+}
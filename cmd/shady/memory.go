@@ -0,0 +1,55 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/polyfloyd/shady/renderer"
+)
+
+type memoryFlags struct {
+	budget *string
+}
+
+func registerMemoryFlags(fs *flag.FlagSet) memoryFlags {
+	return memoryFlags{
+		budget: fs.String("gpu-memory", "", "Limit the GPU memory used by textures and framebuffers, e.g. 256M or 1G. Images of previous shaders are kept for reuse until the limit is reached. Exceeding it is an error instead of a driver crash"),
+	}
+}
+
+// apply sets the memory budget of the renderer.
+func (f memoryFlags) apply() error {
+	if *f.budget == "" {
+		return nil
+	}
+	n, err := parseByteSize(*f.budget)
+	if err != nil {
+		return err
+	}
+	renderer.SetMemoryBudget(n)
+	return nil
+}
+
+// parseByteSize parses a number of bytes with an optional K, M or G suffix,
+// which are powers of 1024. The suffix may be followed by "iB" or "B".
+func parseByteSize(s string) (int64, error) {
+	num := strings.TrimSuffix(strings.TrimSuffix(strings.ToUpper(s), "B"), "I")
+	mul := int64(1)
+	if i := len(num) - 1; i >= 0 {
+		switch num[i] {
+		case 'K':
+			mul, num = 1<<10, num[:i]
+		case 'M':
+			mul, num = 1<<20, num[:i]
+		case 'G':
+			mul, num = 1<<30, num[:i]
+		}
+	}
+	v, err := strconv.ParseFloat(num, 64)
+	if err != nil || v <= 0 {
+		return 0, fmt.Errorf("invalid size %q, expected a number of bytes like 512M or 1G", s)
+	}
+	return int64(v * float64(mul)), nil
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/polyfloyd/shady/renderer"
+)
+
+// metricsWriter appends the values that a shader writes to the bottom row of
+// a buffer to a CSV file, a line for every frame, with -metrics. This lets
+// shaders log measurements like the energy of a simulation during offline
+// renders.
+type metricsWriter struct {
+	buffer string
+	// columns are the names of the values that are written. If empty, all
+	// channels of the row are written, named by the position of their pixel
+	// and the channel, like 0.r.
+	columns  []string
+	interval time.Duration
+	w        *csv.Writer
+
+	header bool
+	failed bool
+}
+
+// parseMetricsColumns parses the names of -metrics-columns, like
+// "energy,mass".
+func parseMetricsColumns(s string) ([]string, error) {
+	if s == "" {
+		return nil, nil
+	}
+	columns := strings.Split(s, ",")
+	for i, c := range columns {
+		if columns[i] = strings.TrimSpace(c); columns[i] == "" {
+			return nil, fmt.Errorf("empty column name in %q", s)
+		}
+	}
+	return columns, nil
+}
+
+func newMetricsWriter(buffer string, w io.Writer, columns []string, interval time.Duration) *metricsWriter {
+	return &metricsWriter{buffer: buffer, columns: columns, interval: interval, w: csv.NewWriter(w)}
+}
+
+// update is called with the contents of the buffer each time it has been
+// rendered.
+func (m *metricsWriter) update(data renderer.PixelData) {
+	if err := m.write(data); err != nil {
+		if !m.failed {
+			log.Printf("Could not write the metrics of %s: %v", m.buffer, err)
+		}
+		m.failed = true
+	} else {
+		m.failed = false
+	}
+}
+
+func (m *metricsWriter) write(data renderer.PixelData) error {
+	if data.Height == 0 {
+		return nil
+	}
+	// The rows are in the order of images, so the bottom row is the last.
+	rowSize := int(data.Width) * 4
+	row := data.Pix[len(data.Pix)-rowSize:]
+	if len(m.columns) > len(row) {
+		return fmt.Errorf("%d columns are set, but the bottom row of the buffer holds %d values", len(m.columns), len(row))
+	}
+	if !m.header {
+		header := []string{"frame", "time"}
+		if len(m.columns) > 0 {
+			header = append(header, m.columns...)
+		} else {
+			for i := range row {
+				header = append(header, fmt.Sprintf("%d.%c", i/4, "rgba"[i%4]))
+			}
+		}
+		if err := m.w.Write(header); err != nil {
+			return err
+		}
+		m.header = true
+	}
+	if len(m.columns) > 0 {
+		row = row[:len(m.columns)]
+	}
+	record := make([]string, 0, 2+len(row))
+	t := time.Duration(data.Frame) * m.interval
+	record = append(record, strconv.FormatUint(data.Frame, 10), strconv.FormatFloat(t.Seconds(), 'f', -1, 64))
+	for _, v := range row {
+		record = append(record, strconv.FormatFloat(float64(v), 'g', -1, 32))
+	}
+	if err := m.w.Write(record); err != nil {
+		return err
+	}
+	// Lines are flushed right away, so the file can be followed while
+	// rendering.
+	m.w.Flush()
+	return m.w.Error()
+}
@@ -0,0 +1,268 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const (
+	// mqttTimeout limits the duration of connecting to an MQTT broker.
+	mqttTimeout = 10 * time.Second
+	// mqttKeepAlive is the interval at which the broker expects to hear from
+	// the client.
+	mqttKeepAlive = 60 * time.Second
+)
+
+// MQTT 3.1.1 packet types.
+const (
+	mqttConnect   = 1
+	mqttConnack   = 2
+	mqttPublish   = 3
+	mqttSubscribe = 8
+	mqttSuback    = 9
+	mqttPingreq   = 12
+	mqttPingresp  = 13
+)
+
+// mqttSensor reports motion from the messages of an MQTT topic, like those of
+// a motion sensor that is connected to home automation.
+type mqttSensor struct {
+	url   *url.URL
+	topic string
+}
+
+func newMQTTSensor(value string) (*mqttSensor, error) {
+	u, err := url.Parse(value)
+	if err != nil {
+		return nil, err
+	}
+	topic := strings.TrimPrefix(u.Path, "/")
+	if strings.HasSuffix(value, "#") {
+		// A multi level wildcard is parsed as an empty fragment.
+		topic += "#"
+	}
+	if topic == "" {
+		return nil, fmt.Errorf("no MQTT topic, e.g. mqtt://localhost/sensors/hallway/motion")
+	}
+	return &mqttSensor{url: u, topic: topic}, nil
+}
+
+func (s *mqttSensor) watch(ctx context.Context, report func(motion bool)) error {
+	host := s.url.Host
+	if s.url.Port() == "" {
+		if s.url.Scheme == "mqtts" {
+			host = net.JoinHostPort(s.url.Hostname(), "8883")
+		} else {
+			host = net.JoinHostPort(s.url.Hostname(), "1883")
+		}
+	}
+	dialer := &net.Dialer{Timeout: mqttTimeout}
+	var conn net.Conn
+	var err error
+	if s.url.Scheme == "mqtts" {
+		conn, err = tls.DialWithDialer(dialer, "tcp", host, &tls.Config{ServerName: s.url.Hostname()})
+	} else {
+		conn, err = dialer.DialContext(ctx, "tcp", host)
+	}
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	go func() {
+		<-ctx.Done()
+		conn.Close()
+	}()
+
+	conn.SetDeadline(time.Now().Add(mqttTimeout))
+	if err := writeMQTTPacket(conn, mqttConnect<<4, mqttConnectPayload(s.url)); err != nil {
+		return err
+	}
+	br := bufio.NewReader(conn)
+	typ, body, err := readMQTTPacket(br)
+	if err != nil {
+		return err
+	}
+	if typ>>4 != mqttConnack || len(body) != 2 {
+		return fmt.Errorf("unexpected MQTT packet %d while connecting", typ>>4)
+	}
+	if body[1] != 0 {
+		return fmt.Errorf("MQTT broker refused the connection with code %d", body[1])
+	}
+
+	var subscribe []byte
+	subscribe = append(subscribe, 0, 1) // Packet identifier.
+	subscribe = appendMQTTString(subscribe, s.topic)
+	subscribe = append(subscribe, 0) // QoS 0.
+	if err := writeMQTTPacket(conn, mqttSubscribe<<4|0x02, subscribe); err != nil {
+		return err
+	}
+
+	// Ping the broker at half the keep alive interval. The deadline is pushed
+	// forward by every packet, so a broker that stops responding is detected.
+	pingDone := make(chan struct{})
+	defer close(pingDone)
+	go func() {
+		ticker := time.NewTicker(mqttKeepAlive / 2)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				writeMQTTPacket(conn, mqttPingreq<<4, nil)
+			case <-pingDone:
+				return
+			}
+		}
+	}()
+
+	for {
+		conn.SetReadDeadline(time.Now().Add(mqttKeepAlive))
+		typ, body, err := readMQTTPacket(br)
+		if err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			return err
+		}
+		switch typ >> 4 {
+		case mqttSuback:
+			if len(body) == 3 && body[2] == 0x80 {
+				return fmt.Errorf("MQTT broker refused the subscription to %s", s.topic)
+			}
+		case mqttPublish:
+			payload, err := mqttPublishPayload(typ, body)
+			if err != nil {
+				return err
+			}
+			report(motionPayload(payload))
+		case mqttPingresp:
+		}
+	}
+}
+
+func mqttConnectPayload(u *url.URL) []byte {
+	var id [6]byte
+	rand.Read(id[:])
+	flags := byte(0x02) // Clean session.
+	var user, password string
+	if u.User != nil {
+		user = u.User.Username()
+		flags |= 0x80
+		if p, ok := u.User.Password(); ok {
+			password = p
+			flags |= 0x40
+		}
+	}
+	var b []byte
+	b = appendMQTTString(b, "MQTT")
+	b = append(b, 4, flags) // Protocol level 3.1.1.
+	b = appendMQTTUint16(b, uint16(mqttKeepAlive/time.Second))
+	b = appendMQTTString(b, "shady-"+hex.EncodeToString(id[:]))
+	if flags&0x80 != 0 {
+		b = appendMQTTString(b, user)
+	}
+	if flags&0x40 != 0 {
+		b = appendMQTTString(b, password)
+	}
+	return b
+}
+
+// mqttPublishPayload returns the payload of a PUBLISH packet with the
+// specified first byte.
+func mqttPublishPayload(typ byte, body []byte) ([]byte, error) {
+	if len(body) < 2 {
+		return nil, fmt.Errorf("truncated MQTT PUBLISH packet")
+	}
+	n := 2 + int(binary.BigEndian.Uint16(body))
+	if qos := (typ >> 1) & 0x03; qos > 0 {
+		// The packet identifier.
+		n += 2
+	}
+	if n > len(body) {
+		return nil, fmt.Errorf("truncated MQTT PUBLISH packet")
+	}
+	return body[n:], nil
+}
+
+func appendMQTTString(b []byte, s string) []byte {
+	return append(appendMQTTUint16(b, uint16(len(s))), s...)
+}
+
+func appendMQTTUint16(b []byte, v uint16) []byte {
+	return append(b, byte(v>>8), byte(v))
+}
+
+func writeMQTTPacket(w io.Writer, typ byte, body []byte) error {
+	packet := []byte{typ}
+	for n := len(body); ; {
+		digit := byte(n % 128)
+		n /= 128
+		if n > 0 {
+			digit |= 0x80
+		}
+		packet = append(packet, digit)
+		if n == 0 {
+			break
+		}
+	}
+	_, err := w.Write(append(packet, body...))
+	return err
+}
+
+func readMQTTPacket(r *bufio.Reader) (byte, []byte, error) {
+	typ, err := r.ReadByte()
+	if err != nil {
+		return 0, nil, err
+	}
+	length := 0
+	for i := 0; ; i++ {
+		if i == 4 {
+			return 0, nil, errors.New("malformed MQTT packet length")
+		}
+		digit, err := r.ReadByte()
+		if err != nil {
+			return 0, nil, err
+		}
+		length |= int(digit&0x7f) << (7 * i)
+		if digit&0x80 == 0 {
+			break
+		}
+	}
+	body := make([]byte, length)
+	if _, err := io.ReadFull(r, body); err != nil {
+		return 0, nil, err
+	}
+	return typ, body, nil
+}
+
+// motionPayload reports whether a message of a sensor signals motion. Plain
+// payloads like "1", "on" and "true" count as motion, as do JSON objects with
+// a true "occupancy", "motion" or "presence" property like those of
+// Zigbee2MQTT.
+func motionPayload(payload []byte) bool {
+	var obj map[string]interface{}
+	if json.Unmarshal(payload, &obj) == nil {
+		for _, key := range []string{"occupancy", "motion", "presence"} {
+			if v, ok := obj[key].(bool); ok {
+				return v
+			}
+		}
+		return false
+	}
+	switch strings.ToLower(strings.TrimSpace(string(payload))) {
+	case "", "0", "false", "off", "no", "clear":
+		return false
+	}
+	return true
+}
@@ -0,0 +1,311 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"image"
+	"io"
+	"log"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/polyfloyd/shady/encode"
+	"github.com/polyfloyd/shady/renderer"
+)
+
+// multiFile is the format of the instances file of "shady multi".
+type multiFile struct {
+	Instances []struct {
+		Name      string   `json:"name"`
+		Shaders   []string `json:"shaders"`
+		Map       []string `json:"map,omitempty"`
+		Geometry  string   `json:"geometry"`
+		Framerate float64  `json:"framerate"`
+		Output    string   `json:"output"`
+		Format    string   `json:"format,omitempty"`
+		Readback  string   `json:"readback,omitempty"`
+		Seed      int64    `json:"seed,omitempty"`
+	} `json:"instances"`
+}
+
+// instanceSpec is an independent render pipeline of "shady multi".
+type instanceSpec struct {
+	name          string
+	shaders       []string
+	mappings      []string
+	width, height uint
+	interval      time.Duration
+	output        string
+	format        encode.Format
+	readback      renderer.PixelFormat
+	seed          int64
+}
+
+func loadInstances(filename string) ([]instanceSpec, error) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	specs, err := parseInstances(data, filepath.Dir(filename))
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", filename, err)
+	}
+	return specs, nil
+}
+
+// parseInstances parses an instances file. Relative paths of shaders are
+// resolved against dir, outputs are relative to the working directory like
+// -o.
+func parseInstances(data []byte, dir string) ([]instanceSpec, error) {
+	var file multiFile
+	if err := json.Unmarshal(data, &file); err != nil {
+		return nil, err
+	}
+	if len(file.Instances) == 0 {
+		return nil, fmt.Errorf("no instances")
+	}
+	var specs []instanceSpec
+	names := map[string]bool{}
+	stdout := false
+	for i, inst := range file.Instances {
+		if inst.Name == "" {
+			return nil, fmt.Errorf("instance %d has no name", i)
+		}
+		if names[inst.Name] {
+			return nil, fmt.Errorf("duplicate instance %q", inst.Name)
+		}
+		names[inst.Name] = true
+		if len(inst.Shaders) == 0 {
+			return nil, fmt.Errorf("instance %q has no shaders", inst.Name)
+		}
+		width, height, err := parseGeometry(inst.Geometry, 16.0/9.0)
+		if err != nil {
+			return nil, fmt.Errorf("instance %q: %v", inst.Name, err)
+		}
+		if inst.Framerate <= 0 {
+			return nil, fmt.Errorf("instance %q needs a framerate", inst.Name)
+		}
+		if inst.Output == "" {
+			return nil, fmt.Errorf("instance %q has no output", inst.Name)
+		}
+		if inst.Output == "-" {
+			if stdout {
+				return nil, fmt.Errorf("only one instance can write to stdout")
+			}
+			stdout = true
+		}
+		if inst.Format == "x11" {
+			return nil, fmt.Errorf("instance %q: x11 output is not supported, use a separate process for every window", inst.Name)
+		}
+		format, _, segmented, err := selectOutputFormat(inst.Format, inst.Output)
+		if err != nil {
+			return nil, fmt.Errorf("instance %q: %v", inst.Name, err)
+		}
+		if segmented || isSequencePattern(inst.Output) {
+			return nil, fmt.Errorf("instance %q: only single stream outputs are supported", inst.Name)
+		}
+		readback, err := readbackFormat(format, inst.Readback)
+		if err != nil {
+			return nil, fmt.Errorf("instance %q: %v", inst.Name, err)
+		}
+		output, err := expandTemplate(inst.Output, outputVars{
+			date:   time.Now(),
+			shader: shaderName(inst.Shaders[0]),
+			seed:   inst.Seed,
+		})
+		if err != nil {
+			return nil, fmt.Errorf("instance %q: %v", inst.Name, err)
+		}
+		specs = append(specs, instanceSpec{
+			name:     inst.Name,
+			shaders:  resolvePaths(inst.Shaders, dir),
+			mappings: inst.Map,
+			width:    width,
+			height:   height,
+			interval: time.Duration(float64(time.Second) / inst.Framerate),
+			output:   output,
+			format:   format,
+			readback: readback,
+			seed:     inst.Seed,
+		})
+	}
+	return specs, nil
+}
+
+// runMulti renders several independent pipelines in a single process. All
+// instances share one OpenGL context and are rendered in turns by the main
+// thread, while every output is encoded in its own goroutine.
+func runMulti(args []string) {
+	fs := flag.NewFlagSet("multi", flag.ExitOnError)
+	instancesFile := fs.String("instances", "", "The JSON file describing the instances to render")
+	glslVersion := fs.String("glsl", "330", "The GLSL version to use")
+	openGLVersionStr := fs.String("opengl", "glsl", "The OpenGL version to use. If \"glsl\", the version is inferred from the requested GLSL version")
+	backendOpts := registerBackendFlags(fs)
+	memoryOpts := registerMemoryFlags(fs)
+	fs.Parse(args)
+
+	if *instancesFile == "" {
+		log.Fatalf("Please specify the instances to render with -instances")
+	}
+	specs, err := loadInstances(*instancesFile)
+	if err != nil {
+		log.Fatalf("-instances: %v", err)
+	}
+	openGLVersion, err := parseOpenGLVersion(*openGLVersionStr, *glslVersion)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := backendOpts.apply(); err != nil {
+		log.Fatalf("-backend: %v", err)
+	}
+	if err := memoryOpts.apply(); err != nil {
+		log.Fatalf("-gpu-memory: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		sig := make(chan os.Signal, 1)
+		signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+		defer signal.Stop(sig)
+		select {
+		case <-sig:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	var encoders sync.WaitGroup
+	instances := make([]*instance, len(specs))
+	for i, spec := range specs {
+		engine, err := renderer.NewShader(spec.width, spec.height, openGLVersion)
+		if err != nil {
+			log.Fatalf("Could not initialize instance %q: %v", spec.name, err)
+		}
+		defer engine.Close()
+		if err := engine.SetPixelFormat(spec.readback); err != nil {
+			log.Fatalf("Could not initialize instance %q: %v", spec.name, err)
+		}
+		engine.SetSeed(spec.seed)
+		env, _, err := environmentLoader(spec.shaders, spec.mappings, *glslVersion, nil)()
+		if err != nil {
+			log.Fatalf("Could not load instance %q: %v", spec.name, err)
+		}
+		engine.SetEnvironment(env)
+
+		w, err := openWriter(spec.output)
+		if err != nil {
+			log.Fatalf("Could not open the output of instance %q: %v", spec.name, err)
+		}
+		inst := &instance{
+			spec:   spec,
+			engine: engine,
+			frames: make(chan image.Image, 2),
+			done:   make(chan struct{}),
+		}
+		instances[i] = inst
+		encoders.Add(1)
+		go func() {
+			defer encoders.Done()
+			inst.encode(w)
+		}()
+	}
+
+	renderInstances(ctx, instances)
+	for _, inst := range instances {
+		close(inst.frames)
+	}
+	encoders.Wait()
+}
+
+type instance struct {
+	spec   instanceSpec
+	engine *renderer.Shader
+	frames chan image.Image
+	// done is closed when the output stops accepting frames.
+	done chan struct{}
+	next time.Time
+}
+
+func (inst *instance) encode(w io.WriteCloser) {
+	err := inst.spec.format.EncodeAnimation(w, inst.frames, inst.spec.interval)
+	if cerr := w.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		log.Printf("Instance %q stopped: %v", inst.spec.name, err)
+	}
+	close(inst.done)
+	// Keep accepting frames until all instances are done.
+	for range inst.frames {
+	}
+}
+
+func (inst *instance) stopped() bool {
+	select {
+	case <-inst.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// renderInstances renders the frame of the instance that is due first until
+// the context is canceled or all outputs have stopped. Frames are dropped
+// instead of delaying the other instances when an output falls behind.
+func renderInstances(ctx context.Context, instances []*instance) {
+	now := time.Now()
+	for _, inst := range instances {
+		inst.next = now
+	}
+	for {
+		var due *instance
+		for _, inst := range instances {
+			if !inst.stopped() && (due == nil || inst.next.Before(due.next)) {
+				due = inst
+			}
+		}
+		if due == nil {
+			return
+		}
+		select {
+		case <-time.After(time.Until(due.next)):
+		case <-ctx.Done():
+			return
+		}
+
+		img, err := due.engine.RenderFrame(due.spec.interval)
+		if err != nil {
+			log.Printf("Instance %q: %v", due.spec.name, err)
+		} else {
+			select {
+			case due.frames <- img:
+			default:
+				encode.ReleaseFrame(img)
+			}
+		}
+		next := nextDeadline(due.next, time.Now(), due.spec.interval)
+		if skip := next.Sub(due.next) - due.spec.interval; skip > 0 {
+			// Keep the animation in step with the clock.
+			due.engine.AdvanceTime(skip)
+		}
+		due.next = next
+	}
+}
+
+// nextDeadline returns when the frame after the one that was due at prev
+// should be rendered. Instances that fell behind skip the frames they missed
+// rather than rendering them all at once.
+func nextDeadline(prev, now time.Time, interval time.Duration) time.Time {
+	next := prev.Add(interval)
+	if next.Before(now.Add(-interval)) {
+		return now
+	}
+	return next
+}
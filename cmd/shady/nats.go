@@ -0,0 +1,358 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// natsTimeout limits the duration of connecting and of requests to NATS.
+const natsTimeout = 10 * time.Second
+
+// natsJobQueue takes jobs from a NATS JetStream pull consumer, which must be
+// created beforehand. Messages are acknowledged when a job is done, terminated
+// when it fails and negatively acknowledged when it is interrupted so it is
+// redelivered. Progress extends the ack deadline of the message. Events are
+// published to the events subject.
+type natsJobQueue struct {
+	conn     *natsConn
+	stream   string
+	consumer string
+	events   string
+	worker   string
+
+	// acks maps the IDs of taken jobs to the reply subjects of their
+	// messages, which are used to acknowledge them.
+	acks map[string]string
+}
+
+func newNATSJobQueue(u *url.URL, worker string) (*natsJobQueue, error) {
+	query := u.Query()
+	q := &natsJobQueue{
+		conn:     &natsConn{url: u},
+		stream:   query.Get("stream"),
+		consumer: query.Get("consumer"),
+		events:   query.Get("events"),
+		worker:   worker,
+		acks:     map[string]string{},
+	}
+	if q.stream == "" || q.consumer == "" {
+		return nil, fmt.Errorf("NATS queues require the stream and consumer, e.g. nats://localhost:4222?stream=SHADY&consumer=workers")
+	}
+	if q.events == "" {
+		q.events = "shady.events"
+	}
+	return q, nil
+}
+
+func (q *natsJobQueue) Take(ctx context.Context) (renderJob, string, error) {
+	msg, err := q.conn.request("$JS.API.CONSUMER.MSG.NEXT."+q.stream+"."+q.consumer, []byte(`{"batch":1,"no_wait":true}`))
+	if err != nil {
+		return renderJob{}, "", err
+	}
+	switch msg.status {
+	case "":
+	case "404", "408":
+		return renderJob{}, "", errNoJob
+	case "503":
+		return renderJob{}, "", fmt.Errorf("JetStream is not available or consumer %s of stream %s does not exist", q.consumer, q.stream)
+	default:
+		return renderJob{}, "", fmt.Errorf("unexpected status %s: %s", msg.status, msg.data)
+	}
+	job, err := parseRenderJob(msg.data)
+	if err == nil && job.ID == "" {
+		err = fmt.Errorf("job without an id")
+	}
+	q.acks[job.ID] = msg.reply
+	if err != nil {
+		q.Finish(job, nil, err)
+		return job, "", err
+	}
+	if err := q.publish(jobEvent{ID: job.ID, Event: "started"}); err != nil {
+		return job, "", err
+	}
+	return job, "", nil
+}
+
+func (q *natsJobQueue) Progress(job renderJob, frame, total uint) error {
+	if ack, ok := q.acks[job.ID]; ok {
+		// Keep JetStream from redelivering the job to another worker.
+		if err := q.conn.publish(ack, []byte("+WPI")); err != nil {
+			return err
+		}
+	}
+	return q.publish(jobEvent{ID: job.ID, Event: "progress", Frame: frame, Frames: total})
+}
+
+func (q *natsJobQueue) Finish(job renderJob, output []byte, jobErr error) error {
+	ack, ok := q.acks[job.ID]
+	if !ok {
+		return fmt.Errorf("job %q is not running", job.ID)
+	}
+	delete(q.acks, job.ID)
+	if errors.Is(jobErr, context.Canceled) {
+		if err := q.conn.publish(ack, []byte("-NAK")); err != nil {
+			return err
+		}
+		return q.publish(jobEvent{ID: job.ID, Event: "released"})
+	}
+	result := "+ACK"
+	if jobErr != nil {
+		// Do not retry jobs that failed, they are likely to fail again.
+		result = "+TERM"
+	}
+	if err := q.conn.publish(ack, []byte(result)); err != nil {
+		return err
+	}
+	return q.publish(newResultEvent(job, output, jobErr))
+}
+
+func (q *natsJobQueue) publish(event jobEvent) error {
+	data, _ := json.Marshal(event.withWorker(q.worker))
+	return q.conn.publish(q.events, data)
+}
+
+// natsMsg is a message received from NATS. Status is set for status messages
+// like "404" in reply to requests.
+type natsMsg struct {
+	subject string
+	reply   string
+	status  string
+	data    []byte
+}
+
+// natsConn is a minimal client for the NATS protocol. It connects on first use
+// and reconnects after errors. It is safe for concurrent use.
+type natsConn struct {
+	url *url.URL
+
+	lock    sync.Mutex
+	conn    net.Conn
+	inbox   string
+	nextID  int
+	replies chan natsMsg
+	closed  chan struct{}
+}
+
+func (c *natsConn) connect() error {
+	host := c.url.Host
+	if c.url.Port() == "" {
+		host = net.JoinHostPort(c.url.Hostname(), "4222")
+	}
+	conn, err := net.DialTimeout("tcp", host, natsTimeout)
+	if err != nil {
+		return err
+	}
+	conn.SetDeadline(time.Now().Add(natsTimeout))
+	r := bufio.NewReader(conn)
+	if line, err := r.ReadString('\n'); err != nil {
+		conn.Close()
+		return err
+	} else if !strings.HasPrefix(line, "INFO ") {
+		conn.Close()
+		return fmt.Errorf("unexpected greeting: %q", line)
+	}
+
+	opts := map[string]interface{}{
+		"verbose":       false,
+		"pedantic":      false,
+		"name":          "shady worker",
+		"lang":          "go",
+		"protocol":      1,
+		"headers":       true,
+		"no_responders": true,
+	}
+	if user := c.url.User; user != nil {
+		if pass, ok := user.Password(); ok {
+			opts["user"] = user.Username()
+			opts["pass"] = pass
+		} else {
+			opts["auth_token"] = user.Username()
+		}
+	}
+	connect, _ := json.Marshal(opts)
+	// The inbox must be unique among all clients of the server.
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		conn.Close()
+		return err
+	}
+	inbox := "_INBOX." + hex.EncodeToString(id)
+	fmt.Fprintf(conn, "CONNECT %s\r\nSUB %s.* 1\r\nPING\r\n", connect, inbox)
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			conn.Close()
+			return err
+		}
+		if strings.HasPrefix(line, "-ERR") {
+			conn.Close()
+			return fmt.Errorf("could not connect: %s", strings.TrimSpace(strings.TrimPrefix(line, "-ERR")))
+		}
+		if strings.HasPrefix(line, "PONG") {
+			break
+		}
+	}
+	conn.SetDeadline(time.Time{})
+
+	c.conn = conn
+	c.inbox = inbox
+	c.replies = make(chan natsMsg, 16)
+	c.closed = make(chan struct{})
+	go c.read(conn, r, c.replies, c.closed)
+	return nil
+}
+
+// read handles messages sent by the server until the connection fails.
+func (c *natsConn) read(conn net.Conn, r *bufio.Reader, replies chan<- natsMsg, closed chan<- struct{}) {
+	defer close(closed)
+	defer conn.Close()
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		line = strings.TrimSuffix(line, "\r\n")
+		switch {
+		case line == "PING":
+			c.lock.Lock()
+			io.WriteString(conn, "PONG\r\n")
+			c.lock.Unlock()
+		case strings.HasPrefix(line, "MSG ") || strings.HasPrefix(line, "HMSG "):
+			msg, err := readNATSMsg(line, r)
+			if err != nil {
+				return
+			}
+			select {
+			case replies <- msg:
+			default:
+				// Nobody is waiting for the reply anymore.
+			}
+		case strings.HasPrefix(line, "-ERR"):
+			return
+		}
+	}
+}
+
+// readNATSMsg reads the payload of a MSG or HMSG line.
+func readNATSMsg(line string, r *bufio.Reader) (natsMsg, error) {
+	fields := strings.Fields(line)
+	headers := fields[0] == "HMSG"
+	// MSG <subject> <sid> [reply] <size>
+	// HMSG <subject> <sid> [reply] <header size> <total size>
+	n := 4
+	if headers {
+		n = 5
+	}
+	if len(fields) != n && len(fields) != n+1 {
+		return natsMsg{}, fmt.Errorf("invalid message: %q", line)
+	}
+	msg := natsMsg{subject: fields[1]}
+	if len(fields) == n+1 {
+		msg.reply = fields[3]
+	}
+	size, err := strconv.Atoi(fields[len(fields)-1])
+	if err != nil {
+		return natsMsg{}, err
+	}
+	hdrSize := 0
+	if headers {
+		if hdrSize, err = strconv.Atoi(fields[len(fields)-2]); err != nil {
+			return natsMsg{}, err
+		}
+	}
+	buf := make([]byte, size+2)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return natsMsg{}, err
+	}
+	if hdrSize > size {
+		return natsMsg{}, fmt.Errorf("invalid message: %q", line)
+	}
+	if headers {
+		// The first line of the headers is like "NATS/1.0 404 No Messages".
+		status := strings.SplitN(string(buf[:hdrSize]), "\r\n", 2)[0]
+		if f := strings.Fields(status); len(f) > 1 {
+			msg.status = f[1]
+		}
+	}
+	msg.data = buf[hdrSize:size]
+	return msg, nil
+}
+
+// ensureConnected connects if there is no connection. The lock must be held.
+func (c *natsConn) ensureConnected() error {
+	if c.conn != nil {
+		select {
+		case <-c.closed:
+			c.conn = nil
+		default:
+			return nil
+		}
+	}
+	return c.connect()
+}
+
+func (c *natsConn) publish(subject string, data []byte) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if err := c.ensureConnected(); err != nil {
+		return err
+	}
+	return c.writePub(subject, "", data)
+}
+
+func (c *natsConn) writePub(subject, reply string, data []byte) error {
+	c.conn.SetWriteDeadline(time.Now().Add(natsTimeout))
+	var err error
+	if reply != "" {
+		_, err = fmt.Fprintf(c.conn, "PUB %s %s %d\r\n%s\r\n", subject, reply, len(data), data)
+	} else {
+		_, err = fmt.Fprintf(c.conn, "PUB %s %d\r\n%s\r\n", subject, len(data), data)
+	}
+	if err != nil {
+		c.conn.Close()
+	}
+	return err
+}
+
+// request publishes a message and waits for the reply.
+func (c *natsConn) request(subject string, data []byte) (natsMsg, error) {
+	c.lock.Lock()
+	if err := c.ensureConnected(); err != nil {
+		c.lock.Unlock()
+		return natsMsg{}, err
+	}
+	c.nextID++
+	reply := c.inbox + "." + strconv.Itoa(c.nextID)
+	replies, closed := c.replies, c.closed
+	err := c.writePub(subject, reply, data)
+	c.lock.Unlock()
+	if err != nil {
+		return natsMsg{}, err
+	}
+
+	timeout := time.After(natsTimeout)
+	for {
+		select {
+		case msg := <-replies:
+			if msg.subject == reply {
+				return msg, nil
+			}
+		case <-closed:
+			return natsMsg{}, fmt.Errorf("connection to NATS lost")
+		case <-timeout:
+			return natsMsg{}, fmt.Errorf("timeout while waiting for a reply to %s", subject)
+		}
+	}
+}
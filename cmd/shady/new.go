@@ -0,0 +1,178 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/template"
+
+	"github.com/polyfloyd/shady/renderer"
+)
+
+// projectTemplate is a set of files that make up a new project.
+type projectTemplate struct {
+	description string
+	// files maps filenames to text/template sources that are executed with
+	// the projectVars.
+	files map[string]string
+	// usage is printed after the project has been created.
+	usage string
+}
+
+type projectVars struct {
+	Width, Height uint
+	Format        string
+}
+
+var projectTemplates = map[string]projectTemplate{
+	"simulation": {
+		description: "A feedback simulation with a state pass and a display pass",
+		files: map[string]string{
+			"state.glsl":   simulationStateTemplate,
+			"display.glsl": simulationDisplayTemplate,
+		},
+		usage: "shady -i display.glsl -g 512x512 -f 60",
+	},
+}
+
+const simulationStateTemplate = `// The state pass of the simulation. Every pixel holds the state of one cell
+// which is updated from its previous value and that of its neighbours.
+//
+// This example implements the Gray-Scott reaction-diffusion model with the
+// concentrations of two chemicals in the red and green channels.
+
+#pragma map state=builtin:Back Buffer
+
+const float feed = 0.037;
+const float kill = 0.06;
+const vec2 diffusion = vec2(1.0, 0.5);
+
+// cell returns the previous state of the cell at the offset from the current
+// one. It uses gl_FragCoord rather than fragCoord, which is flipped, so the
+// state keeps its orientation from frame to frame.
+vec4 cell(ivec2 offset) {
+	ivec2 size = ivec2(iResolution.xy);
+	ivec2 p = (ivec2(gl_FragCoord.xy) + offset + size) % size;
+	return texelFetch(state, p, 0);
+}
+
+// initialState is rendered on the first frame.
+vec4 initialState(vec2 uv) {
+	float seed = step(length(uv - 0.5), 0.05);
+	return vec4(1.0, seed, 0.0, 1.0);
+}
+
+vec4 simulate(vec4 c) {
+	vec4 laplacian = -c
+		+ 0.2 * (cell(ivec2(1, 0)) + cell(ivec2(-1, 0)) + cell(ivec2(0, 1)) + cell(ivec2(0, -1)))
+		+ 0.05 * (cell(ivec2(1, 1)) + cell(ivec2(-1, 1)) + cell(ivec2(1, -1)) + cell(ivec2(-1, -1)));
+	float a = c.r;
+	float b = c.g;
+	float reaction = a * b * b;
+	a += diffusion.x * laplacian.r - reaction + feed * (1.0 - a);
+	b += diffusion.y * laplacian.g + reaction - (kill + feed) * b;
+	return vec4(clamp(vec2(a, b), 0.0, 1.0), 0.0, 1.0);
+}
+
+void mainImage(out vec4 fragColor, in vec2 fragCoord) {
+	if (iFrame == 0) {
+		fragColor = initialState(gl_FragCoord.xy / iResolution.xy);
+		return;
+	}
+	fragColor = simulate(cell(ivec2(0)));
+}
+`
+
+const simulationDisplayTemplate = `// The display pass of the simulation, which turns the state into colors.
+
+#pragma map state=buffer:state.glsl;{{.Width}}x{{.Height}};{{.Format}}
+
+void mainImage(out vec4 fragColor, in vec2 fragCoord) {
+	// Sample with gl_FragCoord to match the orientation of the state pass.
+	vec4 s = texture(state, gl_FragCoord.xy / iResolution.xy);
+	float v = clamp(s.r - s.g, 0.0, 1.0);
+	fragColor = vec4(mix(vec3(0.05, 0.0, 0.15), vec3(1.0, 0.9, 0.6), v), 1.0);
+}
+`
+
+// runNew creates a new project from a template.
+func runNew(args []string) {
+	fs := flag.NewFlagSet("new", flag.ExitOnError)
+	size := fs.String("size", "256x256", "The size of the state buffer")
+	format := fs.String("format", "rgba32f", "The pixel format of the state buffer. Valid values are: rgba8, rgba16f, rgba32f")
+	force := fs.Bool("force", false, "Overwrite existing files")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: shady new [flags] <template> [directory]\n\nTemplates:\n")
+		names := make([]string, 0, len(projectTemplates))
+		for name := range projectTemplates {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			fmt.Fprintf(fs.Output(), "  %s\n\t%s\n", name, projectTemplates[name].description)
+		}
+		fmt.Fprintf(fs.Output(), "\nFlags:\n")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() < 1 || fs.NArg() > 2 {
+		fs.Usage()
+		os.Exit(2)
+	}
+	tmpl, ok := projectTemplates[fs.Arg(0)]
+	if !ok {
+		log.Fatalf("Unknown template %q", fs.Arg(0))
+	}
+	dir := "."
+	if fs.NArg() == 2 {
+		dir = fs.Arg(1)
+	}
+
+	width, height, err := parseGeometry(*size, 1)
+	if err != nil {
+		log.Fatalf("-size: %v", err)
+	}
+	if _, err := renderer.ParsePixelFormat(*format); err != nil {
+		log.Fatalf("-format: %v", err)
+	}
+	vars := projectVars{Width: width, Height: height, Format: *format}
+	if err := createProject(dir, tmpl, vars, *force); err != nil {
+		log.Fatal(err)
+	}
+	log.Printf("Created a new %s project in %s, run it with:", fs.Arg(0), dir)
+	log.Printf("  cd %s && %s", dir, tmpl.usage)
+}
+
+// createProject writes the files of the template to the directory. Existing
+// files are only overwritten if force is set.
+func createProject(dir string, tmpl projectTemplate, vars projectVars, force bool) error {
+	contents := map[string]string{}
+	for name, src := range tmpl.files {
+		t, err := template.New(name).Parse(src)
+		if err != nil {
+			return err
+		}
+		var buf strings.Builder
+		if err := t.Execute(&buf, vars); err != nil {
+			return err
+		}
+		contents[name] = buf.String()
+
+		if _, err := os.Stat(filepath.Join(dir, name)); err == nil && !force {
+			return fmt.Errorf("%s already exists, use -force to overwrite it", filepath.Join(dir, name))
+		}
+	}
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return err
+	}
+	for name, src := range contents {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(src), 0o644); err != nil {
+			return err
+		}
+	}
+	return nil
+}
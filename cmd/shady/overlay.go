@@ -0,0 +1,135 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/polyfloyd/shady/encode"
+)
+
+// overlayPositions maps the positions of -overlay to the fraction of the free
+// space that lies to the left and above the image.
+var overlayPositions = map[string][2]int{
+	"top-left":     {0, 0},
+	"top":          {1, 0},
+	"top-right":    {2, 0},
+	"left":         {0, 1},
+	"center":       {1, 1},
+	"right":        {2, 1},
+	"bottom-left":  {0, 2},
+	"bottom":       {1, 2},
+	"bottom-right": {2, 2},
+}
+
+// overlay is an image like a logo that is drawn on top of every frame with
+// -overlay.
+type overlay struct {
+	// img has its opacity applied already.
+	img      *image.RGBA
+	position string
+}
+
+// parseOverlay parses an -overlay value as FILE[@POSITION[:OPACITY]]. The
+// position defaults to bottom-right and the opacity to 1.
+func parseOverlay(spec string) (file, position string, opacity float64, err error) {
+	file, position, opacity = spec, "bottom-right", 1
+	i := strings.LastIndex(spec, "@")
+	if i < 0 {
+		return file, position, opacity, nil
+	}
+	file, position = spec[:i], spec[i+1:]
+	if j := strings.Index(position, ":"); j >= 0 {
+		if opacity, err = strconv.ParseFloat(position[j+1:], 64); err != nil || opacity < 0 || opacity > 1 {
+			return "", "", 0, fmt.Errorf("invalid opacity %q, expected a number from 0 to 1", position[j+1:])
+		}
+		position = position[:j]
+	}
+	if _, ok := overlayPositions[position]; !ok {
+		return "", "", 0, fmt.Errorf("invalid position %q, expected e.g. top-left, center or bottom-right", position)
+	}
+	return file, position, opacity, nil
+}
+
+func loadOverlay(spec string) (*overlay, error) {
+	file, position, opacity, err := parseOverlay(spec)
+	if err != nil {
+		return nil, err
+	}
+	fd, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer fd.Close()
+	src, _, err := image.Decode(fd)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", file, err)
+	}
+	return newOverlay(src, position, opacity), nil
+}
+
+func newOverlay(src image.Image, position string, opacity float64) *overlay {
+	b := src.Bounds()
+	img := image.NewRGBA(image.Rect(0, 0, b.Dx(), b.Dy()))
+	mask := image.NewUniform(color.Alpha{A: uint8(opacity*255 + 0.5)})
+	draw.DrawMask(img, img.Bounds(), src, b.Min, mask, image.Point{}, draw.Src)
+	return &overlay{img: img, position: position}
+}
+
+// rect returns where the overlay is drawn in a frame. It keeps a margin from
+// the edges of the frame.
+func (ov *overlay) rect(frame image.Rectangle) image.Rectangle {
+	pos := overlayPositions[ov.position]
+	margin := frame.Dx()
+	if frame.Dy() < margin {
+		margin = frame.Dy()
+	}
+	margin /= 32
+	size := ov.img.Bounds().Size()
+	free := frame.Size().Sub(size).Sub(image.Pt(2*margin, 2*margin))
+	at := frame.Min.Add(image.Pt(margin+free.X*pos[0]/2, margin+free.Y*pos[1]/2))
+	return image.Rectangle{Min: at, Max: at.Add(size)}
+}
+
+// draw composites the overlay onto the frame.
+func (ov *overlay) draw(frame image.Image) {
+	r := ov.rect(frame.Bounds())
+	switch f := frame.(type) {
+	case *image.RGBA:
+		draw.Draw(f, r, ov.img, image.Point{}, draw.Over)
+	case *encode.FloatFrame:
+		clip := r.Intersect(f.Rect)
+		for y := clip.Min.Y; y < clip.Max.Y; y++ {
+			for x := clip.Min.X; x < clip.Max.X; x++ {
+				src := ov.img.Pix[ov.img.PixOffset(x-r.Min.X, y-r.Min.Y):]
+				dst := f.Pix[f.PixOffset(x, y):]
+				a := float32(src[3]) / 255
+				for c := 0; c < 4; c++ {
+					dst[c] = float32(src[c])/255 + dst[c]*(1-a)
+				}
+			}
+		}
+	}
+}
+
+// stream draws the overlay onto the frames of the stream. Repeated frames
+// already have the overlay.
+func (ov *overlay) stream(in <-chan image.Image) <-chan image.Image {
+	out := make(chan image.Image)
+	go func() {
+		defer close(out)
+		var prev image.Image
+		for img := range in {
+			if img != prev {
+				ov.draw(img)
+				prev = img
+			}
+			out <- img
+		}
+	}()
+	return out
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/polyfloyd/shady/renderer"
+)
+
+// passController is implemented by engines of which the passes can be turned
+// on and off at runtime.
+type passController interface {
+	Passes() []renderer.PassState
+	SetPassEnabled(name string, enabled bool) error
+	SetSoloPass(name string) error
+}
+
+// passCommand executes the arguments of the pass command of the daemon.
+func passCommand(passes passController, args []string) error {
+	if len(args) != 2 {
+		return fmt.Errorf("usage: pass <name> on|off")
+	}
+	switch args[1] {
+	case "on":
+		return passes.SetPassEnabled(args[0], true)
+	case "off":
+		return passes.SetPassEnabled(args[0], false)
+	}
+	return fmt.Errorf("usage: pass <name> on|off")
+}
+
+// listPasses returns the states of all passes as space separated name=on or
+// name=off pairs, followed by ",solo" for the pass that is shown.
+func listPasses(passes passController) string {
+	var pairs []string
+	for _, p := range passes.Passes() {
+		state := "on"
+		if !p.Enabled {
+			state = "off"
+		}
+		if p.Solo {
+			state += ",solo"
+		}
+		pairs = append(pairs, p.Name+"="+state)
+	}
+	return strings.Join(pairs, " ")
+}
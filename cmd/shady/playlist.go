@@ -0,0 +1,460 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// defaultPlaylistDuration is how long shaders are shown if the playlist does
+// not specify it.
+const defaultPlaylistDuration = 5 * time.Minute
+
+// playlist is a list of shaders that the daemon cycles through.
+type playlist struct {
+	// random selects the next shader randomly by weight instead of in
+	// order.
+	random bool
+	// noRepeat is the number of other shaders that must be shown before a
+	// shader can be randomly selected again.
+	noRepeat int
+	entries  []playlistEntry
+	filters  []playlistFilter
+	// schedule contains rules that show a specific shader instead of the
+	// entries. The first active rule wins.
+	schedule []playlistRule
+}
+
+type playlistEntry struct {
+	files    []string
+	duration time.Duration
+	weight   float64
+	tags     []string
+}
+
+// playlistFilter restricts the shaders that are selected during a time window
+// to those with any of the tags.
+type playlistFilter struct {
+	window timeWindow
+	tags   []string
+}
+
+// playlistRule shows a shader instead of the entries of the playlist during a
+// time window.
+type playlistRule struct {
+	window timeWindow
+	entry  playlistEntry
+}
+
+// timeWindow is a window of the day as offsets from midnight. Windows that end
+// before they start pass midnight.
+type timeWindow struct {
+	from, until time.Duration
+	// days is a bit mask of the weekdays the window starts on. If 0, it
+	// starts on every day.
+	days uint8
+}
+
+func (w timeWindow) onDay(d time.Weekday) bool {
+	return w.days == 0 || w.days&(1<<d) != 0
+}
+
+func (w timeWindow) contains(t time.Time) bool {
+	midnight := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, t.Location())
+	offset := t.Sub(midnight)
+	if w.from <= w.until {
+		return w.onDay(t.Weekday()) && offset >= w.from && offset < w.until
+	}
+	// The part after midnight belongs to the window that started the day
+	// before.
+	return (w.onDay(t.Weekday()) && offset >= w.from) || (w.onDay((t.Weekday()+6)%7) && offset < w.until)
+}
+
+// boundaries returns the times in the week after t at which the window may
+// start or end, in no particular order.
+func (w timeWindow) boundaries(t time.Time) []time.Time {
+	var times []time.Time
+	for day := 0; day <= 7; day++ {
+		midnight := time.Date(t.Year(), t.Month(), t.Day()+day, 0, 0, 0, 0, t.Location())
+		for _, offset := range []time.Duration{w.from, w.until} {
+			if b := midnight.Add(offset); b.After(t) {
+				times = append(times, b)
+			}
+		}
+	}
+	return times
+}
+
+// playlistFile is the JSON encoding of a playlist.
+type playlistFile struct {
+	// Mode is either "sequential" or "random".
+	Mode     string `json:"mode,omitempty"`
+	Duration string `json:"duration,omitempty"`
+	NoRepeat int    `json:"no_repeat,omitempty"`
+	Shaders  []struct {
+		Files    []string `json:"files"`
+		Duration string   `json:"duration,omitempty"`
+		Weight   float64  `json:"weight,omitempty"`
+		Tags     []string `json:"tags,omitempty"`
+	} `json:"shaders"`
+	Filters []struct {
+		From  string   `json:"from"`
+		Until string   `json:"until"`
+		Days  []string `json:"days,omitempty"`
+		Tags  []string `json:"tags"`
+	} `json:"filters,omitempty"`
+	Schedule []struct {
+		From  string   `json:"from"`
+		Until string   `json:"until"`
+		Days  []string `json:"days,omitempty"`
+		Files []string `json:"files"`
+	} `json:"schedule,omitempty"`
+}
+
+func loadPlaylist(filename string) (*playlist, error) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	pl, err := parsePlaylist(data, filepath.Dir(filename))
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", filename, err)
+	}
+	return pl, nil
+}
+
+// parsePlaylist parses a playlist. Relative paths of shaders are resolved
+// against dir.
+func parsePlaylist(data []byte, dir string) (*playlist, error) {
+	var file playlistFile
+	if err := json.Unmarshal(data, &file); err != nil {
+		return nil, fmt.Errorf("invalid playlist: %v", err)
+	}
+	pl := &playlist{noRepeat: file.NoRepeat}
+	switch file.Mode {
+	case "", "sequential":
+	case "random":
+		pl.random = true
+	default:
+		return nil, fmt.Errorf("unknown playlist mode %q, expected \"sequential\" or \"random\"", file.Mode)
+	}
+	if pl.noRepeat < 0 {
+		return nil, fmt.Errorf("no_repeat must not be negative")
+	}
+	defaultDuration, err := parsePlaylistDuration(file.Duration, defaultPlaylistDuration)
+	if err != nil {
+		return nil, err
+	}
+	if len(file.Shaders) == 0 {
+		return nil, fmt.Errorf("a playlist requires at least one shader")
+	}
+	for i, s := range file.Shaders {
+		if len(s.Files) == 0 {
+			return nil, fmt.Errorf("shader %d of the playlist has no files", i)
+		}
+		entry := playlistEntry{files: resolvePaths(s.Files, dir), weight: s.Weight, tags: s.Tags}
+		if entry.duration, err = parsePlaylistDuration(s.Duration, defaultDuration); err != nil {
+			return nil, err
+		}
+		if entry.weight < 0 {
+			return nil, fmt.Errorf("the weight of shader %d of the playlist must not be negative", i)
+		} else if entry.weight == 0 {
+			entry.weight = 1
+		}
+		pl.entries = append(pl.entries, entry)
+	}
+	for _, f := range file.Filters {
+		window, err := parseTimeWindow(f.From, f.Until, f.Days)
+		if err != nil {
+			return nil, err
+		}
+		if len(f.Tags) == 0 {
+			return nil, fmt.Errorf("playlist filter %s-%s has no tags", f.From, f.Until)
+		}
+		pl.filters = append(pl.filters, playlistFilter{window: window, tags: f.Tags})
+	}
+	for _, r := range file.Schedule {
+		window, err := parseTimeWindow(r.From, r.Until, r.Days)
+		if err != nil {
+			return nil, err
+		}
+		if len(r.Files) == 0 {
+			return nil, fmt.Errorf("playlist schedule %s-%s has no files", r.From, r.Until)
+		}
+		pl.schedule = append(pl.schedule, playlistRule{
+			window: window,
+			entry:  playlistEntry{files: resolvePaths(r.Files, dir)},
+		})
+	}
+	return pl, nil
+}
+
+func resolvePaths(files []string, dir string) []string {
+	var resolved []string
+	for _, f := range files {
+		if !filepath.IsAbs(f) {
+			f = filepath.Join(dir, f)
+		}
+		resolved = append(resolved, f)
+	}
+	return resolved
+}
+
+// shaderSets returns the files of all shaders that can be shown by the
+// playlist.
+func (pl *playlist) shaderSets() [][]string {
+	var sets [][]string
+	for _, e := range pl.entries {
+		sets = append(sets, e.files)
+	}
+	for _, r := range pl.schedule {
+		sets = append(sets, r.entry.files)
+	}
+	return sets
+}
+
+func parsePlaylistDuration(s string, def time.Duration) (time.Duration, error) {
+	if s == "" {
+		return def, nil
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil {
+		return 0, fmt.Errorf("invalid playlist duration %q", s)
+	}
+	if d < time.Second {
+		return 0, fmt.Errorf("playlist durations must be at least 1s, got %v", d)
+	}
+	return d, nil
+}
+
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday,
+	"mon": time.Monday,
+	"tue": time.Tuesday,
+	"wed": time.Wednesday,
+	"thu": time.Thursday,
+	"fri": time.Friday,
+	"sat": time.Saturday,
+}
+
+// parseDays parses weekdays and ranges of them like "mon-fri" into a bit mask.
+func parseDays(days []string) (uint8, error) {
+	var mask uint8
+	for _, d := range days {
+		first, last := d, d
+		if i := strings.IndexByte(d, '-'); i >= 0 {
+			first, last = d[:i], d[i+1:]
+		}
+		from, ok1 := weekdays[strings.ToLower(first)]
+		until, ok2 := weekdays[strings.ToLower(last)]
+		if !ok1 || !ok2 {
+			return 0, fmt.Errorf("invalid day %q, expected e.g. \"mon\" or \"mon-fri\"", d)
+		}
+		for day := from; ; day = (day + 1) % 7 {
+			mask |= 1 << day
+			if day == until {
+				break
+			}
+		}
+	}
+	return mask, nil
+}
+
+func parseTimeWindow(from, until string, days []string) (timeWindow, error) {
+	var w timeWindow
+	var err error
+	if w.days, err = parseDays(days); err != nil {
+		return w, err
+	}
+	for _, t := range []struct {
+		s   string
+		dst *time.Duration
+	}{{from, &w.from}, {until, &w.until}} {
+		parsed, err := time.Parse("15:04", t.s)
+		if err != nil {
+			return w, fmt.Errorf("invalid time %q, expected hh:mm", t.s)
+		}
+		*t.dst = time.Duration(parsed.Hour())*time.Hour + time.Duration(parsed.Minute())*time.Minute
+	}
+	if w.from == w.until {
+		return w, fmt.Errorf("the time window %s-%s is empty", from, until)
+	}
+	return w, nil
+}
+
+// eligible returns the indices of the entries that pass all filters that are
+// active at t. If no entry does, all entries are eligible so the playlist
+// never runs dry.
+func (pl *playlist) eligible(t time.Time) []int {
+	var indices []int
+outer:
+	for i, entry := range pl.entries {
+		for _, f := range pl.filters {
+			if f.window.contains(t) && !hasAnyTag(entry.tags, f.tags) {
+				continue outer
+			}
+		}
+		indices = append(indices, i)
+	}
+	if len(indices) == 0 {
+		for i := range pl.entries {
+			indices = append(indices, i)
+		}
+	}
+	return indices
+}
+
+func hasAnyTag(tags, wanted []string) bool {
+	for _, tag := range tags {
+		for _, w := range wanted {
+			if strings.EqualFold(tag, w) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// activeRule returns the index of the schedule rule that is active at t, or -1
+// if there is none.
+func (pl *playlist) activeRule(t time.Time) int {
+	for i, r := range pl.schedule {
+		if r.window.contains(t) {
+			return i
+		}
+	}
+	return -1
+}
+
+// nextRuleChange returns the first time after t at which a different schedule
+// rule becomes active, or the zero time if that never happens.
+func (pl *playlist) nextRuleChange(t time.Time) time.Time {
+	var boundaries []time.Time
+	for _, r := range pl.schedule {
+		boundaries = append(boundaries, r.window.boundaries(t)...)
+	}
+	sort.Slice(boundaries, func(i, j int) bool { return boundaries[i].Before(boundaries[j]) })
+	active := pl.activeRule(t)
+	for _, b := range boundaries {
+		if pl.activeRule(b) != active {
+			return b
+		}
+	}
+	return time.Time{}
+}
+
+// playlistSelector picks the shaders to show from a playlist.
+type playlistSelector struct {
+	playlist *playlist
+	rand     *rand.Rand
+	// history contains the indices of the shown entries, most recent last.
+	history []int
+}
+
+func newPlaylistSelector(pl *playlist, seed int64) *playlistSelector {
+	return &playlistSelector{playlist: pl, rand: rand.New(rand.NewSource(seed))}
+}
+
+// next returns the index of the entry to show at t.
+func (ps *playlistSelector) next(t time.Time) int {
+	eligible := ps.playlist.eligible(t)
+	var i int
+	if ps.playlist.random {
+		i = ps.pickRandom(eligible)
+	} else {
+		i = ps.pickSequential(eligible)
+	}
+	ps.history = append(ps.history, i)
+	if max := ps.playlist.noRepeat + 1; len(ps.history) > max {
+		ps.history = ps.history[len(ps.history)-max:]
+	}
+	return i
+}
+
+func (ps *playlistSelector) pickSequential(eligible []int) int {
+	if len(ps.history) == 0 {
+		return eligible[0]
+	}
+	last := ps.history[len(ps.history)-1]
+	for _, i := range eligible {
+		if i > last {
+			return i
+		}
+	}
+	return eligible[0]
+}
+
+func (ps *playlistSelector) pickRandom(eligible []int) int {
+	// Exclude the most recently shown entries, but always leave at least
+	// one to pick from.
+	n := ps.playlist.noRepeat
+	if n > len(eligible)-1 {
+		n = len(eligible) - 1
+	}
+	recent := map[int]bool{}
+	for j := len(ps.history) - 1; j >= 0 && len(recent) < n; j-- {
+		recent[ps.history[j]] = true
+	}
+	var candidates []int
+	total := 0.0
+	for _, i := range eligible {
+		if !recent[i] {
+			candidates = append(candidates, i)
+			total += ps.playlist.entries[i].weight
+		}
+	}
+	r := ps.rand.Float64() * total
+	for _, i := range candidates {
+		r -= ps.playlist.entries[i].weight
+		if r < 0 {
+			return i
+		}
+	}
+	return candidates[len(candidates)-1]
+}
+
+// runPlaylist loads the shaders of the playlist one after another until the
+// context is canceled. Scheduled shaders are shown for as long as their rule is
+// active.
+func runPlaylist(ctx context.Context, pl *playlist, seed int64, load func([]string) error) {
+	selector := newPlaylistSelector(pl, seed)
+	for {
+		now := time.Now()
+		var entry playlistEntry
+		var until time.Time
+		if i := pl.activeRule(now); i >= 0 {
+			entry = pl.schedule[i].entry
+		} else {
+			entry = pl.entries[selector.next(now)]
+			until = now.Add(entry.duration)
+		}
+		if change := pl.nextRuleChange(now); !change.IsZero() && (until.IsZero() || change.Before(until)) {
+			until = change
+		}
+		if err := load(entry.files); err != nil {
+			log.Printf("Could not load %s: %v", strings.Join(entry.files, ", "), err)
+		}
+		for until.IsZero() || time.Now().Before(until) {
+			// Timers do not advance while the system is suspended, so
+			// wake up regularly to follow the wall clock.
+			wait := time.Minute
+			if !until.IsZero() && time.Until(until) < wait {
+				wait = time.Until(until)
+			}
+			timer := time.NewTimer(wait)
+			select {
+			case <-timer.C:
+			case <-ctx.Done():
+				timer.Stop()
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,352 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// presencePollInterval is how often the presence state is checked for
+	// changes.
+	presencePollInterval = 250 * time.Millisecond
+	// presenceRetryInterval is the time between attempts to reopen a sensor
+	// that failed.
+	presenceRetryInterval = 10 * time.Second
+	// gpioPollInterval is how often the value of a GPIO pin is read.
+	gpioPollInterval = 100 * time.Millisecond
+)
+
+// A motionSensor reports whether it detects motion until the context is
+// canceled or it fails.
+type motionSensor interface {
+	watch(ctx context.Context, report func(motion bool)) error
+}
+
+func parseMotionSensor(s string) (motionSensor, error) {
+	switch {
+	case strings.HasPrefix(s, "gpio:"):
+		return newGPIOSensor(strings.TrimPrefix(s, "gpio:"))
+	case strings.HasPrefix(s, "camera:"):
+		return newCameraSensor(strings.TrimPrefix(s, "camera:"))
+	case strings.HasPrefix(s, "mqtt://"), strings.HasPrefix(s, "mqtts://"):
+		return newMQTTSensor(s)
+	}
+	return nil, fmt.Errorf("unknown motion sensor %q, expected gpio:<pin>, camera:<device> or mqtt://<host>/<topic>", s)
+}
+
+// gpioSensor reads a digital motion sensor, like a PIR sensor, that is
+// connected to a GPIO pin. The pin must be exported through sysfs.
+type gpioSensor struct {
+	path string
+}
+
+func newGPIOSensor(value string) (*gpioSensor, error) {
+	if value == "" {
+		return nil, fmt.Errorf("no GPIO pin")
+	}
+	if pin, err := strconv.Atoi(value); err == nil {
+		return &gpioSensor{path: filepath.Join("/sys/class/gpio", fmt.Sprintf("gpio%d", pin), "value")}, nil
+	}
+	// Any file that contains 0 or 1 can be used.
+	return &gpioSensor{path: value}, nil
+}
+
+func (s *gpioSensor) watch(ctx context.Context, report func(motion bool)) error {
+	ticker := time.NewTicker(gpioPollInterval)
+	defer ticker.Stop()
+	for {
+		value, err := os.ReadFile(s.path)
+		if err != nil {
+			return err
+		}
+		report(strings.TrimSpace(string(value)) == "1")
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// cameraSensor detects motion in the images of a camera by comparing
+// consecutive frames.
+type cameraSensor struct {
+	device string
+	// threshold is the mean difference of the pixels between two frames
+	// from 0 to 1 above which a change counts as motion.
+	threshold float64
+}
+
+const (
+	cameraSensorWidth  = 64
+	cameraSensorHeight = 48
+	cameraSensorRate   = 5
+)
+
+var cameraSensorRe = regexp.MustCompile(`^([^;]+)(?:;([0-9.]+))?$`)
+
+func newCameraSensor(value string) (*cameraSensor, error) {
+	match := cameraSensorRe.FindStringSubmatch(value)
+	if match == nil {
+		return nil, fmt.Errorf("invalid camera sensor %q, expected <device>[;<threshold>]", value)
+	}
+	s := &cameraSensor{device: match[1], threshold: 0.02}
+	if match[2] != "" {
+		t, err := strconv.ParseFloat(match[2], 64)
+		if err != nil || t <= 0 || t >= 1 {
+			return nil, fmt.Errorf("invalid motion threshold %q, expected a number between 0 and 1", match[2])
+		}
+		s.threshold = t
+	}
+	return s, nil
+}
+
+func (s *cameraSensor) watch(ctx context.Context, report func(motion bool)) error {
+	var args []string
+	if strings.HasPrefix(s.device, "/dev/") {
+		args = append(args, "-f", "v4l2")
+	}
+	args = append(args,
+		"-loglevel", "error",
+		"-i", s.device,
+		"-vf", fmt.Sprintf("fps=%d,scale=%d:%d", cameraSensorRate, cameraSensorWidth, cameraSensorHeight),
+		"-pix_fmt", "gray",
+		"-f", "rawvideo",
+		"-",
+	)
+	cmd := exec.CommandContext(ctx, "ffmpeg", args...)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	defer cmd.Wait()
+
+	prev := make([]byte, cameraSensorWidth*cameraSensorHeight)
+	cur := make([]byte, len(prev))
+	for i := 0; ; i++ {
+		if _, err := io.ReadFull(stdout, cur); err != nil {
+			cmd.Wait()
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			return fmt.Errorf("could not read %s: %s", s.device, strings.TrimSpace(stderr.String()))
+		}
+		if i > 0 {
+			report(frameDifference(prev, cur) > s.threshold)
+		}
+		prev, cur = cur, prev
+	}
+}
+
+// frameDifference returns the mean absolute difference of the pixels of two
+// grayscale images from 0 to 1.
+func frameDifference(a, b []byte) float64 {
+	var sum int
+	for i := range a {
+		d := int(a[i]) - int(b[i])
+		if d < 0 {
+			d = -d
+		}
+		sum += d
+	}
+	return float64(sum) / float64(len(a)*255)
+}
+
+// presence keeps track of whether someone is near the display from the
+// reports of a motion sensor. Someone counts as present while there is motion
+// and for the timeout after it has stopped.
+type presence struct {
+	sensor  motionSensor
+	timeout time.Duration
+
+	lock     sync.Mutex
+	motion   bool
+	lastSeen time.Time
+	// failed is set while the sensor does not work, which counts as being
+	// present so a broken sensor does not leave the display dark.
+	failed bool
+}
+
+func (p *presence) report(motion bool, now time.Time) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if motion || p.motion {
+		p.lastSeen = now
+	}
+	p.motion = motion
+	p.failed = false
+}
+
+func (p *presence) setFailed() {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.failed = true
+}
+
+func (p *presence) present(now time.Time) bool {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	return p.failed || p.motion || !p.lastSeen.IsZero() && now.Sub(p.lastSeen) < p.timeout
+}
+
+// Run reads the sensor until the context is canceled and calls apply every
+// time someone arrives or leaves. Nobody is present at the start.
+func (p *presence) Run(ctx context.Context, apply func(present bool)) {
+	go func() {
+		for {
+			err := p.sensor.watch(ctx, func(motion bool) {
+				p.report(motion, time.Now())
+			})
+			if ctx.Err() != nil {
+				return
+			}
+			log.Printf("Presence sensor failed, assuming someone is present: %v", err)
+			p.setFailed()
+			select {
+			case <-time.After(presenceRetryInterval):
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	ticker := time.NewTicker(presencePollInterval)
+	defer ticker.Stop()
+	first, was := true, false
+	for {
+		if present := p.present(time.Now()); first || present != was {
+			if present {
+				log.Printf("Someone is present")
+			} else if !first {
+				log.Printf("Nobody is present anymore")
+			}
+			apply(present)
+			first, was = false, present
+		}
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+type presenceFlags struct {
+	sensor   *string
+	timeout  *time.Duration
+	onAbsent *string
+	fade     *time.Duration
+}
+
+func registerPresenceFlags(fs *flag.FlagSet) presenceFlags {
+	return presenceFlags{
+		sensor:   fs.String("presence", "", "Detect whether someone is near the display with a motion sensor: gpio:<pin>, camera:<device>[;<threshold>] or mqtt://[<user>:<password>@]<host>[:<port>]/<topic>"),
+		timeout:  fs.Duration("presence-timeout", 2*time.Minute, "How long after the last motion someone still counts as present"),
+		onAbsent: fs.String("on-absent", "", "What to do while nobody is present: \"pause\", or \"fade\" to fade to black and then pause"),
+		fade:     fs.Duration("presence-fade", 2*time.Second, "The duration of fading in and out with -on-absent fade"),
+	}
+}
+
+func (f presenceFlags) enabled() bool {
+	return *f.sensor != ""
+}
+
+// newPresence returns nil if no sensor was configured.
+func (f presenceFlags) newPresence() (*presence, error) {
+	switch *f.onAbsent {
+	case "", "pause", "fade":
+	default:
+		return nil, fmt.Errorf("-on-absent: invalid policy %q, expected \"pause\" or \"fade\"", *f.onAbsent)
+	}
+	if !f.enabled() {
+		if *f.onAbsent != "" {
+			return nil, fmt.Errorf("-on-absent requires -presence")
+		}
+		return nil, nil
+	}
+	if *f.timeout <= 0 {
+		return nil, fmt.Errorf("-presence-timeout must be positive")
+	}
+	sensor, err := parseMotionSensor(*f.sensor)
+	if err != nil {
+		return nil, fmt.Errorf("-presence: %w", err)
+	}
+	return &presence{sensor: sensor, timeout: *f.timeout}, nil
+}
+
+// newControl returns a presenceControl that applies -on-absent. fadeTo is nil
+// if the output can not be faded.
+func (f presenceFlags) newControl(pause *pauser, fadeTo func(brightness float64, duration time.Duration)) (*presenceControl, error) {
+	if *f.onAbsent == "fade" && fadeTo == nil {
+		return nil, fmt.Errorf("-on-absent fade requires rendering to a window")
+	}
+	return &presenceControl{
+		policy: *f.onAbsent,
+		fade:   *f.fade,
+		pause:  pause,
+		fadeTo: fadeTo,
+	}, nil
+}
+
+// presenceControl pauses or fades out the output while nobody is present.
+type presenceControl struct {
+	policy string
+	fade   time.Duration
+	pause  *pauser
+	fadeTo func(brightness float64, duration time.Duration)
+
+	lock sync.Mutex
+	// generation is increased for every change, so a pause that is scheduled
+	// after fading out is dropped when someone arrives in the meantime.
+	generation int
+	applied    bool
+}
+
+func (c *presenceControl) Apply(present bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.generation++
+	gen := c.generation
+	fade := c.fade
+	if !c.applied {
+		// The initial state is applied immediately.
+		fade = 0
+		c.applied = true
+	}
+
+	switch c.policy {
+	case "pause":
+		c.pause.Set("presence", !present)
+	case "fade":
+		if present {
+			c.pause.Set("presence", false)
+			c.fadeTo(1, fade)
+			return
+		}
+		c.fadeTo(0, fade)
+		time.AfterFunc(fade, func() {
+			c.lock.Lock()
+			defer c.lock.Unlock()
+			if c.generation == gen {
+				c.pause.Set("presence", true)
+			}
+		})
+	}
+}
@@ -0,0 +1,261 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// redisTimeout limits the duration of a single Redis command.
+const redisTimeout = 10 * time.Second
+
+// redisJobQueue takes jobs from a Redis list. Jobs are atomically moved to
+// <key>:running while they are rendered so they are not lost if the worker
+// dies. Events are published on the <key>:events channel and the final event
+// of every job is also pushed to the <key>:results list.
+type redisJobQueue struct {
+	conn   *redisConn
+	key    string
+	worker string
+
+	// running maps the IDs of taken jobs to their original encoding, which
+	// is needed to remove them from the running list.
+	running map[string]string
+}
+
+func newRedisJobQueue(u *url.URL, worker string) *redisJobQueue {
+	key := u.Query().Get("key")
+	if key == "" {
+		key = "shady:jobs"
+	}
+	return &redisJobQueue{
+		conn:    &redisConn{url: u},
+		key:     key,
+		worker:  worker,
+		running: map[string]string{},
+	}
+}
+
+func (q *redisJobQueue) Take(ctx context.Context) (renderJob, string, error) {
+	reply, err := q.conn.do("RPOPLPUSH", q.key, q.key+":running")
+	if err != nil {
+		return renderJob{}, "", err
+	}
+	if reply == nil {
+		return renderJob{}, "", errNoJob
+	}
+	raw, ok := reply.([]byte)
+	if !ok {
+		return renderJob{}, "", fmt.Errorf("unexpected reply to RPOPLPUSH: %v", reply)
+	}
+	job, err := parseRenderJob(raw)
+	if err == nil && job.ID == "" {
+		err = fmt.Errorf("job without an id")
+	}
+	q.running[job.ID] = string(raw)
+	if err != nil {
+		q.Finish(job, nil, err)
+		return job, "", err
+	}
+	if err := q.publish(jobEvent{ID: job.ID, Event: "started"}); err != nil {
+		return job, "", err
+	}
+	return job, "", nil
+}
+
+func (q *redisJobQueue) Progress(job renderJob, frame, total uint) error {
+	return q.publish(jobEvent{ID: job.ID, Event: "progress", Frame: frame, Frames: total})
+}
+
+func (q *redisJobQueue) Finish(job renderJob, output []byte, jobErr error) error {
+	raw, ok := q.running[job.ID]
+	if !ok {
+		return fmt.Errorf("job %q is not running", job.ID)
+	}
+	delete(q.running, job.ID)
+	if _, err := q.conn.do("LREM", q.key+":running", "1", raw); err != nil {
+		return err
+	}
+	if errors.Is(jobErr, context.Canceled) {
+		// Put the job back at the end that is taken from next.
+		if _, err := q.conn.do("RPUSH", q.key, raw); err != nil {
+			return err
+		}
+		return q.publish(jobEvent{ID: job.ID, Event: "released"})
+	}
+	event := newResultEvent(job, output, jobErr)
+	data, _ := json.Marshal(event.withWorker(q.worker))
+	if _, err := q.conn.do("LPUSH", q.key+":results", string(data)); err != nil {
+		return err
+	}
+	return q.publish(event)
+}
+
+func (q *redisJobQueue) publish(event jobEvent) error {
+	data, _ := json.Marshal(event.withWorker(q.worker))
+	_, err := q.conn.do("PUBLISH", q.key+":events", string(data))
+	return err
+}
+
+// redisConn is a minimal client for the Redis protocol. It connects on first
+// use and reconnects after errors. It is safe for concurrent use.
+type redisConn struct {
+	url *url.URL
+
+	lock sync.Mutex
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+func (c *redisConn) dial() error {
+	host := c.url.Host
+	if c.url.Port() == "" {
+		host = net.JoinHostPort(c.url.Hostname(), "6379")
+	}
+	var conn net.Conn
+	var err error
+	dialer := &net.Dialer{Timeout: redisTimeout}
+	if c.url.Scheme == "rediss" {
+		conn, err = tls.DialWithDialer(dialer, "tcp", host, &tls.Config{ServerName: c.url.Hostname()})
+	} else {
+		conn, err = dialer.Dial("tcp", host)
+	}
+	if err != nil {
+		return err
+	}
+	c.conn, c.r = conn, bufio.NewReader(conn)
+
+	if c.url.User != nil {
+		// redis://:password@host sets the legacy password, a user is
+		// supported by Redis 6 and newer.
+		args := []string{"AUTH"}
+		if pass, ok := c.url.User.Password(); ok {
+			if user := c.url.User.Username(); user != "" {
+				args = append(args, user)
+			}
+			args = append(args, pass)
+		} else {
+			args = append(args, c.url.User.Username())
+		}
+		if _, err := c.roundTrip(args); err != nil {
+			c.close()
+			return fmt.Errorf("could not authenticate: %v", err)
+		}
+	}
+	if db := strings.Trim(c.url.Path, "/"); db != "" {
+		if _, err := c.roundTrip([]string{"SELECT", db}); err != nil {
+			c.close()
+			return fmt.Errorf("could not select database %s: %v", db, err)
+		}
+	}
+	return nil
+}
+
+func (c *redisConn) close() {
+	if c.conn != nil {
+		c.conn.Close()
+		c.conn, c.r = nil, nil
+	}
+}
+
+// do runs a command and returns its reply, which is nil, a string for status
+// replies, []byte, int64 or []interface{}.
+func (c *redisConn) do(args ...string) (interface{}, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.conn == nil {
+		if err := c.dial(); err != nil {
+			return nil, err
+		}
+	}
+	reply, err := c.roundTrip(args)
+	var redisErr redisError
+	if err != nil && !errors.As(err, &redisErr) {
+		// The connection is in an unknown state.
+		c.close()
+	}
+	return reply, err
+}
+
+func (c *redisConn) roundTrip(args []string) (interface{}, error) {
+	c.conn.SetDeadline(time.Now().Add(redisTimeout))
+	var b strings.Builder
+	fmt.Fprintf(&b, "*%d\r\n", len(args))
+	for _, arg := range args {
+		fmt.Fprintf(&b, "$%d\r\n%s\r\n", len(arg), arg)
+	}
+	if _, err := io.WriteString(c.conn, b.String()); err != nil {
+		return nil, err
+	}
+	return readRedisReply(c.r)
+}
+
+// redisError is an error reply sent by the server.
+type redisError string
+
+func (err redisError) Error() string {
+	return string(err)
+}
+
+func readRedisReply(r *bufio.Reader) (interface{}, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	line = strings.TrimSuffix(line, "\r\n")
+	if line == "" {
+		return nil, fmt.Errorf("empty reply")
+	}
+	switch line[0] {
+	case '+':
+		return line[1:], nil
+	case '-':
+		return nil, redisError(line[1:])
+	case ':':
+		return strconv.ParseInt(line[1:], 10, 64)
+	case '$':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return nil, err
+		}
+		if n < 0 {
+			return nil, nil
+		}
+		buf := make([]byte, n+2)
+		if _, err := io.ReadFull(r, buf); err != nil {
+			return nil, err
+		}
+		return buf[:n], nil
+	case '*':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return nil, err
+		}
+		if n < 0 {
+			return nil, nil
+		}
+		items := make([]interface{}, n)
+		for i := range items {
+			if items[i], err = readRedisReply(r); err != nil {
+				var redisErr redisError
+				if !errors.As(err, &redisErr) {
+					return nil, err
+				}
+				items[i] = err
+			}
+		}
+		return items, nil
+	default:
+		return nil, fmt.Errorf("invalid reply %q", line)
+	}
+}
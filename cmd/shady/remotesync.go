@@ -0,0 +1,328 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+type syncFlags struct {
+	source   *string
+	interval *time.Duration
+	dir      *string
+}
+
+func registerSyncFlags(fs *flag.FlagSet) syncFlags {
+	return syncFlags{
+		source:   fs.String("sync", "", "Keep the shaders and assets in sync with a git repository, rsync location or s3://bucket/prefix. Updates are test rendered before they are switched to. Paths of -i and -playlist are relative to the synced files"),
+		interval: fs.Duration("sync-interval", 5*time.Minute, "How often to check -sync for updates"),
+		dir:      fs.String("sync-dir", "", "The directory to keep the files of -sync in. Defaults to a directory in the user cache"),
+	}
+}
+
+func (f syncFlags) enabled() bool {
+	return *f.source != ""
+}
+
+func (f syncFlags) newSyncer(validate func(ctx context.Context, dir string) error) (*syncer, error) {
+	fetch, err := syncFetcher(*f.source)
+	if err != nil {
+		return nil, err
+	}
+	if *f.interval < time.Second {
+		return nil, fmt.Errorf("the sync interval must be at least 1s, got %v", *f.interval)
+	}
+	dir := *f.dir
+	if dir == "" {
+		cache, err := os.UserCacheDir()
+		if err != nil {
+			return nil, err
+		}
+		sum := sha256.Sum256([]byte(*f.source))
+		dir = filepath.Join(cache, "shady", "sync", hex.EncodeToString(sum[:8]))
+	}
+	if err := os.MkdirAll(filepath.Join(dir, "releases"), 0o755); err != nil {
+		return nil, err
+	}
+	return &syncer{dir: dir, fetch: fetch, validate: validate}, nil
+}
+
+// syncFetcher returns a function that updates a local copy of the source.
+func syncFetcher(source string) (func(ctx context.Context, dst string) error, error) {
+	run := func(ctx context.Context, name string, args ...string) error {
+		out, err := exec.CommandContext(ctx, name, args...).CombinedOutput()
+		if err != nil {
+			return fmt.Errorf("%s: %v: %s", name, err, strings.TrimSpace(string(out)))
+		}
+		return nil
+	}
+	switch {
+	case strings.HasPrefix(source, "s3://"):
+		return func(ctx context.Context, dst string) error {
+			return run(ctx, "aws", "s3", "sync", "--delete", "--no-progress", source, dst)
+		}, nil
+	case strings.HasPrefix(source, "git+") || strings.HasSuffix(source, ".git"):
+		url := strings.TrimPrefix(source, "git+")
+		return func(ctx context.Context, dst string) error {
+			if _, err := os.Stat(filepath.Join(dst, ".git")); os.IsNotExist(err) {
+				os.RemoveAll(dst)
+				return run(ctx, "git", "clone", "--quiet", "--depth", "1", url, dst)
+			}
+			if err := run(ctx, "git", "-C", dst, "fetch", "--quiet", "--depth", "1", "origin", "HEAD"); err != nil {
+				return err
+			}
+			if err := run(ctx, "git", "-C", dst, "reset", "--quiet", "--hard", "FETCH_HEAD"); err != nil {
+				return err
+			}
+			return run(ctx, "git", "-C", dst, "clean", "--quiet", "-fdx")
+		}, nil
+	case strings.HasPrefix(source, "rsync://") || strings.Contains(source, ":"):
+		return func(ctx context.Context, dst string) error {
+			if err := os.MkdirAll(dst, 0o755); err != nil {
+				return err
+			}
+			return run(ctx, "rsync", "-a", "--delete", strings.TrimSuffix(source, "/")+"/", dst+"/")
+		}, nil
+	}
+	return nil, fmt.Errorf("unsupported sync source %q, expected a git repository, rsync location or s3:// URL", source)
+}
+
+// syncer keeps a validated copy of remote files in a directory:
+//
+//	staging/           the local copy that is updated from the source
+//	releases/<digest>  validated copies of the staging directory
+//	current            a symlink to the release in use
+//
+// Switching releases only replaces the symlink, so readers never see a
+// partially updated set of files.
+type syncer struct {
+	dir      string
+	fetch    func(ctx context.Context, dst string) error
+	validate func(ctx context.Context, dir string) error
+}
+
+// current returns the path through which the files of the release in use are
+// accessed.
+func (s *syncer) current() string {
+	return filepath.Join(s.dir, "current")
+}
+
+// hasRelease reports whether a release has been switched to before.
+func (s *syncer) hasRelease() bool {
+	_, err := os.Stat(s.current())
+	return err == nil
+}
+
+// update fetches the source and switches to it if it has changed and is
+// valid. It reports whether a new release is in use.
+func (s *syncer) update(ctx context.Context) (bool, error) {
+	staging := filepath.Join(s.dir, "staging")
+	if err := s.fetch(ctx, staging); err != nil {
+		return false, err
+	}
+	digest, err := treeDigest(staging)
+	if err != nil {
+		return false, err
+	}
+	name := digest[:16]
+	if target, err := os.Readlink(s.current()); err == nil && filepath.Base(target) == name {
+		return false, nil
+	}
+
+	release := filepath.Join(s.dir, "releases", name)
+	tmp := release + ".tmp"
+	os.RemoveAll(tmp)
+	if err := copyTree(staging, tmp); err != nil {
+		os.RemoveAll(tmp)
+		return false, err
+	}
+	if err := s.validate(ctx, tmp); err != nil {
+		os.RemoveAll(tmp)
+		return false, fmt.Errorf("rejected update %s: %v", name, err)
+	}
+	os.RemoveAll(release)
+	if err := os.Rename(tmp, release); err != nil {
+		return false, err
+	}
+
+	link := s.current() + ".tmp"
+	os.Remove(link)
+	if err := os.Symlink(filepath.Join("releases", name), link); err != nil {
+		return false, err
+	}
+	if err := os.Rename(link, s.current()); err != nil {
+		return false, err
+	}
+	s.prune(name)
+	return true, nil
+}
+
+// prune removes all releases except the one in use.
+func (s *syncer) prune(keep string) {
+	entries, err := os.ReadDir(filepath.Join(s.dir, "releases"))
+	if err != nil {
+		return
+	}
+	for _, e := range entries {
+		if e.Name() != keep {
+			os.RemoveAll(filepath.Join(s.dir, "releases", e.Name()))
+		}
+	}
+}
+
+// run checks for updates at the interval until the context is canceled and
+// calls onUpdate after switching to a new release.
+func (s *syncer) run(ctx context.Context, interval time.Duration, onUpdate func()) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+		changed, err := s.update(ctx)
+		if err != nil {
+			if ctx.Err() == nil {
+				log.Printf("Could not sync: %v", err)
+			}
+			continue
+		}
+		if changed {
+			log.Printf("Switched to synced files %s", s.releaseName())
+			onUpdate()
+		}
+	}
+}
+
+func (s *syncer) releaseName() string {
+	target, _ := os.Readlink(s.current())
+	return filepath.Base(target)
+}
+
+// treeDigest returns a hash of the names and contents of the files in the
+// directory. Git metadata is ignored.
+func treeDigest(dir string) (string, error) {
+	var files []string
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() && info.Name() == ".git" {
+			return filepath.SkipDir
+		}
+		if info.Mode().IsRegular() {
+			files = append(files, path)
+		}
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+	sort.Strings(files)
+	h := sha256.New()
+	for _, path := range files {
+		rel, _ := filepath.Rel(dir, path)
+		sum, err := fileSHA256(path)
+		if err != nil {
+			return "", err
+		}
+		fmt.Fprintf(h, "%s\x00%s\n", filepath.ToSlash(rel), sum)
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// copyTree copies the regular files and directories of src to dst. Git
+// metadata is not copied.
+func copyTree(src, dst string) error {
+	return filepath.Walk(src, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, _ := filepath.Rel(src, path)
+		target := filepath.Join(dst, rel)
+		switch {
+		case info.IsDir() && info.Name() == ".git":
+			return filepath.SkipDir
+		case info.IsDir():
+			return os.MkdirAll(target, 0o755)
+		case !info.Mode().IsRegular():
+			return nil
+		}
+		in, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer in.Close()
+		out, err := os.OpenFile(target, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, info.Mode().Perm())
+		if err != nil {
+			return err
+		}
+		if _, err := io.Copy(out, in); err != nil {
+			out.Close()
+			return err
+		}
+		return out.Close()
+	})
+}
+
+// testRender renders a single small frame of the shader in a separate process,
+// so shaders that fail to compile or crash the driver are caught before they
+// are shown.
+func testRender(ctx context.Context, self, dir string, files, mappings []string, glslVersion string) error {
+	for _, f := range resolvePaths(files, dir) {
+		if _, err := os.Stat(f); err != nil {
+			return err
+		}
+	}
+	tmp, err := os.MkdirTemp("", "shady-test-render-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmp)
+	args := []string{"-g", "64x36", "-n", "1", "-glsl", glslVersion, "-o", filepath.Join(tmp, "frame.png")}
+	for _, f := range files {
+		args = append(args, "-i", f)
+	}
+	for _, m := range mappings {
+		args = append(args, "-map", m)
+	}
+	cmd := exec.CommandContext(ctx, self, args...)
+	cmd.Dir = dir
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("test render of %s failed: %v: %s", strings.Join(files, ", "), err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+// validateSynced test renders all shaders that can be shown from a set of
+// synced files: those of the playlist if there is one, or the input files.
+func validateSynced(ctx context.Context, self, dir, playlistFile string, inputFiles, mappings []string, glslVersion string) error {
+	sets := [][]string{inputFiles}
+	if playlistFile != "" {
+		pl, err := loadPlaylist(resolvePaths([]string{playlistFile}, dir)[0])
+		if err != nil {
+			return err
+		}
+		sets = pl.shaderSets()
+	}
+	for _, files := range sets {
+		if len(files) == 0 {
+			continue
+		}
+		if err := testRender(ctx, self, dir, files, mappings, glslVersion); err != nil {
+			return err
+		}
+	}
+	return nil
+}
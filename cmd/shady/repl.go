@@ -0,0 +1,208 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/polyfloyd/shady/encode"
+	"github.com/polyfloyd/shady/renderer"
+)
+
+const replHelp = `Enter a GLSL expression or statements that set "vec3 color", e.g.:
+  vec3(uv, 0.5 + 0.5 * sin(t))
+  float d = length(p); vec3 color = vec3(smoothstep(0.5, 0.49, d));
+The variables uv (0 to 1), p (-1 to 1 vertically, centered) and t (seconds)
+are available.
+
+Commands:
+  :def <glsl>  add a declaration, e.g. a function or #pragma map
+  :reset       remove all declarations
+  :source      print the complete shader source
+  :help        show this message
+`
+
+// colorAssignRe matches statements that declare or assign the color variable.
+var colorAssignRe = regexp.MustCompile(`\bcolor\s*=[^=]`)
+
+// replShader is the shader that is rendered by the REPL.
+type replShader struct {
+	decls []string
+	body  string
+}
+
+// setLine updates the body of the shader with a line entered by the user. A
+// line that does not set the color itself is treated as an expression for it.
+func (rs *replShader) setLine(line string) {
+	line = strings.TrimSpace(line)
+	line = strings.TrimSuffix(line, ";")
+	if !colorAssignRe.MatchString(line) {
+		line = fmt.Sprintf("vec3 color = vec3(%s)", line)
+	}
+	rs.body = line + ";"
+}
+
+func (rs *replShader) source() string {
+	var b strings.Builder
+	for _, d := range rs.decls {
+		b.WriteString(d)
+		b.WriteString("\n")
+	}
+	fmt.Fprintf(&b, `
+void mainImage(out vec4 fragColor, in vec2 fragCoord) {
+	vec2 uv = fragCoord / iResolution.xy;
+	vec2 p = (2.0 * fragCoord - iResolution.xy) / iResolution.y;
+	float t = iTime;
+	%s
+	fragColor = vec4(color, 1.0);
+}
+`, rs.body)
+	return b.String()
+}
+
+// runREPL renders GLSL snippets entered on stdin to a window or the terminal.
+func runREPL(args []string) {
+	fs := flag.NewFlagSet("repl", flag.ExitOnError)
+	outputFormat := fs.String("ofmt", "x11", "Where to show the result. Valid values are: x11, ansi")
+	geometry := fs.String("g", "64x32", "The geometry of images rendered to the terminal")
+	glslVersion := fs.String("glsl", "330", "The GLSL version to use")
+	openGLVersionStr := fs.String("opengl", "glsl", "The OpenGL version to use. If \"glsl\", the version is inferred from the requested GLSL version")
+	backendOpts := registerBackendFlags(fs)
+	var shadertoyMappings arrayFlags
+	fs.Var(&shadertoyMappings, "map", "Specify or override ShaderToy input mappings")
+	fs.Parse(args)
+
+	openGLVersion, err := parseOpenGLVersion(*openGLVersionStr, *glslVersion)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := backendOpts.apply(); err != nil {
+		log.Fatalf("-backend: %v", err)
+	}
+
+	// The snippet is written to a file so it is loaded like any other shader,
+	// including its mappings and includes.
+	dir, err := os.MkdirTemp("", "shady-repl")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	filename := filepath.Join(dir, "repl.glsl")
+	newFn := environmentLoader([]string{filename}, shadertoyMappings, *glslVersion, nil)
+
+	rs := &replShader{}
+	rs.setLine("vec3(uv, 0.5 + 0.5 * sin(t))")
+	load := func() (renderer.Environment, error) {
+		if err := os.WriteFile(filename, []byte(rs.source()), 0o644); err != nil {
+			return nil, err
+		}
+		env, _, err := newFn()
+		return env, err
+	}
+	fmt.Fprint(os.Stderr, replHelp)
+
+	switch *outputFormat {
+	case "x11":
+		engine, err := renderer.NewOnScreenEngine(openGLVersion)
+		if err != nil {
+			log.Fatalf("Could initialize engine: %v", err)
+		}
+		defer engine.Close()
+		env, err := load()
+		if err != nil {
+			log.Fatal(err)
+		}
+		engine.SetEnvironment(env)
+
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		go func() {
+			defer cancel()
+			readREPL(os.Stdin, rs, func() {
+				env, err := load()
+				if err != nil {
+					log.Println(err)
+					return
+				}
+				engine.SetEnvironment(env)
+			})
+		}()
+		if err := engine.Animate(ctx); err != nil && !errors.Is(err, renderer.ErrWindowClosed) && !errors.Is(err, context.Canceled) {
+			log.Fatal(err)
+		}
+
+	case "ansi":
+		width, height, err := parseGeometry(*geometry, 2)
+		if err != nil {
+			log.Fatalf("%v", err)
+		}
+		engine, err := renderer.NewShader(width, height, openGLVersion)
+		if err != nil {
+			log.Fatalf("Could initialize engine: %v", err)
+		}
+		defer engine.Close()
+		show := func() {
+			env, err := load()
+			if err != nil {
+				log.Println(err)
+				return
+			}
+			engine.SetEnvironment(env)
+			img, err := engine.RenderFrame(0)
+			if err != nil {
+				log.Println(err)
+				return
+			}
+			if err := (encode.AnsiDisplay{}).Encode(os.Stdout, img); err != nil {
+				log.Fatal(err)
+			}
+		}
+		show()
+		readREPL(os.Stdin, rs, show)
+
+	default:
+		log.Fatalf("Unsupported output format for the REPL: %q", *outputFormat)
+	}
+}
+
+// readREPL reads lines until EOF and calls update each time the shader has
+// changed.
+func readREPL(r io.Reader, rs *replShader, update func()) {
+	scanner := bufio.NewScanner(r)
+	for {
+		fmt.Fprint(os.Stderr, "> ")
+		if !scanner.Scan() {
+			fmt.Fprintln(os.Stderr)
+			return
+		}
+		line := strings.TrimSpace(scanner.Text())
+		switch {
+		case line == "":
+			continue
+		case line == ":help":
+			fmt.Fprint(os.Stderr, replHelp)
+			continue
+		case line == ":source":
+			fmt.Fprint(os.Stderr, rs.source())
+			continue
+		case line == ":reset":
+			rs.decls = nil
+		case strings.HasPrefix(line, ":def "):
+			rs.decls = append(rs.decls, strings.TrimPrefix(line, ":def "))
+		case strings.HasPrefix(line, ":"):
+			fmt.Fprintf(os.Stderr, "Unknown command %q, see :help\n", line)
+			continue
+		default:
+			rs.setLine(line)
+		}
+		update()
+	}
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/polyfloyd/shady/encode"
+	"github.com/polyfloyd/shady/sink"
+)
+
+// sequencePatternRe matches the printf verb for the frame number in the
+// filename of an image sequence, e.g. "frame-%04d.png".
+var sequencePatternRe = regexp.MustCompile(`%0?\d*d`)
+
+// isSequencePattern reports whether the output filename describes an image
+// sequence with one file per frame instead of a single file.
+func isSequencePattern(filename string) bool {
+	return isPrintfPattern(filename) || hasTemplateVar(filename, "frame") || hasTemplateVar(filename, "time")
+}
+
+func isPrintfPattern(filename string) bool {
+	return sequencePatternRe.MatchString(strings.ReplaceAll(filename, "%%", ""))
+}
+
+// sequenceNamer returns a function that names the file of a frame by
+// substituting the frame number into the printf verb of the pattern, if any,
+// and expanding the template placeholders.
+func sequenceNamer(pattern string, vars outputVars, interval time.Duration) func(frame uint64) (string, error) {
+	return func(frame uint64) (string, error) {
+		name := pattern
+		if isPrintfPattern(name) {
+			name = fmt.Sprintf(name, frame)
+		}
+		v := vars
+		v.frame = frame
+		v.time = time.Duration(frame) * interval
+		v.date = time.Now()
+		return expandTemplate(name, v)
+	}
+}
+
+// writeSequence encodes every image from the stream to its own file. Frames are
+// numbered starting at 0. If hook is not nil, it is run for every file after
+// it has been written.
+func writeSequence(name func(frame uint64) (string, error), format encode.Format, stream <-chan image.Image, hook *frameHook) error {
+	if hook != nil {
+		defer hook.Wait()
+	}
+	frame := uint64(0)
+	for img := range stream {
+		filename, err := name(frame)
+		if err != nil {
+			return err
+		}
+		if err := writeImageFile(filename, format, img); err != nil {
+			return err
+		}
+		encode.ReleaseFrame(img)
+		if hook != nil {
+			hook.Run(frame, filename)
+		}
+		frame++
+	}
+	return nil
+}
+
+func writeImageFile(filename string, format encode.Format, img image.Image) error {
+	if sink.IsRemote(filename) {
+		var buf bytes.Buffer
+		if err := format.Encode(&buf, img); err != nil {
+			return err
+		}
+		return sink.Put(filename, buf.Bytes())
+	}
+	// Templates may place frames in directories that do not exist yet.
+	if err := os.MkdirAll(filepath.Dir(filename), 0o755); err != nil {
+		return err
+	}
+	fd, err := os.Create(filename)
+	if err != nil {
+		return err
+	}
+	defer fd.Close()
+	if err := format.Encode(fd, img); err != nil {
+		return err
+	}
+	return fd.Close()
+}
+
+// frameHook runs a shell command for every frame of an image sequence with a
+// limited number of commands running at the same time.
+type frameHook struct {
+	command string
+	jobs    chan struct{}
+	wg      sync.WaitGroup
+}
+
+// newFrameHook returns nil if the command is empty.
+func newFrameHook(command string, maxJobs int) *frameHook {
+	if command == "" {
+		return nil
+	}
+	if maxJobs < 1 {
+		maxJobs = 1
+	}
+	return &frameHook{
+		command: command,
+		jobs:    make(chan struct{}, maxJobs),
+	}
+}
+
+// expand substitutes the {frame} and {file} placeholders of the command. The
+// values are quoted so they are passed to the shell verbatim.
+func (h *frameHook) expand(frame uint64, filename string) string {
+	return strings.NewReplacer(
+		"{frame}", strconv.FormatUint(frame, 10),
+		"{file}", shellQuote(filename),
+	).Replace(h.command)
+}
+
+// Run starts the command for the specified frame. It blocks while the maximum
+// number of commands are running.
+func (h *frameHook) Run(frame uint64, filename string) {
+	h.jobs <- struct{}{}
+	h.wg.Add(1)
+	go func() {
+		defer func() {
+			<-h.jobs
+			h.wg.Done()
+		}()
+		cmd := exec.Command("/bin/sh", "-c", h.expand(frame, filename))
+		cmd.Stdout = os.Stderr
+		cmd.Stderr = os.Stderr
+		if err := cmd.Run(); err != nil {
+			log.Printf("Error running command for frame %d: %v", frame, err)
+		}
+	}()
+}
+
+// Wait blocks until all commands have completed.
+func (h *frameHook) Wait() {
+	h.wg.Wait()
+}
+
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
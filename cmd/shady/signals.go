@@ -0,0 +1,198 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"image"
+	"image/draw"
+	"log"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/polyfloyd/shady/encode"
+)
+
+// signalControls are the actions that can be triggered by sending signals to
+// the process:
+//
+//	SIGUSR1: save a screenshot of the current frame, and the state with -save-state
+//	SIGUSR2: toggle pause
+//	SIGHUP:  reload the shader
+type signalControls struct {
+	screenshot    func(context.Context) (image.Image, error)
+	screenshotDir string
+	pause         *pauser
+	reload        func() error
+	// saveState writes the state of the buffers to the file of -save-state.
+	saveState func(context.Context) error
+}
+
+// handleControlSignals executes the signal controls until the context is
+// canceled.
+func handleControlSignals(ctx context.Context, c signalControls) {
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGUSR1, syscall.SIGUSR2, syscall.SIGHUP)
+	defer signal.Stop(sig)
+	for {
+		var s os.Signal
+		select {
+		case s = <-sig:
+		case <-ctx.Done():
+			return
+		}
+		switch s {
+		case syscall.SIGUSR1:
+			if filename, err := c.saveScreenshot(ctx); err != nil {
+				log.Printf("Could not save screenshot: %v", err)
+			} else {
+				log.Printf("Saved screenshot to %s", filename)
+			}
+			if c.saveState != nil {
+				if err := c.saveState(ctx); err != nil {
+					log.Printf("Could not save state: %v", err)
+				} else {
+					log.Println("Saved state")
+				}
+			}
+		case syscall.SIGUSR2:
+			if c.pause.Toggle("signal") {
+				log.Println("Paused")
+			} else {
+				log.Println("Resumed")
+			}
+		case syscall.SIGHUP:
+			if err := c.reload(); err != nil {
+				log.Printf("Could not reload: %v", err)
+			}
+		}
+	}
+}
+
+func (c signalControls) saveScreenshot(ctx context.Context) (string, error) {
+	filename := filepath.Join(c.screenshotDir, fmt.Sprintf("shady-%s.png", time.Now().Format("20060102-150405.000")))
+	return filename, c.saveScreenshotAs(ctx, filename)
+}
+
+// saveScreenshotAs writes the screenshot to a temporary file first which is
+// then renamed, so readers never observe a partially written image.
+func (c signalControls) saveScreenshotAs(ctx context.Context, filename string) error {
+	img, err := c.screenshot(ctx)
+	if err != nil {
+		return err
+	}
+	if img == nil {
+		return fmt.Errorf("no frame has been rendered yet")
+	}
+	tmp := filename + ".tmp"
+	if err := writeImageFile(tmp, encode.PNGFormat{}, img); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, filename)
+}
+
+// pauser combines the reasons for which rendering may be paused so that
+// resuming for one reason does not override another.
+type pauser struct {
+	lock    sync.Mutex
+	reasons map[string]bool
+	apply   func(paused bool)
+}
+
+// newPauser creates a pauser which calls apply, if not nil, every time the
+// combined paused state changes.
+func newPauser(apply func(paused bool)) *pauser {
+	return &pauser{reasons: map[string]bool{}, apply: apply}
+}
+
+func (p *pauser) Set(reason string, paused bool) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	was := p.paused()
+	p.reasons[reason] = paused
+	if now := p.paused(); now != was && p.apply != nil {
+		p.apply(now)
+	}
+}
+
+// Toggle flips the paused state of the specified reason and returns the new
+// value.
+func (p *pauser) Toggle(reason string) bool {
+	p.lock.Lock()
+	paused := !p.reasons[reason]
+	p.lock.Unlock()
+	p.Set(reason, paused)
+	return paused
+}
+
+func (p *pauser) Paused() bool {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	return p.paused()
+}
+
+func (p *pauser) paused() bool {
+	for _, paused := range p.reasons {
+		if paused {
+			return true
+		}
+	}
+	return false
+}
+
+// pauseStream holds back images from the stream while the pauser is paused.
+func pauseStream(in <-chan image.Image, p *pauser) <-chan image.Image {
+	out := make(chan image.Image)
+	go func() {
+		defer close(out)
+		for img := range in {
+			for p.Paused() {
+				time.Sleep(time.Second / 10)
+			}
+			out <- img
+		}
+	}()
+	return out
+}
+
+// lastFrame remembers the most recent image of a stream.
+type lastFrame struct {
+	lock sync.Mutex
+	img  image.Image
+}
+
+func recordLastFrame(in <-chan image.Image) (<-chan image.Image, *lastFrame) {
+	lf := &lastFrame{}
+	out := make(chan image.Image)
+	go func() {
+		defer close(out)
+		for img := range in {
+			// The frame is kept after it is passed on, so it must not be
+			// reused before the next one arrives.
+			encode.RetainFrame(img)
+			lf.lock.Lock()
+			encode.ReleaseFrame(lf.img)
+			lf.img = img
+			lf.lock.Unlock()
+			out <- img
+		}
+	}()
+	return out, lf
+}
+
+// Image returns a copy of the most recent image, which remains valid after
+// the frame has been released.
+func (lf *lastFrame) Image(context.Context) (image.Image, error) {
+	lf.lock.Lock()
+	defer lf.lock.Unlock()
+	if lf.img == nil {
+		return nil, nil
+	}
+	img := image.NewRGBA(lf.img.Bounds())
+	draw.Draw(img, img.Bounds(), lf.img, lf.img.Bounds().Min, draw.Src)
+	return img, nil
+}
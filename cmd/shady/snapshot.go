@@ -0,0 +1,129 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+)
+
+// snapshotSchedule describes when to save snapshots of a running shader.
+type snapshotSchedule struct {
+	// every is the interval between snapshots. Snapshots are aligned to
+	// multiples of the interval since midnight, like cron does.
+	every time.Duration
+	// at is the time of the day at which a snapshot is saved daily, as an
+	// offset from midnight. It is only used if every is 0.
+	at time.Duration
+	// dir overrides the directory the snapshots are saved to.
+	dir string
+	// file is the path that every snapshot overwrites. If empty, a new file
+	// named after the current time is created for every snapshot.
+	file string
+}
+
+// parseSnapshotSchedule parses a comma separated list of key=value pairs:
+//
+//	every=<duration>  save a snapshot at this interval, e.g. every=1h
+//	at=<hh:mm>        save a snapshot daily at this time, e.g. at=06:00
+//	dir=<path>        save snapshots to this directory
+//	file=<path>       overwrite this file with every snapshot
+func parseSnapshotSchedule(s string) (snapshotSchedule, error) {
+	var sched snapshotSchedule
+	hasAt := false
+	for _, kv := range strings.Split(s, ",") {
+		kv = strings.TrimSpace(kv)
+		i := strings.IndexByte(kv, '=')
+		if i < 0 {
+			return sched, fmt.Errorf("invalid snapshot option %q, expected key=value", kv)
+		}
+		key, value := kv[:i], kv[i+1:]
+		switch key {
+		case "every":
+			d, err := time.ParseDuration(value)
+			if err != nil {
+				return sched, err
+			}
+			if d < time.Second {
+				return sched, fmt.Errorf("snapshot interval must be at least 1s, got %v", d)
+			}
+			sched.every = d
+		case "at":
+			t, err := time.Parse("15:04", value)
+			if err != nil {
+				return sched, fmt.Errorf("invalid snapshot time %q, expected hh:mm", value)
+			}
+			sched.at = time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute
+			hasAt = true
+		case "dir":
+			sched.dir = value
+		case "file":
+			sched.file = value
+		default:
+			return sched, fmt.Errorf("unknown snapshot option %q", key)
+		}
+	}
+	if sched.every == 0 && !hasAt {
+		return sched, fmt.Errorf("snapshot schedule requires either every= or at=")
+	}
+	if sched.every != 0 && hasAt {
+		return sched, fmt.Errorf("snapshot options every= and at= are mutually exclusive")
+	}
+	return sched, nil
+}
+
+// next returns the first time after t at which a snapshot should be saved.
+func (sched snapshotSchedule) next(t time.Time) time.Time {
+	midnight := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, t.Location())
+	if sched.every == 0 {
+		n := midnight.Add(sched.at)
+		if !n.After(t) {
+			n = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, t.Location()).Add(sched.at)
+		}
+		return n
+	}
+	elapsed := t.Sub(midnight)
+	return midnight.Add((elapsed/sched.every + 1) * sched.every)
+}
+
+// runSnapshots saves snapshots according to the schedule until the context is
+// canceled.
+func runSnapshots(ctx context.Context, sched snapshotSchedule, c signalControls) {
+	if sched.dir != "" {
+		c.screenshotDir = sched.dir
+	}
+	next := sched.next(time.Now())
+	for {
+		// Timers do not advance while the system is suspended, so wake up
+		// regularly to follow the wall clock.
+		wait := time.Until(next)
+		if wait > time.Minute {
+			wait = time.Minute
+		}
+		timer := time.NewTimer(wait)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		}
+		now := time.Now()
+		if now.Before(next) {
+			continue
+		}
+		next = sched.next(now)
+		filename := sched.file
+		var err error
+		if filename != "" {
+			err = c.saveScreenshotAs(ctx, filename)
+		} else {
+			filename, err = c.saveScreenshot(ctx)
+		}
+		if err != nil {
+			log.Printf("Could not save snapshot: %v", err)
+			continue
+		}
+		log.Printf("Saved snapshot to %s", filename)
+	}
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/polyfloyd/shady/encode"
+	"github.com/polyfloyd/shady/renderer"
+	"github.com/polyfloyd/shady/shadertoy"
+)
+
+// soundBlockSize is the width and height of the blocks of samples that are
+// rendered at once, like the sound passes of Shadertoy.
+const soundBlockSize = 512
+
+// soundOptions configures rendering a sound shader with -sound.
+type soundOptions struct {
+	source      string
+	includeDirs []string
+	glslVersion string
+	glVersion   renderer.OpenGLVersion
+	sampleRate  int
+}
+
+// renderSoundFile renders the sound shader to a stereo WAV file. The file
+// starts at the animation time start and lasts for the duration, so it lines
+// up with the frames that are rendered.
+func renderSoundFile(filename string, opts soundOptions, start, duration time.Duration) error {
+	abs, err := filepath.Abs(opts.source)
+	if err != nil {
+		return err
+	}
+	resolver := renderer.URLResolver{Next: renderer.FileResolver{SearchPath: opts.includeDirs}}
+	sources, err := renderer.IncludeSources(resolver, renderer.SourceFile{Filename: abs})
+	if err != nil {
+		return err
+	}
+
+	sh, err := renderer.NewShader(soundBlockSize, soundBlockSize, opts.glVersion)
+	if err != nil {
+		return err
+	}
+	defer sh.Close()
+	if err := sh.SetPixelFormat(renderer.PixelFormatRGBA32F); err != nil {
+		return err
+	}
+	startSample := int(start * time.Duration(opts.sampleRate) / time.Second)
+	sh.SetEnvironment(shadertoy.NewSound(sources, opts.glslVersion, opts.sampleRate, startSample))
+
+	f, err := os.Create(filename)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	numSamples := int(duration * time.Duration(opts.sampleRate) / time.Second)
+	err = writeSound(w, opts.sampleRate, numSamples, func() ([]float32, error) {
+		img, err := sh.RenderFrame(0)
+		if err != nil {
+			return nil, err
+		}
+		frame, ok := img.(*encode.FloatFrame)
+		if !ok {
+			return nil, fmt.Errorf("unexpected frame of type %T", img)
+		}
+		return frame.Pix, nil
+	})
+	if err == nil {
+		err = w.Flush()
+	}
+	if err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// writeSound writes a stereo 16-bit WAV file of numSamples samples. The samples
+// are taken from the red and green channels of blocks returned by nextBlock,
+// which are read until there are enough samples.
+func writeSound(w io.Writer, sampleRate, numSamples int, nextBlock func() ([]float32, error)) error {
+	if err := writeWAVHeader(w, 2, sampleRate, numSamples); err != nil {
+		return err
+	}
+	var samples []int16
+	for remaining := numSamples; remaining > 0; {
+		block, err := nextBlock()
+		if err != nil {
+			return err
+		}
+		n := len(block) / 4
+		if n == 0 {
+			return fmt.Errorf("empty block of samples")
+		}
+		if n > remaining {
+			n = remaining
+		}
+		samples = samples[:0]
+		for i := 0; i < n; i++ {
+			samples = append(samples, pcm16(block[i*4]), pcm16(block[i*4+1]))
+		}
+		if err := binary.Write(w, binary.LittleEndian, samples); err != nil {
+			return err
+		}
+		remaining -= n
+	}
+	return nil
+}
+
+// pcm16 converts a sample in the range [-1, 1] to a 16-bit value.
+func pcm16(v float32) int16 {
+	return int16(math.Round(math.Max(-1, math.Min(1, float64(v))) * math.MaxInt16))
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"context"
+	"os"
+
+	"github.com/polyfloyd/shady/renderer"
+)
+
+func readStateFile(filename string) (*renderer.State, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return renderer.ReadState(f)
+}
+
+// writeStateFile writes the state to a temporary file first which is then
+// renamed, so an interrupted write does not destroy the previous state.
+func writeStateFile(filename string, st *renderer.State) error {
+	tmp := filename + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	if err := renderer.WriteState(f, st); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, filename)
+}
+
+// stateSaver returns a function that saves the state of an engine while it
+// is animating.
+func stateSaver(filename string, state func(context.Context) (*renderer.State, error)) func(context.Context) error {
+	return func(ctx context.Context) error {
+		st, err := state(ctx)
+		if err != nil {
+			return err
+		}
+		return writeStateFile(filename, st)
+	}
+}
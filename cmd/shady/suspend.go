@@ -0,0 +1,83 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"time"
+)
+
+const (
+	// suspendPollInterval is how often the clocks are compared to detect
+	// whether the system was suspended.
+	suspendPollInterval = time.Second
+	// suspendMinGap is the minimum difference between the wall clock and the
+	// monotonic clock that is considered a suspend. Smaller differences are
+	// likely caused by clock adjustments.
+	suspendMinGap = 5 * time.Second
+)
+
+type suspendFlags struct {
+	timePolicy *string
+	reload     *bool
+}
+
+func registerSuspendFlags(fs *flag.FlagSet) suspendFlags {
+	return suspendFlags{
+		timePolicy: fs.String("suspend-time", "continue", "How the time of the animation behaves across a system suspend: \"continue\" resumes where it left off, \"jump\" skips forward by the duration of the suspend"),
+		reload:     fs.Bool("suspend-reload", false, "Reload the shader after resuming from a system suspend, rather than only reinitializing inputs such as webcams. The state of buffers is reset"),
+	}
+}
+
+func (f suspendFlags) validate() error {
+	switch *f.timePolicy {
+	case "continue", "jump":
+		return nil
+	default:
+		return fmt.Errorf("invalid -suspend-time %q, expected \"continue\" or \"jump\"", *f.timePolicy)
+	}
+}
+
+// handleResume calls the advance function as configured every time the system
+// resumes from a suspend. Inputs are then reinitialized with resume, or the
+// whole shader with reload if -suspend-reload is set.
+func (f suspendFlags) handleResume(ctx context.Context, advance func(time.Duration), resume func(), reload func() error) {
+	watchSuspend(ctx, func(d time.Duration) {
+		log.Printf("Resumed after being suspended for %v", d.Round(time.Second))
+		if *f.timePolicy == "jump" {
+			advance(d)
+		}
+		if !*f.reload {
+			resume()
+		} else if err := reload(); err != nil {
+			log.Printf("Could not reload after resume: %v", err)
+		}
+	})
+}
+
+// watchSuspend calls fn with the approximate duration of every system suspend
+// until the context is canceled.
+//
+// The monotonic clock of Linux does not advance while the system is suspended
+// while the wall clock does. A suspend is detected by a growing difference
+// between the two.
+func watchSuspend(ctx context.Context, fn func(time.Duration)) {
+	ticker := time.NewTicker(suspendPollInterval)
+	defer ticker.Stop()
+	last := time.Now()
+	for {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+		now := time.Now()
+		// Round(0) strips the monotonic clock reading.
+		gap := now.Round(0).Sub(last.Round(0)) - now.Sub(last)
+		last = now
+		if gap >= suspendMinGap {
+			fn(gap)
+		}
+	}
+}
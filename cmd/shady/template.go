@@ -0,0 +1,101 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// templateVarRe matches placeholders in output filenames with an optional
+// format, e.g. "{frame}" or "{frame:05d}".
+var templateVarRe = regexp.MustCompile(`\{(\w+)(?::([^}]*))?\}`)
+
+// printfSpecRe matches the part of a printf verb after the '%'.
+var printfSpecRe = regexp.MustCompile(`^[-+ #0]*\d*(\.\d+)?[a-zA-Z]$`)
+
+// outputVars are the values that can be substituted into output filenames.
+type outputVars struct {
+	frame  uint64
+	time   time.Duration
+	date   time.Time
+	shader string
+	seed   int64
+	// pass is the name of the pass of files written by -dump-passes.
+	pass string
+}
+
+// shaderName returns the name of a shader file without directory and
+// extension for use in output filenames.
+func shaderName(filename string) string {
+	base := filepath.Base(filename)
+	return strings.TrimSuffix(base, filepath.Ext(base))
+}
+
+// hasTemplateVar reports whether the filename contains the specified
+// placeholder.
+func hasTemplateVar(filename, name string) bool {
+	for _, m := range templateVarRe.FindAllStringSubmatch(filename, -1) {
+		if m[1] == name {
+			return true
+		}
+	}
+	return false
+}
+
+// validateTemplate checks that all placeholders in the filename are known and
+// have a valid format.
+func validateTemplate(filename string) error {
+	_, err := expandTemplate(filename, outputVars{})
+	return err
+}
+
+// expandTemplate substitutes the placeholders in filename:
+//
+//	{frame}   the frame number, e.g. {frame:05d} for zero padding
+//	{time}    the animation time in seconds, e.g. {time:.2f}
+//	{date}    the current date, the format is a Go time layout
+//	{shader}  the name of the first shader file
+//	{seed}    the value of -seed
+//	{pass}    the name of the pass, only for -dump-passes
+//
+// Formats other than those of {date} are printf verbs without the '%'.
+func expandTemplate(filename string, vars outputVars) (string, error) {
+	var err error
+	out := templateVarRe.ReplaceAllStringFunc(filename, func(match string) string {
+		m := templateVarRe.FindStringSubmatch(match)
+		name, spec := m[1], m[2]
+		if name == "date" {
+			if spec == "" {
+				spec = "2006-01-02"
+			}
+			return vars.date.Format(spec)
+		}
+		var value interface{}
+		var defaultSpec string
+		switch name {
+		case "frame":
+			value, defaultSpec = vars.frame, "d"
+		case "time":
+			value, defaultSpec = vars.time.Seconds(), "g"
+		case "shader":
+			value, defaultSpec = vars.shader, "s"
+		case "seed":
+			value, defaultSpec = vars.seed, "d"
+		case "pass":
+			value, defaultSpec = vars.pass, "s"
+		default:
+			err = fmt.Errorf("unknown placeholder %q in %q", match, filename)
+			return match
+		}
+		if spec == "" {
+			spec = defaultSpec
+		} else if !printfSpecRe.MatchString(spec) {
+			err = fmt.Errorf("invalid format %q in %q", spec, filename)
+			return match
+		}
+		return fmt.Sprintf("%"+spec, value)
+	})
+	return out, err
+}
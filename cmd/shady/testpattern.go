@@ -0,0 +1,289 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// testPatterns are builtin shaders for validating output chains, selected with
+// -source test:<name>.
+var testPatterns = map[string]struct {
+	description string
+	source      string
+}{
+	"bars":    {"SMPTE color bars for checking colors and levels", testBarsSource},
+	"sync":    {"A flash on the first frame of every second, use -sync-audio to write the matching beeps", testSyncSource},
+	"grid":    {"A pixel grid with orientation markers for checking resolutions, scaling and LED mappings", testGridSource},
+	"latency": {"The frame number encoded in a grid of cells, use -latency to measure the latency with a camera", testLatencySource},
+}
+
+const testBarsSource = `// An approximation of the SMPTE EG 1 color bars in studio range.
+
+vec3 level(vec3 v) {
+	return (16.0 + v * 219.0) / 255.0;
+}
+
+void mainImage(out vec4 fragColor, in vec2 fragCoord) {
+	vec2 uv = fragCoord / iResolution.xy;
+	float bar = floor(uv.x * 7.0);
+	vec3 color;
+	if (uv.y > 1.0 / 3.0) {
+		// 75% bars: gray, yellow, cyan, green, magenta, red, blue.
+		vec3 bars[7];
+		bars[0] = vec3(1.0, 1.0, 1.0);
+		bars[1] = vec3(1.0, 1.0, 0.0);
+		bars[2] = vec3(0.0, 1.0, 1.0);
+		bars[3] = vec3(0.0, 1.0, 0.0);
+		bars[4] = vec3(1.0, 0.0, 1.0);
+		bars[5] = vec3(1.0, 0.0, 0.0);
+		bars[6] = vec3(0.0, 0.0, 1.0);
+		color = level(bars[int(bar)] * 0.75);
+	} else if (uv.y > 0.25) {
+		// Reverse blue bars: blue, black, magenta, black, cyan, black, gray.
+		vec3 bars[7];
+		bars[0] = vec3(0.0, 0.0, 1.0);
+		bars[1] = vec3(0.0);
+		bars[2] = vec3(1.0, 0.0, 1.0);
+		bars[3] = vec3(0.0);
+		bars[4] = vec3(0.0, 1.0, 1.0);
+		bars[5] = vec3(0.0);
+		bars[6] = vec3(1.0, 1.0, 1.0);
+		color = level(bars[int(bar)] * 0.75);
+	} else {
+		// -I, white, +Q, black, PLUGE and black.
+		float x = uv.x * 7.0;
+		if (x < 1.25) {
+			color = level(vec3(0.0, 0.16, 0.3));
+		} else if (x < 2.5) {
+			color = level(vec3(1.0));
+		} else if (x < 3.75) {
+			color = level(vec3(0.2, 0.0, 0.42));
+		} else if (x < 5.0) {
+			color = level(vec3(0.0));
+		} else if (x < 5.0 + 1.0 / 3.0) {
+			color = level(vec3(-0.04));
+		} else if (x < 5.0 + 2.0 / 3.0) {
+			color = level(vec3(0.0));
+		} else if (x < 6.0) {
+			color = level(vec3(0.04));
+		} else {
+			color = level(vec3(0.0));
+		}
+	}
+	fragColor = vec4(color, 1.0);
+}
+`
+
+const testSyncSource = `// Flashes white on the first frame of every second, which lines up with the
+// beeps written by -sync-audio. The sweep shows the position within the second
+// and the blocks at the bottom encode the frame number in binary, least
+// significant bit at the left, to read latencies from a camera recording.
+
+void mainImage(out vec4 fragColor, in vec2 fragCoord) {
+	vec2 uv = fragCoord / iResolution.xy;
+	float t = iTime + 1e-4;
+	bool flash = iFrame == 0 || floor(t) != floor(t - iTimeDelta);
+	vec3 color = flash ? vec3(1.0) : vec3(0.0);
+
+	// The sweep.
+	if (uv.y > 0.45 && uv.y < 0.55 && abs(uv.x - fract(t)) < 0.01) {
+		color = vec3(1.0, 0.0, 0.0);
+	}
+
+	// The frame counter.
+	if (uv.y < 0.1) {
+		float bit = floor(uv.x * 16.0);
+		bool set = mod(floor(float(iFrame) / pow(2.0, bit)), 2.0) > 0.5;
+		bool border = fract(uv.x * 16.0) < 0.05;
+		color = border ? vec3(0.5) : set ? vec3(0.0, 1.0, 0.0) : vec3(0.0, 0.2, 0.0);
+	}
+	fragColor = vec4(color, 1.0);
+}
+`
+
+const testGridSource = `// Lines every 10 and 100 pixels, a one pixel border, a checkerboard of single
+// pixels along the top and colored squares in the corners: red at the top
+// left, green at the top right, blue at the bottom left and white at the
+// bottom right.
+
+void mainImage(out vec4 fragColor, in vec2 fragCoord) {
+	vec2 p = floor(fragCoord);
+	vec2 size = iResolution.xy;
+	vec3 color = vec3(0.1);
+	if (mod(p.x, 10.0) < 0.5 || mod(p.y, 10.0) < 0.5) {
+		color = vec3(0.35);
+	}
+	if (mod(p.x, 100.0) < 0.5 || mod(p.y, 100.0) < 0.5) {
+		color = vec3(0.8);
+	}
+	if (abs(p.x - floor(size.x / 2.0)) < 0.5 || abs(p.y - floor(size.y / 2.0)) < 0.5) {
+		color = vec3(1.0, 1.0, 0.0);
+	}
+	if (p.y >= size.y - 9.0 && p.y < size.y - 1.0 && p.x > 16.0 && p.x < size.x - 17.0) {
+		color = vec3(mod(p.x + p.y, 2.0));
+	}
+
+	float corner = max(2.0, min(16.0, floor(min(size.x, size.y) / 8.0)));
+	bool left = p.x < corner;
+	bool right = p.x >= size.x - corner;
+	bool top = p.y >= size.y - corner;
+	bool bottom = p.y < corner;
+	if (top && left) {
+		color = vec3(1.0, 0.0, 0.0);
+	} else if (top && right) {
+		color = vec3(0.0, 1.0, 0.0);
+	} else if (bottom && left) {
+		color = vec3(0.0, 0.0, 1.0);
+	} else if (bottom && right) {
+		color = vec3(1.0);
+	}
+
+	if (p.x < 0.5 || p.y < 0.5 || p.x > size.x - 1.5 || p.y > size.y - 1.5) {
+		color = vec3(1.0, 0.0, 1.0);
+	}
+	fragColor = vec4(color, 1.0);
+}
+`
+
+const testLatencySource = `// The frame number as a Gray code in a 4x4 grid of cells, which is read back
+// by -latency from a camera looking at the display. Cells are numbered from the
+// top left in reading order: cell 0 is always white, cells 1 to 13 contain the
+// bits of the code, least significant first, cell 14 is the parity of the code
+// and cell 15 is always black.
+
+float bitAt(float n, float i) {
+	return mod(floor(n / exp2(i)), 2.0);
+}
+
+void mainImage(out vec4 fragColor, in vec2 fragCoord) {
+	vec2 grid = vec2(fragCoord.x, iResolution.y - fragCoord.y) / iResolution.xy * 4.0;
+	vec2 inner = fract(grid);
+	float index = floor(grid.y) * 4.0 + floor(grid.x);
+	float n = mod(float(iFrame), 8192.0);
+	float on = 0.0;
+	if (index < 0.5) {
+		on = 1.0;
+	} else if (index < 13.5) {
+		// Only one bit of a Gray code changes between frames, so a camera
+		// that captures a transition is off by at most one frame.
+		on = abs(bitAt(n, index - 1.0) - bitAt(n, index));
+	} else if (index < 14.5) {
+		// The parity of a Gray code is the lowest bit of the number.
+		on = bitAt(n, 0.0);
+	}
+	// Gaps between the cells keep them apart when the camera is out of focus.
+	if (any(lessThan(inner, vec2(0.1))) || any(greaterThan(inner, vec2(0.9)))) {
+		on = 0.0;
+	}
+	fragColor = vec4(vec3(on), 1.0);
+}
+`
+
+func testPatternNames() []string {
+	names := make([]string, 0, len(testPatterns))
+	for name := range testPatterns {
+		names = append(names, "test:"+name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// writeSource writes the builtin source to dir and returns the filename.
+func writeSource(dir, source string) (string, error) {
+	name := strings.TrimPrefix(source, "test:")
+	pattern, ok := testPatterns[name]
+	if !ok || name == source {
+		return "", fmt.Errorf("unknown source %q, valid sources are: %s", source, strings.Join(testPatternNames(), ", "))
+	}
+	filename := filepath.Join(dir, "test-"+name+".glsl")
+	if err := os.WriteFile(filename, []byte(pattern.source), 0o644); err != nil {
+		return "", err
+	}
+	return filename, nil
+}
+
+// syncAudioSampleRate is the sample rate of the WAV files written by
+// writeSyncAudio.
+const syncAudioSampleRate = 48000
+
+// writeSyncAudio writes a mono 16-bit WAV file with a 1kHz beep at the start of
+// every second of the animation, to go with the sync test pattern. The file
+// starts at the animation time start and lasts for the duration. Each beep
+// lasts as long as the flash.
+func writeSyncAudio(w io.Writer, start, duration, interval time.Duration) error {
+	numSamples := int(duration * syncAudioSampleRate / time.Second)
+	startSample := int(start * syncAudioSampleRate / time.Second)
+	beepSamples := int(interval * syncAudioSampleRate / time.Second)
+	if err := writeWAVHeader(w, 1, syncAudioSampleRate, numSamples); err != nil {
+		return err
+	}
+	samples := make([]int16, numSamples)
+	for i := range samples {
+		if (startSample+i)%syncAudioSampleRate < beepSamples {
+			t := float64(startSample+i) / syncAudioSampleRate
+			samples[i] = int16(math.Sin(2*math.Pi*1000*t) * 0.5 * math.MaxInt16)
+		}
+	}
+	return binary.Write(w, binary.LittleEndian, samples)
+}
+
+// writeWAVHeader writes the header of a 16-bit PCM WAV file with numFrames
+// samples for each of the channels.
+func writeWAVHeader(w io.Writer, channels, sampleRate, numFrames int) error {
+	dataSize := numFrames * channels * 2
+	header := struct {
+		RIFF          [4]byte
+		Size          uint32
+		WAVE          [4]byte
+		Fmt           [4]byte
+		FmtSize       uint32
+		AudioFormat   uint16
+		Channels      uint16
+		SampleRate    uint32
+		ByteRate      uint32
+		BlockAlign    uint16
+		BitsPerSample uint16
+		Data          [4]byte
+		DataSize      uint32
+	}{
+		RIFF:          [4]byte{'R', 'I', 'F', 'F'},
+		Size:          uint32(36 + dataSize),
+		WAVE:          [4]byte{'W', 'A', 'V', 'E'},
+		Fmt:           [4]byte{'f', 'm', 't', ' '},
+		FmtSize:       16,
+		AudioFormat:   1,
+		Channels:      uint16(channels),
+		SampleRate:    uint32(sampleRate),
+		ByteRate:      uint32(sampleRate * channels * 2),
+		BlockAlign:    uint16(channels * 2),
+		BitsPerSample: 16,
+		Data:          [4]byte{'d', 'a', 't', 'a'},
+		DataSize:      uint32(dataSize),
+	}
+	return binary.Write(w, binary.LittleEndian, header)
+}
+
+func writeSyncAudioFile(filename string, start, duration, interval time.Duration) error {
+	f, err := os.Create(filename)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	if err := writeSyncAudio(w, start, duration, interval); err != nil {
+		f.Close()
+		return err
+	}
+	if err := w.Flush(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
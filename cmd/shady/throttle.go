@@ -0,0 +1,203 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"image"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// throttlePollInterval is how often the power and idle state of the system is
+// checked.
+const throttlePollInterval = 10 * time.Second
+
+// throttlePolicy describes what to do with rendering when a condition such as
+// running on battery power is met.
+type throttlePolicy struct {
+	enabled bool
+	pause   bool
+	fps     float64
+}
+
+func parseThrottlePolicy(s string) (throttlePolicy, error) {
+	switch s {
+	case "":
+		return throttlePolicy{}, nil
+	case "pause":
+		return throttlePolicy{enabled: true, pause: true}, nil
+	}
+	fps, err := strconv.ParseFloat(s, 64)
+	if err != nil || fps <= 0 {
+		return throttlePolicy{}, fmt.Errorf("invalid throttle policy %q, expected \"pause\" or a framerate", s)
+	}
+	return throttlePolicy{enabled: true, fps: fps}, nil
+}
+
+type throttleFlags struct {
+	onBattery, onIdle *string
+}
+
+func registerThrottleFlags(fs *flag.FlagSet) throttleFlags {
+	return throttleFlags{
+		onBattery: fs.String("on-battery", "", "What to do while running on battery power: \"pause\" or the maximum number of frames per second"),
+		onIdle:    fs.String("on-idle", "", "What to do while the user is idle: \"pause\" or the maximum number of frames per second"),
+	}
+}
+
+// newThrottle returns nil if no throttle policy was configured.
+func (f throttleFlags) newThrottle() (*throttle, error) {
+	battery, err := parseThrottlePolicy(*f.onBattery)
+	if err != nil {
+		return nil, fmt.Errorf("-on-battery: %w", err)
+	}
+	idle, err := parseThrottlePolicy(*f.onIdle)
+	if err != nil {
+		return nil, fmt.Errorf("-on-idle: %w", err)
+	}
+	if !battery.enabled && !idle.enabled {
+		return nil, nil
+	}
+	return &throttle{battery: battery, idle: idle}, nil
+}
+
+// throttle periodically checks the power and idle state of the system and
+// decides whether rendering should be slowed down or paused.
+type throttle struct {
+	battery, idle throttlePolicy
+
+	lock     sync.Mutex
+	paused   bool
+	interval time.Duration
+}
+
+// State returns whether rendering should be paused and otherwise the minimum
+// interval between frames, which is 0 if the framerate is not limited.
+func (t *throttle) State() (paused bool, interval time.Duration) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	return t.paused, t.interval
+}
+
+// Run polls the system state until the context is canceled and calls apply
+// every time the resulting throttle state changes.
+func (t *throttle) Run(ctx context.Context, apply func(paused bool, interval time.Duration)) {
+	ticker := time.NewTicker(throttlePollInterval)
+	defer ticker.Stop()
+	first := true
+	for {
+		var active []throttlePolicy
+		var reasons []string
+		if t.battery.enabled && onBatteryPower() {
+			active = append(active, t.battery)
+			reasons = append(reasons, "on battery")
+		}
+		if t.idle.enabled && userIdle() {
+			active = append(active, t.idle)
+			reasons = append(reasons, "user idle")
+		}
+		paused, interval := combineThrottlePolicies(active)
+
+		t.lock.Lock()
+		changed := first || paused != t.paused || interval != t.interval
+		t.paused, t.interval = paused, interval
+		t.lock.Unlock()
+		if changed {
+			switch {
+			case paused:
+				log.Printf("Pausing rendering (%s)", strings.Join(reasons, ", "))
+			case interval > 0:
+				log.Printf("Throttling rendering to %.2f fps (%s)", float64(time.Second)/float64(interval), strings.Join(reasons, ", "))
+			case !first:
+				log.Printf("Resuming rendering at full speed")
+			}
+			if apply != nil {
+				apply(paused, interval)
+			}
+		}
+		first = false
+
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// combineThrottlePolicies picks the most restrictive of the active policies.
+func combineThrottlePolicies(active []throttlePolicy) (paused bool, interval time.Duration) {
+	for _, p := range active {
+		if p.pause {
+			return true, 0
+		}
+		if d := time.Duration(float64(time.Second) / p.fps); d > interval {
+			interval = d
+		}
+	}
+	return false, interval
+}
+
+// throttleStream limits the framerate of the stream as instructed by the
+// throttle. Pausing is left to a pauser which the throttle should be applied
+// to.
+func throttleStream(in <-chan image.Image, t *throttle) <-chan image.Image {
+	out := make(chan image.Image)
+	go func() {
+		defer close(out)
+		lastFrame := time.Now()
+		for img := range in {
+			_, interval := t.State()
+			time.Sleep(interval - time.Since(lastFrame))
+			lastFrame = time.Now()
+			out <- img
+		}
+	}()
+	return out
+}
+
+// onBatteryPower reports whether the system has an external power supply which
+// is currently offline. Systems without a battery, such as desktops, never
+// report to be on battery power.
+func onBatteryPower() bool {
+	supplies, _ := filepath.Glob("/sys/class/power_supply/*")
+	hasBattery, hasMains, mainsOnline := false, false, false
+	for _, dir := range supplies {
+		typ, err := os.ReadFile(filepath.Join(dir, "type"))
+		if err != nil {
+			continue
+		}
+		switch strings.TrimSpace(string(typ)) {
+		case "Battery":
+			hasBattery = true
+		case "Mains", "USB":
+			hasMains = true
+			if online, err := os.ReadFile(filepath.Join(dir, "online")); err == nil && strings.TrimSpace(string(online)) == "1" {
+				mainsOnline = true
+			}
+		}
+	}
+	return hasBattery && hasMains && !mainsOnline
+}
+
+// userIdle reports whether the session of the user is marked as idle by
+// systemd-logind. Whether and when this happens depends on the desktop
+// environment.
+func userIdle() bool {
+	session := os.Getenv("XDG_SESSION_ID")
+	if session == "" {
+		session = "auto"
+	}
+	out, err := exec.Command("loginctl", "show-session", session, "--property=IdleHint", "--value").Output()
+	if err != nil {
+		return false
+	}
+	return strings.TrimSpace(string(out)) == "yes"
+}
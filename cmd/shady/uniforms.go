@@ -0,0 +1,207 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"net"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/polyfloyd/shady/renderer"
+)
+
+// uniformFlags configure the values of the uniforms that shaders declare with
+// `#pragma uniform`.
+type uniformFlags struct {
+	values arrayFlags
+	stdin  *bool
+	osc    *string
+}
+
+func registerUniformFlags(fs *flag.FlagSet) *uniformFlags {
+	f := &uniformFlags{
+		stdin: fs.Bool("uniform-stdin", false, "Read uniform values as NAME=VALUE lines from stdin while rendering. The line \"list\" prints the uniforms of the shader"),
+		osc:   fs.String("osc-in", "", "Listen for OSC messages that set uniform values on a UDP address like :9000. The last part of the address of a message is the name of the uniform"),
+	}
+	fs.Var(&f.values, "u", "Set a uniform that the shader declares with #pragma uniform as NAME=VALUE, e.g. speed=2.5 or tint=1,0.5,0.2")
+	return f
+}
+
+// start sets the values of -u and starts reading values from the inputs that
+// are enabled. The inputs stop when done is closed.
+func (f *uniformFlags) start(done <-chan struct{}) (*renderer.UserUniforms, error) {
+	uniforms := renderer.NewUserUniforms()
+	for _, v := range f.values {
+		if err := setUniformLine(uniforms, v); err != nil {
+			return nil, fmt.Errorf("-u: %w", err)
+		}
+	}
+	if *f.stdin {
+		go readUniforms(os.Stdin, os.Stderr, uniforms)
+	}
+	if *f.osc != "" {
+		conn, err := net.ListenPacket("udp", *f.osc)
+		if err != nil {
+			return nil, fmt.Errorf("-osc-in: %w", err)
+		}
+		go func() {
+			<-done
+			conn.Close()
+		}()
+		go receiveOSCUniforms(conn, uniforms)
+	}
+	return uniforms, nil
+}
+
+// setUniformLine sets a value written as NAME=VALUE.
+func setUniformLine(uniforms *renderer.UserUniforms, line string) error {
+	i := strings.IndexByte(line, '=')
+	if i <= 0 {
+		return fmt.Errorf("invalid value %q, expected NAME=VALUE", line)
+	}
+	return uniforms.SetString(strings.TrimSpace(line[:i]), line[i+1:])
+}
+
+// readUniforms sets the values of lines like "speed=2.5" until r is closed.
+// The line "list" writes the declared uniforms and their values to w.
+func readUniforms(r io.Reader, w io.Writer, uniforms *renderer.UserUniforms) {
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		switch {
+		case line == "" || strings.HasPrefix(line, "#"):
+		case line == "list":
+			for _, uu := range uniforms.Declared() {
+				fmt.Fprintf(w, "%s\n", formatUniform(uu, uniforms.Value(uu)))
+			}
+		default:
+			if err := setUniformLine(uniforms, line); err != nil {
+				log.Printf("Could not set uniform: %v", err)
+			}
+		}
+	}
+}
+
+// formatUniform formats a uniform like its declaration, with the current
+// value.
+func formatUniform(uu renderer.UserUniform, value []float32) string {
+	values := make([]string, len(value))
+	for i, v := range value {
+		values[i] = fmt.Sprint(v)
+	}
+	s := fmt.Sprintf("%s %s = %s", uu.Type, uu.Name, strings.Join(values, ", "))
+	if uu.HasRange {
+		s += fmt.Sprintf(" range(%v, %v)", uu.Min, uu.Max)
+	}
+	return s
+}
+
+// receiveOSCUniforms sets the values of the OSC messages that are received
+// until the connection is closed. The float and int arguments of a message are
+// the components of the value.
+func receiveOSCUniforms(conn net.PacketConn, uniforms *renderer.UserUniforms) {
+	buf := make([]byte, 1<<16)
+	for {
+		n, _, err := conn.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		messages, err := parseOSCPacket(buf[:n])
+		if err != nil {
+			log.Printf("Invalid OSC packet: %v", err)
+			continue
+		}
+		for _, msg := range messages {
+			if err := uniforms.Set(path.Base(msg.address), msg.args); err != nil {
+				log.Printf("Could not set uniform: %v", err)
+			}
+		}
+	}
+}
+
+// oscInMessage is an OSC message with numeric arguments.
+type oscInMessage struct {
+	address string
+	args    []float32
+}
+
+// parseOSCPacket parses an OSC message, or the messages of a bundle. Messages
+// without any float or int arguments are left out.
+func parseOSCPacket(b []byte) ([]oscInMessage, error) {
+	if bytes.HasPrefix(b, []byte("#bundle\x00")) {
+		if len(b) < 16 {
+			return nil, fmt.Errorf("truncated bundle")
+		}
+		// The time tag is ignored, values apply immediately.
+		b = b[16:]
+		var messages []oscInMessage
+		for len(b) >= 4 {
+			size := int(binary.BigEndian.Uint32(b))
+			if size > len(b)-4 {
+				return nil, fmt.Errorf("truncated bundle element")
+			}
+			inner, err := parseOSCPacket(b[4 : 4+size])
+			if err != nil {
+				return nil, err
+			}
+			messages = append(messages, inner...)
+			b = b[4+size:]
+		}
+		return messages, nil
+	}
+
+	address, b, err := readOSCString(b)
+	if err != nil {
+		return nil, err
+	}
+	tags, b, err := readOSCString(b)
+	if err != nil || !strings.HasPrefix(tags, ",") {
+		return nil, fmt.Errorf("%s: missing type tags", address)
+	}
+	msg := oscInMessage{address: address}
+	for _, tag := range tags[1:] {
+		switch tag {
+		case 'f', 'i':
+			if len(b) < 4 {
+				return nil, fmt.Errorf("%s: truncated arguments", address)
+			}
+			v := binary.BigEndian.Uint32(b)
+			if tag == 'f' {
+				msg.args = append(msg.args, math.Float32frombits(v))
+			} else {
+				msg.args = append(msg.args, float32(int32(v)))
+			}
+			b = b[4:]
+		case 'T':
+			msg.args = append(msg.args, 1)
+		case 'F':
+			msg.args = append(msg.args, 0)
+		default:
+			return nil, fmt.Errorf("%s: unsupported argument type %q", address, tag)
+		}
+	}
+	if len(msg.args) == 0 {
+		return nil, nil
+	}
+	return []oscInMessage{msg}, nil
+}
+
+// readOSCString reads a string that is padded to a multiple of 4 bytes.
+func readOSCString(b []byte) (string, []byte, error) {
+	end := bytes.IndexByte(b, 0)
+	if end < 0 {
+		return "", nil, fmt.Errorf("unterminated string")
+	}
+	next := (end/4 + 1) * 4
+	if next > len(b) {
+		next = len(b)
+	}
+	return string(b[:end]), b[next:], nil
+}
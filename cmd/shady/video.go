@@ -0,0 +1,52 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/polyfloyd/shady/encode"
+)
+
+type videoFlags struct {
+	codec       *string
+	hardware    *string
+	device      *string
+	crf         *int
+	pixelFormat *string
+	subtitles   *string
+	subOffset   *time.Duration
+}
+
+func registerVideoFlags(fs *flag.FlagSet) videoFlags {
+	return videoFlags{
+		codec:       fs.String("video-codec", "", "The codec of video, HLS and DASH output: h264, hevc or vp9. If empty, vp9 is used for webm and h264 for anything else"),
+		hardware:    fs.String("hw-encoder", "", "Encode video, HLS and DASH output on the GPU with vaapi or nvenc instead of on the CPU. Combine with -gpu-convert to also convert the frames on the GPU"),
+		device:      fs.String("vaapi-device", encode.DefaultVAAPIDevice, "The DRM render node used by -hw-encoder vaapi"),
+		crf:         fs.Int("video-crf", 0, "The constant rate factor of video, HLS and DASH output, lower is better. If 0, the default of the encoder is used"),
+		pixelFormat: fs.String("video-pix-fmt", "", "The FFmpeg pixel format of video, HLS and DASH output, e.g. yuv444p or yuv420p10le. If empty, yuv420p is used, or nv12 with -hw-encoder vaapi"),
+		subtitles:   fs.String("subtitles", "", "Burn the subtitles of an SRT or ASS file into video, HLS and DASH output. Subtitles are timed by the animation time"),
+		subOffset:   fs.Duration("subtitles-offset", 0, "Shift -subtitles by this duration, e.g. to match the timeline of an input video. Subtitles at this time are shown at the start of the animation"),
+	}
+}
+
+// encoder returns the configured encoder for an animation that starts at the
+// time start.
+func (f videoFlags) encoder(start time.Duration) (encode.VideoEncoder, error) {
+	enc := encode.VideoEncoder{
+		Codec:           *f.codec,
+		Hardware:        *f.hardware,
+		Device:          *f.device,
+		CRF:             *f.crf,
+		PixelFormat:     *f.pixelFormat,
+		Subtitles:       *f.subtitles,
+		SubtitlesOffset: start + *f.subOffset,
+	}
+	if enc.Subtitles != "" {
+		if _, err := os.Stat(enc.Subtitles); err != nil {
+			return enc, fmt.Errorf("-subtitles: %w", err)
+		}
+	}
+	return enc, enc.Validate()
+}
@@ -0,0 +1,257 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/polyfloyd/shady/renderer"
+)
+
+type warpFlags struct {
+	file      *string
+	calibrate *bool
+	grid      *string
+	keystone  *string
+	lens      *string
+	rotate    *int
+	flip      *string
+}
+
+func registerWarpFlags(fs *flag.FlagSet) warpFlags {
+	return warpFlags{
+		file:      fs.String("warp", "", "Map the rendered image onto the output through the mesh and edge blending of a warp file, for projection mapping"),
+		calibrate: fs.Bool("warp-calibrate", false, "Edit the points of the -warp file interactively in the window. Press s to save"),
+		grid:      fs.String("warp-grid", "4x4", "The number of points of new -warp files as COLSxROWS"),
+		keystone:  fs.String("keystone", "", "Move the corners of the output with a perspective transform as X,Y pairs for the top left, top right, bottom right and bottom left in the 0-1 range. Overrides the keystone of the -warp file"),
+		lens:      fs.String("lens", "", "Correct the lens distortion of a projector as K1[,K2]. Positive values correct barrel distortion, negative values pincushion distortion. Overrides the lens of the -warp file"),
+		rotate:    fs.Int("rotate", 0, "Rotate the output clockwise by 90, 180 or 270 degrees, e.g. for displays mounted in portrait. For 90 and 270, -g is the geometry of the output and the shader renders with its width and height swapped. Overrides the rotation of the -warp file"),
+		flip:      fs.String("flip", "", "Mirror the output horizontally with \"h\", vertically with \"v\" or both with \"hv\", e.g. for rear projection. Overrides the flip of the -warp file"),
+	}
+}
+
+func (f warpFlags) enabled() bool {
+	return *f.file != "" || *f.keystone != "" || *f.lens != "" || *f.rotate != 0 || *f.flip != ""
+}
+
+// load reads the warp file and applies the corrections set by flags. If the
+// file does not exist while calibrating, a new warp is created.
+func (f warpFlags) load() (*renderer.Warp, error) {
+	var w *renderer.Warp
+	if _, err := os.Stat(*f.file); *f.file == "" || (*f.calibrate && os.IsNotExist(err)) {
+		cols, rows := 2, 2
+		if *f.file != "" {
+			if _, err := fmt.Sscanf(*f.grid, "%dx%d", &cols, &rows); err != nil {
+				return nil, fmt.Errorf("invalid -warp-grid %q, expected COLSxROWS", *f.grid)
+			}
+		}
+		w = renderer.NewWarp(cols, rows)
+	} else if w, err = loadWarp(*f.file); err != nil {
+		return nil, err
+	}
+
+	if *f.keystone != "" {
+		values, err := parseFloats(*f.keystone)
+		if err != nil || len(values) != 8 {
+			return nil, fmt.Errorf("invalid -keystone %q, expected 4 comma separated X,Y pairs", *f.keystone)
+		}
+		for i := range w.Keystone {
+			w.Keystone[i] = renderer.WarpPoint{X: values[i*2], Y: values[i*2+1]}
+		}
+	}
+	if *f.lens != "" {
+		values, err := parseFloats(*f.lens)
+		if err != nil || len(values) > 2 {
+			return nil, fmt.Errorf("invalid -lens %q, expected K1[,K2]", *f.lens)
+		}
+		w.Lens = renderer.LensDistortion{K1: values[0]}
+		if len(values) == 2 {
+			w.Lens.K2 = values[1]
+		}
+	}
+	if *f.rotate != 0 {
+		w.Orientation.Rotate = *f.rotate
+	}
+	if *f.flip != "" {
+		flipX, flipY, err := parseFlip(*f.flip)
+		if err != nil {
+			return nil, fmt.Errorf("invalid -flip %q, expected \"h\", \"v\" or \"hv\"", *f.flip)
+		}
+		w.Orientation.FlipX, w.Orientation.FlipY = flipX, flipY
+	}
+	return w, w.Validate()
+}
+
+// parseFlip parses the horizontal and vertical flips of an orientation.
+func parseFlip(s string) (flipX, flipY bool, err error) {
+	switch s {
+	case "", "none":
+		return false, false, nil
+	case "h":
+		return true, false, nil
+	case "v":
+		return false, true, nil
+	case "hv", "vh":
+		return true, true, nil
+	}
+	return false, false, fmt.Errorf("invalid flip %q, expected \"h\", \"v\" or \"hv\"", s)
+}
+
+func formatFlip(flipX, flipY bool) string {
+	s := ""
+	if flipX {
+		s += "h"
+	}
+	if flipY {
+		s += "v"
+	}
+	return s
+}
+
+func parseFloats(s string) ([]float64, error) {
+	var values []float64
+	for _, field := range strings.Split(s, ",") {
+		v, err := strconv.ParseFloat(strings.TrimSpace(field), 64)
+		if err != nil {
+			return nil, err
+		}
+		values = append(values, v)
+	}
+	return values, nil
+}
+
+// warpFile is the JSON encoding of a renderer.Warp.
+type warpFile struct {
+	Cols int `json:"cols"`
+	Rows int `json:"rows"`
+	// Interpolation is either "linear" or "bezier".
+	Interpolation string         `json:"interpolation,omitempty"`
+	Points        [][2]float64   `json:"points"`
+	Source        *[4]float64    `json:"source,omitempty"`
+	Blend         *warpBlendFile `json:"blend,omitempty"`
+	// Keystone contains the corners of the output in the order top left,
+	// top right, bottom right, bottom left.
+	Keystone *[4][2]float64 `json:"keystone,omitempty"`
+	Lens     *warpLensFile  `json:"lens,omitempty"`
+	// Rotate is the clockwise rotation of the output in degrees.
+	Rotate int    `json:"rotate,omitempty"`
+	Flip   string `json:"flip,omitempty"`
+}
+
+type warpBlendFile struct {
+	Left   float64 `json:"left,omitempty"`
+	Right  float64 `json:"right,omitempty"`
+	Top    float64 `json:"top,omitempty"`
+	Bottom float64 `json:"bottom,omitempty"`
+	Curve  float64 `json:"curve,omitempty"`
+	Gamma  float64 `json:"gamma,omitempty"`
+}
+
+type warpLensFile struct {
+	K1 float64 `json:"k1"`
+	K2 float64 `json:"k2,omitempty"`
+}
+
+func parseWarp(data []byte) (*renderer.Warp, error) {
+	var file warpFile
+	if err := json.Unmarshal(data, &file); err != nil {
+		return nil, fmt.Errorf("invalid warp: %v", err)
+	}
+	w := &renderer.Warp{Cols: file.Cols, Rows: file.Rows}
+	switch file.Interpolation {
+	case "", "linear":
+	case "bezier":
+		w.Bezier = true
+	default:
+		return nil, fmt.Errorf("unknown warp interpolation %q, expected \"linear\" or \"bezier\"", file.Interpolation)
+	}
+	for _, p := range file.Points {
+		w.Points = append(w.Points, renderer.WarpPoint{X: p[0], Y: p[1]})
+	}
+	if file.Source != nil {
+		w.Source = *file.Source
+	}
+	if b := file.Blend; b != nil {
+		w.Blend = renderer.EdgeBlend{
+			Left:   b.Left,
+			Right:  b.Right,
+			Top:    b.Top,
+			Bottom: b.Bottom,
+			Curve:  b.Curve,
+			Gamma:  b.Gamma,
+		}
+	}
+	if file.Keystone != nil {
+		for i, p := range file.Keystone {
+			w.Keystone[i] = renderer.WarpPoint{X: p[0], Y: p[1]}
+		}
+	}
+	if file.Lens != nil {
+		w.Lens = renderer.LensDistortion{K1: file.Lens.K1, K2: file.Lens.K2}
+	}
+	w.Orientation.Rotate = file.Rotate
+	var err error
+	if w.Orientation.FlipX, w.Orientation.FlipY, err = parseFlip(file.Flip); err != nil {
+		return nil, err
+	}
+	return w, w.Validate()
+}
+
+func loadWarp(filename string) (*renderer.Warp, error) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	w, err := parseWarp(data)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", filename, err)
+	}
+	return w, nil
+}
+
+func encodeWarp(w *renderer.Warp) ([]byte, error) {
+	file := warpFile{Cols: w.Cols, Rows: w.Rows, Interpolation: "linear"}
+	if w.Bezier {
+		file.Interpolation = "bezier"
+	}
+	for _, p := range w.Points {
+		file.Points = append(file.Points, [2]float64{p.X, p.Y})
+	}
+	if w.Source != [4]float64{} {
+		source := w.Source
+		file.Source = &source
+	}
+	if b := w.Blend; b != (renderer.EdgeBlend{}) {
+		file.Blend = &warpBlendFile{b.Left, b.Right, b.Top, b.Bottom, b.Curve, b.Gamma}
+	}
+	if w.Keystone != [4]renderer.WarpPoint{} {
+		var keystone [4][2]float64
+		for i, p := range w.Keystone {
+			keystone[i] = [2]float64{p.X, p.Y}
+		}
+		file.Keystone = &keystone
+	}
+	if w.Lens != (renderer.LensDistortion{}) {
+		file.Lens = &warpLensFile{K1: w.Lens.K1, K2: w.Lens.K2}
+	}
+	file.Rotate = w.Orientation.Rotate
+	file.Flip = formatFlip(w.Orientation.FlipX, w.Orientation.FlipY)
+	return json.MarshalIndent(file, "", "\t")
+}
+
+// saveWarp writes the warp to the file. The file is replaced atomically so it
+// is not corrupted if shady is interrupted.
+func saveWarp(filename string, w *renderer.Warp) error {
+	data, err := encodeWarp(w)
+	if err != nil {
+		return err
+	}
+	tmp := filename + ".tmp"
+	if err := os.WriteFile(tmp, append(data, '\n'), 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, filename)
+}
@@ -0,0 +1,388 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// errNoJob is returned by job queues when no job is available.
+var errNoJob = errors.New("no job available")
+
+// jobQueue is a source of render jobs for "shady worker".
+type jobQueue interface {
+	// Take claims the next job so no other worker runs it. It returns the
+	// directory that relative paths of the job are resolved against, or
+	// errNoJob if the queue is empty. If the directory is empty, the job is
+	// rendered in a temporary directory.
+	Take(ctx context.Context) (renderJob, string, error)
+	// Finish reports the result of a job that was taken. If the job was
+	// interrupted, err is context.Canceled and the job should be returned
+	// to the queue. The output of the render is stored with the result.
+	Finish(job renderJob, output []byte, err error) error
+}
+
+// jobProgressReporter is implemented by queues that report the progress of
+// jobs while they are rendered.
+type jobProgressReporter interface {
+	Progress(job renderJob, frame, total uint) error
+}
+
+// jobEvent is published by queues that support events.
+type jobEvent struct {
+	ID    string `json:"id"`
+	Event string `json:"event"`
+	// Worker identifies the worker that runs the job.
+	Worker string    `json:"worker,omitempty"`
+	Time   time.Time `json:"time"`
+	Frame  uint      `json:"frame,omitempty"`
+	Frames uint      `json:"frames,omitempty"`
+	Error  string    `json:"error,omitempty"`
+	Log    string    `json:"log,omitempty"`
+}
+
+// newResultEvent returns the done or failed event of a finished job.
+func newResultEvent(job renderJob, output []byte, err error) jobEvent {
+	event := jobEvent{ID: job.ID, Event: "done", Log: string(output)}
+	if err != nil {
+		event.Event = "failed"
+		event.Error = err.Error()
+	}
+	return event
+}
+
+func (event jobEvent) withWorker(worker string) jobEvent {
+	event.Worker = worker
+	event.Time = time.Now()
+	return event
+}
+
+// progressWriter scans the statistics printed by -v for the number of frames
+// that were rendered.
+type progressWriter struct {
+	fn       func(frame uint)
+	buf      []byte
+	interval time.Duration
+	last     time.Time
+}
+
+var progressRe = regexp.MustCompile(`frames=(\d+)/`)
+
+func (w *progressWriter) Write(p []byte) (int, error) {
+	w.buf = append(w.buf, p...)
+	i := bytes.LastIndexAny(w.buf, "\r\n")
+	if i < 0 {
+		return len(p), nil
+	}
+	lines, rest := w.buf[:i], w.buf[i+1:]
+	if m := progressRe.FindAllSubmatch(lines, -1); m != nil && time.Since(w.last) >= w.interval {
+		frame, _ := strconv.ParseUint(string(m[len(m)-1][1]), 10, 64)
+		w.fn(uint(frame))
+		w.last = time.Now()
+	}
+	w.buf = append(w.buf[:0], rest...)
+	return len(p), nil
+}
+
+// runWorker runs render jobs from a queue until interrupted.
+func runWorker(args []string) {
+	fs := flag.NewFlagSet("worker", flag.ExitOnError)
+	queueURL := fs.String("queue", "", "The job queue to take jobs from: a directory of .json job files or an http(s) URL")
+	poll := fs.Duration("poll", 5*time.Second, "How often to check for new jobs when the queue is empty")
+	once := fs.Bool("once", false, "Exit when the queue is empty instead of waiting for new jobs")
+	ci := fs.Bool("ci", false, "Run jobs with -ci, for workers without a GPU or display")
+	name := fs.String("name", defaultWorkerName(), "The name of the worker in events published to the queue")
+	progressInterval := fs.Duration("progress-interval", 5*time.Second, "How often to report the progress of a job to queues that support it")
+	fs.Parse(args)
+
+	if *queueURL == "" {
+		log.Fatalf("Please specify a job queue with -queue")
+	}
+	queue, err := openJobQueue(*queueURL, *name)
+	if err != nil {
+		log.Fatalf("-queue: %v", err)
+	}
+	self, err := os.Executable()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		sig := make(chan os.Signal, 1)
+		signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+		defer signal.Stop(sig)
+		select {
+		case <-sig:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	for ctx.Err() == nil {
+		job, dir, err := queue.Take(ctx)
+		if errors.Is(err, errNoJob) {
+			if *once {
+				return
+			}
+			select {
+			case <-time.After(*poll):
+			case <-ctx.Done():
+			}
+			continue
+		} else if err != nil {
+			log.Printf("Could not take a job: %v", err)
+			select {
+			case <-time.After(*poll):
+			case <-ctx.Done():
+			}
+			continue
+		}
+
+		log.Printf("Running job %s", job.ID)
+		var progress *progressWriter
+		if reporter, ok := queue.(jobProgressReporter); ok {
+			var total uint
+			if job.Frames != nil {
+				total = job.Frames.Last - job.Frames.First + 1
+			}
+			progress = &progressWriter{
+				interval: *progressInterval,
+				fn: func(frame uint) {
+					if err := reporter.Progress(job, frame, total); err != nil {
+						log.Printf("Could not report the progress of job %s: %v", job.ID, err)
+					}
+				},
+			}
+		}
+		output, err := runJob(ctx, self, job, dir, *ci, progress)
+		if ctx.Err() != nil {
+			err = context.Canceled
+		}
+		if err != nil {
+			log.Printf("Job %s failed: %v", job.ID, err)
+		} else {
+			log.Printf("Job %s is done", job.ID)
+		}
+		if err := queue.Finish(job, output, err); err != nil {
+			log.Printf("Could not report the result of job %s: %v", job.ID, err)
+		}
+	}
+}
+
+// runJob renders a job in a separate process, so a job that crashes the
+// driver does not stop the worker. The combined output is returned. If
+// progress is not nil, it receives the statistics of the render.
+func runJob(ctx context.Context, self string, job renderJob, dir string, ci bool, progress *progressWriter) ([]byte, error) {
+	if dir == "" {
+		tmp, err := os.MkdirTemp("", "shady-job-")
+		if err != nil {
+			return nil, err
+		}
+		defer os.RemoveAll(tmp)
+		dir = tmp
+	}
+	if err := job.fetchAssets(dir); err != nil {
+		return nil, err
+	}
+	args := job.args()
+	if ci {
+		args = append([]string{"-ci"}, args...)
+	}
+	if progress != nil {
+		args = append(args, "-v")
+	}
+	var output bytes.Buffer
+	cmd := exec.CommandContext(ctx, self, args...)
+	cmd.Dir = dir
+	cmd.Stdout = &output
+	cmd.Stderr = io.MultiWriter(&output, os.Stderr)
+	if progress != nil {
+		cmd.Stderr = io.MultiWriter(&output, os.Stderr, progress)
+	}
+	err := cmd.Run()
+	return output.Bytes(), err
+}
+
+func defaultWorkerName() string {
+	host, _ := os.Hostname()
+	return fmt.Sprintf("%s-%d", host, os.Getpid())
+}
+
+func openJobQueue(u, worker string) (jobQueue, error) {
+	if strings.HasPrefix(u, "http://") || strings.HasPrefix(u, "https://") {
+		return &httpJobQueue{url: strings.TrimSuffix(u, "/"), client: http.DefaultClient}, nil
+	}
+	if strings.HasPrefix(u, "redis://") || strings.HasPrefix(u, "rediss://") {
+		parsed, err := url.Parse(u)
+		if err != nil {
+			return nil, err
+		}
+		return newRedisJobQueue(parsed, worker), nil
+	}
+	if strings.HasPrefix(u, "nats://") {
+		parsed, err := url.Parse(u)
+		if err != nil {
+			return nil, err
+		}
+		return newNATSJobQueue(parsed, worker)
+	}
+	if info, err := os.Stat(u); err != nil {
+		return nil, err
+	} else if !info.IsDir() {
+		return nil, fmt.Errorf("%s is not a directory", u)
+	}
+	return newDirJobQueue(u), nil
+}
+
+// dirJobQueue takes jobs from .json files in a directory, which may be shared
+// by multiple workers. A job is claimed by renaming it to .json.running, and
+// renamed to .json.done or .json.failed when finished. The output of the
+// render is written next to it in a .log file.
+type dirJobQueue struct {
+	dir string
+	// running maps the IDs of taken jobs to their filenames.
+	running map[string]string
+}
+
+func newDirJobQueue(dir string) *dirJobQueue {
+	return &dirJobQueue{dir: dir, running: map[string]string{}}
+}
+
+func (q *dirJobQueue) Take(ctx context.Context) (renderJob, string, error) {
+	names, err := filepath.Glob(filepath.Join(q.dir, "*.json"))
+	if err != nil {
+		return renderJob{}, "", err
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		// Renaming is atomic, so only one worker claims the job.
+		if err := os.Rename(name, name+".running"); err != nil {
+			continue
+		}
+		data, err := os.ReadFile(name + ".running")
+		if err != nil {
+			return renderJob{}, "", err
+		}
+		job, err := parseRenderJob(data)
+		if job.ID == "" {
+			job.ID = strings.TrimSuffix(filepath.Base(name), ".json")
+		}
+		if err != nil {
+			log.Printf("Skipping %s: %v", name, err)
+			if err := finishJobFile(name, nil, err); err != nil {
+				return renderJob{}, "", err
+			}
+			continue
+		}
+		q.running[job.ID] = name
+		return job, q.dir, nil
+	}
+	return renderJob{}, "", errNoJob
+}
+
+func (q *dirJobQueue) Finish(job renderJob, output []byte, jobErr error) error {
+	name, ok := q.running[job.ID]
+	if !ok {
+		return fmt.Errorf("job %q is not running", job.ID)
+	}
+	delete(q.running, job.ID)
+	if errors.Is(jobErr, context.Canceled) {
+		return os.Rename(name+".running", name)
+	}
+	return finishJobFile(name, output, jobErr)
+}
+
+func finishJobFile(name string, output []byte, jobErr error) error {
+	if jobErr != nil {
+		output = append(output, []byte(jobErr.Error()+"\n")...)
+	}
+	if err := os.WriteFile(strings.TrimSuffix(name, ".json")+".log", output, 0o644); err != nil {
+		return err
+	}
+	if jobErr != nil {
+		return os.Rename(name+".running", name+".failed")
+	}
+	return os.Rename(name+".running", name+".done")
+}
+
+// httpJobQueue takes jobs from a web service. A GET request on the URL returns
+// the next job as JSON, or 204 No Content if there is none. The result is
+// reported with a POST request to <url>/<id>/done or <url>/<id>/failed with
+// the output of the render as body, or <url>/<id>/release if the job was
+// interrupted.
+type httpJobQueue struct {
+	url    string
+	client *http.Client
+}
+
+func (q *httpJobQueue) Take(ctx context.Context) (renderJob, string, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, q.url, nil)
+	if err != nil {
+		return renderJob{}, "", err
+	}
+	resp, err := q.client.Do(req)
+	if err != nil {
+		return renderJob{}, "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNoContent {
+		return renderJob{}, "", errNoJob
+	}
+	if resp.StatusCode != http.StatusOK {
+		return renderJob{}, "", fmt.Errorf("unexpected status: %s", resp.Status)
+	}
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return renderJob{}, "", err
+	}
+	job, err := parseRenderJob(data)
+	if err != nil {
+		if job.ID != "" {
+			// Do not leave the job claimed.
+			q.Finish(job, nil, err)
+		}
+		return job, "", err
+	}
+	if job.ID == "" {
+		return job, "", fmt.Errorf("the queue returned a job without an id")
+	}
+	return job, "", nil
+}
+
+func (q *httpJobQueue) Finish(job renderJob, output []byte, jobErr error) error {
+	result := "done"
+	if errors.Is(jobErr, context.Canceled) {
+		result = "release"
+	} else if jobErr != nil {
+		result = "failed"
+		output = append(output, []byte(jobErr.Error()+"\n")...)
+	}
+	u := q.url + "/" + url.PathEscape(job.ID) + "/" + result
+	resp, err := q.client.Post(u, "text/plain", bytes.NewReader(output))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("unexpected status: %s", resp.Status)
+	}
+	return nil
+}
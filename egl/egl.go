@@ -1,11 +1,49 @@
 package egl
 
 // #cgo pkg-config: egl
+// #include <stdint.h>
 // #include <EGL/egl.h>
+// #include <EGL/eglext.h>
+//
+// #ifndef EGL_DRM_RENDER_NODE_FILE_EXT
+// #define EGL_DRM_RENDER_NODE_FILE_EXT 0x3377
+// #endif
+//
+// static EGLint queryDevices(EGLDeviceEXT *devices, EGLint max) {
+// 	PFNEGLQUERYDEVICESEXTPROC query = (PFNEGLQUERYDEVICESEXTPROC)eglGetProcAddress("eglQueryDevicesEXT");
+// 	EGLint n = 0;
+// 	if (!query || !query(max, devices, &n)) {
+// 		return -1;
+// 	}
+// 	return n;
+// }
+//
+// static const char *queryDeviceString(EGLDeviceEXT dev, EGLint name) {
+// 	PFNEGLQUERYDEVICESTRINGEXTPROC query = (PFNEGLQUERYDEVICESTRINGEXTPROC)eglGetProcAddress("eglQueryDeviceStringEXT");
+// 	if (!query) {
+// 		return NULL;
+// 	}
+// 	return query(dev, name);
+// }
+//
+// static int getDeviceDisplay(EGLDeviceEXT dev, EGLDisplay *dpy) {
+// 	PFNEGLGETPLATFORMDISPLAYEXTPROC get = (PFNEGLGETPLATFORMDISPLAYEXTPROC)eglGetProcAddress("eglGetPlatformDisplayEXT");
+// 	if (!get) {
+// 		return 0;
+// 	}
+// 	*dpy = get(EGL_PLATFORM_DEVICE_EXT, dev, NULL);
+// 	return *dpy != EGL_NO_DISPLAY;
+// }
+//
+// static EGLImage createTextureImage(EGLDisplay dpy, EGLContext ctx, unsigned int texture) {
+// 	EGLAttrib attribs[] = {EGL_GL_TEXTURE_LEVEL, 0, EGL_NONE};
+// 	return eglCreateImage(dpy, ctx, EGL_GL_TEXTURE_2D, (EGLClientBuffer)(uintptr_t)texture, attribs);
+// }
 import "C"
 import (
 	"fmt"
 	"strings"
+	"unsafe"
 )
 
 var DefaultDisplay = NativeDisplayType{v: C.EGLNativeDisplayType(C.EGL_DEFAULT_DISPLAY)}
@@ -40,6 +78,69 @@ func GetDisplay(dtype NativeDisplayType) (Display, error) {
 	return Display{dpy: dpy}, nil
 }
 
+// maxDevices is the maximum number of devices returned by QueryDevices.
+const maxDevices = 16
+
+// Device is a device like a GPU that can be rendered with directly, without a
+// display server.
+type Device struct {
+	dev C.EGLDeviceEXT
+}
+
+// QueryDevices lists the devices of the EGL implementation. It requires the
+// EGL_EXT_device_enumeration extension.
+func QueryDevices() ([]Device, error) {
+	var devs [maxDevices]C.EGLDeviceEXT
+	n := C.queryDevices(&devs[0], maxDevices)
+	if n < 0 {
+		return nil, fmt.Errorf("failed to call eglQueryDevicesEXT, EGL_EXT_device_enumeration is required")
+	}
+	devices := make([]Device, n)
+	for i := range devices {
+		devices[i] = Device{dev: devs[i]}
+	}
+	return devices, nil
+}
+
+func (d Device) queryString(name C.EGLint) string {
+	str := C.queryDeviceString(d.dev, name)
+	if str == nil {
+		return ""
+	}
+	return C.GoString(str)
+}
+
+// Extensions retrieves a list of the extensions of the device.
+func (d Device) Extensions() []string {
+	return strings.Fields(d.queryString(C.EGL_EXTENSIONS))
+}
+
+// DRMDeviceFile returns the path of the DRM device node of the device, like
+// /dev/dri/card0. It is empty if the device has none, like software
+// renderers.
+func (d Device) DRMDeviceFile() string {
+	return d.queryString(C.EGL_DRM_DEVICE_FILE_EXT)
+}
+
+// DRMRenderNodeFile returns the path of the DRM render node of the device,
+// like /dev/dri/renderD128, if the implementation reports it.
+func (d Device) DRMRenderNodeFile() string {
+	return d.queryString(C.EGL_DRM_RENDER_NODE_FILE_EXT)
+}
+
+// Display initializes a display that renders with the device. It requires the
+// EGL_EXT_platform_device extension.
+func (d Device) Display() (Display, error) {
+	var dpy C.EGLDisplay
+	if C.getDeviceDisplay(d.dev, &dpy) == 0 {
+		return Display{}, fmt.Errorf("failed to call eglGetPlatformDisplayEXT, EGL_EXT_platform_device is required")
+	}
+	if C.eglInitialize(dpy, nil, nil) == C.EGL_FALSE {
+		return Display{}, fmt.Errorf("error initializing display: %w", getError())
+	}
+	return Display{dpy: dpy}, nil
+}
+
 // ClientAPIs retrieves a list of supported client APIs.
 func (d Display) ClientAPIs() []string {
 	str := C.GoString(C.eglQueryString(d.dpy, C.EGL_CLIENT_APIS))
@@ -120,8 +221,31 @@ func (d Display) CreateContext(surface *Surface, openGLMajor, openGLMinor int) (
 	}, nil
 }
 
+// CreateSurfacelessContext creates a context that is not bound to a surface,
+// so it can only render to framebuffer objects. It requires the
+// EGL_KHR_surfaceless_context extension.
+func (d Display) CreateSurfacelessContext(openGLMajor, openGLMinor int) (*Context, error) {
+	configAttribs := []C.EGLint{
+		// Surfaces are not created, so any type will do.
+		C.EGL_SURFACE_TYPE, 0,
+		C.EGL_BLUE_SIZE, 8,
+		C.EGL_GREEN_SIZE, 8,
+		C.EGL_RED_SIZE, 8,
+		C.EGL_RENDERABLE_TYPE, C.EGL_OPENGL_BIT,
+		C.EGL_NONE,
+	}
+	var numConfigs C.EGLint
+	var eglCfg C.EGLConfig
+	if C.eglChooseConfig(d.dpy, &configAttribs[0], &eglCfg, 1, &numConfigs) == C.EGL_FALSE || numConfigs == 0 {
+		return nil, fmt.Errorf("failed to call eglChooseConfig")
+	}
+	return d.CreateContext(&Surface{conf: eglCfg}, openGLMajor, openGLMinor)
+}
+
 type Context struct {
 	Display Display
+	// Surface is the surface of the context, its EGLSurface is nil for
+	// surfaceless contexts.
 	Surface *Surface
 
 	context C.EGLContext
@@ -131,6 +255,33 @@ func (cx Context) MakeCurrent() {
 	C.eglMakeCurrent(cx.Display.dpy, cx.Surface.surf, cx.Surface.surf, cx.context)
 }
 
+// Image is an EGLImage, which shares the storage of a resource with other
+// contexts and APIs.
+type Image struct {
+	dpy C.EGLDisplay
+	img C.EGLImage
+}
+
+// CreateTextureImage creates an image from level 0 of a 2D texture of the
+// context. It requires EGL 1.5.
+func (cx Context) CreateTextureImage(texture uint32) (Image, error) {
+	img := C.createTextureImage(cx.Display.dpy, cx.context, C.uint(texture))
+	if img == nil {
+		return Image{}, fmt.Errorf("failed to call eglCreateImage: %w", getError())
+	}
+	return Image{dpy: cx.Display.dpy, img: img}, nil
+}
+
+// Pointer returns the EGLImage handle to pass to other APIs, like
+// glEGLImageTargetTexture2DOES.
+func (img Image) Pointer() unsafe.Pointer {
+	return unsafe.Pointer(img.img)
+}
+
+func (img Image) Destroy() {
+	C.eglDestroyImage(img.dpy, img.img)
+}
+
 func getError() error {
 	switch code := C.eglGetError(); code {
 	case C.EGL_NOT_INITIALIZED:
@@ -0,0 +1,191 @@
+package encode
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"image"
+	"image/png"
+	"io"
+	"math"
+	"time"
+)
+
+var pngSignature = []byte("\x89PNG\r\n\x1a\n")
+
+// APNGFormat writes animated PNG images, which keep the full color of the
+// frames, unlike GIF. The compressed frames are kept in memory until the stream
+// ends, as the number of frames precedes them in the file.
+type APNGFormat struct{}
+
+func (f APNGFormat) Extensions() []string {
+	return []string{"apng", "png"}
+}
+
+func (f APNGFormat) Encode(w io.Writer, img image.Image) error {
+	// A PNG image is an APNG of a single frame.
+	return png.Encode(w, img)
+}
+
+func (f APNGFormat) EncodeAnimation(w io.Writer, stream <-chan image.Image, interval time.Duration) error {
+	var header []byte
+	var frames [][]byte
+	opaque := true
+	for img := range stream {
+		if header == nil {
+			opaque = isOpaque(img)
+		}
+		var buf bytes.Buffer
+		// All frames must have the color type of the first one.
+		err := png.Encode(&buf, fixedOpacity{Image: img, opaque: opaque})
+		ReleaseFrame(img)
+		if err != nil {
+			return err
+		}
+		frameHeader, data, err := pngImageData(buf.Bytes())
+		if err != nil {
+			return err
+		}
+		if header == nil {
+			header = frameHeader
+		} else if !bytes.Equal(header, frameHeader) {
+			return fmt.Errorf("apng: all frames must have the same size")
+		}
+		frames = append(frames, data)
+	}
+	if header == nil {
+		return nil
+	}
+
+	if _, err := w.Write(pngSignature); err != nil {
+		return err
+	}
+	if err := writePNGChunk(w, "IHDR", header); err != nil {
+		return err
+	}
+	actl := make([]byte, 8)
+	binary.BigEndian.PutUint32(actl[0:], uint32(len(frames)))
+	// The animation loops forever.
+	binary.BigEndian.PutUint32(actl[4:], 0)
+	if err := writePNGChunk(w, "acTL", actl); err != nil {
+		return err
+	}
+	num, den := apngDelay(interval)
+	var seq uint32
+	for i, data := range frames {
+		fctl := make([]byte, 26)
+		binary.BigEndian.PutUint32(fctl[0:], seq)
+		copy(fctl[4:12], header[0:8])
+		binary.BigEndian.PutUint16(fctl[20:], num)
+		binary.BigEndian.PutUint16(fctl[22:], den)
+		// The offsets, the dispose op and the blend op are 0: frames
+		// replace the whole canvas.
+		seq++
+		if err := writePNGChunk(w, "fcTL", fctl); err != nil {
+			return err
+		}
+		if i == 0 {
+			// The first frame is also the image that is shown by
+			// decoders without support for APNG.
+			if err := writePNGChunk(w, "IDAT", data); err != nil {
+				return err
+			}
+			continue
+		}
+		fdat := make([]byte, 4+len(data))
+		binary.BigEndian.PutUint32(fdat, seq)
+		copy(fdat[4:], data)
+		seq++
+		if err := writePNGChunk(w, "fdAT", fdat); err != nil {
+			return err
+		}
+	}
+	return writePNGChunk(w, "IEND", nil)
+}
+
+// apngDelay returns the interval as a fraction of seconds, exact if possible.
+func apngDelay(interval time.Duration) (uint16, uint16) {
+	if interval <= 0 {
+		return 0, 100
+	}
+	s := interval.Seconds()
+	bestNum, bestDen, bestErr := uint16(0), uint16(100), math.Inf(1)
+	for den := 1; den <= math.MaxUint16; den++ {
+		num := math.Round(s * float64(den))
+		if num > math.MaxUint16 {
+			break
+		}
+		if e := math.Abs(num/float64(den) - s); e < bestErr {
+			bestNum, bestDen, bestErr = uint16(num), uint16(den), e
+			// Durations are rounded to nanoseconds.
+			if e < 1e-9 {
+				break
+			}
+		}
+	}
+	return bestNum, bestDen
+}
+
+// pngImageData returns the data of the IHDR chunk and the concatenated data of
+// the IDAT chunks of a PNG image.
+func pngImageData(b []byte) ([]byte, []byte, error) {
+	if !bytes.HasPrefix(b, pngSignature) {
+		return nil, nil, fmt.Errorf("apng: not a png image")
+	}
+	b = b[len(pngSignature):]
+	var header, data []byte
+	for len(b) >= 12 {
+		n := int(binary.BigEndian.Uint32(b))
+		if n > len(b)-12 {
+			return nil, nil, fmt.Errorf("apng: truncated chunk")
+		}
+		switch string(b[4:8]) {
+		case "IHDR":
+			header = b[8 : 8+n]
+		case "IDAT":
+			data = append(data, b[8:8+n]...)
+		}
+		b = b[12+n:]
+	}
+	if len(header) != 13 || data == nil {
+		return nil, nil, fmt.Errorf("apng: missing image data")
+	}
+	return header, data, nil
+}
+
+func writePNGChunk(w io.Writer, typ string, data []byte) error {
+	buf := make([]byte, 12+len(data))
+	binary.BigEndian.PutUint32(buf, uint32(len(data)))
+	copy(buf[4:], typ)
+	copy(buf[8:], data)
+	binary.BigEndian.PutUint32(buf[8+len(data):], crc32.ChecksumIEEE(buf[4:8+len(data)]))
+	_, err := w.Write(buf)
+	return err
+}
+
+// fixedOpacity sets whether the PNG encoder writes an alpha channel, which it
+// otherwise decides for every image by its pixels.
+type fixedOpacity struct {
+	image.Image
+	opaque bool
+}
+
+func (img fixedOpacity) Opaque() bool {
+	return img.opaque
+}
+
+func isOpaque(img image.Image) bool {
+	if o, ok := img.(interface{ Opaque() bool }); ok {
+		return o.Opaque()
+	}
+	b := img.Bounds()
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			if _, _, _, a := img.At(x, y).RGBA(); a != 0xffff {
+				return false
+			}
+		}
+	}
+	return true
+}
@@ -0,0 +1,84 @@
+package encode
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"image/color"
+	"image/png"
+	"testing"
+	"time"
+)
+
+func TestAPNGEncodeAnimation(t *testing.T) {
+	stream := make(chan image.Image, 2)
+	first := image.NewRGBA(image.Rect(0, 0, 4, 2))
+	first.Set(1, 1, color.RGBA{R: 0xff, A: 0xff})
+	for i := range first.Pix {
+		if i%4 == 3 {
+			first.Pix[i] = 0xff
+		}
+	}
+	second := image.NewRGBA(image.Rect(0, 0, 4, 2))
+	// The second frame is transparent, but must have the color type of
+	// the first.
+	stream <- first
+	stream <- second
+	close(stream)
+	var buf bytes.Buffer
+	if err := (APNGFormat{}).EncodeAnimation(&buf, stream, time.Second/30); err != nil {
+		t.Fatal(err)
+	}
+
+	var chunks []string
+	var fctl []byte
+	b := buf.Bytes()[len(pngSignature):]
+	for len(b) >= 12 {
+		n := int(binary.BigEndian.Uint32(b))
+		typ := string(b[4:8])
+		chunks = append(chunks, typ)
+		if typ == "fcTL" && fctl == nil {
+			fctl = b[8 : 8+n]
+		}
+		b = b[12+n:]
+	}
+	if exp := "IHDR acTL fcTL IDAT fcTL fdAT IEND"; join(chunks) != exp {
+		t.Fatalf("unexpected chunks %q, expected %q", join(chunks), exp)
+	}
+	if num, den := binary.BigEndian.Uint16(fctl[20:]), binary.BigEndian.Uint16(fctl[22:]); num != 1 || den != 30 {
+		t.Errorf("unexpected delay %d/%d", num, den)
+	}
+
+	// Decoders without support for APNG show the first frame.
+	img, err := png.Decode(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r, _, _, _ := img.At(1, 1).RGBA(); r != 0xffff {
+		t.Errorf("unexpected color of the first frame %v", img.At(1, 1))
+	}
+}
+
+func TestAPNGDelay(t *testing.T) {
+	cases := map[time.Duration][2]uint16{
+		time.Second / 30: {1, 30},
+		time.Second / 4:  {1, 4},
+		time.Duration(1001 * time.Second / 30000): {1001, 30000},
+	}
+	for interval, exp := range cases {
+		if num, den := apngDelay(interval); num != exp[0] || den != exp[1] {
+			t.Errorf("%v: got %d/%d, expected %d/%d", interval, num, den, exp[0], exp[1])
+		}
+	}
+}
+
+func join(s []string) string {
+	var b bytes.Buffer
+	for i, v := range s {
+		if i > 0 {
+			b.WriteByte(' ')
+		}
+		b.WriteString(v)
+	}
+	return b.String()
+}
@@ -0,0 +1,222 @@
+package encode
+
+import (
+	"encoding/binary"
+	"image"
+	"image/draw"
+	"math"
+)
+
+// The conversions in this file dominate the CPU time of raw outputs at high
+// resolutions. Packed formats are converted 4 pixels at a time using 64 bit
+// words instead of byte by byte, and all conversions work on row slices so the
+// compiler can drop most bounds checks.
+
+// asRGBA returns the image as RGBA, converting it if necessary.
+func asRGBA(img image.Image) *image.RGBA {
+	if rgba, ok := img.(*image.RGBA); ok {
+		return rgba
+	}
+	rgba := image.NewRGBA(img.Bounds())
+	draw.Draw(rgba, rgba.Bounds(), img, img.Bounds().Min, draw.Src)
+	return rgba
+}
+
+// resize returns buf with a length of n, reusing its memory if possible.
+func resize(buf []byte, n int) []byte {
+	if cap(buf) < n {
+		return make([]byte, n)
+	}
+	return buf[:n]
+}
+
+// toRGB24 converts the image to packed RGB, reusing buf if it is large
+// enough.
+func toRGB24(buf []byte, img image.Image) []byte {
+	return toPacked24(buf, img, false)
+}
+
+// toBGR24 converts the image to packed BGR, reusing buf if it is large
+// enough.
+func toBGR24(buf []byte, img image.Image) []byte {
+	return toPacked24(buf, img, true)
+}
+
+func toPacked24(buf []byte, img image.Image, bgr bool) []byte {
+	rgba := asRGBA(img)
+	b := rgba.Bounds()
+	w := b.Dx()
+	buf = resize(buf, w*b.Dy()*3)
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		off := rgba.PixOffset(b.Min.X, y)
+		dst := buf[(y-b.Min.Y)*w*3 : (y-b.Min.Y+1)*w*3]
+		src := rgba.Pix[off : off+w*4]
+		if bgr {
+			rgbaToBGR24(dst, src)
+		} else {
+			rgbaToRGB24(dst, src)
+		}
+	}
+	return buf
+}
+
+// rgbaToRGB24 converts a row of RGBA pixels to RGB. dst must be 3/4 the size
+// of src.
+func rgbaToRGB24(dst, src []byte) {
+	n := len(src) / 4
+	i := 0
+	for ; i+4 <= n; i += 4 {
+		s := src[i*4 : i*4+16]
+		d := dst[i*3 : i*3+12]
+		pack24(d, binary.LittleEndian.Uint64(s), binary.LittleEndian.Uint64(s[8:]))
+	}
+	for ; i < n; i++ {
+		copy(dst[i*3:i*3+3], src[i*4:i*4+3])
+	}
+}
+
+// rgbaToBGR24 converts a row of RGBA pixels to BGR. dst must be 3/4 the size
+// of src.
+func rgbaToBGR24(dst, src []byte) {
+	n := len(src) / 4
+	i := 0
+	for ; i+4 <= n; i += 4 {
+		s := src[i*4 : i*4+16]
+		d := dst[i*3 : i*3+12]
+		pack24(d, swapRB(binary.LittleEndian.Uint64(s)), swapRB(binary.LittleEndian.Uint64(s[8:])))
+	}
+	for ; i < n; i++ {
+		s := src[i*4 : i*4+3]
+		d := dst[i*3 : i*3+3]
+		d[0], d[1], d[2] = s[2], s[1], s[0]
+	}
+}
+
+// pack24 writes the first 3 bytes of each of the 4 pixels in the little endian
+// words a and b to the 12 bytes of d.
+func pack24(d []byte, a, b uint64) {
+	p0 := a & 0xffffff
+	p1 := a >> 32 & 0xffffff
+	p2 := b & 0xffffff
+	p3 := b >> 32 & 0xffffff
+	binary.LittleEndian.PutUint64(d, p0|p1<<24|p2<<48)
+	binary.LittleEndian.PutUint32(d[8:], uint32(p2>>16|p3<<8))
+}
+
+// swapRB swaps the first and third byte of both pixels in a little endian
+// word.
+func swapRB(u uint64) uint64 {
+	const lo = 0x000000ff000000ff
+	return u>>16&lo | u&(lo<<8) | (u&lo)<<16
+}
+
+// toRGB565 converts the image to 16 bit RGB in little endian byte order, as
+// used by many LED controllers and small displays.
+func toRGB565(buf []byte, img image.Image) []byte {
+	rgba := asRGBA(img)
+	b := rgba.Bounds()
+	w := b.Dx()
+	buf = resize(buf, w*b.Dy()*2)
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		off := rgba.PixOffset(b.Min.X, y)
+		dst := buf[(y-b.Min.Y)*w*2 : (y-b.Min.Y+1)*w*2]
+		src := rgba.Pix[off : off+w*4]
+		for x := 0; x < w; x++ {
+			p := src[x*4 : x*4+3]
+			binary.LittleEndian.PutUint16(dst[x*2:], uint16(p[0]>>3)<<11|uint16(p[1]>>2)<<5|uint16(p[2]>>3))
+		}
+	}
+	return buf
+}
+
+// toX2RGB10 converts the image to 10 bits per channel packed in a little endian
+// 32-bit word per pixel with red in the highest bits, which is the x2rgb10le
+// pixel format of FFmpeg. The 2 bits of padding are zero.
+func toX2RGB10(buf []byte, img image.Image) []byte {
+	pix := floatPixels(img)
+	buf = resize(buf, len(pix))
+	for i := 0; i+3 < len(pix); i += 4 {
+		c := func(v float32) uint32 {
+			return uint32(math.Round(clamp01(v) * 1023))
+		}
+		binary.LittleEndian.PutUint32(buf[i:], c(pix[i])<<20|c(pix[i+1])<<10|c(pix[i+2]))
+	}
+	return buf
+}
+
+// i420Size returns the size of an I420 image of the specified dimensions.
+func i420Size(w, h int) int {
+	cw, ch := (w+1)/2, (h+1)/2
+	return w*h + 2*cw*ch
+}
+
+// toI420 converts the image to planar YUV 4:2:0, also known as I420 or
+// yuv420p: a full resolution Y plane followed by U and V planes of half the
+// width and height, rounded up. The BT.601 limited range coefficients are
+// used, which is what most consumers assume for video of unknown origin.
+func toI420(buf []byte, img image.Image) []byte {
+	rgba := asRGBA(img)
+	b := rgba.Bounds()
+	w, h := b.Dx(), b.Dy()
+	cw := (w + 1) / 2
+	buf = resize(buf, i420Size(w, h))
+	yPlane := buf[:w*h]
+	uPlane := buf[w*h : w*h+cw*((h+1)/2)]
+	vPlane := buf[w*h+cw*((h+1)/2):]
+	for y := 0; y < h; y += 2 {
+		y1 := y + 1
+		if y1 == h {
+			y1 = y
+		}
+		off0 := rgba.PixOffset(b.Min.X, b.Min.Y+y)
+		off1 := rgba.PixOffset(b.Min.X, b.Min.Y+y1)
+		rgbaToI420Rows(
+			yPlane[y*w:(y+1)*w], yPlane[y1*w:(y1+1)*w],
+			uPlane[y/2*cw:(y/2+1)*cw], vPlane[y/2*cw:(y/2+1)*cw],
+			rgba.Pix[off0:off0+w*4], rgba.Pix[off1:off1+w*4],
+		)
+	}
+	return buf
+}
+
+// rgbaToI420Rows converts two rows of RGBA pixels to their luma rows and the
+// shared chroma row. For images with an odd height, both source rows are the
+// same.
+func rgbaToI420Rows(y0, y1, u, v, src0, src1 []byte) {
+	w := len(y0)
+	x := 0
+	for ; x+2 <= w; x += 2 {
+		a := src0[x*4 : x*4+8]
+		b := src1[x*4 : x*4+8]
+		y0[x] = luma(a[0], a[1], a[2])
+		y0[x+1] = luma(a[4], a[5], a[6])
+		y1[x] = luma(b[0], b[1], b[2])
+		y1[x+1] = luma(b[4], b[5], b[6])
+		r := int(a[0]) + int(a[4]) + int(b[0]) + int(b[4])
+		g := int(a[1]) + int(a[5]) + int(b[1]) + int(b[5])
+		bl := int(a[2]) + int(a[6]) + int(b[2]) + int(b[6])
+		u[x/2], v[x/2] = chroma(r, g, bl)
+	}
+	if x < w {
+		a := src0[x*4 : x*4+4]
+		b := src1[x*4 : x*4+4]
+		y0[x] = luma(a[0], a[1], a[2])
+		y1[x] = luma(b[0], b[1], b[2])
+		u[x/2], v[x/2] = chroma(
+			2*(int(a[0])+int(b[0])),
+			2*(int(a[1])+int(b[1])),
+			2*(int(a[2])+int(b[2])),
+		)
+	}
+}
+
+func luma(r, g, b byte) byte {
+	return byte((66*int(r)+129*int(g)+25*int(b)+128)>>8 + 16)
+}
+
+// chroma computes U and V from the sums of the channels of 4 pixels.
+func chroma(r, g, b int) (byte, byte) {
+	u := (-38*r-74*g+112*b+512)>>10 + 128
+	v := (112*r-94*g-18*b+512)>>10 + 128
+	return byte(u), byte(v)
+}
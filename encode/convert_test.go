@@ -0,0 +1,178 @@
+package encode
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"math/rand"
+	"testing"
+)
+
+func randomImage(w, h int) *image.RGBA {
+	img := image.NewRGBA(image.Rect(0, 0, w, h))
+	rand.New(rand.NewSource(1)).Read(img.Pix)
+	return img
+}
+
+// packed24Reference converts an image pixel by pixel.
+func packed24Reference(img image.Image, bgr bool) []byte {
+	b := img.Bounds()
+	var buf []byte
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			c := color.RGBAModel.Convert(img.At(x, y)).(color.RGBA)
+			if bgr {
+				buf = append(buf, c.B, c.G, c.R)
+			} else {
+				buf = append(buf, c.R, c.G, c.B)
+			}
+		}
+	}
+	return buf
+}
+
+func TestPacked24(t *testing.T) {
+	img := randomImage(13, 5)
+	images := map[string]image.Image{
+		"rgba":     img,
+		"subimage": img.SubImage(image.Rect(3, 1, 12, 4)),
+		"gray":     image.NewGray(image.Rect(0, 0, 6, 2)),
+	}
+	for name, img := range images {
+		if out, expected := toRGB24(nil, img), packed24Reference(img, false); !bytes.Equal(out, expected) {
+			t.Errorf("%s: toRGB24 = %v, expected %v", name, out, expected)
+		}
+		if out, expected := toBGR24(nil, img), packed24Reference(img, true); !bytes.Equal(out, expected) {
+			t.Errorf("%s: toBGR24 = %v, expected %v", name, out, expected)
+		}
+	}
+
+	// The buffer is reused if it is large enough.
+	buf := make([]byte, 0, 13*5*3)
+	if out := toRGB24(buf, img); &out[0] != &buf[:1][0] {
+		t.Errorf("the buffer was not reused")
+	}
+}
+
+func TestI420(t *testing.T) {
+	img := image.NewRGBA(image.Rect(0, 0, 3, 3))
+	fill := func(r image.Rectangle, c color.RGBA) {
+		for y := r.Min.Y; y < r.Max.Y; y++ {
+			for x := r.Min.X; x < r.Max.X; x++ {
+				img.SetRGBA(x, y, c)
+			}
+		}
+	}
+	fill(img.Bounds(), color.RGBA{255, 255, 255, 255})
+	fill(image.Rect(0, 0, 2, 2), color.RGBA{255, 0, 0, 255})
+	fill(image.Rect(2, 2, 3, 3), color.RGBA{0, 0, 0, 255})
+
+	out := toI420(nil, img)
+	expected := []byte{
+		// Y
+		82, 82, 235,
+		82, 82, 235,
+		235, 235, 16,
+		// U
+		90, 128,
+		128, 128,
+		// V
+		240, 128,
+		128, 128,
+	}
+	if !bytes.Equal(out, expected) {
+		t.Errorf("toI420 = %v, expected %v", out, expected)
+	}
+	if n := i420Size(3, 3); n != len(expected) {
+		t.Errorf("i420Size(3, 3) = %d, expected %d", n, len(expected))
+	}
+}
+
+func BenchmarkConvert(b *testing.B) {
+	img := randomImage(3840, 2160)
+	conversions := map[string]func([]byte, image.Image) []byte{
+		"rgb24": toRGB24,
+		"bgr24": toBGR24,
+		"i420":  toI420,
+		"rgb24-bytewise": func(buf []byte, img image.Image) []byte {
+			rgba := img.(*image.RGBA)
+			buf = resize(buf, len(rgba.Pix)/4*3)
+			for i := 0; i < len(rgba.Pix)/4; i++ {
+				copy(buf[i*3:i*3+3], rgba.Pix[i*4:i*4+3])
+			}
+			return buf
+		},
+	}
+	for name, convert := range conversions {
+		b.Run(name, func(b *testing.B) {
+			b.SetBytes(int64(len(img.Pix)))
+			var buf []byte
+			for i := 0; i < b.N; i++ {
+				buf = convert(buf, img)
+			}
+		})
+	}
+}
+
+func TestRGB565(t *testing.T) {
+	img := image.NewRGBA(image.Rect(0, 0, 2, 1))
+	img.SetRGBA(0, 0, color.RGBA{0xff, 0x00, 0x00, 0xff})
+	img.SetRGBA(1, 0, color.RGBA{0x08, 0x0c, 0xff, 0xff})
+	expected := []byte{0x00, 0xf8, 0x7f, 0x08}
+	if out := toRGB565(nil, img); !bytes.Equal(out, expected) {
+		t.Errorf("toRGB565 = %#v, expected %#v", out, expected)
+	}
+}
+
+func TestRawFrame(t *testing.T) {
+	img := randomImage(5, 3)
+	conversions := map[string]func([]byte, image.Image) []byte{
+		"rgb24":   toRGB24,
+		"bgr24":   toBGR24,
+		"rgb565":  toRGB565,
+		"yuv420p": toI420,
+	}
+	for layout, convert := range conversions {
+		frame := &RawFrame{Layout: layout, Rect: img.Bounds(), Pix: convert(nil, img)}
+		// Decoding and converting again must be lossless, except for the
+		// rounding of YUV.
+		if layout != "yuv420p" {
+			if out := convert(nil, frame); !bytes.Equal(out, frame.Pix) {
+				t.Errorf("%s: decoded frame converts to %v, expected %v", layout, out, frame.Pix)
+			}
+		}
+		// Outputs of the same layout write the frame as is.
+		var buf bytes.Buffer
+		if err := Formats[layout].Encode(&buf, frame); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(buf.Bytes(), frame.Pix) {
+			t.Errorf("%s: raw frame was not written as is", layout)
+		}
+	}
+
+	frame := &RawFrame{Layout: "yuv420p", Rect: image.Rect(0, 0, 1, 1), Pix: []byte{235, 128, 128}}
+	if c := frame.At(0, 0); c != (color.RGBA{0xff, 0xff, 0xff, 0xff}) {
+		t.Errorf("white decodes to %v", c)
+	}
+}
+
+func TestX2RGB10(t *testing.T) {
+	frame := &FloatFrame{Rect: image.Rect(0, 0, 2, 1), Pix: []float32{
+		1, 0.5, 0, 1,
+		2, -1, 0.25, 0,
+	}}
+	expected := []byte{0x00, 0x00, 0xf8, 0x3f, 0x00, 0x01, 0xf0, 0x3f}
+	if out := toX2RGB10(nil, frame); !bytes.Equal(out, expected) {
+		t.Errorf("toX2RGB10 = %#v, expected %#v", out, expected)
+	}
+	// 8-bit images are scaled to the full range.
+	img := image.NewRGBA(image.Rect(0, 0, 1, 1))
+	img.SetRGBA(0, 0, color.RGBA{0xff, 0x00, 0xff, 0xff})
+	if out := toX2RGB10(nil, img); !bytes.Equal(out, []byte{0xff, 0x03, 0xf0, 0x3f}) {
+		t.Errorf("toX2RGB10 = %#v", out)
+	}
+	if c := frame.At(1, 0); c != (color.RGBA64{0xffff, 0, 0x4000, 0}) {
+		t.Errorf("At(1, 0) = %v", c)
+	}
+}
@@ -0,0 +1,164 @@
+package encode
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// DataType is the numeric type that exported channel values are stored as.
+type DataType string
+
+const (
+	DataFloat32 DataType = "f32"
+	DataFloat16 DataType = "f16"
+	// DataUint8 and DataUint16 scale values in the 0-1 range to the full
+	// range of the integer type.
+	DataUint8  DataType = "u8"
+	DataUint16 DataType = "u16"
+)
+
+// ParseDataType parses the name of a data type.
+func ParseDataType(s string) (DataType, error) {
+	switch t := DataType(s); t {
+	case DataFloat32, DataFloat16, DataUint8, DataUint16:
+		return t, nil
+	}
+	return "", fmt.Errorf("unknown data type %q, valid types are f32, f16, u8 and u16", s)
+}
+
+// Size returns the size in bytes of a single value.
+func (t DataType) Size() int {
+	switch t {
+	case DataFloat32:
+		return 4
+	case DataUint8:
+		return 1
+	default:
+		return 2
+	}
+}
+
+// npyDescr is the type description of the data type in NumPy's notation.
+func (t DataType) npyDescr() string {
+	switch t {
+	case DataFloat32:
+		return "<f4"
+	case DataFloat16:
+		return "<f2"
+	case DataUint8:
+		return "|u1"
+	default:
+		return "<u2"
+	}
+}
+
+// EncodeRawData writes the values in little endian byte order without any
+// header.
+func EncodeRawData(w io.Writer, values []float32, dtype DataType) error {
+	buf := make([]byte, len(values)*dtype.Size())
+	for i, v := range values {
+		switch dtype {
+		case DataFloat32:
+			binary.LittleEndian.PutUint32(buf[i*4:], math.Float32bits(v))
+		case DataFloat16:
+			binary.LittleEndian.PutUint16(buf[i*2:], float16Bits(v))
+		case DataUint8:
+			buf[i] = uint8(math.Round(clamp01(v) * math.MaxUint8))
+		case DataUint16:
+			binary.LittleEndian.PutUint16(buf[i*2:], uint16(math.Round(clamp01(v)*math.MaxUint16)))
+		}
+	}
+	_, err := w.Write(buf)
+	return err
+}
+
+// EncodeNPY writes the values as a NumPy array file with the specified shape.
+func EncodeNPY(w io.Writer, values []float32, dtype DataType, shape ...int) error {
+	n := 1
+	for _, d := range shape {
+		n *= d
+	}
+	if n != len(values) {
+		return fmt.Errorf("shape %v does not match the number of values: %d", shape, len(values))
+	}
+	dims := make([]string, len(shape))
+	for i, d := range shape {
+		dims[i] = strconv.Itoa(d)
+	}
+	shapeStr := strings.Join(dims, ", ")
+	if len(shape) == 1 {
+		// A tuple with a single element needs a trailing comma.
+		shapeStr += ","
+	}
+	header := fmt.Sprintf("{'descr': '%s', 'fortran_order': False, 'shape': (%s), }", dtype.npyDescr(), shapeStr)
+	// The total size of the preamble must be a multiple of 64 and the header
+	// is terminated by a newline.
+	const preambleSize = 10
+	pad := 64 - (preambleSize+len(header)+1)%64
+	if pad == 64 {
+		pad = 0
+	}
+	header += strings.Repeat(" ", pad) + "\n"
+
+	preamble := make([]byte, preambleSize)
+	copy(preamble, "\x93NUMPY\x01\x00")
+	binary.LittleEndian.PutUint16(preamble[8:], uint16(len(header)))
+	if _, err := w.Write(preamble); err != nil {
+		return err
+	}
+	if _, err := io.WriteString(w, header); err != nil {
+		return err
+	}
+	return EncodeRawData(w, values, dtype)
+}
+
+func clamp01(v float32) float64 {
+	return math.Max(0, math.Min(1, float64(v)))
+}
+
+// float16Bits converts a float to the bits of the nearest IEEE 754 half
+// precision float.
+func float16Bits(f float32) uint16 {
+	bits := math.Float32bits(f)
+	sign := uint16(bits>>16) & 0x8000
+	exp := int((bits>>23)&0xff) - 127 + 15
+	mant := bits & 0x7fffff
+
+	switch {
+	case (bits>>23)&0xff == 0xff:
+		// Infinity and NaN.
+		if mant != 0 {
+			return sign | 0x7e00
+		}
+		return sign | 0x7c00
+	case exp >= 0x1f:
+		// Too large, round to infinity.
+		return sign | 0x7c00
+	case exp <= 0:
+		// Subnormal or too small.
+		if exp < -10 {
+			return sign
+		}
+		mant |= 0x800000
+		shift := uint(14 - exp)
+		half := mant >> shift
+		// Round to nearest even.
+		rem := mant & (1<<shift - 1)
+		if rem > 1<<(shift-1) || (rem == 1<<(shift-1) && half&1 == 1) {
+			half++
+		}
+		return sign | uint16(half)
+	}
+	half := uint32(exp)<<10 | mant>>13
+	rem := mant & 0x1fff
+	if rem > 0x1000 || (rem == 0x1000 && half&1 == 1) {
+		// This may carry into the exponent, which correctly rounds up to
+		// the next power of two or infinity.
+		half++
+	}
+	return sign | uint16(half)
+}
@@ -0,0 +1,80 @@
+package encode
+
+import (
+	"bytes"
+	"math"
+	"testing"
+)
+
+func TestFloat16Bits(t *testing.T) {
+	cases := map[float32]uint16{
+		0:                     0x0000,
+		1:                     0x3c00,
+		-2:                    0xc000,
+		0.5:                   0x3800,
+		65504:                 0x7bff,
+		65536:                 0x7c00,
+		float32(math.Inf(-1)): 0xfc00,
+		5.960464477539063e-8:  0x0001,
+		6.103515625e-5:        0x0400,
+		1.0009765625:          0x3c01,
+		// Exactly halfway between 1 and 1.0009765625, rounds to even.
+		1.00048828125: 0x3c00,
+	}
+	for f, expected := range cases {
+		if h := float16Bits(f); h != expected {
+			t.Errorf("float16Bits(%v) = %#04x, expected %#04x", f, h, expected)
+		}
+	}
+	if h := float16Bits(float32(math.NaN())); h&0x7c00 != 0x7c00 || h&0x3ff == 0 {
+		t.Errorf("float16Bits(NaN) = %#04x, expected a NaN", h)
+	}
+}
+
+func TestEncodeRawData(t *testing.T) {
+	values := []float32{0, 0.5, 1, 2}
+	expected := map[DataType][]byte{
+		DataFloat32: {0, 0, 0, 0, 0, 0, 0, 0x3f, 0, 0, 0x80, 0x3f, 0, 0, 0, 0x40},
+		DataFloat16: {0, 0, 0, 0x38, 0, 0x3c, 0, 0x40},
+		DataUint8:   {0, 128, 255, 255},
+		DataUint16:  {0, 0, 0, 0x80, 0xff, 0xff, 0xff, 0xff},
+	}
+	for dtype, exp := range expected {
+		var buf bytes.Buffer
+		if err := EncodeRawData(&buf, values, dtype); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(buf.Bytes(), exp) {
+			t.Errorf("unexpected %s data: % x, expected % x", dtype, buf.Bytes(), exp)
+		}
+	}
+}
+
+func TestEncodeNPY(t *testing.T) {
+	var buf bytes.Buffer
+	if err := EncodeNPY(&buf, make([]float32, 2*3*4), DataFloat16, 2, 3, 4); err != nil {
+		t.Fatal(err)
+	}
+	b := buf.Bytes()
+	if !bytes.HasPrefix(b, []byte("\x93NUMPY\x01\x00")) {
+		t.Fatalf("missing magic: %q", b[:8])
+	}
+	headerLen := int(b[8]) | int(b[9])<<8
+	if (10+headerLen)%64 != 0 {
+		t.Errorf("preamble is not aligned to 64 bytes: %d", 10+headerLen)
+	}
+	header := string(b[10 : 10+headerLen])
+	if expected := "{'descr': '<f2', 'fortran_order': False, 'shape': (2, 3, 4), }"; header[:len(expected)] != expected {
+		t.Errorf("unexpected header: %q", header)
+	}
+	if header[len(header)-1] != '\n' {
+		t.Errorf("header is not terminated by a newline")
+	}
+	if len(b)-10-headerLen != 2*3*4*2 {
+		t.Errorf("unexpected data size: %d", len(b)-10-headerLen)
+	}
+
+	if err := EncodeNPY(&buf, make([]float32, 3), DataFloat32, 2, 2); err == nil {
+		t.Errorf("expected an error for a mismatching shape")
+	}
+}
@@ -4,9 +4,7 @@ import (
 	"bytes"
 	"fmt"
 	"image"
-	"image/color/palette"
 	"image/draw"
-	"image/gif"
 	"image/jpeg"
 	"image/png"
 	"io"
@@ -28,6 +26,41 @@ func (f PNGFormat) EncodeAnimation(w io.Writer, stream <-chan image.Image, inter
 		if err := f.Encode(w, img); err != nil {
 			return err
 		}
+		ReleaseFrame(img)
+	}
+	return nil
+}
+
+// PNG16Format writes PNG images with 16 bits per channel. Frames are read back
+// as half floats, so the gradients of HDR shaders are not banded by the 8-bit
+// path. Values outside of the 0-1 range are clamped.
+type PNG16Format struct{}
+
+func (f PNG16Format) Extensions() []string {
+	return []string{"png"}
+}
+
+func (f PNG16Format) Precision() string {
+	return "rgba16f"
+}
+
+func (f PNG16Format) Encode(w io.Writer, img image.Image) error {
+	if _, ok := img.(*FloatFrame); !ok {
+		// Frames that were read back with 8 bits are widened, so the
+		// file is 16-bit regardless of -readback.
+		wide := image.NewRGBA64(img.Bounds())
+		draw.Draw(wide, wide.Bounds(), img, img.Bounds().Min, draw.Src)
+		img = wide
+	}
+	return png.Encode(w, img)
+}
+
+func (f PNG16Format) EncodeAnimation(w io.Writer, stream <-chan image.Image, interval time.Duration) error {
+	for img := range stream {
+		if err := f.Encode(w, img); err != nil {
+			return err
+		}
+		ReleaseFrame(img)
 	}
 	return nil
 }
@@ -47,6 +80,7 @@ func (f JPGFormat) EncodeAnimation(w io.Writer, stream <-chan image.Image, inter
 		if err := f.Encode(w, img); err != nil {
 			return err
 		}
+		ReleaseFrame(img)
 	}
 	return nil
 }
@@ -58,39 +92,110 @@ func (f RGB24Format) Extensions() []string {
 }
 
 func (f RGB24Format) Encode(w io.Writer, img image.Image) error {
-	bounds := img.Bounds()
-	buf := make([]byte, bounds.Dx()*bounds.Dy()*3)
-	if rgba, ok := img.(*image.RGBA); ok {
-		for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
-			for x := bounds.Min.X; x < bounds.Max.X; x++ {
-				i := y*bounds.Dx() + x
-				copy(buf[i*3:i*3+3], rgba.Pix[i*4:i*4+3])
-			}
-		}
-	} else {
-		for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
-			for x := bounds.Min.X; x < bounds.Max.X; x++ {
-				i := y*bounds.Dx() + x
-				r, g, b, _ := img.At(x, y).RGBA()
-				buf[i*3] = byte(r >> 8)
-				buf[i*3+1] = byte(g >> 8)
-				buf[i*3+2] = byte(b >> 8)
-			}
-		}
-	}
-	_, err := w.Write(buf)
-	return err
+	return encodeRaw(w, img, "rgb24", toRGB24)
 }
 
 func (f RGB24Format) EncodeAnimation(w io.Writer, stream <-chan image.Image, interval time.Duration) error {
+	return encodeRawAnimation(w, stream, "rgb24", toRGB24)
+}
+
+type BGR24Format struct{}
+
+func (f BGR24Format) Extensions() []string {
+	return []string{}
+}
+
+func (f BGR24Format) Encode(w io.Writer, img image.Image) error {
+	return encodeRaw(w, img, "bgr24", toBGR24)
+}
+
+func (f BGR24Format) EncodeAnimation(w io.Writer, stream <-chan image.Image, interval time.Duration) error {
+	return encodeRawAnimation(w, stream, "bgr24", toBGR24)
+}
+
+type RGB565Format struct{}
+
+func (f RGB565Format) Extensions() []string {
+	return []string{}
+}
+
+func (f RGB565Format) Encode(w io.Writer, img image.Image) error {
+	return encodeRaw(w, img, "rgb565", toRGB565)
+}
+
+func (f RGB565Format) EncodeAnimation(w io.Writer, stream <-chan image.Image, interval time.Duration) error {
+	return encodeRawAnimation(w, stream, "rgb565", toRGB565)
+}
+
+// I420Format writes planar YUV 4:2:0 images, see toI420.
+type I420Format struct{}
+
+func (f I420Format) Extensions() []string {
+	return []string{}
+}
+
+func (f I420Format) Encode(w io.Writer, img image.Image) error {
+	return encodeRaw(w, img, "yuv420p", toI420)
+}
+
+func (f I420Format) EncodeAnimation(w io.Writer, stream <-chan image.Image, interval time.Duration) error {
+	return encodeRawAnimation(w, stream, "yuv420p", toI420)
+}
+
+// X2RGB10Format writes 10-bit RGB images, see toX2RGB10. Frames are read back
+// with 10 bits per channel.
+type X2RGB10Format struct{}
+
+func (f X2RGB10Format) Extensions() []string {
+	return []string{}
+}
+
+func (f X2RGB10Format) Precision() string {
+	return "rgb10a2"
+}
+
+func (f X2RGB10Format) Encode(w io.Writer, img image.Image) error {
+	return encodeRaw(w, img, "x2rgb10le", toX2RGB10)
+}
+
+func (f X2RGB10Format) EncodeAnimation(w io.Writer, stream <-chan image.Image, interval time.Duration) error {
+	return encodeRawAnimation(w, stream, "x2rgb10le", toX2RGB10)
+}
+
+// encodeRaw writes the image in a raw layout. Frames that are already in that
+// layout are written as they are.
+func encodeRaw(w io.Writer, img image.Image, layout string, convert func(buf []byte, img image.Image) []byte) error {
+	pix, _ := rawPixels(nil, img, layout, convert)
+	_, err := w.Write(pix)
+	return err
+}
+
+// encodeRawAnimation writes every image of the stream like encodeRaw, reusing
+// the buffer of the conversion for every frame.
+func encodeRawAnimation(w io.Writer, stream <-chan image.Image, layout string, convert func(buf []byte, img image.Image) []byte) error {
+	var buf, pix []byte
 	for img := range stream {
-		if err := f.Encode(w, img); err != nil {
+		pix, buf = rawPixels(buf, img, layout, convert)
+		_, err := w.Write(pix)
+		ReleaseFrame(img)
+		if err != nil {
 			return err
 		}
 	}
 	return nil
 }
 
+// rawPixels returns the pixels of the image in the layout, converting them into
+// buf unless the image is a RawFrame of that layout. The buffer is returned
+// for reuse.
+func rawPixels(buf []byte, img image.Image, layout string, convert func(buf []byte, img image.Image) []byte) (pix, newBuf []byte) {
+	if raw, ok := img.(*RawFrame); ok && raw.Layout == layout {
+		return raw.Pix, buf
+	}
+	buf = convert(buf, img)
+	return buf, buf
+}
+
 type RGBA32Format struct{}
 
 func (f RGBA32Format) Extensions() []string {
@@ -114,42 +219,11 @@ func (f RGBA32Format) EncodeAnimation(w io.Writer, stream <-chan image.Image, in
 		if err := f.Encode(w, img); err != nil {
 			return err
 		}
+		ReleaseFrame(img)
 	}
 	return nil
 }
 
-type GIFFormat struct{}
-
-func (f GIFFormat) Extensions() []string {
-	return []string{"gif"}
-}
-
-func (f GIFFormat) Encode(w io.Writer, img image.Image) error {
-	// Forward to the code stream encoder for easy code reuse.
-	stream := make(chan image.Image, 1)
-	stream <- img
-	close(stream)
-	return f.EncodeAnimation(w, stream, 0)
-}
-
-func (f GIFFormat) EncodeAnimation(w io.Writer, stream <-chan image.Image, interval time.Duration) error {
-	gifImg := &gif.GIF{
-		Image:           []*image.Paletted{},
-		Delay:           []int{},
-		LoopCount:       0,
-		Disposal:        []byte{},
-		BackgroundIndex: 0,
-	}
-	for img := range stream {
-		frame := image.NewPaletted(img.Bounds(), palette.Plan9)
-		draw.Draw(frame, img.Bounds(), img, image.Point{X: 0, Y: 0}, draw.Over)
-		gifImg.Image = append(gifImg.Image, frame)
-		gifImg.Delay = append(gifImg.Delay, int(interval/(time.Second/100)))
-		gifImg.Disposal = append(gifImg.Disposal, gif.DisposalBackground)
-	}
-	return gif.EncodeAll(w, gifImg)
-}
-
 type AnsiDisplay struct {
 	initDone bool
 }
@@ -207,6 +281,7 @@ func (f *AnsiDisplay) EncodeAnimation(w io.Writer, stream <-chan image.Image, in
 			// Reset to the default background color and jump to the next line.
 			fmt.Fprintf(&buf, "\x1b[0m\n")
 		}
+		ReleaseFrame(img)
 		if _, err := io.Copy(w, &buf); err != nil {
 			return err
 		}
@@ -0,0 +1,32 @@
+package encode
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/png"
+	"testing"
+)
+
+func TestPNG16(t *testing.T) {
+	for _, img := range []image.Image{
+		&FloatFrame{Rect: image.Rect(0, 0, 2, 1), Pix: []float32{0.5, 0.25, 2, 1, 0, 0, 0, 1}},
+		NewFrame(image.Rect(0, 0, 2, 1)),
+	} {
+		var buf bytes.Buffer
+		if err := (PNG16Format{}).Encode(&buf, img); err != nil {
+			t.Fatal(err)
+		}
+		decoded, err := png.Decode(&buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if m := decoded.ColorModel(); m != color.RGBA64Model && m != color.NRGBA64Model {
+			t.Errorf("%T was not encoded with 16 bits per channel", img)
+		}
+	}
+
+	if f, ok := DetectFormat("out.png"); !ok || f != Formats["png"] {
+		t.Errorf("out.png should be detected as 8-bit png, got %#v", f)
+	}
+}
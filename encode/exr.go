@@ -0,0 +1,99 @@
+package encode
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"io"
+	"time"
+)
+
+// EXRFormat writes uncompressed OpenEXR images with half float RGBA channels.
+// Frames are read back as half floats, so values outside of the 0-1 range are
+// kept. The values are written as the shader renders them, shaders for EXR
+// output should render linear light.
+type EXRFormat struct{}
+
+func (f EXRFormat) Extensions() []string {
+	return []string{"exr"}
+}
+
+func (f EXRFormat) Precision() string {
+	return "rgba16f"
+}
+
+func (f EXRFormat) Encode(w io.Writer, img image.Image) error {
+	b := img.Bounds()
+	width, height := b.Dx(), b.Dy()
+	pix := floatPixels(img)
+
+	var buf bytes.Buffer
+	le := func(v interface{}) {
+		binary.Write(&buf, binary.LittleEndian, v)
+	}
+	attribute := func(name, typ string, size int) {
+		buf.WriteString(name + "\x00" + typ + "\x00")
+		le(int32(size))
+	}
+	le(uint32(20000630)) // Magic.
+	le(uint32(2))        // Version 2, single part scanline image.
+
+	// Channels are stored in alphabetical order.
+	channels := []struct {
+		name   string
+		offset int
+	}{{"A", 3}, {"B", 2}, {"G", 1}, {"R", 0}}
+	attribute("channels", "chlist", len(channels)*18+1)
+	for _, c := range channels {
+		buf.WriteString(c.name + "\x00")
+		le(int32(1))       // Half float.
+		le([4]uint8{})     // Linear flag and reserved bytes.
+		le([2]int32{1, 1}) // Sampling.
+	}
+	buf.WriteByte(0)
+	attribute("compression", "compression", 1)
+	buf.WriteByte(0)
+	window := [4]int32{0, 0, int32(width) - 1, int32(height) - 1}
+	attribute("dataWindow", "box2i", 16)
+	le(window)
+	attribute("displayWindow", "box2i", 16)
+	le(window)
+	attribute("lineOrder", "lineOrder", 1)
+	buf.WriteByte(0) // Increasing Y.
+	attribute("pixelAspectRatio", "float", 4)
+	le(float32(1))
+	attribute("screenWindowCenter", "v2f", 8)
+	le([2]float32{0, 0})
+	attribute("screenWindowWidth", "float", 4)
+	le(float32(1))
+	buf.WriteByte(0)
+
+	// Every scanline is a block, preceded by a table of their offsets.
+	lineSize := width * len(channels) * 2
+	start := buf.Len() + height*8
+	for y := 0; y < height; y++ {
+		le(uint64(start + y*(8+lineSize)))
+	}
+	line := make([]uint16, width*len(channels))
+	for y := 0; y < height; y++ {
+		le([2]int32{int32(y), int32(lineSize)})
+		for ci, c := range channels {
+			for x := 0; x < width; x++ {
+				line[ci*width+x] = float16Bits(pix[(y*width+x)*4+c.offset])
+			}
+		}
+		le(line)
+	}
+	_, err := w.Write(buf.Bytes())
+	return err
+}
+
+func (f EXRFormat) EncodeAnimation(w io.Writer, stream <-chan image.Image, interval time.Duration) error {
+	for img := range stream {
+		if err := f.Encode(w, img); err != nil {
+			return err
+		}
+		ReleaseFrame(img)
+	}
+	return nil
+}
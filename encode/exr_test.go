@@ -0,0 +1,56 @@
+package encode
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"testing"
+)
+
+func TestEXR(t *testing.T) {
+	frame := &FloatFrame{Rect: image.Rect(0, 0, 3, 2), Pix: make([]float32, 3*2*4)}
+	for i := range frame.Pix {
+		frame.Pix[i] = float32(i) / 4
+	}
+	var buf bytes.Buffer
+	if err := (EXRFormat{}).Encode(&buf, frame); err != nil {
+		t.Fatal(err)
+	}
+	data := buf.Bytes()
+	if magic := binary.LittleEndian.Uint32(data); magic != 20000630 {
+		t.Fatalf("magic = %d", magic)
+	}
+
+	// The header ends with an empty attribute name, followed by the offset
+	// table of the scanlines.
+	end := bytes.Index(data, []byte("screenWindowWidth\x00float\x00\x04\x00\x00\x00")) + 33
+	if end < 33 || data[end-1] != 0 {
+		t.Fatalf("could not find the end of the header")
+	}
+	const lineSize = 3 * 4 * 2
+	for y := 0; y < 2; y++ {
+		offset := int(binary.LittleEndian.Uint64(data[end+y*8:]))
+		if offset != end+2*8+y*(8+lineSize) {
+			t.Fatalf("line %d is at offset %d", y, offset)
+		}
+		line := data[offset:]
+		if ly := binary.LittleEndian.Uint32(line); int(ly) != y {
+			t.Errorf("line %d has y = %d", y, ly)
+		}
+		if size := binary.LittleEndian.Uint32(line[4:]); size != lineSize {
+			t.Errorf("line %d has size %d", y, size)
+		}
+		// Channels are stored in the order A, B, G, R.
+		for ci, channel := range []int{3, 2, 1, 0} {
+			for x := 0; x < 3; x++ {
+				v := binary.LittleEndian.Uint16(line[8+(ci*3+x)*2:])
+				if expected := float16Bits(frame.Pix[(y*3+x)*4+channel]); v != expected {
+					t.Errorf("channel %d of (%d, %d) = %#x, expected %#x", channel, x, y, v, expected)
+				}
+			}
+		}
+	}
+	if len(data) != end+2*8+2*(8+lineSize) {
+		t.Errorf("the file is %d bytes", len(data))
+	}
+}
@@ -0,0 +1,141 @@
+package encode
+
+import (
+	"fmt"
+	"image"
+	"io"
+	"os"
+	"os/exec"
+	"strconv"
+	"time"
+)
+
+// VideoFormat encodes animations to a video file by piping raw frames into
+// FFmpeg, which must be installed. The video is written as a single stream,
+// so it can be written to pipes and remote outputs like any other format. MP4
+// is therefore fragmented.
+type VideoFormat struct {
+	// Muxer is the name of the FFmpeg muxer.
+	Muxer string
+	// Extension is the extension of the file excluding '.'.
+	Extension string
+	// Encoder is the video encoder to use.
+	Encoder VideoEncoder
+}
+
+func (f VideoFormat) Extensions() []string {
+	return []string{f.Extension}
+}
+
+// Validate checks whether the encoder can be stored in the container.
+func (f VideoFormat) Validate() error {
+	if err := f.Encoder.Validate(); err != nil {
+		return err
+	}
+	if codec := f.codec(); f.Muxer == "webm" && codec != "vp9" {
+		return fmt.Errorf("webm output requires the vp9 codec, not %s", codec)
+	}
+	return nil
+}
+
+// codec returns the codec of the encoder, which defaults to the most common
+// one of the container.
+func (f VideoFormat) codec() string {
+	if f.Encoder.Codec != "" {
+		return f.Encoder.Codec
+	}
+	if f.Muxer == "webm" {
+		return "vp9"
+	}
+	return "h264"
+}
+
+// Encode encodes the image as a video of a single frame.
+func (f VideoFormat) Encode(w io.Writer, img image.Image) error {
+	stream := make(chan image.Image, 1)
+	stream <- img
+	close(stream)
+	return f.EncodeAnimation(w, stream, time.Second)
+}
+
+func (f VideoFormat) EncodeAnimation(w io.Writer, stream <-chan image.Image, interval time.Duration) error {
+	if interval <= 0 {
+		return fmt.Errorf("%s output requires a framerate", f.Extension)
+	}
+	if err := f.Validate(); err != nil {
+		return err
+	}
+	first, ok := <-stream
+	if !ok {
+		return nil
+	}
+	enc := f.Encoder
+	enc.Codec = f.codec()
+
+	raw, input := rawVideoInput(first, interval)
+	args := []string{"-hide_banner", "-loglevel", "error"}
+	args = append(args, enc.inputArgs()...)
+	args = append(args, input...)
+	args = append(args, enc.outputArgs(false)...)
+	if f.Muxer == "mp4" {
+		// Regular MP4 files can only be finished by seeking back to the
+		// start, which is not possible on a pipe.
+		args = append(args, "-movflags", "+frag_keyframe+empty_moov+default_base_moof")
+	}
+	args = append(args, "-f", f.Muxer, "pipe:1")
+
+	cmd := exec.Command("ffmpeg", args...)
+	cmd.Stdout = w
+	return feedFFmpeg(cmd, raw, first, stream)
+}
+
+// rawVideoInput returns the raw format in which frames of the stream starting
+// with first are written to FFmpeg and the arguments that describe them.
+// Frames that have been converted to yuv420p on the GPU are passed as they
+// are, so FFmpeg does not have to convert them.
+func rawVideoInput(first image.Image, interval time.Duration) (Format, []string) {
+	var raw Format = RGBA32Format{}
+	pixelFormat := "rgba"
+	if frame, ok := first.(*RawFrame); ok && frame.Layout == "yuv420p" {
+		raw, pixelFormat = I420Format{}, "yuv420p"
+	}
+	fps := float64(time.Second) / float64(interval)
+	return raw, []string{
+		"-f", "rawvideo",
+		"-pixel_format", pixelFormat,
+		"-video_size", fmt.Sprintf("%dx%d", first.Bounds().Dx(), first.Bounds().Dy()),
+		// Every frame lasts exactly one interval, regardless of how long it
+		// took to render.
+		"-framerate", strconv.FormatFloat(fps, 'f', -1, 64),
+		"-i", "-",
+	}
+}
+
+// feedFFmpeg starts the FFmpeg command and writes the first image and the
+// rest of the stream to its standard input until the stream closes.
+func feedFFmpeg(cmd *exec.Cmd, raw Format, first image.Image, stream <-chan image.Image) error {
+	cmd.Stderr = os.Stderr
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return err
+	}
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("could not start ffmpeg: %w", err)
+	}
+
+	err = raw.Encode(stdin, first)
+	ReleaseFrame(first)
+	for img := range stream {
+		if err != nil {
+			ReleaseFrame(img)
+			continue // Drain the stream.
+		}
+		err = raw.Encode(stdin, img)
+		ReleaseFrame(img)
+	}
+	stdin.Close()
+	if waitErr := cmd.Wait(); waitErr != nil {
+		return fmt.Errorf("ffmpeg: %w", waitErr)
+	}
+	return err
+}
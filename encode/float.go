@@ -0,0 +1,61 @@
+package encode
+
+import (
+	"image"
+	"image/color"
+	"math"
+)
+
+// FloatFrame is a frame of which the channels are stored as floats, as it is
+// read back from render targets of more than 8 bits per channel. The values
+// are not clamped, so formats like EXR can store values outside of the 0-1
+// range. It implements image.Image with 16 bits per channel for outputs that
+// do not handle floats.
+type FloatFrame struct {
+	Rect image.Rectangle
+	// Pix holds the red, green, blue and alpha channels of every pixel,
+	// rows from top to bottom.
+	Pix []float32
+}
+
+func (f *FloatFrame) ColorModel() color.Model {
+	return color.RGBA64Model
+}
+
+func (f *FloatFrame) Bounds() image.Rectangle {
+	return f.Rect
+}
+
+func (f *FloatFrame) At(x, y int) color.Color {
+	if !(image.Point{X: x, Y: y}).In(f.Rect) {
+		return color.RGBA64{}
+	}
+	i := f.PixOffset(x, y)
+	v := func(c float32) uint16 {
+		return uint16(math.Round(clamp01(c) * math.MaxUint16))
+	}
+	return color.RGBA64{v(f.Pix[i]), v(f.Pix[i+1]), v(f.Pix[i+2]), v(f.Pix[i+3])}
+}
+
+// PixOffset returns the index of the first channel of the pixel at (x, y).
+func (f *FloatFrame) PixOffset(x, y int) int {
+	return ((y-f.Rect.Min.Y)*f.Rect.Dx() + (x - f.Rect.Min.X)) * 4
+}
+
+// floatPixels returns the channels of the image as floats in the layout of
+// FloatFrame.Pix. Values of 8-bit images are scaled to the 0-1 range.
+func floatPixels(img image.Image) []float32 {
+	if f, ok := img.(*FloatFrame); ok {
+		return f.Pix
+	}
+	rgba := asRGBA(img)
+	b := rgba.Bounds()
+	pix := make([]float32, 0, b.Dx()*b.Dy()*4)
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		off := rgba.PixOffset(b.Min.X, y)
+		for _, v := range rgba.Pix[off : off+b.Dx()*4] {
+			pix = append(pix, float32(v)/math.MaxUint8)
+		}
+	}
+	return pix
+}
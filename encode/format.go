@@ -4,33 +4,64 @@ import (
 	"image"
 	"io"
 	"path"
+	"sort"
 	"time"
 )
 
 var Formats = map[string]Format{
-	"ansi":   &AnsiDisplay{},
-	"gif":    GIFFormat{},
-	"jpg":    JPGFormat{},
-	"png":    PNGFormat{},
-	"rgb24":  RGB24Format{},
-	"rgba32": RGBA32Format{},
+	"ansi":      &AnsiDisplay{},
+	"apng":      APNGFormat{},
+	"bgr24":     BGR24Format{},
+	"exr":       EXRFormat{},
+	"gif":       GIFFormat{},
+	"jpg":       JPGFormat{},
+	"mkv":       VideoFormat{Muxer: "matroska", Extension: "mkv"},
+	"mp4":       VideoFormat{Muxer: "mp4", Extension: "mp4"},
+	"png":       PNGFormat{},
+	"png16":     PNG16Format{},
+	"rgb24":     RGB24Format{},
+	"rgb565":    RGB565Format{},
+	"rgba32":    RGBA32Format{},
+	"webm":      VideoFormat{Muxer: "webm", Extension: "webm"},
+	"x2rgb10le": X2RGB10Format{},
+	"yuv420p":   I420Format{},
 }
 
+// DetectFormat returns the format of a file by its extension. If several
+// formats share the extension, the one named after it is returned, or else the
+// first by name, e.g. png rather than apng or png16.
 func DetectFormat(filename string) (Format, bool) {
 	ext := path.Ext(filename)
 	if len(ext) == 0 {
 		return nil, false
 	}
-	for _, f := range Formats {
-		for _, e := range f.Extensions() {
-			if e == ext[1:] {
-				return f, true
-			}
+	if f, ok := Formats[ext[1:]]; ok && HasExtension(f, ext[1:]) {
+		return f, true
+	}
+	names := make([]string, 0, len(Formats))
+	for name := range Formats {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if HasExtension(Formats[name], ext[1:]) {
+			return Formats[name], true
 		}
 	}
 	return nil, false
 }
 
+// HasExtension reports whether ext, excluding '.', is one of the extensions of
+// the format.
+func HasExtension(f Format, ext string) bool {
+	for _, e := range f.Extensions() {
+		if e == ext {
+			return true
+		}
+	}
+	return false
+}
+
 type Format interface {
 	// Extensions returns all file extensions excluding '.' that this format is
 	// commonly encoded into.
@@ -43,6 +74,16 @@ type Format interface {
 	// io.Writer.
 	//
 	// The function should consume all images from the stream until it closes.
-	// The interval parameter is the time between two images.
+	// The interval parameter is the time between two images. Images should be
+	// passed to ReleaseFrame once they are no longer needed.
 	EncodeAnimation(w io.Writer, stream <-chan image.Image, interval time.Duration) error
 }
+
+// A PrecisionFormat is a Format that stores more than 8 bits per channel.
+type PrecisionFormat interface {
+	Format
+	// Precision returns the name of the pixel format of package renderer
+	// that frames should be read back in, e.g. "rgba16f". Frames are then
+	// passed as *FloatFrame.
+	Precision() string
+}
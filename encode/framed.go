@@ -0,0 +1,287 @@
+package encode
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"image"
+	"io"
+	"time"
+)
+
+// FrameMagic is the start of every frame header written by FramedFormat.
+const FrameMagic = "SHDF"
+
+// FrameHeaderSize is the size in bytes of the header written by FramedFormat.
+const FrameHeaderSize = 32
+
+// Pixel format identifiers used in frame headers.
+const (
+	FramePixelFormatOther   uint16 = 0
+	FramePixelFormatRGB24   uint16 = 1
+	FramePixelFormatRGBA32  uint16 = 2
+	FramePixelFormatPNG     uint16 = 3
+	FramePixelFormatJPG     uint16 = 4
+	FramePixelFormatBGR24   uint16 = 5
+	FramePixelFormatI420    uint16 = 6
+	FramePixelFormatRGB565  uint16 = 7
+	FramePixelFormatX2RGB10 uint16 = 8
+	FramePixelFormatEXR     uint16 = 9
+)
+
+// FramePixelFormatDelta is set in the pixel format of frames whose payload
+// only contains the pixels that changed since the previous frame, see
+// FramedFormat.Delta.
+const FramePixelFormatDelta uint16 = 0x8000
+
+// FrameHeader precedes every frame written by FramedFormat. All fields are
+// encoded in little endian byte order:
+//
+//	offset  size  field
+//	0       4     magic, "SHDF"
+//	4       2     header size, 32
+//	6       2     pixel format
+//	8       4     width
+//	12      4     height
+//	16      4     payload size in bytes
+//	20      4     frame number
+//	24      8     presentation timestamp in microseconds
+//
+// Consumers should skip any bytes of the header past the fields they know
+// about so the header can be extended in the future.
+type FrameHeader struct {
+	PixelFormat uint16
+	Width       uint32
+	Height      uint32
+	PayloadSize uint32
+	Frame       uint32
+	PTS         time.Duration
+}
+
+// MarshalBinary encodes the header.
+func (h FrameHeader) MarshalBinary() ([]byte, error) {
+	buf := make([]byte, FrameHeaderSize)
+	copy(buf, FrameMagic)
+	binary.LittleEndian.PutUint16(buf[4:], FrameHeaderSize)
+	binary.LittleEndian.PutUint16(buf[6:], h.PixelFormat)
+	binary.LittleEndian.PutUint32(buf[8:], h.Width)
+	binary.LittleEndian.PutUint32(buf[12:], h.Height)
+	binary.LittleEndian.PutUint32(buf[16:], h.PayloadSize)
+	binary.LittleEndian.PutUint32(buf[20:], h.Frame)
+	binary.LittleEndian.PutUint64(buf[24:], uint64(h.PTS/time.Microsecond))
+	return buf, nil
+}
+
+// ReadFrameHeader reads the next header from a framed stream.
+func ReadFrameHeader(r io.Reader) (FrameHeader, error) {
+	var h FrameHeader
+	buf := make([]byte, 8)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return h, err
+	}
+	if string(buf[:4]) != FrameMagic {
+		return h, fmt.Errorf("invalid frame magic: %q", buf[:4])
+	}
+	size := int(binary.LittleEndian.Uint16(buf[4:]))
+	if size < FrameHeaderSize {
+		return h, fmt.Errorf("frame header too small: %d", size)
+	}
+	buf = append(buf, make([]byte, size-8)...)
+	if _, err := io.ReadFull(r, buf[8:]); err != nil {
+		return h, err
+	}
+	h.PixelFormat = binary.LittleEndian.Uint16(buf[6:])
+	h.Width = binary.LittleEndian.Uint32(buf[8:])
+	h.Height = binary.LittleEndian.Uint32(buf[12:])
+	h.PayloadSize = binary.LittleEndian.Uint32(buf[16:])
+	h.Frame = binary.LittleEndian.Uint32(buf[20:])
+	h.PTS = time.Duration(binary.LittleEndian.Uint64(buf[24:])) * time.Microsecond
+	return h, nil
+}
+
+// FramedFormat wraps another format and prefixes every encoded image with a
+// FrameHeader, which allows consumers of a stream to detect changes in
+// resolution and to resynchronize by scanning for the magic.
+type FramedFormat struct {
+	Format Format
+	// PixelFormat identifies the encoding of the payload, see
+	// FramePixelFormatOther and friends.
+	PixelFormat uint16
+	// Delta writes only the pixels of an animation that changed since the
+	// previous frame and skips frames that did not change at all, which
+	// requires a pixel format with a fixed size per pixel. A full frame is
+	// written every KeyframeInterval so consumers can join a running stream,
+	// or only when the resolution changes if it is 0.
+	Delta            bool
+	KeyframeInterval time.Duration
+}
+
+// FramePixelSize returns the number of bytes per pixel of a pixel format, or 0
+// if pixels do not have a fixed size.
+func FramePixelSize(pixelFormat uint16) int {
+	switch pixelFormat &^ FramePixelFormatDelta {
+	case FramePixelFormatRGB24, FramePixelFormatBGR24:
+		return 3
+	case FramePixelFormatRGBA32, FramePixelFormatX2RGB10:
+		return 4
+	case FramePixelFormatRGB565:
+		return 2
+	default:
+		return 0
+	}
+}
+
+// FramePixelFormat returns the pixel format identifier of a format by its name
+// in Formats.
+func FramePixelFormat(name string) uint16 {
+	switch name {
+	case "rgb24":
+		return FramePixelFormatRGB24
+	case "rgba32":
+		return FramePixelFormatRGBA32
+	case "png", "png16":
+		return FramePixelFormatPNG
+	case "jpg":
+		return FramePixelFormatJPG
+	case "bgr24":
+		return FramePixelFormatBGR24
+	case "yuv420p":
+		return FramePixelFormatI420
+	case "rgb565":
+		return FramePixelFormatRGB565
+	case "x2rgb10le":
+		return FramePixelFormatX2RGB10
+	case "exr":
+		return FramePixelFormatEXR
+	default:
+		return FramePixelFormatOther
+	}
+}
+
+func (f FramedFormat) Extensions() []string {
+	return []string{}
+}
+
+func (f FramedFormat) Encode(w io.Writer, img image.Image) error {
+	var payload bytes.Buffer
+	if err := f.Format.Encode(&payload, img); err != nil {
+		return err
+	}
+	return f.writeFrame(w, img.Bounds(), f.PixelFormat, payload.Bytes(), 0, 0)
+}
+
+func (f FramedFormat) writeFrame(w io.Writer, bounds image.Rectangle, pixelFormat uint16, payload []byte, frame uint32, pts time.Duration) error {
+	header, _ := FrameHeader{
+		PixelFormat: pixelFormat,
+		Width:       uint32(bounds.Dx()),
+		Height:      uint32(bounds.Dy()),
+		PayloadSize: uint32(len(payload)),
+		Frame:       frame,
+		PTS:         pts,
+	}.MarshalBinary()
+	if _, err := w.Write(header); err != nil {
+		return err
+	}
+	_, err := w.Write(payload)
+	return err
+}
+
+func (f FramedFormat) EncodeAnimation(w io.Writer, stream <-chan image.Image, interval time.Duration) error {
+	pixelSize := FramePixelSize(f.PixelFormat)
+	if f.Delta && pixelSize == 0 {
+		return fmt.Errorf("delta frames require a raw format with a fixed size per pixel")
+	}
+	frame := uint32(0)
+	var payload bytes.Buffer
+	var prev []byte
+	var prevBounds image.Rectangle
+	var lastKeyframe time.Duration
+	for img := range stream {
+		payload.Reset()
+		err := f.Format.Encode(&payload, img)
+		bounds := img.Bounds()
+		ReleaseFrame(img)
+		if err != nil {
+			return err
+		}
+		pts := time.Duration(frame) * interval
+		pixelFormat, data := f.PixelFormat, payload.Bytes()
+		if f.Delta {
+			keyframe := prev == nil || bounds != prevBounds ||
+				f.KeyframeInterval > 0 && pts-lastKeyframe >= f.KeyframeInterval
+			if keyframe {
+				lastKeyframe = pts
+			} else if delta := frameDelta(prev, data, pixelSize); len(delta) == 0 {
+				frame++
+				continue
+			} else if len(delta) < len(data) {
+				pixelFormat, data = pixelFormat|FramePixelFormatDelta, delta
+			}
+			prev, prevBounds = append(prev[:0], payload.Bytes()...), bounds
+		}
+		if err := f.writeFrame(w, bounds, pixelFormat, data, frame, pts); err != nil {
+			return err
+		}
+		frame++
+	}
+	return nil
+}
+
+// frameDelta returns the payload of a delta frame that turns prev into cur,
+// which is empty if they are equal. It consists of runs of changed pixels,
+// each of which is:
+//
+//	offset  size         field
+//	0       4            index of the first pixel of the run
+//	4       4            number of pixels n
+//	8       n*pixelSize  the pixels
+//
+// Runs that are only separated by a few unchanged pixels are merged, as their
+// headers would be larger than the pixels in between.
+func frameDelta(prev, cur []byte, pixelSize int) []byte {
+	const runHeaderSize = 8
+	maxGap := (runHeaderSize + pixelSize - 1) / pixelSize
+	numPixels := len(cur) / pixelSize
+	changed := func(i int) bool {
+		return !bytes.Equal(prev[i*pixelSize:(i+1)*pixelSize], cur[i*pixelSize:(i+1)*pixelSize])
+	}
+	var delta []byte
+	for i := 0; i < numPixels; {
+		if !changed(i) {
+			i++
+			continue
+		}
+		start, end := i, i+1
+		for j := end; j < numPixels && j-end <= maxGap; j++ {
+			if changed(j) {
+				end = j + 1
+			}
+		}
+		var header [runHeaderSize]byte
+		binary.LittleEndian.PutUint32(header[0:], uint32(start))
+		binary.LittleEndian.PutUint32(header[4:], uint32(end-start))
+		delta = append(delta, header[:]...)
+		delta = append(delta, cur[start*pixelSize:end*pixelSize]...)
+		i = end
+	}
+	return delta
+}
+
+// ApplyFrameDelta updates the pixels of the previous frame with the payload of
+// a frame that has FramePixelFormatDelta set.
+func ApplyFrameDelta(frame, payload []byte, pixelSize int) error {
+	for len(payload) > 0 {
+		if len(payload) < 8 {
+			return fmt.Errorf("truncated delta run")
+		}
+		start := int(binary.LittleEndian.Uint32(payload[0:]))
+		n := int(binary.LittleEndian.Uint32(payload[4:]))
+		payload = payload[8:]
+		if n*pixelSize > len(payload) || (start+n)*pixelSize > len(frame) {
+			return fmt.Errorf("delta run of %d pixels at %d is out of bounds", n, start)
+		}
+		copy(frame[start*pixelSize:], payload[:n*pixelSize])
+		payload = payload[n*pixelSize:]
+	}
+	return nil
+}
@@ -0,0 +1,106 @@
+package encode
+
+import (
+	"bytes"
+	"image"
+	"io"
+	"testing"
+	"time"
+)
+
+func TestFramedFormat(t *testing.T) {
+	f := FramedFormat{Format: RGBA32Format{}, PixelFormat: FramePixelFormatRGBA32}
+	stream := make(chan image.Image, 2)
+	stream <- image.NewRGBA(image.Rect(0, 0, 4, 2))
+	stream <- image.NewRGBA(image.Rect(0, 0, 3, 3))
+	close(stream)
+
+	var buf bytes.Buffer
+	if err := f.EncodeAnimation(&buf, stream, time.Second/25); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []FrameHeader{
+		{PixelFormat: FramePixelFormatRGBA32, Width: 4, Height: 2, PayloadSize: 32, Frame: 0, PTS: 0},
+		{PixelFormat: FramePixelFormatRGBA32, Width: 3, Height: 3, PayloadSize: 36, Frame: 1, PTS: 40 * time.Millisecond},
+	}
+	for _, e := range expected {
+		h, err := ReadFrameHeader(&buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if h != e {
+			t.Fatalf("unexpected header %+v, expected %+v", h, e)
+		}
+		if _, err := io.CopyN(io.Discard, &buf, int64(h.PayloadSize)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if buf.Len() != 0 {
+		t.Fatalf("%d trailing bytes", buf.Len())
+	}
+}
+
+func TestFramedDelta(t *testing.T) {
+	f := FramedFormat{Format: RGB24Format{}, PixelFormat: FramePixelFormatRGB24, Delta: true}
+	frames := make([]*image.RGBA, 4)
+	for i := range frames {
+		frames[i] = image.NewRGBA(image.Rect(0, 0, 8, 2))
+	}
+	frames[1].Pix[0] = 0xff
+	frames[1].Pix[12*4+2] = 0xff
+	copy(frames[2].Pix, frames[1].Pix)
+	copy(frames[3].Pix, frames[1].Pix)
+	for i := range frames[3].Pix {
+		frames[3].Pix[i] ^= 0xff
+	}
+	stream := make(chan image.Image, len(frames))
+	for _, img := range frames {
+		stream <- img
+	}
+	close(stream)
+
+	var buf bytes.Buffer
+	if err := f.EncodeAnimation(&buf, stream, time.Second/25); err != nil {
+		t.Fatal(err)
+	}
+
+	// Frame 2 is equal to frame 1 and is skipped entirely. Frame 3 is written
+	// in full, as all pixels changed.
+	expected := []FrameHeader{
+		{PixelFormat: FramePixelFormatRGB24, Width: 8, Height: 2, PayloadSize: 48, Frame: 0, PTS: 0},
+		{PixelFormat: FramePixelFormatRGB24 | FramePixelFormatDelta, Width: 8, Height: 2, PayloadSize: 22, Frame: 1, PTS: 40 * time.Millisecond},
+		{PixelFormat: FramePixelFormatRGB24, Width: 8, Height: 2, PayloadSize: 48, Frame: 3, PTS: 120 * time.Millisecond},
+	}
+	var frame []byte
+	for i, e := range expected {
+		h, err := ReadFrameHeader(&buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if h != e {
+			t.Fatalf("unexpected header %+v, expected %+v", h, e)
+		}
+		payload := make([]byte, h.PayloadSize)
+		if _, err := io.ReadFull(&buf, payload); err != nil {
+			t.Fatal(err)
+		}
+		if h.PixelFormat&FramePixelFormatDelta != 0 {
+			if err := ApplyFrameDelta(frame, payload, FramePixelSize(h.PixelFormat)); err != nil {
+				t.Fatal(err)
+			}
+		} else {
+			frame = payload
+		}
+		if img := toRGB24(nil, frames[h.Frame]); !bytes.Equal(frame, img) {
+			t.Fatalf("frame %d decodes to %v, expected %v", i, frame, img)
+		}
+	}
+	if buf.Len() != 0 {
+		t.Fatalf("%d trailing bytes", buf.Len())
+	}
+
+	if err := ApplyFrameDelta(make([]byte, 6), []byte{1, 0, 0, 0, 2, 0, 0, 0, 1, 2, 3, 4, 5, 6}, 3); err == nil {
+		t.Errorf("a run past the end of the frame is applied")
+	}
+}
@@ -0,0 +1,321 @@
+package encode
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/gif"
+	"io"
+	"sort"
+	"time"
+)
+
+// GIFPalette selects how the colors of GIF frames are chosen.
+type GIFPalette string
+
+const (
+	// GIFPaletteGlobal shares a palette between all frames, which is chosen
+	// from the colors of the whole animation. The frames are kept in memory
+	// until the stream ends.
+	GIFPaletteGlobal GIFPalette = "global"
+	// GIFPaletteFrame chooses a palette for every frame, which suits
+	// animations of which the colors change over time.
+	GIFPaletteFrame GIFPalette = "frame"
+)
+
+// gifMinDelay is the shortest delay between frames in centiseconds that
+// browsers play as is. Shorter delays are played as 10 by most of them.
+const gifMinDelay = 2
+
+// GIFFormat writes animated GIF images. The palettes are chosen from the colors
+// of the frames by median cut.
+type GIFFormat struct {
+	// Palette defaults to GIFPaletteGlobal.
+	Palette GIFPalette
+	// Dither enables Floyd–Steinberg dithering, which hides the banding of
+	// gradients at the cost of a larger file.
+	Dither bool
+}
+
+// ParseGIFPalette parses the name of a palette mode.
+func ParseGIFPalette(s string) (GIFPalette, error) {
+	switch p := GIFPalette(s); p {
+	case GIFPaletteGlobal, GIFPaletteFrame:
+		return p, nil
+	}
+	return "", fmt.Errorf("unknown GIF palette %q, expected global or frame", s)
+}
+
+func (f GIFFormat) Extensions() []string {
+	return []string{"gif"}
+}
+
+func (f GIFFormat) Encode(w io.Writer, img image.Image) error {
+	// Forward to the code stream encoder for easy code reuse.
+	stream := make(chan image.Image, 1)
+	stream <- img
+	close(stream)
+	return f.EncodeAnimation(w, stream, 0)
+}
+
+func (f GIFFormat) EncodeAnimation(w io.Writer, stream <-chan image.Image, interval time.Duration) error {
+	gifImg := &gif.GIF{
+		Image:           []*image.Paletted{},
+		Delay:           []int{},
+		LoopCount:       0,
+		Disposal:        []byte{},
+		BackgroundIndex: 0,
+	}
+	var frames []*image.RGBA
+	var hist histogram
+	for img := range stream {
+		frame := toRGBA(img)
+		if frame == img {
+			// The frame is copied, as it is used after it is released.
+			frame = image.NewRGBA(img.Bounds())
+			copy(frame.Pix, img.(*image.RGBA).Pix)
+		}
+		ReleaseFrame(img)
+		if f.Palette == GIFPaletteFrame {
+			hist = histogram{}
+			hist.add(frame)
+			gifImg.Image = append(gifImg.Image, newQuantizer(hist.palette(256)).paletted(frame, f.Dither))
+		} else {
+			hist.add(frame)
+			frames = append(frames, frame)
+		}
+		i := len(gifImg.Delay)
+		gifImg.Delay = append(gifImg.Delay, gifDelay(i, interval))
+		gifImg.Disposal = append(gifImg.Disposal, gif.DisposalBackground)
+	}
+	if f.Palette != GIFPaletteFrame {
+		q := newQuantizer(hist.palette(256))
+		for _, frame := range frames {
+			gifImg.Image = append(gifImg.Image, q.paletted(frame, f.Dither))
+		}
+	}
+	return gif.EncodeAll(w, gifImg)
+}
+
+// gifDelay returns the delay of frame i in centiseconds. The rounding errors
+// of the delays do not add up, so an animation of 30 frames per second takes
+// 3 and 4 centiseconds per frame in turn.
+func gifDelay(i int, interval time.Duration) int {
+	if interval == 0 {
+		return 0
+	}
+	cs := func(i int) int {
+		return int((time.Duration(i)*interval + 5*time.Millisecond) / (10 * time.Millisecond))
+	}
+	if d := cs(i+1) - cs(i); d > gifMinDelay {
+		return d
+	}
+	return gifMinDelay
+}
+
+func toRGBA(img image.Image) *image.RGBA {
+	if rgba, ok := img.(*image.RGBA); ok && rgba.Stride == 4*rgba.Rect.Dx() {
+		return rgba
+	}
+	rgba := image.NewRGBA(img.Bounds())
+	draw.Draw(rgba, rgba.Bounds(), img, img.Bounds().Min, draw.Src)
+	return rgba
+}
+
+// histogram counts the colors of images with 5 bits per channel. The sums of
+// the full colors are kept, so the colors of the palette are exact averages.
+type histogram struct {
+	count [1 << 15]uint64
+	sum   [1 << 15][3]uint64
+}
+
+func colorBin(r, g, b uint8) int {
+	return int(r>>3)<<10 | int(g>>3)<<5 | int(b>>3)
+}
+
+// add counts the pixels of an image. Alpha is ignored, which draws the colors
+// on black.
+func (h *histogram) add(img *image.RGBA) {
+	for i := 0; i+3 < len(img.Pix); i += 4 {
+		r, g, b := img.Pix[i], img.Pix[i+1], img.Pix[i+2]
+		bin := colorBin(r, g, b)
+		h.count[bin]++
+		h.sum[bin][0] += uint64(r)
+		h.sum[bin][1] += uint64(g)
+		h.sum[bin][2] += uint64(b)
+	}
+}
+
+// palette returns at most n colors for the counted pixels by median cut: the
+// box of colors with the largest range times pixels is split at the median of
+// its widest channel until there are n boxes.
+func (h *histogram) palette(n int) color.Palette {
+	type box struct {
+		bins  []int
+		count uint64
+	}
+	var all box
+	for bin, c := range h.count {
+		if c > 0 {
+			all.bins = append(all.bins, bin)
+			all.count += c
+		}
+	}
+	if len(all.bins) == 0 {
+		return color.Palette{color.RGBA{A: 0xff}}
+	}
+	channel := func(bin, ch int) int { return bin >> (10 - 5*ch) & 31 }
+	widest := func(b box) (int, int) {
+		bestCh, bestRange := 0, -1
+		for ch := 0; ch < 3; ch++ {
+			lo, hi := 31, 0
+			for _, bin := range b.bins {
+				v := channel(bin, ch)
+				if v < lo {
+					lo = v
+				}
+				if v > hi {
+					hi = v
+				}
+			}
+			if hi-lo > bestRange {
+				bestCh, bestRange = ch, hi-lo
+			}
+		}
+		return bestCh, bestRange
+	}
+
+	boxes := []box{all}
+	for len(boxes) < n {
+		split, splitCh := -1, 0
+		var splitScore uint64
+		for i, b := range boxes {
+			if len(b.bins) < 2 {
+				continue
+			}
+			ch, rng := widest(b)
+			if score := uint64(rng+1) * b.count; score > splitScore {
+				split, splitCh, splitScore = i, ch, score
+			}
+		}
+		if split < 0 {
+			break
+		}
+		b := boxes[split]
+		sort.Slice(b.bins, func(i, j int) bool { return channel(b.bins[i], splitCh) < channel(b.bins[j], splitCh) })
+		var below uint64
+		at := 1
+		for ; at < len(b.bins)-1; at++ {
+			if below += h.count[b.bins[at-1]]; below*2 >= b.count {
+				break
+			}
+		}
+		lo, hi := box{bins: b.bins[:at]}, box{bins: b.bins[at:]}
+		for _, bin := range lo.bins {
+			lo.count += h.count[bin]
+		}
+		hi.count = b.count - lo.count
+		boxes[split] = lo
+		boxes = append(boxes, hi)
+	}
+
+	pal := make(color.Palette, len(boxes))
+	for i, b := range boxes {
+		var sum [3]uint64
+		for _, bin := range b.bins {
+			for ch := range sum {
+				sum[ch] += h.sum[bin][ch]
+			}
+		}
+		pal[i] = color.RGBA{
+			R: uint8((sum[0] + b.count/2) / b.count),
+			G: uint8((sum[1] + b.count/2) / b.count),
+			B: uint8((sum[2] + b.count/2) / b.count),
+			A: 0xff,
+		}
+	}
+	return pal
+}
+
+// quantizer maps colors to the nearest color of a palette. The nearest colors
+// are cached by the bins of the histogram.
+type quantizer struct {
+	palette color.Palette
+	rgb     [][3]int32
+	cache   [1 << 15]int16
+}
+
+func newQuantizer(pal color.Palette) *quantizer {
+	q := &quantizer{palette: pal, rgb: make([][3]int32, len(pal))}
+	for i, c := range pal {
+		r, g, b, _ := c.RGBA()
+		q.rgb[i] = [3]int32{int32(r >> 8), int32(g >> 8), int32(b >> 8)}
+	}
+	for i := range q.cache {
+		q.cache[i] = -1
+	}
+	return q
+}
+
+func (q *quantizer) index(r, g, b uint8) uint8 {
+	bin := colorBin(r, g, b)
+	if i := q.cache[bin]; i >= 0 {
+		return uint8(i)
+	}
+	best, bestDist := 0, int32(-1)
+	for i, c := range q.rgb {
+		dr, dg, db := c[0]-int32(r), c[1]-int32(g), c[2]-int32(b)
+		if dist := dr*dr + dg*dg + db*db; bestDist < 0 || dist < bestDist {
+			best, bestDist = i, dist
+		}
+	}
+	q.cache[bin] = int16(best)
+	return uint8(best)
+}
+
+// paletted maps an image to the palette. With dither, the error of every pixel
+// is spread over its neighbours by Floyd–Steinberg.
+func (q *quantizer) paletted(img *image.RGBA, dither bool) *image.Paletted {
+	b := img.Bounds()
+	dst := image.NewPaletted(b, q.palette)
+	w := b.Dx()
+	// The errors of the current and the next row, with a pixel of margin
+	// on both sides.
+	cur, next := make([][3]int32, w+2), make([][3]int32, w+2)
+	clamp := func(v int32) uint8 {
+		if v < 0 {
+			return 0
+		} else if v > 255 {
+			return 255
+		}
+		return uint8(v)
+	}
+	for y := 0; y < b.Dy(); y++ {
+		src := img.Pix[y*img.Stride : y*img.Stride+4*w]
+		row := dst.Pix[y*dst.Stride : y*dst.Stride+w]
+		for x := 0; x < w; x++ {
+			r, g, bl := src[4*x], src[4*x+1], src[4*x+2]
+			if !dither {
+				row[x] = q.index(r, g, bl)
+				continue
+			}
+			e := cur[x+1]
+			c := [3]uint8{clamp(int32(r) + e[0]/16), clamp(int32(g) + e[1]/16), clamp(int32(bl) + e[2]/16)}
+			i := q.index(c[0], c[1], c[2])
+			row[x] = i
+			for ch := 0; ch < 3; ch++ {
+				d := int32(c[ch]) - q.rgb[i][ch]
+				cur[x+2][ch] += d * 7
+				next[x][ch] += d * 3
+				next[x+1][ch] += d * 5
+				next[x+2][ch] += d
+			}
+		}
+		cur, next = next, cur
+		for i := range next {
+			next[i] = [3]int32{}
+		}
+	}
+	return dst
+}
@@ -0,0 +1,88 @@
+package encode
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/gif"
+	"testing"
+	"time"
+)
+
+func gradientFrame(offset int) *image.RGBA {
+	img := image.NewRGBA(image.Rect(0, 0, 64, 4))
+	for x := 0; x < 64; x++ {
+		for y := 0; y < 4; y++ {
+			img.Set(x, y, color.RGBA{R: uint8(x * 4), G: uint8(offset), B: 0x80, A: 0xff})
+		}
+	}
+	return img
+}
+
+func TestHistogramPalette(t *testing.T) {
+	img := image.NewRGBA(image.Rect(0, 0, 3, 1))
+	colors := []color.RGBA{{R: 0xff, A: 0xff}, {G: 0x80, A: 0xff}, {R: 1, G: 2, B: 3, A: 0xff}}
+	for i, c := range colors {
+		img.Set(i, 0, c)
+	}
+	var h histogram
+	h.add(img)
+	pal := h.palette(256)
+	if len(pal) != len(colors) {
+		t.Fatalf("expected a color for every distinct color, got %v", pal)
+	}
+	for _, c := range colors {
+		if pal[pal.Index(c)] != c {
+			t.Errorf("%v is not in the palette %v", c, pal)
+		}
+	}
+
+	h = histogram{}
+	h.add(gradientFrame(0))
+	if pal := h.palette(4); len(pal) != 4 {
+		t.Errorf("expected 4 colors, got %d", len(pal))
+	}
+}
+
+func TestGIFEncodeAnimation(t *testing.T) {
+	for _, f := range []GIFFormat{{}, {Palette: GIFPaletteFrame, Dither: true}} {
+		stream := make(chan image.Image, 3)
+		for i := 0; i < 3; i++ {
+			stream <- gradientFrame(i * 100)
+		}
+		close(stream)
+		var buf bytes.Buffer
+		if err := f.EncodeAnimation(&buf, stream, time.Second/30); err != nil {
+			t.Fatal(err)
+		}
+		decoded, err := gif.DecodeAll(&buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(decoded.Image) != 3 {
+			t.Fatalf("%+v: expected 3 frames, got %d", f, len(decoded.Image))
+		}
+		if exp := []int{3, 4, 3}; decoded.Delay[0] != exp[0] || decoded.Delay[1] != exp[1] || decoded.Delay[2] != exp[2] {
+			t.Errorf("%+v: unexpected delays %v, expected %v", f, decoded.Delay, exp)
+		}
+		// The frames only differ in green, which a shared palette has to
+		// cover for all of them.
+		r, g, _, _ := decoded.Image[2].At(32, 0).RGBA()
+		if r>>8 < 0x70 || r>>8 > 0x90 || g>>8 < 0xb8 || g>>8 > 0xd8 {
+			t.Errorf("%+v: unexpected color %v", f, decoded.Image[2].At(32, 0))
+		}
+	}
+}
+
+func TestGIFDelay(t *testing.T) {
+	var total int
+	for i := 0; i < 30; i++ {
+		total += gifDelay(i, time.Second/30)
+	}
+	if total != 100 {
+		t.Errorf("30 frames at 30 fps should last 100 centiseconds, got %d", total)
+	}
+	if d := gifDelay(0, time.Second/100); d != gifMinDelay {
+		t.Errorf("expected at least %d centiseconds, got %d", gifMinDelay, d)
+	}
+}
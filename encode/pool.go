@@ -0,0 +1,137 @@
+package encode
+
+import (
+	"image"
+	"sync"
+)
+
+// Rendering at high resolutions produces a lot of garbage if every frame is a
+// new image, so frames are recycled through a pool.
+//
+// The receiver of a frame owns it. Stages that pass frames on pass on the
+// ownership, the final consumer calls ReleaseFrame when it is done with a
+// frame so its memory can be used for a later frame. Releasing is optional,
+// frames that are not released are garbage collected as usual. A consumer
+// must not use a frame after releasing it, since it will be overwritten.
+//
+// Stages that keep a frame after passing it on, for example to take
+// screenshots, must call RetainFrame before passing it and ReleaseFrame when
+// they no longer need it. The frame is reused after the last release.
+//
+// The EncodeAnimation implementations of this package release every frame
+// after it has been encoded.
+
+var framePool = struct {
+	lock  sync.Mutex
+	pools map[frameKey]*sync.Pool
+	// refs counts the owners of frames that have more than one.
+	refs map[image.Image]int
+}{
+	pools: map[frameKey]*sync.Pool{},
+	refs:  map[image.Image]int{},
+}
+
+// frameKey identifies frames that can be reused for each other. The layout is
+// empty for RGBA frames and "float" for FloatFrames.
+type frameKey struct {
+	layout string
+	rect   image.Rectangle
+}
+
+func getPooled(key frameKey) interface{} {
+	framePool.lock.Lock()
+	pool, ok := framePool.pools[key]
+	if !ok {
+		pool = &sync.Pool{}
+		framePool.pools[key] = pool
+	}
+	framePool.lock.Unlock()
+	return pool.Get()
+}
+
+// NewFrame returns an image for a frame, reusing the memory of a released
+// frame of the same size if possible. The contents are undefined, every
+// pixel should be written.
+func NewFrame(r image.Rectangle) *image.RGBA {
+	if img, ok := getPooled(frameKey{rect: r}).(*image.RGBA); ok {
+		return img
+	}
+	return image.NewRGBA(r)
+}
+
+// NewRawFrame returns a RawFrame of size bytes in the layout, reusing the
+// memory of a released frame like NewFrame.
+func NewRawFrame(layout string, r image.Rectangle, size int) *RawFrame {
+	if f, ok := getPooled(frameKey{layout: layout, rect: r}).(*RawFrame); ok && len(f.Pix) == size {
+		return f
+	}
+	return &RawFrame{Layout: layout, Rect: r, Pix: make([]byte, size)}
+}
+
+// NewFloatFrame returns a FloatFrame, reusing the memory of a released frame
+// like NewFrame.
+func NewFloatFrame(r image.Rectangle) *FloatFrame {
+	if f, ok := getPooled(frameKey{layout: "float", rect: r}).(*FloatFrame); ok {
+		return f
+	}
+	return &FloatFrame{Rect: r, Pix: make([]float32, r.Dx()*r.Dy()*4)}
+}
+
+// poolKey returns the key of frames that are pooled.
+func poolKey(img image.Image) (frameKey, bool) {
+	switch f := img.(type) {
+	case *image.RGBA:
+		if f != nil {
+			return frameKey{rect: f.Rect}, true
+		}
+	case *RawFrame:
+		if f != nil {
+			return frameKey{layout: f.Layout, rect: f.Rect}, true
+		}
+	case *FloatFrame:
+		if f != nil {
+			return frameKey{layout: "float", rect: f.Rect}, true
+		}
+	}
+	return frameKey{}, false
+}
+
+// RetainFrame adds an owner to a frame, which must release it as well.
+func RetainFrame(img image.Image) {
+	if _, ok := poolKey(img); !ok {
+		return
+	}
+	framePool.lock.Lock()
+	defer framePool.lock.Unlock()
+	if n, ok := framePool.refs[img]; ok {
+		framePool.refs[img] = n + 1
+	} else {
+		framePool.refs[img] = 2
+	}
+}
+
+// ReleaseFrame gives up the ownership of a frame. After the last owner has
+// released it, it is reused by NewFrame, NewRawFrame or NewFloatFrame. Other
+// images are ignored.
+func ReleaseFrame(img image.Image) {
+	key, ok := poolKey(img)
+	if !ok {
+		return
+	}
+	framePool.lock.Lock()
+	if n, ok := framePool.refs[img]; ok {
+		if n > 2 {
+			framePool.refs[img] = n - 1
+		} else {
+			delete(framePool.refs, img)
+		}
+		framePool.lock.Unlock()
+		return
+	}
+	pool, ok := framePool.pools[key]
+	framePool.lock.Unlock()
+	// Only frames of sizes that are rendered are pooled.
+	if ok {
+		pool.Put(img)
+	}
+}
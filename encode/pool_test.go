@@ -0,0 +1,60 @@
+package encode
+
+import (
+	"image"
+	"testing"
+)
+
+func TestFramePool(t *testing.T) {
+	r := image.Rect(0, 0, 7, 3)
+	img := NewFrame(r)
+	if img.Bounds() != r || len(img.Pix) != 7*3*4 {
+		t.Fatalf("unexpected frame of %v with %d bytes", img.Bounds(), len(img.Pix))
+	}
+
+	// The pool may drop frames, so try a few times.
+	reused := false
+	for i := 0; i < 10 && !reused; i++ {
+		ReleaseFrame(img)
+		reused = NewFrame(r) == img
+	}
+	if !reused {
+		t.Errorf("a released frame was not reused")
+	}
+	if other := NewFrame(image.Rect(0, 0, 3, 7)); other == img {
+		t.Errorf("a frame was reused for a different size")
+	}
+}
+
+func TestFramePoolRetain(t *testing.T) {
+	img := NewFrame(image.Rect(0, 0, 2, 2))
+	RetainFrame(img)
+	RetainFrame(img)
+	for i := 0; i < 2; i++ {
+		ReleaseFrame(img)
+		framePool.lock.Lock()
+		_, shared := framePool.refs[img]
+		framePool.lock.Unlock()
+		if i == 0 && !shared {
+			t.Fatalf("the frame lost its owners after %d releases", i+1)
+		}
+		if i == 1 && shared {
+			t.Fatalf("the frame is still shared after %d releases", i+1)
+		}
+	}
+	ReleaseFrame(img)
+
+	// Other images and nil are ignored.
+	RetainFrame(image.NewGray(image.Rect(0, 0, 1, 1)))
+	ReleaseFrame(image.NewGray(image.Rect(0, 0, 1, 1)))
+	ReleaseFrame(nil)
+	ReleaseFrame((*image.RGBA)(nil))
+}
+
+func BenchmarkFramePool(b *testing.B) {
+	r := image.Rect(0, 0, 3840, 2160)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		ReleaseFrame(NewFrame(r))
+	}
+}
@@ -0,0 +1,66 @@
+package encode
+
+import (
+	"image"
+	"image/color"
+)
+
+// RawFrame is a frame that is already in the byte layout of a raw format, for
+// example because it was converted on the GPU. Outputs of that format write
+// the bytes as they are. It implements image.Image, so other outputs can
+// encode it like any other image, although it is slower.
+type RawFrame struct {
+	// Layout is the name of the format in Formats: rgb24, bgr24, rgb565 or
+	// yuv420p.
+	Layout string
+	Rect   image.Rectangle
+	Pix    []byte
+}
+
+func (f *RawFrame) ColorModel() color.Model {
+	return color.RGBAModel
+}
+
+func (f *RawFrame) Bounds() image.Rectangle {
+	return f.Rect
+}
+
+func (f *RawFrame) At(x, y int) color.Color {
+	if !(image.Point{X: x, Y: y}).In(f.Rect) {
+		return color.RGBA{}
+	}
+	w, h := f.Rect.Dx(), f.Rect.Dy()
+	x, y = x-f.Rect.Min.X, y-f.Rect.Min.Y
+	i := y*w + x
+	switch f.Layout {
+	case "rgb24":
+		return color.RGBA{f.Pix[i*3], f.Pix[i*3+1], f.Pix[i*3+2], 0xff}
+	case "bgr24":
+		return color.RGBA{f.Pix[i*3+2], f.Pix[i*3+1], f.Pix[i*3], 0xff}
+	case "rgb565":
+		v := uint16(f.Pix[i*2]) | uint16(f.Pix[i*2+1])<<8
+		r, g, b := byte(v>>11), byte(v>>5&0x3f), byte(v&0x1f)
+		return color.RGBA{r<<3 | r>>2, g<<2 | g>>4, b<<3 | b>>2, 0xff}
+	case "yuv420p":
+		cw, ch := (w+1)/2, (h+1)/2
+		c := y/2*cw + x/2
+		return yuvToRGBA(f.Pix[i], f.Pix[w*h+c], f.Pix[w*h+cw*ch+c])
+	}
+	return color.RGBA{}
+}
+
+// yuvToRGBA is the inverse of the BT.601 limited range conversion of toI420.
+func yuvToRGBA(y, u, v byte) color.RGBA {
+	c := 298 * (int(y) - 16)
+	d, e := int(u)-128, int(v)-128
+	clamp := func(x int) byte {
+		x = (x + 128) >> 8
+		if x < 0 {
+			return 0
+		} else if x > 0xff {
+			return 0xff
+		}
+		return byte(x)
+	}
+	return color.RGBA{clamp(c + 409*e), clamp(c - 100*d - 208*e), clamp(c + 516*d), 0xff}
+}
@@ -0,0 +1,111 @@
+package encode
+
+import (
+	"fmt"
+	"image"
+	"math"
+	"os/exec"
+	"path"
+	"strconv"
+	"time"
+)
+
+// SegmentedFormats are formats that write a playlist along with a rolling set
+// of video segments instead of a single stream. Because multiple files are
+// written, these are not Formats.
+var SegmentedFormats = map[string]SegmentedFormat{
+	"hls":  {Muxer: "hls", Extension: "m3u8"},
+	"dash": {Muxer: "dash", Extension: "mpd"},
+}
+
+// DetectSegmentedFormat looks up the segmented format by the extension of the
+// playlist filename.
+func DetectSegmentedFormat(filename string) (SegmentedFormat, bool) {
+	ext := path.Ext(filename)
+	if len(ext) == 0 {
+		return SegmentedFormat{}, false
+	}
+	for _, f := range SegmentedFormats {
+		if f.Extension == ext[1:] {
+			return f, true
+		}
+	}
+	return SegmentedFormat{}, false
+}
+
+// SegmentedFormat encodes animations to H.264 or HEVC for live streaming with
+// HLS or DASH, which also supports VP9. Encoding is done by piping raw frames
+// into FFmpeg, which must be installed.
+type SegmentedFormat struct {
+	// Muxer is the name of the FFmpeg muxer, either "hls" or "dash".
+	Muxer string
+	// Extension is the extension of the playlist file excluding '.'.
+	Extension string
+}
+
+// SegmentOptions configure the segments written by a SegmentedFormat.
+type SegmentOptions struct {
+	// Duration is the target duration of each segment.
+	Duration time.Duration
+	// ListSize is the number of segments kept in the playlist. Older segments
+	// are deleted. If 0, all segments are kept.
+	ListSize int
+	// Encoder is the video encoder to use.
+	Encoder VideoEncoder
+}
+
+// EncodeSegments encodes a series of successive images to the playlist at
+// filename. Segments are written to the same directory.
+//
+// The function consumes all images from the stream until it closes.
+func (f SegmentedFormat) EncodeSegments(filename string, stream <-chan image.Image, interval time.Duration, opts SegmentOptions) error {
+	if interval <= 0 {
+		return fmt.Errorf("%s output requires a framerate", f.Muxer)
+	}
+	if err := opts.Encoder.Validate(); err != nil {
+		return err
+	}
+	if f.Muxer == "hls" && opts.Encoder.Codec == "vp9" {
+		return fmt.Errorf("hls output requires the h264 or hevc codec")
+	}
+	first, ok := <-stream
+	if !ok {
+		return nil
+	}
+	fps := float64(time.Second) / float64(interval)
+	segmentDuration := opts.Duration.Seconds()
+	if segmentDuration <= 0 {
+		segmentDuration = 4
+	}
+	// Force a keyframe at the start of every segment.
+	gop := strconv.Itoa(int(math.Max(1, math.Round(fps*segmentDuration))))
+	segmentSeconds := strconv.FormatFloat(segmentDuration, 'f', -1, 64)
+	listSize := strconv.Itoa(opts.ListSize)
+
+	raw, input := rawVideoInput(first, interval)
+	args := []string{"-hide_banner", "-loglevel", "error", "-y"}
+	args = append(args, opts.Encoder.inputArgs()...)
+	args = append(args, input...)
+	args = append(args, opts.Encoder.outputArgs(true)...)
+	args = append(args,
+		"-g", gop, "-keyint_min", gop, "-sc_threshold", "0",
+		"-f", f.Muxer,
+	)
+	switch f.Muxer {
+	case "hls":
+		args = append(args,
+			"-hls_time", segmentSeconds,
+			"-hls_list_size", listSize,
+			"-hls_flags", "delete_segments+independent_segments",
+		)
+	case "dash":
+		args = append(args,
+			"-seg_duration", segmentSeconds,
+			"-window_size", listSize,
+			"-remove_at_exit", "0",
+		)
+	}
+	args = append(args, filename)
+
+	return feedFFmpeg(exec.Command("ffmpeg", args...), raw, first, stream)
+}
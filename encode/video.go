@@ -0,0 +1,167 @@
+package encode
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// VideoEncoder selects how FFmpeg encodes the video of video and segmented
+// outputs.
+type VideoEncoder struct {
+	// Codec is "h264", "hevc" or "vp9". Defaults to h264.
+	Codec string
+	// Hardware is the API of the hardware encoder to use, "vaapi" or
+	// "nvenc". If empty, video is encoded in software.
+	Hardware string
+	// Device is the DRM render node used by VA-API. Defaults to
+	// DefaultVAAPIDevice.
+	Device string
+	// CRF is the constant rate factor, or the constant quality of hardware
+	// encoders. Lower values are of higher quality. If 0, the default of the
+	// encoder is used.
+	CRF int
+	// PixelFormat is the FFmpeg pixel format of the encoded video. Defaults
+	// to yuv420p.
+	PixelFormat string
+	// Subtitles is the path of an SRT or ASS file of which the subtitles are
+	// burnt into the video, which requires FFmpeg to be built with libass.
+	Subtitles string
+	// SubtitlesOffset is the time of the first frame in the subtitles.
+	SubtitlesOffset time.Duration
+}
+
+// DefaultVAAPIDevice is the render node of the first GPU.
+const DefaultVAAPIDevice = "/dev/dri/renderD128"
+
+// Validate checks whether the encoder is supported.
+func (e VideoEncoder) Validate() error {
+	maxCRF := 51
+	switch e.Codec {
+	case "", "h264", "hevc":
+	case "vp9":
+		maxCRF = 63
+		if e.Hardware == "nvenc" {
+			return fmt.Errorf("nvenc can not encode vp9")
+		}
+	default:
+		return fmt.Errorf("unsupported video codec %q, valid codecs are h264, hevc and vp9", e.Codec)
+	}
+	switch e.Hardware {
+	case "", "vaapi", "nvenc":
+	default:
+		return fmt.Errorf("unsupported hardware encoder %q, valid encoders are vaapi and nvenc", e.Hardware)
+	}
+	if e.CRF < 0 || e.CRF > maxCRF {
+		return fmt.Errorf("the crf of %s must be between 0 and %d, got %d", e.codec(), maxCRF, e.CRF)
+	}
+	return nil
+}
+
+func (e VideoEncoder) codec() string {
+	if e.Codec == "" {
+		return "h264"
+	}
+	return e.Codec
+}
+
+// inputArgs are the FFmpeg arguments that come before the input.
+func (e VideoEncoder) inputArgs() []string {
+	if e.Hardware != "vaapi" {
+		return nil
+	}
+	device := e.Device
+	if device == "" {
+		device = DefaultVAAPIDevice
+	}
+	return []string{"-vaapi_device", device}
+}
+
+// filters returns the FFmpeg video filters that are applied to every frame
+// before it is encoded.
+func (e VideoEncoder) filters() []string {
+	if e.Subtitles == "" {
+		return nil
+	}
+	subtitles := "subtitles=filename=" + escapeFilterArg(e.Subtitles)
+	if e.SubtitlesOffset == 0 {
+		return []string{subtitles}
+	}
+	// The subtitles are shown at the timestamps of the frames, which start
+	// at 0, so they are shifted to the time of the subtitles and back.
+	offset := strconv.FormatFloat(e.SubtitlesOffset.Seconds(), 'f', -1, 64)
+	return []string{"setpts=PTS+" + offset + "/TB", subtitles, "setpts=PTS-STARTPTS"}
+}
+
+// escapeFilterArg escapes the value of an option of a filter, which is parsed
+// as part of an option list of the filter and then of the filter graph.
+func escapeFilterArg(s string) string {
+	s = strings.NewReplacer(`\`, `\\`, `'`, `\'`, `:`, `\:`).Replace(s)
+	return strings.NewReplacer(`\`, `\\`, `'`, `\'`, `[`, `\[`, `]`, `\]`, `,`, `\,`, `;`, `\;`).Replace(s)
+}
+
+// outputArgs are the FFmpeg arguments that select and configure the encoder.
+// Frames are converted to YUV 4:2:0 by default, the only format all players
+// support. Live encoders are tuned for latency rather than compression.
+func (e VideoEncoder) outputArgs(live bool) []string {
+	codec := e.codec()
+	pixelFormat := e.PixelFormat
+	if pixelFormat == "" {
+		pixelFormat = "yuv420p"
+	}
+	var args []string
+	filters := e.filters()
+	switch e.Hardware {
+	case "vaapi":
+		// Frames are uploaded to the GPU as NV12, which is what VA-API
+		// encoders take.
+		upload := "nv12"
+		if e.PixelFormat != "" {
+			upload = e.PixelFormat
+		}
+		filters = append(filters, "format="+upload, "hwupload")
+		args = []string{"-vf", strings.Join(filters, ","), "-c:v", codec + "_vaapi"}
+		if e.CRF > 0 {
+			args = append(args, "-qp", strconv.Itoa(e.CRF))
+		}
+		return args
+	case "nvenc":
+		if len(filters) > 0 {
+			args = []string{"-vf", strings.Join(filters, ",")}
+		}
+		args = append(args, "-c:v", codec+"_nvenc", "-preset", "p4")
+		if live {
+			args = append(args, "-tune", "ll")
+		}
+		if e.CRF > 0 {
+			args = append(args, "-cq", strconv.Itoa(e.CRF))
+		}
+		return append(args, "-pix_fmt", pixelFormat)
+	}
+	if len(filters) > 0 {
+		args = []string{"-vf", strings.Join(filters, ",")}
+	}
+
+	switch codec {
+	case "vp9":
+		args = append(args, "-c:v", "libvpx-vp9", "-row-mt", "1")
+		if live {
+			args = append(args, "-deadline", "realtime", "-cpu-used", "8")
+		}
+		if e.CRF > 0 {
+			// Without a bitrate limit, VP9 is encoded at constant quality.
+			args = append(args, "-crf", strconv.Itoa(e.CRF), "-b:v", "0")
+		}
+	default:
+		lib := map[string]string{"h264": "libx264", "hevc": "libx265"}[codec]
+		args = append(args, "-c:v", lib)
+		if live {
+			args = append(args, "-preset", "veryfast", "-tune", "zerolatency")
+		}
+		if e.CRF > 0 {
+			args = append(args, "-crf", strconv.Itoa(e.CRF))
+		}
+	}
+	return append(args, "-pix_fmt", pixelFormat)
+}
@@ -0,0 +1,97 @@
+package encode
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestVideoEncoder(t *testing.T) {
+	cases := []struct {
+		encoder      VideoEncoder
+		input, codec []string
+	}{
+		{VideoEncoder{}, nil, []string{"-c:v", "libx264"}},
+		{VideoEncoder{Codec: "hevc"}, nil, []string{"-c:v", "libx265"}},
+		{VideoEncoder{Hardware: "vaapi"}, []string{"-vaapi_device", DefaultVAAPIDevice}, []string{"-vf", "format=nv12,hwupload", "-c:v", "h264_vaapi"}},
+		{VideoEncoder{Codec: "hevc", Hardware: "vaapi", Device: "/dev/dri/renderD129"}, []string{"-vaapi_device", "/dev/dri/renderD129"}, []string{"-vf", "format=nv12,hwupload", "-c:v", "hevc_vaapi"}},
+		{VideoEncoder{Codec: "hevc", Hardware: "nvenc"}, nil, []string{"-c:v", "hevc_nvenc"}},
+		{VideoEncoder{Codec: "vp9"}, nil, []string{"-c:v", "libvpx-vp9"}},
+		{VideoEncoder{Codec: "vp9", Hardware: "vaapi"}, []string{"-vaapi_device", DefaultVAAPIDevice}, []string{"-vf", "format=nv12,hwupload", "-c:v", "vp9_vaapi"}},
+	}
+	for _, c := range cases {
+		if err := c.encoder.Validate(); err != nil {
+			t.Errorf("%+v: %v", c.encoder, err)
+		}
+		if input := c.encoder.inputArgs(); !reflect.DeepEqual(input, c.input) {
+			t.Errorf("%+v: input arguments %q, expected %q", c.encoder, input, c.input)
+		}
+		if output := c.encoder.outputArgs(true); !reflect.DeepEqual(output[:len(c.codec)], c.codec) {
+			t.Errorf("%+v: output arguments %q, expected %q first", c.encoder, output, c.codec)
+		}
+	}
+
+	for _, e := range []VideoEncoder{{Codec: "av1"}, {Hardware: "qsv"}, {Codec: "vp9", Hardware: "nvenc"}, {CRF: 52}, {CRF: -1}} {
+		if err := e.Validate(); err == nil {
+			t.Errorf("%+v: expected an error", e)
+		}
+	}
+}
+
+func TestVideoEncoderQuality(t *testing.T) {
+	cases := []struct {
+		encoder VideoEncoder
+		live    bool
+		args    []string
+	}{
+		{VideoEncoder{}, true, []string{"-c:v", "libx264", "-preset", "veryfast", "-tune", "zerolatency", "-pix_fmt", "yuv420p"}},
+		{VideoEncoder{CRF: 18, PixelFormat: "yuv444p"}, false, []string{"-c:v", "libx264", "-crf", "18", "-pix_fmt", "yuv444p"}},
+		{VideoEncoder{Codec: "vp9", CRF: 31}, false, []string{"-c:v", "libvpx-vp9", "-row-mt", "1", "-crf", "31", "-b:v", "0", "-pix_fmt", "yuv420p"}},
+		{VideoEncoder{Hardware: "nvenc", CRF: 23}, false, []string{"-c:v", "h264_nvenc", "-preset", "p4", "-cq", "23", "-pix_fmt", "yuv420p"}},
+		{VideoEncoder{Hardware: "vaapi", CRF: 23, PixelFormat: "p010"}, false, []string{"-vf", "format=p010,hwupload", "-c:v", "h264_vaapi", "-qp", "23"}},
+	}
+	for _, c := range cases {
+		if args := c.encoder.outputArgs(c.live); !reflect.DeepEqual(args, c.args) {
+			t.Errorf("%+v: output arguments %q, expected %q", c.encoder, args, c.args)
+		}
+	}
+}
+
+func TestVideoEncoderSubtitles(t *testing.T) {
+	cases := []struct {
+		encoder VideoEncoder
+		filters string
+	}{
+		{VideoEncoder{Subtitles: "demo.srt"}, "subtitles=filename=demo.srt"},
+		{VideoEncoder{Subtitles: "it's [a]:b.ass"}, `subtitles=filename=it\\\'s \[a\]\\:b.ass`},
+		{VideoEncoder{Subtitles: "demo.srt", SubtitlesOffset: 1500 * time.Millisecond}, "setpts=PTS+1.5/TB,subtitles=filename=demo.srt,setpts=PTS-STARTPTS"},
+		{VideoEncoder{Subtitles: "demo.srt", Hardware: "vaapi"}, "subtitles=filename=demo.srt,format=nv12,hwupload"},
+		{VideoEncoder{Subtitles: "demo.srt", Hardware: "nvenc"}, "subtitles=filename=demo.srt"},
+	}
+	for _, c := range cases {
+		args := c.encoder.outputArgs(false)
+		if len(args) < 2 || args[0] != "-vf" || args[1] != c.filters {
+			t.Errorf("%+v: output arguments %q, expected the filters %q", c.encoder, args, c.filters)
+		}
+	}
+}
+
+func TestVideoFormat(t *testing.T) {
+	if f, ok := DetectFormat("out.webm"); !ok || f != Formats["webm"] {
+		t.Fatalf("webm was not detected, got %v", f)
+	}
+	webm := VideoFormat{Muxer: "webm", Extension: "webm"}
+	if err := webm.Validate(); err != nil {
+		t.Errorf("webm: %v", err)
+	}
+	if webm.codec() != "vp9" || Formats["mp4"].(VideoFormat).codec() != "h264" {
+		t.Errorf("unexpected default codecs")
+	}
+	webm.Encoder.Codec = "h264"
+	if err := webm.Validate(); err == nil {
+		t.Errorf("expected an error for h264 in webm")
+	}
+	if err := (VideoFormat{Muxer: "mp4", Extension: "mp4"}).EncodeAnimation(nil, nil, 0); err == nil {
+		t.Errorf("expected an error without a framerate")
+	}
+}
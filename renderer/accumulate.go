@@ -0,0 +1,242 @@
+package renderer
+
+import (
+	"fmt"
+	"math"
+
+	"github.com/go-gl/gl/v3.3-core/gl"
+)
+
+const (
+	accumulateResolveVert = SourceBuf(`#version 330 core
+		in vec2 pos;
+
+		void main() {
+			gl_Position = vec4(pos, 0.0, 1.0);
+		}
+	`)
+	accumulateResolveFrag = SourceBuf(`#version 330 core
+		out vec4 fragColor;
+		uniform sampler2D accumulated;
+		uniform float numSamples;
+
+		void main() {
+			fragColor = texelFetch(accumulated, ivec2(gl_FragCoord.xy), 0) / numSamples;
+		}
+	`)
+	// accumulateDenoiseFrag resolves the accumulated samples with a bilateral
+	// filter, which smooths out noise while preserving edges.
+	accumulateDenoiseFrag = SourceBuf(`#version 330 core
+		out vec4 fragColor;
+		uniform sampler2D accumulated;
+		uniform float numSamples;
+		uniform float sigmaRange;
+
+		const int radius = 5;
+		const float sigmaSpatial = 2.0;
+
+		void main() {
+			ivec2 size = textureSize(accumulated, 0);
+			ivec2 p = ivec2(gl_FragCoord.xy);
+			vec4 center = texelFetch(accumulated, p, 0) / numSamples;
+			vec4 sum = vec4(0.0);
+			float weightSum = 0.0;
+			for (int y = -radius; y <= radius; y++) {
+				for (int x = -radius; x <= radius; x++) {
+					ivec2 q = clamp(p + ivec2(x, y), ivec2(0), size - 1);
+					vec4 c = texelFetch(accumulated, q, 0) / numSamples;
+					vec3 d = c.rgb - center.rgb;
+					float w = exp(
+						-float(x*x + y*y) / (2.0 * sigmaSpatial * sigmaSpatial)
+						- dot(d, d) / (2.0 * sigmaRange * sigmaRange)
+					);
+					sum += c * w;
+					weightSum += w;
+				}
+			}
+			fragColor = sum / weightSum;
+		}
+	`)
+)
+
+// AccumulationOptions configure progressive rendering, where multiple samples
+// of the same frame are averaged to produce the output image. This is what
+// path tracing shaders need to converge to a noise free image.
+type AccumulationOptions struct {
+	// Samples is the number of samples rendered for each frame. A value of 0
+	// accumulates samples until Stop is closed or the frame has converged.
+	Samples uint
+	// Stop may be closed to finish the frame that is currently being
+	// accumulated with all samples that have been rendered so far.
+	Stop <-chan struct{}
+	// NoiseThreshold enables adaptive sampling if non-zero. A frame is
+	// considered converged when the estimated RMS error of the averaged
+	// color drops below this value. Samples then acts as the upper limit.
+	NoiseThreshold float64
+	// Denoise enables a bilateral filter that is applied to the averaged
+	// samples if non-zero. The value is the standard deviation of the color
+	// difference in the 0-1 range, larger values smooth more aggressively.
+	Denoise float64
+}
+
+// firstNoiseCheckpoint is the number of samples after which adaptive sampling
+// first estimates the noise. Subsequent checks are done every time the number
+// of samples doubles.
+const firstNoiseCheckpoint = 8
+
+// SamplePreRenderer may be implemented by environments that support rendering
+// multiple samples per frame.
+type SamplePreRenderer interface {
+	// PreRenderSample is called before every sample of a frame except the
+	// first, which is preceded by PreRender. Only values that differ per
+	// sample, such as the sample index, should be updated.
+	PreRenderSample(state RenderState)
+}
+
+// accumulator sums the samples of a frame in a floating point framebuffer.
+type accumulator struct {
+	w, h   uint
+	fbo    uint32
+	tex    uint32
+	memory *MemoryReservation
+
+	resolveProgram uint32
+	denoise        float64
+}
+
+func newAccumulator(width, height uint, denoise float64) (*accumulator, error) {
+	acc := &accumulator{w: width, h: height, denoise: denoise}
+
+	resolveFrag := accumulateResolveFrag
+	if denoise > 0 {
+		resolveFrag = accumulateDenoiseFrag
+	}
+	var err error
+	acc.resolveProgram, err = linkProgram(map[Stage][]Source{
+		StageVertex:   {accumulateResolveVert},
+		StageFragment: {resolveFrag},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	acc.memory, err = ReserveMemory(fmt.Sprintf("a %dx%d accumulation buffer", width, height), int64(width)*int64(height)*16)
+	if err != nil {
+		gl.DeleteProgram(acc.resolveProgram)
+		return nil, err
+	}
+	gl.GenFramebuffers(1, &acc.fbo)
+	gl.BindFramebuffer(gl.FRAMEBUFFER, acc.fbo)
+	gl.GenTextures(1, &acc.tex)
+	gl.BindTexture(gl.TEXTURE_2D, acc.tex)
+	gl.TexImage2D(gl.TEXTURE_2D, 0, gl.RGBA32F, int32(width), int32(height), 0, gl.RGBA, gl.FLOAT, nil)
+	gl.TexParameteri(gl.TEXTURE_2D, gl.TEXTURE_MAG_FILTER, gl.NEAREST)
+	gl.TexParameteri(gl.TEXTURE_2D, gl.TEXTURE_MIN_FILTER, gl.NEAREST)
+	gl.FramebufferTexture2D(gl.FRAMEBUFFER, gl.COLOR_ATTACHMENT0, gl.TEXTURE_2D, acc.tex, 0)
+	status := gl.CheckFramebufferStatus(gl.FRAMEBUFFER)
+	gl.BindFramebuffer(gl.FRAMEBUFFER, 0)
+	gl.BindTexture(gl.TEXTURE_2D, 0)
+	if status != gl.FRAMEBUFFER_COMPLETE {
+		acc.Close()
+		return nil, fmt.Errorf("incomplete accumulation framebuffer")
+	}
+	return acc, nil
+}
+
+// Accumulate renders samples into the accumulation buffer with additive
+// blending. The sample function is called for each sample with the index of
+// that sample and should return false to stop early.
+//
+// The number of samples accumulated is returned.
+func (acc *accumulator) Accumulate(sample func(i uint) bool) uint {
+	var prevFBO int32
+	gl.GetIntegerv(gl.DRAW_FRAMEBUFFER_BINDING, &prevFBO)
+
+	gl.BindFramebuffer(gl.FRAMEBUFFER, acc.fbo)
+	gl.ClearColor(0, 0, 0, 0)
+	gl.Clear(gl.COLOR_BUFFER_BIT)
+	gl.Enable(gl.BLEND)
+	gl.BlendFunc(gl.ONE, gl.ONE)
+	gl.BlendEquation(gl.FUNC_ADD)
+
+	n := uint(0)
+	for sample(n) {
+		n++
+	}
+
+	gl.Disable(gl.BLEND)
+	gl.BindFramebuffer(gl.FRAMEBUFFER, uint32(prevFBO))
+	return n
+}
+
+// Resolve draws the average of the accumulated samples to the currently bound
+// framebuffer. The vertex array of a fullscreen quad should be bound.
+func (acc *accumulator) Resolve(numSamples uint) {
+	if numSamples == 0 {
+		numSamples = 1
+	}
+	gl.UseProgram(acc.resolveProgram)
+	gl.ActiveTexture(gl.TEXTURE0)
+	gl.BindTexture(gl.TEXTURE_2D, acc.tex)
+	gl.Uniform1i(gl.GetUniformLocation(acc.resolveProgram, gl.Str("accumulated\x00")), 0)
+	gl.Uniform1f(gl.GetUniformLocation(acc.resolveProgram, gl.Str("numSamples\x00")), float32(numSamples))
+	if acc.denoise > 0 {
+		gl.Uniform1f(gl.GetUniformLocation(acc.resolveProgram, gl.Str("sigmaRange\x00")), float32(acc.denoise))
+	}
+
+	loc := uint32(gl.GetAttribLocation(acc.resolveProgram, gl.Str("pos\x00")))
+	gl.EnableVertexAttribArray(loc)
+	gl.VertexAttribPointer(loc, 3, gl.FLOAT, false, 0, nil)
+	gl.DrawArrays(gl.TRIANGLE_STRIP, 0, 4)
+	gl.BindTexture(gl.TEXTURE_2D, 0)
+}
+
+// Mean reads back the average of the numSamples samples accumulated so far.
+func (acc *accumulator) Mean(numSamples uint) []float32 {
+	mean := make([]float32, acc.w*acc.h*4)
+	var prevFBO int32
+	gl.GetIntegerv(gl.READ_FRAMEBUFFER_BINDING, &prevFBO)
+	gl.BindFramebuffer(gl.READ_FRAMEBUFFER, acc.fbo)
+	gl.ReadBuffer(gl.COLOR_ATTACHMENT0)
+	gl.ReadPixels(0, 0, int32(acc.w), int32(acc.h), gl.RGBA, gl.FLOAT, gl.Ptr(mean))
+	gl.BindFramebuffer(gl.READ_FRAMEBUFFER, uint32(prevFBO))
+	for i := range mean {
+		mean[i] /= float32(numSamples)
+	}
+	return mean
+}
+
+// estimateNoise estimates the RMS error of the color channels of an image
+// averaged over n samples by comparing it to the average of the first n/2
+// samples.
+//
+// The difference between the two is equal to half the difference between the
+// means of the first and second half of the samples, which has a variance of
+// σ²/n. That is the same as the variance of the mean of all n samples.
+func estimateNoise(mean, halfMean []float32) float64 {
+	if len(mean) != len(halfMean) {
+		panic("mismatched slice lengths")
+	}
+	sum := 0.0
+	n := 0
+	for i := range mean {
+		if i%4 == 3 {
+			continue // Skip alpha.
+		}
+		d := float64(mean[i] - halfMean[i])
+		sum += d * d
+		n++
+	}
+	if n == 0 {
+		return 0
+	}
+	return math.Sqrt(sum / float64(n))
+}
+
+func (acc *accumulator) Close() error {
+	gl.DeleteFramebuffers(1, &acc.fbo)
+	gl.DeleteTextures(1, &acc.tex)
+	gl.DeleteProgram(acc.resolveProgram)
+	acc.memory.Release()
+	return nil
+}
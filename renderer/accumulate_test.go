@@ -0,0 +1,34 @@
+package renderer
+
+import (
+	"math"
+	"math/rand"
+	"testing"
+)
+
+func TestEstimateNoise(t *testing.T) {
+	// Simulate a single pixel channel that is sampled from a uniform
+	// distribution with a known standard deviation.
+	const n = 1024
+	const pixels = 4096
+	rng := rand.New(rand.NewSource(1))
+	mean := make([]float32, pixels*4)
+	halfMean := make([]float32, pixels*4)
+	for p := 0; p < pixels*4; p++ {
+		sum := 0.0
+		for i := 0; i < n; i++ {
+			sum += rng.Float64()
+			if i == n/2-1 {
+				halfMean[p] = float32(sum / (n / 2))
+			}
+		}
+		mean[p] = float32(sum / n)
+	}
+
+	// The standard deviation of U(0,1) is 1/sqrt(12).
+	exp := 1 / math.Sqrt(12) / math.Sqrt(n)
+	got := estimateNoise(mean, halfMean)
+	if math.Abs(got-exp)/exp > 0.1 {
+		t.Fatalf("unexpected noise estimate: exp %v, got %v", exp, got)
+	}
+}
@@ -0,0 +1,184 @@
+package renderer
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/go-gl/glfw/v3.3/glfw"
+
+	"github.com/polyfloyd/shady/egl"
+)
+
+// Backend selects how the OpenGL context for off-screen rendering is created.
+type Backend string
+
+const (
+	// BackendAuto tries the GLFW, EGL and software backends in that order.
+	BackendAuto Backend = "auto"
+	// BackendGLFW uses the context of a hidden window, which requires a
+	// display server.
+	BackendGLFW Backend = "glfw"
+	// BackendEGL renders with a GPU through EGL, without a display server.
+	BackendEGL Backend = "egl"
+	// BackendSoftware renders on the CPU with the software renderer of Mesa.
+	BackendSoftware Backend = "software"
+)
+
+// ParseBackend parses the name of a backend.
+func ParseBackend(s string) (Backend, error) {
+	switch b := Backend(s); b {
+	case BackendAuto, BackendGLFW, BackendEGL, BackendSoftware:
+		return b, nil
+	}
+	return "", fmt.Errorf("unknown backend %q, expected one of auto, glfw, egl or software", s)
+}
+
+var (
+	contextBackend = BackendAuto
+	contextDevice  string
+	// activeBackend is the backend that created the context.
+	activeBackend Backend
+	// glfwWindow is the hidden window of which the context is used by
+	// BackendGLFW.
+	glfwWindow *glfw.Window
+)
+
+// SetBackend selects the backend of the context that is created for
+// off-screen rendering. device is the DRM device or render node of the GPU
+// that BackendEGL renders with, like /dev/dri/renderD128. If it is empty, the
+// first GPU that works is used.
+//
+// The context is created once, so this must be called before the first Shader
+// is created.
+func SetBackend(backend Backend, device string) {
+	contextBackend, contextDevice = backend, device
+}
+
+// initContext creates the context for off-screen rendering with the backend
+// set by SetBackend and makes it current.
+func initContext(glVersion OpenGLVersion) error {
+	backends := []Backend{contextBackend}
+	if contextBackend == BackendAuto {
+		backends = []Backend{BackendGLFW, BackendEGL, BackendSoftware}
+	}
+	var errs []string
+	for _, b := range backends {
+		var err error
+		switch b {
+		case BackendGLFW:
+			err = initGLFW(glVersion)
+		case BackendEGL:
+			err = initEGLDevice(glVersion, contextDevice, false)
+			if err != nil && contextDevice == "" {
+				// Fall back to the default display, which may be
+				// provided by a display server.
+				if defaultErr := initEGL(glVersion); defaultErr == nil {
+					err = nil
+				} else {
+					err = fmt.Errorf("%v, default display: %v", err, defaultErr)
+				}
+			}
+		case BackendSoftware:
+			err = initEGLDevice(glVersion, "", true)
+			if err != nil {
+				// The software device is not always exposed, but Mesa
+				// also renders in software when asked to.
+				os.Setenv("LIBGL_ALWAYS_SOFTWARE", "1")
+				if defaultErr := initEGL(glVersion); defaultErr == nil {
+					err = nil
+				} else {
+					err = fmt.Errorf("%v, default display: %v", err, defaultErr)
+				}
+			}
+		}
+		if err == nil {
+			activeBackend = b
+			return nil
+		}
+		errs = append(errs, fmt.Sprintf("%s: %v", b, err))
+	}
+	return fmt.Errorf("could not create an OpenGL context (%s)", strings.Join(errs, "; "))
+}
+
+func initGLFW(glVersion OpenGLVersion) error {
+	if err := glfw.Init(); err != nil {
+		return err
+	}
+	maj, min := glVersion.majorMinor()
+	glfw.WindowHint(glfw.Visible, glfw.False)
+	glfw.WindowHint(glfw.ContextVersionMajor, maj)
+	glfw.WindowHint(glfw.ContextVersionMinor, min)
+	window, err := glfw.CreateWindow(1, 1, "Shady", nil, nil)
+	if err != nil {
+		glfw.Terminate()
+		return err
+	}
+	window.MakeContextCurrent()
+	glfwWindow = window
+	return nil
+}
+
+// initEGLDevice creates a context on the first EGL device that works. Devices
+// of software renderers are only used if software is set. If device is set,
+// only the GPU with that device or render node is used.
+func initEGLDevice(glVersion OpenGLVersion, device string, software bool) error {
+	devices, err := egl.QueryDevices()
+	if err != nil {
+		return err
+	}
+	var lastErr error
+	for _, dev := range devices {
+		if hasString(dev.Extensions(), "EGL_MESA_device_software") != software {
+			continue
+		}
+		if device != "" && device != dev.DRMDeviceFile() && device != dev.DRMRenderNodeFile() {
+			continue
+		}
+		display, err := dev.Display()
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		if err := display.BindAPI(egl.OpenGLAPI); err != nil {
+			lastErr = err
+			continue
+		}
+		glMajor, glMinor := glVersion.majorMinor()
+		var glContext *egl.Context
+		if hasString(display.Extensions(), "EGL_KHR_surfaceless_context") {
+			glContext, err = display.CreateSurfacelessContext(glMajor, glMinor)
+		} else {
+			var surface *egl.Surface
+			if surface, err = display.CreateSurface(1<<12, 1<<12); err == nil {
+				glContext, err = display.CreateContext(surface, glMajor, glMinor)
+			}
+		}
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		glContext.MakeCurrent()
+		eglContext = glContext
+		return nil
+	}
+	switch {
+	case lastErr != nil:
+		return lastErr
+	case device != "":
+		return fmt.Errorf("no EGL device %s", device)
+	case software:
+		return errors.New("no software EGL device")
+	}
+	return errors.New("no EGL device")
+}
+
+func hasString(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,14 @@
+package renderer
+
+import "testing"
+
+func TestParseBackend(t *testing.T) {
+	for _, s := range []string{"auto", "glfw", "egl", "software"} {
+		if b, err := ParseBackend(s); err != nil || string(b) != s {
+			t.Errorf("ParseBackend(%q) = %q, %v", s, b, err)
+		}
+	}
+	if _, err := ParseBackend("x11"); err == nil {
+		t.Errorf("expected an error for an unknown backend")
+	}
+}
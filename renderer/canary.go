@@ -0,0 +1,307 @@
+package renderer
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"sort"
+
+	"github.com/go-gl/gl/v3.3-core/gl"
+)
+
+// The size of the frame that is rendered to test new environments. It is kept
+// small, most shaders that fail do so everywhere.
+const canaryWidth, canaryHeight = 64, 36
+
+// loadedEnvironment is an environment that is set up and linked for rendering
+// in the current context.
+type loadedEnvironment struct {
+	env        Environment
+	program    uint32
+	uniforms   map[string]Uniform
+	vertLoc    uint32
+	subTargets map[string]*Shader
+	// subOrder holds the names of the sub targets in the order they are
+	// rendered in.
+	subOrder  []string
+	subInputs map[string][]string
+	// tweaks is set if tweakable literals are lifted and the sources have
+	// any.
+	tweaks *tweakSet
+	// defines are the macros that are defined for the program.
+	defines map[string]string
+	// userUniforms is set if the sources declare uniforms with
+	// `#pragma uniform`.
+	userUniforms *userUniformSet
+	// fingerprints identify the sub targets, see passFingerprint.
+	fingerprints map[string]string
+	// reused holds the names of the sub targets that were taken over from
+	// the environment that this one replaces, which are not closed with it
+	// until it is the current environment.
+	reused map[string]bool
+}
+
+// loadEnvironment sets up an environment and links its program. configure is
+// called for the Shaders of the sub environments before they are loaded. If
+// tweak is set, tweakable literals are lifted to uniforms. The Defines of the
+// state override the defaults of the options of the sources. The values of
+// the uniforms that the sources declare are taken from userUniforms, which may
+// be nil. The sub targets of reuse of which the fingerprint did not change are
+// taken over instead of being loaded again.
+func loadEnvironment(env Environment, state RenderState, glVersion OpenGLVersion, tweak bool, userUniforms *UserUniforms, reuse reusablePasses, configure func(s *Shader)) (*loadedEnvironment, error) {
+	if err := env.Setup(state); err != nil {
+		return nil, fmt.Errorf("error setting up environment: %w", err)
+	}
+	le := &loadedEnvironment{
+		env:          env,
+		subTargets:   map[string]*Shader{},
+		subInputs:    map[string][]string{},
+		fingerprints: map[string]string{},
+		reused:       map[string]bool{},
+	}
+	if err := le.link(glVersion, tweak, state.Defines, userUniforms, reuse, configure); err != nil {
+		le.Close()
+		return nil, err
+	}
+	return le, nil
+}
+
+func (le *loadedEnvironment) link(glVersion OpenGLVersion, tweak bool, defines map[string]string, userUniforms *UserUniforms, reuse reusablePasses, configure func(s *Shader)) error {
+	subEnvs, err := le.env.SubEnvironments()
+	if err != nil {
+		return err
+	}
+	le.subOrder = subTargetOrder(subEnvs)
+	for _, name := range le.subOrder {
+		env := subEnvs[name]
+		for _, input := range env.Inputs {
+			if _, ok := subEnvs[input]; !ok {
+				return fmt.Errorf("buffer %q reads %q, which is not a buffer of the same shader", name, input)
+			}
+		}
+		le.subInputs[name] = env.Inputs
+		if le.fingerprints[name], err = passFingerprint(env); err != nil {
+			return err
+		}
+		if p, ok := reuse[name]; ok && p.fingerprint == le.fingerprints[name] {
+			// The pass is unchanged, so its program and its previous
+			// frames, like the state of a simulation, are kept.
+			le.subTargets[name] = p.shader
+			le.reused[name] = true
+			continue
+		}
+		s, err := newShaderInContext(env.Width, env.Height, glVersion, env.Format)
+		if err != nil {
+			return err
+		}
+		configure(s)
+		s.SetEnvironment(env.Environment)
+		le.subTargets[name] = s
+		if p, ok := reuse[name]; ok {
+			// The program of the pass changed, but the state of a
+			// simulation is kept.
+			if err := s.inheritFrame(p.shader); err != nil {
+				return err
+			}
+		}
+		if err := s.reloadEnvironment(context.Background()); err != nil {
+			return err
+		}
+	}
+
+	sources, err := le.env.Sources()
+	if err != nil {
+		return err
+	}
+	for stage, ss := range sources {
+		if err := checkSourceRequirements(stage, ss); err != nil {
+			return err
+		}
+		if sources[stage], err = dedupeFunctions(ss); err != nil {
+			return err
+		}
+	}
+	if tweak {
+		if sources, le.tweaks, err = liftSourceTweaks(sources); err != nil {
+			return err
+		}
+	}
+	// The pragmas are replaced after the tweaks are lifted, which compares
+	// the sources to the files they are read from.
+	sources, declared, err := liftUserUniforms(sources)
+	if err != nil {
+		return err
+	}
+	le.userUniforms = newUserUniformSet(userUniforms, declared)
+	if le.defines, err = activeDefines(sources, defines); err != nil {
+		return err
+	}
+	for stage, ss := range sources {
+		if sources[stage], err = injectDefines(ss, le.defines); err != nil {
+			return err
+		}
+	}
+	le.program, err = linkProgram(sources)
+	if err != nil {
+		return err
+	}
+	gl.UseProgram(le.program)
+	le.tweaks.locate(le.program)
+	le.userUniforms.locate(le.program)
+	le.uniforms = ListUniforms(le.program)
+	le.vertLoc = uint32(gl.GetAttribLocation(le.program, gl.Str("vert\x00")))
+	return nil
+}
+
+// subTargetOrder returns the names of the sub environments in the order they
+// are rendered in.
+func subTargetOrder(envs map[string]SubEnvironment) []string {
+	names := make([]string, 0, len(envs))
+	for name := range envs {
+		names = append(names, name)
+	}
+	sort.Slice(names, func(i, j int) bool {
+		a, b := envs[names[i]], envs[names[j]]
+		if a.Order != b.Order {
+			return a.Order < b.Order
+		}
+		return names[i] < names[j]
+	})
+	return names
+}
+
+// inputTextures returns the textures of the inputs of a sub target. rendered
+// holds the textures of the sub targets that were rendered this frame, the
+// other inputs provide their previous frame, or 0 if they have none yet.
+func inputTextures(targets map[string]*Shader, inputs []string, rendered map[string]uint32) (map[string]uint32, func()) {
+	textures := map[string]uint32{}
+	var frees []func()
+	for _, name := range inputs {
+		if tex, ok := rendered[name]; ok {
+			textures[name] = tex
+			continue
+		}
+		if s := targets[name]; s.prevFrameHandle != nil {
+			tex, free := s.renderer.Texture(s.prevFrameHandle)
+			textures[name] = tex
+			frees = append(frees, free)
+		} else {
+			textures[name] = s.initialFrame
+		}
+	}
+	return textures, func() {
+		for _, free := range frees {
+			free()
+		}
+	}
+}
+
+func (le *loadedEnvironment) Close() error {
+	for name, s := range le.subTargets {
+		if !le.reused[name] {
+			s.Close()
+		}
+	}
+	if le.program != 0 {
+		gl.DeleteProgram(le.program)
+	}
+	return le.env.Close()
+}
+
+// canary renders a single small frame off-screen and checks that the result
+// looks like an image. The quad of vao and vbo is drawn and the framebuffer
+// binding and viewport are restored afterwards.
+//
+// Sub environments render one frame ahead as a side effect, which is not
+// noticeable for the freshly loaded environments this is used for. Passes that
+// are taken over from the current environment advance by a frame.
+func (le *loadedEnvironment) canary(state RenderState, vao, vbo uint32) error {
+	var prevFBO int32
+	var prevViewport [4]int32
+	gl.GetIntegerv(gl.FRAMEBUFFER_BINDING, &prevFBO)
+	gl.GetIntegerv(gl.VIEWPORT, &prevViewport[0])
+	defer func() {
+		gl.BindFramebuffer(gl.FRAMEBUFFER, uint32(prevFBO))
+		gl.Viewport(prevViewport[0], prevViewport[1], prevViewport[2], prevViewport[3])
+	}()
+
+	subTextures := map[string]uint32{}
+	for _, name := range le.subOrder {
+		s := le.subTargets[name]
+		inputs, freeInputs := inputTextures(le.subTargets, le.subInputs[name], subTextures)
+		s.inputs = inputs
+		h := s.nextHandle(state.Interval)
+		s.inputs = nil
+		freeInputs()
+		if h == nil {
+			return fmt.Errorf("could not render buffer %q", name)
+		}
+		tex, free := s.renderer.Texture(h)
+		defer free()
+		subTextures[name] = tex
+	}
+
+	// A float target is used if possible, so NaN values survive to be
+	// detected. Otherwise they usually end up as black.
+	format := PixelFormatRGBA8
+	if supportsFloatTargets(contextInfo()) {
+		format = PixelFormatRGBA32F
+	}
+	var fbo, tex uint32
+	gl.GenFramebuffers(1, &fbo)
+	defer gl.DeleteFramebuffers(1, &fbo)
+	gl.BindFramebuffer(gl.FRAMEBUFFER, fbo)
+	gl.GenTextures(1, &tex)
+	defer gl.DeleteTextures(1, &tex)
+	gl.BindTexture(gl.TEXTURE_2D, tex)
+	gl.TexImage2D(gl.TEXTURE_2D, 0, format.internalFormat(), canaryWidth, canaryHeight, 0, gl.RGBA, format.transferType(), nil)
+	gl.TexParameteri(gl.TEXTURE_2D, gl.TEXTURE_MAG_FILTER, gl.NEAREST)
+	gl.TexParameteri(gl.TEXTURE_2D, gl.TEXTURE_MIN_FILTER, gl.NEAREST)
+	gl.FramebufferTexture2D(gl.FRAMEBUFFER, gl.COLOR_ATTACHMENT0, gl.TEXTURE_2D, tex, 0)
+	gl.BindTexture(gl.TEXTURE_2D, 0)
+	if status := gl.CheckFramebufferStatus(gl.FRAMEBUFFER); status != gl.FRAMEBUFFER_COMPLETE {
+		return fmt.Errorf("incomplete canary framebuffer")
+	}
+	gl.Viewport(0, 0, canaryWidth, canaryHeight)
+	gl.Clear(gl.COLOR_BUFFER_BIT)
+
+	gl.BindVertexArray(vao)
+	gl.BindBuffer(gl.ARRAY_BUFFER, vbo)
+	gl.UseProgram(le.program)
+	gl.EnableVertexAttribArray(le.vertLoc)
+	gl.VertexAttribPointer(le.vertLoc, 3, gl.FLOAT, false, 0, nil)
+	state.CanvasWidth, state.CanvasHeight = canaryWidth, canaryHeight
+	state.Program = le.program
+	state.Uniforms = le.uniforms
+	state.Defines = le.defines
+	state.PreviousFrameTexID = func() uint32 { return 0 }
+	state.SubBuffers = subTextures
+	le.env.PreRender(state)
+	le.tweaks.apply()
+	le.userUniforms.apply()
+	gl.DrawArrays(gl.TRIANGLE_STRIP, 0, 4)
+
+	pix := make([]float32, canaryWidth*canaryHeight*4)
+	gl.ReadPixels(0, 0, canaryWidth, canaryHeight, gl.RGBA, gl.FLOAT, gl.Ptr(&pix[0]))
+	return checkCanaryFrame(pix)
+}
+
+// checkCanaryFrame rejects RGBA frames that contain NaN or infinite values,
+// or of which every pixel is black.
+func checkCanaryFrame(pix []float32) error {
+	black := true
+	for i := 0; i+3 < len(pix); i += 4 {
+		for _, v := range pix[i : i+4] {
+			if math.IsNaN(float64(v)) || math.IsInf(float64(v), 0) {
+				return fmt.Errorf("the shader renders NaN or infinite values")
+			}
+		}
+		if pix[i] > 0.5/255 || pix[i+1] > 0.5/255 || pix[i+2] > 0.5/255 {
+			black = false
+		}
+	}
+	if black {
+		return fmt.Errorf("the shader renders a black frame")
+	}
+	return nil
+}
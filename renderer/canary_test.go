@@ -0,0 +1,52 @@
+package renderer
+
+import (
+	"fmt"
+	"math"
+	"testing"
+)
+
+func TestCheckCanaryFrame(t *testing.T) {
+	frame := func(r, g, b, a float32) []float32 {
+		pix := make([]float32, 4*4)
+		for i := 0; i < len(pix); i += 4 {
+			pix[i], pix[i+1], pix[i+2], pix[i+3] = 0, 0, 0, 1
+		}
+		pix[8], pix[9], pix[10], pix[11] = r, g, b, a
+		return pix
+	}
+	nan := float32(math.NaN())
+	inf := float32(math.Inf(1))
+	tests := []struct {
+		pix []float32
+		ok  bool
+	}{
+		{frame(0.5, 0, 0, 1), true},
+		{frame(0, 0, 0.01, 0), true},
+		{frame(0, 0, 0, 1), false},
+		{frame(1, 1, 1, 0), true},
+		{frame(nan, 1, 1, 1), false},
+		{frame(1, 1, 1, nan), false},
+		{frame(inf, 1, 1, 1), false},
+	}
+	for i, test := range tests {
+		if err := checkCanaryFrame(test.pix); (err == nil) != test.ok {
+			t.Errorf("%d: unexpected result %v", i, err)
+		}
+	}
+}
+
+func TestSubTargetOrder(t *testing.T) {
+	envs := map[string]SubEnvironment{
+		"thing": {},
+		"BufC":  {Order: 2},
+		"BufA":  {Order: 0},
+		"BufB":  {Order: 1},
+		"aux":   {},
+	}
+	order := subTargetOrder(envs)
+	expected := []string{"BufA", "aux", "thing", "BufB", "BufC"}
+	if fmt.Sprint(order) != fmt.Sprint(expected) {
+		t.Errorf("order = %v, expected %v", order, expected)
+	}
+}
@@ -0,0 +1,137 @@
+package renderer
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"sync"
+	"time"
+)
+
+var clockNameRe = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// Clocks is a set of named time bases that run alongside the animation time.
+// Every clock is exposed to shaders as a float uniform with its name, in
+// seconds. Clocks can be reset, paused and sped up individually, so for
+// example a clock for the current scene can start at 0 for every shader while
+// the animation time keeps running.
+//
+// Clocks are defined relative to the animation time, so all shaders that are
+// rendered for the same frame see the same values. It is safe for concurrent
+// use, changes take effect at the next frame.
+type Clocks struct {
+	lock sync.Mutex
+	// now is the animation time of the most recent frame, changes are
+	// anchored to it.
+	now    time.Duration
+	clocks map[string]*clock
+}
+
+type clock struct {
+	// base is the value of the clock at the animation time anchor.
+	base   time.Duration
+	anchor time.Duration
+	rate   float64
+	paused bool
+}
+
+func (c *clock) at(t time.Duration) time.Duration {
+	if c.paused {
+		return c.base
+	}
+	return c.base + time.Duration(c.rate*float64(t-c.anchor))
+}
+
+// rebase moves the anchor of the clock to t without changing its value.
+func (c *clock) rebase(t time.Duration) {
+	c.base, c.anchor = c.at(t), t
+}
+
+// Add adds a clock that starts at 0 and runs at the speed of the animation.
+func (cs *Clocks) Add(name string) error {
+	if !clockNameRe.MatchString(name) {
+		return fmt.Errorf("invalid clock name %q, clocks must be named like GLSL identifiers", name)
+	}
+	cs.lock.Lock()
+	defer cs.lock.Unlock()
+	if cs.clocks == nil {
+		cs.clocks = map[string]*clock{}
+	}
+	if _, ok := cs.clocks[name]; ok {
+		return fmt.Errorf("duplicate clock %q", name)
+	}
+	cs.clocks[name] = &clock{anchor: cs.now, rate: 1}
+	return nil
+}
+
+// Names returns the names of all clocks in alphabetical order.
+func (cs *Clocks) Names() []string {
+	cs.lock.Lock()
+	defer cs.lock.Unlock()
+	names := make([]string, 0, len(cs.clocks))
+	for name := range cs.clocks {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Get returns the current value of a clock.
+func (cs *Clocks) Get(name string) (time.Duration, error) {
+	var t time.Duration
+	err := cs.update(name, func(c *clock) {
+		t = c.at(cs.now)
+	})
+	return t, err
+}
+
+// Set sets the value of a clock.
+func (cs *Clocks) Set(name string, t time.Duration) error {
+	return cs.update(name, func(c *clock) {
+		c.base, c.anchor = t, cs.now
+	})
+}
+
+// SetRate sets the speed of a clock relative to the animation, 1 is the same
+// speed and negative values run the clock backwards.
+func (cs *Clocks) SetRate(name string, rate float64) error {
+	return cs.update(name, func(c *clock) {
+		c.rebase(cs.now)
+		c.rate = rate
+	})
+}
+
+// SetPaused stops or resumes a clock.
+func (cs *Clocks) SetPaused(name string, paused bool) error {
+	return cs.update(name, func(c *clock) {
+		c.rebase(cs.now)
+		c.paused = paused
+	})
+}
+
+func (cs *Clocks) update(name string, fn func(c *clock)) error {
+	cs.lock.Lock()
+	defer cs.lock.Unlock()
+	c, ok := cs.clocks[name]
+	if !ok {
+		return fmt.Errorf("no such clock %q", name)
+	}
+	fn(c)
+	return nil
+}
+
+// at returns the values of all clocks at the animation time t. Clocks that
+// are changed later are anchored to t.
+func (cs *Clocks) at(t time.Duration) map[string]time.Duration {
+	if cs == nil {
+		return nil
+	}
+	cs.lock.Lock()
+	defer cs.lock.Unlock()
+	cs.now = t
+	values := make(map[string]time.Duration, len(cs.clocks))
+	for name, c := range cs.clocks {
+		values[name] = c.at(t)
+	}
+	return values
+}
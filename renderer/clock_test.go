@@ -0,0 +1,46 @@
+package renderer
+
+import (
+	"testing"
+	"time"
+)
+
+func TestClocks(t *testing.T) {
+	var clocks Clocks
+	if err := clocks.Add("scene"); err != nil {
+		t.Fatal(err)
+	}
+	if err := clocks.Add("scene"); err == nil {
+		t.Errorf("expected an error for a duplicate clock")
+	}
+	if err := clocks.Add("1x"); err == nil {
+		t.Errorf("expected an error for an invalid name")
+	}
+
+	expect := func(now time.Duration, expected time.Duration) {
+		t.Helper()
+		if v := clocks.at(now)["scene"]; v != expected {
+			t.Errorf("at %v: expected %v, got %v", now, expected, v)
+		}
+	}
+	expect(2*time.Second, 2*time.Second)
+	clocks.Set("scene", 0)
+	expect(3*time.Second, time.Second)
+	clocks.SetPaused("scene", true)
+	expect(10*time.Second, time.Second)
+	clocks.SetPaused("scene", false)
+	expect(11*time.Second, 2*time.Second)
+	clocks.SetRate("scene", 0.5)
+	expect(13*time.Second, 3*time.Second)
+	if v, err := clocks.Get("scene"); err != nil || v != 3*time.Second {
+		t.Errorf("unexpected value %v, %v", v, err)
+	}
+
+	if err := clocks.Set("missing", 0); err == nil {
+		t.Errorf("expected an error for a missing clock")
+	}
+	var none *Clocks
+	if v := none.at(time.Second); v != nil {
+		t.Errorf("expected no clocks, got %v", v)
+	}
+}
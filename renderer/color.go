@@ -0,0 +1,109 @@
+package renderer
+
+import (
+	"fmt"
+	"math"
+
+	"github.com/go-gl/gl/v3.3-core/gl"
+)
+
+// colorCurveSize is the number of entries of the lookup table the curves of a
+// color calibration are sampled into on the GPU.
+const colorCurveSize = 1024
+
+// ColorCalibration corrects the colors of an output, so LED panels or
+// projectors with different responses look the same. Colors are first
+// transformed by the matrix and then mapped through the curves.
+type ColorCalibration struct {
+	// Matrix transforms the RGB color as a column vector. Rows are in the
+	// order red, green, blue. If zero, colors are not transformed.
+	Matrix [3][3]float64
+	// Curves map the red, green and blue channels. The values are the
+	// outputs for inputs spaced evenly over the 0-1 range, so a curve must
+	// have at least 2 values. Channels without a curve are not mapped.
+	Curves [3][]float64
+}
+
+func (c ColorCalibration) Validate() error {
+	for _, row := range c.Matrix {
+		for _, v := range row {
+			if math.IsNaN(v) || math.IsInf(v, 0) {
+				return fmt.Errorf("invalid color matrix %v", c.Matrix)
+			}
+		}
+	}
+	for i, curve := range c.Curves {
+		if curve == nil {
+			continue
+		}
+		if len(curve) < 2 {
+			return fmt.Errorf("the %s color curve requires at least 2 values, got %d", colorChannels[i], len(curve))
+		}
+		for _, v := range curve {
+			if v < 0 || v > 1 || math.IsNaN(v) {
+				return fmt.Errorf("the values of the %s color curve must be between 0 and 1, got %v", colorChannels[i], v)
+			}
+		}
+	}
+	return nil
+}
+
+var colorChannels = [3]string{"red", "green", "blue"}
+
+// matrix returns the color matrix in column-major order, as expected by
+// OpenGL.
+func (c ColorCalibration) matrix() [9]float32 {
+	m := c.Matrix
+	if m == [3][3]float64{} {
+		m = [3][3]float64{{1, 0, 0}, {0, 1, 0}, {0, 0, 1}}
+	}
+	var out [9]float32
+	for row := range m {
+		for col := range m[row] {
+			out[col*3+row] = float32(m[row][col])
+		}
+	}
+	return out
+}
+
+// curve returns the output of the curve of a channel for the input by
+// interpolating linearly between the values.
+func (c ColorCalibration) curve(channel int, x float64) float64 {
+	values := c.Curves[channel]
+	if values == nil {
+		return x
+	}
+	x = math.Max(0, math.Min(1, x)) * float64(len(values)-1)
+	i := int(x)
+	if i >= len(values)-1 {
+		return values[len(values)-1]
+	}
+	return values[i] + (values[i+1]-values[i])*(x-float64(i))
+}
+
+// lut returns the curves sampled into an RGB lookup table of the specified
+// size.
+func (c ColorCalibration) lut(size int) []float32 {
+	lut := make([]float32, 0, size*3)
+	for i := 0; i < size; i++ {
+		x := float64(i) / float64(size-1)
+		for channel := range c.Curves {
+			lut = append(lut, float32(c.curve(channel, x)))
+		}
+	}
+	return lut
+}
+
+// newColorCurveTexture uploads the curves of the calibration to a 1D texture.
+func newColorCurveTexture(c ColorCalibration) uint32 {
+	lut := c.lut(colorCurveSize)
+	var tex uint32
+	gl.GenTextures(1, &tex)
+	gl.BindTexture(gl.TEXTURE_1D, tex)
+	gl.TexParameteri(gl.TEXTURE_1D, gl.TEXTURE_MAG_FILTER, gl.LINEAR)
+	gl.TexParameteri(gl.TEXTURE_1D, gl.TEXTURE_MIN_FILTER, gl.LINEAR)
+	gl.TexParameteri(gl.TEXTURE_1D, gl.TEXTURE_WRAP_S, gl.CLAMP_TO_EDGE)
+	gl.TexImage1D(gl.TEXTURE_1D, 0, gl.RGB32F, colorCurveSize, 0, gl.RGB, gl.FLOAT, gl.Ptr(&lut[0]))
+	gl.BindTexture(gl.TEXTURE_1D, 0)
+	return tex
+}
@@ -0,0 +1,58 @@
+package renderer
+
+import (
+	"math"
+	"testing"
+)
+
+func TestColorCalibration(t *testing.T) {
+	var identity ColorCalibration
+	if m := identity.matrix(); m != [9]float32{1, 0, 0, 0, 1, 0, 0, 0, 1} {
+		t.Errorf("unexpected identity matrix: %v", m)
+	}
+	lut := identity.lut(5)
+	for i := 0; i < 5; i++ {
+		for channel := 0; channel < 3; channel++ {
+			if v := lut[i*3+channel]; math.Abs(float64(v)-float64(i)/4) > 1e-6 {
+				t.Errorf("identity curve %d at %d is %v", channel, i, v)
+			}
+		}
+	}
+
+	c := ColorCalibration{
+		Matrix: [3][3]float64{{0.9, 0.1, 0}, {0, 1, 0}, {0, 0, 0.8}},
+		Curves: [3][]float64{nil, {0, 0.25, 1}, {1, 0}},
+	}
+	if err := c.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	// OpenGL expects the matrix in column-major order.
+	if m := c.matrix(); m[3] != 0.1 || m[1] != 0 || m[8] != 0.8 {
+		t.Errorf("unexpected matrix: %v", m)
+	}
+	for _, tt := range []struct {
+		channel int
+		in, out float64
+	}{
+		{0, 0.3, 0.3},
+		{1, 0.25, 0.125},
+		{1, 0.75, 0.625},
+		{1, 2, 1},
+		{2, 0.25, 0.75},
+		{2, -1, 1},
+	} {
+		if out := c.curve(tt.channel, tt.in); math.Abs(out-tt.out) > 1e-9 {
+			t.Errorf("curve %d maps %v to %v, expected %v", tt.channel, tt.in, out, tt.out)
+		}
+	}
+
+	for _, invalid := range []ColorCalibration{
+		{Curves: [3][]float64{{0.5}}},
+		{Curves: [3][]float64{nil, {0, 1.5}}},
+		{Matrix: [3][3]float64{{math.NaN()}}},
+	} {
+		if err := invalid.Validate(); err == nil {
+			t.Errorf("expected an error for %+v", invalid)
+		}
+	}
+}
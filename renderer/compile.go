@@ -4,6 +4,8 @@ import (
 	"bytes"
 	"fmt"
 	"io"
+	"os"
+	"path/filepath"
 	"regexp"
 	"strconv"
 	"strings"
@@ -18,6 +20,7 @@ func compileShader(stage Stage, sources ...Source) (uint32, error) {
 	}
 
 	originalSources := make([]string, len(sources))
+	names := make([]string, len(sources))
 	src := ""
 	for i, s := range sources {
 		c, err := s.Contents()
@@ -25,6 +28,17 @@ func compileShader(stage Stage, sources ...Source) (uint32, error) {
 			return 0, err
 		}
 		originalSources[i] = string(c)
+		if orig := OriginSource(s); orig != s {
+			// Errors show the source as it was written. Its line numbers
+			// are the same.
+			s = orig
+			if c, err := s.Contents(); err == nil {
+				originalSources[i] = string(c)
+			}
+		}
+		if f, ok := s.(SourceFile); ok {
+			names[i] = f.Filename
+		}
 		if i != 0 {
 			src += fmt.Sprintf("#line 1 %d\n", i)
 		}
@@ -48,6 +62,7 @@ func compileShader(stage Stage, sources ...Source) (uint32, error) {
 		gl.DeleteShader(shader)
 		return 0, CompileError{
 			sources: originalSources,
+			names:   names,
 			stage:   stage,
 			log:     log,
 		}
@@ -104,8 +119,14 @@ func linkProgram(sources map[Stage][]Source) (uint32, error) {
 	return program, nil
 }
 
+// CompileError is the error of a shader stage that failed to compile. The
+// messages of the log of the driver are reported at the files and lines of
+// the sources they refer to.
 type CompileError struct {
 	sources []string
+	// names holds the filenames of the sources, or an empty string for
+	// sources that are not files.
+	names []string
 
 	stage Stage
 	log   string
@@ -129,6 +150,10 @@ func (err CompileError) PrettyPrint(out io.Writer) {
 	}
 
 	for _, marker := range markers {
+		fmt.Fprintf(out, "%s:%d: %s\n", err.sourceName(marker.fileno), marker.lineno, marker.message)
+		if marker.fileno < 0 || marker.fileno >= len(err.sources) {
+			continue
+		}
 		lines := strings.Split(err.sources[marker.fileno], "\n")
 		for i := marker.lineno - 2; i < marker.lineno+2; i++ {
 			if 0 <= i && i < len(lines) {
@@ -141,21 +166,77 @@ func (err CompileError) PrettyPrint(out io.Writer) {
 	}
 }
 
-func (err CompileError) markers() []errorMarker {
-	errLineRe := regexp.MustCompile(`(?m)^(\d+):(\d+)\((\d+)\): (.+)$`)
+// sourceName returns the name of the source with the index to report errors
+// at. Files in the working directory are named relative to it.
+func (err CompileError) sourceName(fileno int) string {
+	if fileno < 0 || fileno >= len(err.names) || err.names[fileno] == "" {
+		return fmt.Sprintf("<source %d>", fileno)
+	}
+	return relativeName(err.names[fileno])
+}
+
+// relativeName names files in the working directory relative to it.
+func relativeName(filename string) string {
+	if wd, err := os.Getwd(); err == nil {
+		if rel, err := filepath.Rel(wd, filename); err == nil && !strings.HasPrefix(rel, "..") {
+			return rel
+		}
+	}
+	return filename
+}
 
+// Diagnostic is a message of the compiler about a line of a source.
+type Diagnostic struct {
+	// File is the name of the source file, or empty if the source is not a
+	// file.
+	File    string
+	Line    int
+	Message string
+}
+
+// Diagnostics returns the messages of the compiler at their locations, or nil
+// if the log of the driver could not be parsed.
+func (err CompileError) Diagnostics() []Diagnostic {
+	var diags []Diagnostic
+	for _, m := range err.markers() {
+		d := Diagnostic{Line: m.lineno, Message: m.message}
+		if 0 <= m.fileno && m.fileno < len(err.names) {
+			d.File = err.names[m.fileno]
+		}
+		diags = append(diags, d)
+	}
+	return diags
+}
+
+// The formats in which drivers report the source index and line of errors.
+var errLineRes = []*regexp.Regexp{
+	// Mesa: 0:12(5): error: ...
+	regexp.MustCompile(`(?m)^(\d+):(\d+)\(\d+\): (.+)$`),
+	// NVIDIA: 0(12) : error C0000: ...
+	regexp.MustCompile(`(?m)^(\d+)\((\d+)\) : (.+)$`),
+	// AMD, Apple and ANGLE: ERROR: 0:12: ...
+	regexp.MustCompile(`(?m)^((?:ERROR|WARNING): )(\d+):(\d+): (.+)$`),
+}
+
+func (err CompileError) markers() []errorMarker {
 	var markers []errorMarker
-	matches := errLineRe.FindAllStringSubmatch(err.log, -1)
-	for _, m := range matches {
-		fileno, _ := strconv.Atoi(m[1])
-		lineno, _ := strconv.Atoi(m[2])
-		message := m[4]
-
-		markers = append(markers, errorMarker{
-			fileno:  fileno,
-			lineno:  lineno,
-			message: message,
-		})
+	for _, re := range errLineRes {
+		for _, m := range re.FindAllStringSubmatch(err.log, -1) {
+			if len(m) == 5 {
+				// The severity is part of the message.
+				m = []string{m[0], m[2], m[3], strings.ToLower(strings.TrimSuffix(m[1], ": ")) + ": " + m[4]}
+			}
+			fileno, _ := strconv.Atoi(m[1])
+			lineno, _ := strconv.Atoi(m[2])
+			markers = append(markers, errorMarker{
+				fileno:  fileno,
+				lineno:  lineno,
+				message: strings.TrimSpace(m[3]),
+			})
+		}
+		if len(markers) > 0 {
+			break
+		}
 	}
 	return markers
 }
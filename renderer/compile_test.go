@@ -1,6 +1,8 @@
 package renderer
 
 import (
+	"bytes"
+	"strings"
 	"testing"
 )
 
@@ -58,3 +60,36 @@ void main() {
 		t.Fatalf("Unexpected lineno")
 	}
 }
+
+func TestMarkerFormats(t *testing.T) {
+	logs := map[string]string{
+		"mesa":   "0:12(5): error: `foo' undeclared\n",
+		"nvidia": "1(12) : error C1008: undefined variable \"foo\"\n",
+		"amd":    "ERROR: 1:12: 'foo' : undeclared identifier\nERROR: 1 compilation errors.  No code generated.\n",
+	}
+	for driver, log := range logs {
+		m := CompileError{log: log}.markers()
+		if len(m) != 1 {
+			t.Errorf("%s: got %d markers, expected 1", driver, len(m))
+			continue
+		}
+		if m[0].lineno != 12 {
+			t.Errorf("%s: unexpected lineno %d", driver, m[0].lineno)
+		}
+	}
+}
+
+func TestErrorLocation(t *testing.T) {
+	err := CompileError{
+		sources: []string{"#version 330", "\n\nvoid main() {\n\tfoo;\n}"},
+		names:   []string{"", "shaders/main.glsl"},
+		log:     "0:1(1): warning: bar\n1:4(2): error: `foo' undeclared\n",
+	}
+	var buf bytes.Buffer
+	err.PrettyPrint(&buf)
+	for _, expected := range []string{"<source 0>:1: warning: bar\n", "shaders/main.glsl:4: error: `foo' undeclared\n", "0004: \tfoo;\n"} {
+		if !strings.Contains(buf.String(), expected) {
+			t.Errorf("%q is not reported in:\n%s", expected, buf.String())
+		}
+	}
+}
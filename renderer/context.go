@@ -0,0 +1,144 @@
+package renderer
+
+import (
+	"context"
+	"fmt"
+	"image"
+	"time"
+)
+
+// ContextOptions configure a Context.
+type ContextOptions struct {
+	// Width and Height are the size of the frames that are rendered.
+	Width, Height uint
+	// GLVersion is the version of the off-screen context that is created.
+	GLVersion OpenGLVersion
+	// Current renders with the context that is current on the calling
+	// thread instead of creating one, like NewShaderInCurrentContext.
+	Current bool
+}
+
+// Context renders many programs with a single OpenGL context, for
+// applications that embed shady to render shaders on demand, like a service
+// that renders thumbnails. Programs are compiled once and can be rendered in
+// any order, so switching between them does not set up anything again.
+//
+// A Context and its programs must only be used from the thread that owns the
+// OpenGL context, see runtime.LockOSThread.
+type Context struct {
+	opts ContextOptions
+	// programs are the compiled programs by the fingerprint of their sources.
+	programs map[string]*Program
+}
+
+// NewContext creates the OpenGL context, or uses the current one if
+// opts.Current is set.
+func NewContext(opts ContextOptions) (*Context, error) {
+	if err := checkRenderTarget(opts.Width, opts.Height, PixelFormatRGBA8); err != nil {
+		return nil, err
+	}
+	var err error
+	if opts.Current {
+		err = initCurrentGL()
+	} else {
+		err = initOffScreenGL(opts.GLVersion)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &Context{opts: opts, programs: map[string]*Program{}}, nil
+}
+
+// Compile sets up the environment and compiles its program. If a program of
+// an environment with the same sources was compiled before and is not closed,
+// that program is returned instead and env is closed. Mappings that are not
+// part of the sources are not compared, so environments that only differ in
+// those should be compiled by separate contexts.
+func (c *Context) Compile(env Environment) (*Program, error) {
+	key, err := passFingerprint(SubEnvironment{Environment: env})
+	if err != nil {
+		return nil, err
+	}
+	if p, ok := c.programs[key]; ok {
+		if err := env.Close(); err != nil {
+			return nil, err
+		}
+		return p, nil
+	}
+	sh, err := newShaderInContext(c.opts.Width, c.opts.Height, c.opts.GLVersion, PixelFormatRGBA8)
+	if err != nil {
+		return nil, err
+	}
+	sh.SetEnvironment(env)
+	if err := sh.reloadEnvironment(context.Background()); err != nil {
+		sh.Close()
+		return nil, err
+	}
+	p := &Program{ctx: c, key: key, sh: sh}
+	c.programs[key] = p
+	return p, nil
+}
+
+// Close closes all programs that are not closed yet. A created context is
+// kept for later contexts of the process.
+func (c *Context) Close() error {
+	var firstErr error
+	for _, p := range c.programs {
+		if err := p.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// Program is a compiled environment of a Context.
+type Program struct {
+	ctx *Context
+	key string
+	sh  *Shader
+	// prev is the time of the previous frame, if any frame was rendered.
+	prev     time.Duration
+	rendered bool
+}
+
+// RenderFrame renders the frame at time t into buf, which must have the size
+// of the context. The time may jump back and forth, the time since the
+// previous frame is passed to the shader as the interval. Buffers of the
+// program keep their state between frames.
+func (p *Program) RenderFrame(t time.Duration, buf *image.RGBA) error {
+	if buf.Rect.Dx() != int(p.ctx.opts.Width) || buf.Rect.Dy() != int(p.ctx.opts.Height) || buf.Stride != 4*buf.Rect.Dx() {
+		return fmt.Errorf("the buffer must be a %dx%d image without padding, got %v", p.ctx.opts.Width, p.ctx.opts.Height, buf.Rect)
+	}
+	var interval time.Duration
+	if p.rendered {
+		interval = t - p.prev
+	}
+	// The engine renders at its own time, which is moved to t.
+	p.sh.AdvanceTime(t - p.sh.time)
+	handle := p.sh.nextHandle(interval)
+	if handle == nil {
+		return fmt.Errorf("could not render frame")
+	}
+	p.prev, p.rendered = t, true
+	p.sh.health.Frame()
+	pr := p.sh.renderer.(*pboRenderer)
+	pr.wait(handle.(int))
+	pr.readRGBA(handle.(int), buf.Pix)
+	return nil
+}
+
+// Shader returns the engine of the program, to configure things like clocks
+// and user uniforms.
+func (p *Program) Shader() *Shader {
+	return p.sh
+}
+
+// Close frees the program. It is compiled again if the environment is passed
+// to Compile later.
+func (p *Program) Close() error {
+	if p.ctx.programs[p.key] != p {
+		return nil
+	}
+	delete(p.ctx.programs, p.key)
+	return p.sh.Close()
+}
@@ -0,0 +1,71 @@
+package renderer
+
+import (
+	"image"
+	"testing"
+	"time"
+)
+
+func TestContext(t *testing.T) {
+	initTestGL(t)
+
+	ctx, err := NewContext(ContextOptions{Width: 4, Height: 2, Current: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ctx.Close()
+	env := func(color string) Environment {
+		return sourcesEnv{
+			StageVertex: {SourceBuf(`
+				#version 330
+				in vec3 vert;
+				void main() { gl_Position = vec4(vert, 1.0); }
+			`)},
+			StageFragment: {SourceBuf(`
+				#version 330
+				out vec4 color;
+				void main() { color = ` + color + `; }
+			`)},
+		}
+	}
+	red, err := ctx.Compile(env("vec4(1.0, 0.0, 0.0, 1.0)"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cached, err := ctx.Compile(env("vec4(1.0, 0.0, 0.0, 1.0)")); err != nil || cached != red {
+		t.Errorf("the same sources are compiled again: %v", err)
+	}
+	green, err := ctx.Compile(env("vec4(0.0, 1.0, 0.0, 1.0)"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	buf := image.NewRGBA(image.Rect(0, 0, 4, 2))
+	for _, c := range []struct {
+		p     *Program
+		pixel [4]uint8
+	}{
+		{red, [4]uint8{255, 0, 0, 255}},
+		{green, [4]uint8{0, 255, 0, 255}},
+		{red, [4]uint8{255, 0, 0, 255}},
+	} {
+		if err := c.p.RenderFrame(time.Second, buf); err != nil {
+			t.Fatal(err)
+		}
+		var pixel [4]uint8
+		copy(pixel[:], buf.Pix)
+		if pixel != c.pixel {
+			t.Errorf("pixel = %v, expected %v", pixel, c.pixel)
+		}
+	}
+	if err := red.RenderFrame(0, image.NewRGBA(image.Rect(0, 0, 2, 2))); err == nil {
+		t.Errorf("expected an error for a buffer of the wrong size")
+	}
+
+	if err := red.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if p, err := ctx.Compile(env("vec4(1.0, 0.0, 0.0, 1.0)")); err != nil || p == red {
+		t.Errorf("a closed program is returned: %v", err)
+	}
+}
@@ -0,0 +1,113 @@
+package renderer
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+var (
+	optionPragmaRe = regexp.MustCompile(`(?m)^[ \t]*#pragma[ \t]+option[ \t]+(\w+)(?:[ \t]*=[ \t]*(.*?))?[ \t]*$`)
+	defineRe       = regexp.MustCompile(`^(\w+)(?:=(.*))?$`)
+	versionRe      = regexp.MustCompile(`^\s*#version\b`)
+)
+
+// ParseDefine parses the definition of a macro as NAME=VALUE, or NAME to
+// define it as 1.
+func ParseDefine(str string) (name, value string, err error) {
+	match := defineRe.FindStringSubmatch(str)
+	if match == nil {
+		return "", "", fmt.Errorf("invalid definition %q, expected NAME=VALUE or NAME", str)
+	}
+	if !strings.Contains(str, "=") {
+		return match[1], "1", nil
+	}
+	return match[1], match[2], nil
+}
+
+// activeDefines returns the macros that are defined for the sources. Options
+// that are declared with `#pragma option NAME=VALUE` are defined with their
+// default value unless they are overridden. `#pragma option NAME` declares an
+// option that is not defined by default.
+func activeDefines(sources map[Stage][]Source, overrides map[string]string) (map[string]string, error) {
+	defines := map[string]string{}
+	for _, ss := range sources {
+		for _, s := range ss {
+			c, err := s.Contents()
+			if err != nil {
+				return nil, err
+			}
+			for _, m := range optionPragmaRe.FindAllStringSubmatch(string(c), -1) {
+				if strings.Contains(m[0], "=") {
+					defines[m[1]] = m[2]
+				}
+			}
+		}
+	}
+	for name, value := range overrides {
+		defines[name] = value
+	}
+	return defines, nil
+}
+
+// injectDefines defines the macros after the #version directive of the
+// sources of a stage. If none of the sources has one, they are defined at the
+// top of the first source.
+func injectDefines(sources []Source, defines map[string]string) ([]Source, error) {
+	if len(defines) == 0 || len(sources) == 0 {
+		return sources, nil
+	}
+	names := make([]string, 0, len(defines))
+	for name := range defines {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var lines strings.Builder
+	for _, name := range names {
+		fmt.Fprintf(&lines, "#define %s %s\n", name, defines[name])
+	}
+
+	target := 0
+	for i, s := range sources {
+		c, err := s.Contents()
+		if err != nil {
+			return nil, err
+		}
+		if _, ok := versionLine(string(c)); ok {
+			target = i
+			break
+		}
+	}
+	c, err := sources[target].Contents()
+	if err != nil {
+		return nil, err
+	}
+	injected := append([]Source{}, sources...)
+	injected[target] = liftedSource{Source: sources[target], contents: insertAfterVersion(string(c), lines.String())}
+	return injected, nil
+}
+
+// versionLine returns the index of the line of the #version directive of the
+// source.
+func versionLine(src string) (int, bool) {
+	for i, line := range strings.Split(src, "\n") {
+		if versionRe.MatchString(line) {
+			return i, true
+		}
+	}
+	return 0, false
+}
+
+// insertAfterVersion inserts the lines, which end with a newline, after the
+// #version directive of the source, or at the top if it has none. A #line
+// directive follows them, so the line numbers of the source are unchanged.
+func insertAfterVersion(src, lines string) string {
+	at := 0
+	if i, ok := versionLine(src); ok {
+		at = i + 1
+	}
+	ls := strings.Split(src, "\n")
+	inserted := append(append([]string{}, ls[:at]...), fmt.Sprintf("%s#line %d", lines, at+1))
+	return strings.Join(append(inserted, ls[at:]...), "\n")
+}
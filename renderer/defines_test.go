@@ -0,0 +1,61 @@
+package renderer
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseDefine(t *testing.T) {
+	valid := map[string][2]string{
+		"QUALITY=2":           {"QUALITY", "2"},
+		"USE_FOG":             {"USE_FOG", "1"},
+		"EMPTY=":              {"EMPTY", ""},
+		"COLOR=vec3(1, 0, 0)": {"COLOR", "vec3(1, 0, 0)"},
+	}
+	for str, expected := range valid {
+		name, value, err := ParseDefine(str)
+		if err != nil {
+			t.Errorf("%q: %v", str, err)
+			continue
+		}
+		if name != expected[0] || value != expected[1] {
+			t.Errorf("%q: got %q=%q, expected %q=%q", str, name, value, expected[0], expected[1])
+		}
+	}
+	for _, str := range []string{"", "=1", "A B=1"} {
+		if _, _, err := ParseDefine(str); err == nil {
+			t.Errorf("%q: expected an error", str)
+		}
+	}
+}
+
+func TestActiveDefines(t *testing.T) {
+	sources := map[Stage][]Source{
+		StageFragment: {SourceBuf("#pragma option QUALITY=2\n#pragma option USE_FOG\n#pragma option TINT = vec3(1.0)\n")},
+	}
+	defines, err := activeDefines(sources, map[string]string{"QUALITY": "4", "DEBUG": "1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]string{"QUALITY": "4", "TINT": "vec3(1.0)", "DEBUG": "1"}
+	if !reflect.DeepEqual(defines, expected) {
+		t.Errorf("got %v, expected %v", defines, expected)
+	}
+}
+
+func TestInjectDefines(t *testing.T) {
+	header := SourceBuf("\n#version 330\nuniform float iTime;")
+	main := SourceBuf("void main() {}")
+	sources, err := injectDefines([]Source{main, header}, map[string]string{"B": "2", "A": "1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sources[0] != main {
+		t.Errorf("a source without a #version directive was changed")
+	}
+	c, _ := sources[1].Contents()
+	expected := "\n#version 330\n#define A 1\n#define B 2\n#line 3\nuniform float iTime;"
+	if string(c) != expected {
+		t.Errorf("got %q, expected %q", c, expected)
+	}
+}
@@ -57,8 +57,8 @@ type SourceFile struct {
 	Filename string
 }
 
-func SourceFiles(filenames ...string) []SourceFile {
-	sources := make([]SourceFile, len(filenames))
+func SourceFiles(filenames ...string) []Source {
+	sources := make([]Source, len(filenames))
 	for i, f := range filenames {
 		sources[i] = SourceFile{Filename: f}
 	}
@@ -107,23 +107,96 @@ type Environment interface {
 	Close() error
 }
 
+// An IdleEnvironment is an Environment that can tell when the frames it renders
+// stop changing, for example because it renders a still image. The renderer
+// then skips rendering and reuses the previous frame.
+type IdleEnvironment interface {
+	Environment
+	// Idle reports whether the frame of the state would be identical to the
+	// previous one, because none of the inputs of the program changed.
+	Idle(state RenderState) bool
+}
+
+// An OutputEnvironment is an Environment of which the fragment shader writes
+// to textures besides the image, through the outputs at location 1 and up.
+type OutputEnvironment interface {
+	Environment
+	// Outputs returns the textures that the outputs write to in the frame
+	// that PreRender prepared, in the order of their locations. A texture
+	// of 0 leaves the location unused.
+	Outputs() []uint32
+}
+
+// A ResumeEnvironment is an Environment with inputs that may not survive a
+// suspend of the system, like capture devices.
+type ResumeEnvironment interface {
+	Environment
+	// Resume reinitializes the inputs after the system resumed from a
+	// suspend.
+	Resume()
+}
+
 type SubEnvironment struct {
 	Environment
 	Width, Height uint
+	// Format is the storage format of the render target. The zero value is
+	// PixelFormatRGBA8.
+	Format PixelFormat
+	// Order sets the order in which the sub environments of an environment
+	// are rendered every frame, lowest first. Sub environments of the same
+	// order are rendered in the order of their names.
+	Order int
+	// Inputs names the sub environments of the same parent, which may
+	// include this one, of which the output is added to the SubBuffers of
+	// this environment. Inputs that are rendered before it provide the
+	// current frame, the others provide the previous frame.
+	Inputs []string
 }
 
 type RenderState struct {
 	Time            time.Duration
 	Interval        time.Duration
 	FramesProcessed uint64
+	// Sample is the index of the sample of the current frame that is being
+	// rendered when rendering progressively.
+	Sample uint
+	// Seed should be used to seed random sources so that renders can be
+	// varied and reproduced.
+	Seed int64
+	// Date is the date of the current frame. It should be used instead of
+	// the current time so renders can be reproduced.
+	Date time.Time
 
 	CanvasWidth  uint
 	CanvasHeight uint
 
+	// Clocks contains the values of the named clocks set on the engine at
+	// the time of the frame.
+	Clocks map[string]time.Duration
+	// Loop is the duration of the loop that is rendered, or 0 if the
+	// animation does not loop.
+	Loop time.Duration
+
+	// Defines holds the macros that are defined for the variant of the
+	// shader that is rendered, see Shader.SetDefines. During Setup, these are
+	// only the macros that were set explicitly, afterwards they include the
+	// defaults of the options declared by the sources.
+	Defines map[string]string
+
+	// Program is the OpenGL program that is currently being rendered.
+	Program            uint32
 	Uniforms           map[string]Uniform
 	PreviousFrameTexID func() uint32
 
 	// SubBuffers contains the render output for each environment returned by
 	// SubEnvironments as a textureID.
 	SubBuffers map[string]uint32
+
+	// Input is the state of the mouse and keyboard of the window that is
+	// rendered to. It is nil when rendering off-screen.
+	Input *Input
+
+	// Tile is the part of the image that is rendered if the canvas is a
+	// tile of a larger image. It is nil otherwise.
+	Tile *Tile
 }
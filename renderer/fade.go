@@ -0,0 +1,24 @@
+package renderer
+
+import (
+	"time"
+)
+
+// fade is a linear transition of the brightness of the output.
+type fade struct {
+	from, to float64
+	start    time.Time
+	duration time.Duration
+}
+
+// at returns the brightness at the specified time.
+func (f fade) at(t time.Time) float64 {
+	if t.Before(f.start) {
+		return f.from
+	}
+	if f.duration <= 0 || t.Sub(f.start) >= f.duration {
+		return f.to
+	}
+	progress := float64(t.Sub(f.start)) / float64(f.duration)
+	return f.from + (f.to-f.from)*progress
+}
@@ -0,0 +1,29 @@
+package renderer
+
+import (
+	"testing"
+	"time"
+)
+
+func TestFade(t *testing.T) {
+	start := time.Unix(1000, 0)
+	f := fade{from: 1, to: 0, start: start, duration: 2 * time.Second}
+	cases := map[time.Duration]float64{
+		-time.Second:           1,
+		0:                      1,
+		500 * time.Millisecond: 0.75,
+		time.Second:            0.5,
+		2 * time.Second:        0,
+		time.Minute:            0,
+	}
+	for offset, expected := range cases {
+		if b := f.at(start.Add(offset)); b != expected {
+			t.Errorf("%v: got %v, expected %v", offset, b, expected)
+		}
+	}
+
+	instant := fade{from: 0, to: 1, start: start}
+	if b := instant.at(start); b != 1 {
+		t.Errorf("a fade without a duration should be at its end, got %v", b)
+	}
+}
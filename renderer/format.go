@@ -0,0 +1,91 @@
+package renderer
+
+import (
+	"fmt"
+
+	"github.com/go-gl/gl/v3.3-core/gl"
+)
+
+// PixelFormat is the storage format of a render target.
+type PixelFormat int
+
+const (
+	// PixelFormatRGBA8 stores 8-bit normalized values, which is what is
+	// needed for displaying images.
+	PixelFormatRGBA8 PixelFormat = iota
+	// PixelFormatRGBA16F stores half precision floats.
+	PixelFormatRGBA16F
+	// PixelFormatRGBA32F stores single precision floats, which simulations
+	// need to keep their state without loss of precision.
+	PixelFormatRGBA32F
+	// PixelFormatRGB10A2 stores 10-bit normalized colors and a 2-bit alpha,
+	// as needed for 10-bit video.
+	PixelFormatRGB10A2
+)
+
+// ParsePixelFormat parses the name of a format as returned by String.
+func ParsePixelFormat(s string) (PixelFormat, error) {
+	for _, f := range []PixelFormat{PixelFormatRGBA8, PixelFormatRGBA16F, PixelFormatRGBA32F, PixelFormatRGB10A2} {
+		if f.String() == s {
+			return f, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown pixel format %q, valid formats are rgba8, rgba16f, rgba32f and rgb10a2", s)
+}
+
+func (f PixelFormat) String() string {
+	switch f {
+	case PixelFormatRGBA16F:
+		return "rgba16f"
+	case PixelFormatRGBA32F:
+		return "rgba32f"
+	case PixelFormatRGB10A2:
+		return "rgb10a2"
+	default:
+		return "rgba8"
+	}
+}
+
+func (f PixelFormat) internalFormat() int32 {
+	switch f {
+	case PixelFormatRGBA16F:
+		return gl.RGBA16F
+	case PixelFormatRGBA32F:
+		return gl.RGBA32F
+	case PixelFormatRGB10A2:
+		return gl.RGB10_A2
+	default:
+		return gl.RGBA8
+	}
+}
+
+// transferType is the type of the pixel data that is transferred between the
+// render target and pixel buffers. Formats of more than 8 bits per channel are
+// transferred as 32-bit floats.
+func (f PixelFormat) transferType() uint32 {
+	if f == PixelFormatRGBA8 {
+		return gl.UNSIGNED_BYTE
+	}
+	return gl.FLOAT
+}
+
+// bytesPerPixel is the size of a pixel of the transfer type.
+func (f PixelFormat) bytesPerPixel() int {
+	if f == PixelFormatRGBA8 {
+		return 4
+	}
+	return 16
+}
+
+// PixelData is a copy of the raw contents of a render target.
+type PixelData struct {
+	Width, Height uint
+	// Format is the format of the render target the data was copied from.
+	Format PixelFormat
+	// Frame is the number of the frame that was rendered.
+	Frame uint64
+	// Pix holds the 4 channels of every pixel with rows in the same order
+	// as images produced by the renderer. Values of PixelFormatRGBA8 targets
+	// are normalized to the 0-1 range.
+	Pix []float32
+}
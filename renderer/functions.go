@@ -0,0 +1,287 @@
+package renderer
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+var (
+	ppConditionalRe = regexp.MustCompile(`^\s*#\s*(if|ifdef|ifndef|elif|else|endif)\b\s*(\w*)`)
+	ppDefineRe      = regexp.MustCompile(`^\s*#\s*define\s+(\w+)`)
+	ppDirectiveRe   = regexp.MustCompile(`^\s*#`)
+)
+
+// glslFunction is a function definition at the top level of a source.
+type glslFunction struct {
+	name string
+	// signature is the name and the types of the parameters, which identify
+	// overloads.
+	signature string
+	// text is the definition without comments and with whitespace collapsed,
+	// to compare definitions.
+	text       string
+	start, end int
+	line       int
+}
+
+// dedupeFunctions removes the definitions of functions that are defined
+// identically by an earlier source of a stage, like a helper that is copied
+// into two included libraries. The definitions are blanked so the line numbers
+// of errors are unchanged. Definitions with the same signature but a
+// different body are an error that names both sources.
+//
+// Definitions inside of preprocessor conditionals are left alone, as only one
+// of them may be compiled. Include guards are not conditionals in this sense.
+func dedupeFunctions(sources []Source) ([]Source, error) {
+	type definition struct {
+		fn     glslFunction
+		source int
+	}
+	defined := map[string]definition{}
+	var deduped []Source
+	for i, s := range sources {
+		c, err := s.Contents()
+		if err != nil {
+			return nil, err
+		}
+		src := string(c)
+		var remove []glslFunction
+		for _, fn := range topLevelFunctions(src) {
+			prev, ok := defined[fn.signature]
+			if !ok {
+				defined[fn.signature] = definition{fn, i}
+				continue
+			}
+			if prev.source == i {
+				// Left to the compiler.
+				continue
+			}
+			if prev.fn.text == fn.text && (isParameterized(s) || isParameterized(sources[prev.source])) {
+				// The macros may make identical definitions behave
+				// differently.
+				return nil, fmt.Errorf("%s:%d: %s is also defined at %s:%d with other macros, please include one of them with a prefix",
+					sourceLabel(s, i), fn.line, fn.name, sourceLabel(sources[prev.source], prev.source), prev.fn.line)
+			}
+			if prev.fn.text != fn.text {
+				return nil, fmt.Errorf("%s:%d: %s is also defined at %s:%d with a different body, please rename one of them",
+					sourceLabel(s, i), fn.line, fn.name, sourceLabel(sources[prev.source], prev.source), prev.fn.line)
+			}
+			remove = append(remove, fn)
+		}
+		if len(remove) == 0 {
+			deduped = append(deduped, s)
+			continue
+		}
+		b := []byte(src)
+		for _, fn := range remove {
+			blank(b[fn.start:fn.end])
+		}
+		deduped = append(deduped, liftedSource{Source: s, contents: string(b)})
+	}
+	return deduped, nil
+}
+
+// topLevelFunctions returns the function definitions of a source that are not
+// inside of a preprocessor conditional.
+func topLevelFunctions(src string) []glslFunction {
+	code, conditional := glslCode(src)
+	var fns []glslFunction
+	stmtStart := 0
+	for i := 0; i < len(code); i++ {
+		switch code[i] {
+		case ';', '}':
+			stmtStart = i + 1
+		case '{':
+			end := matchingBrace(code, i)
+			if end < 0 {
+				return fns
+			}
+			if fn, ok := parseFunction(code, stmtStart, i, end); ok && !conditional[fn.line-1] {
+				fns = append(fns, fn)
+			}
+			// Blocks like structs continue until the semicolon.
+			i, stmtStart = end-1, end
+		}
+	}
+	return fns
+}
+
+// glslCode returns the source with comments and preprocessor directives
+// replaced by spaces, and whether each line is inside of a conditional.
+func glslCode(src string) ([]byte, []bool) {
+	code := []byte(src)
+	for i := 0; i < len(code); i++ {
+		switch {
+		case code[i] == '/' && i+1 < len(code) && code[i+1] == '/':
+			end := strings.IndexByte(src[i:], '\n')
+			if end < 0 {
+				end = len(src) - i
+			}
+			blank(code[i : i+end])
+			i += end
+		case code[i] == '/' && i+1 < len(code) && code[i+1] == '*':
+			end := strings.Index(src[i+2:], "*/")
+			if end < 0 {
+				end = len(src) - i - 2
+			} else {
+				end += 2
+			}
+			blank(code[i : i+2+end])
+			i += 1 + end
+		}
+	}
+
+	lines := strings.Split(string(code), "\n")
+	conditional := make([]bool, len(lines))
+	// stack holds whether each open conditional is an include guard.
+	var stack []bool
+	inside := func() bool {
+		for _, guard := range stack {
+			if !guard {
+				return true
+			}
+		}
+		return false
+	}
+	offset := 0
+	continued := false
+	for i, line := range lines {
+		conditional[i] = inside()
+		if m := ppConditionalRe.FindStringSubmatch(line); m != nil {
+			switch m[1] {
+			case "if", "ifdef":
+				stack = append(stack, false)
+			case "ifndef":
+				stack = append(stack, isIncludeGuard(lines[i+1:], m[2]))
+			case "elif", "else":
+				if len(stack) > 0 {
+					stack[len(stack)-1] = false
+				}
+			case "endif":
+				if len(stack) > 0 {
+					stack = stack[:len(stack)-1]
+				}
+			}
+		}
+		if continued || ppDirectiveRe.MatchString(line) {
+			blank(code[offset : offset+len(line)])
+			// Macros continue on the next line after a backslash.
+			continued = strings.HasSuffix(strings.TrimRight(line, " \t\r"), "\\")
+		}
+		offset += len(line) + 1
+	}
+	return code, conditional
+}
+
+// isIncludeGuard reports whether the #ifndef of the macro is followed by its
+// #define.
+func isIncludeGuard(after []string, macro string) bool {
+	for _, line := range after {
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		m := ppDefineRe.FindStringSubmatch(line)
+		return m != nil && m[1] == macro
+	}
+	return false
+}
+
+// parseFunction parses the statement from start up to the body that opens at
+// brace, which ends at end, as a function definition.
+func parseFunction(code []byte, start, brace, end int) (glslFunction, bool) {
+	head := strings.TrimSpace(string(code[start:brace]))
+	if !strings.HasSuffix(head, ")") {
+		return glslFunction{}, false
+	}
+	open := strings.LastIndexByte(head, '(')
+	if open < 0 {
+		return glslFunction{}, false
+	}
+	decl := strings.Fields(head[:open])
+	if len(decl) < 2 {
+		// A function has a return type.
+		return glslFunction{}, false
+	}
+	name := decl[len(decl)-1]
+	var types []string
+	for _, param := range strings.Split(head[open+1:len(head)-1], ",") {
+		fields := strings.Fields(param)
+		if len(fields) > 1 {
+			fields = fields[:len(fields)-1]
+		}
+		if t := strings.Join(fields, " "); t != "" && t != "void" {
+			types = append(types, t)
+		}
+	}
+	for start < brace && isSpace(code[start]) {
+		start++
+	}
+	return glslFunction{
+		name:      name,
+		signature: name + "(" + strings.Join(types, ",") + ")",
+		text:      strings.Join(strings.Fields(string(code[start:end])), " "),
+		start:     start,
+		end:       end,
+		line:      strings.Count(string(code[:start]), "\n") + 1,
+	}, true
+}
+
+// matchingBrace returns the offset after the brace that closes the one at
+// open, or -1 if it is not closed.
+func matchingBrace(code []byte, open int) int {
+	depth := 0
+	for i := open; i < len(code); i++ {
+		switch code[i] {
+		case '{':
+			depth++
+		case '}':
+			if depth--; depth == 0 {
+				return i + 1
+			}
+		}
+	}
+	return -1
+}
+
+// blank replaces the characters with spaces, except for newlines.
+func blank(b []byte) {
+	for i, c := range b {
+		if c != '\n' {
+			b[i] = ' '
+		}
+	}
+}
+
+func isSpace(c byte) bool {
+	return c == ' ' || c == '\t' || c == '\n' || c == '\r'
+}
+
+// isParameterized reports whether the source is included with macros.
+func isParameterized(s Source) bool {
+	for {
+		switch t := s.(type) {
+		case ParameterizedSource:
+			return true
+		case PrefixedSource:
+			s = t.Source
+		case liftedSource:
+			s = t.Source
+		default:
+			return false
+		}
+	}
+}
+
+// sourceLabel returns the name of a source to report errors at.
+func sourceLabel(s Source, index int) string {
+	switch s := OriginSource(s).(type) {
+	case SourceFile:
+		return relativeName(s.Filename)
+	case SourceFS:
+		return s.Name
+	case SourceURL:
+		return s.URL
+	}
+	return fmt.Sprintf("<source %d>", index)
+}
@@ -0,0 +1,45 @@
+package renderer
+
+import (
+	"strings"
+	"testing"
+	"testing/fstest"
+)
+
+func TestDedupeFunctions(t *testing.T) {
+	fs := fstest.MapFS{
+		"noise.glsl": {Data: []byte("// Noise.\nfloat hash21(vec2 p) {\n\treturn fract(sin(dot(p, vec2(12.9898, 78.233))) * 43758.5453);\n}\n\nfloat noise(vec2 p) { return hash21(floor(p)); }\n")},
+		"dots.glsl":  {Data: []byte("float hash21(vec2 p)\n{\n\treturn fract(sin(dot(p, vec2(12.9898, 78.233))) * 43758.5453); // Same.\n}\nfloat hash21(vec3 p) { return p.x; }\n")},
+		"other.glsl": {Data: []byte("struct S { float x; };\nfloat hash21(vec2 q) { return q.x; }\n")},
+	}
+	source := func(name string) Source { return SourceFS{FS: fs, Name: name} }
+
+	sources, err := dedupeFunctions([]Source{source("noise.glsl"), source("dots.glsl"), SourceBuf("void main() {}")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, _ := sources[1].Contents()
+	if strings.Contains(string(c), "vec2 p") || !strings.Contains(string(c), "float hash21(vec3 p)") {
+		t.Errorf("the identical definition was not removed, or the overload was:\n%s", c)
+	}
+	if strings.Count(string(c), "\n") != 5 {
+		t.Errorf("the line numbers of the source changed:\n%s", c)
+	}
+	if _, ok := sources[0].(SourceFS); !ok {
+		t.Errorf("the first source was changed")
+	}
+
+	_, err = dedupeFunctions([]Source{source("noise.glsl"), source("other.glsl")})
+	if err == nil || err.Error() != "other.glsl:2: hash21 is also defined at noise.glsl:2 with a different body, please rename one of them" {
+		t.Errorf("unexpected error for a conflict: %v", err)
+	}
+
+	guarded := SourceBuf("#ifndef NOISE\n#define NOISE\nfloat hash21(vec2 p) { return p.y; }\n#endif\n")
+	if _, err := dedupeFunctions([]Source{source("other.glsl"), guarded}); err == nil {
+		t.Errorf("expected an error for a conflict in an include guard")
+	}
+	conditional := SourceBuf("#ifdef FAST\nfloat hash21(vec2 p) { return p.y; }\n#endif\n")
+	if _, err := dedupeFunctions([]Source{source("other.glsl"), conditional}); err != nil {
+		t.Errorf("unexpected error for a definition in a conditional: %v", err)
+	}
+}
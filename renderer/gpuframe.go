@@ -0,0 +1,31 @@
+package renderer
+
+import (
+	"fmt"
+
+	"github.com/polyfloyd/shady/egl"
+)
+
+// GPUFrame is a completed frame that is still in GPU memory, see
+// Shader.SetFrameCallback.
+type GPUFrame struct {
+	// Texture is the name of the GL_TEXTURE_2D holding the frame in the
+	// context of the renderer. Like framebuffers, the first row is at the
+	// bottom.
+	Texture uint32
+	Width   uint
+	Height  uint
+	Format  PixelFormat
+	Frame   uint64
+}
+
+// EGLImage creates an EGLImage sharing the storage of the texture, so the frame
+// can be used in other contexts and APIs. The storage is reused for later
+// frames, so the image may be kept, but it must be destroyed before the Shader
+// is closed. It requires EGL 1.5.
+func (f GPUFrame) EGLImage() (egl.Image, error) {
+	if eglContext == nil {
+		return egl.Image{}, fmt.Errorf("frame was not rendered with EGL")
+	}
+	return eglContext.CreateTextureImage(f.Texture)
+}
@@ -0,0 +1,60 @@
+package renderer
+
+import (
+	"sync"
+	"time"
+)
+
+// Health tracks whether an engine is making progress. It is safe for
+// concurrent use.
+type Health struct {
+	lock              sync.Mutex
+	lastFrame         time.Time
+	frames            uint64
+	consecutiveErrors int
+	lastError         error
+}
+
+// HealthStatus is a snapshot of a Health.
+type HealthStatus struct {
+	// LastFrame is the time at which the most recent frame was rendered. It
+	// is zero if no frame has been rendered yet.
+	LastFrame time.Time
+	// Frames is the total number of frames rendered.
+	Frames uint64
+	// ConsecutiveErrors is the number of errors that occurred since the last
+	// successfully rendered frame.
+	ConsecutiveErrors int
+	// LastError is the most recent error, or nil if a frame was rendered
+	// successfully since.
+	LastError error
+}
+
+// Frame records a successfully rendered frame.
+func (h *Health) Frame() {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	h.lastFrame = time.Now()
+	h.frames++
+	h.consecutiveErrors = 0
+	h.lastError = nil
+}
+
+// Error records an error that prevented a frame from being rendered.
+func (h *Health) Error(err error) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	h.consecutiveErrors++
+	h.lastError = err
+}
+
+func (h *Health) Status() HealthStatus {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	return HealthStatus{
+		LastFrame:         h.lastFrame,
+		Frames:            h.frames,
+		ConsecutiveErrors: h.consecutiveErrors,
+		LastError:         h.lastError,
+	}
+}
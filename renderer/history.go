@@ -0,0 +1,213 @@
+package renderer
+
+import (
+	"log"
+	"time"
+
+	"github.com/go-gl/gl/v3.3-core/gl"
+	"github.com/go-gl/glfw/v3.3/glfw"
+)
+
+// historyRing tracks the slots of a ring of the most recent frames and the
+// frame that is viewed while stepping through them.
+type historyRing struct {
+	size   int
+	count  int
+	latest int
+	// back is the number of frames before the latest that is viewed, if
+	// viewing is set.
+	back    int
+	viewing bool
+}
+
+// push returns the slot of a new latest frame, which replaces the oldest if
+// the ring is full.
+func (r *historyRing) push() int {
+	r.latest = (r.latest + 1) % r.size
+	if r.count < r.size {
+		r.count++
+	}
+	return r.latest
+}
+
+// step moves the viewed frame back, if n is negative, or forward in time.
+// Stepping back from the live frames starts viewing the frame before the
+// latest, stepping forward past the latest frame returns to the live frames.
+func (r *historyRing) step(n int) {
+	if r.count == 0 {
+		return
+	}
+	if !r.viewing {
+		if n >= 0 {
+			return
+		}
+		r.viewing = true
+	}
+	r.back -= n
+	if r.back < 0 {
+		r.live()
+		return
+	}
+	if r.back > r.count-1 {
+		r.back = r.count - 1
+	}
+}
+
+// live stops viewing the history.
+func (r *historyRing) live() {
+	r.viewing, r.back = false, 0
+}
+
+// viewed returns the slot of the frame that is viewed.
+func (r *historyRing) viewed() (int, bool) {
+	if !r.viewing {
+		return 0, false
+	}
+	return (r.latest - r.back + r.size) % r.size, true
+}
+
+// textureCopy is a copy of a rendered texture.
+type textureCopy struct {
+	fbo, tex uint32
+	w, h     int
+	format   PixelFormat
+	memory   *MemoryReservation
+}
+
+// copyFrom copies the texture, which is reallocated if its size or format
+// changed.
+func (tc *textureCopy) copyFrom(src uint32, w, h int, format PixelFormat) error {
+	if tc.tex == 0 || tc.w != w || tc.h != h || tc.format != format {
+		tc.free()
+		mem, err := ReserveMemory("the frame history", int64(w)*int64(h)*int64(format.bytesPerPixel()))
+		if err != nil {
+			return err
+		}
+		*tc = textureCopy{w: w, h: h, format: format, memory: mem}
+		gl.GenTextures(1, &tc.tex)
+		gl.BindTexture(gl.TEXTURE_2D, tc.tex)
+		gl.TexImage2D(gl.TEXTURE_2D, 0, format.internalFormat(), int32(w), int32(h), 0, gl.RGBA, format.transferType(), nil)
+		gl.TexParameteri(gl.TEXTURE_2D, gl.TEXTURE_MAG_FILTER, gl.NEAREST)
+		gl.TexParameteri(gl.TEXTURE_2D, gl.TEXTURE_MIN_FILTER, gl.NEAREST)
+		gl.BindTexture(gl.TEXTURE_2D, 0)
+		gl.GenFramebuffers(1, &tc.fbo)
+		gl.BindFramebuffer(gl.FRAMEBUFFER, tc.fbo)
+		gl.FramebufferTexture2D(gl.FRAMEBUFFER, gl.COLOR_ATTACHMENT0, gl.TEXTURE_2D, tc.tex, 0)
+		gl.BindFramebuffer(gl.FRAMEBUFFER, 0)
+	}
+	copyTexture(tc.tex, src, int32(w), int32(h))
+	return nil
+}
+
+func (tc *textureCopy) free() {
+	if tc.tex == 0 {
+		return
+	}
+	gl.DeleteFramebuffers(1, &tc.fbo)
+	gl.DeleteTextures(1, &tc.tex)
+	tc.memory.Release()
+	*tc = textureCopy{}
+}
+
+// historyFrame is a frame of the history with the outputs of its passes.
+type historyFrame struct {
+	frame  uint64
+	time   time.Duration
+	image  textureCopy
+	passes map[string]*textureCopy
+}
+
+// frameHistory keeps copies of the most recent frames of a window and of the
+// outputs of their passes, so a glitch can be inspected after it has passed.
+// The history is stepped through with the arrow keys, which pauses rendering.
+// It must only be used from the thread that owns the OpenGL context.
+type frameHistory struct {
+	ring   historyRing
+	frames []historyFrame
+}
+
+func newFrameHistory(size int) *frameHistory {
+	return &frameHistory{
+		ring:   historyRing{size: size, latest: size - 1},
+		frames: make([]historyFrame, size),
+	}
+}
+
+// record copies the rendered image and the outputs of the passes as the
+// latest frame.
+func (fh *frameHistory) record(frame uint64, t time.Duration, image uint32, w, h int, passes map[string]uint32, targets map[string]*Shader) error {
+	hf := &fh.frames[fh.ring.push()]
+	hf.frame, hf.time = frame, t
+	if err := hf.image.copyFrom(image, w, h, PixelFormatRGBA8); err != nil {
+		return err
+	}
+	if hf.passes == nil {
+		hf.passes = map[string]*textureCopy{}
+	}
+	for name, tc := range hf.passes {
+		if _, ok := passes[name]; !ok {
+			tc.free()
+			delete(hf.passes, name)
+		}
+	}
+	for name, tex := range passes {
+		s, ok := targets[name]
+		if !ok || tex == 0 {
+			continue
+		}
+		tc, ok := hf.passes[name]
+		if !ok {
+			tc = &textureCopy{}
+			hf.passes[name] = tc
+		}
+		pr := s.renderer.(*pboRenderer)
+		if err := tc.copyFrom(tex, int(pr.w), int(pr.h), pr.format); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// viewed returns the frame that is viewed, if any.
+func (fh *frameHistory) viewed() (*historyFrame, bool) {
+	i, ok := fh.ring.viewed()
+	if !ok {
+		return nil, false
+	}
+	return &fh.frames[i], true
+}
+
+// onKey handles the hotkeys of the history: left steps back a frame, right
+// steps forward and end returns to the live frames. With shift, the arrow keys
+// step 10 frames.
+func (fh *frameHistory) onKey(key glfw.Key, action glfw.Action, mods glfw.ModifierKey) {
+	if action != glfw.Press && action != glfw.Repeat {
+		return
+	}
+	n := 1
+	if mods&glfw.ModShift != 0 {
+		n = 10
+	}
+	switch key {
+	case glfw.KeyLeft:
+		fh.ring.step(-n)
+	case glfw.KeyRight:
+		fh.ring.step(n)
+	case glfw.KeyEnd:
+		fh.ring.live()
+	default:
+		return
+	}
+	if hf, ok := fh.viewed(); ok {
+		log.Printf("Viewing frame %d at %v, %d frames back", hf.frame, hf.time.Round(time.Millisecond), fh.ring.back)
+	}
+}
+
+func (fh *frameHistory) Close() {
+	for i := range fh.frames {
+		fh.frames[i].image.free()
+		for _, tc := range fh.frames[i].passes {
+			tc.free()
+		}
+	}
+}
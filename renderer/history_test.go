@@ -0,0 +1,40 @@
+package renderer
+
+import (
+	"testing"
+)
+
+func TestHistoryRing(t *testing.T) {
+	r := historyRing{size: 3, latest: 2}
+	r.step(-1)
+	if _, ok := r.viewed(); ok {
+		t.Fatalf("viewing an empty history")
+	}
+	for i := 0; i < 4; i++ {
+		r.push()
+	}
+	// Slots 1, 2 and 0 hold the frames from oldest to latest.
+	if r.latest != 0 || r.count != 3 {
+		t.Fatalf("latest = %d, count = %d, expected 0 and 3", r.latest, r.count)
+	}
+	r.step(1)
+	if _, ok := r.viewed(); ok {
+		t.Errorf("stepping forward while live views the history")
+	}
+	r.step(-1)
+	if slot, ok := r.viewed(); !ok || slot != 2 {
+		t.Errorf("viewed = %d, %v, expected 2, true", slot, ok)
+	}
+	r.step(-10)
+	if slot, ok := r.viewed(); !ok || slot != 1 || r.back != 2 {
+		t.Errorf("viewed = %d, %v, %d back, expected the oldest slot 1", slot, ok, r.back)
+	}
+	r.step(2)
+	if slot, ok := r.viewed(); !ok || slot != 0 {
+		t.Errorf("viewed = %d, %v, expected the latest slot 0", slot, ok)
+	}
+	r.step(1)
+	if _, ok := r.viewed(); ok {
+		t.Errorf("stepping past the latest frame does not return to live")
+	}
+}
@@ -0,0 +1,73 @@
+package renderer
+
+import (
+	"strings"
+
+	"github.com/go-gl/gl/v3.3-core/gl"
+)
+
+// ContextInfo describes the capabilities of the OpenGL implementation.
+type ContextInfo struct {
+	// Backend is the backend that created the context, it is empty for
+	// contexts of the application, see NewShaderInCurrentContext.
+	Backend                Backend  `json:"backend,omitempty"`
+	Vendor                 string   `json:"vendor"`
+	Renderer               string   `json:"renderer"`
+	Version                string   `json:"version"`
+	ShadingLanguageVersion string   `json:"shading_language_version"`
+	MaxTextureSize         int      `json:"max_texture_size"`
+	MaxRenderbufferSize    int      `json:"max_renderbuffer_size"`
+	MaxTextureImageUnits   int      `json:"max_texture_image_units"`
+	Extensions             []string `json:"extensions"`
+}
+
+// HasExtension reports whether the extension is supported.
+func (info ContextInfo) HasExtension(name string) bool {
+	for _, ext := range info.Extensions {
+		if ext == name {
+			return true
+		}
+	}
+	return false
+}
+
+// QueryContextInfo creates an offscreen context and queries its capabilities.
+func QueryContextInfo(glVersion OpenGLVersion) (ContextInfo, error) {
+	sh, err := NewShader(1, 1, glVersion)
+	if err != nil {
+		return ContextInfo{}, err
+	}
+	defer sh.Close()
+	return contextInfo(), nil
+}
+
+// currentContextInfo queries the capabilities of the current context.
+func currentContextInfo() ContextInfo {
+	info := ContextInfo{
+		Backend:                activeBackend,
+		Vendor:                 gl.GoStr(gl.GetString(gl.VENDOR)),
+		Renderer:               gl.GoStr(gl.GetString(gl.RENDERER)),
+		Version:                gl.GoStr(gl.GetString(gl.VERSION)),
+		ShadingLanguageVersion: gl.GoStr(gl.GetString(gl.SHADING_LANGUAGE_VERSION)),
+		MaxTextureSize:         getInteger(gl.MAX_TEXTURE_SIZE),
+		MaxRenderbufferSize:    getInteger(gl.MAX_RENDERBUFFER_SIZE),
+		MaxTextureImageUnits:   getInteger(gl.MAX_TEXTURE_IMAGE_UNITS),
+	}
+	if major, _, ok := parseGLVersion(info.Version); ok && major < 3 {
+		// Indexed queries are not available before OpenGL 3.0.
+		info.Extensions = strings.Fields(gl.GoStr(gl.GetString(gl.EXTENSIONS)))
+		return info
+	}
+	n := getInteger(gl.NUM_EXTENSIONS)
+	info.Extensions = make([]string, 0, n)
+	for i := 0; i < n; i++ {
+		info.Extensions = append(info.Extensions, gl.GoStr(gl.GetStringi(gl.EXTENSIONS, uint32(i))))
+	}
+	return info
+}
+
+func getInteger(name uint32) int {
+	var v int32
+	gl.GetIntegerv(name, &v)
+	return int(v)
+}
@@ -0,0 +1,130 @@
+package renderer
+
+import (
+	"math"
+
+	"github.com/go-gl/glfw/v3.3/glfw"
+)
+
+// Input is the state of the mouse and keyboard of a window in the form that
+// Shadertoy exposes it to shaders. It is only available when rendering to a
+// window, see RenderState.Input.
+type Input struct {
+	// Mouse is the state of the left mouse button like iMouse of Shadertoy,
+	// in pixels of the canvas with the origin in the bottom left. xy is the
+	// position of the mouse while the button is held down and zw is the
+	// position at which it was pressed. z is negative while the button is up
+	// and w is negative except for the frame in which it was pressed.
+	Mouse [4]float32
+	// Keys contains a row of 256 values like the keyboard texture of
+	// Shadertoy, indexed by the JavaScript keycode of a key. Row 0 is 255
+	// while a key is held down, row 1 is 255 in the frame in which it was
+	// pressed and row 2 toggles every time it is pressed.
+	Keys [3][256]byte
+
+	cursor     [2]float32
+	buttonDown bool
+	// clicked and pressed are set if Mouse and Keys hold values that only
+	// last for the current frame.
+	clicked, pressed bool
+	mouseChanged     bool
+}
+
+// MouseChanged reports whether Mouse changed since the previous frame.
+func (in *Input) MouseChanged() bool {
+	return in.mouseChanged
+}
+
+func (in *Input) onCursorPos(x, y float32) {
+	in.cursor = [2]float32{x, y}
+	if in.buttonDown {
+		in.Mouse[0], in.Mouse[1] = x, y
+		in.mouseChanged = true
+	}
+}
+
+func (in *Input) onMouseButton(down bool) {
+	if down == in.buttonDown {
+		return
+	}
+	in.buttonDown = down
+	if down {
+		x, y := in.cursor[0], in.cursor[1]
+		in.Mouse = [4]float32{x, y, x, y}
+		in.clicked = true
+	} else {
+		in.Mouse[2] = -float32(math.Abs(float64(in.Mouse[2])))
+		in.Mouse[3] = -float32(math.Abs(float64(in.Mouse[3])))
+	}
+	in.mouseChanged = true
+}
+
+func (in *Input) onKey(key glfw.Key, action glfw.Action) {
+	code, ok := jsKeyCode(key)
+	if !ok || action == glfw.Repeat {
+		return
+	}
+	if action == glfw.Press {
+		if in.Keys[0][code] != 0 {
+			return
+		}
+		in.Keys[0][code] = 255
+		in.Keys[1][code] = 255
+		in.Keys[2][code] ^= 255
+		in.pressed = true
+	} else {
+		in.Keys[0][code] = 0
+	}
+}
+
+// endFrame should be called after every frame that is rendered, so the values
+// that only last for a single frame are reset.
+func (in *Input) endFrame() {
+	in.mouseChanged = false
+	if in.clicked {
+		in.Mouse[3] = -in.Mouse[3]
+		in.clicked, in.mouseChanged = false, true
+	}
+	if in.pressed {
+		in.Keys[1] = [256]byte{}
+		in.pressed = false
+	}
+}
+
+// jsKeyCode maps a GLFW key to the keycode that browsers report for it, which
+// is how Shadertoy indexes the keyboard texture.
+func jsKeyCode(key glfw.Key) (int, bool) {
+	switch {
+	case key >= glfw.KeyA && key <= glfw.KeyZ, key >= glfw.Key0 && key <= glfw.Key9, key == glfw.KeySpace:
+		// Letters, digits and the space have the same codes.
+		return int(key), true
+	case key >= glfw.KeyF1 && key <= glfw.KeyF12:
+		return 112 + int(key-glfw.KeyF1), true
+	}
+	code, ok := jsKeyCodes[key]
+	return code, ok
+}
+
+// jsKeyCodes contains the keycodes of the other keys that are supported.
+var jsKeyCodes = map[glfw.Key]int{
+	glfw.KeyBackspace:    8,
+	glfw.KeyTab:          9,
+	glfw.KeyEnter:        13,
+	glfw.KeyLeftShift:    16,
+	glfw.KeyRightShift:   16,
+	glfw.KeyLeftControl:  17,
+	glfw.KeyRightControl: 17,
+	glfw.KeyLeftAlt:      18,
+	glfw.KeyRightAlt:     18,
+	glfw.KeyEscape:       27,
+	glfw.KeyPageUp:       33,
+	glfw.KeyPageDown:     34,
+	glfw.KeyEnd:          35,
+	glfw.KeyHome:         36,
+	glfw.KeyLeft:         37,
+	glfw.KeyUp:           38,
+	glfw.KeyRight:        39,
+	glfw.KeyDown:         40,
+	glfw.KeyInsert:       45,
+	glfw.KeyDelete:       46,
+}
@@ -0,0 +1,78 @@
+package renderer
+
+import (
+	"testing"
+
+	"github.com/go-gl/glfw/v3.3/glfw"
+)
+
+func TestInputMouse(t *testing.T) {
+	var in Input
+	in.onCursorPos(10, 20)
+	if in.Mouse != [4]float32{} || in.MouseChanged() {
+		t.Fatalf("expected moving without a button to be ignored, got %v", in.Mouse)
+	}
+
+	in.onMouseButton(true)
+	if in.Mouse != [4]float32{10, 20, 10, 20} || !in.MouseChanged() {
+		t.Fatalf("got %v after clicking", in.Mouse)
+	}
+	in.endFrame()
+	if in.Mouse != [4]float32{10, 20, 10, -20} || !in.MouseChanged() {
+		t.Fatalf("got %v in the frame after clicking", in.Mouse)
+	}
+	in.endFrame()
+	if in.MouseChanged() {
+		t.Fatalf("expected the mouse to be unchanged")
+	}
+
+	in.onCursorPos(30, 40)
+	in.onMouseButton(false)
+	if in.Mouse != [4]float32{30, 40, -10, -20} {
+		t.Fatalf("got %v after releasing", in.Mouse)
+	}
+	in.endFrame()
+	in.onCursorPos(50, 60)
+	if in.Mouse != [4]float32{30, 40, -10, -20} || in.MouseChanged() {
+		t.Fatalf("got %v after moving without a button", in.Mouse)
+	}
+}
+
+func TestInputKeys(t *testing.T) {
+	var in Input
+	in.onKey(glfw.KeyLeft, glfw.Press)
+	if in.Keys[0][37] != 255 || in.Keys[1][37] != 255 || in.Keys[2][37] != 255 {
+		t.Fatalf("got %d, %d, %d after pressing", in.Keys[0][37], in.Keys[1][37], in.Keys[2][37])
+	}
+	in.onKey(glfw.KeyLeft, glfw.Repeat)
+	in.endFrame()
+	if in.Keys[0][37] != 255 || in.Keys[1][37] != 0 || in.Keys[2][37] != 255 {
+		t.Fatalf("got %d, %d, %d in the frame after pressing", in.Keys[0][37], in.Keys[1][37], in.Keys[2][37])
+	}
+	in.onKey(glfw.KeyLeft, glfw.Release)
+	in.onKey(glfw.KeyLeft, glfw.Press)
+	in.onKey(glfw.KeyLeft, glfw.Release)
+	if in.Keys[0][37] != 0 || in.Keys[1][37] != 255 || in.Keys[2][37] != 0 {
+		t.Fatalf("got %d, %d, %d after pressing again", in.Keys[0][37], in.Keys[1][37], in.Keys[2][37])
+	}
+}
+
+func TestJSKeyCode(t *testing.T) {
+	for key, expected := range map[glfw.Key]int{
+		glfw.KeyA:          65,
+		glfw.KeyZ:          90,
+		glfw.Key0:          48,
+		glfw.KeySpace:      32,
+		glfw.KeyF12:        123,
+		glfw.KeyEnter:      13,
+		glfw.KeyRightShift: 16,
+		glfw.KeyUp:         38,
+	} {
+		if code, ok := jsKeyCode(key); !ok || code != expected {
+			t.Errorf("%d: got %d, %v, expected %d", key, code, ok, expected)
+		}
+	}
+	if _, ok := jsKeyCode(glfw.KeyUnknown); ok {
+		t.Errorf("expected unknown keys to be ignored")
+	}
+}
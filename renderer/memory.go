@@ -0,0 +1,152 @@
+package renderer
+
+import (
+	"container/list"
+	"fmt"
+	"sync"
+)
+
+// The estimates in this file track how much GPU memory textures and
+// framebuffers use, so a budget can be enforced on embedded GPUs that share
+// little memory and tend to take down the driver or the whole system when it
+// runs out, instead of reporting an error.
+
+// gpuMemory is the budget of the single context that is used.
+var gpuMemory = memoryBudget{
+	cached: list.New(),
+	byKey:  map[string]*list.Element{},
+}
+
+type memoryBudget struct {
+	lock sync.Mutex
+	// limit is the budget in bytes, 0 if unlimited.
+	limit int64
+	used  int64
+	// cached holds assets that are not in use, the least recently used at
+	// the back.
+	cached *list.List
+	byKey  map[string]*list.Element
+}
+
+type cachedAsset struct {
+	key   string
+	value interface{}
+	free  func()
+}
+
+// MemoryReservation is an amount of GPU memory accounted for by
+// ReserveMemory.
+type MemoryReservation struct {
+	size int64
+}
+
+// Release returns the reserved memory to the budget. It is safe to call more
+// than once and on a nil reservation.
+func (r *MemoryReservation) Release() {
+	if r == nil {
+		return
+	}
+	gpuMemory.lock.Lock()
+	defer gpuMemory.lock.Unlock()
+	gpuMemory.used -= r.size
+	r.size = 0
+}
+
+// SetMemoryBudget limits the estimated amount of GPU memory in bytes used by
+// textures and framebuffers. Allocations that do not fit fail with an error
+// after evicting unused cached assets. If 0, memory is not limited and assets
+// are not cached. It should be called before rendering.
+func SetMemoryBudget(bytes int64) {
+	gpuMemory.lock.Lock()
+	defer gpuMemory.lock.Unlock()
+	gpuMemory.limit = bytes
+}
+
+// MemoryUsage returns the estimated GPU memory in bytes that is in use,
+// including cached assets, and the budget.
+func MemoryUsage() (used, budget int64) {
+	gpuMemory.lock.Lock()
+	defer gpuMemory.lock.Unlock()
+	return gpuMemory.used, gpuMemory.limit
+}
+
+// ReserveMemory accounts for an allocation of GPU memory. If it exceeds the
+// budget, unused cached assets are evicted, least recently used first. An
+// error describing what did not fit is returned if that is not enough.
+//
+// It must be called from the thread that owns the OpenGL context, since
+// evicted assets are freed.
+func ReserveMemory(what string, bytes int64) (*MemoryReservation, error) {
+	gpuMemory.lock.Lock()
+	defer gpuMemory.lock.Unlock()
+	mb := &gpuMemory
+	for mb.limit > 0 && mb.used+bytes > mb.limit && mb.cached.Len() > 0 {
+		mb.evict(mb.cached.Back())
+	}
+	if mb.limit > 0 && mb.used+bytes > mb.limit {
+		return nil, fmt.Errorf("%s needs %s of GPU memory, but only %s of the %s budget is free, please use smaller sizes or increase the budget",
+			what, formatBytes(bytes), formatBytes(mb.limit-mb.used), formatBytes(mb.limit))
+	}
+	mb.used += bytes
+	return &MemoryReservation{size: bytes}, nil
+}
+
+// CacheAsset keeps an asset that is no longer in use so it can be taken back
+// with TakeCachedAsset, for example when the same shader is loaded again. The
+// memory of the asset should remain reserved while it is cached. free is
+// called from ReserveMemory when the asset is evicted and must release the
+// asset and its reservation.
+//
+// Without a budget, nothing limits the cache, so free is called immediately.
+func CacheAsset(key string, value interface{}, free func()) {
+	gpuMemory.lock.Lock()
+	mb := &gpuMemory
+	if mb.limit == 0 {
+		mb.lock.Unlock()
+		free()
+		return
+	}
+	if e, ok := mb.byKey[key]; ok {
+		mb.evict(e)
+	}
+	mb.byKey[key] = mb.cached.PushFront(&cachedAsset{key: key, value: value, free: free})
+	mb.lock.Unlock()
+}
+
+// TakeCachedAsset removes an asset that was stored with CacheAsset from the
+// cache and returns it.
+func TakeCachedAsset(key string) (interface{}, bool) {
+	gpuMemory.lock.Lock()
+	defer gpuMemory.lock.Unlock()
+	e, ok := gpuMemory.byKey[key]
+	if !ok {
+		return nil, false
+	}
+	gpuMemory.cached.Remove(e)
+	delete(gpuMemory.byKey, key)
+	return e.Value.(*cachedAsset).value, true
+}
+
+// evict frees a cached asset. The lock must be held, it is released while
+// the asset is freed, since that releases its reservation.
+func (mb *memoryBudget) evict(e *list.Element) {
+	asset := mb.cached.Remove(e).(*cachedAsset)
+	delete(mb.byKey, asset.key)
+	mb.lock.Unlock()
+	defer mb.lock.Lock()
+	asset.free()
+}
+
+// formatBytes formats a size in bytes for humans.
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%dB", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit && exp < 3; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f%ciB", float64(n)/float64(div), "KMGT"[exp])
+}
@@ -0,0 +1,74 @@
+package renderer
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestMemoryBudget(t *testing.T) {
+	SetMemoryBudget(100)
+	defer SetMemoryBudget(0)
+
+	a, err := ReserveMemory("a", 60)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ReserveMemory("b", 50); err == nil || !strings.Contains(err.Error(), "b needs 50B") {
+		t.Fatalf("expected an error for exceeding the budget, got %v", err)
+	}
+	a.Release()
+	a.Release()
+	if used, _ := MemoryUsage(); used != 0 {
+		t.Fatalf("expected all memory to be released, %d is in use", used)
+	}
+
+	// Unused assets are evicted least recently used first.
+	var freed []string
+	cache := func(key string, size int64) {
+		r, err := ReserveMemory(key, size)
+		if err != nil {
+			t.Fatal(err)
+		}
+		CacheAsset(key, key, func() {
+			freed = append(freed, key)
+			r.Release()
+		})
+	}
+	cache("old", 40)
+	cache("new", 40)
+	c, err := ReserveMemory("c", 30)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(freed) != 1 || freed[0] != "old" {
+		t.Fatalf("expected the least recently used asset to be evicted, got %v", freed)
+	}
+	if v, ok := TakeCachedAsset("new"); !ok || v != "new" {
+		t.Fatalf("expected the cached asset to be taken, got %v", v)
+	}
+	if _, ok := TakeCachedAsset("new"); ok {
+		t.Fatalf("an asset can only be taken once")
+	}
+	c.Release()
+
+	// Without a budget, nothing is cached.
+	SetMemoryBudget(0)
+	freed = nil
+	cache("x", 10)
+	if len(freed) != 1 {
+		t.Fatalf("expected the asset to be freed immediately")
+	}
+}
+
+func TestFormatBytes(t *testing.T) {
+	for n, expected := range map[int64]string{
+		512:     "512B",
+		1536:    "1.5KiB",
+		1 << 20: "1.0MiB",
+		3 << 30: "3.0GiB",
+	} {
+		if s := formatBytes(n); s != expected {
+			t.Errorf("%d: expected %q, got %q", n, expected, s)
+		}
+	}
+}
@@ -0,0 +1,268 @@
+package renderer
+
+import (
+	"fmt"
+	"image"
+
+	"github.com/go-gl/gl/v3.3-core/gl"
+
+	"github.com/polyfloyd/shady/encode"
+)
+
+const (
+	packVert = SourceBuf(`#version 330 core
+		in vec2 pos;
+
+		void main() {
+			gl_Position = vec4(pos, 0.0, 1.0);
+		}
+	`)
+	// packFrag writes 4 bytes of the output layout to every texel. The
+	// conversions are the same as those of package encode, so the results
+	// are identical.
+	packFrag = SourceBuf(`#version 330 core
+		out vec4 fragColor;
+		uniform sampler2D source;
+		uniform int outputLayout;
+		uniform int packedWidth;
+		uniform int packedSize;
+
+		const int RGB24 = 1;
+		const int BGR24 = 2;
+		const int I420 = 3;
+		const int RGB565 = 4;
+
+		ivec3 pixel(int x, int y) {
+			return ivec3(round(texelFetch(source, ivec2(x, y), 0).rgb * 255.0));
+		}
+
+		int byteAt(int i) {
+			if (i >= packedSize) {
+				return 0;
+			}
+			ivec2 size = textureSize(source, 0);
+			int w = size.x;
+			int h = size.y;
+			if (outputLayout == RGB24) {
+				int p = i / 3;
+				return pixel(p % w, p / w)[i % 3];
+			}
+			if (outputLayout == BGR24) {
+				int p = i / 3;
+				return pixel(p % w, p / w)[2 - i % 3];
+			}
+			if (outputLayout == RGB565) {
+				int p = i / 2;
+				ivec3 c = pixel(p % w, p / w);
+				int v = (c.r >> 3) << 11 | (c.g >> 2) << 5 | c.b >> 3;
+				return i % 2 == 0 ? v & 0xff : v >> 8;
+			}
+			// I420
+			if (i < w * h) {
+				ivec3 c = pixel(i % w, i / w);
+				return ((66 * c.r + 129 * c.g + 25 * c.b + 128) >> 8) + 16;
+			}
+			int cw = (w + 1) / 2;
+			int ch = (h + 1) / 2;
+			int j = i - w * h;
+			int k = j % (cw * ch);
+			int x = k % cw * 2;
+			int y = k / cw * 2;
+			int x1 = min(x + 1, w - 1);
+			int y1 = min(y + 1, h - 1);
+			ivec3 s = pixel(x, y) + pixel(x1, y) + pixel(x, y1) + pixel(x1, y1);
+			if (j < cw * ch) {
+				return ((-38 * s.r - 74 * s.g + 112 * s.b + 512) >> 10) + 128;
+			}
+			return ((112 * s.r - 94 * s.g - 18 * s.b + 512) >> 10) + 128;
+		}
+
+		void main() {
+			int base = (int(gl_FragCoord.y) * packedWidth + int(gl_FragCoord.x)) * 4;
+			fragColor = vec4(byteAt(base), byteAt(base + 1), byteAt(base + 2), byteAt(base + 3)) / 255.0;
+		}
+	`)
+)
+
+// OutputLayout is the byte layout frames are converted to on the GPU before
+// they are read back, see Shader.SetOutputLayout.
+type OutputLayout int
+
+// The values are those of the outputLayout uniform of packFrag.
+const (
+	// OutputLayoutRGBA reads frames back as they are rendered.
+	OutputLayoutRGBA OutputLayout = iota
+	OutputLayoutRGB24
+	OutputLayoutBGR24
+	OutputLayoutI420
+	OutputLayoutRGB565
+)
+
+var outputLayouts = []OutputLayout{OutputLayoutRGBA, OutputLayoutRGB24, OutputLayoutBGR24, OutputLayoutI420, OutputLayoutRGB565}
+
+// OutputLayoutOf returns the layout of the raw output format with the name in
+// encode.Formats, if it has one.
+func OutputLayoutOf(format string) (OutputLayout, bool) {
+	for _, l := range outputLayouts {
+		if l.String() == format {
+			return l, true
+		}
+	}
+	return 0, false
+}
+
+// String returns the name of the matching format in encode.Formats.
+func (l OutputLayout) String() string {
+	switch l {
+	case OutputLayoutRGB24:
+		return "rgb24"
+	case OutputLayoutBGR24:
+		return "bgr24"
+	case OutputLayoutI420:
+		return "yuv420p"
+	case OutputLayoutRGB565:
+		return "rgb565"
+	default:
+		return "rgba32"
+	}
+}
+
+// size returns the number of bytes of a frame in the layout.
+func (l OutputLayout) size(w, h int) int {
+	switch l {
+	case OutputLayoutRGB24, OutputLayoutBGR24:
+		return w * h * 3
+	case OutputLayoutI420:
+		cw, ch := (w+1)/2, (h+1)/2
+		return w*h + 2*cw*ch
+	case OutputLayoutRGB565:
+		return w * h * 2
+	default:
+		return w * h * 4
+	}
+}
+
+// packer converts the render targets of a pboRenderer to an output layout. The
+// bytes of a frame are stored in the texels of an RGBA8 target of the same
+// width as the frame, 4 bytes per texel, so they can be read back as one
+// block.
+type packer struct {
+	layout  OutputLayout
+	w, h    int
+	size    int
+	pw, ph  int32
+	program uint32
+	vao     uint32
+	vbo     uint32
+	memory  *MemoryReservation
+	targets []struct {
+		fbo, tex, pbo uint32
+	}
+}
+
+func newPacker(layout OutputLayout, w, h uint, numTargets int) (*packer, error) {
+	pk := &packer{layout: layout, w: int(w), h: int(h)}
+	pk.size = layout.size(pk.w, pk.h)
+	texels := (pk.size + 3) / 4
+	pk.pw = int32(w)
+	pk.ph = int32((texels + pk.w - 1) / pk.w)
+
+	// Every target has a texture and a pixel buffer of the same size.
+	mem, err := ReserveMemory(fmt.Sprintf("a %dx%d %s conversion target", w, h, layout), 2*int64(numTargets)*int64(pk.pw)*int64(pk.ph)*4)
+	if err != nil {
+		return nil, err
+	}
+	pk.memory = mem
+	pk.program, err = linkProgram(map[Stage][]Source{
+		StageVertex:   {packVert},
+		StageFragment: {packFrag},
+	})
+	if err != nil {
+		pk.Close()
+		return nil, err
+	}
+	pk.vao, pk.vbo = createGLQuad()
+	gl.BindVertexArray(pk.vao)
+	gl.BindBuffer(gl.ARRAY_BUFFER, pk.vbo)
+	loc := uint32(gl.GetAttribLocation(pk.program, gl.Str("pos\x00")))
+	gl.EnableVertexAttribArray(loc)
+	gl.VertexAttribPointer(loc, 3, gl.FLOAT, false, 0, nil)
+	gl.BindBuffer(gl.ARRAY_BUFFER, 0)
+	gl.BindVertexArray(0)
+
+	pk.targets = make([]struct{ fbo, tex, pbo uint32 }, numTargets)
+	for i := range pk.targets {
+		t := &pk.targets[i]
+		gl.GenFramebuffers(1, &t.fbo)
+		gl.BindFramebuffer(gl.FRAMEBUFFER, t.fbo)
+		gl.GenTextures(1, &t.tex)
+		gl.BindTexture(gl.TEXTURE_2D, t.tex)
+		gl.TexImage2D(gl.TEXTURE_2D, 0, gl.RGBA8, pk.pw, pk.ph, 0, gl.RGBA, gl.UNSIGNED_BYTE, nil)
+		gl.TexParameteri(gl.TEXTURE_2D, gl.TEXTURE_MAG_FILTER, gl.NEAREST)
+		gl.TexParameteri(gl.TEXTURE_2D, gl.TEXTURE_MIN_FILTER, gl.NEAREST)
+		gl.FramebufferTexture2D(gl.FRAMEBUFFER, gl.COLOR_ATTACHMENT0, gl.TEXTURE_2D, t.tex, 0)
+		status := gl.CheckFramebufferStatus(gl.FRAMEBUFFER)
+		gl.GenBuffers(1, &t.pbo)
+		gl.BindBuffer(gl.PIXEL_PACK_BUFFER, t.pbo)
+		gl.BufferData(gl.PIXEL_PACK_BUFFER, int(pk.pw*pk.ph*4), nil, gl.DYNAMIC_READ)
+		gl.BindBuffer(gl.PIXEL_PACK_BUFFER, 0)
+		gl.BindFramebuffer(gl.FRAMEBUFFER, 0)
+		gl.BindTexture(gl.TEXTURE_2D, 0)
+		if status != gl.FRAMEBUFFER_COMPLETE {
+			pk.Close()
+			return nil, fmt.Errorf("incomplete conversion framebuffer")
+		}
+	}
+	return pk, nil
+}
+
+// Draw converts the texture into target i and starts reading it back. It
+// changes the framebuffer binding and viewport.
+func (pk *packer) Draw(i int, tex uint32) {
+	t := pk.targets[i]
+	gl.BindFramebuffer(gl.FRAMEBUFFER, t.fbo)
+	gl.Viewport(0, 0, pk.pw, pk.ph)
+	gl.UseProgram(pk.program)
+	uniform := func(name string) int32 {
+		return gl.GetUniformLocation(pk.program, gl.Str(name+"\x00"))
+	}
+	gl.Uniform1i(uniform("outputLayout"), int32(pk.layout))
+	gl.Uniform1i(uniform("packedWidth"), pk.pw)
+	gl.Uniform1i(uniform("packedSize"), int32(pk.size))
+	gl.ActiveTexture(gl.TEXTURE0)
+	gl.BindTexture(gl.TEXTURE_2D, tex)
+	gl.Uniform1i(uniform("source"), 0)
+	gl.BindVertexArray(pk.vao)
+	gl.DrawArrays(gl.TRIANGLE_STRIP, 0, 4)
+	gl.BindVertexArray(0)
+	gl.BindTexture(gl.TEXTURE_2D, 0)
+
+	gl.BindBuffer(gl.PIXEL_PACK_BUFFER, t.pbo)
+	gl.ReadPixels(0, 0, pk.pw, pk.ph, gl.RGBA, gl.UNSIGNED_BYTE, nil)
+	gl.BindBuffer(gl.PIXEL_PACK_BUFFER, 0)
+}
+
+// Frame returns the converted contents of target i as a frame from the pool of
+// package encode.
+func (pk *packer) Frame(i int) *encode.RawFrame {
+	frame := encode.NewRawFrame(pk.layout.String(), image.Rect(0, 0, pk.w, pk.h), pk.size)
+	gl.BindBuffer(gl.PIXEL_PACK_BUFFER, pk.targets[i].pbo)
+	gl.GetBufferSubData(gl.PIXEL_PACK_BUFFER, 0, pk.size, gl.Ptr(&frame.Pix[0]))
+	gl.BindBuffer(gl.PIXEL_PACK_BUFFER, 0)
+	return frame
+}
+
+func (pk *packer) Close() error {
+	for _, t := range pk.targets {
+		gl.DeleteFramebuffers(1, &t.fbo)
+		gl.DeleteTextures(1, &t.tex)
+		gl.DeleteBuffers(1, &t.pbo)
+	}
+	if pk.program != 0 {
+		gl.DeleteProgram(pk.program)
+	}
+	gl.DeleteVertexArrays(1, &pk.vao)
+	gl.DeleteBuffers(1, &pk.vbo)
+	pk.memory.Release()
+	return nil
+}
@@ -0,0 +1,35 @@
+package renderer
+
+import (
+	"testing"
+
+	"github.com/polyfloyd/shady/encode"
+)
+
+func TestOutputLayouts(t *testing.T) {
+	for _, l := range outputLayouts {
+		if _, ok := encode.Formats[l.String()]; !ok {
+			t.Errorf("%v has no output format", l)
+		}
+		if parsed, ok := OutputLayoutOf(l.String()); !ok || parsed != l {
+			t.Errorf("OutputLayoutOf(%q) = %v, %v", l, parsed, ok)
+		}
+	}
+	if _, ok := OutputLayoutOf("png"); ok {
+		t.Errorf("png should not have a layout")
+	}
+	if n := OutputLayoutI420.size(5, 3); n != 5*3+2*3*2 {
+		t.Errorf("unexpected I420 size %d", n)
+	}
+}
+
+func TestPackShader(t *testing.T) {
+	initTestGL(t)
+
+	if _, err := linkProgram(map[Stage][]Source{
+		StageVertex:   {packVert},
+		StageFragment: {packFrag},
+	}); err != nil {
+		t.Fatal(err)
+	}
+}
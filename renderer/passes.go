@@ -0,0 +1,320 @@
+package renderer
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+	"unsafe"
+
+	"github.com/go-gl/gl/v3.3-core/gl"
+	"github.com/go-gl/glfw/v3.3/glfw"
+)
+
+// PassState is the runtime state of a pass of the current environment, which
+// is a sub environment like a buffer.
+type PassState struct {
+	Name string
+	// Enabled is false if the pass is not rendered. Passes that read it see
+	// its last frame.
+	Enabled bool
+	// Solo is set if the output of the pass is shown instead of the final
+	// image.
+	Solo bool
+}
+
+// passControls holds the passes that are disabled or soloed. It is safe to use
+// from any goroutine. States are kept by name when the environment is
+// reloaded, so they survive editing the shader.
+type passControls struct {
+	lock     sync.Mutex
+	names    []string
+	disabled map[string]bool
+	solo     string
+}
+
+// setPasses sets the names of the passes of the current environment, in the
+// order they are rendered in.
+func (pc *passControls) setPasses(names []string) {
+	pc.lock.Lock()
+	defer pc.lock.Unlock()
+	pc.names = names
+}
+
+func (pc *passControls) has(name string) bool {
+	for _, n := range pc.names {
+		if n == name {
+			return true
+		}
+	}
+	return false
+}
+
+func (pc *passControls) SetEnabled(name string, enabled bool) error {
+	pc.lock.Lock()
+	defer pc.lock.Unlock()
+	if !pc.has(name) {
+		return fmt.Errorf("no such pass: %q", name)
+	}
+	if pc.disabled == nil {
+		pc.disabled = map[string]bool{}
+	}
+	if enabled {
+		delete(pc.disabled, name)
+	} else {
+		pc.disabled[name] = true
+	}
+	return nil
+}
+
+// SetSolo shows the output of the named pass, or the final image if name is
+// empty.
+func (pc *passControls) SetSolo(name string) error {
+	pc.lock.Lock()
+	defer pc.lock.Unlock()
+	if name != "" && !pc.has(name) {
+		return fmt.Errorf("no such pass: %q", name)
+	}
+	pc.solo = name
+	return nil
+}
+
+func (pc *passControls) States() []PassState {
+	pc.lock.Lock()
+	defer pc.lock.Unlock()
+	states := make([]PassState, len(pc.names))
+	for i, name := range pc.names {
+		states[i] = PassState{Name: name, Enabled: !pc.disabled[name], Solo: name == pc.solo}
+	}
+	return states
+}
+
+// current returns the disabled passes and the soloed pass for the next frame.
+func (pc *passControls) current() (map[string]bool, string) {
+	pc.lock.Lock()
+	defer pc.lock.Unlock()
+	disabled := make(map[string]bool, len(pc.disabled))
+	for name := range pc.disabled {
+		disabled[name] = true
+	}
+	solo := pc.solo
+	if !pc.has(solo) {
+		solo = ""
+	}
+	return disabled, solo
+}
+
+// onKey handles the hotkeys of passes: the number keys 1-9 solo the pass with
+// that position in the render order and 0 shows the final image again. With
+// shift, the number keys toggle the pass instead.
+func (pc *passControls) onKey(key glfw.Key, action glfw.Action, mods glfw.ModifierKey) {
+	if action != glfw.Press || key < glfw.Key0 || key > glfw.Key9 {
+		return
+	}
+	i := int(key - glfw.Key1)
+	if key == glfw.Key0 {
+		if mods&glfw.ModShift == 0 {
+			pc.SetSolo("")
+		}
+		return
+	}
+	states := pc.States()
+	if i >= len(states) {
+		return
+	}
+	if mods&glfw.ModShift != 0 {
+		pc.SetEnabled(states[i].Name, !states[i].Enabled)
+	} else {
+		pc.SetSolo(states[i].Name)
+	}
+}
+
+// renderSubTargets renders the sub targets in order and returns their
+// textures, which are valid until free is called. Disabled sub targets are not
+// rendered and provide their previous frame, or 0 if they have none. rendered
+// is called for every sub target that was rendered, if not nil.
+func renderSubTargets(targets map[string]*Shader, order []string, inputs map[string][]string, interval time.Duration, disabled map[string]bool, rendered func(name string, s *Shader, handle interface{})) (map[string]uint32, func()) {
+	textures := map[string]uint32{}
+	var frees []func()
+	for _, name := range order {
+		s := targets[name]
+		h := s.prevFrameHandle
+		if !disabled[name] {
+			in, freeInputs := inputTextures(targets, inputs[name], textures)
+			s.inputs = in
+			h = s.nextHandle(interval)
+			s.inputs = nil
+			freeInputs()
+			if rendered != nil && h != nil {
+				rendered(name, s, h)
+			}
+		}
+		if h == nil {
+			textures[name] = s.initialFrame
+			continue
+		}
+		tex, free := s.renderer.Texture(h)
+		textures[name] = tex
+		frees = append(frees, free)
+	}
+	return textures, func() {
+		for _, free := range frees {
+			free()
+		}
+	}
+}
+
+// passFingerprint identifies the sources and the render target of a sub
+// environment. The sources are read before the environment is set up, so
+// includes are part of it, but the files that mappings load are not.
+func passFingerprint(env SubEnvironment) (string, error) {
+	sources, err := env.Sources()
+	if err != nil {
+		return "", err
+	}
+	stages := make([]string, 0, len(sources))
+	for stage := range sources {
+		stages = append(stages, string(stage))
+	}
+	sort.Strings(stages)
+	h := sha256.New()
+	fmt.Fprintf(h, "%dx%d %d %d %q\n", env.Width, env.Height, env.Format, env.Order, env.Inputs)
+	for _, stage := range stages {
+		for _, s := range sources[Stage(stage)] {
+			c, err := s.Contents()
+			if err != nil {
+				return "", err
+			}
+			fmt.Fprintf(h, "%s %d\n", stage, len(c))
+			h.Write(c)
+		}
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// reusablePasses are the sub targets of the current environment by name,
+// which the environment that replaces it takes over if their fingerprints are
+// unchanged. This keeps the state of the passes that are not edited.
+type reusablePasses map[string]reusablePass
+
+type reusablePass struct {
+	fingerprint string
+	shader      *Shader
+}
+
+func newReusablePasses(subTargets map[string]*Shader, fingerprints map[string]string) reusablePasses {
+	rp := reusablePasses{}
+	for name, s := range subTargets {
+		if fp, ok := fingerprints[name]; ok {
+			rp[name] = reusablePass{fingerprint: fp, shader: s}
+		}
+	}
+	return rp
+}
+
+// takenBy returns the passes that le took over.
+func (rp reusablePasses) takenBy(le *loadedEnvironment) reusablePasses {
+	taken := reusablePasses{}
+	for name, p := range rp {
+		if le != nil && le.subTargets[name] == p.shader {
+			taken[name] = p
+		}
+	}
+	return taken
+}
+
+// closeUnused closes the passes that le did not take over. le may be nil if
+// loading failed.
+func (rp reusablePasses) closeUnused(le *loadedEnvironment) {
+	for name, p := range rp {
+		if le == nil || le.subTargets[name] != p.shader {
+			p.shader.Close()
+		}
+	}
+}
+
+// without returns the sub targets that are not in rp.
+func (rp reusablePasses) without(subTargets map[string]*Shader) map[string]*Shader {
+	rest := make(map[string]*Shader, len(subTargets))
+	for name, s := range subTargets {
+		if p, ok := rp[name]; !ok || p.shader != s {
+			rest[name] = s
+		}
+	}
+	return rest
+}
+
+// inheritFrame takes over the time and a copy of the previous frame of the
+// pass that s replaces, so a simulation that reads its own output is not reset
+// when its program changes. Nothing is inherited if the size or the format of
+// the pass changed.
+func (s *Shader) inheritFrame(prev *Shader) error {
+	pr, prevPR := s.renderer.(*pboRenderer), prev.renderer.(*pboRenderer)
+	if prev.prevFrameHandle == nil || pr.w != prevPR.w || pr.h != prevPR.h || pr.format != prevPR.format {
+		return nil
+	}
+	if err := s.allocInitialFrame(nil); err != nil {
+		return err
+	}
+	src, free := prev.renderer.Texture(prev.prevFrameHandle)
+	copyTexture(s.initialFrame, src, int32(pr.w), int32(pr.h))
+	free()
+
+	// Simulations often initialize their state in the first frame.
+	s.time, s.frame = prev.time, prev.frame
+	return nil
+}
+
+// copyTexture copies the pixels of the texture src to dst, which have the
+// size w by h. The bindings of the framebuffers are restored afterwards.
+func copyTexture(dst, src uint32, w, h int32) {
+	var prevRead, prevDraw int32
+	gl.GetIntegerv(gl.READ_FRAMEBUFFER_BINDING, &prevRead)
+	gl.GetIntegerv(gl.DRAW_FRAMEBUFFER_BINDING, &prevDraw)
+	var fbos [2]uint32
+	gl.GenFramebuffers(2, &fbos[0])
+	gl.BindFramebuffer(gl.READ_FRAMEBUFFER, fbos[0])
+	gl.FramebufferTexture2D(gl.READ_FRAMEBUFFER, gl.COLOR_ATTACHMENT0, gl.TEXTURE_2D, src, 0)
+	gl.BindFramebuffer(gl.DRAW_FRAMEBUFFER, fbos[1])
+	gl.FramebufferTexture2D(gl.DRAW_FRAMEBUFFER, gl.COLOR_ATTACHMENT0, gl.TEXTURE_2D, dst, 0)
+	gl.BlitFramebuffer(0, 0, w, h, 0, 0, w, h, gl.COLOR_BUFFER_BIT, gl.NEAREST)
+	gl.BindFramebuffer(gl.READ_FRAMEBUFFER, uint32(prevRead))
+	gl.BindFramebuffer(gl.DRAW_FRAMEBUFFER, uint32(prevDraw))
+	gl.DeleteFramebuffers(2, &fbos[0])
+}
+
+// allocInitialFrame creates the initial frame with the pixels, which are in
+// the transfer type of the format. If pix is nil, the contents are undefined.
+// It has the size of the image before it is warped.
+func (s *Shader) allocInitialFrame(pix []byte) error {
+	pr := s.renderer.(*pboRenderer)
+	mem, err := ReserveMemory("the previous frame of a pass", int64(s.w)*int64(s.h)*int64(pr.format.bytesPerPixel()))
+	if err != nil {
+		return err
+	}
+	s.initialFrameMemory = mem
+	var data unsafe.Pointer
+	if pix != nil {
+		data = gl.Ptr(&pix[0])
+	}
+	gl.GenTextures(1, &s.initialFrame)
+	gl.BindTexture(gl.TEXTURE_2D, s.initialFrame)
+	gl.PixelStorei(gl.UNPACK_ALIGNMENT, 4)
+	gl.TexImage2D(gl.TEXTURE_2D, 0, pr.format.internalFormat(), int32(s.w), int32(s.h), 0, gl.RGBA, pr.format.transferType(), data)
+	gl.TexParameteri(gl.TEXTURE_2D, gl.TEXTURE_MAG_FILTER, gl.NEAREST)
+	gl.TexParameteri(gl.TEXTURE_2D, gl.TEXTURE_MIN_FILTER, gl.NEAREST)
+	gl.BindTexture(gl.TEXTURE_2D, 0)
+	return nil
+}
+
+func (s *Shader) freeInitialFrame() {
+	if s.initialFrame == 0 {
+		return
+	}
+	gl.DeleteTextures(1, &s.initialFrame)
+	s.initialFrame = 0
+	s.initialFrameMemory.Release()
+	s.initialFrameMemory = nil
+}
@@ -0,0 +1,119 @@
+package renderer
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/go-gl/glfw/v3.3/glfw"
+)
+
+func TestPassControls(t *testing.T) {
+	var pc passControls
+	pc.setPasses([]string{"BufferA", "BufferB"})
+	if err := pc.SetEnabled("BufferB", false); err != nil {
+		t.Fatal(err)
+	}
+	if err := pc.SetSolo("BufferA"); err != nil {
+		t.Fatal(err)
+	}
+	if err := pc.SetEnabled("missing", false); err == nil {
+		t.Errorf("an unknown pass was disabled")
+	}
+	if err := pc.SetSolo("missing"); err == nil {
+		t.Errorf("an unknown pass was soloed")
+	}
+	expected := []PassState{
+		{Name: "BufferA", Enabled: true, Solo: true},
+		{Name: "BufferB", Enabled: false},
+	}
+	if states := pc.States(); !reflect.DeepEqual(states, expected) {
+		t.Errorf("unexpected states %+v, expected %+v", states, expected)
+	}
+
+	// States are kept for passes that still exist after a reload.
+	pc.setPasses([]string{"BufferB", "BufferC"})
+	disabled, solo := pc.current()
+	if !disabled["BufferB"] || solo != "" {
+		t.Errorf("unexpected state after reload: %v, %q", disabled, solo)
+	}
+	pc.setPasses([]string{"BufferA", "BufferB"})
+	if _, solo := pc.current(); solo != "BufferA" {
+		t.Errorf("the solo pass was not restored: %q", solo)
+	}
+}
+
+func TestPassHotkeys(t *testing.T) {
+	var pc passControls
+	pc.setPasses([]string{"BufferA", "BufferB"})
+	pc.onKey(glfw.Key2, glfw.Press, 0)
+	pc.onKey(glfw.Key1, glfw.Press, glfw.ModShift)
+	pc.onKey(glfw.Key9, glfw.Press, 0)
+	expected := []PassState{
+		{Name: "BufferA", Enabled: false},
+		{Name: "BufferB", Enabled: true, Solo: true},
+	}
+	if states := pc.States(); !reflect.DeepEqual(states, expected) {
+		t.Errorf("unexpected states %+v, expected %+v", states, expected)
+	}
+	pc.onKey(glfw.Key0, glfw.Press, 0)
+	if _, solo := pc.current(); solo != "" {
+		t.Errorf("0 did not show the final image, solo is %q", solo)
+	}
+}
+
+// sourcesEnv is an environment of which only the sources are used.
+type sourcesEnv map[Stage][]Source
+
+func (env sourcesEnv) Sources() (map[Stage][]Source, error)                { return env, nil }
+func (env sourcesEnv) Setup(RenderState) error                             { return nil }
+func (env sourcesEnv) SubEnvironments() (map[string]SubEnvironment, error) { return nil, nil }
+func (env sourcesEnv) PreRender(RenderState)                               {}
+func (env sourcesEnv) Close() error                                        { return nil }
+
+func TestPassFingerprint(t *testing.T) {
+	pass := func(src string, width uint, inputs ...string) SubEnvironment {
+		return SubEnvironment{
+			Environment: sourcesEnv{StageFragment: {SourceBuf("#version 330\n"), SourceBuf(src)}},
+			Width:       width,
+			Height:      64,
+			Inputs:      inputs,
+		}
+	}
+	fingerprint := func(env SubEnvironment) string {
+		fp, err := passFingerprint(env)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return fp
+	}
+	base := fingerprint(pass("void mainImage() {}", 64, "BufA"))
+	if fp := fingerprint(pass("void mainImage() {}", 64, "BufA")); fp != base {
+		t.Errorf("expected the fingerprints of the same pass to be equal")
+	}
+	for i, env := range []SubEnvironment{
+		pass("void mainImage() { }", 64, "BufA"),
+		pass("void mainImage() {}", 32, "BufA"),
+		pass("void mainImage() {}", 64, "BufA", "BufB"),
+	} {
+		if fingerprint(env) == base {
+			t.Errorf("%d: expected the fingerprint to change", i)
+		}
+	}
+}
+
+func TestReusablePasses(t *testing.T) {
+	a, b, c := &Shader{}, &Shader{}, &Shader{}
+	reuse := newReusablePasses(map[string]*Shader{"BufA": a, "BufB": b, "BufC": c}, map[string]string{"BufA": "fa", "BufB": "fb"})
+	if len(reuse) != 2 {
+		t.Fatalf("expected only the passes with a fingerprint, got %v", reuse)
+	}
+	next := &loadedEnvironment{subTargets: map[string]*Shader{"BufA": a, "BufB": {}}}
+	taken := reuse.takenBy(next)
+	if len(taken) != 1 || taken["BufA"].shader != a {
+		t.Errorf("unexpected taken passes %v", taken)
+	}
+	rest := taken.without(map[string]*Shader{"BufA": a, "BufB": b, "BufC": c})
+	if len(rest) != 2 || rest["BufB"] != b || rest["BufC"] != c {
+		t.Errorf("unexpected remaining passes %v", rest)
+	}
+}
@@ -0,0 +1,206 @@
+package renderer
+
+import (
+	"regexp"
+	"sort"
+	"strings"
+)
+
+var (
+	identifierRe = regexp.MustCompile(`\b[A-Za-z_]\w*`)
+	arraySizeRe  = regexp.MustCompile(`\[[^\]]*\]`)
+	// ppKeepRe matches the directives of which the identifiers are not
+	// prefixed, like the paths of includes.
+	ppKeepRe = regexp.MustCompile(`(?m)^[ \t]*#[ \t]*(?:pragma|version|extension|line)\b.*$`)
+	// sharedQualifiers are the qualifiers of declarations that are shared
+	// with the rest of the program, which keep their names.
+	sharedQualifiers = map[string]bool{
+		"uniform": true, "in": true, "out": true, "inout": true, "varying": true,
+		"attribute": true, "buffer": true, "shared": true, "precision": true,
+	}
+)
+
+// PrefixedSource is a source that is included with
+// `#pragma use "lib.glsl" prefix(sdf_)`. The identifiers that it declares at
+// the top level, like functions, constants, structs and macros, are prefixed,
+// so libraries that use the same names can be included together. Uniforms,
+// inputs and outputs keep their names.
+type PrefixedSource struct {
+	Source
+	Prefix string
+}
+
+// Contents implements the Source interface.
+func (s PrefixedSource) Contents() ([]byte, error) {
+	c, err := s.Source.Contents()
+	if err != nil {
+		return nil, err
+	}
+	return []byte(prefixIdentifiers(string(c), s.Prefix)), nil
+}
+
+// OriginSource returns the source that s is derived from, like the file of a
+// PrefixedSource or ParameterizedSource.
+func OriginSource(s Source) Source {
+	for {
+		switch t := s.(type) {
+		case PrefixedSource:
+			s = t.Source
+		case ParameterizedSource:
+			s = t.Source
+		case liftedSource:
+			s = t.Source
+		default:
+			return s
+		}
+	}
+}
+
+// prefixIdentifiers prefixes the uses of the identifiers that the source
+// declares at the top level. Members of structs are left alone.
+func prefixIdentifiers(src, prefix string) string {
+	names, keep, structs := topLevelNames(src)
+	if len(names) == 0 {
+		return src
+	}
+	for _, r := range ppKeepRe.FindAllStringIndex(src, -1) {
+		keep = append(keep, [2]int{r[0], r[1]})
+	}
+	sort.Slice(keep, func(i, j int) bool { return keep[i][0] < keep[j][0] })
+
+	var out strings.Builder
+	prev := 0
+	k := 0
+	for _, m := range identifierRe.FindAllStringIndex(src, -1) {
+		for k < len(keep) && keep[k][1] <= m[0] {
+			k++
+		}
+		if k < len(keep) && keep[k][0] <= m[0] {
+			continue
+		}
+		if !names[src[m[0]:m[1]]] || strings.HasSuffix(strings.TrimRight(src[:m[0]], " \t"), ".") {
+			continue
+		}
+		if inRanges(structs, m[0]) {
+			// Members are followed by a ; , or [, unlike their types.
+			if rest := strings.TrimLeft(src[m[1]:], " \t\r\n"); rest == "" || strings.IndexByte(";,[", rest[0]) >= 0 {
+				continue
+			}
+		}
+		out.WriteString(src[prev:m[0]])
+		out.WriteString(prefix)
+		prev = m[0]
+	}
+	out.WriteString(src[prev:])
+	return out.String()
+}
+
+func inRanges(ranges [][2]int, offset int) bool {
+	for _, r := range ranges {
+		if r[0] <= offset && offset < r[1] {
+			return true
+		}
+	}
+	return false
+}
+
+// topLevelNames returns the identifiers that are declared at the top level of
+// a source, the ranges of interface blocks, which are not to be prefixed, and
+// the ranges of the bodies of structs.
+func topLevelNames(src string) (map[string]bool, [][2]int, [][2]int) {
+	code, _ := glslCode(src)
+	names := map[string]bool{}
+	var keep, structs [][2]int
+	stmtStart := 0
+	// block is set after an interface block, of which the instance name is
+	// shared as well.
+	block := false
+	for i := 0; i < len(code); i++ {
+		switch code[i] {
+		case ';':
+			if !block {
+				declaredNames(string(code[stmtStart:i]), names)
+			}
+			stmtStart, block = i+1, false
+		case '}':
+			stmtStart = i + 1
+		case '{':
+			end := matchingBrace(code, i)
+			if end < 0 {
+				i = len(code)
+				break
+			}
+			head := strings.Fields(string(code[stmtStart:i]))
+			if fn, ok := parseFunction(code, stmtStart, i, end); ok {
+				names[fn.name] = true
+			} else {
+				if len(head) == 2 && head[0] == "struct" {
+					names[head[1]] = true
+					structs = append(structs, [2]int{i, end})
+				} else {
+					block = true
+					keep = append(keep, [2]int{i, end})
+				}
+			}
+			i, stmtStart = end-1, end
+		}
+	}
+	for _, line := range strings.Split(src, "\n") {
+		if m := ppDefineRe.FindStringSubmatch(line); m != nil {
+			names[m[1]] = true
+		}
+	}
+	delete(names, "main")
+	return names, keep, structs
+}
+
+// declaredNames adds the names of the variables or the function prototype that
+// a top level statement declares.
+func declaredNames(stmt string, names map[string]bool) {
+	for _, f := range strings.Fields(stmt) {
+		if sharedQualifiers[f] || strings.HasPrefix(f, "layout") {
+			return
+		}
+	}
+	for i, decl := range splitArguments(stmt) {
+		if j := strings.IndexByte(decl, '='); j >= 0 {
+			decl = decl[:j]
+		}
+		if j := strings.IndexByte(decl, '('); j >= 0 {
+			if i == 0 {
+				// A prototype.
+				if f := strings.Fields(decl[:j]); len(f) >= 2 {
+					names[f[len(f)-1]] = true
+				}
+			}
+			return
+		}
+		f := strings.Fields(arraySizeRe.ReplaceAllString(decl, " "))
+		if len(f) == 0 || (i == 0 && len(f) < 2) {
+			continue
+		}
+		if name := f[len(f)-1]; identifierRe.FindString(name) == name {
+			names[name] = true
+		}
+	}
+}
+
+// splitArguments splits at the commas that are not inside of parentheses.
+func splitArguments(s string) []string {
+	var parts []string
+	depth, start := 0, 0
+	for i, c := range s {
+		switch c {
+		case '(':
+			depth++
+		case ')':
+			depth--
+		case ',':
+			if depth == 0 {
+				parts = append(parts, s[start:i])
+				start = i + 1
+			}
+		}
+	}
+	return append(parts, s[start:])
+}
@@ -0,0 +1,78 @@
+package renderer
+
+import (
+	"testing"
+	"testing/fstest"
+)
+
+func TestPrefixIdentifiers(t *testing.T) {
+	src := `#ifndef SDF_LIB
+#define SDF_LIB
+#define EPS 0.001
+#pragma use "box.glsl"
+uniform float iTime;
+const float PI = 3.14159, TAU = 2.0 * PI;
+struct Hit { float d; vec3 p; };
+float box(vec3 p, vec3 b);
+// box of size b
+Hit scene(vec3 p) {
+	Hit h;
+	h.d = box(p, vec3(PI)) - EPS + iTime;
+	h.p = p;
+	float d = h.d;
+	return h;
+}
+float box(vec3 p, vec3 b) { return length(max(abs(p) - b, 0.0)); }
+void main() {}
+#endif
+`
+	expected := `#ifndef sdf_SDF_LIB
+#define sdf_SDF_LIB
+#define sdf_EPS 0.001
+#pragma use "box.glsl"
+uniform float iTime;
+const float sdf_PI = 3.14159, sdf_TAU = 2.0 * sdf_PI;
+struct sdf_Hit { float d; vec3 p; };
+float sdf_box(vec3 p, vec3 b);
+// sdf_box of size b
+sdf_Hit sdf_scene(vec3 p) {
+	sdf_Hit h;
+	h.d = sdf_box(p, vec3(sdf_PI)) - sdf_EPS + iTime;
+	h.p = p;
+	float d = h.d;
+	return h;
+}
+float sdf_box(vec3 p, vec3 b) { return length(max(abs(p) - b, 0.0)); }
+void main() {}
+#endif
+`
+	if out := prefixIdentifiers(src, "sdf_"); out != expected {
+		t.Errorf("unexpected output:\n%s", out)
+	}
+}
+
+func TestIncludePrefix(t *testing.T) {
+	fsys := fstest.MapFS{
+		"main.glsl":  {Data: []byte("#pragma use \"noise.glsl\" prefix(a_)\n#pragma use \"noise.glsl\" prefix(b_)\n#pragma use \"noise.glsl\"\n")},
+		"noise.glsl": {Data: []byte("float hash21(vec2 p) { return p.x; }\n")},
+	}
+	sources, err := IncludeSources(FSResolver{FS: fsys}, SourceFS{FS: fsys, Name: "main.glsl"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sources) != 4 {
+		t.Fatalf("unexpected number of sources: exp %v, got %v", 4, len(sources))
+	}
+	for i, expected := range []string{"float a_hash21(vec2 p) { return p.x; }\n", "float b_hash21(vec2 p) { return p.x; }\n", "float hash21(vec2 p) { return p.x; }\n"} {
+		c, err := sources[i].Contents()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(c) != expected {
+			t.Errorf("unexpected contents of source %d: %q", i, c)
+		}
+		if OriginSource(sources[i]).(SourceFS).Name != "noise.glsl" {
+			t.Errorf("unexpected origin of source %d", i)
+		}
+	}
+}
@@ -1,67 +1,203 @@
 package renderer
 
 import (
-	"io/ioutil"
+	"fmt"
 	"path/filepath"
 	"regexp"
+	"sort"
+	"strings"
 )
 
-var ppIncludeRe = regexp.MustCompile(`(?im)^#pragma\s+use\s+"([^"]+)"$`)
+var (
+	ppIncludeRe     = regexp.MustCompile(`(?im)^#pragma\s+use\s+"([^"]+)"(.*)$`)
+	includeOptionRe = regexp.MustCompile(`^\s*(prefix|with)\s*\(`)
+	includeIdentRe  = regexp.MustCompile(`^\w+$`)
+)
+
+// ParameterizedSource is a source that is included with
+// `#pragma use "blur.glsl" with (RADIUS=5)`. The macros are defined at the
+// top of the source and undefined at the end, so one library can be included
+// several times with different values. Their line numbers are unchanged.
+type ParameterizedSource struct {
+	Source
+	Defines map[string]string
+}
+
+// Contents implements the Source interface.
+func (s ParameterizedSource) Contents() ([]byte, error) {
+	c, err := s.Source.Contents()
+	if err != nil {
+		return nil, err
+	}
+	var defines, undefs strings.Builder
+	for _, name := range s.names() {
+		// A macro that is defined for the whole program is replaced.
+		fmt.Fprintf(&defines, "#undef %s\n#define %s %s\n", name, name, s.Defines[name])
+		fmt.Fprintf(&undefs, "#undef %s\n", name)
+	}
+	return []byte(insertAfterVersion(string(c), defines.String()) + "\n" + undefs.String()), nil
+}
+
+func (s ParameterizedSource) names() []string {
+	names := make([]string, 0, len(s.Defines))
+	for name := range s.Defines {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// includeOptions parses the options that follow the path of an include:
+// `prefix(NAME)` and `with (NAME=VALUE, ...)`, in any order.
+func includeOptions(opts string) (prefix string, defines map[string]string, err error) {
+	if i := strings.Index(opts, "//"); i >= 0 {
+		opts = opts[:i]
+	}
+	for strings.TrimSpace(opts) != "" {
+		m := includeOptionRe.FindStringSubmatch(opts)
+		if m == nil {
+			return "", nil, fmt.Errorf("unknown option %q, expected prefix(...) or with (...)", strings.TrimSpace(opts))
+		}
+		open := len(m[0]) - 1
+		end := matchingParen(opts, open)
+		if end < 0 {
+			return "", nil, fmt.Errorf("unterminated %s(", m[1])
+		}
+		arg := strings.TrimSpace(opts[open+1 : end-1])
+		switch m[1] {
+		case "prefix":
+			if !includeIdentRe.MatchString(arg) {
+				return "", nil, fmt.Errorf("invalid prefix %q", arg)
+			}
+			prefix = arg
+		case "with":
+			defines = map[string]string{}
+			for _, d := range splitArguments(arg) {
+				name, value, err := ParseDefine(strings.TrimSpace(d))
+				if err != nil {
+					return "", nil, err
+				}
+				defines[name] = value
+			}
+		}
+		opts = opts[end:]
+	}
+	return prefix, defines, nil
+}
+
+// matchingParen returns the offset after the parenthesis that closes the one
+// at open, or -1 if it is not closed.
+func matchingParen(s string, open int) int {
+	depth := 0
+	for i := open; i < len(s); i++ {
+		switch s[i] {
+		case '(':
+			depth++
+		case ')':
+			if depth--; depth == 0 {
+				return i + 1
+			}
+		}
+	}
+	return -1
+}
 
 // Includes recursively resolves dependencies in the specified file.
 //
 // The argument file is returned included in the returned list of files.
 func Includes(filenames ...string) ([]string, error) {
-	return processRecursive(filenames, []string{})
-}
-
-func processRecursive(filenames []string, sources []string) ([]string, error) {
-	for _, filename := range filenames {
+	sources := make([]Source, len(filenames))
+	for i, filename := range filenames {
 		absFilename, err := filepath.Abs(filename)
 		if err != nil {
 			return nil, err
 		}
-		currentFile := absFilename
-		shaderSource, err := ioutil.ReadFile(currentFile)
+		sources[i] = SourceFile{Filename: absFilename}
+	}
+	resolved, err := IncludeSources(FileResolver{}, sources...)
+	files := make([]string, 0, len(resolved))
+	for _, s := range resolved {
+		if f, ok := OriginSource(s).(SourceFile); ok {
+			files = append(files, f.Filename)
+		}
+	}
+	return files, err
+}
+
+// IncludeSources recursively resolves the includes of the sources with the
+// resolver. The included sources come before the sources that include them in
+// the returned list, which ends with the argument sources. Every source is
+// included only once.
+func IncludeSources(resolver Resolver, sources ...Source) ([]Source, error) {
+	return processRecursive(resolver, sources, []Source{}, nil)
+}
+
+// processRecursive appends the sources and their includes to resolved. parents
+// are the sources that include the sources, directly or indirectly.
+func processRecursive(resolver Resolver, sources, resolved, parents []Source) ([]Source, error) {
+	for _, current := range sources {
+		if containsSource(resolved, current) {
+			// The source was included by one of the sources before it.
+			continue
+		}
+		shaderSource, err := current.Contents()
 		if err != nil {
 			return nil, err
 		}
 
 		// We need to check for recursion using a set that includes the current
-		// file. But we need to append the current file after all included sources
-		// in the list of files. Create a new temporary set of included source
-		// files for the recursion check.
-		checkset := append(sources, currentFile)
+		// file and the files that include it. But we need to append the current
+		// file after all included sources in the list of files. Create a new
+		// temporary set of included source files for the recursion check.
+		ancestors := append(append([]Source{}, parents...), current)
+		checkset := append(append([]Source{}, resolved...), ancestors...)
 
 		// Check for files being included in the current file so we can later
 		// recurse into all of them.
 		includeMatches := ppIncludeRe.FindAllSubmatch(shaderSource, -1)
-		includes := make([]string, 0, len(includeMatches))
-	outer:
+		includes := make([]Source, 0, len(includeMatches))
 		for _, submatch := range includeMatches {
-			includedFile := string(submatch[1])
-			if !filepath.IsAbs(includedFile) {
-				includedFile = filepath.Join(filepath.Dir(absFilename), includedFile)
-			} else {
-				includedFile = filepath.Clean(includedFile)
+			prefix, defines, err := includeOptions(string(submatch[2]))
+			if err != nil {
+				return nil, fmt.Errorf("#pragma use %q: %w", submatch[1], err)
+			}
+			included, err := resolver.Resolve(current.Dir(), string(submatch[1]))
+			if err != nil {
+				return nil, err
+			}
+			// The macros are defined before the identifiers are prefixed,
+			// so they are prefixed along with the uses in the source.
+			if len(defines) > 0 {
+				included = ParameterizedSource{Source: included, Defines: defines}
+			}
+			if prefix != "" {
+				included = PrefixedSource{Source: included, Prefix: prefix}
 			}
 
 			// Check whether we have already included the referred file. This stops
 			// infinite recursions.
-			for _, inc := range checkset {
-				if inc == includedFile {
-					continue outer
-				}
+			if containsSource(checkset, included) {
+				continue
 			}
-			includes = append(includes, includedFile)
+			includes = append(includes, included)
 		}
 
-		sources, err = processRecursive(includes, sources)
+		resolved, err = processRecursive(resolver, includes, resolved, ancestors)
 		if err != nil {
 			return nil, err
 		}
-		sources = append(sources, currentFile)
+		resolved = append(resolved, current)
 	}
 
-	return sources, nil
+	return resolved, nil
+}
+
+func containsSource(sources []Source, s Source) bool {
+	id := sourceID(s)
+	for _, inc := range sources {
+		if sourceID(inc) == id {
+			return true
+		}
+	}
+	return false
 }
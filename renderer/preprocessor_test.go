@@ -1,7 +1,12 @@
 package renderer
 
 import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
 	"testing"
+	"testing/fstest"
 )
 
 func TestPlain(t *testing.T) {
@@ -43,3 +48,101 @@ func TestStopRecursionCycle(t *testing.T) {
 		t.Fatalf("unexpected number of sources: exp %v, got %v", 1, len(sources))
 	}
 }
+
+func TestIncludeSearchPath(t *testing.T) {
+	dir := t.TempDir()
+	lib := filepath.Join(dir, "lib")
+	if err := os.Mkdir(lib, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(lib, "noise.glsl"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	main := SourceBuf(`#pragma use "noise.glsl"`)
+
+	sources, err := IncludeSources(FileResolver{SearchPath: []string{lib}}, main)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sources) != 2 || sources[0] != (SourceFile{Filename: filepath.Join(lib, "noise.glsl")}) {
+		t.Fatalf("unexpected sources: %v", sources)
+	}
+	if _, err := IncludeSources(FileResolver{SearchPath: []string{dir}}, main); err == nil {
+		t.Fatalf("an include that is not in the search path was resolved")
+	}
+}
+
+func TestIncludeFS(t *testing.T) {
+	fsys := fstest.MapFS{
+		"main.glsl":       {Data: []byte(`#pragma use "lib/a.glsl"`)},
+		"lib/a.glsl":      {Data: []byte("#pragma use \"b.glsl\"\n#pragma use \"/main.glsl\"")},
+		"lib/b.glsl":      {Data: []byte(`#pragma use "a.glsl"`)},
+		"lib/unused.glsl": {},
+	}
+	sources, err := IncludeSources(FSResolver{FS: fsys}, SourceFS{FS: fsys, Name: "main.glsl"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, s := range sources {
+		names = append(names, s.(SourceFS).Name)
+	}
+	if len(names) != 3 || names[0] != "lib/b.glsl" || names[1] != "lib/a.glsl" || names[2] != "main.glsl" {
+		t.Fatalf("unexpected sources: %v", names)
+	}
+}
+
+func TestIncludeURL(t *testing.T) {
+	server := httptest.NewServer(http.FileServer(http.Dir("../testdata/preprocessor")))
+	defer server.Close()
+
+	resolver := URLResolver{Next: FileResolver{}}
+	sources, err := IncludeSources(resolver, SourceURL{URL: server.URL + "/include-recursive.glsl"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sources) != 3 {
+		t.Fatalf("unexpected number of sources: exp %v, got %v", 3, len(sources))
+	}
+	if u := sources[0].(SourceURL).URL; u != server.URL+"/include-recursive-dep2.glsl" {
+		t.Fatalf("unexpected first source: %s", u)
+	}
+}
+
+func TestIncludeWith(t *testing.T) {
+	fsys := fstest.MapFS{
+		"main.glsl": {Data: []byte("#pragma use \"blur.glsl\" with (RADIUS=5, TINT=vec3(1, 0, 0)) prefix(big_)\n#pragma use \"blur.glsl\" prefix(small_) with (RADIUS=1)\n")},
+		"blur.glsl": {Data: []byte("#ifndef RADIUS\n#define RADIUS 3\n#endif\nfloat blur(float x) { return x * float(RADIUS); }\n")},
+	}
+	sources, err := IncludeSources(FSResolver{FS: fsys}, SourceFS{FS: fsys, Name: "main.glsl"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sources) != 3 {
+		t.Fatalf("unexpected number of sources: exp %v, got %v", 3, len(sources))
+	}
+	c, err := sources[1].Contents()
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := "#undef small_RADIUS\n#define small_RADIUS 1\n#line 1\n#ifndef small_RADIUS\n#define small_RADIUS 3\n#endif\nfloat small_blur(float x) { return x * float(small_RADIUS); }\n\n#undef small_RADIUS\n"
+	if string(c) != expected {
+		t.Errorf("unexpected contents:\n%s", c)
+	}
+	if p := sources[0].(PrefixedSource).Source.(ParameterizedSource); p.Defines["TINT"] != "vec3(1, 0, 0)" || p.Defines["RADIUS"] != "5" {
+		t.Errorf("unexpected macros %v", p.Defines)
+	}
+
+	if _, err := dedupeFunctions([]Source{ParameterizedSource{Source: sources[0].(PrefixedSource).Source, Defines: map[string]string{"RADIUS": "2"}}, SourceFS{FS: fsys, Name: "blur.glsl"}}); err == nil {
+		t.Errorf("expected an error for the same function with other macros")
+	}
+
+	for _, opts := range []string{" with (RADIUS=5", " prefix(1-)", " as lib", " with (=5)"} {
+		if _, _, err := includeOptions(opts); err == nil {
+			t.Errorf("expected an error for %q", opts)
+		}
+	}
+	if prefix, defines, err := includeOptions(" // the library"); err != nil || prefix != "" || defines != nil {
+		t.Errorf("unexpected options of a comment: %q, %v, %v", prefix, defines, err)
+	}
+}
@@ -12,12 +12,14 @@ import (
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/go-gl/gl/v3.3-core/gl"
 	"github.com/go-gl/glfw/v3.3/glfw"
 
 	"github.com/polyfloyd/shady/egl"
+	"github.com/polyfloyd/shady/encode"
 )
 
 const (
@@ -34,9 +36,11 @@ const (
 		out vec4 fragColor;
 		in vec2 texCoord;
 		uniform sampler2D screenTexture;
+		uniform float brightness;
 
 		void main() {
-			fragColor = texture(screenTexture, texCoord);
+			vec4 color = texture(screenTexture, texCoord);
+			fragColor = vec4(color.rgb * brightness, color.a);
 		}
 	`)
 )
@@ -52,7 +56,19 @@ const (
 
 var ErrWindowClosed = errors.New("window closed")
 
-var initGLOnce sync.Once
+var (
+	initGLOnce        sync.Once
+	initCurrentGLOnce sync.Once
+	// initGLErr is the error of creating the context for off-screen
+	// rendering, which is only attempted once.
+	initGLErr error
+	// initCurrentGLErr is the error of loading the functions of the current
+	// context, which is also only attempted once.
+	initCurrentGLErr error
+)
+
+// eglContext is the context used for offscreen rendering.
+var eglContext *egl.Context
 
 func initEGL(glVersion OpenGLVersion) error {
 	display, err := egl.GetDisplay(egl.DefaultDisplay)
@@ -72,6 +88,7 @@ func initEGL(glVersion OpenGLVersion) error {
 		return err
 	}
 	glContext.MakeCurrent()
+	eglContext = glContext
 	return nil
 }
 
@@ -93,6 +110,14 @@ func initOpenGL() error {
 }
 
 type Shader struct {
+	// timeSkip is added to the time before rendering the next frame. It is
+	// accessed atomically and kept first in the struct to be 64-bit
+	// aligned on 32-bit platforms.
+	timeSkip int64
+	// resume is set if the environment should be resumed before the next
+	// frame, see Resume. It is accessed atomically.
+	resume int32
+
 	w, h      uint
 	glVersion OpenGLVersion
 
@@ -104,34 +129,139 @@ type Shader struct {
 	renderer imageRenderer
 	program  uint32
 
-	env     Environment
-	newEnvs chan Environment
+	env         Environment
+	newEnvs     chan Environment
+	canary      bool
+	keepOnError bool
+	tweak       bool
+	tweaks      *tweakSet
+	onLoad      func(error)
+	// defines are the macros that are set explicitly, activeDefines are
+	// those of the current environment.
+	defines       map[string]string
+	activeDefines map[string]string
+	// userStore holds the values of userUniforms, the uniforms that the
+	// sources of the current environment declare.
+	userStore    *UserUniforms
+	userUniforms *userUniformSet
 
 	subTargets map[string]*Shader
+	subOrder   []string
+	subInputs  map[string][]string
+	// subFingerprints identify the sub targets, so the unchanged ones are
+	// kept when the environment is reloaded.
+	subFingerprints map[string]string
+	exports         map[string]func(PixelData)
+	exportAll       func(name string, data PixelData)
+	// inputs holds the textures of the sibling sub targets that this Shader
+	// reads, set by the parent for the next frame.
+	inputs map[string]uint32
+
+	frameCallback func(GPUFrame)
 
 	time            time.Duration
 	frame           uint64
+	seed            int64
+	startDate       time.Time
 	prevFrameHandle interface{}
+	// initialFrame is a texture that stands in for the previous frame until
+	// the first frame is rendered, see inheritFrame.
+	initialFrame       uint32
+	initialFrameMemory *MemoryReservation
+	// initialState is restored for the next environment that is loaded, see
+	// SetInitialState.
+	initialState  *State
+	stateRequests chan stateRequest
+	// idle is set if the previous frame was not rendered because it would
+	// have been identical to the one before, see IdleEnvironment.
+	idle bool
+	// reloaded is set if the environment changed since the previous frame.
+	reloaded bool
+
+	accumulation AccumulationOptions
+	acc          *accumulator
+
+	warp        *warper
+	warpTargets [2]struct {
+		fbo, tex uint32
+	}
+	warpTarget int
+	warpMemory *MemoryReservation
+
+	clocks *Clocks
+	loop   time.Duration
+	// input is the input of the window of the engine if the shader renders
+	// a pass of it.
+	input *Input
+	// tile is the part of the image that is rendered, if it is rendered in
+	// tiles.
+	tile *Tile
+
+	health Health
 }
 
 func NewShader(width, height uint, glVersion OpenGLVersion) (*Shader, error) {
+	return newShader(width, height, glVersion, PixelFormatRGBA8)
+}
+
+func newShader(width, height uint, glVersion OpenGLVersion, format PixelFormat) (*Shader, error) {
+	if err := initOffScreenGL(glVersion); err != nil {
+		return nil, err
+	}
+	return newShaderInContext(width, height, glVersion, format)
+}
+
+// initOffScreenGL creates the context of the process for off-screen rendering
+// and makes it current, if that has not been done yet.
+func initOffScreenGL(glVersion OpenGLVersion) error {
 	// Hack: Unit tests require a different style of initialization. We'll
 	// detect whether we are running as a test for now.
-	var err error
 	if strings.HasSuffix(os.Args[0], ".test") {
-		err = initOpenGL()
-		if err == nil {
-			err = initEGL(glVersion)
+		if err := initOpenGL(); err != nil {
+			return err
 		}
-	} else {
-		initGLOnce.Do(func() {
-			err = initOpenGL()
-			if err == nil {
-				err = initEGL(glVersion)
-			}
-		})
+		return initEGL(glVersion)
 	}
-	if err != nil {
+	initGLOnce.Do(func() {
+		// The functions are loaded for the context, so it is created
+		// first.
+		initGLErr = initContext(glVersion)
+		if initGLErr == nil {
+			initGLErr = initOpenGL()
+		}
+	})
+	return initGLErr
+}
+
+// NewShaderInCurrentContext creates a Shader that renders with the OpenGL
+// context that is current on the calling thread, instead of creating its own
+// context. This allows applications with an existing context to render shady
+// passes inline. To keep the state of the application separate, create a
+// context that shares objects with it and make that current instead.
+//
+// All methods of the Shader must be called from the thread of the context.
+// Rendering changes the bound program, buffers and textures. The framebuffer
+// binding and viewport are restored.
+func NewShaderInCurrentContext(width, height uint) (*Shader, error) {
+	if err := initCurrentGL(); err != nil {
+		return nil, err
+	}
+	return newShaderInContext(width, height, 0, PixelFormatRGBA8)
+}
+
+// initCurrentGL loads the functions of OpenGL for the current context. It
+// returns the same error to every caller if that failed.
+func initCurrentGL() error {
+	initCurrentGLOnce.Do(func() {
+		initCurrentGLErr = initOpenGL()
+	})
+	return initCurrentGLErr
+}
+
+// newShaderInContext creates a Shader in the current context, which must be
+// initialized.
+func newShaderInContext(width, height uint, glVersion OpenGLVersion, format PixelFormat) (*Shader, error) {
+	if err := checkRenderTarget(width, height, format); err != nil {
 		return nil, err
 	}
 
@@ -139,8 +269,10 @@ func NewShader(width, height uint, glVersion OpenGLVersion) (*Shader, error) {
 		w:         width,
 		h:         height,
 		glVersion: glVersion,
-		renderer:  &pboRenderer{w: width, h: height},
+		renderer:  &pboRenderer{w: width, h: height, format: format},
 		newEnvs:   make(chan Environment, 1),
+
+		stateRequests: make(chan stateRequest),
 	}
 
 	// Set up the render targets.
@@ -154,7 +286,7 @@ func NewShader(width, height uint, glVersion OpenGLVersion) (*Shader, error) {
 
 // reloadEnvironment ensures that an environment is set and set up for
 // rendering.
-func (sh *Shader) reloadEnvironment(ctx context.Context) error {
+func (sh *Shader) reloadEnvironment(ctx context.Context) (err error) {
 	var env Environment
 	if sh.env == nil {
 		// If no environment is set, block until it is set or the context is
@@ -174,92 +306,465 @@ func (sh *Shader) reloadEnvironment(ctx context.Context) error {
 		}
 	}
 
-	// Close the old environment if there is one.
-	if sh.env != nil {
-		sh.env.Close()
-		gl.DeleteProgram(sh.program)
-		sh.env = nil
-	}
 	if env == nil {
+		sh.closeEnvironment()
 		return nil
 	}
+	if sh.onLoad != nil {
+		defer func() { sh.onLoad(err) }()
+	}
+	// The passes that did not change are taken over by the next
+	// environment, so their state survives editing the others.
+	reuse := newReusablePasses(sh.subTargets, sh.subFingerprints)
+	if !sh.canary && !sh.keepOnError {
+		// Unless it is kept, the old environment is closed first so
+		// inputs like cameras are free to be opened again.
+		sh.closeEnvironmentKeeping(reuse)
+	}
 
 	renderState := RenderState{
 		Time:            sh.time,
 		FramesProcessed: sh.frame,
+		Seed:            sh.seed,
+		Date:            dateAt(sh.startDate, sh.time),
 		CanvasWidth:     sh.w,
 		CanvasHeight:    sh.h,
+		Loop:            sh.loop,
 		Uniforms:        sh.uniforms,
+		Defines:         sh.defines,
+	}
+	next, err := loadEnvironment(env, renderState, sh.glVersion, sh.tweak, sh.userStore, reuse, func(s *Shader) {
+		s.seed = sh.seed
+		s.startDate = sh.startDate
+		s.clocks = sh.clocks
+		s.loop = sh.loop
+		s.input = sh.input
+		s.tweak = sh.tweak
+		s.defines = sh.defines
+		s.userStore = sh.userStore
+	})
+	if err != nil {
+		if sh.env != nil {
+			return fmt.Errorf("keeping the current shader: %w", err)
+		}
+		reuse.closeUnused(nil)
+		return err
 	}
-	if err := env.Setup(renderState); err != nil {
-		return fmt.Errorf("error setting up environment: %w", err)
+	if sh.env != nil {
+		if sh.canary {
+			renderState.Clocks = sh.clocks.at(sh.time)
+			if err := next.canary(renderState, sh.vao, sh.vbo); err != nil {
+				next.Close()
+				return fmt.Errorf("keeping the current shader: %w", err)
+			}
+		}
+		sh.closeEnvironmentKeeping(reuse.takenBy(next))
+	} else {
+		reuse.closeUnused(next)
+	}
+	sh.env = next.env
+	sh.reloaded = true
+	sh.program = next.program
+	sh.uniforms = next.uniforms
+	sh.tweaks = next.tweaks
+	sh.activeDefines = next.defines
+	sh.userUniforms = next.userUniforms
+	sh.vertLoc = next.vertLoc
+	sh.subTargets = next.subTargets
+	sh.subOrder = next.subOrder
+	sh.subInputs = next.subInputs
+	sh.subFingerprints = next.fingerprints
+	if err := sh.restoreState(); err != nil {
+		log.Printf("Could not restore the state: %v", err)
+	}
+	for name := range sh.exports {
+		if _, ok := sh.subTargets[name]; !ok {
+			log.Printf("Can not export %q, no buffer with this name is mapped", name)
+		}
 	}
+	gl.UseProgram(sh.program)
+	return nil
+}
 
-	subEnvs, err := env.SubEnvironments()
+// closeEnvironment closes the current environment, if there is one.
+func (sh *Shader) closeEnvironment() {
+	sh.closeEnvironmentKeeping(nil)
+}
+
+// closeEnvironmentKeeping closes the current environment, except for the sub
+// targets of keep, which are taken over by the next environment.
+func (sh *Shader) closeEnvironmentKeeping(keep reusablePasses) {
+	if sh.env == nil {
+		return
+	}
+	le := loadedEnvironment{env: sh.env, program: sh.program, subTargets: keep.without(sh.subTargets)}
+	le.Close()
+	sh.env, sh.program, sh.subTargets, sh.subOrder, sh.subInputs = nil, 0, nil, nil, nil
+	sh.tweaks, sh.activeDefines, sh.userUniforms, sh.subFingerprints = nil, nil, nil, nil
+}
+
+// SetCanary enables test rendering of environments that replace the current
+// one. A new environment is rendered off-screen first and rejected if it
+// produces NaN values or a black frame, in which case the current environment
+// keeps rendering. Both environments are set up at the same time while
+// testing, which fails for inputs that can only be opened once.
+func (sh *Shader) SetCanary(enabled bool) {
+	sh.canary = enabled
+}
+
+// SetKeepOnError keeps the current environment rendering if one that replaces
+// it fails to load, e.g. because it does not compile. Like with SetCanary, both
+// environments are set up at the same time, but the new one is not test
+// rendered.
+func (sh *Shader) SetKeepOnError(enabled bool) {
+	sh.keepOnError = enabled
+}
+
+// SetTweaks enables lifting the numeric literals of shaders that are marked
+// with a /*tweak*/ comment, or that are on the line after a `#pragma tweak`,
+// to uniforms. The values are read from the source files again when they are
+// modified, so they can be adjusted without recompiling the shader. It
+// applies to environments that are set after it is called.
+func (sh *Shader) SetTweaks(enabled bool) {
+	sh.tweak = enabled
+}
+
+// SetDefines sets macros that are defined for all sources, in addition to and
+// overriding the defaults of the options that sources declare with
+// `#pragma option NAME=VALUE`. The macros are defined right after the #version
+// directive. It applies to environments that are set after it is called.
+func (sh *Shader) SetDefines(defines map[string]string) {
+	sh.defines = defines
+}
+
+// SetUserUniforms sets where the values of the uniforms that sources declare
+// with `#pragma uniform` are taken from. Without it, the uniforms keep their
+// default values. It applies to environments that are set after it is
+// called.
+func (sh *Shader) SetUserUniforms(uniforms *UserUniforms) {
+	sh.userStore = uniforms
+}
+
+// SetLoadCallback sets a function that is called every time an environment
+// that was set has been loaded, with nil on success or the error that
+// prevented it from loading, like a CompileError. It should be called before
+// animating.
+func (sh *Shader) SetLoadCallback(fn func(err error)) {
+	sh.onLoad = fn
+}
+
+// SetSeed sets the seed that is passed to environments to initialize random
+// sources. It should be called before animating.
+func (sh *Shader) SetSeed(seed int64) {
+	sh.seed = seed
+}
+
+// SetStartDate pins the date passed to environments for the first frame, the
+// date of later frames advances with the animation time. This makes renders
+// reproducible. The zero value uses the current time.
+func (sh *Shader) SetStartDate(t time.Time) {
+	sh.startDate = t
+}
+
+// SetClocks exposes the named clocks to shaders, including those of buffers.
+// It should be called before animating.
+func (sh *Shader) SetClocks(clocks *Clocks) {
+	sh.clocks = clocks
+}
+
+// SetLoop sets the duration of the loop that is rendered, which shaders can
+// use to loop seamlessly, see RenderState.Loop. It should be called before
+// animating.
+func (sh *Shader) SetLoop(d time.Duration) {
+	sh.loop = d
+}
+
+// SetStartFrame starts the animation at the specified frame instead of the
+// first, so an animation can be rendered in parts. It must be called before
+// rendering. Buffers still start at their first frame.
+func (sh *Shader) SetStartFrame(frame uint64, interval time.Duration) {
+	sh.frame = frame
+	sh.time = time.Duration(frame) * interval
+}
+
+func (sh *Shader) SetEnvironment(env Environment) {
+	sh.newEnvs <- env
+}
+
+// SetAccumulation configures the number of samples that are averaged for each
+// frame. By default, a single sample is rendered.
+//
+// This should be called from the thread that owns the OpenGL context before
+// animating.
+func (sh *Shader) SetAccumulation(opts AccumulationOptions) error {
+	if opts.Samples == 0 && opts.Stop == nil && opts.NoiseThreshold <= 0 {
+		return fmt.Errorf("unlimited accumulation requires a stop channel or noise threshold")
+	}
+	if sh.acc != nil {
+		sh.acc.Close()
+		sh.acc = nil
+	}
+	sh.accumulation = opts
+	if opts.Samples == 1 && opts.NoiseThreshold <= 0 && opts.Denoise <= 0 {
+		return nil
+	}
+	var err error
+	sh.acc, err = newAccumulator(sh.w, sh.h, opts.Denoise)
+	return err
+}
+
+// SetWarp maps the rendered image onto the output through the warp. Shaders
+// still see the image before it was warped as the previous frame. If the warp
+// rotates the output by a quarter turn, the width and height of output frames
+// are those of the shader swapped.
+//
+// This should be called from the thread that owns the OpenGL context before
+// animating.
+func (sh *Shader) SetWarp(w *Warp) error {
+	wp, err := newWarper(w)
 	if err != nil {
 		return err
 	}
-	sh.subTargets = map[string]*Shader{}
-	for name, env := range subEnvs {
-		s, err := NewShader(env.Width, env.Height, sh.glVersion)
-		if err != nil {
+	pr := sh.renderer.(*pboRenderer)
+	outW, outH := sh.w, sh.h
+	if w.Orientation.SwapsAxes() {
+		outW, outH = sh.h, sh.w
+	}
+	if pr.w != outW || pr.h != outH {
+		pr.Close()
+		*pr = pboRenderer{w: outW, h: outH, format: pr.format, layout: pr.layout, depth: pr.depth}
+		if err := pr.Setup(); err != nil {
+			wp.Close()
 			return err
 		}
-		s.SetEnvironment(env.Environment)
-		if err := s.reloadEnvironment(context.Background()); err != nil {
+		// The previous frame was rendered by the old targets.
+		sh.prevFrameHandle = nil
+	}
+	if sh.warp == nil {
+		format := pr.format
+		size := int64(len(sh.warpTargets)) * int64(sh.w) * int64(sh.h) * int64(format.bytesPerPixel())
+		mem, err := ReserveMemory("the warp targets", size)
+		if err != nil {
+			wp.Close()
 			return err
 		}
-		sh.subTargets[name] = s
+		sh.warpMemory = mem
+		for i := range sh.warpTargets {
+			t := &sh.warpTargets[i]
+			gl.GenFramebuffers(1, &t.fbo)
+			gl.BindFramebuffer(gl.FRAMEBUFFER, t.fbo)
+			gl.GenTextures(1, &t.tex)
+			gl.BindTexture(gl.TEXTURE_2D, t.tex)
+			gl.TexImage2D(gl.TEXTURE_2D, 0, format.internalFormat(), int32(sh.w), int32(sh.h), 0, gl.RGBA, format.transferType(), nil)
+			gl.TexParameteri(gl.TEXTURE_2D, gl.TEXTURE_MAG_FILTER, gl.NEAREST)
+			gl.TexParameteri(gl.TEXTURE_2D, gl.TEXTURE_MIN_FILTER, gl.NEAREST)
+			gl.FramebufferTexture2D(gl.FRAMEBUFFER, gl.COLOR_ATTACHMENT0, gl.TEXTURE_2D, t.tex, 0)
+			status := gl.CheckFramebufferStatus(gl.FRAMEBUFFER)
+			gl.BindFramebuffer(gl.FRAMEBUFFER, 0)
+			gl.BindTexture(gl.TEXTURE_2D, 0)
+			if status != gl.FRAMEBUFFER_COMPLETE {
+				wp.Close()
+				sh.warpMemory.Release()
+				return fmt.Errorf("incomplete warp framebuffer")
+			}
+		}
+	} else {
+		sh.warp.Close()
 	}
+	sh.warp = wp
+	return nil
+}
 
-	sources, err := env.Sources()
-	if err != nil {
-		return err
+// SetOutputLayout converts frames to the byte layout of a raw output format on
+// the GPU before they are read back, so less data is transferred and the CPU
+// does not have to convert them. Frames are then returned as
+// *encode.RawFrame, which the matching output of package encode writes as is.
+// Only 8-bit render targets can be converted.
+//
+// This should be called from the thread that owns the OpenGL context before
+// animating.
+func (sh *Shader) SetOutputLayout(layout OutputLayout) error {
+	pr := sh.renderer.(*pboRenderer)
+	if layout == pr.layout {
+		return nil
 	}
-	sh.program, err = linkProgram(sources)
-	if err != nil {
+	if pr.format != PixelFormatRGBA8 {
+		return fmt.Errorf("%s frames can not be converted on the GPU", pr.format)
+	}
+	pr.Close()
+	*pr = pboRenderer{w: pr.w, h: pr.h, format: pr.format, layout: layout, depth: pr.depth}
+	// The previous frame was rendered by the old targets.
+	sh.prevFrameHandle = nil
+	return pr.Setup()
+}
+
+// SetPixelFormat sets the format of the render targets of the frames that are
+// read back. Frames of formats other than PixelFormatRGBA8 are returned as
+// *encode.FloatFrame, so outputs with more than 8 bits per channel receive the
+// full precision.
+//
+// This should be called from the thread that owns the OpenGL context before
+// SetWarp and animating.
+func (sh *Shader) SetPixelFormat(format PixelFormat) error {
+	pr := sh.renderer.(*pboRenderer)
+	if format == pr.format {
+		return nil
+	}
+	if format != PixelFormatRGBA8 && pr.layout != OutputLayoutRGBA {
+		return fmt.Errorf("%s frames can not be converted on the GPU", format)
+	}
+	if err := checkRenderTarget(pr.w, pr.h, format); err != nil {
 		return err
 	}
-	gl.UseProgram(sh.program)
-	sh.uniforms = ListUniforms(sh.program)
-	sh.vertLoc = uint32(gl.GetAttribLocation(sh.program, gl.Str("vert\x00")))
+	pr.Close()
+	*pr = pboRenderer{w: pr.w, h: pr.h, format: format, layout: pr.layout, depth: pr.depth}
+	// The previous frame was rendered by the old targets.
+	sh.prevFrameHandle = nil
+	return pr.Setup()
+}
 
-	sh.env = env
-	return nil
+// SetReadbackDepth sets the number of frames that Animate queues on the GPU
+// before the oldest is read back, which is DefaultReadbackDepth by default.
+// The GPU renders the queued frames while the CPU encodes the previous one, so
+// a deeper queue raises the throughput of fast outputs at the cost of latency
+// and memory. A depth of 1 reads every frame back as soon as it is rendered.
+//
+// This should be called from the thread that owns the OpenGL context before
+// SetWarp and animating.
+func (sh *Shader) SetReadbackDepth(depth int) error {
+	if depth < 1 {
+		return fmt.Errorf("the readback depth must be at least 1")
+	}
+	pr := sh.renderer.(*pboRenderer)
+	if depth == len(pr.targets) {
+		return nil
+	}
+	pr.Close()
+	*pr = pboRenderer{w: pr.w, h: pr.h, format: pr.format, layout: pr.layout, depth: depth}
+	// The previous frame was rendered by the old targets.
+	sh.prevFrameHandle = nil
+	return pr.Setup()
 }
 
-func (sh *Shader) SetEnvironment(env Environment) {
-	sh.newEnvs <- env
+// ExportBuffer calls fn with the raw contents of the sub environment with the
+// specified name every time it has been rendered. A buffer may be exported to
+// multiple functions. It should be called before animating.
+func (sh *Shader) ExportBuffer(name string, fn func(PixelData)) {
+	if sh.exports == nil {
+		sh.exports = map[string]func(PixelData){}
+	}
+	sh.exports[name] = chainExports(sh.exports[name], fn)
+}
+
+// chainExports returns an export function that calls prev, if it is set, and
+// then fn.
+func chainExports(prev, fn func(PixelData)) func(PixelData) {
+	if prev == nil {
+		return fn
+	}
+	return func(data PixelData) {
+		prev(data)
+		fn(data)
+	}
+}
+
+// ExportPasses calls fn with the name and raw contents of every sub
+// environment each time it has been rendered, like ExportBuffer. It should be
+// called before animating.
+func (sh *Shader) ExportPasses(fn func(name string, data PixelData)) {
+	sh.exportAll = fn
+}
+
+// SetFrameCallback sets a function that is called with every completed frame
+// while it is still on the GPU, before it is read back. This allows the frame
+// to be composited into another OpenGL pipeline without copies.
+//
+// This is unsafe: the callback runs on the rendering thread with the context
+// of the renderer current. It must restore any OpenGL state it changes and
+// must not modify or delete the texture, which is reused for later frames
+// after the callback returns.
+func (sh *Shader) SetFrameCallback(fn func(GPUFrame)) {
+	sh.frameCallback = fn
+}
+
+// AdvanceTime skips the animation forward by the specified duration. It may be
+// called from any goroutine and takes effect on the next frame.
+func (sh *Shader) AdvanceTime(d time.Duration) {
+	atomic.AddInt64(&sh.timeSkip, int64(d))
+}
+
+// Resume reinitializes the inputs of the environment and of the buffers, see
+// ResumeEnvironment. It may be called from any goroutine and takes effect on
+// the next frame.
+func (sh *Shader) Resume() {
+	atomic.StoreInt32(&sh.resume, 1)
+}
+
+// resumeEnvironment resumes the environment and those of the sub targets, and
+// of theirs.
+func resumeEnvironment(env Environment, targets map[string]*Shader) {
+	if r, ok := env.(ResumeEnvironment); ok {
+		r.Resume()
+	}
+	for _, s := range targets {
+		resumeEnvironment(s.env, s.subTargets)
+	}
 }
 
 func (sh *Shader) nextHandle(interval time.Duration) interface{} {
 	if err := sh.reloadEnvironment(context.Background()); err != nil {
 		log.Printf("Error reloading environment: %v", err)
-		return nil
+		if sh.env == nil {
+			return nil
+		}
+	}
+	if skip := atomic.SwapInt64(&sh.timeSkip, 0); skip != 0 {
+		sh.time += time.Duration(skip)
+		for _, s := range sh.subTargets {
+			s.AdvanceTime(time.Duration(skip))
+		}
+	}
+	if atomic.SwapInt32(&sh.resume, 0) != 0 {
+		resumeEnvironment(sh.env, sh.subTargets)
 	}
 
 	prevTexID, freePrevTexID := uint32(0), func() {}
 	getPrevTexID := func() uint32 {
+		if sh.warp != nil && sh.prevFrameHandle != nil {
+			// The previous frame is the image before it was warped.
+			return sh.warpTargets[sh.warpTarget].tex
+		}
 		if sh.prevFrameHandle != nil && prevTexID == 0 {
 			prevTexID, freePrevTexID = sh.renderer.Texture(sh.prevFrameHandle)
+		} else if sh.prevFrameHandle == nil {
+			return sh.initialFrame
 		}
 		return prevTexID
 	}
 	defer freePrevTexID()
 
-	subTextures := map[string]uint32{}
-	freeSubTextures := []func(){}
-	for name, s := range sh.subTargets {
-		h := s.nextHandle(interval)
-		textureID, free := s.renderer.Texture(h)
-		subTextures[name] = textureID
-		freeSubTextures = append(freeSubTextures, free)
-	}
-	defer func() {
-		for _, free := range freeSubTextures {
-			free()
+	subTextures, freeSubTextures := renderSubTargets(sh.subTargets, sh.subOrder, sh.subInputs, interval, nil, func(name string, s *Shader, h interface{}) {
+		export, ok := sh.exports[name]
+		if !ok && sh.exportAll == nil {
+			return
 		}
-	}()
+		data := s.renderer.(*pboRenderer).Pixels(h)
+		data.Frame = s.frame - 1
+		if ok {
+			export(data)
+		}
+		if sh.exportAll != nil {
+			sh.exportAll(name, data)
+		}
+	})
+	defer freeSubTextures()
+	// The outputs of sibling sub targets come after those of our own, which
+	// take precedence.
+	for name, tex := range sh.inputs {
+		if _, ok := subTextures[name]; !ok {
+			subTextures[name] = tex
+		}
+	}
 
 	// Ensure that the render state is up to date.
 	gl.BindVertexArray(sh.vao)
@@ -268,52 +773,267 @@ func (sh *Shader) nextHandle(interval time.Duration) interface{} {
 	gl.EnableVertexAttribArray(sh.vertLoc)
 	gl.VertexAttribPointer(sh.vertLoc, 3, gl.FLOAT, false, 0, nil)
 
-	sh.env.PreRender(RenderState{
+	renderState := RenderState{
 		Time:               sh.time,
 		Interval:           interval,
 		FramesProcessed:    sh.frame,
+		Seed:               sh.seed,
+		Date:               dateAt(sh.startDate, sh.time),
 		CanvasWidth:        sh.w,
 		CanvasHeight:       sh.h,
+		Clocks:             sh.clocks.at(sh.time),
+		Loop:               sh.loop,
+		Program:            sh.program,
 		Uniforms:           sh.uniforms,
+		Defines:            sh.activeDefines,
 		PreviousFrameTexID: getPrevTexID,
 		SubBuffers:         subTextures,
-	})
+		Input:              sh.input,
+		Tile:               sh.tile,
+	}
+	if sh.tweaks.update() || sh.userUniforms.update() {
+		sh.reloaded = true
+	}
+	sh.idle = sh.isIdle(renderState)
+	if sh.idle {
+		// The previous frame is reused as is.
+		sh.time += interval
+		sh.frame++
+		sh.frameDone(sh.prevFrameHandle)
+		return sh.prevFrameHandle
+	}
+	sh.reloaded = false
+	sh.env.PreRender(renderState)
+	sh.tweaks.apply()
+	sh.userUniforms.apply()
 	sh.time += interval
 	sh.frame++
 
 	// Render the geometry.
+	drawScene := func() {
+		if sh.acc == nil {
+			drawWithOutputs(sh.env)
+			return
+		}
+		var halfMean []float32
+		checkpoint := uint(firstNoiseCheckpoint)
+		numSamples := sh.acc.Accumulate(func(i uint) bool {
+			if i > 0 {
+				if sh.accumulation.Samples != 0 && i >= sh.accumulation.Samples {
+					return false
+				}
+				if sh.accumulation.NoiseThreshold > 0 && i == checkpoint {
+					mean := sh.acc.Mean(i)
+					if halfMean != nil && estimateNoise(mean, halfMean) < sh.accumulation.NoiseThreshold {
+						return false
+					}
+					halfMean = mean
+					checkpoint *= 2
+				}
+				select {
+				case <-sh.accumulation.Stop:
+					return false
+				default:
+				}
+				if spr, ok := sh.env.(SamplePreRenderer); ok {
+					renderState.Sample = i
+					spr.PreRenderSample(renderState)
+				}
+			}
+			drawWithOutputs(sh.env)
+			return true
+		})
+		sh.acc.Resolve(numSamples)
+	}
 	handle := sh.renderer.Draw(func() {
-		gl.DrawArrays(gl.TRIANGLE_STRIP, 0, 4)
+		if sh.warp == nil {
+			drawScene()
+			return
+		}
+		var target int32
+		gl.GetIntegerv(gl.FRAMEBUFFER_BINDING, &target)
+		sh.warpTarget = (sh.warpTarget + 1) % len(sh.warpTargets)
+		source := sh.warpTargets[sh.warpTarget]
+		var viewport [4]int32
+		gl.GetIntegerv(gl.VIEWPORT, &viewport[0])
+		gl.BindFramebuffer(gl.FRAMEBUFFER, source.fbo)
+		gl.Viewport(0, 0, int32(sh.w), int32(sh.h))
+		gl.Clear(gl.COLOR_BUFFER_BIT)
+		drawScene()
+		gl.BindFramebuffer(gl.FRAMEBUFFER, uint32(target))
+		gl.Viewport(viewport[0], viewport[1], viewport[2], viewport[3])
+		sh.warp.Draw(source.tex, false, 1)
 	})
 	sh.prevFrameHandle = handle
+	sh.freeInitialFrame()
+	sh.frameDone(handle)
 	return handle
 }
 
+// drawWithOutputs draws the quad to the bound framebuffer with the outputs of
+// the environment attached to it, see OutputEnvironment. They are detached
+// again afterwards.
+func drawWithOutputs(env Environment) {
+	var outputs []uint32
+	if oe, ok := env.(OutputEnvironment); ok {
+		outputs = oe.Outputs()
+	}
+	if len(outputs) == 0 {
+		gl.DrawArrays(gl.TRIANGLE_STRIP, 0, 4)
+		return
+	}
+	buffers := []uint32{gl.COLOR_ATTACHMENT0}
+	for i, tex := range outputs {
+		attachment := gl.COLOR_ATTACHMENT1 + uint32(i)
+		if tex == 0 {
+			buffers = append(buffers, gl.NONE)
+			continue
+		}
+		gl.FramebufferTexture2D(gl.DRAW_FRAMEBUFFER, attachment, gl.TEXTURE_2D, tex, 0)
+		buffers = append(buffers, attachment)
+	}
+	gl.DrawBuffers(int32(len(buffers)), &buffers[0])
+	gl.DrawArrays(gl.TRIANGLE_STRIP, 0, 4)
+	for i, tex := range outputs {
+		if tex != 0 {
+			gl.FramebufferTexture2D(gl.DRAW_FRAMEBUFFER, gl.COLOR_ATTACHMENT1+uint32(i), gl.TEXTURE_2D, 0, 0)
+		}
+	}
+	gl.DrawBuffers(1, &buffers[0])
+}
+
+// frameDone passes a completed frame to the frame callback, if there is one.
+func (sh *Shader) frameDone(handle interface{}) {
+	if sh.frameCallback != nil {
+		frame := sh.renderer.(*pboRenderer).gpuFrame(handle)
+		frame.Frame = sh.frame - 1
+		sh.frameCallback(frame)
+	}
+}
+
+// isIdle reports whether the frame of the state would be identical to the
+// previous one. Shaders that read the output of sibling passes are never idle,
+// since those may read their output in turn.
+func (sh *Shader) isIdle(state RenderState) bool {
+	if sh.prevFrameHandle == nil || sh.reloaded || sh.acc != nil || len(sh.inputs) > 0 {
+		return false
+	}
+	for _, s := range sh.subTargets {
+		if !s.idle {
+			return false
+		}
+	}
+	env, ok := sh.env.(IdleEnvironment)
+	return ok && env.Idle(state)
+}
+
+// dateAt returns the date of a frame at the animation time.
+func dateAt(startDate time.Time, t time.Duration) time.Time {
+	if startDate.IsZero() {
+		return time.Now()
+	}
+	return startDate.Add(t)
+}
+
 func (sh *Shader) Animate(ctx context.Context, interval time.Duration, stream chan<- image.Image) {
-	buffer := make(chan interface{}, sh.renderer.NumBuffers())
+	type pendingFrame struct {
+		handle interface{}
+		idle   bool
+	}
+	buffer := make(chan pendingFrame, sh.renderer.NumBuffers())
+	// last is the most recent frame, which is kept to repeat it.
+	var last image.Image
+	defer func() {
+		if last != nil {
+			encode.ReleaseFrame(last)
+		}
+	}()
 	for {
 		if err := sh.reloadEnvironment(ctx); errors.Is(err, context.Canceled) {
 			return
 		} else if err != nil {
 			log.Printf("Error reloading environment: %v", err)
+			sh.health.Error(err)
 			continue
 		}
 
 		handle := sh.nextHandle(interval)
-		buffer <- handle
+		buffer <- pendingFrame{handle: handle, idle: sh.idle}
+		sh.health.Frame()
 
 		if len(buffer) != cap(buffer) {
 			// Give the first renders time to complete.
 			continue
 		}
 
-		img := sh.renderer.Image(<-buffer)
-		select {
-		case <-ctx.Done():
-			return
-		case stream <- img:
+		// Frames that are identical to the previous one are not read back,
+		// the previous image is passed on again instead. Consumers can
+		// detect repeated frames by comparing the images.
+		frame := <-buffer
+		if !frame.idle || last == nil {
+			img := sh.renderer.Image(frame.handle)
+			if last != nil {
+				encode.ReleaseFrame(last)
+			}
+			last = img
 		}
+		encode.RetainFrame(last)
+		img := last
+	send:
+		for {
+			select {
+			case <-ctx.Done():
+				// The reference for the stream is not passed on.
+				encode.ReleaseFrame(img)
+				return
+			case reply := <-sh.stateRequests:
+				reply <- sh.CaptureState()
+			case stream <- img:
+				break send
+			}
+		}
+	}
+}
+
+// RenderFrame synchronously renders a single frame with the most recently set
+// environment. Unlike Animate, the returned image is always rendered with the
+// new environment, which makes it suitable for interactive use.
+//
+// An environment must have been set before calling this.
+func (sh *Shader) RenderFrame(interval time.Duration) (image.Image, error) {
+	if err := sh.reloadEnvironment(context.Background()); err != nil {
+		sh.health.Error(err)
+		return nil, err
+	}
+	handle := sh.nextHandle(interval)
+	if handle == nil {
+		return nil, fmt.Errorf("could not render frame")
 	}
+	sh.health.Frame()
+	return sh.renderer.Image(handle), nil
+}
+
+// RenderGPUFrame synchronously renders a single frame like RenderFrame, but
+// returns it in GPU memory instead of reading it back. The texture is reused
+// for later frames, so it should be used before rendering the next one.
+func (sh *Shader) RenderGPUFrame(interval time.Duration) (GPUFrame, error) {
+	if err := sh.reloadEnvironment(context.Background()); err != nil {
+		sh.health.Error(err)
+		return GPUFrame{}, err
+	}
+	handle := sh.nextHandle(interval)
+	if handle == nil {
+		return GPUFrame{}, fmt.Errorf("could not render frame")
+	}
+	sh.health.Frame()
+	frame := sh.renderer.(*pboRenderer).gpuFrame(handle)
+	frame.Frame = sh.frame - 1
+	return frame, nil
+}
+
+// Health returns the progress of the engine.
+func (sh *Shader) Health() *Health {
+	return &sh.health
 }
 
 func (sh *Shader) Close() error {
@@ -324,6 +1044,18 @@ func (sh *Shader) Close() error {
 	for _, s := range sh.subTargets {
 		s.Close()
 	}
+	if sh.acc != nil {
+		sh.acc.Close()
+	}
+	if sh.warp != nil {
+		sh.warp.Close()
+		for _, t := range sh.warpTargets {
+			gl.DeleteFramebuffers(1, &t.fbo)
+			gl.DeleteTextures(1, &t.tex)
+		}
+		sh.warpMemory.Release()
+	}
+	sh.freeInitialFrame()
 	gl.DeleteProgram(sh.program)
 	gl.DeleteVertexArrays(1, &sh.vao)
 	gl.DeleteBuffers(1, &sh.vbo)
@@ -340,8 +1072,21 @@ func (sh *Shader) Close() error {
 // shaders. This texture is then immediately outputted to the window by drawing
 // a fullscreen quad.
 type OnScreenEngine struct {
-	env     Environment
-	newEnvs chan Environment
+	env         Environment
+	newEnvs     chan Environment
+	canary      bool
+	keepOnError bool
+	tweak       bool
+	tweaks      *tweakSet
+	onLoad      func(error)
+	// defines are the macros that are set explicitly, activeDefines are
+	// those of the current environment.
+	defines       map[string]string
+	activeDefines map[string]string
+	// userStore holds the values of userUniforms, the uniforms that the
+	// sources of the current environment declare.
+	userStore    *UserUniforms
+	userUniforms *userUniformSet
 
 	glVersion OpenGLVersion
 
@@ -353,15 +1098,50 @@ type OnScreenEngine struct {
 	targets [2]struct {
 		fbo, tex uint32
 	}
+	// target is the index of the target that the next frame is rendered
+	// to, the other one holds the previous frame.
+	target int
 
 	program    uint32
 	subTargets map[string]*Shader
-	uniforms   map[string]Uniform
-
-	time  time.Duration
-	frame uint64
+	subOrder   []string
+	subInputs  map[string][]string
+	// subFingerprints identify the sub targets, see Shader.subFingerprints.
+	subFingerprints map[string]string
+	uniforms        map[string]Uniform
+	passes          passControls
+	exports         map[string]func(PixelData)
+
+	time      time.Duration
+	frame     uint64
+	seed      int64
+	startDate time.Time
+
+	throttleLock  sync.Mutex
+	paused        bool
+	frameInterval time.Duration
+	timeSkip      time.Duration
+	// resume is set if the environment should be resumed before the next
+	// frame, see Resume.
+	resume bool
+	fade   fade
+
+	screenshots chan chan image.Image
+	// initialState is restored for the next environment that is loaded, see
+	// SetInitialState.
+	initialState  *State
+	stateRequests chan stateRequest
+	health        Health
+	onPresent     func(frame uint64)
+
+	warp        *warper
+	calibration *warpCalibration
+	clocks      *Clocks
+	loop        time.Duration
+	history     *frameHistory
 
 	window *glfw.Window
+	input  Input
 }
 
 func NewOnScreenEngine(glVersion OpenGLVersion) (*OnScreenEngine, error) {
@@ -386,13 +1166,31 @@ func NewOnScreenEngine(glVersion OpenGLVersion) (*OnScreenEngine, error) {
 	}
 
 	eng := &OnScreenEngine{
-		newEnvs: make(chan Environment, 1),
-		window:  window,
+		newEnvs:       make(chan Environment, 1),
+		screenshots:   make(chan chan image.Image),
+		window:        window,
+		stateRequests: make(chan stateRequest),
+		fade:          fade{from: 1, to: 1},
 	}
 
 	w, h := eng.window.GetFramebufferSize()
 	eng.onResize(window, w, h)
 	window.SetSizeCallback(eng.onResize)
+	window.SetKeyCallback(func(_ *glfw.Window, key glfw.Key, _ int, action glfw.Action, mods glfw.ModifierKey) {
+		eng.passes.onKey(key, action, mods)
+		if eng.history != nil {
+			eng.history.onKey(key, action, mods)
+		}
+		eng.input.onKey(key, action)
+	})
+	window.SetCursorPosCallback(func(_ *glfw.Window, x, y float64) {
+		eng.input.onCursorPos(eng.canvasPos(x, y))
+	})
+	window.SetMouseButtonCallback(func(_ *glfw.Window, button glfw.MouseButton, action glfw.Action, _ glfw.ModifierKey) {
+		if button == glfw.MouseButtonLeft {
+			eng.input.onMouseButton(action == glfw.Press)
+		}
+	})
 
 	eng.copyProgram, err = linkProgram(map[Stage][]Source{
 		StageVertex:   {textureCopyVert},
@@ -406,7 +1204,31 @@ func NewOnScreenEngine(glVersion OpenGLVersion) (*OnScreenEngine, error) {
 	return eng, nil
 }
 
-func (eng *OnScreenEngine) onResize(win *glfw.Window, width int, height int) {
+// canvasSize returns the size of the rendered image for a window of the
+// specified size.
+func (eng *OnScreenEngine) canvasSize(width, height int) (int, int) {
+	if eng.warp != nil && eng.warp.warp.Orientation.SwapsAxes() {
+		return height, width
+	}
+	return width, height
+}
+
+// canvasPos converts a position of the cursor in the window to pixels of the
+// canvas with the origin in the bottom left. Warps are not taken into account.
+func (eng *OnScreenEngine) canvasPos(x, y float64) (float32, float32) {
+	windowW, windowH := eng.window.GetSize()
+	fbW, fbH := eng.window.GetFramebufferSize()
+	if windowW == 0 || windowH == 0 {
+		return 0, 0
+	}
+	// The framebuffer is larger than the window on displays that are scaled.
+	x *= float64(fbW) / float64(windowW)
+	y *= float64(fbH) / float64(windowH)
+	return float32(x), float32(float64(fbH) - y)
+}
+
+func (eng *OnScreenEngine) onResize(win *glfw.Window, windowWidth int, windowHeight int) {
+	width, height := eng.canvasSize(windowWidth, windowHeight)
 	for i := range eng.targets {
 		t := &eng.targets[i]
 		if t.fbo != 0 {
@@ -432,13 +1254,198 @@ func (eng *OnScreenEngine) onResize(win *glfw.Window, width int, height int) {
 	gl.BindFramebuffer(gl.FRAMEBUFFER, 0)
 	gl.BindTexture(gl.TEXTURE_2D, 0)
 
-	gl.Viewport(0, 0, int32(width), int32(height))
+	gl.Viewport(0, 0, int32(windowWidth), int32(windowHeight))
+}
+
+// SetSeed sets the seed that is passed to environments to initialize random
+// sources. It should be called before animating.
+func (eng *OnScreenEngine) SetSeed(seed int64) {
+	eng.seed = seed
+}
+
+// SetStartDate pins the date passed to environments for the first frame, see
+// Shader.SetStartDate.
+func (eng *OnScreenEngine) SetStartDate(t time.Time) {
+	eng.startDate = t
+}
+
+// SetVSync enables or disables waiting for the vertical blank of the display
+// before presenting a frame. It should be called from the thread that owns
+// the OpenGL context.
+func (eng *OnScreenEngine) SetVSync(enabled bool) {
+	if enabled {
+		glfw.SwapInterval(1)
+	} else {
+		glfw.SwapInterval(0)
+	}
+}
+
+// SetClocks exposes the named clocks to shaders. It should be called before
+// animating.
+func (eng *OnScreenEngine) SetClocks(clocks *Clocks) {
+	eng.clocks = clocks
+}
+
+// SetHistory keeps copies of the specified number of most recent frames and
+// the outputs of their passes, which can be stepped through with the arrow
+// keys to inspect a glitch after it happened. Stepping back pauses rendering,
+// the end key resumes it. Screenshots show the frame that is viewed. It should
+// be called before animating.
+func (eng *OnScreenEngine) SetHistory(frames int) {
+	if eng.history != nil {
+		eng.history.Close()
+		eng.history = nil
+	}
+	if frames > 0 {
+		eng.history = newFrameHistory(frames)
+	}
+}
+
+// SetLoop sets the duration of the loop that shaders can use, like
+// Shader.SetLoop. It should be called before animating.
+func (eng *OnScreenEngine) SetLoop(d time.Duration) {
+	eng.loop = d
+}
+
+// ExportBuffer calls fn with the raw contents of the sub environment with the
+// specified name every time it has been rendered, like Shader.ExportBuffer.
+// It should be called before animating.
+func (eng *OnScreenEngine) ExportBuffer(name string, fn func(PixelData)) {
+	if eng.exports == nil {
+		eng.exports = map[string]func(PixelData){}
+	}
+	eng.exports[name] = chainExports(eng.exports[name], fn)
+}
+
+// SetPresentCallback sets a function that is called with the number of every
+// frame right after it has been presented to the window. It should be called
+// before animating.
+func (eng *OnScreenEngine) SetPresentCallback(fn func(frame uint64)) {
+	eng.onPresent = fn
+}
+
+// SetWarp maps the rendered image onto the window through the warp. The warp
+// is kept and may be modified by calibration. If the warp rotates the output
+// by a quarter turn, the image is rendered with the width and height of the
+// window swapped.
+//
+// This should be called from the thread that owns the OpenGL context before
+// animating.
+func (eng *OnScreenEngine) SetWarp(w *Warp) error {
+	wp, err := newWarper(w)
+	if err != nil {
+		return err
+	}
+	if eng.warp != nil {
+		eng.warp.Close()
+	}
+	eng.warp = wp
+	// The size of the render targets depends on the orientation.
+	width, height := eng.window.GetFramebufferSize()
+	eng.onResize(eng.window, width, height)
+	return nil
+}
+
+// SetPaused stops or resumes rendering. Time does not advance while paused.
+func (eng *OnScreenEngine) SetPaused(paused bool) {
+	eng.throttleLock.Lock()
+	defer eng.throttleLock.Unlock()
+	eng.paused = paused
+}
+
+// SetFrameInterval sets the minimum time between two frames. If 0, frames are
+// rendered as fast as the display allows.
+func (eng *OnScreenEngine) SetFrameInterval(interval time.Duration) {
+	eng.throttleLock.Lock()
+	defer eng.throttleLock.Unlock()
+	eng.frameInterval = interval
+}
+
+// FadeTo changes the brightness of the window to the specified value between
+// 0 and 1 over the duration. The rendering itself is not affected, so
+// screenshots show the frames at full brightness.
+func (eng *OnScreenEngine) FadeTo(brightness float64, duration time.Duration) {
+	eng.throttleLock.Lock()
+	defer eng.throttleLock.Unlock()
+	now := time.Now()
+	eng.fade = fade{from: eng.fade.at(now), to: brightness, start: now, duration: duration}
+}
+
+// AdvanceTime skips the animation forward by the specified duration. It may be
+// called from any goroutine and takes effect on the next frame.
+func (eng *OnScreenEngine) AdvanceTime(d time.Duration) {
+	eng.throttleLock.Lock()
+	defer eng.throttleLock.Unlock()
+	eng.timeSkip += d
+}
+
+// Resume reinitializes the inputs like Shader.Resume. It may be called from
+// any goroutine and takes effect on the next frame.
+func (eng *OnScreenEngine) Resume() {
+	eng.throttleLock.Lock()
+	defer eng.throttleLock.Unlock()
+	eng.resume = true
+}
+
+// Health returns the progress of the engine.
+func (eng *OnScreenEngine) Health() *Health {
+	return &eng.health
+}
+
+// Screenshot returns a copy of the most recently rendered frame. It may be
+// called from any goroutine.
+func (eng *OnScreenEngine) Screenshot(ctx context.Context) (image.Image, error) {
+	reply := make(chan image.Image, 1)
+	select {
+	case eng.screenshots <- reply:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	select {
+	case img := <-reply:
+		return img, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// serveScreenshot answers a pending screenshot request, if any, with the
+// contents of the specified framebuffer of w by h pixels.
+func (eng *OnScreenEngine) serveScreenshot(fbo uint32, w, h int) {
+	var reply chan image.Image
+	select {
+	case reply = <-eng.screenshots:
+	default:
+		return
+	}
+	img := image.NewRGBA(image.Rect(0, 0, w, h))
+	if len(img.Pix) > 0 {
+		gl.BindFramebuffer(gl.READ_FRAMEBUFFER, fbo)
+		gl.ReadBuffer(gl.COLOR_ATTACHMENT0)
+		gl.PixelStorei(gl.PACK_ALIGNMENT, 4)
+		gl.ReadPixels(0, 0, int32(w), int32(h), gl.RGBA, gl.UNSIGNED_BYTE, gl.Ptr(img.Pix))
+		gl.BindFramebuffer(gl.READ_FRAMEBUFFER, 0)
+	}
+	reply <- img
+}
+
+func (eng *OnScreenEngine) throttle() (paused bool, interval, skip time.Duration, resume bool) {
+	eng.throttleLock.Lock()
+	defer eng.throttleLock.Unlock()
+	skip, eng.timeSkip = eng.timeSkip, 0
+	resume, eng.resume = eng.resume, false
+	return eng.paused, eng.frameInterval, skip, resume
+}
+
+func (eng *OnScreenEngine) brightness() float32 {
+	eng.throttleLock.Lock()
+	defer eng.throttleLock.Unlock()
+	return float32(eng.fade.at(time.Now()))
 }
 
 func (eng *OnScreenEngine) Animate(ctx context.Context) error {
 	lastFrame := time.Now()
 	interval := time.Second / 60
-	i := 0
 	for {
 		if eng.window.ShouldClose() {
 			return ErrWindowClosed
@@ -451,68 +1458,183 @@ func (eng *OnScreenEngine) Animate(ctx context.Context) error {
 			return err
 		} else if err != nil {
 			log.Printf("Error reloading environment: %v", err)
+			eng.health.Error(err)
 			continue
 		}
+		select {
+		case reply := <-eng.stateRequests:
+			reply <- eng.CaptureState()
+		default:
+		}
+
+		paused, minInterval, skip, resume := eng.throttle()
+		eng.time += skip
+		if resume {
+			resumeEnvironment(eng.env, eng.subTargets)
+		}
+		if eng.history != nil {
+			if hf, ok := eng.history.viewed(); ok {
+				eng.showHistoryFrame(hf)
+				glfw.WaitEventsTimeout(0.1)
+				lastFrame = time.Now()
+				continue
+			}
+		}
+		if paused {
+			w, h := eng.canvasSize(eng.window.GetFramebufferSize())
+			eng.serveScreenshot(eng.targets[(eng.target+len(eng.targets)-1)%len(eng.targets)].fbo, w, h)
+			glfw.WaitEventsTimeout(0.1)
+			lastFrame = time.Now()
+			continue
+		}
+
+		disabled, solo := eng.passes.current()
+		subTextures, freeSubTextures := renderSubTargets(eng.subTargets, eng.subOrder, eng.subInputs, interval, disabled, func(name string, s *Shader, h interface{}) {
+			if export, ok := eng.exports[name]; ok {
+				data := s.renderer.(*pboRenderer).Pixels(h)
+				data.Frame = s.frame - 1
+				export(data)
+			}
+		})
 
 		gl.BindVertexArray(eng.quadVAO)
 		gl.BindBuffer(gl.ARRAY_BUFFER, eng.quadVBO)
 
-		target := &eng.targets[i%len(eng.targets)]
-		prevTarget := &eng.targets[(i+len(eng.targets)-1)%len(eng.targets)]
+		target := &eng.targets[eng.target]
+		prevTarget := &eng.targets[(eng.target+len(eng.targets)-1)%len(eng.targets)]
 
 		// 1st pass: render the actual image.
-		w, h := eng.window.GetFramebufferSize()
+		windowW, windowH := eng.window.GetFramebufferSize()
+		w, h := eng.canvasSize(windowW, windowH)
 		gl.BindFramebuffer(gl.FRAMEBUFFER, target.fbo)
+		gl.Viewport(0, 0, int32(w), int32(h))
 		gl.UseProgram(eng.program)
 		eng.env.PreRender(RenderState{
 			Time:               eng.time,
 			Interval:           interval,
 			FramesProcessed:    eng.frame,
+			Seed:               eng.seed,
+			Date:               dateAt(eng.startDate, eng.time),
 			CanvasWidth:        uint(w),
 			CanvasHeight:       uint(h),
+			Clocks:             eng.clocks.at(eng.time),
+			Loop:               eng.loop,
+			Program:            eng.program,
 			Uniforms:           eng.uniforms,
+			Defines:            eng.activeDefines,
 			PreviousFrameTexID: func() uint32 { return prevTarget.tex },
-			SubBuffers:         nil, // TODO
+			SubBuffers:         subTextures,
+			Input:              &eng.input,
 		})
+		eng.tweaks.update()
+		eng.tweaks.apply()
+		eng.userUniforms.apply()
 
 		gl.EnableVertexAttribArray(eng.vertLoc)
 		gl.VertexAttribPointer(eng.vertLoc, 3, gl.FLOAT, false, 0, nil)
-		gl.DrawArrays(gl.TRIANGLE_STRIP, 0, 4)
+		drawWithOutputs(eng.env)
+		eng.serveScreenshot(target.fbo, w, h)
+		if eng.history != nil {
+			if err := eng.history.record(eng.frame, eng.time, target.tex, w, h, subTextures, eng.subTargets); err != nil {
+				log.Printf("Disabling the frame history: %v", err)
+				eng.SetHistory(0)
+			}
+		}
 
 		// 2nd pass: copy the rendered image to the on-screen framebuffer.
-		gl.BindFramebuffer(gl.FRAMEBUFFER, 0)
-		gl.UseProgram(eng.copyProgram)
-		gl.ActiveTexture(gl.TEXTURE0)
-		gl.BindTexture(gl.TEXTURE_2D, target.tex)
-		gl.Uniform1i(
-			gl.GetUniformLocation(eng.copyProgram, gl.Str("screenTexture\x00")),
-			0,
-		)
-
-		loc := uint32(gl.GetAttribLocation(eng.copyProgram, gl.Str("pos\x00")))
-		gl.EnableVertexAttribArray(loc)
-		gl.VertexAttribPointer(loc, 3, gl.FLOAT, false, 0, nil)
-		gl.DrawArrays(gl.TRIANGLE_STRIP, 0, 4)
+		shown := target.tex
+		if solo != "" {
+			shown = subTextures[solo]
+		}
+		eng.present(shown, windowW, windowH)
+		freeSubTextures()
 
+		if d := minInterval - time.Since(lastFrame); d > 0 {
+			time.Sleep(d)
+		}
 		now := time.Now()
 		interval = now.Sub(lastFrame)
 		lastFrame = now
 		eng.time += interval
+		frame := eng.frame
 		eng.frame++
-		i++
+		eng.health.Frame()
+		eng.input.endFrame()
+		eng.target = (eng.target + 1) % len(eng.targets)
 
 		eng.window.SwapBuffers()
+		if eng.onPresent != nil {
+			eng.onPresent(frame)
+		}
 		glfw.PollEvents()
 	}
 }
 
+// present draws the texture to the window, which has a framebuffer of the
+// specified size.
+func (eng *OnScreenEngine) present(tex uint32, windowW, windowH int) {
+	gl.BindFramebuffer(gl.FRAMEBUFFER, 0)
+	gl.Viewport(0, 0, int32(windowW), int32(windowH))
+	brightness := eng.brightness()
+	if eng.warp != nil {
+		eng.warp.Draw(tex, true, brightness)
+		if eng.calibration != nil {
+			eng.calibration.Draw(eng.window.GetSize())
+		}
+	} else {
+		eng.copy(tex, brightness)
+	}
+}
+
+// showHistoryFrame shows a frame of the history, or the output of the soloed
+// pass in it.
+func (eng *OnScreenEngine) showHistoryFrame(hf *historyFrame) {
+	shown := &hf.image
+	if _, solo := eng.passes.current(); solo != "" {
+		if tc, ok := hf.passes[solo]; ok {
+			shown = tc
+		}
+	}
+	eng.serveScreenshot(shown.fbo, shown.w, shown.h)
+	gl.BindVertexArray(eng.quadVAO)
+	gl.BindBuffer(gl.ARRAY_BUFFER, eng.quadVBO)
+	windowW, windowH := eng.window.GetFramebufferSize()
+	eng.present(shown.tex, windowW, windowH)
+	eng.window.SwapBuffers()
+}
+
+// copy draws the texture to the bound framebuffer with its colors scaled by
+// the brightness. The vertex array of a fullscreen quad should be bound.
+func (eng *OnScreenEngine) copy(tex uint32, brightness float32) {
+	gl.UseProgram(eng.copyProgram)
+	gl.ActiveTexture(gl.TEXTURE0)
+	gl.BindTexture(gl.TEXTURE_2D, tex)
+	gl.Uniform1i(
+		gl.GetUniformLocation(eng.copyProgram, gl.Str("screenTexture\x00")),
+		0,
+	)
+	gl.Uniform1f(gl.GetUniformLocation(eng.copyProgram, gl.Str("brightness\x00")), brightness)
+
+	loc := uint32(gl.GetAttribLocation(eng.copyProgram, gl.Str("pos\x00")))
+	gl.EnableVertexAttribArray(loc)
+	gl.VertexAttribPointer(loc, 3, gl.FLOAT, false, 0, nil)
+	gl.DrawArrays(gl.TRIANGLE_STRIP, 0, 4)
+}
+
 func (eng *OnScreenEngine) Close() error {
+	eng.SetHistory(0)
+	if eng.calibration != nil {
+		eng.calibration.Close()
+	}
+	if eng.warp != nil {
+		eng.warp.Close()
+	}
 	eng.window.Destroy()
 	glfw.Terminate()
 	return nil
 }
 
-func (eng *OnScreenEngine) reloadEnvironment(ctx context.Context) error {
+func (eng *OnScreenEngine) reloadEnvironment(ctx context.Context) (err error) {
 	var env Environment
 	if eng.env == nil {
 		// If no environment is set, block until it is set or the context is
@@ -532,65 +1654,161 @@ func (eng *OnScreenEngine) reloadEnvironment(ctx context.Context) error {
 		}
 	}
 
-	// Close the old environment if there is one.
-	if eng.env != nil {
-		eng.env.Close()
-		gl.DeleteProgram(eng.program)
-		eng.env = nil
-	}
 	if env == nil {
+		eng.closeEnvironment()
 		return nil
 	}
+	if eng.onLoad != nil {
+		defer func() { eng.onLoad(err) }()
+	}
+	reuse := newReusablePasses(eng.subTargets, eng.subFingerprints)
+	if !eng.canary && !eng.keepOnError {
+		eng.closeEnvironmentKeeping(reuse)
+	}
 
 	w, h := eng.window.GetFramebufferSize()
 	renderState := RenderState{
 		Time:            eng.time,
 		FramesProcessed: eng.frame,
+		Seed:            eng.seed,
+		Date:            dateAt(eng.startDate, eng.time),
 		CanvasWidth:     uint(w),
 		CanvasHeight:    uint(h),
+		Loop:            eng.loop,
 		Uniforms:        eng.uniforms,
+		Defines:         eng.defines,
 	}
-	if err := env.Setup(renderState); err != nil {
-		return fmt.Errorf("error setting up environment: %w", err)
-	}
-
-	subEnvs, err := env.SubEnvironments()
+	next, err := loadEnvironment(env, renderState, eng.glVersion, eng.tweak, eng.userStore, reuse, func(s *Shader) {
+		s.seed = eng.seed
+		s.startDate = eng.startDate
+		s.loop = eng.loop
+		s.input = &eng.input
+		s.tweak = eng.tweak
+		s.defines = eng.defines
+		s.userStore = eng.userStore
+	})
 	if err != nil {
+		if eng.env != nil {
+			return fmt.Errorf("keeping the current shader: %w", err)
+		}
+		reuse.closeUnused(nil)
 		return err
 	}
-	eng.subTargets = map[string]*Shader{}
-	for name, env := range subEnvs {
-		s, err := NewShader(env.Width, env.Height, eng.glVersion)
-		if err != nil {
-			return err
-		}
-		s.SetEnvironment(env.Environment)
-		if err := s.reloadEnvironment(context.Background()); err != nil {
-			return err
+	if eng.env != nil {
+		if eng.canary {
+			renderState.Clocks = eng.clocks.at(eng.time)
+			if err := next.canary(renderState, eng.quadVAO, eng.quadVBO); err != nil {
+				next.Close()
+				return fmt.Errorf("keeping the current shader: %w", err)
+			}
 		}
-		eng.subTargets[name] = s
+		eng.closeEnvironmentKeeping(reuse.takenBy(next))
+	} else {
+		reuse.closeUnused(next)
 	}
-
-	sources, err := env.Sources()
-	if err != nil {
-		return err
+	eng.env = next.env
+	eng.program = next.program
+	eng.uniforms = next.uniforms
+	eng.tweaks = next.tweaks
+	eng.activeDefines = next.defines
+	eng.userUniforms = next.userUniforms
+	eng.vertLoc = next.vertLoc
+	eng.subTargets = next.subTargets
+	eng.subOrder = next.subOrder
+	eng.subInputs = next.subInputs
+	eng.subFingerprints = next.fingerprints
+	eng.passes.setPasses(next.subOrder)
+	if err := eng.restoreState(); err != nil {
+		log.Printf("Could not restore the state: %v", err)
 	}
-	eng.program, err = linkProgram(sources)
-	if err != nil {
-		return err
+	for name := range eng.exports {
+		if _, ok := eng.subTargets[name]; !ok {
+			log.Printf("Can not export %q, no buffer with this name is mapped", name)
+		}
 	}
 	gl.UseProgram(eng.program)
-	eng.uniforms = ListUniforms(eng.program)
-	eng.vertLoc = uint32(gl.GetAttribLocation(eng.program, gl.Str("vert\x00")))
-
-	eng.env = env
 	return nil
 }
 
+// closeEnvironment closes the current environment, if there is one.
+func (eng *OnScreenEngine) closeEnvironment() {
+	eng.closeEnvironmentKeeping(nil)
+}
+
+// closeEnvironmentKeeping closes the current environment, except for the sub
+// targets of keep, see Shader.closeEnvironmentKeeping.
+func (eng *OnScreenEngine) closeEnvironmentKeeping(keep reusablePasses) {
+	if eng.env == nil {
+		return
+	}
+	le := loadedEnvironment{env: eng.env, program: eng.program, subTargets: keep.without(eng.subTargets)}
+	le.Close()
+	eng.env, eng.program, eng.subTargets = nil, 0, nil
+	eng.subOrder, eng.subInputs, eng.tweaks, eng.activeDefines = nil, nil, nil, nil
+	eng.userUniforms, eng.subFingerprints = nil, nil
+	eng.passes.setPasses(nil)
+}
+
+// SetCanary enables test rendering of environments that replace the current
+// one, see Shader.SetCanary.
+func (eng *OnScreenEngine) SetCanary(enabled bool) {
+	eng.canary = enabled
+}
+
+// SetKeepOnError keeps the current environment rendering if one that replaces
+// it fails to load, see Shader.SetKeepOnError.
+func (eng *OnScreenEngine) SetKeepOnError(enabled bool) {
+	eng.keepOnError = enabled
+}
+
+// SetTweaks enables lifting tweakable literals to uniforms, see
+// Shader.SetTweaks.
+func (eng *OnScreenEngine) SetTweaks(enabled bool) {
+	eng.tweak = enabled
+}
+
+// SetDefines sets macros that are defined for all sources, see
+// Shader.SetDefines.
+func (eng *OnScreenEngine) SetDefines(defines map[string]string) {
+	eng.defines = defines
+}
+
+// SetUserUniforms sets where the values of the uniforms that sources declare
+// are taken from, see Shader.SetUserUniforms.
+func (eng *OnScreenEngine) SetUserUniforms(uniforms *UserUniforms) {
+	eng.userStore = uniforms
+}
+
+// SetLoadCallback sets a function that is called every time an environment
+// has been loaded, see Shader.SetLoadCallback.
+func (eng *OnScreenEngine) SetLoadCallback(fn func(err error)) {
+	eng.onLoad = fn
+}
+
 func (eng *OnScreenEngine) SetEnvironment(env Environment) {
 	eng.newEnvs <- env
 }
 
+// Passes returns the state of the passes of the current environment in the
+// order they are rendered in. It may be called from any goroutine.
+func (eng *OnScreenEngine) Passes() []PassState {
+	return eng.passes.States()
+}
+
+// SetPassEnabled turns rendering of a pass on or off while debugging. A
+// disabled pass keeps its last frame, which is what passes that read it see.
+// It may be called from any goroutine.
+func (eng *OnScreenEngine) SetPassEnabled(name string, enabled bool) error {
+	return eng.passes.SetEnabled(name, enabled)
+}
+
+// SetSoloPass shows the output of a pass in the window instead of the final
+// image, or the final image again if name is empty. Screenshots are not
+// affected. It may be called from any goroutine.
+func (eng *OnScreenEngine) SetSoloPass(name string) error {
+	return eng.passes.SetSolo(name)
+}
+
 type renderer interface {
 	io.Closer
 	Setup() error
@@ -605,37 +1823,79 @@ type imageRenderer interface {
 	Image(handle interface{}) image.Image
 }
 
+// DefaultReadbackDepth is the number of frames that are queued on the GPU
+// before they are read back, unless it is set with Shader.SetReadbackDepth.
+const DefaultReadbackDepth = 3
+
 type pboRenderer struct {
-	w, h           uint
+	w, h   uint
+	format PixelFormat
+	layout OutputLayout
+	// depth is the number of targets, DefaultReadbackDepth if it is 0.
+	depth int
+	// packer converts frames to the layout before they are read back, if
+	// it is not RGBA. The pixel buffers of the targets are not used then.
+	packer         *packer
+	memory         *MemoryReservation
 	curTargetIndex int
-	targets        [3]struct {
-		pbo, rbo, fbo uint32
-	}
+	targets        []pboTarget
+	// fences is set if the context supports sync objects, with which the
+	// transfers of the targets are tracked.
+	fences bool
+}
+
+type pboTarget struct {
+	pbo, tex, fbo uint32
+	// fence is signaled once the frame has been transferred to the pixel
+	// buffer, or the packer.
+	fence uintptr
 }
 
 func (pr *pboRenderer) Setup() error {
+	depth := pr.depth
+	if depth <= 0 {
+		depth = DefaultReadbackDepth
+	}
+	pr.targets = make([]pboTarget, depth)
+	pr.fences = supportsFences(contextInfo())
+	// Every target has a texture and a pixel buffer of the same size.
+	size := 2 * int64(len(pr.targets)) * int64(pr.w) * int64(pr.h) * int64(pr.format.bytesPerPixel())
+	mem, err := ReserveMemory(fmt.Sprintf("a %dx%d %s render target", pr.w, pr.h, pr.format), size)
+	if err != nil {
+		return err
+	}
+	pr.memory = mem
+	if pr.layout != OutputLayoutRGBA {
+		if pr.packer, err = newPacker(pr.layout, pr.w, pr.h, len(pr.targets)); err != nil {
+			pr.memory.Release()
+			return err
+		}
+	}
 	for i := range pr.targets {
 		t := &pr.targets[i]
 		// Framebuffer.
 		gl.GenFramebuffers(1, &t.fbo)
 		gl.BindFramebuffer(gl.FRAMEBUFFER, t.fbo)
-		// Color renderbuffer.
-		gl.GenRenderbuffers(1, &t.rbo)
-		gl.BindRenderbuffer(gl.RENDERBUFFER, t.rbo)
-		gl.RenderbufferStorage(gl.RENDERBUFFER, gl.RGBA8, int32(pr.w), int32(pr.h))
+		// Color texture. A texture is used rather than a renderbuffer so
+		// it can be exposed by GPUFrame.
+		gl.GenTextures(1, &t.tex)
+		gl.BindTexture(gl.TEXTURE_2D, t.tex)
+		gl.TexImage2D(gl.TEXTURE_2D, 0, pr.format.internalFormat(), int32(pr.w), int32(pr.h), 0, gl.RGBA, pr.format.transferType(), nil)
+		gl.TexParameteri(gl.TEXTURE_2D, gl.TEXTURE_MAG_FILTER, gl.NEAREST)
+		gl.TexParameteri(gl.TEXTURE_2D, gl.TEXTURE_MIN_FILTER, gl.NEAREST)
 
-		gl.FramebufferRenderbuffer(gl.DRAW_FRAMEBUFFER, gl.COLOR_ATTACHMENT0, gl.RENDERBUFFER, t.rbo)
+		gl.FramebufferTexture2D(gl.DRAW_FRAMEBUFFER, gl.COLOR_ATTACHMENT0, gl.TEXTURE_2D, t.tex, 0)
 		gl.PixelStorei(gl.UNPACK_ALIGNMENT, 4)
 		gl.ReadBuffer(gl.COLOR_ATTACHMENT0)
 
 		// Pixelbuffer
 		gl.GenBuffers(1, &t.pbo)
 		gl.BindBuffer(gl.PIXEL_PACK_BUFFER, t.pbo)
-		gl.BufferData(gl.PIXEL_PACK_BUFFER, int(pr.w*pr.h*4), nil, gl.DYNAMIC_READ)
+		gl.BufferData(gl.PIXEL_PACK_BUFFER, int(pr.w*pr.h)*pr.format.bytesPerPixel(), nil, gl.DYNAMIC_READ)
 	}
 	gl.BindFramebuffer(gl.FRAMEBUFFER, 0)
 	gl.BindBuffer(gl.PIXEL_PACK_BUFFER, 0)
-	gl.BindRenderbuffer(gl.RENDERBUFFER, 0)
+	gl.BindTexture(gl.TEXTURE_2D, 0)
 	return nil
 }
 
@@ -643,13 +1903,67 @@ func (pr *pboRenderer) NumBuffers() int {
 	return len(pr.targets)
 }
 
+// Image returns the contents of the render target as a frame from the pool of
+// package encode, which may be released after use. If an output layout is set,
+// the frame is an *encode.RawFrame. Frames of formats other than
+// PixelFormatRGBA8 are an *encode.FloatFrame.
 func (pr *pboRenderer) Image(handle interface{}) image.Image {
 	i := handle.(int)
-	img := image.NewRGBA(image.Rect(0, 0, int(pr.w), int(pr.h)))
+	pr.wait(i)
+	if pr.packer != nil {
+		return pr.packer.Frame(i)
+	}
+	if pr.format != PixelFormatRGBA8 {
+		frame := encode.NewFloatFrame(image.Rect(0, 0, int(pr.w), int(pr.h)))
+		gl.BindBuffer(gl.PIXEL_PACK_BUFFER, pr.targets[i].pbo)
+		gl.GetBufferSubData(gl.PIXEL_PACK_BUFFER, 0, len(frame.Pix)*4, gl.Ptr(&frame.Pix[0]))
+		gl.BindBuffer(gl.PIXEL_PACK_BUFFER, 0)
+		return frame
+	}
+	img := encode.NewFrame(image.Rect(0, 0, int(pr.w), int(pr.h)))
+	pr.readRGBA(i, img.Pix)
+	return img
+}
+
+// readRGBA copies the frame of the target i, which must be complete, to pix.
+// The format must be PixelFormatRGBA8.
+func (pr *pboRenderer) readRGBA(i int, pix []uint8) {
 	gl.BindBuffer(gl.PIXEL_PACK_BUFFER, pr.targets[i].pbo)
-	gl.GetBufferSubData(gl.PIXEL_PACK_BUFFER, 0, int(pr.w*pr.h*4), gl.Ptr(&img.Pix[0]))
+	gl.GetBufferSubData(gl.PIXEL_PACK_BUFFER, 0, int(pr.w*pr.h*4), gl.Ptr(&pix[0]))
 	gl.BindBuffer(gl.PIXEL_PACK_BUFFER, 0)
-	return img
+}
+
+// Pixels copies the raw contents of the render target.
+func (pr *pboRenderer) Pixels(handle interface{}) PixelData {
+	i := handle.(int)
+	pr.wait(i)
+	data := PixelData{
+		Width:  pr.w,
+		Height: pr.h,
+		Format: pr.format,
+		Pix:    make([]float32, pr.w*pr.h*4),
+	}
+	gl.BindBuffer(gl.PIXEL_PACK_BUFFER, pr.targets[i].pbo)
+	if pr.format == PixelFormatRGBA8 {
+		buf := make([]uint8, len(data.Pix))
+		gl.GetBufferSubData(gl.PIXEL_PACK_BUFFER, 0, len(buf), gl.Ptr(&buf[0]))
+		for i, v := range buf {
+			data.Pix[i] = float32(v) / 255
+		}
+	} else {
+		gl.GetBufferSubData(gl.PIXEL_PACK_BUFFER, 0, len(data.Pix)*4, gl.Ptr(&data.Pix[0]))
+	}
+	gl.BindBuffer(gl.PIXEL_PACK_BUFFER, 0)
+	return data
+}
+
+func (pr *pboRenderer) gpuFrame(handle interface{}) GPUFrame {
+	return GPUFrame{
+		Texture: pr.targets[handle.(int)].tex,
+		Width:   pr.w,
+		Height:  pr.h,
+		Format:  pr.format,
+	}
 }
 
 // Draw instructs OpenGL to render a single image with the scene drawn by
@@ -658,30 +1972,74 @@ func (pr *pboRenderer) Image(handle interface{}) image.Image {
 func (pr *pboRenderer) Draw(drawFunc func()) interface{} {
 	pr.curTargetIndex = (pr.curTargetIndex + 1) % len(pr.targets)
 	t := &pr.targets[pr.curTargetIndex]
+	// Restore the state of the caller afterwards, which may be rendering to
+	// a window or be an application that embeds shady.
+	var prevFBO int32
+	var prevViewport [4]int32
+	gl.GetIntegerv(gl.FRAMEBUFFER_BINDING, &prevFBO)
+	gl.GetIntegerv(gl.VIEWPORT, &prevViewport[0])
 	gl.BindFramebuffer(gl.FRAMEBUFFER, t.fbo)
+	gl.Viewport(0, 0, int32(pr.w), int32(pr.h))
 	gl.Clear(gl.COLOR_BUFFER_BIT)
 	drawFunc()
-	// Start the transfer of the image to the PBO.
-	gl.BindBuffer(gl.PIXEL_PACK_BUFFER, t.pbo)
-	gl.ReadPixels(0, 0, int32(pr.w), int32(pr.h), gl.RGBA, gl.UNSIGNED_BYTE, nil)
-	gl.BindFramebuffer(gl.FRAMEBUFFER, 0)
+	if pr.packer != nil {
+		pr.packer.Draw(pr.curTargetIndex, t.tex)
+	} else {
+		// Start the transfer of the image to the PBO.
+		gl.BindBuffer(gl.PIXEL_PACK_BUFFER, t.pbo)
+		gl.ReadPixels(0, 0, int32(pr.w), int32(pr.h), gl.RGBA, pr.format.transferType(), nil)
+		gl.BindBuffer(gl.PIXEL_PACK_BUFFER, 0)
+	}
+	if pr.fences {
+		// The transfer completes in the background while the next frames
+		// are rendered, the fence tells when it can be read without
+		// stalling.
+		if t.fence != 0 {
+			gl.DeleteSync(t.fence)
+		}
+		t.fence = gl.FenceSync(gl.SYNC_GPU_COMMANDS_COMPLETE, 0)
+	}
+	gl.BindFramebuffer(gl.FRAMEBUFFER, uint32(prevFBO))
+	gl.Viewport(prevViewport[0], prevViewport[1], prevViewport[2], prevViewport[3])
 	return pr.curTargetIndex
 }
 
+// wait blocks until the transfer of target i has completed.
+func (pr *pboRenderer) wait(i int) {
+	t := &pr.targets[i]
+	if t.fence == 0 {
+		return
+	}
+	for gl.ClientWaitSync(t.fence, gl.SYNC_FLUSH_COMMANDS_BIT, uint64(time.Second)) == gl.TIMEOUT_EXPIRED {
+		// Keep waiting, the frame may take long to render.
+	}
+	gl.DeleteSync(t.fence)
+	t.fence = 0
+}
+
 func (pr *pboRenderer) Texture(handle interface{}) (uint32, func()) {
 	t := pr.targets[handle.(int)]
 	var tex uint32
 	gl.GenTextures(1, &tex)
 	gl.BindTexture(gl.TEXTURE_2D, tex)
-	gl.TexImage2D(gl.TEXTURE_2D, 0, gl.RGBA, int32(pr.w), int32(pr.h), 0, gl.RGBA, gl.UNSIGNED_BYTE, nil)
+	gl.TexImage2D(gl.TEXTURE_2D, 0, pr.format.internalFormat(), int32(pr.w), int32(pr.h), 0, gl.RGBA, pr.format.transferType(), nil)
 	gl.TexParameteri(gl.TEXTURE_2D, gl.TEXTURE_WRAP_S, gl.CLAMP_TO_EDGE)
 	gl.TexParameteri(gl.TEXTURE_2D, gl.TEXTURE_WRAP_T, gl.CLAMP_TO_EDGE)
 	gl.TexParameteri(gl.TEXTURE_2D, gl.TEXTURE_MAG_FILTER, gl.NEAREST)
 	gl.TexParameteri(gl.TEXTURE_2D, gl.TEXTURE_MIN_FILTER, gl.NEAREST)
 
-	gl.BindBuffer(gl.PIXEL_UNPACK_BUFFER, t.pbo)
-	gl.TexSubImage2D(gl.TEXTURE_2D, 0, 0, 0, int32(pr.w), int32(pr.h), gl.RGBA, gl.UNSIGNED_BYTE, nil)
-	gl.BindBuffer(gl.PIXEL_UNPACK_BUFFER, 0)
+	if pr.packer != nil {
+		// The pixel buffer is not filled, copy from the framebuffer.
+		var prevFBO int32
+		gl.GetIntegerv(gl.READ_FRAMEBUFFER_BINDING, &prevFBO)
+		gl.BindFramebuffer(gl.READ_FRAMEBUFFER, t.fbo)
+		gl.CopyTexSubImage2D(gl.TEXTURE_2D, 0, 0, 0, 0, 0, int32(pr.w), int32(pr.h))
+		gl.BindFramebuffer(gl.READ_FRAMEBUFFER, uint32(prevFBO))
+	} else {
+		gl.BindBuffer(gl.PIXEL_UNPACK_BUFFER, t.pbo)
+		gl.TexSubImage2D(gl.TEXTURE_2D, 0, 0, 0, int32(pr.w), int32(pr.h), gl.RGBA, pr.format.transferType(), nil)
+		gl.BindBuffer(gl.PIXEL_UNPACK_BUFFER, 0)
+	}
 	gl.BindTexture(gl.TEXTURE_2D, 0)
 	return tex, func() {
 		gl.DeleteTextures(1, &tex)
@@ -691,9 +2049,16 @@ func (pr *pboRenderer) Texture(handle interface{}) (uint32, func()) {
 func (pr *pboRenderer) Close() error {
 	for _, t := range pr.targets {
 		gl.DeleteFramebuffers(1, &t.fbo)
-		gl.DeleteRenderbuffers(1, &t.rbo)
+		gl.DeleteTextures(1, &t.tex)
 		gl.DeleteBuffers(1, &t.pbo)
+		if t.fence != 0 {
+			gl.DeleteSync(t.fence)
+		}
+	}
+	if pr.packer != nil {
+		pr.packer.Close()
 	}
+	pr.memory.Release()
 	return nil
 }
 
@@ -0,0 +1,120 @@
+package renderer
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// The checks in this file verify the features that are required by shaders and
+// render targets before they are used, so users get an actionable error
+// instead of a cryptic message from the driver, or a black screen.
+
+var (
+	versionDirectiveRe = regexp.MustCompile(`(?m)^\s*#version\s+(\d+)(\s+es)?`)
+	derivativeFuncRe   = regexp.MustCompile(`\b(dFdx|dFdy|fwidth)\s*\(`)
+	derivativeExtRe    = regexp.MustCompile(`(?m)^\s*#extension\s+GL_OES_standard_derivatives\b`)
+	glVersionRe        = regexp.MustCompile(`^(?:OpenGL ES (?:GLSL ES )?)?(\d+)\.(\d+)`)
+)
+
+var (
+	cachedContextInfoOnce sync.Once
+	cachedContextInfo     ContextInfo
+)
+
+// contextInfo returns the capabilities of the current context. Only a single
+// context is used, so the info is queried once.
+func contextInfo() ContextInfo {
+	cachedContextInfoOnce.Do(func() {
+		cachedContextInfo = currentContextInfo()
+	})
+	return cachedContextInfo
+}
+
+// parseGLVersion parses the major and minor version from a GL_VERSION string.
+func parseGLVersion(s string) (int, int, bool) {
+	m := glVersionRe.FindStringSubmatch(s)
+	if m == nil {
+		return 0, 0, false
+	}
+	major, _ := strconv.Atoi(m[1])
+	minor, _ := strconv.Atoi(m[2])
+	return major, minor, true
+}
+
+// CheckTextureSize returns an error if a texture of the specified size exceeds
+// the limits of the OpenGL implementation. It must be called from the thread
+// that owns the OpenGL context.
+func CheckTextureSize(what string, width, height int) error {
+	info := contextInfo()
+	if max := info.MaxTextureSize; max > 0 && (width > max || height > max) {
+		return fmt.Errorf("%s is %dx%d, but %s supports textures of at most %dx%d, please use a smaller size", what, width, height, info.Renderer, max, max)
+	}
+	return nil
+}
+
+// checkRenderTarget verifies that a render target of the specified size and
+// format can be created.
+func checkRenderTarget(width, height uint, format PixelFormat) error {
+	info := contextInfo()
+	if max := info.MaxRenderbufferSize; max > 0 && (int(width) > max || int(height) > max) {
+		return fmt.Errorf("the render size of %dx%d exceeds the maximum of %dx%d supported by %s, please use a smaller -g or buffer size, or -tile for still images", width, height, max, max, info.Renderer)
+	}
+	if format != PixelFormatRGBA8 && !supportsFloatTargets(info) {
+		return fmt.Errorf("%s framebuffers require OpenGL 3.0 or the GL_ARB_color_buffer_float and GL_ARB_texture_float extensions, which %s does not support, please use rgba8", format, info.Renderer)
+	}
+	return nil
+}
+
+func supportsFloatTargets(info ContextInfo) bool {
+	if major, _, ok := parseGLVersion(info.Version); !ok || major >= 3 {
+		// Let the driver decide if the version is unknown.
+		return true
+	}
+	return info.HasExtension("GL_ARB_color_buffer_float") && info.HasExtension("GL_ARB_texture_float")
+}
+
+// supportsFences reports whether the context supports sync objects, which are
+// part of OpenGL 3.2 and OpenGL ES 3.0.
+func supportsFences(info ContextInfo) bool {
+	major, minor, ok := parseGLVersion(info.Version)
+	if !ok {
+		// Calling the functions is fatal if they are missing, so unknown
+		// versions are assumed not to support them.
+		return false
+	}
+	if strings.HasPrefix(info.Version, "OpenGL ES") {
+		return major >= 3
+	}
+	return major > 3 || major == 3 && minor >= 2 || info.HasExtension("GL_ARB_sync")
+}
+
+// checkSourceRequirements verifies that the features used by the sources of a
+// stage are available in the GLSL version they are compiled with.
+func checkSourceRequirements(stage Stage, sources []Source) error {
+	src := ""
+	for _, s := range sources {
+		c, err := s.Contents()
+		if err != nil {
+			return err
+		}
+		src += string(c) + "\n"
+	}
+	return checkGLSLRequirements(stage, src)
+}
+
+func checkGLSLRequirements(stage Stage, src string) error {
+	m := versionDirectiveRe.FindStringSubmatch(src)
+	if m == nil {
+		return nil
+	}
+	version, _ := strconv.Atoi(m[1])
+	es := m[2] != "" || version == 100
+	if es && version < 300 && stage == StageFragment && derivativeFuncRe.MatchString(src) && !derivativeExtRe.MatchString(src) {
+		fn := derivativeFuncRe.FindStringSubmatch(src)[1]
+		return fmt.Errorf("%s requires the GL_OES_standard_derivatives extension, which is not enabled in GLSL ES %d, please use a newer -glsl version", fn, version)
+	}
+	return nil
+}
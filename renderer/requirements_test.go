@@ -0,0 +1,84 @@
+package renderer
+
+import (
+	"testing"
+)
+
+func TestParseGLVersion(t *testing.T) {
+	cases := map[string][2]int{
+		"3.3 (Core Profile) Mesa 23.1.0": {3, 3},
+		"4.6.0 NVIDIA 535.54.03":         {4, 6},
+		"2.1 Mesa 10.1.3":                {2, 1},
+		"OpenGL ES 2.0 Mesa 20.0.8":      {2, 0},
+	}
+	for input, expected := range cases {
+		major, minor, ok := parseGLVersion(input)
+		if !ok || major != expected[0] || minor != expected[1] {
+			t.Errorf("parseGLVersion(%q) = %d, %d, %v, expected %v", input, major, minor, ok, expected)
+		}
+	}
+	if _, _, ok := parseGLVersion("foo"); ok {
+		t.Errorf("expected an invalid version to fail")
+	}
+}
+
+func TestSupportsFloatTargets(t *testing.T) {
+	if !supportsFloatTargets(ContextInfo{Version: "3.3 Mesa"}) {
+		t.Errorf("OpenGL 3.3 should support float targets")
+	}
+	if supportsFloatTargets(ContextInfo{Version: "2.1 Mesa"}) {
+		t.Errorf("OpenGL 2.1 without extensions should not support float targets")
+	}
+	info := ContextInfo{Version: "2.1 Mesa", Extensions: []string{"GL_ARB_color_buffer_float", "GL_ARB_texture_float"}}
+	if !supportsFloatTargets(info) {
+		t.Errorf("OpenGL 2.1 with extensions should support float targets")
+	}
+}
+
+func TestSupportsFences(t *testing.T) {
+	supported := []ContextInfo{
+		{Version: "3.3 (Core Profile) Mesa 23.1.0"},
+		{Version: "4.6.0 NVIDIA 535.54.03"},
+		{Version: "OpenGL ES 3.2 Mesa 23.1.0"},
+		{Version: "2.1 Mesa 10.1.3", Extensions: []string{"GL_ARB_sync"}},
+	}
+	for _, info := range supported {
+		if !supportsFences(info) {
+			t.Errorf("expected %q to support fences", info.Version)
+		}
+	}
+	unsupported := []ContextInfo{
+		{Version: "3.1 Mesa 10.1.3"},
+		{Version: "OpenGL ES 2.0 Mesa 20.0.8"},
+		{Version: ""},
+	}
+	for _, info := range unsupported {
+		if supportsFences(info) {
+			t.Errorf("expected %q to not support fences", info.Version)
+		}
+	}
+}
+
+func TestCheckGLSLRequirements(t *testing.T) {
+	valid := []string{
+		"#version 330\nvoid main() { float f = dFdx(1.0); }",
+		"#version 100\nvoid main() { gl_FragColor = vec4(1.0); }",
+		"#version 100\n#extension GL_OES_standard_derivatives : enable\nvoid main() { float f = fwidth(1.0); }",
+		"#version 300 es\nvoid main() { float f = dFdy(1.0); }",
+		"void main() { float f = dFdx(1.0); }",
+	}
+	for _, src := range valid {
+		if err := checkGLSLRequirements(StageFragment, src); err != nil {
+			t.Errorf("unexpected error for %q: %v", src, err)
+		}
+	}
+	invalid := []string{
+		"#version 100\nvoid main() { float f = dFdx(1.0); }",
+		"#version 100\nvoid main() { float f = fwidth (1.0); }",
+	}
+	for _, src := range invalid {
+		if err := checkGLSLRequirements(StageFragment, src); err == nil {
+			t.Errorf("expected an error for %q", src)
+		}
+	}
+}
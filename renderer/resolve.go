@@ -0,0 +1,180 @@
+package renderer
+
+import (
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// A Resolver locates the sources that are included with `#pragma use`.
+type Resolver interface {
+	// Resolve returns the source of the include path, which is included by a
+	// source with the specified parent directory, see Source.Dir.
+	Resolve(fromDir, path string) (Source, error)
+}
+
+// FileResolver resolves includes on disk. Relative paths are resolved
+// relative to the including file first and then to each directory of the
+// search path.
+type FileResolver struct {
+	SearchPath []string
+}
+
+// Resolve implements the Resolver interface.
+func (r FileResolver) Resolve(fromDir, name string) (Source, error) {
+	if filepath.IsAbs(name) {
+		return SourceFile{Filename: filepath.Clean(name)}, nil
+	}
+	dirs := append([]string{fromDir}, r.SearchPath...)
+	var first string
+	for i, dir := range dirs {
+		filename, err := filepath.Abs(filepath.Join(dir, name))
+		if err != nil {
+			return nil, err
+		}
+		if _, err := os.Stat(filename); err == nil {
+			return SourceFile{Filename: filename}, nil
+		}
+		if i == 0 {
+			first = filename
+		}
+	}
+	if len(r.SearchPath) > 0 {
+		return nil, fmt.Errorf("%s not found in %s", name, strings.Join(dirs, ", "))
+	}
+	// The file is returned as is, so the error of reading it is reported.
+	return SourceFile{Filename: first}, nil
+}
+
+// FSResolver resolves includes in a file system, like embedded files.
+type FSResolver struct {
+	FS fs.FS
+}
+
+// Resolve implements the Resolver interface. Paths are slash separated and
+// relative to the including file, or to the root of the file system if they
+// start with a slash.
+func (r FSResolver) Resolve(fromDir, name string) (Source, error) {
+	if strings.HasPrefix(name, "/") {
+		name = path.Clean(name[1:])
+	} else {
+		name = path.Join(fromDir, name)
+	}
+	if !fs.ValidPath(name) {
+		return nil, fmt.Errorf("invalid include path %q", name)
+	}
+	return SourceFS{FS: r.FS, Name: name}, nil
+}
+
+// URLResolver resolves includes that are HTTP or HTTPS URLs and relative
+// includes of sources that were downloaded. Other includes are resolved with
+// Next.
+type URLResolver struct {
+	// Client is used to download sources. Defaults to http.DefaultClient.
+	Client *http.Client
+	Next   Resolver
+}
+
+// Resolve implements the Resolver interface.
+func (r URLResolver) Resolve(fromDir, name string) (Source, error) {
+	if isURL(name) {
+		return SourceURL{URL: name, Client: r.Client}, nil
+	}
+	if isURL(fromDir) {
+		base, err := url.Parse(fromDir + "/")
+		if err != nil {
+			return nil, err
+		}
+		ref, err := url.Parse(name)
+		if err != nil {
+			return nil, err
+		}
+		return SourceURL{URL: base.ResolveReference(ref).String(), Client: r.Client}, nil
+	}
+	return r.Next.Resolve(fromDir, name)
+}
+
+func isURL(s string) bool {
+	return strings.HasPrefix(s, "http://") || strings.HasPrefix(s, "https://")
+}
+
+// SourceFS is an implementation of the Source interface for files of a file
+// system.
+type SourceFS struct {
+	FS   fs.FS
+	Name string
+}
+
+// Contents implements the Source interface.
+func (s SourceFS) Contents() ([]byte, error) {
+	return fs.ReadFile(s.FS, s.Name)
+}
+
+// Dir implements the Source interface.
+func (s SourceFS) Dir() string {
+	return path.Dir(s.Name)
+}
+
+// SourceURL is an implementation of the Source interface for sources that are
+// downloaded over HTTP. They are downloaded every time they are read.
+type SourceURL struct {
+	URL string
+	// Client is used for the download. Defaults to http.DefaultClient.
+	Client *http.Client
+}
+
+// Contents implements the Source interface.
+func (s SourceURL) Contents() ([]byte, error) {
+	client := s.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Get(s.URL)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("could not download %s: %s", s.URL, resp.Status)
+	}
+	return io.ReadAll(resp.Body)
+}
+
+// Dir implements the Source interface.
+func (s SourceURL) Dir() string {
+	u, err := url.Parse(s.URL)
+	if err != nil {
+		return s.URL
+	}
+	u.Path = path.Dir(u.Path)
+	u.RawQuery, u.Fragment = "", ""
+	return strings.TrimSuffix(u.String(), "/")
+}
+
+// sourceID identifies a source so it is included only once.
+func sourceID(s Source) string {
+	switch s := s.(type) {
+	case SourceFile:
+		return "file:" + s.Filename
+	case SourceFS:
+		return "fs:" + s.Name
+	case SourceURL:
+		return s.URL
+	case PrefixedSource:
+		return "prefix:" + s.Prefix + ":" + sourceID(s.Source)
+	case ParameterizedSource:
+		var defines []string
+		for _, name := range s.names() {
+			defines = append(defines, name+"="+s.Defines[name])
+		}
+		return "with:" + strings.Join(defines, ",") + ":" + sourceID(s.Source)
+	}
+	c, _ := s.Contents()
+	return "buf:" + string(c)
+}
@@ -0,0 +1,292 @@
+package renderer
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/gob"
+	"fmt"
+	"io"
+	"log"
+	"time"
+
+	"github.com/go-gl/gl/v3.3-core/gl"
+)
+
+// stateMagic starts state files, followed by the version of the encoding.
+var stateMagic = []byte("SHADYSTATE")
+
+const stateVersion = 1
+
+// State is a snapshot of the buffers of an engine, like the state of a
+// simulation, which an engine can resume from later.
+type State struct {
+	// Time and Frame are those of the next frame of the engine.
+	Time  time.Duration
+	Frame uint64
+	// Buffers are the last frames of the buffers by name. The names of
+	// buffers of buffers are joined by a slash.
+	Buffers map[string]BufferState
+	// Back is the last frame of the engine itself, which shaders read as
+	// the previous frame, like the Back Buffer of shadertoy. It is nil if
+	// nothing was rendered yet.
+	Back *BufferState
+}
+
+// BufferState is the last frame of a buffer.
+type BufferState struct {
+	Width, Height uint
+	Format        PixelFormat
+	Time          time.Duration
+	Frame         uint64
+	// Pix holds the pixels in the order of OpenGL, bottom to top, as bytes
+	// for PixelFormatRGBA8 and as 32-bit floats for other formats.
+	Pix []byte
+}
+
+// WriteState encodes the state to w.
+func WriteState(w io.Writer, st *State) error {
+	bw := bufio.NewWriter(w)
+	fmt.Fprintf(bw, "%s %d\n", stateMagic, stateVersion)
+	if err := gob.NewEncoder(bw).Encode(st); err != nil {
+		return err
+	}
+	return bw.Flush()
+}
+
+// ReadState decodes a state that was written by WriteState.
+func ReadState(r io.Reader) (*State, error) {
+	br := bufio.NewReader(r)
+	header, err := br.ReadBytes('\n')
+	if err != nil || !bytes.HasPrefix(header, stateMagic) {
+		return nil, fmt.Errorf("not a state file of shady")
+	}
+	var version int
+	if _, err := fmt.Sscanf(string(header[len(stateMagic):]), " %d\n", &version); err != nil || version != stateVersion {
+		return nil, fmt.Errorf("unsupported version of the state file: %q", bytes.TrimSpace(header))
+	}
+	var st State
+	if err := gob.NewDecoder(br).Decode(&st); err != nil {
+		return nil, fmt.Errorf("could not decode state: %w", err)
+	}
+	return &st, nil
+}
+
+// captureBuffers adds the last frames of the sub targets, and of theirs, to
+// the buffers of the state.
+func captureBuffers(st *State, prefix string, targets map[string]*Shader) {
+	for name, s := range targets {
+		b, ok := s.captureFrame()
+		if !ok {
+			// Nothing was rendered yet.
+			continue
+		}
+		st.Buffers[prefix+name] = b
+		captureBuffers(st, prefix+name+"/", s.subTargets)
+	}
+}
+
+// captureFrame returns the frame that the shader reads as its previous frame,
+// or false if nothing was rendered yet.
+func (s *Shader) captureFrame() (BufferState, bool) {
+	pr := s.renderer.(*pboRenderer)
+	pix := make([]byte, int(s.w)*int(s.h)*pr.format.bytesPerPixel())
+	switch {
+	case s.prevFrameHandle != nil && s.warp != nil:
+		// The previous frame is the image before it was warped.
+		readTexture(s.warpTargets[s.warpTarget].tex, int32(s.w), int32(s.h), pr.format, pix)
+	case s.prevFrameHandle != nil && pr.packer != nil:
+		// The pixel buffer is not filled, see pboRenderer.Texture.
+		readTexture(pr.targets[s.prevFrameHandle.(int)].tex, int32(s.w), int32(s.h), pr.format, pix)
+	case s.prevFrameHandle != nil:
+		i := s.prevFrameHandle.(int)
+		pr.wait(i)
+		gl.BindBuffer(gl.PIXEL_PACK_BUFFER, pr.targets[i].pbo)
+		gl.GetBufferSubData(gl.PIXEL_PACK_BUFFER, 0, len(pix), gl.Ptr(&pix[0]))
+		gl.BindBuffer(gl.PIXEL_PACK_BUFFER, 0)
+	case s.initialFrame != 0:
+		readTexture(s.initialFrame, int32(s.w), int32(s.h), pr.format, pix)
+	default:
+		return BufferState{}, false
+	}
+	return BufferState{
+		Width:  s.w,
+		Height: s.h,
+		Format: pr.format,
+		Time:   s.time,
+		Frame:  s.frame,
+		Pix:    pix,
+	}, true
+}
+
+// readTexture copies the pixels of the texture, which has the size w by h, to
+// pix.
+func readTexture(tex uint32, w, h int32, format PixelFormat, pix []byte) {
+	var prevRead int32
+	gl.GetIntegerv(gl.READ_FRAMEBUFFER_BINDING, &prevRead)
+	var fbo uint32
+	gl.GenFramebuffers(1, &fbo)
+	gl.BindFramebuffer(gl.READ_FRAMEBUFFER, fbo)
+	gl.FramebufferTexture2D(gl.READ_FRAMEBUFFER, gl.COLOR_ATTACHMENT0, gl.TEXTURE_2D, tex, 0)
+	gl.PixelStorei(gl.PACK_ALIGNMENT, 4)
+	gl.ReadPixels(0, 0, w, h, gl.RGBA, format.transferType(), gl.Ptr(&pix[0]))
+	gl.BindFramebuffer(gl.READ_FRAMEBUFFER, uint32(prevRead))
+	gl.DeleteFramebuffers(1, &fbo)
+}
+
+// restoreBuffers sets the frames of the state as the initial frames of the
+// sub targets, and of theirs. Buffers of which the size or the format changed
+// start over.
+func restoreBuffers(st *State, prefix string, targets map[string]*Shader) error {
+	for name, s := range targets {
+		b, ok := st.Buffers[prefix+name]
+		if !ok {
+			log.Printf("The state has no buffer %s, it starts over", prefix+name)
+			continue
+		}
+		if restored, err := s.restoreFrame(prefix+name, b); err != nil {
+			return err
+		} else if !restored {
+			continue
+		}
+		s.time, s.frame = b.Time, b.Frame
+		if err := restoreBuffers(st, prefix+name+"/", s.subTargets); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// restoreFrame sets the frame as the initial frame of the shader. It returns
+// false if the size or the format of the frame does not match.
+func (s *Shader) restoreFrame(name string, b BufferState) (bool, error) {
+	pr := s.renderer.(*pboRenderer)
+	if b.Width != s.w || b.Height != s.h || b.Format != pr.format || len(b.Pix) != int(s.w)*int(s.h)*pr.format.bytesPerPixel() {
+		log.Printf("The buffer %s of the state is %dx%d %s, but the buffer is %dx%d %s, it starts over", name, b.Width, b.Height, b.Format, s.w, s.h, pr.format)
+		return false, nil
+	}
+	s.freeInitialFrame()
+	if err := s.allocInitialFrame(b.Pix); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// stateRequest is a request for the state of an engine that is served by the
+// thread that renders.
+type stateRequest chan *State
+
+// requestState sends a request to an engine and waits for the state.
+func requestState(ctx context.Context, requests chan stateRequest) (*State, error) {
+	reply := make(stateRequest, 1)
+	select {
+	case requests <- reply:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	select {
+	case st := <-reply:
+		return st, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// SetInitialState resumes from a state. The time and frame are set right
+// away, the buffers are restored for the first environment that is loaded. It
+// should be called before animating.
+func (sh *Shader) SetInitialState(st *State) {
+	sh.initialState = st
+	sh.time, sh.frame = st.Time, st.Frame
+}
+
+// CaptureState returns the current state. It must be called from the thread
+// that owns the OpenGL context while not animating, like after Animate
+// returned. See State for other goroutines.
+func (sh *Shader) CaptureState() *State {
+	st := &State{Time: sh.time, Frame: sh.frame, Buffers: map[string]BufferState{}}
+	captureBuffers(st, "", sh.subTargets)
+	if b, ok := sh.captureFrame(); ok {
+		st.Back = &b
+	}
+	return st
+}
+
+// State returns the state after the current frame. It may be called from any
+// goroutine while animating.
+func (sh *Shader) State(ctx context.Context) (*State, error) {
+	return requestState(ctx, sh.stateRequests)
+}
+
+// restoreState applies the initial state, if it is set, to the environment
+// that was just loaded.
+func (sh *Shader) restoreState() error {
+	if sh.initialState == nil {
+		return nil
+	}
+	st := sh.initialState
+	sh.initialState = nil
+	if st.Back != nil {
+		if _, err := sh.restoreFrame("Back Buffer", *st.Back); err != nil {
+			return err
+		}
+	}
+	return restoreBuffers(st, "", sh.subTargets)
+}
+
+// SetInitialState resumes from a state like Shader.SetInitialState. It should
+// be called before animating.
+func (eng *OnScreenEngine) SetInitialState(st *State) {
+	eng.initialState = st
+	eng.time, eng.frame = st.Time, st.Frame
+}
+
+// CaptureState returns the current state like Shader.CaptureState.
+func (eng *OnScreenEngine) CaptureState() *State {
+	st := &State{Time: eng.time, Frame: eng.frame, Buffers: map[string]BufferState{}}
+	captureBuffers(st, "", eng.subTargets)
+	// The targets are only allocated once the window is shown.
+	if t := eng.targets[(eng.target+len(eng.targets)-1)%len(eng.targets)]; t.tex != 0 {
+		w, h := eng.canvasSize(eng.window.GetFramebufferSize())
+		pix := make([]byte, w*h*4)
+		readTexture(t.tex, int32(w), int32(h), PixelFormatRGBA8, pix)
+		st.Back = &BufferState{
+			Width:  uint(w),
+			Height: uint(h),
+			Format: PixelFormatRGBA8,
+			Time:   eng.time,
+			Frame:  eng.frame,
+			Pix:    pix,
+		}
+	}
+	return st
+}
+
+// State returns the state after the current frame. It may be called from any
+// goroutine while animating.
+func (eng *OnScreenEngine) State(ctx context.Context) (*State, error) {
+	return requestState(ctx, eng.stateRequests)
+}
+
+func (eng *OnScreenEngine) restoreState() error {
+	if eng.initialState == nil {
+		return nil
+	}
+	st := eng.initialState
+	eng.initialState = nil
+	if b := st.Back; b != nil {
+		w, h := eng.canvasSize(eng.window.GetFramebufferSize())
+		if b.Width != uint(w) || b.Height != uint(h) || b.Format != PixelFormatRGBA8 || len(b.Pix) != w*h*4 {
+			log.Printf("The Back Buffer of the state is %dx%d %s, but the window is %dx%d %s, it starts over", b.Width, b.Height, b.Format, w, h, PixelFormatRGBA8)
+		} else {
+			// Either target may be read as the previous frame first.
+			gl.PixelStorei(gl.UNPACK_ALIGNMENT, 4)
+			for _, t := range eng.targets {
+				gl.BindTexture(gl.TEXTURE_2D, t.tex)
+				gl.TexSubImage2D(gl.TEXTURE_2D, 0, 0, 0, int32(w), int32(h), gl.RGBA, gl.UNSIGNED_BYTE, gl.Ptr(&b.Pix[0]))
+			}
+			gl.BindTexture(gl.TEXTURE_2D, 0)
+		}
+	}
+	return restoreBuffers(st, "", eng.subTargets)
+}
@@ -0,0 +1,48 @@
+package renderer
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestStateRoundTrip(t *testing.T) {
+	st := &State{
+		Time:  90 * time.Second,
+		Frame: 5400,
+		Buffers: map[string]BufferState{
+			"sim":      {Width: 2, Height: 1, Format: PixelFormatRGBA32F, Time: 90 * time.Second, Frame: 5400, Pix: bytes.Repeat([]byte{1}, 32)},
+			"sim/blur": {Width: 1, Height: 1, Format: PixelFormatRGBA8, Time: 90 * time.Second, Frame: 5400, Pix: []byte{1, 2, 3, 4}},
+		},
+		Back: &BufferState{Width: 1, Height: 1, Format: PixelFormatRGBA8, Time: 90 * time.Second, Frame: 5400, Pix: []byte{4, 3, 2, 1}},
+	}
+	var buf bytes.Buffer
+	if err := WriteState(&buf, st); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(buf.String(), "SHADYSTATE 1\n") {
+		t.Fatalf("the header is missing: %q", buf.String()[:16])
+	}
+	got, err := ReadState(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, st) {
+		t.Fatalf("got %+v, expected %+v", got, st)
+	}
+}
+
+func TestReadStateInvalid(t *testing.T) {
+	for _, data := range []string{
+		"",
+		"\x89PNG\r\n",
+		"SHADYSTATE 2\n",
+		"SHADYSTATE 1\ngarbage",
+	} {
+		if _, err := ReadState(strings.NewReader(data)); err == nil {
+			t.Errorf("%q: expected an error", data)
+		}
+	}
+}
@@ -0,0 +1,99 @@
+package renderer
+
+import (
+	"context"
+	"fmt"
+	"image"
+	"image/draw"
+	"time"
+
+	"github.com/polyfloyd/shady/encode"
+)
+
+// Tile is the part of an image that the canvas renders when an image is
+// rendered in tiles, see Shader.RenderTiles.
+type Tile struct {
+	// X and Y are the offset of the tile in the image in pixels, from the
+	// bottom left like gl_FragCoord.
+	X, Y uint
+	// ImageWidth and ImageHeight are the size of the whole image.
+	ImageWidth, ImageHeight uint
+}
+
+// RenderTiles renders a single frame of width by height pixels, which may be
+// larger than the render targets of the GPU can be. The image is rendered in
+// tiles of the size of the Shader, which are assembled in memory. Each tile
+// renders the same frame with an offset, see RenderState.Tile.
+//
+// Buffers are rendered from the whole canvas, so environments with sub
+// environments can not be rendered in tiles. Neither can a warp or output
+// layout be used.
+func (sh *Shader) RenderTiles(width, height uint, interval time.Duration) (image.Image, error) {
+	if err := sh.reloadEnvironment(context.Background()); err != nil {
+		sh.health.Error(err)
+		return nil, err
+	}
+	if len(sh.subTargets) > 0 {
+		return nil, fmt.Errorf("shaders with buffers can not be rendered in tiles")
+	}
+	pr := sh.renderer.(*pboRenderer)
+	if sh.warp != nil || pr.layout != OutputLayoutRGBA {
+		return nil, fmt.Errorf("tiles can not be rendered with a warp or output layout")
+	}
+
+	var img image.Image
+	if pr.format == PixelFormatRGBA8 {
+		img = encode.NewFrame(image.Rect(0, 0, int(width), int(height)))
+	} else {
+		img = encode.NewFloatFrame(image.Rect(0, 0, int(width), int(height)))
+	}
+	startTime, startFrame := sh.time, sh.frame
+	defer func() { sh.tile = nil }()
+	for _, r := range tileRects(width, height, sh.w, sh.h) {
+		// Every tile renders the same frame from scratch, so the frame of
+		// the previous tile is not reused or read as the previous frame.
+		sh.time, sh.frame = startTime, startFrame
+		sh.prevFrameHandle = nil
+		sh.tile = &Tile{X: uint(r.Min.X), Y: uint(r.Min.Y), ImageWidth: width, ImageHeight: height}
+		handle := sh.nextHandle(interval)
+		if handle == nil {
+			encode.ReleaseFrame(img)
+			return nil, fmt.Errorf("could not render tile at %d,%d", r.Min.X, r.Min.Y)
+		}
+		tile := pr.Image(handle)
+		pasteTile(img, tile, r.Min)
+		encode.ReleaseFrame(tile)
+	}
+	sh.health.Frame()
+	return img, nil
+}
+
+// tileRects splits an image into tiles of tileWidth by tileHeight pixels. The
+// tiles at the right and top edges extend past the image if it is not a
+// multiple of the tile size.
+func tileRects(width, height, tileWidth, tileHeight uint) []image.Rectangle {
+	var rects []image.Rectangle
+	for y := uint(0); y < height; y += tileHeight {
+		for x := uint(0); x < width; x += tileWidth {
+			rects = append(rects, image.Rect(int(x), int(y), int(x+tileWidth), int(y+tileHeight)))
+		}
+	}
+	return rects
+}
+
+// pasteTile copies a tile that was read back into the image at the offset.
+// Both are in the order in which rows are read back, so the rows of a tile
+// are not flipped. The parts of a tile that lie outside of the image are left
+// out.
+func pasteTile(dst, tile image.Image, at image.Point) {
+	switch d := dst.(type) {
+	case *image.RGBA:
+		draw.Draw(d, tile.Bounds().Add(at), tile, image.Point{}, draw.Src)
+	case *encode.FloatFrame:
+		t := tile.(*encode.FloatFrame)
+		r := t.Rect.Add(at).Intersect(d.Rect)
+		for y := r.Min.Y; y < r.Max.Y; y++ {
+			copy(d.Pix[d.PixOffset(r.Min.X, y):d.PixOffset(r.Max.X, y)], t.Pix[t.PixOffset(r.Min.X-at.X, y-at.Y):])
+		}
+	}
+}
@@ -0,0 +1,57 @@
+package renderer
+
+import (
+	"image"
+	"image/color"
+	"reflect"
+	"testing"
+
+	"github.com/polyfloyd/shady/encode"
+)
+
+func TestTileRects(t *testing.T) {
+	rects := tileRects(5, 3, 2, 2)
+	expected := []image.Rectangle{
+		image.Rect(0, 0, 2, 2), image.Rect(2, 0, 4, 2), image.Rect(4, 0, 6, 2),
+		image.Rect(0, 2, 2, 4), image.Rect(2, 2, 4, 4), image.Rect(4, 2, 6, 4),
+	}
+	if !reflect.DeepEqual(rects, expected) {
+		t.Fatalf("unexpected tiles: %v", rects)
+	}
+}
+
+func TestPasteTile(t *testing.T) {
+	dst := image.NewRGBA(image.Rect(0, 0, 3, 3))
+	tile := image.NewRGBA(image.Rect(0, 0, 2, 2))
+	for i := range tile.Pix {
+		tile.Pix[i] = 255
+	}
+	pasteTile(dst, tile, image.Pt(2, 1))
+	for y := 0; y < 3; y++ {
+		for x := 0; x < 3; x++ {
+			want := color.RGBA{}
+			if x == 2 && y >= 1 {
+				want = color.RGBA{255, 255, 255, 255}
+			}
+			if c := dst.RGBAAt(x, y); c != want {
+				t.Errorf("unexpected color at %d,%d: %v", x, y, c)
+			}
+		}
+	}
+
+	fdst := &encode.FloatFrame{Rect: image.Rect(0, 0, 3, 3), Pix: make([]float32, 3*3*4)}
+	ftile := &encode.FloatFrame{Rect: image.Rect(0, 0, 2, 2), Pix: make([]float32, 2*2*4)}
+	for i := range ftile.Pix {
+		ftile.Pix[i] = float32(i)
+	}
+	pasteTile(fdst, ftile, image.Pt(2, 1))
+	if v := fdst.Pix[fdst.PixOffset(2, 1):fdst.PixOffset(3, 1)]; !reflect.DeepEqual(v, []float32{0, 1, 2, 3}) {
+		t.Errorf("unexpected pixel: %v", v)
+	}
+	if v := fdst.Pix[fdst.PixOffset(2, 2):fdst.PixOffset(3, 2)]; !reflect.DeepEqual(v, []float32{8, 9, 10, 11}) {
+		t.Errorf("unexpected pixel: %v", v)
+	}
+	if v := fdst.Pix[fdst.PixOffset(1, 1)]; v != 0 {
+		t.Errorf("pixel outside of the tile was written: %v", v)
+	}
+}
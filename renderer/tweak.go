@@ -0,0 +1,264 @@
+package renderer
+
+import (
+	"fmt"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-gl/gl/v3.3-core/gl"
+)
+
+// Numeric literals that are annotated with a /*tweak*/ comment, or that are on
+// the line after a `#pragma tweak`, are lifted to uniforms, see SetTweaks.
+// Editing their values then updates the uniforms without recompiling.
+
+var (
+	tweakLiteralRe = regexp.MustCompile(`(\d+\.\d*|\.\d+|\d+)([eE][-+]?\d+)?[fF]?`)
+	tweakCommentRe = regexp.MustCompile(`^\s*/\*\s*tweak\s*\*/`)
+	tweakPragmaRe  = regexp.MustCompile(`^\s*#pragma\s+tweak\s*$`)
+	tweakConstRe   = regexp.MustCompile(`\bconst\s+`)
+	tweakGlobalRe  = regexp.MustCompile(`^(\s*)const\s+\w+\s+(\w+)\s*=\s*(.+?)\s*;\s*$`)
+)
+
+// The interval at which files are checked for changed tweak values.
+const tweakCheckInterval = time.Second / 10
+
+type tweak struct {
+	name string
+	// typ is "float" or "int".
+	typ      string
+	value    float64
+	location int32
+}
+
+// liftTweaks replaces the tweakable literals of a source with uniforms, which
+// are named after their index starting at first. The declarations are inserted
+// at the top of the source, or after the #version directive, followed by a
+// #line directive so the line numbers of errors are unchanged.
+//
+// Uniforms are not constant expressions, so the const qualifiers of lines with
+// a lifted literal are removed. Globals can not be initialized with uniforms
+// either, so constants outside of functions become macros.
+func liftTweaks(src string, first int) (string, []tweak) {
+	lines := strings.Split(src, "\n")
+	var tweaks []tweak
+	pragma := false
+	depth := 0
+	for i, line := range lines {
+		global := depth == 0
+		depth += strings.Count(line, "{") - strings.Count(line, "}")
+		all := pragma
+		pragma = tweakPragmaRe.MatchString(line)
+		if pragma {
+			continue
+		}
+
+		var out strings.Builder
+		prev := 0
+		for _, m := range tweakLiteralRe.FindAllStringIndex(line, -1) {
+			start, end := m[0], m[1]
+			if start > 0 && isIdentByte(line[start-1]) || end < len(line) && isIdentByte(line[end]) {
+				continue
+			}
+			replaceEnd := end
+			if c := tweakCommentRe.FindString(line[end:]); c != "" {
+				replaceEnd += len(c)
+			} else if !all {
+				continue
+			}
+			t, ok := parseTweak(line[start:end])
+			if !ok {
+				continue
+			}
+			t.name = fmt.Sprintf("shadyTweak%d", first+len(tweaks))
+			tweaks = append(tweaks, t)
+			out.WriteString(line[prev:start])
+			out.WriteString(t.name)
+			prev = replaceEnd
+		}
+		if prev == 0 {
+			continue
+		}
+		out.WriteString(line[prev:])
+		if m := tweakGlobalRe.FindStringSubmatch(out.String()); global && m != nil {
+			lines[i] = fmt.Sprintf("%s#define %s (%s)", m[1], m[2], m[3])
+		} else {
+			lines[i] = tweakConstRe.ReplaceAllString(out.String(), "")
+		}
+	}
+	if len(tweaks) == 0 {
+		return src, nil
+	}
+
+	var decls strings.Builder
+	for _, t := range tweaks {
+		fmt.Fprintf(&decls, "uniform %s %s;\n", t.typ, t.name)
+	}
+	return insertAfterVersion(strings.Join(lines, "\n"), decls.String()), tweaks
+}
+
+func isIdentByte(c byte) bool {
+	return c == '_' || c == '.' || '0' <= c && c <= '9' || 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z'
+}
+
+// parseTweak parses a literal matched by tweakLiteralRe.
+func parseTweak(lit string) (tweak, bool) {
+	if strings.ContainsAny(lit, ".eEfF") {
+		v, err := strconv.ParseFloat(strings.TrimRight(lit, "fF"), 64)
+		return tweak{typ: "float", value: v}, err == nil
+	}
+	// Like in C, literals with a leading zero are octal.
+	v, err := strconv.ParseInt(lit, 0, 32)
+	return tweak{typ: "int", value: float64(v)}, err == nil
+}
+
+// TweakOnly reports whether the source b only differs from a in the values of
+// tweakable literals, so it can be applied without recompiling.
+func TweakOnly(a, b []byte) bool {
+	liftedA, tweaksA := liftTweaks(string(a), 0)
+	liftedB, tweaksB := liftTweaks(string(b), 0)
+	return liftedA == liftedB && sameTweakTypes(tweaksA, tweaksB)
+}
+
+func sameTweakTypes(a, b []tweak) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i].typ != b[i].typ {
+			return false
+		}
+	}
+	return true
+}
+
+// liftedSource is a Source of which the tweakable literals are lifted.
+type liftedSource struct {
+	Source
+	contents string
+}
+
+func (s liftedSource) Contents() ([]byte, error) {
+	return []byte(s.contents), nil
+}
+
+// tweakedSource tracks the tweaks of a source file of a program.
+type tweakedSource struct {
+	filename string
+	first    int
+	lifted   string
+	modTime  time.Time
+	tweaks   []tweak
+}
+
+// tweakSet holds the tweaks of all sources of a program.
+type tweakSet struct {
+	sources []*tweakedSource
+	checked time.Time
+}
+
+// liftSourceTweaks lifts the tweakable literals of the sources of all stages.
+// It returns nil if none of the sources have any.
+func liftSourceTweaks(sources map[Stage][]Source) (map[Stage][]Source, *tweakSet, error) {
+	set := &tweakSet{}
+	n := 0
+	lifted := map[Stage][]Source{}
+	for stage, ss := range sources {
+		for _, s := range ss {
+			c, err := s.Contents()
+			if err != nil {
+				return nil, nil, err
+			}
+			src, tweaks := liftTweaks(string(c), n)
+			if len(tweaks) == 0 {
+				lifted[stage] = append(lifted[stage], s)
+				continue
+			}
+			lifted[stage] = append(lifted[stage], liftedSource{Source: s, contents: src})
+			ts := &tweakedSource{first: n, lifted: src, tweaks: tweaks}
+			if f, ok := s.(SourceFile); ok {
+				// Only files can change after the program is linked.
+				ts.filename = f.Filename
+				if info, err := os.Stat(f.Filename); err == nil {
+					ts.modTime = info.ModTime()
+				}
+			}
+			set.sources = append(set.sources, ts)
+			n += len(tweaks)
+		}
+	}
+	if n == 0 {
+		return sources, nil, nil
+	}
+	return lifted, set, nil
+}
+
+// locate looks up the locations of the uniforms in the linked program.
+func (set *tweakSet) locate(program uint32) {
+	if set == nil {
+		return
+	}
+	for _, ts := range set.sources {
+		for i := range ts.tweaks {
+			ts.tweaks[i].location = gl.GetUniformLocation(program, gl.Str(ts.tweaks[i].name+"\x00"))
+		}
+	}
+}
+
+// update reads the values of the tweaks from source files that were modified.
+// Changes to anything other than the values are left to be picked up by
+// reloading the shader. It reports whether any value was changed.
+func (set *tweakSet) update() bool {
+	if set == nil || time.Since(set.checked) < tweakCheckInterval {
+		return false
+	}
+	set.checked = time.Now()
+	changed := false
+	for _, ts := range set.sources {
+		if ts.filename == "" {
+			continue
+		}
+		info, err := os.Stat(ts.filename)
+		if err != nil || info.ModTime().Equal(ts.modTime) {
+			continue
+		}
+		ts.modTime = info.ModTime()
+		c, err := os.ReadFile(ts.filename)
+		if err != nil {
+			continue
+		}
+		lifted, tweaks := liftTweaks(string(c), ts.first)
+		if lifted != ts.lifted || !sameTweakTypes(tweaks, ts.tweaks) {
+			continue
+		}
+		for i, t := range tweaks {
+			if ts.tweaks[i].value != t.value {
+				ts.tweaks[i].value = t.value
+				changed = true
+			}
+		}
+	}
+	return changed
+}
+
+// apply sets the uniforms of the tweaks of the program that is in use.
+func (set *tweakSet) apply() {
+	if set == nil {
+		return
+	}
+	for _, ts := range set.sources {
+		for _, t := range ts.tweaks {
+			if t.location < 0 {
+				continue
+			}
+			if t.typ == "int" {
+				gl.Uniform1i(t.location, int32(t.value))
+			} else {
+				gl.Uniform1f(t.location, float32(t.value))
+			}
+		}
+	}
+}
@@ -0,0 +1,60 @@
+package renderer
+
+import (
+	"testing"
+)
+
+func TestLiftTweaks(t *testing.T) {
+	src := "#version 330\n" +
+		"const float speed = 2.5 /*tweak*/;\n" +
+		"#pragma tweak\n" +
+		"vec3 color = vec3(1.0, .5, 0);\n" +
+		"void main() {\n" +
+		"\tconst int n = 010/* tweak */;\n" +
+		"\tfloat vec2x = 3.0;\n" +
+		"}"
+	lifted, tweaks := liftTweaks(src, 4)
+	expected := "#version 330\n" +
+		"uniform float shadyTweak4;\n" +
+		"uniform float shadyTweak5;\n" +
+		"uniform float shadyTweak6;\n" +
+		"uniform int shadyTweak7;\n" +
+		"uniform int shadyTweak8;\n" +
+		"#line 2\n" +
+		"#define speed (shadyTweak4)\n" +
+		"#pragma tweak\n" +
+		"vec3 color = vec3(shadyTweak5, shadyTweak6, shadyTweak7);\n" +
+		"void main() {\n" +
+		"\tint n = shadyTweak8;\n" +
+		"\tfloat vec2x = 3.0;\n" +
+		"}"
+	if lifted != expected {
+		t.Errorf("unexpected lifted source:\n%s\nexpected:\n%s", lifted, expected)
+	}
+	values := []float64{2.5, 1, 0.5, 0, 8}
+	if len(tweaks) != len(values) {
+		t.Fatalf("got %d tweaks, expected %d", len(tweaks), len(values))
+	}
+	for i, v := range values {
+		if tweaks[i].value != v {
+			t.Errorf("tweak %d = %v, expected %v", i, tweaks[i].value, v)
+		}
+	}
+
+	if s, tweaks := liftTweaks("float x = 1.0;", 0); s != "float x = 1.0;" || tweaks != nil {
+		t.Errorf("a source without tweaks was changed: %q", s)
+	}
+}
+
+func TestTweakOnly(t *testing.T) {
+	a := []byte("float x = 1.0 /*tweak*/;")
+	if !TweakOnly(a, []byte("float x = 2.25 /*tweak*/;")) {
+		t.Errorf("a changed value requires recompiling")
+	}
+	if TweakOnly(a, []byte("float y = 1.0 /*tweak*/;")) {
+		t.Errorf("a changed name does not require recompiling")
+	}
+	if TweakOnly(a, []byte("float x = 1 /*tweak*/;")) {
+		t.Errorf("a changed type does not require recompiling")
+	}
+}
@@ -0,0 +1,136 @@
+package renderer
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+	"strings"
+
+	"github.com/go-gl/gl/v3.3-core/gl"
+)
+
+// BlockField is a single member of a UniformBlock.
+type BlockField struct {
+	Name string
+	// Type is the GLSL type of the field. Only scalar and vector types of
+	// float, int and bool are supported.
+	Type string
+	// Value holds the components of the field. Integers and booleans are
+	// converted when the block is packed.
+	Value []float32
+}
+
+// UniformBlock packs a set of values into a uniform buffer object with the
+// std140 layout so they can be updated with a single call per frame instead
+// of one glUniform call per value.
+type UniformBlock struct {
+	Name    string
+	Fields  []BlockField
+	Binding uint32
+
+	ubo uint32
+}
+
+func blockFieldLayout(typ string) (size, align int, err error) {
+	var n int
+	switch typ {
+	case "float", "int", "uint", "bool":
+		n = 1
+	case "vec2", "ivec2", "uvec2", "bvec2":
+		n = 2
+	case "vec3", "ivec3", "uvec3", "bvec3":
+		n = 3
+	case "vec4", "ivec4", "uvec4", "bvec4":
+		n = 4
+	default:
+		return 0, 0, fmt.Errorf("unsupported uniform block field type: %q", typ)
+	}
+	// std140: scalars are aligned to their size, vec2 to twice that and vec3
+	// and vec4 to four times the size of a scalar.
+	align = map[int]int{1: 4, 2: 8, 3: 16, 4: 16}[n]
+	return n * 4, align, nil
+}
+
+// Declaration returns the GLSL declaration of the block. Members of the block
+// are accessible in the global scope of the shader.
+func (ub *UniformBlock) Declaration() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "layout(std140) uniform %s {\n", ub.Name)
+	for _, f := range ub.Fields {
+		fmt.Fprintf(&b, "\t%s %s;\n", f.Type, f.Name)
+	}
+	fmt.Fprintf(&b, "};\n")
+	return b.String()
+}
+
+// Pack encodes the values of all fields using the std140 layout.
+func (ub *UniformBlock) Pack() ([]byte, error) {
+	var buf []byte
+	for _, f := range ub.Fields {
+		size, align, err := blockFieldLayout(f.Type)
+		if err != nil {
+			return nil, err
+		}
+		for len(buf)%align != 0 {
+			buf = append(buf, 0)
+		}
+		for i := 0; i < size/4; i++ {
+			var v float32
+			if i < len(f.Value) {
+				v = f.Value[i]
+			}
+			var word uint32
+			switch f.Type[0] {
+			case 'i', 'u':
+				word = uint32(int32(v))
+			case 'b':
+				if v != 0 {
+					word = 1
+				}
+			default:
+				word = math.Float32bits(v)
+			}
+			var b [4]byte
+			binary.LittleEndian.PutUint32(b[:], word)
+			buf = append(buf, b[:]...)
+		}
+	}
+	// The size of a block is rounded up to the alignment of a vec4.
+	for len(buf)%16 != 0 || len(buf) == 0 {
+		buf = append(buf, 0)
+	}
+	return buf, nil
+}
+
+// Update uploads the current field values to the GPU and binds the block to
+// the specified program.
+func (ub *UniformBlock) Update(program uint32) error {
+	data, err := ub.Pack()
+	if err != nil {
+		return err
+	}
+	if ub.ubo == 0 {
+		gl.GenBuffers(1, &ub.ubo)
+	}
+	gl.BindBuffer(gl.UNIFORM_BUFFER, ub.ubo)
+	gl.BufferData(gl.UNIFORM_BUFFER, len(data), gl.Ptr(data), gl.DYNAMIC_DRAW)
+	gl.BindBuffer(gl.UNIFORM_BUFFER, 0)
+
+	index := gl.GetUniformBlockIndex(program, gl.Str(ub.Name+"\x00"))
+	if index == gl.INVALID_INDEX {
+		// The block is not used by the program and was optimized out.
+		return nil
+	}
+	gl.UniformBlockBinding(program, index, ub.Binding)
+	gl.BindBufferBase(gl.UNIFORM_BUFFER, ub.Binding, ub.ubo)
+	return nil
+}
+
+// Close frees the uniform buffer.
+func (ub *UniformBlock) Close() error {
+	if ub.ubo != 0 {
+		gl.DeleteBuffers(1, &ub.ubo)
+		ub.ubo = 0
+	}
+	return nil
+}
@@ -0,0 +1,45 @@
+package renderer
+
+import (
+	"encoding/binary"
+	"math"
+	"testing"
+)
+
+func TestUniformBlockPackStd140(t *testing.T) {
+	ub := UniformBlock{
+		Name: "Params",
+		Fields: []BlockField{
+			{Name: "a", Type: "float", Value: []float32{1}},
+			{Name: "b", Type: "vec3", Value: []float32{2, 3, 4}},
+			{Name: "c", Type: "vec2", Value: []float32{5, 6}},
+			{Name: "d", Type: "int", Value: []float32{7}},
+		},
+	}
+	buf, err := ub.Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// a at 0, b aligned to 16, c aligned to 8 after b ends at 28, d at 40.
+	if len(buf) != 48 {
+		t.Fatalf("unexpected block size: exp %v, got %v", 48, len(buf))
+	}
+	float := func(offset int) float32 {
+		return math.Float32frombits(binary.LittleEndian.Uint32(buf[offset:]))
+	}
+	for offset, exp := range map[int]float32{0: 1, 16: 2, 20: 3, 24: 4, 32: 5, 36: 6} {
+		if v := float(offset); v != exp {
+			t.Fatalf("unexpected value at offset %d: exp %v, got %v", offset, exp, v)
+		}
+	}
+	if v := int32(binary.LittleEndian.Uint32(buf[40:])); v != 7 {
+		t.Fatalf("unexpected int value: exp %v, got %v", 7, v)
+	}
+}
+
+func TestUniformBlockInvalidType(t *testing.T) {
+	ub := UniformBlock{Fields: []BlockField{{Name: "m", Type: "mat4"}}}
+	if _, err := ub.Pack(); err == nil {
+		t.Fatalf("expected an error for an unsupported type")
+	}
+}
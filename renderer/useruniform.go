@@ -0,0 +1,371 @@
+package renderer
+
+import (
+	"fmt"
+	"math"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/go-gl/gl/v3.3-core/gl"
+)
+
+var userUniformPragmaRe = regexp.MustCompile(`^[ \t]*#pragma[ \t]+uniform\b(.*)$`)
+var userUniformRe = regexp.MustCompile(`^\s*(\w+)\s+(\w+)\s*=\s*(.+?)(?:\s+range\(\s*([^,\s]+)\s*,\s*([^)\s]+)\s*\))?\s*;?\s*$`)
+
+// UserUniform is a parameter that a shader declares with
+// `#pragma uniform <type> <name> = <value> [range(<min>, <max>)]`. Its value
+// can be changed while rendering through UserUniforms.
+type UserUniform struct {
+	// Type is float, int or bool, or a vector of them like vec3.
+	Type    string
+	Name    string
+	Default []float32
+	// Min and Max are the range of the values, if HasRange is set.
+	Min, Max float64
+	HasRange bool
+}
+
+// userUniformType returns the number of components of the type and whether
+// they are integers.
+func userUniformType(typ string) (n int, integer bool, ok bool) {
+	switch typ {
+	case "float":
+		return 1, false, true
+	case "int", "bool":
+		return 1, true, true
+	}
+	if len(typ) < 4 {
+		return 0, false, false
+	}
+	n, err := strconv.Atoi(typ[len(typ)-1:])
+	if err != nil || n < 2 || n > 4 {
+		return 0, false, false
+	}
+	switch typ[:len(typ)-1] {
+	case "vec":
+		return n, false, true
+	case "ivec", "bvec":
+		return n, true, true
+	}
+	return 0, false, false
+}
+
+// ParseUserUniformValue parses the value of a uniform of the type, like
+// `0.5`, `1, 0.5, 0.2` or `vec3(1, 0.5, 0.2)`. A single value sets all
+// components of a vector. Booleans may be written as true or false.
+func ParseUserUniformValue(typ, s string) ([]float32, error) {
+	n, _, ok := userUniformType(typ)
+	if !ok {
+		return nil, fmt.Errorf("unsupported uniform type %q, expected float, int, bool or a vector of them", typ)
+	}
+	value, err := parseComponents(s)
+	if err != nil {
+		return nil, fmt.Errorf("%w of %s", err, typ)
+	}
+	if len(value) == 1 && n > 1 {
+		for len(value) < n {
+			value = append(value, value[0])
+		}
+	}
+	if len(value) != n {
+		return nil, fmt.Errorf("%s has %d components, got %d", typ, n, len(value))
+	}
+	return value, nil
+}
+
+// parseComponents parses comma separated numbers, which may be wrapped in a
+// constructor like vec3(...).
+func parseComponents(s string) ([]float32, error) {
+	s = strings.TrimSpace(s)
+	if strings.HasSuffix(s, ")") {
+		if i := strings.IndexByte(s, '('); i >= 0 {
+			s = s[i+1 : len(s)-1]
+		}
+	}
+	var value []float32
+	for _, v := range strings.Split(s, ",") {
+		switch v = strings.TrimSpace(v); v {
+		case "true":
+			value = append(value, 1)
+		case "false":
+			value = append(value, 0)
+		default:
+			f, err := strconv.ParseFloat(v, 32)
+			if err != nil {
+				return nil, fmt.Errorf("invalid value %q", v)
+			}
+			value = append(value, float32(f))
+		}
+	}
+	return value, nil
+}
+
+// parseUserUniform parses the part of a `#pragma uniform` line after the
+// pragma.
+func parseUserUniform(decl string) (UserUniform, error) {
+	m := userUniformRe.FindStringSubmatch(decl)
+	if m == nil {
+		return UserUniform{}, fmt.Errorf("invalid uniform %q, expected <type> <name> = <value> [range(<min>, <max>)]", strings.TrimSpace(decl))
+	}
+	value, err := ParseUserUniformValue(m[1], m[3])
+	if err != nil {
+		return UserUniform{}, err
+	}
+	uu := UserUniform{Type: m[1], Name: m[2], Default: value}
+	if m[4] != "" {
+		if uu.Min, err = strconv.ParseFloat(m[4], 64); err != nil {
+			return UserUniform{}, fmt.Errorf("invalid minimum %q", m[4])
+		}
+		if uu.Max, err = strconv.ParseFloat(m[5], 64); err != nil {
+			return UserUniform{}, fmt.Errorf("invalid maximum %q", m[5])
+		}
+		if uu.Min > uu.Max {
+			return UserUniform{}, fmt.Errorf("the range of %s is empty", uu.Name)
+		}
+		uu.HasRange = true
+	}
+	return uu, nil
+}
+
+// clamp limits the components of the value to the range of the uniform.
+func (uu UserUniform) clamp(value []float32) []float32 {
+	if !uu.HasRange {
+		return value
+	}
+	clamped := make([]float32, len(value))
+	for i, v := range value {
+		clamped[i] = float32(math.Max(uu.Min, math.Min(uu.Max, float64(v))))
+	}
+	return clamped
+}
+
+// liftUserUniforms replaces the `#pragma uniform` lines of the sources with
+// declarations of the uniforms, so the line numbers of the sources do not
+// change. It returns the uniforms that are declared.
+func liftUserUniforms(sources map[Stage][]Source) (map[Stage][]Source, []UserUniform, error) {
+	var uniforms []UserUniform
+	declared := map[string]UserUniform{}
+	lifted := map[Stage][]Source{}
+	for stage, ss := range sources {
+		for i, s := range ss {
+			c, err := s.Contents()
+			if err != nil {
+				return nil, nil, err
+			}
+			lines := strings.Split(string(c), "\n")
+			found := false
+			for lineno, line := range lines {
+				m := userUniformPragmaRe.FindStringSubmatch(line)
+				if m == nil {
+					continue
+				}
+				uu, err := parseUserUniform(m[1])
+				if err != nil {
+					return nil, nil, fmt.Errorf("%s:%d: %w", sourceLabel(s, i), lineno+1, err)
+				}
+				if prev, ok := declared[uu.Name]; ok && prev.Type != uu.Type {
+					return nil, nil, fmt.Errorf("%s:%d: uniform %s is declared as %s and %s", sourceLabel(s, i), lineno+1, uu.Name, prev.Type, uu.Type)
+				} else if !ok {
+					declared[uu.Name] = uu
+					uniforms = append(uniforms, uu)
+				}
+				lines[lineno] = fmt.Sprintf("uniform %s %s;", uu.Type, uu.Name)
+				found = true
+			}
+			if found {
+				s = liftedSource{Source: s, contents: strings.Join(lines, "\n")}
+			}
+			lifted[stage] = append(lifted[stage], s)
+		}
+	}
+	return lifted, uniforms, nil
+}
+
+// UserUniforms holds the values of the uniforms that shaders declare with
+// `#pragma uniform`, see UserUniform. Values can be set from any goroutine
+// and are applied from the next frame. Uniforms without a value are set to
+// their default.
+type UserUniforms struct {
+	mu       sync.Mutex
+	values   map[string][]float32
+	declared map[string]UserUniform
+	// changes counts the values that were set, so renderers know when to
+	// render again.
+	changes uint64
+}
+
+// NewUserUniforms returns an empty set of values.
+func NewUserUniforms() *UserUniforms {
+	return &UserUniforms{values: map[string][]float32{}, declared: map[string]UserUniform{}}
+}
+
+// Set sets the value of a uniform. If a loaded shader declares the uniform,
+// the value must have its number of components, or a single value for all
+// components, and is clamped to its range. Values of uniforms that are not
+// declared yet are kept for shaders that are loaded later.
+func (u *UserUniforms) Set(name string, value []float32) error {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if uu, ok := u.declared[name]; ok {
+		n, _, _ := userUniformType(uu.Type)
+		if len(value) == 1 && n > 1 {
+			for len(value) < n {
+				value = append(value, value[0])
+			}
+		}
+		if len(value) != n {
+			return fmt.Errorf("%s is a %s of %d components, got %d", name, uu.Type, n, len(value))
+		}
+		value = uu.clamp(value)
+	}
+	u.values[name] = append([]float32{}, value...)
+	u.changes++
+	return nil
+}
+
+// SetString sets the value of a uniform that is written as text, like
+// `1, 0.5, 0.2`, see ParseUserUniformValue.
+func (u *UserUniforms) SetString(name, value string) error {
+	u.mu.Lock()
+	uu, ok := u.declared[name]
+	u.mu.Unlock()
+	var v []float32
+	var err error
+	if ok {
+		v, err = ParseUserUniformValue(uu.Type, value)
+	} else {
+		v, err = parseComponents(value)
+	}
+	if err != nil {
+		return fmt.Errorf("%s: %w", name, err)
+	}
+	return u.Set(name, v)
+}
+
+// Declared returns the uniforms that are declared by the loaded shaders,
+// sorted by name.
+func (u *UserUniforms) Declared() []UserUniform {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	uniforms := make([]UserUniform, 0, len(u.declared))
+	for _, uu := range u.declared {
+		uniforms = append(uniforms, uu)
+	}
+	sort.Slice(uniforms, func(i, j int) bool { return uniforms[i].Name < uniforms[j].Name })
+	return uniforms
+}
+
+// Value returns the current value of a declared uniform.
+func (u *UserUniforms) Value(uu UserUniform) []float32 {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	n, _, _ := userUniformType(uu.Type)
+	if v, ok := u.values[uu.Name]; ok && len(v) == n {
+		return uu.clamp(v)
+	}
+	return uu.Default
+}
+
+func (u *UserUniforms) declare(uniforms []UserUniform) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	for _, uu := range uniforms {
+		u.declared[uu.Name] = uu
+	}
+}
+
+func (u *UserUniforms) changeCount() uint64 {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return u.changes
+}
+
+// userUniformSet holds the user uniforms of a linked program.
+type userUniformSet struct {
+	// store is nil if the values can not be changed, in which case the
+	// defaults are used.
+	store     *UserUniforms
+	uniforms  []UserUniform
+	locations []int32
+	applied   uint64
+}
+
+// newUserUniformSet returns nil if there are no uniforms.
+func newUserUniformSet(store *UserUniforms, uniforms []UserUniform) *userUniformSet {
+	if len(uniforms) == 0 {
+		return nil
+	}
+	if store != nil {
+		store.declare(uniforms)
+	}
+	return &userUniformSet{store: store, uniforms: uniforms}
+}
+
+// locate looks up the locations of the uniforms in the linked program.
+func (set *userUniformSet) locate(program uint32) {
+	if set == nil {
+		return
+	}
+	set.locations = make([]int32, len(set.uniforms))
+	for i, uu := range set.uniforms {
+		set.locations[i] = gl.GetUniformLocation(program, gl.Str(uu.Name+"\x00"))
+	}
+}
+
+// update reports whether any value was set since the uniforms were applied.
+func (set *userUniformSet) update() bool {
+	if set == nil || set.store == nil {
+		return false
+	}
+	return set.store.changeCount() != set.applied
+}
+
+// apply sets the uniforms of the program that is in use.
+func (set *userUniformSet) apply() {
+	if set == nil {
+		return
+	}
+	if set.store != nil {
+		set.applied = set.store.changeCount()
+	}
+	for i, uu := range set.uniforms {
+		loc := set.locations[i]
+		if loc < 0 {
+			continue
+		}
+		v := uu.Default
+		if set.store != nil {
+			v = set.store.Value(uu)
+		}
+		if _, integer, _ := userUniformType(uu.Type); integer {
+			iv := make([]int32, len(v))
+			for j, f := range v {
+				iv[j] = int32(math.Round(float64(f)))
+			}
+			switch len(iv) {
+			case 1:
+				gl.Uniform1iv(loc, 1, &iv[0])
+			case 2:
+				gl.Uniform2iv(loc, 1, &iv[0])
+			case 3:
+				gl.Uniform3iv(loc, 1, &iv[0])
+			case 4:
+				gl.Uniform4iv(loc, 1, &iv[0])
+			}
+			continue
+		}
+		switch len(v) {
+		case 1:
+			gl.Uniform1fv(loc, 1, &v[0])
+		case 2:
+			gl.Uniform2fv(loc, 1, &v[0])
+		case 3:
+			gl.Uniform3fv(loc, 1, &v[0])
+		case 4:
+			gl.Uniform4fv(loc, 1, &v[0])
+		}
+	}
+}
@@ -0,0 +1,77 @@
+package renderer
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseUserUniform(t *testing.T) {
+	uu, err := parseUserUniform(" float speed = 1.0 range(0, 10)")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := (UserUniform{Type: "float", Name: "speed", Default: []float32{1}, Min: 0, Max: 10, HasRange: true}); !reflect.DeepEqual(uu, expected) {
+		t.Errorf("unexpected uniform %#v", uu)
+	}
+	if uu, err := parseUserUniform(" vec3 tint = vec3(1, 0.5, 0.2);"); err != nil || !reflect.DeepEqual(uu.Default, []float32{1, 0.5, 0.2}) || uu.HasRange {
+		t.Errorf("unexpected uniform %#v, %v", uu, err)
+	}
+	if uu, err := parseUserUniform(" bvec2 flags = true"); err != nil || !reflect.DeepEqual(uu.Default, []float32{1, 1}) {
+		t.Errorf("unexpected uniform %#v, %v", uu, err)
+	}
+	for _, decl := range []string{"float speed", "mat2 m = 1", "vec2 v = 1, 2, 3", "float f = 1 range(2, 1)", "int i = x"} {
+		if _, err := parseUserUniform(decl); err == nil {
+			t.Errorf("expected an error for %q", decl)
+		}
+	}
+}
+
+func TestLiftUserUniforms(t *testing.T) {
+	src := SourceBuf("#version 330\n#pragma uniform float speed = 2 range(0, 10)\nvoid main() {}\n")
+	lifted, uniforms, err := liftUserUniforms(map[Stage][]Source{StageFragment: {src}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(uniforms) != 1 || uniforms[0].Name != "speed" {
+		t.Fatalf("unexpected uniforms %#v", uniforms)
+	}
+	c, _ := lifted[StageFragment][0].Contents()
+	if lines := strings.Split(string(c), "\n"); lines[1] != "uniform float speed;" || len(lines) != 4 {
+		t.Errorf("unexpected lifted source:\n%s", c)
+	}
+
+	conflict := SourceBuf("#pragma uniform int speed = 2\n")
+	if _, _, err := liftUserUniforms(map[Stage][]Source{StageFragment: {src, conflict}}); err == nil {
+		t.Errorf("expected an error for conflicting types")
+	}
+}
+
+func TestUserUniforms(t *testing.T) {
+	u := NewUserUniforms()
+	if err := u.SetString("speed", "20"); err != nil {
+		t.Fatal(err)
+	}
+	speed := UserUniform{Type: "float", Name: "speed", Default: []float32{1}, Max: 10, HasRange: true}
+	tint := UserUniform{Type: "vec3", Name: "tint", Default: []float32{1, 1, 1}}
+	set := newUserUniformSet(u, []UserUniform{speed, tint})
+	if !set.update() {
+		t.Errorf("the value that was set before loading is not pending")
+	}
+	if v := u.Value(speed); !reflect.DeepEqual(v, []float32{10}) {
+		t.Errorf("the value was not clamped to the range: %v", v)
+	}
+	set.applied = u.changeCount()
+	if err := u.SetString("tint", "0.5"); err != nil {
+		t.Fatal(err)
+	}
+	if v := u.Value(tint); !reflect.DeepEqual(v, []float32{0.5, 0.5, 0.5}) || !set.update() {
+		t.Errorf("unexpected value %v", v)
+	}
+	if err := u.Set("tint", []float32{1, 2}); err == nil {
+		t.Errorf("expected an error for the wrong number of components")
+	}
+	if names := u.Declared(); len(names) != 2 || names[0].Name != "speed" {
+		t.Errorf("unexpected declared uniforms %#v", names)
+	}
+}
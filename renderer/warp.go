@@ -0,0 +1,575 @@
+package renderer
+
+import (
+	"fmt"
+	"math"
+
+	"github.com/go-gl/gl/v3.3-core/gl"
+)
+
+const (
+	warpVert = SourceBuf(`#version 330 core
+		in vec2 pos;
+		in vec2 param;
+		out vec2 meshCoord;
+		uniform float flipY;
+
+		void main() {
+			gl_Position = vec4(pos.x * 2.0 - 1.0, (1.0 - pos.y * 2.0) * flipY, 0.0, 1.0);
+			meshCoord = param;
+		}
+	`)
+	warpFrag = SourceBuf(`#version 330 core
+		in vec2 meshCoord;
+		out vec4 fragColor;
+		uniform sampler2D source;
+		uniform vec4 sourceRect;
+		uniform vec4 blendWidth;
+		uniform float blendCurve;
+		uniform float blendGamma;
+		uniform mat3 colorMatrix;
+		uniform sampler1D colorCurves;
+		uniform float colorCurveSize;
+		uniform float brightness;
+
+		float ramp(float t) {
+			if (t < 0.5) {
+				return 0.5 * pow(2.0 * t, blendCurve);
+			}
+			return 1.0 - 0.5 * pow(2.0 * (1.0 - t), blendCurve);
+		}
+
+		float edge(float d, float width) {
+			return width > 0.0 ? ramp(clamp(d / width, 0.0, 1.0)) : 1.0;
+		}
+
+		float curve(float x, int channel) {
+			// Sample at the centers of the first and last texels at 0 and 1.
+			float t = (clamp(x, 0.0, 1.0) * (colorCurveSize - 1.0) + 0.5) / colorCurveSize;
+			return texture(colorCurves, t)[channel];
+		}
+
+		void main() {
+			vec4 color = texture(source, mix(sourceRect.xy, sourceRect.zw, meshCoord));
+			vec3 c = colorMatrix * color.rgb;
+			color.rgb = vec3(curve(c.r, 0), curve(c.g, 1), curve(c.b, 2));
+			float blend = edge(meshCoord.x, blendWidth.x)
+				* edge(1.0 - meshCoord.x, blendWidth.y)
+				* edge(meshCoord.y, blendWidth.z)
+				* edge(1.0 - meshCoord.y, blendWidth.w);
+			fragColor = vec4(color.rgb * pow(blend, 1.0 / blendGamma) * brightness, color.a);
+		}
+	`)
+)
+
+const (
+	// warpSubdivisions is the minimum number of quads each cell of a warp
+	// mesh is split into along each axis. Cells are not drawn as single
+	// quads because the triangles would distort the image along their
+	// diagonals.
+	warpSubdivisions = 16
+	// warpMinQuads is the minimum number of quads along each axis of the
+	// whole mesh, so lens distortion is smooth for meshes with few points.
+	warpMinQuads = 64
+)
+
+// WarpPoint is a position in the output. Coordinates are in the 0-1 range with
+// the origin at the top left.
+type WarpPoint struct {
+	X, Y float64
+}
+
+// Warp maps the rendered image onto the output through a grid of control
+// points, so it can be projected onto surfaces that are curved or at an angle
+// to the projector. The control points are spaced evenly over the rendered
+// image and are moved to where that part of the image should appear in the
+// output.
+type Warp struct {
+	// Cols and Rows are the number of control points along each axis, at
+	// least 2.
+	Cols, Rows int
+	// Points are the control points in row-major order starting at the top
+	// left. Point (c, r) shows the rendered image at (c/(Cols-1), r/(Rows-1)).
+	Points []WarpPoint
+	// Bezier interpolates between the points with smooth cubic curves that
+	// pass through them instead of straight lines.
+	Bezier bool
+	// Source is the region of the rendered image that is mapped as
+	// {left, top, right, bottom} in the 0-1 range. Projectors that each show
+	// part of the image use different regions. If zero, the whole image is
+	// used.
+	Source [4]float64
+	Blend  EdgeBlend
+
+	// Keystone moves the corners of the output to {top left, top right,
+	// bottom right, bottom left} with a perspective transform, which
+	// compensates for a projector that is at an angle to the surface. It is
+	// applied after the mesh. If zero, the corners are not moved.
+	Keystone [4]WarpPoint
+	// Lens compensates for the distortion of the projector optics. It is
+	// applied last.
+	Lens LensDistortion
+
+	// Color calibrates the colors of the output before the edges are
+	// blended.
+	Color ColorCalibration
+	// Orientation rotates and mirrors the output after all other
+	// transforms, for displays that are mounted rotated or projected onto
+	// from behind.
+	Orientation Orientation
+}
+
+// Orientation rotates the output clockwise by Rotate degrees, which must be a
+// multiple of 90, and then mirrors it horizontally and vertically if FlipX and
+// FlipY are set.
+type Orientation struct {
+	Rotate       int
+	FlipX, FlipY bool
+}
+
+// SwapsAxes reports whether the output is rotated by a quarter turn, in which
+// case the width and height of the output are those of the rendered image
+// swapped.
+func (o Orientation) SwapsAxes() bool {
+	return o.Rotate%180 != 0
+}
+
+func (o Orientation) apply(p WarpPoint) WarpPoint {
+	switch o.Rotate {
+	case 90:
+		p = WarpPoint{X: 1 - p.Y, Y: p.X}
+	case 180:
+		p = WarpPoint{X: 1 - p.X, Y: 1 - p.Y}
+	case 270:
+		p = WarpPoint{X: p.Y, Y: 1 - p.X}
+	}
+	if o.FlipX {
+		p.X = 1 - p.X
+	}
+	if o.FlipY {
+		p.Y = 1 - p.Y
+	}
+	return p
+}
+
+func (o Orientation) invert(p WarpPoint) WarpPoint {
+	if o.FlipX {
+		p.X = 1 - p.X
+	}
+	if o.FlipY {
+		p.Y = 1 - p.Y
+	}
+	switch o.Rotate {
+	case 90:
+		p = WarpPoint{X: p.Y, Y: 1 - p.X}
+	case 180:
+		p = WarpPoint{X: 1 - p.X, Y: 1 - p.Y}
+	case 270:
+		p = WarpPoint{X: 1 - p.Y, Y: p.X}
+	}
+	return p
+}
+
+// LensDistortion is a radial distortion around the center of the output.
+// Points at distance r from the center, where the edges are at 1, are moved to
+// r * (1 + K1*r^2 + K2*r^4). Positive values bend straight lines outward like a
+// pincushion, which corrects barrel distortion, and negative values the other
+// way around.
+type LensDistortion struct {
+	K1, K2 float64
+}
+
+// EdgeBlend fades out the edges of a warped image, so the overlap of images of
+// multiple projectors has the same brightness as the rest of the surface. The
+// ramps of overlapping images should be equally wide.
+type EdgeBlend struct {
+	// Left, Right, Top and Bottom are the widths of the ramps as a fraction
+	// of the source region. Edges with a width of 0 are not blended.
+	Left, Right, Top, Bottom float64
+	// Curve is the exponent of the ramps, higher values are steeper in the
+	// middle. If 0, 2 is used.
+	Curve float64
+	// Gamma is the gamma of the projector, which the ramps are corrected
+	// for. If 0, 2.2 is used.
+	Gamma float64
+}
+
+// NewWarp returns a warp with evenly spaced control points, which maps the
+// image onto the output as is.
+func NewWarp(cols, rows int) *Warp {
+	w := &Warp{Cols: cols, Rows: rows}
+	w.Reset()
+	return w
+}
+
+// Reset moves all control points back to their original positions.
+func (w *Warp) Reset() {
+	w.Points = make([]WarpPoint, 0, w.Cols*w.Rows)
+	for r := 0; r < w.Rows; r++ {
+		for c := 0; c < w.Cols; c++ {
+			w.Points = append(w.Points, WarpPoint{
+				X: float64(c) / float64(w.Cols-1),
+				Y: float64(r) / float64(w.Rows-1),
+			})
+		}
+	}
+}
+
+func (w *Warp) Validate() error {
+	if w.Cols < 2 || w.Rows < 2 {
+		return fmt.Errorf("a warp requires at least 2x2 points, got %dx%d", w.Cols, w.Rows)
+	}
+	if len(w.Points) != w.Cols*w.Rows {
+		return fmt.Errorf("a warp of %dx%d requires %d points, got %d", w.Cols, w.Rows, w.Cols*w.Rows, len(w.Points))
+	}
+	if w.Source != [4]float64{} {
+		s := w.Source
+		if s[0] < 0 || s[1] < 0 || s[2] > 1 || s[3] > 1 || s[0] >= s[2] || s[1] >= s[3] {
+			return fmt.Errorf("invalid warp source region %v", s)
+		}
+	}
+	b := w.Blend
+	for _, width := range []float64{b.Left, b.Right, b.Top, b.Bottom} {
+		if width < 0 || width > 1 {
+			return fmt.Errorf("edge blend widths must be between 0 and 1, got %v", width)
+		}
+	}
+	if b.Left+b.Right > 1 || b.Top+b.Bottom > 1 {
+		return fmt.Errorf("opposite edge blends must not overlap")
+	}
+	if b.Curve < 0 || b.Gamma < 0 {
+		return fmt.Errorf("edge blend curve and gamma must not be negative")
+	}
+	if w.Keystone != [4]WarpPoint{} {
+		// The corners must form a convex quad in order, otherwise the
+		// image would fold over itself.
+		sign := 0.0
+		for i := range w.Keystone {
+			a, b, c := w.Keystone[i], w.Keystone[(i+1)%4], w.Keystone[(i+2)%4]
+			cross := (b.X-a.X)*(c.Y-b.Y) - (b.Y-a.Y)*(c.X-b.X)
+			if cross == 0 || (sign != 0 && (cross > 0) != (sign > 0)) {
+				return fmt.Errorf("the keystone corners must form a convex quad in the order top left, top right, bottom right, bottom left")
+			}
+			sign = cross
+		}
+	}
+	if err := w.Color.Validate(); err != nil {
+		return err
+	}
+	switch w.Orientation.Rotate {
+	case 0, 90, 180, 270:
+	default:
+		return fmt.Errorf("the output can only be rotated by 0, 90, 180 or 270 degrees, got %d", w.Orientation.Rotate)
+	}
+	// The distortion must keep points in order from the center up to the
+	// corners, otherwise it has no inverse.
+	for r := 0.0; r <= math.Sqrt2; r += 0.01 {
+		if 1+3*w.Lens.K1*r*r+5*w.Lens.K2*r*r*r*r <= 0 {
+			return fmt.Errorf("lens distortion %v folds the image over itself", w.Lens)
+		}
+	}
+	return nil
+}
+
+// point returns the control point at (c, r). Points outside of the grid are
+// extrapolated from the edge, which keeps curves straight at the edges.
+func (w *Warp) point(c, r int) WarpPoint {
+	extrapolate := func(a, b WarpPoint) WarpPoint {
+		return WarpPoint{X: 2*a.X - b.X, Y: 2*a.Y - b.Y}
+	}
+	switch {
+	case c < 0:
+		return extrapolate(w.point(0, r), w.point(1, r))
+	case c >= w.Cols:
+		return extrapolate(w.point(w.Cols-1, r), w.point(w.Cols-2, r))
+	case r < 0:
+		return extrapolate(w.point(c, 0), w.point(c, 1))
+	case r >= w.Rows:
+		return extrapolate(w.point(c, w.Rows-1), w.point(c, w.Rows-2))
+	}
+	return w.Points[r*w.Cols+c]
+}
+
+// At returns the position on the mesh of the rendered image at (u, v) in the
+// 0-1 range, which is where it appears in the output before the keystone, lens
+// distortion and orientation are applied.
+func (w *Warp) At(u, v float64) WarpPoint {
+	cell := func(t float64, n int) (int, float64) {
+		i := int(t * float64(n-1))
+		if i > n-2 {
+			i = n - 2
+		}
+		if i < 0 {
+			i = 0
+		}
+		return i, t*float64(n-1) - float64(i)
+	}
+	c, tu := cell(u, w.Cols)
+	r, tv := cell(v, w.Rows)
+	if !w.Bezier {
+		top := lerpPoint(w.point(c, r), w.point(c+1, r), tu)
+		bottom := lerpPoint(w.point(c, r+1), w.point(c+1, r+1), tu)
+		return lerpPoint(top, bottom, tv)
+	}
+	var rows [4]WarpPoint
+	for i := range rows {
+		rows[i] = catmullRom(w.point(c-1, r+i-1), w.point(c, r+i-1), w.point(c+1, r+i-1), w.point(c+2, r+i-1), tu)
+	}
+	return catmullRom(rows[0], rows[1], rows[2], rows[3], tv)
+}
+
+// output applies the keystone, lens distortion and orientation to a position on
+// the mesh.
+func (w *Warp) output(p WarpPoint) WarpPoint {
+	if w.Keystone != [4]WarpPoint{} {
+		p = squareToQuad(w.Keystone).apply(p)
+	}
+	if w.Lens != (LensDistortion{}) {
+		x, y := p.X*2-1, p.Y*2-1
+		r2 := x*x + y*y
+		scale := 1 + w.Lens.K1*r2 + w.Lens.K2*r2*r2
+		p = WarpPoint{X: (x*scale + 1) / 2, Y: (y*scale + 1) / 2}
+	}
+	return w.Orientation.apply(p)
+}
+
+// input is the inverse of output.
+func (w *Warp) input(p WarpPoint) WarpPoint {
+	p = w.Orientation.invert(p)
+	if w.Lens != (LensDistortion{}) {
+		x, y := p.X*2-1, p.Y*2-1
+		rd := math.Hypot(x, y)
+		if rd > 0 {
+			// Solve r * (1 + K1*r^2 + K2*r^4) = rd with Newton's method.
+			r := rd
+			for i := 0; i < 20; i++ {
+				r2 := r * r
+				f := r*(1+w.Lens.K1*r2+w.Lens.K2*r2*r2) - rd
+				df := 1 + 3*w.Lens.K1*r2 + 5*w.Lens.K2*r2*r2
+				r -= f / df
+			}
+			x, y = x*r/rd, y*r/rd
+		}
+		p = WarpPoint{X: (x + 1) / 2, Y: (y + 1) / 2}
+	}
+	if w.Keystone != [4]WarpPoint{} {
+		p = squareToQuad(w.Keystone).inverse().apply(p)
+	}
+	return p
+}
+
+// homography is a 3x3 perspective transform in row-major order.
+type homography [9]float64
+
+// squareToQuad returns the perspective transform that maps the corners of the
+// unit square to the corners of the quad in the order top left, top right,
+// bottom right, bottom left.
+func squareToQuad(q [4]WarpPoint) homography {
+	dx1, dy1 := q[1].X-q[2].X, q[1].Y-q[2].Y
+	dx2, dy2 := q[3].X-q[2].X, q[3].Y-q[2].Y
+	sx := q[0].X - q[1].X + q[2].X - q[3].X
+	sy := q[0].Y - q[1].Y + q[2].Y - q[3].Y
+	det := dx1*dy2 - dx2*dy1
+	g := (sx*dy2 - dx2*sy) / det
+	h := (dx1*sy - sx*dy1) / det
+	return homography{
+		q[1].X - q[0].X + g*q[1].X, q[3].X - q[0].X + h*q[3].X, q[0].X,
+		q[1].Y - q[0].Y + g*q[1].Y, q[3].Y - q[0].Y + h*q[3].Y, q[0].Y,
+		g, h, 1,
+	}
+}
+
+func (m homography) apply(p WarpPoint) WarpPoint {
+	z := m[6]*p.X + m[7]*p.Y + m[8]
+	return WarpPoint{
+		X: (m[0]*p.X + m[1]*p.Y + m[2]) / z,
+		Y: (m[3]*p.X + m[4]*p.Y + m[5]) / z,
+	}
+}
+
+// inverse returns the adjugate of the transform, which is its inverse up to a
+// scale that does not matter for perspective transforms.
+func (m homography) inverse() homography {
+	return homography{
+		m[4]*m[8] - m[5]*m[7], m[2]*m[7] - m[1]*m[8], m[1]*m[5] - m[2]*m[4],
+		m[5]*m[6] - m[3]*m[8], m[0]*m[8] - m[2]*m[6], m[2]*m[3] - m[0]*m[5],
+		m[3]*m[7] - m[4]*m[6], m[1]*m[6] - m[0]*m[7], m[0]*m[4] - m[1]*m[3],
+	}
+}
+
+func lerpPoint(a, b WarpPoint, t float64) WarpPoint {
+	return WarpPoint{X: a.X + (b.X-a.X)*t, Y: a.Y + (b.Y-a.Y)*t}
+}
+
+// catmullRom evaluates the cubic Bezier curve between p1 and p2 with tangents
+// derived from the neighbouring points.
+func catmullRom(p0, p1, p2, p3 WarpPoint, t float64) WarpPoint {
+	f := func(a, b, c, d float64) float64 {
+		return 0.5 * (2*b + (c-a)*t + (2*a-5*b+4*c-d)*t*t + (3*b-a-3*c+d)*t*t*t)
+	}
+	return WarpPoint{X: f(p0.X, p1.X, p2.X, p3.X), Y: f(p0.Y, p1.Y, p2.Y, p3.Y)}
+}
+
+// quads returns the number of quads along each axis that the mesh is
+// tessellated into.
+func (w *Warp) quads() (int, int) {
+	n := func(points int) int {
+		s := warpSubdivisions
+		if cells := points - 1; cells*s < warpMinQuads {
+			s = (warpMinQuads + cells - 1) / cells
+		}
+		return (points - 1) * s
+	}
+	return n(w.Cols), n(w.Rows)
+}
+
+// vertices tessellates the mesh into triangles. Every vertex consists of the
+// position in the output followed by the position in the rendered image.
+func (w *Warp) vertices() []float32 {
+	nu, nv := w.quads()
+	grid := make([]WarpPoint, 0, (nu+1)*(nv+1))
+	for j := 0; j <= nv; j++ {
+		for i := 0; i <= nu; i++ {
+			grid = append(grid, w.output(w.At(float64(i)/float64(nu), float64(j)/float64(nv))))
+		}
+	}
+	vertices := make([]float32, 0, nu*nv*6*4)
+	vertex := func(i, j int) {
+		p := grid[j*(nu+1)+i]
+		vertices = append(vertices, float32(p.X), float32(p.Y), float32(i)/float32(nu), float32(j)/float32(nv))
+	}
+	for j := 0; j < nv; j++ {
+		for i := 0; i < nu; i++ {
+			vertex(i, j)
+			vertex(i+1, j)
+			vertex(i, j+1)
+			vertex(i+1, j)
+			vertex(i+1, j+1)
+			vertex(i, j+1)
+		}
+	}
+	return vertices
+}
+
+// warper draws a warped image with OpenGL.
+type warper struct {
+	warp *Warp
+	// dirty is set when the points have changed and the mesh must be
+	// tessellated again.
+	dirty bool
+
+	program     uint32
+	vao, vbo    uint32
+	sampler     uint32
+	curves      uint32
+	numVertices int32
+}
+
+func newWarper(w *Warp) (*warper, error) {
+	if err := w.Validate(); err != nil {
+		return nil, err
+	}
+	wp := &warper{warp: w, dirty: true}
+	var err error
+	wp.program, err = linkProgram(map[Stage][]Source{
+		StageVertex:   {warpVert},
+		StageFragment: {warpFrag},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	gl.GenVertexArrays(1, &wp.vao)
+	gl.BindVertexArray(wp.vao)
+	gl.GenBuffers(1, &wp.vbo)
+	gl.BindBuffer(gl.ARRAY_BUFFER, wp.vbo)
+	posLoc := uint32(gl.GetAttribLocation(wp.program, gl.Str("pos\x00")))
+	paramLoc := uint32(gl.GetAttribLocation(wp.program, gl.Str("param\x00")))
+	gl.EnableVertexAttribArray(posLoc)
+	gl.VertexAttribPointer(posLoc, 2, gl.FLOAT, false, 4*4, nil)
+	gl.EnableVertexAttribArray(paramLoc)
+	gl.VertexAttribPointer(paramLoc, 2, gl.FLOAT, false, 4*4, gl.PtrOffset(2*4))
+	gl.BindBuffer(gl.ARRAY_BUFFER, 0)
+	gl.BindVertexArray(0)
+
+	// The rendered image is sampled with linear filtering, regardless of
+	// how the texture is configured for shaders.
+	gl.GenSamplers(1, &wp.sampler)
+	gl.SamplerParameteri(wp.sampler, gl.TEXTURE_MAG_FILTER, gl.LINEAR)
+	gl.SamplerParameteri(wp.sampler, gl.TEXTURE_MIN_FILTER, gl.LINEAR)
+	gl.SamplerParameteri(wp.sampler, gl.TEXTURE_WRAP_S, gl.CLAMP_TO_EDGE)
+	gl.SamplerParameteri(wp.sampler, gl.TEXTURE_WRAP_T, gl.CLAMP_TO_EDGE)
+	wp.curves = newColorCurveTexture(w.Color)
+	return wp, nil
+}
+
+// Draw draws the texture through the mesh to the bound framebuffer with its
+// colors scaled by the brightness. The first row of the texture is the top of
+// the image. If flipY is set, the first row of the framebuffer is the bottom,
+// like that of a window.
+func (wp *warper) Draw(tex uint32, flipY bool, brightness float32) {
+	gl.BindVertexArray(wp.vao)
+	if wp.dirty {
+		vertices := wp.warp.vertices()
+		gl.BindBuffer(gl.ARRAY_BUFFER, wp.vbo)
+		gl.BufferData(gl.ARRAY_BUFFER, len(vertices)*4, gl.Ptr(&vertices[0]), gl.DYNAMIC_DRAW)
+		gl.BindBuffer(gl.ARRAY_BUFFER, 0)
+		wp.numVertices = int32(len(vertices) / 4)
+		wp.dirty = false
+	}
+
+	gl.ClearColor(0, 0, 0, 0)
+	gl.Clear(gl.COLOR_BUFFER_BIT)
+	gl.UseProgram(wp.program)
+	uniform := func(name string) int32 {
+		return gl.GetUniformLocation(wp.program, gl.Str(name+"\x00"))
+	}
+	if flipY {
+		gl.Uniform1f(uniform("flipY"), 1)
+	} else {
+		gl.Uniform1f(uniform("flipY"), -1)
+	}
+	source := wp.warp.Source
+	if source == [4]float64{} {
+		source = [4]float64{0, 0, 1, 1}
+	}
+	gl.Uniform4f(uniform("sourceRect"), float32(source[0]), float32(source[1]), float32(source[2]), float32(source[3]))
+	b := wp.warp.Blend
+	gl.Uniform4f(uniform("blendWidth"), float32(b.Left), float32(b.Right), float32(b.Top), float32(b.Bottom))
+	curve, gamma := b.Curve, b.Gamma
+	if curve == 0 {
+		curve = 2
+	}
+	if gamma == 0 {
+		gamma = 2.2
+	}
+	gl.Uniform1f(uniform("blendCurve"), float32(curve))
+	gl.Uniform1f(uniform("blendGamma"), float32(gamma))
+	matrix := wp.warp.Color.matrix()
+	gl.UniformMatrix3fv(uniform("colorMatrix"), 1, false, &matrix[0])
+	gl.Uniform1f(uniform("colorCurveSize"), colorCurveSize)
+	gl.Uniform1f(uniform("brightness"), brightness)
+
+	gl.ActiveTexture(gl.TEXTURE0)
+	gl.BindTexture(gl.TEXTURE_2D, tex)
+	gl.BindSampler(0, wp.sampler)
+	gl.Uniform1i(uniform("source"), 0)
+	gl.ActiveTexture(gl.TEXTURE1)
+	gl.BindTexture(gl.TEXTURE_1D, wp.curves)
+	gl.Uniform1i(uniform("colorCurves"), 1)
+	gl.DrawArrays(gl.TRIANGLES, 0, wp.numVertices)
+	gl.BindTexture(gl.TEXTURE_1D, 0)
+	gl.ActiveTexture(gl.TEXTURE0)
+	gl.BindSampler(0, 0)
+	gl.BindTexture(gl.TEXTURE_2D, 0)
+	gl.BindVertexArray(0)
+}
+
+func (wp *warper) Close() error {
+	gl.DeleteProgram(wp.program)
+	gl.DeleteVertexArrays(1, &wp.vao)
+	gl.DeleteBuffers(1, &wp.vbo)
+	gl.DeleteSamplers(1, &wp.sampler)
+	gl.DeleteTextures(1, &wp.curves)
+	return nil
+}
@@ -0,0 +1,184 @@
+package renderer
+
+import (
+	"math"
+	"testing"
+)
+
+func TestWarpIdentity(t *testing.T) {
+	for _, bezier := range []bool{false, true} {
+		w := NewWarp(3, 4)
+		w.Bezier = bezier
+		if err := w.Validate(); err != nil {
+			t.Fatal(err)
+		}
+		for _, uv := range [][2]float64{{0, 0}, {1, 1}, {0.25, 0.75}, {0.5, 0.1}, {0.99, 0.01}} {
+			p := w.At(uv[0], uv[1])
+			if math.Abs(p.X-uv[0]) > 1e-9 || math.Abs(p.Y-uv[1]) > 1e-9 {
+				t.Errorf("bezier=%v: %v is mapped to %v", bezier, uv, p)
+			}
+		}
+	}
+}
+
+func TestWarpInterpolation(t *testing.T) {
+	w := NewWarp(3, 3)
+	// Push the center point to the right.
+	w.Points[4] = WarpPoint{X: 0.7, Y: 0.5}
+
+	for _, bezier := range []bool{false, true} {
+		w.Bezier = bezier
+		// The curves pass through the control points.
+		for i, p := range w.Points {
+			c, r := i%w.Cols, i/w.Cols
+			got := w.At(float64(c)/2, float64(r)/2)
+			if math.Abs(got.X-p.X) > 1e-9 || math.Abs(got.Y-p.Y) > 1e-9 {
+				t.Errorf("bezier=%v: point %d is at %v, expected %v", bezier, i, got, p)
+			}
+		}
+	}
+
+	// Halfway between the left edge and the center, straight lines are
+	// halfway while the curve already bends further.
+	w.Bezier = false
+	linear := w.At(0.25, 0.5)
+	w.Bezier = true
+	bezier := w.At(0.25, 0.5)
+	if math.Abs(linear.X-0.35) > 1e-9 {
+		t.Errorf("unexpected linear interpolation: %v", linear)
+	}
+	if bezier.X <= linear.X {
+		t.Errorf("bezier interpolation is not smooth: %v", bezier)
+	}
+}
+
+func TestWarpVertices(t *testing.T) {
+	w := NewWarp(2, 3)
+	vertices := w.vertices()
+	nu, nv := w.quads()
+	if nu != warpMinQuads || nv != warpMinQuads {
+		t.Fatalf("unexpected number of quads: %dx%d", nu, nv)
+	}
+	if exp := nu * nv * 6 * 4; len(vertices) != exp {
+		t.Fatalf("unexpected number of floats: %d, expected %d", len(vertices), exp)
+	}
+	for i := 0; i < len(vertices); i += 4 {
+		// An identity warp maps every position in the image to itself.
+		if math.Abs(float64(vertices[i]-vertices[i+2])) > 1e-6 || math.Abs(float64(vertices[i+1]-vertices[i+3])) > 1e-6 {
+			t.Fatalf("vertex %d is at %v", i/4, vertices[i:i+4])
+		}
+	}
+}
+
+func TestWarpValidate(t *testing.T) {
+	invalid := map[string]func(w *Warp){
+		"too small":          func(w *Warp) { w.Cols = 1 },
+		"missing points":     func(w *Warp) { w.Points = w.Points[1:] },
+		"empty source":       func(w *Warp) { w.Source = [4]float64{0.5, 0, 0.5, 1} },
+		"source out of view": func(w *Warp) { w.Source = [4]float64{0, 0, 1.5, 1} },
+		"negative blend":     func(w *Warp) { w.Blend.Left = -0.1 },
+		"overlapping blend":  func(w *Warp) { w.Blend.Top, w.Blend.Bottom = 0.6, 0.6 },
+	}
+	for name, modify := range invalid {
+		w := NewWarp(3, 3)
+		modify(w)
+		if err := w.Validate(); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+}
+
+func TestNearestWarpPoint(t *testing.T) {
+	w := NewWarp(3, 3)
+	i, dist := nearestWarpPoint(w, 390, 10, 400, 200)
+	if i != 2 || math.Abs(dist-math.Hypot(10, 10)) > 1e-9 {
+		t.Errorf("unexpected nearest point: %d at %v", i, dist)
+	}
+}
+
+func TestWarpKeystone(t *testing.T) {
+	w := NewWarp(2, 2)
+	w.Keystone = [4]WarpPoint{{0.1, 0}, {0.9, 0.1}, {1, 1}, {0, 0.9}}
+	if err := w.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	// The points are in row-major order, the keystone goes around.
+	for i, corner := range []int{0, 1, 3, 2} {
+		exp := w.Keystone[corner]
+		if got := w.output(w.Points[i]); math.Abs(got.X-exp.X) > 1e-9 || math.Abs(got.Y-exp.Y) > 1e-9 {
+			t.Errorf("point %d is at %v, expected %v", i, got, exp)
+		}
+	}
+	p := WarpPoint{X: 0.3, Y: 0.6}
+	if got := w.input(w.output(p)); math.Abs(got.X-p.X) > 1e-9 || math.Abs(got.Y-p.Y) > 1e-9 {
+		t.Errorf("keystone does not round trip: %v", got)
+	}
+
+	w.Keystone = [4]WarpPoint{{0, 0}, {1, 1}, {1, 0}, {0, 1}}
+	if err := w.Validate(); err == nil {
+		t.Errorf("expected an error for a self intersecting keystone")
+	}
+}
+
+func TestWarpLens(t *testing.T) {
+	w := NewWarp(2, 2)
+	w.Lens = LensDistortion{K1: 0.1, K2: 0.02}
+	if err := w.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	if got := w.output(WarpPoint{X: 0.5, Y: 0.5}); got != (WarpPoint{X: 0.5, Y: 0.5}) {
+		t.Errorf("the center moved to %v", got)
+	}
+	// Pincushion moves the middle of the edges out less than the corners.
+	edge, corner := w.output(WarpPoint{X: 1, Y: 0.5}), w.output(WarpPoint{X: 1, Y: 1})
+	if edge.X <= 1 || corner.X <= edge.X {
+		t.Errorf("unexpected distortion: edge %v, corner %v", edge, corner)
+	}
+	p := WarpPoint{X: 0.8, Y: 0.1}
+	if got := w.input(w.output(p)); math.Abs(got.X-p.X) > 1e-9 || math.Abs(got.Y-p.Y) > 1e-9 {
+		t.Errorf("lens distortion does not round trip: %v", got)
+	}
+
+	w.Lens = LensDistortion{K1: -0.5}
+	if err := w.Validate(); err == nil {
+		t.Errorf("expected an error for distortion that folds the image")
+	}
+}
+
+func TestWarpOrientation(t *testing.T) {
+	topLeft := WarpPoint{X: 0.1, Y: 0.2}
+	for _, tt := range []struct {
+		orientation Orientation
+		expected    WarpPoint
+	}{
+		{Orientation{}, WarpPoint{X: 0.1, Y: 0.2}},
+		{Orientation{Rotate: 90}, WarpPoint{X: 0.8, Y: 0.1}},
+		{Orientation{Rotate: 180}, WarpPoint{X: 0.9, Y: 0.8}},
+		{Orientation{Rotate: 270}, WarpPoint{X: 0.2, Y: 0.9}},
+		{Orientation{FlipX: true}, WarpPoint{X: 0.9, Y: 0.2}},
+		{Orientation{FlipY: true}, WarpPoint{X: 0.1, Y: 0.8}},
+		{Orientation{Rotate: 90, FlipX: true}, WarpPoint{X: 0.2, Y: 0.1}},
+	} {
+		w := NewWarp(2, 2)
+		w.Orientation = tt.orientation
+		if err := w.Validate(); err != nil {
+			t.Fatal(err)
+		}
+		out := w.output(topLeft)
+		if math.Abs(out.X-tt.expected.X) > 1e-9 || math.Abs(out.Y-tt.expected.Y) > 1e-9 {
+			t.Errorf("%+v: %v is mapped to %v, expected %v", tt.orientation, topLeft, out, tt.expected)
+		}
+		if in := w.input(out); math.Abs(in.X-topLeft.X) > 1e-9 || math.Abs(in.Y-topLeft.Y) > 1e-9 {
+			t.Errorf("%+v: %v is mapped back to %v", tt.orientation, out, in)
+		}
+		if swaps := tt.orientation.Rotate%180 == 90; w.Orientation.SwapsAxes() != swaps {
+			t.Errorf("%+v: expected SwapsAxes to be %v", tt.orientation, swaps)
+		}
+	}
+
+	w := NewWarp(2, 2)
+	w.Orientation.Rotate = -90
+	if err := w.Validate(); err == nil {
+		t.Errorf("expected an error for a rotation of -90 degrees")
+	}
+}
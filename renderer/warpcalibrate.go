@@ -0,0 +1,263 @@
+package renderer
+
+import (
+	"fmt"
+	"log"
+	"math"
+
+	"github.com/go-gl/gl/v3.3-core/gl"
+	"github.com/go-gl/glfw/v3.3/glfw"
+)
+
+const (
+	warpOverlayVert = SourceBuf(`#version 330 core
+		in vec2 pos;
+		in vec3 color;
+		out vec3 lineColor;
+
+		void main() {
+			gl_Position = vec4(pos.x * 2.0 - 1.0, 1.0 - pos.y * 2.0, 0.0, 1.0);
+			lineColor = color;
+		}
+	`)
+	warpOverlayFrag = SourceBuf(`#version 330 core
+		in vec3 lineColor;
+		out vec4 fragColor;
+
+		void main() {
+			fragColor = vec4(lineColor, 1.0);
+		}
+	`)
+)
+
+const (
+	// warpGrabDistance is the distance in pixels from a control point within
+	// which a click selects it.
+	warpGrabDistance = 20
+	// warpHandleSize is half the size in pixels of the squares drawn around
+	// control points.
+	warpHandleSize = 5
+)
+
+const warpCalibrationTitle = "Shady - Warp calibration: drag points, tab selects, arrows nudge, b toggles bezier, r resets, h hides, s saves"
+
+// warpCalibration edits the control points of a warp in a window.
+type warpCalibration struct {
+	warper *warper
+	save   func(*Warp) error
+
+	selected int
+	dragging bool
+	hidden   bool
+
+	program  uint32
+	vao, vbo uint32
+}
+
+// SetWarpCalibration enables editing the control points of the warp set with
+// SetWarp using the mouse and keyboard. Points are dragged with the mouse or
+// selected with tab and nudged with the arrow keys. The save function is called
+// with the warp when s is pressed.
+//
+// This should be called from the thread that owns the OpenGL context before
+// animating.
+func (eng *OnScreenEngine) SetWarpCalibration(save func(*Warp) error) error {
+	if eng.warp == nil {
+		return fmt.Errorf("warp calibration requires a warp")
+	}
+	cal := &warpCalibration{warper: eng.warp, save: save}
+	var err error
+	cal.program, err = linkProgram(map[Stage][]Source{
+		StageVertex:   {warpOverlayVert},
+		StageFragment: {warpOverlayFrag},
+	})
+	if err != nil {
+		return err
+	}
+	gl.GenVertexArrays(1, &cal.vao)
+	gl.BindVertexArray(cal.vao)
+	gl.GenBuffers(1, &cal.vbo)
+	gl.BindBuffer(gl.ARRAY_BUFFER, cal.vbo)
+	posLoc := uint32(gl.GetAttribLocation(cal.program, gl.Str("pos\x00")))
+	colorLoc := uint32(gl.GetAttribLocation(cal.program, gl.Str("color\x00")))
+	gl.EnableVertexAttribArray(posLoc)
+	gl.VertexAttribPointer(posLoc, 2, gl.FLOAT, false, 5*4, nil)
+	gl.EnableVertexAttribArray(colorLoc)
+	gl.VertexAttribPointer(colorLoc, 3, gl.FLOAT, false, 5*4, gl.PtrOffset(2*4))
+	gl.BindBuffer(gl.ARRAY_BUFFER, 0)
+	gl.BindVertexArray(0)
+
+	eng.calibration = cal
+	eng.window.SetTitle(warpCalibrationTitle)
+	eng.window.SetMouseButtonCallback(cal.onMouseButton)
+	eng.window.SetCursorPosCallback(cal.onCursorPos)
+	eng.window.SetKeyCallback(cal.onKey)
+	return nil
+}
+
+func (cal *warpCalibration) onMouseButton(win *glfw.Window, button glfw.MouseButton, action glfw.Action, mods glfw.ModifierKey) {
+	if button != glfw.MouseButtonLeft {
+		return
+	}
+	if action == glfw.Release {
+		cal.dragging = false
+		return
+	}
+	x, y := win.GetCursorPos()
+	w, h := win.GetSize()
+	if i, dist := nearestWarpPoint(cal.warper.warp, x, y, w, h); dist <= warpGrabDistance {
+		cal.selected = i
+		cal.dragging = true
+	}
+}
+
+func (cal *warpCalibration) onCursorPos(win *glfw.Window, x, y float64) {
+	if !cal.dragging {
+		return
+	}
+	w, h := win.GetSize()
+	if w == 0 || h == 0 {
+		return
+	}
+	warp := cal.warper.warp
+	warp.Points[cal.selected] = warp.input(WarpPoint{X: x / float64(w), Y: y / float64(h)})
+	cal.warper.dirty = true
+}
+
+func (cal *warpCalibration) onKey(win *glfw.Window, key glfw.Key, scancode int, action glfw.Action, mods glfw.ModifierKey) {
+	if action == glfw.Release {
+		return
+	}
+	warp := cal.warper.warp
+	w, h := win.GetSize()
+	if w == 0 || h == 0 {
+		return
+	}
+	step := 1.0
+	if mods&glfw.ModShift != 0 {
+		step = 10
+	}
+	nudge := func(dx, dy float64) {
+		// Points are moved in the output, so the arrows match the
+		// direction on the display regardless of the orientation.
+		p := warp.output(warp.Points[cal.selected])
+		p.X += dx * step / float64(w)
+		p.Y += dy * step / float64(h)
+		warp.Points[cal.selected] = warp.input(p)
+		cal.warper.dirty = true
+	}
+	switch key {
+	case glfw.KeyTab:
+		n := len(warp.Points)
+		if mods&glfw.ModShift != 0 {
+			cal.selected = (cal.selected + n - 1) % n
+		} else {
+			cal.selected = (cal.selected + 1) % n
+		}
+	case glfw.KeyLeft:
+		nudge(-1, 0)
+	case glfw.KeyRight:
+		nudge(1, 0)
+	case glfw.KeyUp:
+		nudge(0, -1)
+	case glfw.KeyDown:
+		nudge(0, 1)
+	case glfw.KeyB:
+		warp.Bezier = !warp.Bezier
+		cal.warper.dirty = true
+	case glfw.KeyR:
+		warp.Reset()
+		cal.warper.dirty = true
+	case glfw.KeyH:
+		cal.hidden = !cal.hidden
+	case glfw.KeyS:
+		if action != glfw.Press {
+			return
+		}
+		if err := cal.save(warp); err != nil {
+			log.Printf("Could not save warp: %v", err)
+		} else {
+			log.Printf("Saved warp")
+		}
+	}
+}
+
+// Draw draws the mesh and control points over the bound framebuffer of a
+// window of the specified size.
+func (cal *warpCalibration) Draw(width, height int) {
+	if cal.hidden {
+		return
+	}
+	vertices := warpOverlay(cal.warper.warp, cal.selected, width, height)
+	gl.BindVertexArray(cal.vao)
+	gl.BindBuffer(gl.ARRAY_BUFFER, cal.vbo)
+	gl.BufferData(gl.ARRAY_BUFFER, len(vertices)*4, gl.Ptr(&vertices[0]), gl.STREAM_DRAW)
+	gl.BindBuffer(gl.ARRAY_BUFFER, 0)
+	gl.UseProgram(cal.program)
+	gl.DrawArrays(gl.LINES, 0, int32(len(vertices)/5))
+	gl.BindVertexArray(0)
+}
+
+func (cal *warpCalibration) Close() error {
+	gl.DeleteProgram(cal.program)
+	gl.DeleteVertexArrays(1, &cal.vao)
+	gl.DeleteBuffers(1, &cal.vbo)
+	return nil
+}
+
+// nearestWarpPoint returns the index of the control point nearest to the
+// position in a window of the specified size and its distance in pixels.
+func nearestWarpPoint(warp *Warp, x, y float64, width, height int) (int, float64) {
+	nearest, nearestDist := 0, math.Inf(1)
+	for i, p := range warp.Points {
+		p = warp.output(p)
+		dist := math.Hypot(p.X*float64(width)-x, p.Y*float64(height)-y)
+		if dist < nearestDist {
+			nearest, nearestDist = i, dist
+		}
+	}
+	return nearest, nearestDist
+}
+
+// warpOverlay returns the lines that show the mesh and control points in a
+// window of the specified size. Every vertex consists of the position followed
+// by the color.
+func warpOverlay(warp *Warp, selected, width, height int) []float32 {
+	var vertices []float32
+	line := func(a, b WarpPoint, r, g, bl float32) {
+		vertices = append(vertices,
+			float32(a.X), float32(a.Y), r, g, bl,
+			float32(b.X), float32(b.Y), r, g, bl)
+	}
+	meshLine := func(u0, v0, u1, v1 float64) {
+		line(warp.output(warp.At(u0, v0)), warp.output(warp.At(u1, v1)), 0, 0.8, 0)
+	}
+	// The lines through the rows and columns of control points.
+	nu, nv := warp.quads()
+	for r := 0; r < warp.Rows; r++ {
+		v := float64(r) / float64(warp.Rows-1)
+		for i := 0; i < nu; i++ {
+			meshLine(float64(i)/float64(nu), v, float64(i+1)/float64(nu), v)
+		}
+	}
+	for c := 0; c < warp.Cols; c++ {
+		u := float64(c) / float64(warp.Cols-1)
+		for j := 0; j < nv; j++ {
+			meshLine(u, float64(j)/float64(nv), u, float64(j+1)/float64(nv))
+		}
+	}
+	// The handles of the control points.
+	dx, dy := warpHandleSize/float64(width), warpHandleSize/float64(height)
+	for i, p := range warp.Points {
+		p = warp.output(p)
+		r, g, b := float32(1), float32(1), float32(1)
+		if i == selected {
+			b = 0
+		}
+		corners := [4]WarpPoint{{p.X - dx, p.Y - dy}, {p.X + dx, p.Y - dy}, {p.X + dx, p.Y + dy}, {p.X - dx, p.Y + dy}}
+		for k := range corners {
+			line(corners[k], corners[(k+1)%4], r, g, b)
+		}
+	}
+	return vertices
+}
@@ -0,0 +1,105 @@
+package audio
+
+import (
+	"math"
+	"sync"
+
+	"github.com/mjibson/go-dsp/fft"
+)
+
+// The audio texture is computed like the AnalyserNode of Web Audio does with
+// its default settings, which is what Shadertoy uses.
+const (
+	fftSize     = 2048
+	smoothing   = 0.8
+	minDecibels = -100.0
+	maxDecibels = -30.0
+)
+
+// analyser computes the frequency spectrum of the most recent samples.
+type analyser struct {
+	window []float64
+	// smoothed is the magnitude of every frequency bin, averaged over time.
+	smoothed []float64
+}
+
+func newAnalyser() *analyser {
+	a := &analyser{
+		window:   make([]float64, fftSize),
+		smoothed: make([]float64, fftSize/2),
+	}
+	// Blackman window.
+	for i := range a.window {
+		x := 2 * math.Pi * float64(i) / fftSize
+		a.window[i] = 0.42 - 0.5*math.Cos(x) + 0.08*math.Cos(2*x)
+	}
+	return a
+}
+
+// spectrum writes the magnitudes of the first len(dst) frequency bins of the
+// fftSize samples to dst, mapped from minDecibels-maxDecibels to 0-255.
+func (a *analyser) spectrum(dst []byte, samples []float64) {
+	windowed := make([]float64, fftSize)
+	for i, s := range samples[len(samples)-fftSize:] {
+		windowed[i] = s * a.window[i]
+	}
+	freqs := fft.FFTReal(windowed)
+	for i := range a.smoothed {
+		mag := math.Hypot(real(freqs[i]), imag(freqs[i])) / fftSize
+		a.smoothed[i] = smoothing*a.smoothed[i] + (1-smoothing)*mag
+	}
+	for i := range dst {
+		db := 20 * math.Log10(a.smoothed[i])
+		dst[i] = clampByte(255 / (maxDecibels - minDecibels) * (db - minDecibels))
+	}
+}
+
+// waveform writes the last len(dst) samples to dst with silence at 128.
+func waveform(dst []byte, samples []float64) {
+	for i, s := range samples[len(samples)-len(dst):] {
+		dst[i] = clampByte(128 * (s + 1))
+	}
+}
+
+func clampByte(v float64) byte {
+	if !(v > 0) {
+		return 0
+	} else if v >= 255 {
+		return 255
+	}
+	return byte(v)
+}
+
+// ring keeps the most recent samples of a stream.
+type ring struct {
+	lock sync.Mutex
+	buf  []float64
+	// pos is the index that is written next.
+	pos int
+}
+
+func newRing(size int) *ring {
+	return &ring{buf: make([]float64, size)}
+}
+
+func (r *ring) Write(samples []float64) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if len(samples) > len(r.buf) {
+		samples = samples[len(samples)-len(r.buf):]
+	}
+	for len(samples) > 0 {
+		n := copy(r.buf[r.pos:], samples)
+		samples = samples[n:]
+		r.pos = (r.pos + n) % len(r.buf)
+	}
+}
+
+// Latest copies the len(dst) most recent samples to dst, oldest first.
+func (r *ring) Latest(dst []float64) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	start := (r.pos - len(dst) + len(r.buf)) % len(r.buf)
+	n := copy(dst, r.buf[start:])
+	copy(dst[n:], r.buf)
+}
@@ -0,0 +1,69 @@
+package audio
+
+import (
+	"math"
+	"reflect"
+	"testing"
+)
+
+func TestSpectrum(t *testing.T) {
+	// A quiet sine wave at the frequency of bin 64.
+	samples := make([]float64, fftSize)
+	for i := range samples {
+		samples[i] = 0.001 * math.Sin(2*math.Pi*64*float64(i)/fftSize)
+	}
+	a := newAnalyser()
+	spectrum := make([]byte, texWidth)
+	for i := 0; i < 50; i++ {
+		a.spectrum(spectrum, samples)
+	}
+	peak := 0
+	for i, v := range spectrum {
+		if v > spectrum[peak] {
+			peak = i
+		}
+	}
+	if peak != 64 {
+		t.Errorf("the peak is at bin %d, expected 64", peak)
+	}
+	// The magnitude is 0.001 * 0.42 / 2, about -73.6dB.
+	if spectrum[peak] != 96 {
+		t.Errorf("the peak is %d, expected 96", spectrum[peak])
+	}
+	if spectrum[200] != 0 {
+		t.Errorf("bins far from the sine are %d, expected 0", spectrum[200])
+	}
+
+	// The spectrum is smoothed over time.
+	a = newAnalyser()
+	a.spectrum(spectrum, samples)
+	first := spectrum[64]
+	a.spectrum(spectrum, samples)
+	if !(first < spectrum[64]) {
+		t.Errorf("the spectrum is not smoothed: %d, then %d", first, spectrum[64])
+	}
+}
+
+func TestWaveform(t *testing.T) {
+	wave := make([]byte, 4)
+	waveform(wave, []float64{1, -2, -1, 0, 0.5, 1.5})
+	if expected := []byte{0, 128, 192, 255}; !reflect.DeepEqual(wave, expected) {
+		t.Errorf("waveform = %v, expected %v", wave, expected)
+	}
+}
+
+func TestRing(t *testing.T) {
+	r := newRing(4)
+	r.Write([]float64{1, 2, 3})
+	latest := make([]float64, 2)
+	r.Latest(latest)
+	if expected := []float64{2, 3}; !reflect.DeepEqual(latest, expected) {
+		t.Errorf("Latest = %v, expected %v", latest, expected)
+	}
+	r.Write([]float64{4, 5, 6, 7, 8, 9})
+	latest = make([]float64, 4)
+	r.Latest(latest)
+	if expected := []float64{6, 7, 8, 9}; !reflect.DeepEqual(latest, expected) {
+		t.Errorf("Latest = %v, expected %v", latest, expected)
+	}
+}
@@ -2,13 +2,11 @@ package audio
 
 import (
 	"fmt"
-	"os"
 	"regexp"
 	"strconv"
 	"time"
 
 	"github.com/go-gl/gl/v3.3-core/gl"
-	"github.com/mjibson/go-dsp/fft"
 
 	"github.com/polyfloyd/shady/renderer"
 	"github.com/polyfloyd/shady/shadertoy"
@@ -16,18 +14,25 @@ import (
 
 func init() {
 	shadertoy.RegisterResourceType("audio", func(m shadertoy.Mapping, genTexID shadertoy.GenTexFunc, _ renderer.RenderState) (shadertoy.Resource, error) {
-		source, err := parseMappingValue(m.PWD, m.Value)
-		if err != nil {
-			return nil, err
-		}
-		r := newAudioTexture(m.Name, source, genTexID())
-		return r, nil
+		return NewTexture(m.Name, m.PWD, m.Value, genTexID())
 	})
 }
 
+// NewTexture creates the texture of an audio mapping with the value of the
+// audio loader, for loaders of other packages that include audio.
+func NewTexture(uniformName, pwd, value string, texIndex uint32) (shadertoy.Resource, error) {
+	source, err := parseMappingValue(pwd, value)
+	if err != nil {
+		return nil, err
+	}
+	return newAudioTexture(uniformName, source, texIndex), nil
+}
+
+// The texture has the layout of the audio inputs of Shadertoy: row 0 holds
+// the spectrum and row 1 the wave, both in the red channel.
 const (
 	texWidth  = 512
-	texHeight = 4
+	texHeight = 2
 )
 
 var (
@@ -37,16 +42,23 @@ var (
 
 func parseMappingValue(pwd, value string) (*source, error) {
 	if match := genericValueRe.FindStringSubmatch(value); match != nil {
-		return newAudioFileSource(match[1])
+		filename, err := shadertoy.ResolvePath(pwd, match[1])
+		if err != nil {
+			return nil, err
+		}
+		return newAudioFileSource(filename)
 	}
 
 	match := pcmValueRe.FindStringSubmatch(value)
 	if match == nil {
 		return nil, fmt.Errorf("could not parse audio value: %q (format: %s)", value, pcmValueRe)
 	}
-	filename, err := shadertoy.ResolvePath(pwd, match[1])
-	if err != nil {
-		return nil, err
+	filename := match[1]
+	if filename != "-" {
+		var err error
+		if filename, err = shadertoy.ResolvePath(pwd, filename); err != nil {
+			return nil, err
+		}
 	}
 	samplerate, err := strconv.Atoi(match[2])
 	if err != nil {
@@ -56,21 +68,19 @@ func parseMappingValue(pwd, value string) (*source, error) {
 	if err != nil {
 		return nil, err
 	}
+	if samplerate == 0 || channels == 0 {
+		return nil, fmt.Errorf("the PCM sample rate and number of channels must not be zero")
+	}
 	format := format(match[4])
-	if format.Bits()%8 != 0 {
-		return nil, fmt.Errorf("the number of PCM sample bits must be a multiple of 8, format: %q", format)
+	if err := format.Validate(); err != nil {
+		return nil, err
 	}
 
-	fd, err := os.Open(filename)
+	file, realtime, err := openPCM(filename)
 	if err != nil {
-		return nil, fmt.Errorf("could not open audio source: %w", err)
-	}
-	return &source{
-		SampleRate: samplerate,
-		Channels:   channels,
-		Format:     format,
-		file:       fd,
-	}, nil
+		return nil, err
+	}
+	return newSource(file, samplerate, channels, format, realtime), nil
 }
 
 // texture is a mapping of an audio stream.
@@ -79,33 +89,37 @@ type texture struct {
 	id          uint32
 	index       uint32
 	source      *source
+	analyser    *analyser
 
-	prevPeriod     []float64
-	stabilizedWave []float64
+	latest []float64
+	data   []uint8
 }
 
 func newAudioTexture(uniformName string, source *source, texIndex uint32) *texture {
 	at := &texture{
-		uniformName:    uniformName,
-		index:          texIndex,
-		source:         source,
-		prevPeriod:     make([]float64, texWidth),
-		stabilizedWave: make([]float64, texWidth),
+		uniformName: uniformName,
+		index:       texIndex,
+		source:      source,
+		analyser:    newAnalyser(),
+		latest:      make([]float64, fftSize),
+		data:        make([]uint8, texWidth*texHeight),
+	}
+	// The wave of silence is at the middle of the range.
+	for i := range at.data[texWidth:] {
+		at.data[texWidth+i] = 128
 	}
 	gl.GenTextures(1, &at.id)
 	gl.BindTexture(gl.TEXTURE_2D, at.id)
-
-	var initialData [texWidth * texHeight * 3]uint8
 	gl.TexImage2D(
-		gl.TEXTURE_2D,          // target
-		0,                      // level
-		gl.RGBA,                // internalFormat
-		texWidth,               // width
-		texHeight,              // height
-		0,                      // border
-		gl.RGB,                 // format
-		gl.UNSIGNED_BYTE,       // type
-		gl.Ptr(initialData[:]), // data
+		gl.TEXTURE_2D,    // target
+		0,                // level
+		gl.R8,            // internalFormat
+		texWidth,         // width
+		texHeight,        // height
+		0,                // border
+		gl.RED,           // format
+		gl.UNSIGNED_BYTE, // type
+		gl.Ptr(at.data),  // data
 	)
 	gl.TexParameteri(gl.TEXTURE_2D, gl.TEXTURE_WRAP_S, gl.CLAMP_TO_EDGE)
 	gl.TexParameteri(gl.TEXTURE_2D, gl.TEXTURE_WRAP_T, gl.CLAMP_TO_EDGE)
@@ -123,66 +137,25 @@ func (at *texture) UniformSource() string {
 }
 
 func (at *texture) PreRender(state renderer.RenderState) {
-	newPeriod := at.source.ReadSamples(state.Interval)
-	prevPeriod := at.prevPeriod[len(at.prevPeriod)-texWidth:]
-	at.prevPeriod = append(at.prevPeriod, newPeriod...)[len(newPeriod):]
-	period := at.prevPeriod[len(at.prevPeriod)-texWidth:]
+	at.source.Advance(state.Interval)
 
 	if loc, ok := state.Uniforms[at.uniformName]; ok {
-		textureData := make([]uint8, texWidth*texHeight*3)
-		// FFT
-		freqs := fft.FFTReal(period)
-		for x := 0; x < texWidth/2; x++ {
-			fft1 := uint8((real(freqs[x])*0.5 + 0.5) * 255.0)
-			fft2 := uint8((imag(freqs[x])*0.5 + 0.5) * 255.0)
-			textureData[x*2*3+0] = fft1
-			textureData[x*2*3+1] = fft1
-			textureData[x*2*3+2] = fft1
-			textureData[(x*2+1)*3+0] = fft2
-			textureData[(x*2+1)*3+1] = fft2
-			textureData[(x*2+1)*3+2] = fft2
-		}
-		// Wave
-		for x := 0; x < texWidth; x++ {
-			wave := uint8((period[x]*0.5 + 0.5) * 255.0)
-			textureData[(texWidth+x)*3+0] = wave
-			textureData[(texWidth+x)*3+1] = wave
-			textureData[(texWidth+x)*3+2] = wave
-		}
-		// Stabilized Wave
-		corrPeriod := period
-		// Search the newly read samples for a window of samples that
-		// resebles the previous period.
-		best := -1.0
-		for i := 0; i < len(newPeriod)-texWidth; i++ {
-			p := newPeriod[i : i+texWidth]
-			w := correlate(p, prevPeriod)
-			if w > best {
-				best = w
-				corrPeriod = p
-			}
-		}
-		const n = 0.35
-		for x := 0; x < texWidth; x++ {
-			at.stabilizedWave[x] = at.stabilizedWave[x]*(1-n) + corrPeriod[x]*n
-			wave := uint8((at.stabilizedWave[x]*0.5 + 0.5) * 255.0)
-			textureData[(texWidth*2+x)*3+0] = wave
-			textureData[(texWidth*2+x)*3+1] = wave
-			textureData[(texWidth*2+x)*3+2] = wave
-		}
+		at.source.samples.Latest(at.latest)
+		at.analyser.spectrum(at.data[:texWidth], at.latest)
+		waveform(at.data[texWidth:], at.latest)
 
 		gl.ActiveTexture(gl.TEXTURE0 + at.index)
 		gl.BindTexture(gl.TEXTURE_2D, at.id)
 		gl.TexSubImage2D(
-			gl.TEXTURE_2D,       // target,
-			0,                   // level,
-			0,                   // xoffset,
-			0,                   // yoffset,
-			texWidth,            // width,
-			texHeight,           // height,
-			gl.RGB,              // format,
-			gl.UNSIGNED_BYTE,    // type,
-			gl.Ptr(textureData), // data
+			gl.TEXTURE_2D,    // target,
+			0,                // level,
+			0,                // xoffset,
+			0,                // yoffset,
+			texWidth,         // width,
+			texHeight,        // height,
+			gl.RED,           // format,
+			gl.UNSIGNED_BYTE, // type,
+			gl.Ptr(at.data),  // data
 		)
 		gl.Uniform1i(loc.Location, int32(at.index))
 	}
@@ -212,14 +185,3 @@ func (at *texture) Close() error {
 	gl.DeleteTextures(1, &at.id)
 	return nil
 }
-
-func correlate(a, b []float64) float64 {
-	if len(a) != len(b) {
-		panic("mismatched slice lengths")
-	}
-	w := 0.0
-	for i := range a {
-		w += a[i] * b[i]
-	}
-	return w
-}
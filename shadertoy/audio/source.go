@@ -4,16 +4,28 @@ import (
 	"fmt"
 	"io"
 	"log"
+	"math"
+	"os"
 	"os/exec"
 	"strconv"
 	"time"
 )
 
+// decodeRate is the sample rate audio files are decoded at. It is that of most
+// Web Audio contexts, so frequency bins are at the same place as in Shadertoy.
+const decodeRate = 44100
+
+// source decodes PCM audio into a ring buffer of mono samples.
 type source struct {
 	SampleRate int
 	Channels   int
 	Format     format
 	file       io.ReadCloser
+	// realtime sources are read as fast as they produce audio, so the ring
+	// always holds the most recent samples. Other sources are read as the
+	// animation advances.
+	realtime bool
+	samples  *ring
 }
 
 func newAudioFileSource(filename string) (*source, error) {
@@ -25,7 +37,7 @@ func newAudioFileSource(filename string) (*source, error) {
 			"-f", "s16le",
 			"-acodec", "pcm_s16le",
 			"-ac", "1",
-			"-ar", "22000",
+			"-ar", strconv.Itoa(decodeRate),
 			"-",
 		)
 		cmd.Stdout = w
@@ -37,33 +49,72 @@ func newAudioFileSource(filename string) (*source, error) {
 		}
 		w.Close()
 	}()
-	return &source{
-		SampleRate: 22000,
-		Channels:   1,
-		Format:     "s16le",
-		file:       r,
-	}, nil
+	return newSource(r, decodeRate, 1, "s16le", false), nil
 }
 
-func (s *source) ReadSamples(period time.Duration) []float64 {
-	numBytes := s.Format.Bits() / 8
-	buf := make([]byte, s.SampleRate*s.Channels*int(period)/int(time.Second)*numBytes)
-	n, err := s.file.Read(buf)
-	if err != nil {
-		return make([]float64, time.Duration(s.SampleRate)*period/time.Second)
+func newSource(file io.ReadCloser, sampleRate, channels int, format format, realtime bool) *source {
+	s := &source{
+		SampleRate: sampleRate,
+		Channels:   channels,
+		Format:     format,
+		file:       file,
+		realtime:   realtime,
+		samples:    newRing(fftSize),
+	}
+	if realtime {
+		go s.run()
 	}
+	return s
+}
 
-	samples := make([]float64, n/numBytes)
-	switch s.Format {
-	case "s16le":
-		for i := range samples {
-			offset := i * s.Channels * numBytes
-			bytes := buf[offset : offset+numBytes]
-			sample := int16(bytes[0]) | int16(bytes[1])<<8
-			samples[i] = float64(sample) / float64(0x7fff)
+// run reads a realtime source until it is closed.
+func (s *source) run() {
+	frameSize := s.Channels * s.Format.Bits() / 8
+	buf := make([]byte, 1024*frameSize)
+	var pending int
+	for {
+		n, err := s.file.Read(buf[pending:])
+		pending += n
+		whole := pending - pending%frameSize
+		s.samples.Write(s.decode(buf[:whole]))
+		pending = copy(buf, buf[whole:pending])
+		if err != nil {
+			if err != io.EOF {
+				log.Printf("audio: %v", err)
+			}
+			return
 		}
-	default:
-		panic(fmt.Sprintf("Unimplemented format %q", s.Format))
+	}
+}
+
+// Advance reads the samples that are played during the period from sources
+// that are not realtime. Once the source has ended, the audio is silent.
+func (s *source) Advance(period time.Duration) {
+	if s.realtime {
+		return
+	}
+	frameSize := s.Channels * s.Format.Bits() / 8
+	buf := make([]byte, int(time.Duration(s.SampleRate)*period/time.Second)*frameSize)
+	n, _ := io.ReadFull(s.file, buf)
+	for i := n - n%frameSize; i < len(buf); i++ {
+		buf[i] = s.Format.silence(i % (s.Format.Bits() / 8))
+	}
+	s.samples.Write(s.decode(buf))
+}
+
+// decode converts whole frames of PCM to samples in the range of -1 to 1,
+// mixing all channels down to one.
+func (s *source) decode(buf []byte) []float64 {
+	sampleSize := s.Format.Bits() / 8
+	frameSize := s.Channels * sampleSize
+	samples := make([]float64, len(buf)/frameSize)
+	for i := range samples {
+		var sum float64
+		for c := 0; c < s.Channels; c++ {
+			offset := i*frameSize + c*sampleSize
+			sum += s.Format.decode(buf[offset : offset+sampleSize])
+		}
+		samples[i] = sum / float64(s.Channels)
 	}
 	return samples
 }
@@ -72,6 +123,8 @@ func (s *source) Close() error {
 	return s.file.Close()
 }
 
+// format is a PCM encoding like s16le: the sign as s or u, the number of bits
+// per sample and the endianness as le or be.
 type format string
 
 func (f format) Bits() int {
@@ -85,3 +138,69 @@ func (f format) Bits() int {
 	}
 	return b
 }
+
+func (f format) Validate() error {
+	switch f.Bits() {
+	case 8, 16, 24, 32:
+		return nil
+	}
+	return fmt.Errorf("unsupported PCM format %q, valid sample sizes are 8, 16, 24 and 32 bits", string(f))
+}
+
+func (f format) signed() bool {
+	return f[0] == 's'
+}
+
+func (f format) bigEndian() bool {
+	return f[len(f)-2:] == "be"
+}
+
+// decode converts a single sample to the range of -1 to 1.
+func (f format) decode(b []byte) float64 {
+	var u uint32
+	if f.bigEndian() {
+		for _, c := range b {
+			u = u<<8 | uint32(c)
+		}
+	} else {
+		for i := len(b) - 1; i >= 0; i-- {
+			u = u<<8 | uint32(b[i])
+		}
+	}
+	bits := uint(len(b) * 8)
+	if !f.signed() {
+		// Flipping the highest bit turns unsigned samples into signed ones.
+		u ^= 1 << (bits - 1)
+	}
+	v := int32(u<<(32-bits)) >> (32 - bits)
+	return math.Max(float64(v)/float64(int64(1)<<(bits-1)-1), -1)
+}
+
+// silence returns byte i of a sample with the value 0.
+func (f format) silence(i int) byte {
+	if f.signed() {
+		return 0
+	}
+	if i == 0 && f.bigEndian() || i == f.Bits()/8-1 && !f.bigEndian() {
+		return 0x80
+	}
+	return 0
+}
+
+// openPCM opens a raw PCM file or pipe. The filename "-" refers to stdin.
+// Audio that is not read from a regular file is played in realtime.
+func openPCM(filename string) (io.ReadCloser, bool, error) {
+	if filename == "-" {
+		return io.NopCloser(os.Stdin), true, nil
+	}
+	fd, err := os.Open(filename)
+	if err != nil {
+		return nil, false, fmt.Errorf("could not open audio source: %w", err)
+	}
+	info, err := fd.Stat()
+	if err != nil {
+		fd.Close()
+		return nil, false, err
+	}
+	return fd, !info.Mode().IsRegular(), nil
+}
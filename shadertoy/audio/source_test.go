@@ -0,0 +1,52 @@
+package audio
+
+import (
+	"bytes"
+	"io"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestFormatDecode(t *testing.T) {
+	tests := []struct {
+		format   format
+		sample   []byte
+		expected float64
+	}{
+		{"s16le", []byte{0xff, 0x7f}, 1},
+		{"s16le", []byte{0x00, 0x80}, -1},
+		{"s16be", []byte{0x7f, 0xff}, 1},
+		{"u8le", []byte{0x80}, 0},
+		{"u8le", []byte{0xff}, 1},
+		{"u16be", []byte{0x00, 0x00}, -1},
+		{"s24le", []byte{0x00, 0x00, 0xc0}, -0.5},
+		{"s32be", []byte{0x00, 0x00, 0x00, 0x00}, 0},
+	}
+	for _, test := range tests {
+		if v := test.format.decode(test.sample); v < test.expected-1e-4 || v > test.expected+1e-4 {
+			t.Errorf("%s %v decodes to %v, expected %v", test.format, test.sample, v, test.expected)
+		}
+	}
+
+	for _, f := range []format{"s8le", "u16le", "s24be", "s32le"} {
+		if err := f.Validate(); err != nil {
+			t.Errorf("%s: %v", f, err)
+		}
+	}
+	if err := format("s12le").Validate(); err == nil {
+		t.Errorf("12 bit samples are accepted")
+	}
+}
+
+func TestSourceAdvance(t *testing.T) {
+	// Stereo u8 audio is mixed down to mono, and is silent after the end.
+	pcm := []byte{0xff, 0xff, 0x00, 0x00, 0xff, 0x00}
+	s := newSource(io.NopCloser(bytes.NewReader(pcm)), 4, 2, "u8le", false)
+	s.Advance(time.Second)
+	latest := make([]float64, 4)
+	s.samples.Latest(latest)
+	if expected := []float64{1, -1, 0, 0}; !reflect.DeepEqual(latest, expected) {
+		t.Errorf("samples = %v, expected %v", latest, expected)
+	}
+}
@@ -2,6 +2,7 @@ package shadertoy
 
 import (
 	"fmt"
+	"path/filepath"
 	"regexp"
 	"strconv"
 
@@ -11,7 +12,7 @@ import (
 )
 
 func init() {
-	RegisterResourceType("buffer", func(m Mapping, genTexID GenTexFunc, _ renderer.RenderState) (Resource, error) {
+	RegisterResourceType("buffer", func(m Mapping, genTexID GenTexFunc, state renderer.RenderState) (Resource, error) {
 		match := bufferValueRe.FindStringSubmatch(m.Value)
 		if match == nil {
 			return nil, fmt.Errorf("could not parse buffer value: %q (format: %s)", m.Value, bufferValueRe)
@@ -21,16 +22,33 @@ func init() {
 		if err != nil {
 			return nil, err
 		}
-		width, err := strconv.ParseUint(match[2], 10, 32)
-		if err != nil {
-			return nil, err
+		// Without a size, the buffer is as large as the canvas.
+		width, height := uint64(state.CanvasWidth), uint64(state.CanvasHeight)
+		if match[2] != "" {
+			if width, err = strconv.ParseUint(match[2], 10, 32); err != nil {
+				return nil, err
+			}
+			if height, err = strconv.ParseUint(match[3], 10, 32); err != nil {
+				return nil, err
+			}
+		}
+
+		format := renderer.PixelFormatRGBA8
+		if match[4] != "" {
+			if format, err = renderer.ParsePixelFormat(match[4]); err != nil {
+				return nil, err
+			}
 		}
-		height, err := strconv.ParseUint(match[3], 10, 32)
+
+		resolver := m.Resolver
+		if resolver == nil {
+			resolver = renderer.FileResolver{}
+		}
+		absFilename, err := filepath.Abs(filename)
 		if err != nil {
 			return nil, err
 		}
-
-		sources, err := renderer.Includes(filename)
+		sources, err := renderer.IncludeSources(resolver, renderer.SourceFile{Filename: absFilename})
 		if err != nil {
 			return nil, err
 		}
@@ -41,12 +59,14 @@ func init() {
 			filename: filename,
 			width:    uint(width),
 			height:   uint(height),
-			sources:  renderer.SourceFiles(sources...),
+			format:   format,
+			sources:  sources,
+			pass:     m.Pass,
 		}, nil
 	})
 }
 
-var bufferValueRe = regexp.MustCompile(`^([^;]+);(\d+)x(\d+)$`)
+var bufferValueRe = regexp.MustCompile(`^([^;]+)(?:;(\d+)x(\d+))?(?:;(\w+))?$`)
 
 type bufferImage struct {
 	name  string
@@ -54,7 +74,10 @@ type bufferImage struct {
 
 	filename      string
 	width, height uint
-	sources       []renderer.SourceFile
+	format        renderer.PixelFormat
+	sources       []renderer.Source
+	// pass is set if the buffer is the pass of a multi-pass shader.
+	pass bool
 }
 
 func (tex *bufferImage) UniformSource() string {
@@ -80,4 +103,8 @@ func (tex *bufferImage) PreRender(state renderer.RenderState) {
 	}
 }
 
+// Idle implements the IdleResource interface. Whether the output of the buffer
+// changed is tracked by the renderer.
+func (tex *bufferImage) Idle(renderer.RenderState) bool { return true }
+
 func (tex *bufferImage) Close() error { return nil }
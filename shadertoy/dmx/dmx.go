@@ -0,0 +1,225 @@
+package dmx
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/go-gl/gl/v3.3-core/gl"
+
+	"github.com/polyfloyd/shady/renderer"
+	"github.com/polyfloyd/shady/shadertoy"
+)
+
+// defaultChannels is the number of channels that are mapped if the mapping
+// does not specify it.
+const defaultChannels = 16
+
+func init() {
+	shadertoy.RegisterResourceType("dmx", func(m shadertoy.Mapping, _ shadertoy.GenTexFunc, _ renderer.RenderState) (shadertoy.Resource, error) {
+		cfg, err := parseValue(m.Value)
+		if err != nil {
+			return nil, err
+		}
+		rx, err := listen(cfg)
+		if err != nil {
+			return nil, err
+		}
+		return &dmxInput{uniformName: m.Name, receiver: rx, values: make([]float32, cfg.channels)}, nil
+	})
+}
+
+type config struct {
+	protocol string
+	universe uint16
+	// address is the first channel that is mapped, starting at 1 like the
+	// addresses of fixtures.
+	address  int
+	channels int
+	listen   string
+}
+
+// parseValue parses the value of a dmx mapping as
+// "<artnet|sacn>[:<universe>][;address=<n>][;channels=<n>][;listen=<addr>]".
+func parseValue(value string) (config, error) {
+	parts := strings.Split(value, ";")
+	cfg := config{address: 1, channels: defaultChannels}
+	protocol, universe := parts[0], ""
+	if i := strings.IndexByte(protocol, ':'); i >= 0 {
+		protocol, universe = protocol[:i], protocol[i+1:]
+	}
+	switch protocol {
+	case "artnet":
+	case "sacn":
+		cfg.universe = 1
+	default:
+		return config{}, fmt.Errorf("unknown dmx protocol %q, expected artnet or sacn", protocol)
+	}
+	cfg.protocol = protocol
+	if universe != "" {
+		n, err := strconv.ParseUint(universe, 10, 16)
+		if err != nil || protocol == "artnet" && n > 0x7fff || protocol == "sacn" && (n < 1 || n > 63999) {
+			return config{}, fmt.Errorf("invalid %s universe %q", protocol, universe)
+		}
+		cfg.universe = uint16(n)
+	}
+
+	for _, opt := range parts[1:] {
+		key, arg := opt, ""
+		if i := strings.IndexByte(opt, '='); i >= 0 {
+			key, arg = opt[:i], opt[i+1:]
+		}
+		var err error
+		switch key {
+		case "address":
+			cfg.address, err = strconv.Atoi(arg)
+		case "channels":
+			cfg.channels, err = strconv.Atoi(arg)
+		case "listen":
+			cfg.listen = arg
+			if arg == "" {
+				err = fmt.Errorf("no address")
+			}
+		default:
+			return config{}, fmt.Errorf("unknown dmx option %q", opt)
+		}
+		if err != nil {
+			return config{}, fmt.Errorf("invalid dmx option %q: %w", opt, err)
+		}
+	}
+	if cfg.address < 1 || cfg.address > universeSize {
+		return config{}, fmt.Errorf("the dmx address must be between 1 and %d, got %d", universeSize, cfg.address)
+	}
+	if cfg.channels < 1 || cfg.address+cfg.channels-1 > universeSize {
+		return config{}, fmt.Errorf("dmx channels %d to %d do not fit in a universe", cfg.address, cfg.address+cfg.channels-1)
+	}
+	return cfg, nil
+}
+
+// receiver keeps the channels of a universe that were last received.
+type receiver struct {
+	cfg        config
+	conn       *net.UDPConn
+	loopClosed chan struct{}
+
+	lock     sync.Mutex
+	channels [universeSize]byte
+	changed  bool
+}
+
+func listen(cfg config) (*receiver, error) {
+	var conn *net.UDPConn
+	var err error
+	switch {
+	case cfg.listen != "":
+		var addr *net.UDPAddr
+		if addr, err = net.ResolveUDPAddr("udp", cfg.listen); err == nil {
+			conn, err = net.ListenUDP("udp", addr)
+		}
+	case cfg.protocol == "sacn":
+		// Joining the group of the universe also receives packets that are
+		// sent to this host directly.
+		conn, err = net.ListenMulticastUDP("udp4", nil, &net.UDPAddr{IP: sACNMulticastGroup(cfg.universe), Port: sACNPort})
+	default:
+		conn, err = net.ListenUDP("udp4", &net.UDPAddr{Port: artNetPort})
+	}
+	if err != nil {
+		return nil, fmt.Errorf("could not listen for %s: %w", cfg.protocol, err)
+	}
+
+	rx := &receiver{cfg: cfg, conn: conn, loopClosed: make(chan struct{})}
+	go func() {
+		defer close(rx.loopClosed)
+		buf := make([]byte, 1024)
+		for {
+			n, _, err := conn.ReadFromUDP(buf)
+			if err != nil {
+				// The connection was closed.
+				return
+			}
+			rx.handle(buf[:n])
+		}
+	}()
+	return rx, nil
+}
+
+func (rx *receiver) handle(packet []byte) {
+	var universe uint16
+	var data []byte
+	var ok bool
+	if rx.cfg.protocol == "sacn" {
+		var terminated bool
+		if universe, data, terminated, ok = parseSACN(packet); terminated {
+			// Keep the last look in place, like fixtures do.
+			return
+		}
+	} else {
+		universe, data, ok = parseArtDmx(packet)
+	}
+	if !ok || universe != rx.cfg.universe {
+		return
+	}
+	rx.lock.Lock()
+	defer rx.lock.Unlock()
+	// Channels that are not in the packet keep their previous values.
+	if !bytes.Equal(rx.channels[:len(data)], data) {
+		copy(rx.channels[:], data)
+		rx.changed = true
+	}
+}
+
+// read copies the mapped channels as values from 0 to 1 to values.
+func (rx *receiver) read(values []float32) {
+	rx.lock.Lock()
+	defer rx.lock.Unlock()
+	for i := range values {
+		values[i] = float32(rx.channels[rx.cfg.address-1+i]) / 255
+	}
+	rx.changed = false
+}
+
+// pending reports whether any of the channels changed since they were last
+// read.
+func (rx *receiver) pending() bool {
+	rx.lock.Lock()
+	defer rx.lock.Unlock()
+	return rx.changed
+}
+
+func (rx *receiver) Close() error {
+	err := rx.conn.Close()
+	<-rx.loopClosed
+	return err
+}
+
+// dmxInput is a mapping of the channels of a DMX universe to a uniform array.
+type dmxInput struct {
+	uniformName string
+	receiver    *receiver
+
+	values []float32
+}
+
+func (di *dmxInput) UniformSource() string {
+	return fmt.Sprintf("uniform float %s[%d];", di.uniformName, len(di.values))
+}
+
+// Idle implements the shadertoy.IdleResource interface. The channels are
+// idle as long as none of them changed since the previous frame.
+func (di *dmxInput) Idle(renderer.RenderState) bool {
+	return !di.receiver.pending()
+}
+
+func (di *dmxInput) PreRender(state renderer.RenderState) {
+	di.receiver.read(di.values)
+	if loc, ok := state.Uniforms[di.uniformName+"[0]"]; ok {
+		gl.Uniform1fv(loc.Location, int32(len(di.values)), &di.values[0])
+	}
+}
+
+func (di *dmxInput) Close() error {
+	return di.receiver.Close()
+}
@@ -0,0 +1,136 @@
+package dmx
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+)
+
+func artDmxPacket(universe uint16, data []byte) []byte {
+	p := append([]byte{}, artNetID...)
+	p = append(p, 0x00, 0x50, 0, 14, 1, 0, byte(universe), byte(universe>>8))
+	p = append(p, byte(len(data)>>8), byte(len(data)))
+	return append(p, data...)
+}
+
+func sACNPacket(universe uint16, options byte, data []byte) []byte {
+	p := make([]byte, 126+len(data))
+	binary.BigEndian.PutUint16(p[0:], 0x0010)
+	copy(p[4:], sACNID)
+	binary.BigEndian.PutUint32(p[18:], sACNRootVector)
+	binary.BigEndian.PutUint32(p[40:], sACNFramingVector)
+	copy(p[44:], "desk")
+	p[108] = 100
+	p[112] = options
+	binary.BigEndian.PutUint16(p[113:], universe)
+	p[117] = sACNDMPVector
+	p[118] = 0xa1
+	binary.BigEndian.PutUint16(p[121:], 1)
+	binary.BigEndian.PutUint16(p[123:], uint16(len(data)+1))
+	copy(p[126:], data)
+	return p
+}
+
+func TestParseArtDmx(t *testing.T) {
+	universe, data, ok := parseArtDmx(artDmxPacket(0x123, []byte{1, 2, 3, 4}))
+	if !ok || universe != 0x123 || !bytes.Equal(data, []byte{1, 2, 3, 4}) {
+		t.Fatalf("got universe %#x, data %v, %v", universe, data, ok)
+	}
+
+	poll := artDmxPacket(0, nil)
+	poll[8], poll[9] = 0x00, 0x20
+	for _, p := range [][]byte{poll, artDmxPacket(0, []byte{1, 2})[:19], []byte("Art-Net")} {
+		if _, _, ok := parseArtDmx(p); ok {
+			t.Errorf("%v: expected an invalid packet", p)
+		}
+	}
+}
+
+func TestParseSACN(t *testing.T) {
+	universe, data, terminated, ok := parseSACN(sACNPacket(7, 0, []byte{255, 0, 128}))
+	if !ok || terminated || universe != 7 || !bytes.Equal(data, []byte{255, 0, 128}) {
+		t.Fatalf("got universe %d, data %v, %v, %v", universe, data, terminated, ok)
+	}
+	if _, _, terminated, ok := parseSACN(sACNPacket(7, sACNStreamTerminated, []byte{1})); !ok || !terminated {
+		t.Errorf("expected a terminated stream")
+	}
+	if _, _, _, ok := parseSACN(sACNPacket(7, sACNPreviewData, []byte{1})); ok {
+		t.Errorf("expected preview data to be ignored")
+	}
+	rdm := sACNPacket(7, 0, []byte{1})
+	rdm[125] = 0xcc
+	if _, _, _, ok := parseSACN(rdm); ok {
+		t.Errorf("expected a non-zero start code to be ignored")
+	}
+	if ip := sACNMulticastGroup(0x0102).String(); ip != "239.255.1.2" {
+		t.Errorf("got multicast group %s", ip)
+	}
+}
+
+func TestParseValue(t *testing.T) {
+	valid := map[string]config{
+		"artnet":                         {protocol: "artnet", address: 1, channels: defaultChannels},
+		"artnet:3;address=10;channels=4": {protocol: "artnet", universe: 3, address: 10, channels: 4},
+		"sacn":                           {protocol: "sacn", universe: 1, address: 1, channels: defaultChannels},
+		"sacn:2;listen=:5569":            {protocol: "sacn", universe: 2, address: 1, channels: defaultChannels, listen: ":5569"},
+		"sacn:1;address=512;channels=1":  {protocol: "sacn", universe: 1, address: 512, channels: 1},
+	}
+	for value, expected := range valid {
+		cfg, err := parseValue(value)
+		if err != nil {
+			t.Errorf("%q: unexpected error: %v", value, err)
+			continue
+		}
+		if cfg != expected {
+			t.Errorf("%q: got %+v, expected %+v", value, cfg, expected)
+		}
+	}
+
+	for _, value := range []string{
+		"",
+		"dmx512",
+		"artnet:32768",
+		"sacn:0",
+		"artnet;address=0",
+		"artnet;address=510;channels=4",
+		"artnet;channels=x",
+		"artnet;listen=",
+		"artnet;blackout",
+	} {
+		if _, err := parseValue(value); err == nil {
+			t.Errorf("%q: expected an error", value)
+		}
+	}
+}
+
+func TestReceiver(t *testing.T) {
+	rx := &receiver{cfg: config{protocol: "artnet", universe: 1, address: 3, channels: 2}}
+	values := make([]float32, 2)
+
+	rx.handle(artDmxPacket(0, []byte{0, 0, 255, 255}))
+	if rx.pending() {
+		t.Fatalf("expected packets of other universes to be ignored")
+	}
+	rx.handle(artDmxPacket(1, []byte{0, 0, 255, 51, 9}))
+	if !rx.pending() {
+		t.Fatalf("expected the channels to have changed")
+	}
+	rx.read(values)
+	if values[0] != 1 || values[1] != 0.2 {
+		t.Fatalf("got values %v", values)
+	}
+	if rx.pending() {
+		t.Fatalf("expected no changes after reading")
+	}
+
+	// A shorter packet only updates the channels it contains.
+	rx.handle(artDmxPacket(1, []byte{0, 0, 0}))
+	rx.read(values)
+	if values[0] != 0 || values[1] != 0.2 {
+		t.Fatalf("got values %v after a short packet", values)
+	}
+	rx.handle(artDmxPacket(1, []byte{0, 0, 0}))
+	if rx.pending() {
+		t.Fatalf("expected a repeated packet not to change the channels")
+	}
+}
@@ -0,0 +1,79 @@
+package dmx
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+)
+
+const (
+	universeSize = 512
+
+	artNetPort = 6454
+	sACNPort   = 5568
+)
+
+var (
+	artNetID = []byte("Art-Net\x00")
+	sACNID   = []byte("ASC-E1.17\x00\x00\x00")
+)
+
+const (
+	artNetOpDmx = 0x5000
+
+	sACNRootVector    = 0x00000004
+	sACNFramingVector = 0x00000002
+	sACNDMPVector     = 0x02
+	// sACNStreamTerminated is the option bit that is set by sources that
+	// stop sending.
+	sACNStreamTerminated = 0x40
+	sACNPreviewData      = 0x80
+)
+
+// parseArtDmx returns the 15-bit port address and the channel data of an
+// ArtDmx packet.
+func parseArtDmx(packet []byte) (uint16, []byte, bool) {
+	if len(packet) < 18 || !bytes.Equal(packet[:8], artNetID) {
+		return 0, nil, false
+	}
+	if binary.LittleEndian.Uint16(packet[8:]) != artNetOpDmx {
+		return 0, nil, false
+	}
+	universe := uint16(packet[15]&0x7f)<<8 | uint16(packet[14])
+	length := int(binary.BigEndian.Uint16(packet[16:]))
+	if length > universeSize || 18+length > len(packet) {
+		return 0, nil, false
+	}
+	return universe, packet[18 : 18+length], true
+}
+
+// parseSACN returns the universe and the channel data of an E1.31 data
+// packet. Packets with a non-zero start code, like those with RDM, are
+// ignored. terminated is set if the source stopped sending.
+func parseSACN(packet []byte) (universe uint16, data []byte, terminated, ok bool) {
+	if len(packet) < 126 || !bytes.Equal(packet[4:16], sACNID) {
+		return 0, nil, false, false
+	}
+	if binary.BigEndian.Uint32(packet[18:]) != sACNRootVector ||
+		binary.BigEndian.Uint32(packet[40:]) != sACNFramingVector ||
+		packet[117] != sACNDMPVector {
+		return 0, nil, false, false
+	}
+	options := packet[112]
+	if options&sACNPreviewData != 0 {
+		return 0, nil, false, false
+	}
+	universe = binary.BigEndian.Uint16(packet[113:])
+	// The property count includes the start code.
+	count := int(binary.BigEndian.Uint16(packet[123:]))
+	if count < 1 || count > universeSize+1 || 125+count > len(packet) || packet[125] != 0 {
+		return 0, nil, false, false
+	}
+	return universe, packet[126 : 125+count], options&sACNStreamTerminated != 0, true
+}
+
+// sACNMulticastGroup returns the multicast address to which the packets of a
+// universe are sent.
+func sACNMulticastGroup(universe uint16) net.IP {
+	return net.IPv4(239, 255, byte(universe>>8), byte(universe))
+}
@@ -0,0 +1,103 @@
+package shadertoy
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/polyfloyd/shady/renderer"
+)
+
+func init() {
+	RegisterResourceType("file", func(m Mapping, genTexID GenTexFunc, state renderer.RenderState) (Resource, error) {
+		// Options of the target loader follow the filename after a ';'.
+		filename := m.Value
+		if i := strings.LastIndexByte(filename, ';'); i >= 0 {
+			filename = filename[:i]
+		}
+		path, err := ResolvePath(m.PWD, filename)
+		if err != nil {
+			return nil, err
+		}
+		kind, err := DetectResourceType(path)
+		if err != nil {
+			return nil, err
+		}
+		build, ok := resourceBuilders[kind]
+		if !ok {
+			return nil, fmt.Errorf("%s looks like %s, but support for it is not compiled in", path, kind)
+		}
+		m.Namespace = kind
+		return build(m, genTexID, state)
+	})
+}
+
+// magicSignatures map the magic bytes at the start of files to resource
+// types. The first match wins.
+var magicSignatures = []struct {
+	offset int
+	magic  string
+	kind   string
+}{
+	{0, "\x89PNG\r\n\x1a\n", "image"},
+	{0, "\xff\xd8\xff", "image"},
+	{0, "GIF87a", "image"},
+	{0, "GIF89a", "image"},
+	{8, "WEBP", "image"},
+	{8, "WAVE", "audio"},
+	{0, "fLaC", "audio"},
+	{0, "ID3", "audio"},
+	{0, "OggS", "audio"},
+	{0, "\xff\xfb", "audio"},
+	{0, "\xff\xf3", "audio"},
+	{0, "\xff\xf2", "audio"},
+	{4, "ftypavif", "image"},
+	{4, "ftypheic", "image"},
+	{4, "ftyp", "video"},
+	{0, "\x1a\x45\xdf\xa3", "video"},
+	{8, "AVI ", "video"},
+	{0, "ply\n", "pointcloud"},
+	{0, "ply\r\n", "pointcloud"},
+}
+
+// extensionKinds are used when a file can not be identified by its contents.
+var extensionKinds = map[string]string{
+	".csv": "pointcloud",
+	".xyz": "pointcloud",
+	".ts":  "video",
+	".mpg": "video",
+}
+
+// DetectResourceType guesses the resource type of a file from its first bytes,
+// falling back to the file extension.
+func DetectResourceType(path string) (string, error) {
+	fd, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer fd.Close()
+	header := make([]byte, 512)
+	n, err := io.ReadFull(fd, header)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return "", err
+	}
+	if kind, ok := sniffResourceType(header[:n]); ok {
+		return kind, nil
+	}
+	if kind, ok := extensionKinds[strings.ToLower(filepath.Ext(path))]; ok {
+		return kind, nil
+	}
+	return "", fmt.Errorf("unable to detect the type of %s, please specify it explicitly like image:%s", path, filepath.Base(path))
+}
+
+func sniffResourceType(header []byte) (string, bool) {
+	for _, sig := range magicSignatures {
+		if len(header) >= sig.offset+len(sig.magic) && bytes.Equal(header[sig.offset:sig.offset+len(sig.magic)], []byte(sig.magic)) {
+			return sig.kind, true
+		}
+	}
+	return "", false
+}
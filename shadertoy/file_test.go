@@ -0,0 +1,30 @@
+package shadertoy
+
+import (
+	"testing"
+)
+
+func TestSniffResourceType(t *testing.T) {
+	cases := map[string]string{
+		"\x89PNG\r\n\x1a\n\x00\x00":            "image",
+		"\xff\xd8\xff\xe0\x00\x10JFIF":         "image",
+		"GIF89a\x01\x00":                       "image",
+		"RIFF\x24\x00\x00\x00WAVEfmt ":         "audio",
+		"fLaC\x00\x00\x00\x22":                 "audio",
+		"\x00\x00\x00\x20ftypisom\x00\x00\x02": "video",
+		"\x00\x00\x00\x1cftypavif\x00\x00\x00": "image",
+		"\x1a\x45\xdf\xa3\x9f\x42\x86\x81":     "video",
+		"ply\nformat ascii 1.0\n":              "pointcloud",
+	}
+	for header, expected := range cases {
+		kind, ok := sniffResourceType([]byte(header))
+		if !ok || kind != expected {
+			t.Errorf("detected %q as %q, expected %q", header, kind, expected)
+		}
+	}
+	for _, header := range []string{"", "void main() {}", "\x00\x00"} {
+		if kind, ok := sniffResourceType([]byte(header)); ok {
+			t.Errorf("unexpectedly detected %q as %q", header, kind)
+		}
+	}
+}
@@ -0,0 +1,377 @@
+package gpio
+
+import (
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-gl/gl/v3.3-core/gl"
+
+	"github.com/polyfloyd/shady/renderer"
+	"github.com/polyfloyd/shady/shadertoy"
+)
+
+const (
+	defaultChip = "/dev/gpiochip0"
+	// encoderPollInterval is how often the pins of a rotary encoder are read.
+	// Encoders produce short pulses, so they are read much more often than
+	// frames are rendered.
+	encoderPollInterval = time.Millisecond
+)
+
+func init() {
+	shadertoy.RegisterResourceType("gpio", func(m shadertoy.Mapping, _ shadertoy.GenTexFunc, _ renderer.RenderState) (shadertoy.Resource, error) {
+		cfg, err := parseValue(m.Value)
+		if err != nil {
+			return nil, err
+		}
+		l, err := requestLines(cfg.chip, cfg.pins, cfg.lineOptions)
+		if err != nil {
+			return nil, err
+		}
+		switch cfg.mode {
+		case modeEncoder:
+			return newEncoderInput(m.Name, l), nil
+		case modeOutput:
+			return newPinOutput(m.Name, l, cfg.x, cfg.y), nil
+		}
+		return newPinInput(m.Name, l), nil
+	})
+}
+
+type mode int
+
+const (
+	modeInput mode = iota
+	modeEncoder
+	modeOutput
+)
+
+type lineOptions struct {
+	output    bool
+	activeLow bool
+	pull      string
+}
+
+type config struct {
+	lineOptions
+	chip string
+	pins []uint32
+	mode mode
+	// x and y are the coordinates of the pixel that drives an output pin.
+	x, y int
+}
+
+// parseValue parses the value of a gpio mapping as
+// "<pins>[;chip=<path>][;pull=up|down][;active-low][;encoder][;out[=<x>,<y>]]".
+func parseValue(value string) (config, error) {
+	parts := strings.Split(value, ";")
+	cfg := config{chip: defaultChip}
+	for _, s := range strings.Split(parts[0], ",") {
+		pin, err := strconv.ParseUint(strings.TrimSpace(s), 10, 32)
+		if err != nil {
+			return config{}, fmt.Errorf("invalid gpio pin %q in %q", s, value)
+		}
+		cfg.pins = append(cfg.pins, uint32(pin))
+	}
+
+	for _, opt := range parts[1:] {
+		key, arg := opt, ""
+		if i := strings.IndexByte(opt, '='); i >= 0 {
+			key, arg = opt[:i], opt[i+1:]
+		}
+		switch key {
+		case "chip":
+			if arg == "" {
+				return config{}, fmt.Errorf("no gpio chip in %q", value)
+			}
+			cfg.chip = arg
+		case "pull":
+			if arg != "up" && arg != "down" {
+				return config{}, fmt.Errorf("invalid gpio pull %q, expected up or down", arg)
+			}
+			cfg.pull = arg
+		case "active-low":
+			cfg.activeLow = true
+		case "encoder":
+			cfg.mode = modeEncoder
+		case "out":
+			cfg.mode = modeOutput
+			cfg.output = true
+			if arg != "" {
+				if _, err := fmt.Sscanf(arg, "%d,%d", &cfg.x, &cfg.y); err != nil || cfg.x < 0 || cfg.y < 0 {
+					return config{}, fmt.Errorf("invalid gpio output pixel %q, expected <x>,<y>", arg)
+				}
+			}
+		default:
+			return config{}, fmt.Errorf("unknown gpio option %q", opt)
+		}
+	}
+
+	switch cfg.mode {
+	case modeEncoder:
+		if len(cfg.pins) != 2 {
+			return config{}, fmt.Errorf("a gpio encoder requires 2 pins, got %d", len(cfg.pins))
+		}
+	case modeOutput:
+		if len(cfg.pins) != 1 {
+			return config{}, fmt.Errorf("a gpio output requires 1 pin, got %d", len(cfg.pins))
+		}
+		if cfg.pull != "" {
+			return config{}, fmt.Errorf("a gpio output can not be pulled %s", cfg.pull)
+		}
+	}
+	return cfg, nil
+}
+
+// pinInput is a mapping of the states of input pins, like those of buttons
+// and switches, to a uniform array.
+type pinInput struct {
+	uniformName string
+	lines       *lines
+
+	values  []int32
+	changed []float32
+	failed  bool
+}
+
+func newPinInput(uniformName string, l *lines) *pinInput {
+	return &pinInput{
+		uniformName: uniformName,
+		lines:       l,
+		values:      make([]int32, l.n),
+		changed:     make([]float32, l.n),
+	}
+}
+
+func (pi *pinInput) UniformSource() string {
+	return fmt.Sprintf(`
+		uniform int %[1]s[%[2]d];
+		uniform float %[1]sChanged[%[2]d];
+	`, pi.uniformName, len(pi.values))
+}
+
+// Idle implements the shadertoy.IdleResource interface. The pins are idle as
+// long as none of them changed since the previous frame.
+func (pi *pinInput) Idle(renderer.RenderState) bool {
+	values, err := pi.lines.values()
+	if err != nil {
+		return true
+	}
+	for i, v := range values {
+		if v != (pi.values[i] == 1) {
+			return false
+		}
+	}
+	return true
+}
+
+func (pi *pinInput) PreRender(state renderer.RenderState) {
+	values, err := pi.lines.values()
+	if err != nil {
+		if !pi.failed {
+			log.Printf("Could not read gpio pins of %s: %v", pi.uniformName, err)
+			pi.failed = true
+		}
+	} else {
+		pi.failed = false
+		for i, v := range values {
+			var n int32
+			if v {
+				n = 1
+			}
+			if n != pi.values[i] {
+				pi.values[i] = n
+				pi.changed[i] = float32(state.Time.Seconds())
+			}
+		}
+	}
+
+	if loc, ok := state.Uniforms[pi.uniformName+"[0]"]; ok {
+		gl.Uniform1iv(loc.Location, int32(len(pi.values)), &pi.values[0])
+	}
+	if loc, ok := state.Uniforms[pi.uniformName+"Changed[0]"]; ok {
+		gl.Uniform1fv(loc.Location, int32(len(pi.changed)), &pi.changed[0])
+	}
+}
+
+func (pi *pinInput) Close() error {
+	return pi.lines.Close()
+}
+
+// encoderTransitions maps the previous and current state of the two pins of a
+// quadrature encoder, as prev<<2|cur, to a step. Invalid transitions, where
+// both pins changed, are ignored.
+var encoderTransitions = [16]int8{0, -1, 1, 0, 1, 0, 0, -1, -1, 0, 0, 1, 0, 1, -1, 0}
+
+// encoder decodes the steps of a rotary encoder.
+type encoder struct {
+	state uint8
+	steps int32
+}
+
+func (e *encoder) update(a, b bool) {
+	var cur uint8
+	if a {
+		cur |= 2
+	}
+	if b {
+		cur |= 1
+	}
+	e.steps += int32(encoderTransitions[e.state<<2|cur])
+	e.state = cur
+}
+
+// encoderInput is a mapping of the position of a rotary encoder to a uniform.
+type encoderInput struct {
+	uniformName string
+	lines       *lines
+	loopClosed  chan struct{}
+	stop        chan struct{}
+
+	lock    sync.Mutex
+	encoder encoder
+	last    int32
+}
+
+func newEncoderInput(uniformName string, l *lines) *encoderInput {
+	ei := &encoderInput{
+		uniformName: uniformName,
+		lines:       l,
+		loopClosed:  make(chan struct{}),
+		stop:        make(chan struct{}),
+	}
+	if values, err := l.values(); err == nil {
+		ei.encoder.update(values[0], values[1])
+		ei.encoder.steps = 0
+	}
+
+	go func() {
+		defer close(ei.loopClosed)
+		ticker := time.NewTicker(encoderPollInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+			case <-ei.stop:
+				return
+			}
+			values, err := l.values()
+			if err != nil {
+				log.Printf("Could not read gpio encoder %s: %v", uniformName, err)
+				return
+			}
+			ei.lock.Lock()
+			ei.encoder.update(values[0], values[1])
+			ei.lock.Unlock()
+		}
+	}()
+	return ei
+}
+
+func (ei *encoderInput) UniformSource() string {
+	return fmt.Sprintf("uniform int %s;", ei.uniformName)
+}
+
+func (ei *encoderInput) steps() int32 {
+	ei.lock.Lock()
+	defer ei.lock.Unlock()
+	return ei.encoder.steps
+}
+
+// Idle implements the shadertoy.IdleResource interface. The encoder is idle
+// as long as it was not turned since the previous frame.
+func (ei *encoderInput) Idle(renderer.RenderState) bool {
+	return ei.steps() == ei.last
+}
+
+func (ei *encoderInput) PreRender(state renderer.RenderState) {
+	ei.last = ei.steps()
+	if loc, ok := state.Uniforms[ei.uniformName]; ok {
+		gl.Uniform1i(loc.Location, ei.last)
+	}
+}
+
+func (ei *encoderInput) Close() error {
+	close(ei.stop)
+	<-ei.loopClosed
+	return ei.lines.Close()
+}
+
+// pinOutput drives an output pin, like that of a relay, from a pixel of the
+// previous frame. The pin is high while the red channel of the pixel is above
+// one half.
+type pinOutput struct {
+	uniformName string
+	lines       *lines
+	x, y        int
+
+	fbo    uint32
+	value  bool
+	set    bool
+	failed bool
+}
+
+func newPinOutput(uniformName string, l *lines, x, y int) *pinOutput {
+	po := &pinOutput{
+		uniformName: uniformName,
+		lines:       l,
+		x:           x,
+		y:           y,
+	}
+	gl.GenFramebuffers(1, &po.fbo)
+	return po
+}
+
+func (po *pinOutput) UniformSource() string {
+	return fmt.Sprintf("uniform ivec2 %s;", po.uniformName)
+}
+
+// readPixel returns the color of the output pixel in the previous frame.
+func (po *pinOutput) readPixel(state renderer.RenderState) ([4]float32, bool) {
+	var pixel [4]float32
+	if state.PreviousFrameTexID == nil || uint(po.x) >= state.CanvasWidth || uint(po.y) >= state.CanvasHeight {
+		return pixel, false
+	}
+	tex := state.PreviousFrameTexID()
+	if tex == 0 {
+		return pixel, false
+	}
+	var prevFBO int32
+	gl.GetIntegerv(gl.READ_FRAMEBUFFER_BINDING, &prevFBO)
+	gl.BindFramebuffer(gl.READ_FRAMEBUFFER, po.fbo)
+	gl.FramebufferTexture2D(gl.READ_FRAMEBUFFER, gl.COLOR_ATTACHMENT0, gl.TEXTURE_2D, tex, 0)
+	gl.ReadPixels(int32(po.x), int32(po.y), 1, 1, gl.RGBA, gl.FLOAT, gl.Ptr(&pixel[0]))
+	gl.BindFramebuffer(gl.READ_FRAMEBUFFER, uint32(prevFBO))
+	return pixel, true
+}
+
+func (po *pinOutput) PreRender(state renderer.RenderState) {
+	if loc, ok := state.Uniforms[po.uniformName]; ok {
+		gl.Uniform2i(loc.Location, int32(po.x), int32(po.y))
+	}
+	pixel, ok := po.readPixel(state)
+	if !ok {
+		return
+	}
+	value := pixel[0] > 0.5
+	if po.set && value == po.value {
+		return
+	}
+	if err := po.lines.set([]bool{value}); err != nil {
+		if !po.failed {
+			log.Printf("Could not set gpio pin of %s: %v", po.uniformName, err)
+			po.failed = true
+		}
+		return
+	}
+	po.value, po.set, po.failed = value, true, false
+}
+
+func (po *pinOutput) Close() error {
+	gl.DeleteFramebuffers(1, &po.fbo)
+	return po.lines.Close()
+}
@@ -0,0 +1,74 @@
+package gpio
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseValue(t *testing.T) {
+	valid := map[string]config{
+		"17": {chip: defaultChip, pins: []uint32{17}},
+		"17,27, 22;pull=up;active-low": {
+			lineOptions: lineOptions{activeLow: true, pull: "up"},
+			chip:        defaultChip,
+			pins:        []uint32{17, 27, 22},
+		},
+		"5,6;encoder;chip=/dev/gpiochip4": {chip: "/dev/gpiochip4", pins: []uint32{5, 6}, mode: modeEncoder},
+		"18;out":                          {lineOptions: lineOptions{output: true}, chip: defaultChip, pins: []uint32{18}, mode: modeOutput},
+		"18;out=3,4":                      {lineOptions: lineOptions{output: true}, chip: defaultChip, pins: []uint32{18}, mode: modeOutput, x: 3, y: 4},
+	}
+	for value, expected := range valid {
+		cfg, err := parseValue(value)
+		if err != nil {
+			t.Errorf("%q: unexpected error: %v", value, err)
+			continue
+		}
+		if !reflect.DeepEqual(cfg, expected) {
+			t.Errorf("%q: got %+v, expected %+v", value, cfg, expected)
+		}
+	}
+
+	for _, value := range []string{
+		"",
+		"a",
+		"17;pull=sideways",
+		"17;chip=",
+		"17;blink",
+		"5;encoder",
+		"5,6,7;encoder",
+		"18,19;out",
+		"18;out;pull=up",
+		"18;out=3",
+		"18;out=-1,2",
+	} {
+		if _, err := parseValue(value); err == nil {
+			t.Errorf("%q: expected an error", value)
+		}
+	}
+}
+
+func TestEncoder(t *testing.T) {
+	var e encoder
+	// One detent clockwise is the gray code sequence 00, 10, 11, 01, 00.
+	for _, ab := range [][2]bool{{true, false}, {true, true}, {false, true}, {false, false}} {
+		e.update(ab[0], ab[1])
+	}
+	if e.steps != 4 {
+		t.Fatalf("got %d steps clockwise, expected 4", e.steps)
+	}
+	for _, ab := range [][2]bool{{false, true}, {true, true}, {true, false}, {false, false}} {
+		e.update(ab[0], ab[1])
+	}
+	if e.steps != 0 {
+		t.Fatalf("got %d steps after turning back, expected 0", e.steps)
+	}
+
+	// Bouncing between two states cancels out and skipping a state is
+	// ignored.
+	e.update(true, false)
+	e.update(false, false)
+	e.update(true, true)
+	if e.steps != 0 {
+		t.Fatalf("got %d steps after bouncing, expected 0", e.steps)
+	}
+}
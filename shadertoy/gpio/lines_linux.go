@@ -0,0 +1,120 @@
+package gpio
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+// Structures and requests of the GPIO character device ABI, see linux/gpio.h.
+const (
+	gpioHandlesMax = 64
+
+	gpioHandleRequestInput        = 1 << 0
+	gpioHandleRequestOutput       = 1 << 1
+	gpioHandleRequestActiveLow    = 1 << 2
+	gpioHandleRequestBiasPullUp   = 1 << 5
+	gpioHandleRequestBiasPullDown = 1 << 6
+)
+
+type gpioHandleRequest struct {
+	LineOffsets   [gpioHandlesMax]uint32
+	Flags         uint32
+	DefaultValues [gpioHandlesMax]uint8
+	ConsumerLabel [32]byte
+	Lines         uint32
+	FD            int32
+}
+
+type gpioHandleData struct {
+	Values [gpioHandlesMax]uint8
+}
+
+// iowr returns the request of an ioctl that reads and writes a structure.
+func iowr(nr, size uintptr) uintptr {
+	const iocReadWrite = 3
+	return iocReadWrite<<30 | size<<16 | 0xb4<<8 | nr
+}
+
+var (
+	gpioGetLineHandleIoctl       = iowr(0x03, unsafe.Sizeof(gpioHandleRequest{}))
+	gpioHandleGetLineValuesIoctl = iowr(0x08, unsafe.Sizeof(gpioHandleData{}))
+	gpioHandleSetLineValuesIoctl = iowr(0x09, unsafe.Sizeof(gpioHandleData{}))
+)
+
+func ioctl(fd, req uintptr, arg unsafe.Pointer) error {
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, fd, req, uintptr(arg)); errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+// lines is a set of GPIO lines of a chip that have been requested as inputs
+// or outputs.
+type lines struct {
+	fd int
+	n  int
+}
+
+func requestLines(chip string, offsets []uint32, opts lineOptions) (*lines, error) {
+	if len(offsets) > gpioHandlesMax {
+		return nil, fmt.Errorf("at most %d pins can be requested", gpioHandlesMax)
+	}
+	f, err := os.Open(chip)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var req gpioHandleRequest
+	copy(req.LineOffsets[:], offsets)
+	req.Lines = uint32(len(offsets))
+	copy(req.ConsumerLabel[:], "shady")
+	if opts.output {
+		req.Flags |= gpioHandleRequestOutput
+	} else {
+		req.Flags |= gpioHandleRequestInput
+	}
+	if opts.activeLow {
+		req.Flags |= gpioHandleRequestActiveLow
+	}
+	switch opts.pull {
+	case "up":
+		req.Flags |= gpioHandleRequestBiasPullUp
+	case "down":
+		req.Flags |= gpioHandleRequestBiasPullDown
+	}
+	if err := ioctl(f.Fd(), gpioGetLineHandleIoctl, unsafe.Pointer(&req)); err != nil {
+		return nil, fmt.Errorf("could not request pins %v of %s: %w", offsets, chip, err)
+	}
+	return &lines{fd: int(req.FD), n: len(offsets)}, nil
+}
+
+// values returns the values of the lines in the order they were requested.
+func (l *lines) values() ([]bool, error) {
+	var data gpioHandleData
+	if err := ioctl(uintptr(l.fd), gpioHandleGetLineValuesIoctl, unsafe.Pointer(&data)); err != nil {
+		return nil, err
+	}
+	values := make([]bool, l.n)
+	for i := range values {
+		values[i] = data.Values[i] != 0
+	}
+	return values, nil
+}
+
+// set sets the values of output lines.
+func (l *lines) set(values []bool) error {
+	var data gpioHandleData
+	for i, v := range values {
+		if v {
+			data.Values[i] = 1
+		}
+	}
+	return ioctl(uintptr(l.fd), gpioHandleSetLineValuesIoctl, unsafe.Pointer(&data))
+}
+
+func (l *lines) Close() error {
+	return syscall.Close(l.fd)
+}
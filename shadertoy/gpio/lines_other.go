@@ -0,0 +1,28 @@
+//go:build !linux
+
+package gpio
+
+import (
+	"fmt"
+)
+
+// lines is a stub for platforms without the GPIO character device.
+type lines struct {
+	n int
+}
+
+func requestLines(chip string, offsets []uint32, opts lineOptions) (*lines, error) {
+	return nil, fmt.Errorf("GPIO is only supported on Linux")
+}
+
+func (l *lines) values() ([]bool, error) {
+	return nil, fmt.Errorf("GPIO is only supported on Linux")
+}
+
+func (l *lines) set(values []bool) error {
+	return fmt.Errorf("GPIO is only supported on Linux")
+}
+
+func (l *lines) Close() error {
+	return nil
+}
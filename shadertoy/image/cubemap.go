@@ -0,0 +1,170 @@
+package image
+
+import (
+	"fmt"
+	"image"
+	"image/draw"
+	"os"
+	"strings"
+
+	"github.com/go-gl/gl/v3.3-core/gl"
+
+	"github.com/polyfloyd/shady/renderer"
+	"github.com/polyfloyd/shady/shadertoy"
+)
+
+// cubemapFaces are the names of the faces of a cubemap in the order of the
+// cubemap targets of OpenGL, starting at TEXTURE_CUBE_MAP_POSITIVE_X.
+var cubemapFaces = [6]string{"px", "nx", "py", "ny", "pz", "nz"}
+
+func init() {
+	shadertoy.RegisterResourceType("cubemap", func(m shadertoy.Mapping, genTexID shadertoy.GenTexFunc, _ renderer.RenderState) (shadertoy.Resource, error) {
+		match := imageValueRe.FindStringSubmatch(m.Value)
+		files, err := cubemapFiles(match[1])
+		if err != nil {
+			return nil, err
+		}
+		var faces [6]image.Image
+		for i, file := range files {
+			path, err := shadertoy.ResolvePath(m.PWD, file)
+			if err != nil {
+				return nil, err
+			}
+			if faces[i], err = decodeImage(path); err != nil {
+				return nil, err
+			}
+			if b, first := faces[i].Bounds(), faces[0].Bounds(); b.Dx() != b.Dy() || b.Size() != first.Size() {
+				return nil, fmt.Errorf("%s is %dx%d, but the faces of a cubemap must be squares of the same size", path, b.Dx(), b.Dy())
+			}
+		}
+		size := faces[0].Bounds().Dx()
+		if err := renderer.CheckTextureSize(files[0], size, size); err != nil {
+			return nil, err
+		}
+		bytesPerPixel := int64(4)
+		if colorSpace(match[2]) == linear {
+			bytesPerPixel = 8
+		}
+		mem, err := renderer.ReserveMemory(m.Value, 6*int64(size)*int64(size)*bytesPerPixel)
+		if err != nil {
+			return nil, err
+		}
+		tex := newCubemapTexture(faces, colorSpace(match[2]), m.Name, genTexID())
+		tex.memory = mem
+		return tex, nil
+	})
+}
+
+// cubemapFiles returns the files of the faces of a cubemap mapping, which are
+// either six comma separated files in the order px, nx, py, ny, pz, nz, or a
+// single file name in which a * is replaced by the names of the faces.
+func cubemapFiles(value string) ([]string, error) {
+	if files := strings.Split(value, ","); len(files) == 6 {
+		return files, nil
+	}
+	if strings.Count(value, "*") != 1 || strings.Contains(value, ",") {
+		return nil, fmt.Errorf("invalid cubemap %q, expected six images as px,nx,py,ny,pz,nz or a name like sky_*.png", value)
+	}
+	files := make([]string, len(cubemapFaces))
+	for i, face := range cubemapFaces {
+		files[i] = strings.Replace(value, "*", face, 1)
+	}
+	return files, nil
+}
+
+func decodeImage(path string) (image.Image, error) {
+	fd, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer fd.Close()
+	img, _, err := image.Decode(fd)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return img, nil
+}
+
+// cubemapTexture is a mapping of six images to a samplerCube.
+type cubemapTexture struct {
+	uniformName string
+	id          uint32
+	index       uint32
+	size        int
+
+	memory *renderer.MemoryReservation
+}
+
+func newCubemapTexture(faces [6]image.Image, cs colorSpace, uniformName string, texID uint32) *cubemapTexture {
+	tex := &cubemapTexture{
+		uniformName: uniformName,
+		index:       texID,
+		size:        faces[0].Bounds().Dx(),
+	}
+	gl.GenTextures(1, &tex.id)
+	gl.BindTexture(gl.TEXTURE_CUBE_MAP, tex.id)
+	gl.PixelStorei(gl.UNPACK_ALIGNMENT, 1)
+	for i, img := range faces {
+		target := uint32(gl.TEXTURE_CUBE_MAP_POSITIVE_X + i)
+		size := int32(tex.size)
+		if cs == linear {
+			gl.TexImage2D(target, 0, gl.RGBA16, size, size, 0, gl.RGBA, gl.UNSIGNED_SHORT, gl.Ptr(linearPixels(img)))
+			continue
+		}
+		rgbaImg, ok := img.(*image.RGBA)
+		if !ok || rgbaImg.Stride != 4*tex.size {
+			rgbaImg = image.NewRGBA(img.Bounds())
+			draw.Draw(rgbaImg, img.Bounds(), img, img.Bounds().Min, draw.Src)
+		}
+		internalFormat := int32(gl.RGBA)
+		if cs == sRGB {
+			internalFormat = gl.SRGB8_ALPHA8
+		}
+		gl.TexImage2D(target, 0, internalFormat, size, size, 0, gl.RGBA, gl.UNSIGNED_BYTE, gl.Ptr(rgbaImg.Pix))
+	}
+	gl.PixelStorei(gl.UNPACK_ALIGNMENT, 4)
+	// Environment maps are sampled in between texels and across the edges
+	// of the faces.
+	gl.Enable(gl.TEXTURE_CUBE_MAP_SEAMLESS)
+	gl.TexParameteri(gl.TEXTURE_CUBE_MAP, gl.TEXTURE_WRAP_S, gl.CLAMP_TO_EDGE)
+	gl.TexParameteri(gl.TEXTURE_CUBE_MAP, gl.TEXTURE_WRAP_T, gl.CLAMP_TO_EDGE)
+	gl.TexParameteri(gl.TEXTURE_CUBE_MAP, gl.TEXTURE_WRAP_R, gl.CLAMP_TO_EDGE)
+	gl.TexParameteri(gl.TEXTURE_CUBE_MAP, gl.TEXTURE_MAG_FILTER, gl.LINEAR)
+	gl.TexParameteri(gl.TEXTURE_CUBE_MAP, gl.TEXTURE_MIN_FILTER, gl.LINEAR)
+	gl.BindTexture(gl.TEXTURE_CUBE_MAP, 0)
+	return tex
+}
+
+func (tex *cubemapTexture) UniformSource() string {
+	return fmt.Sprintf(`
+		uniform samplerCube %s;
+		uniform vec3 %sSize;
+	`, tex.uniformName, tex.uniformName)
+}
+
+func (tex *cubemapTexture) PreRender(state renderer.RenderState) {
+	if loc, ok := state.Uniforms[tex.uniformName]; ok {
+		gl.ActiveTexture(gl.TEXTURE0 + tex.index)
+		gl.BindTexture(gl.TEXTURE_CUBE_MAP, tex.id)
+		gl.Uniform1i(loc.Location, int32(tex.index))
+	}
+	size := float32(tex.size)
+	if m := shadertoy.IchannelNumRe.FindStringSubmatch(tex.uniformName); m != nil {
+		if loc, ok := state.Uniforms[fmt.Sprintf("iChannelResolution[%s]", m[1])]; ok {
+			gl.Uniform3f(loc.Location, size, size, 1.0)
+		}
+	}
+	if loc, ok := state.Uniforms[fmt.Sprintf("%sSize", tex.uniformName)]; ok {
+		gl.Uniform3f(loc.Location, size, size, 1.0)
+	}
+}
+
+// Idle implements the shadertoy.IdleResource interface, cubemaps do not
+// change.
+func (tex *cubemapTexture) Idle(renderer.RenderState) bool { return true }
+
+func (tex *cubemapTexture) Close() error {
+	gl.DeleteTextures(1, &tex.id)
+	tex.memory.Release()
+	return nil
+}
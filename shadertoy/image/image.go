@@ -3,9 +3,11 @@ package image
 import (
 	"fmt"
 	"image"
+	"image/color"
 	"image/draw"
 	"math/rand"
 	"os"
+	"regexp"
 
 	"github.com/go-gl/gl/v3.3-core/gl"
 
@@ -14,7 +16,7 @@ import (
 )
 
 func init() {
-	shadertoy.RegisterResourceType("builtin", func(m shadertoy.Mapping, genTexID shadertoy.GenTexFunc, _ renderer.RenderState) (shadertoy.Resource, error) {
+	shadertoy.RegisterResourceType("builtin", func(m shadertoy.Mapping, genTexID shadertoy.GenTexFunc, state renderer.RenderState) (shadertoy.Resource, error) {
 		switch m.Value {
 		case "Back Buffer":
 			r := &backBufferImage{
@@ -23,20 +25,44 @@ func init() {
 			}
 			return r, nil
 		case "RGBA Noise Small": // 64x64 4channels uint8
-			r := newImageTexture(noise(image.Rect(0, 0, 64, 64)), m.Name, genTexID())
+			r := newImageTexture(noise(image.Rect(0, 0, 64, 64), state.Seed), m.Name, genTexID(), gl.RGBA)
 			return r, nil
 		case "RGBA Noise Medium": // 256x256 4channels uint8
-			r := newImageTexture(noise(image.Rect(0, 0, 256, 256)), m.Name, genTexID())
+			r := newImageTexture(noise(image.Rect(0, 0, 256, 256), state.Seed), m.Name, genTexID(), gl.RGBA)
+			return r, nil
+		case "RNG State": // canvas sized 4channels uint32
+			location, err := m.GenOutput()
+			if err != nil {
+				return nil, err
+			}
+			r := newRNGStateTexture(m.Name, genTexID(), location, state)
+			return r, nil
+		case "Keyboard": // 256x3 1channel uint8
+			r := newKeyboardTexture(m.Name, genTexID())
 			return r, nil
 		default:
 			return nil, fmt.Errorf("unknown builtin mapping %q", m.Value)
 		}
 	})
 	shadertoy.RegisterResourceType("image", func(m shadertoy.Mapping, genTexID shadertoy.GenTexFunc, _ renderer.RenderState) (shadertoy.Resource, error) {
-		path, err := shadertoy.ResolvePath(m.PWD, m.Value)
+		match := imageValueRe.FindStringSubmatch(m.Value)
+		path, err := shadertoy.ResolvePath(m.PWD, match[1])
+		if err != nil {
+			return nil, err
+		}
+		info, err := os.Stat(path)
 		if err != nil {
 			return nil, err
 		}
+		// Textures of images that were used by a previous shader are
+		// reused if the file did not change.
+		key := fmt.Sprintf("image:%s;%s;%d;%d", path, match[2], info.Size(), info.ModTime().UnixNano())
+		if cached, ok := renderer.TakeCachedAsset(key); ok {
+			tex := *cached.(*imageTexture)
+			tex.uniformName, tex.index = m.Name, genTexID()
+			return &tex, nil
+		}
+
 		fd, err := os.Open(path)
 		if err != nil {
 			return nil, err
@@ -46,20 +72,64 @@ func init() {
 		if err != nil {
 			return nil, err
 		}
-		r := newImageTexture(img, m.Name, genTexID())
-		return r, nil
+		if err := renderer.CheckTextureSize(path, img.Bounds().Dx(), img.Bounds().Dy()); err != nil {
+			return nil, err
+		}
+		bytesPerPixel := int64(4)
+		if colorSpace(match[2]) == linear {
+			bytesPerPixel = 8
+		}
+		mem, err := renderer.ReserveMemory(path, int64(img.Bounds().Dx())*int64(img.Bounds().Dy())*bytesPerPixel)
+		if err != nil {
+			return nil, err
+		}
+		var tex *imageTexture
+		if colorSpace(match[2]) == linear {
+			tex = newLinearImageTexture(img, m.Name, genTexID())
+		} else {
+			internalFormat := int32(gl.RGBA)
+			if colorSpace(match[2]) == sRGB {
+				internalFormat = gl.SRGB8_ALPHA8
+			}
+			tex = newImageTexture(img, m.Name, genTexID(), internalFormat)
+		}
+		tex.key, tex.memory = key, mem
+		return tex, nil
 	})
 }
 
+// imageValueRe matches the value of image mappings, which may be followed by
+// the color space of the image.
+var imageValueRe = regexp.MustCompile(`^(.+?)(?:;(srgb|linear))?$`)
+
+// colorSpace controls how the values of an image are interpreted when sampled.
+type colorSpace string
+
+const (
+	// raw uploads 8-bit color values as is, which matches Shadertoy with its
+	// sRGB option disabled.
+	raw colorSpace = ""
+	// sRGB images are decoded to linear values when sampled. This should be
+	// used for color textures that are used in lighting calculations.
+	sRGB colorSpace = "srgb"
+	// linear images contain data like normals or heightmaps. Values are
+	// uploaded exactly with 16-bit precision and without premultiplying alpha.
+	linear colorSpace = "linear"
+)
+
 // imageTexture is a mapping of a static image texture.
 type imageTexture struct {
 	uniformName string
 	id          uint32
 	index       uint32
 	rect        image.Rectangle
+
+	// key identifies textures of image files in the asset cache.
+	key    string
+	memory *renderer.MemoryReservation
 }
 
-func newImageTexture(img image.Image, uniformName string, texID uint32) *imageTexture {
+func newImageTexture(img image.Image, uniformName string, texID uint32, internalFormat int32) *imageTexture {
 	tex := &imageTexture{
 		uniformName: uniformName,
 		index:       texID,
@@ -79,7 +149,7 @@ func newImageTexture(img image.Image, uniformName string, texID uint32) *imageTe
 	gl.TexImage2D(
 		gl.TEXTURE_2D,            // target
 		0,                        // level
-		gl.RGBA,                  // internalFormat
+		internalFormat,           // internalFormat
 		int32(img.Bounds().Dx()), // width
 		int32(img.Bounds().Dy()), // height
 		0,                        // border
@@ -95,6 +165,47 @@ func newImageTexture(img image.Image, uniformName string, texID uint32) *imageTe
 	return tex
 }
 
+// newLinearImageTexture creates a texture of data stored in an image. Unlike
+// newImageTexture, the values are not premultiplied with alpha and 16-bit
+// images keep their precision.
+func newLinearImageTexture(img image.Image, uniformName string, texID uint32) *imageTexture {
+	tex := &imageTexture{
+		uniformName: uniformName,
+		index:       texID,
+		rect:        img.Bounds(),
+	}
+	gl.GenTextures(1, &tex.id)
+	gl.BindTexture(gl.TEXTURE_2D, tex.id)
+	gl.PixelStorei(gl.UNPACK_ALIGNMENT, 1)
+	if nrgba, ok := img.(*image.NRGBA); ok && nrgba.Stride == 4*nrgba.Rect.Dx() {
+		gl.TexImage2D(gl.TEXTURE_2D, 0, gl.RGBA8, int32(tex.rect.Dx()), int32(tex.rect.Dy()), 0, gl.RGBA, gl.UNSIGNED_BYTE, gl.Ptr(nrgba.Pix))
+	} else {
+		pix := linearPixels(img)
+		gl.TexImage2D(gl.TEXTURE_2D, 0, gl.RGBA16, int32(tex.rect.Dx()), int32(tex.rect.Dy()), 0, gl.RGBA, gl.UNSIGNED_SHORT, gl.Ptr(pix))
+	}
+	gl.PixelStorei(gl.UNPACK_ALIGNMENT, 4)
+	gl.TexParameteri(gl.TEXTURE_2D, gl.TEXTURE_WRAP_S, gl.REPEAT)
+	gl.TexParameteri(gl.TEXTURE_2D, gl.TEXTURE_WRAP_T, gl.REPEAT)
+	gl.TexParameteri(gl.TEXTURE_2D, gl.TEXTURE_MAG_FILTER, gl.NEAREST)
+	gl.TexParameteri(gl.TEXTURE_2D, gl.TEXTURE_MIN_FILTER, gl.NEAREST)
+	gl.BindTexture(gl.TEXTURE_2D, 0)
+	return tex
+}
+
+// linearPixels converts an image to non-premultiplied 16-bit RGBA values in
+// native byte order.
+func linearPixels(img image.Image) []uint16 {
+	b := img.Bounds()
+	pix := make([]uint16, 0, b.Dx()*b.Dy()*4)
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			c := color.NRGBA64Model.Convert(img.At(x, y)).(color.NRGBA64)
+			pix = append(pix, c.R, c.G, c.B, c.A)
+		}
+	}
+	return pix
+}
+
 func (tex *imageTexture) UniformSource() string {
 	return fmt.Sprintf(`
 		uniform sampler2D %s;
@@ -118,14 +229,26 @@ func (tex *imageTexture) PreRender(state renderer.RenderState) {
 	}
 }
 
+// Idle implements the shadertoy.IdleResource interface, images do not change.
+func (tex *imageTexture) Idle(renderer.RenderState) bool { return true }
+
 func (tex *imageTexture) Close() error {
-	gl.DeleteTextures(1, &tex.id)
+	if tex.key != "" {
+		renderer.CacheAsset(tex.key, tex, tex.free)
+		return nil
+	}
+	tex.free()
 	return nil
 }
 
-func noise(rect image.Rectangle) image.Image {
+func (tex *imageTexture) free() {
+	gl.DeleteTextures(1, &tex.id)
+	tex.memory.Release()
+}
+
+func noise(rect image.Rectangle, seed int64) image.Image {
 	img := image.NewRGBA(rect)
-	rng := rand.New(rand.NewSource(1337))
+	rng := rand.New(rand.NewSource(1337 + seed))
 	rng.Read(img.Pix)
 	return img
 }
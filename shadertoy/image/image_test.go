@@ -0,0 +1,313 @@
+package image
+
+import (
+	"image"
+	"image/color"
+	"os"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-gl/gl/v3.3-core/gl"
+
+	"github.com/polyfloyd/shady/egl"
+	"github.com/polyfloyd/shady/renderer"
+)
+
+func TestImageValueRe(t *testing.T) {
+	cases := map[string][2]string{
+		"foo.png":                {"foo.png", ""},
+		"foo.png;srgb":           {"foo.png", "srgb"},
+		"dir/normals.png;linear": {"dir/normals.png", "linear"},
+		"foo;bar.png":            {"foo;bar.png", ""},
+	}
+	for input, expected := range cases {
+		m := imageValueRe.FindStringSubmatch(input)
+		if m == nil {
+			t.Errorf("no match for %q", input)
+			continue
+		}
+		if m[1] != expected[0] || m[2] != expected[1] {
+			t.Errorf("unexpected match for %q: (%q, %q), expected (%q, %q)", input, m[1], m[2], expected[0], expected[1])
+		}
+	}
+}
+
+func TestLinearPixels(t *testing.T) {
+	img := image.NewNRGBA64(image.Rect(0, 0, 2, 1))
+	img.Set(0, 0, color.NRGBA64{R: 0x1234, G: 0xffff, B: 0, A: 0})
+	img.Set(1, 0, color.NRGBA64{R: 1, G: 2, B: 3, A: 0x8000})
+	pix := linearPixels(img)
+	expected := []uint16{0x1234, 0xffff, 0, 0, 1, 2, 3, 0x8000}
+	if len(pix) != len(expected) {
+		t.Fatalf("unexpected number of values: %d", len(pix))
+	}
+	for i := range expected {
+		if pix[i] != expected[i] {
+			t.Errorf("value %d: got %#x, expected %#x", i, pix[i], expected[i])
+		}
+	}
+}
+
+func TestCubemapFiles(t *testing.T) {
+	expected := []string{"sky_px.png", "sky_nx.png", "sky_py.png", "sky_ny.png", "sky_pz.png", "sky_nz.png"}
+	for _, value := range []string{"sky_*.png", strings.Join(expected, ",")} {
+		files, err := cubemapFiles(value)
+		if err != nil {
+			t.Fatalf("%q: %v", value, err)
+		}
+		if strings.Join(files, ",") != strings.Join(expected, ",") {
+			t.Errorf("%q: unexpected files %v", value, files)
+		}
+	}
+	for _, value := range []string{"sky.png", "a.png,b.png", "*_*.png"} {
+		if _, err := cubemapFiles(value); err == nil {
+			t.Errorf("%q: expected an error", value)
+		}
+	}
+}
+
+func TestParseVolume(t *testing.T) {
+	header := []byte("BIN\x00")
+	for _, n := range []uint32{2, 2, 2} {
+		header = append(header, byte(n), 0, 0, 0)
+	}
+	header = append(header, 1, 0, 0, 0)
+	data := append(header, 0, 1, 2, 3, 4, 5, 6, 7)
+	vol, err := parseVolume(data, [3]int{}, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if vol.width != 2 || vol.height != 2 || vol.depth != 2 || vol.channels != 1 || len(vol.pix) != 8 {
+		t.Errorf("unexpected volume %dx%dx%d with %d channels and %d bytes", vol.width, vol.height, vol.depth, vol.channels, len(vol.pix))
+	}
+	if _, err := parseVolume(data[:len(data)-1], [3]int{}, 1); err == nil {
+		t.Errorf("expected an error for a truncated volume")
+	}
+
+	vol, err = parseVolume(make([]byte, 2*1*3*2), [3]int{2, 1, 3}, 2)
+	if err != nil || vol.depth != 3 || vol.channels != 2 {
+		t.Errorf("unexpected raw volume %+v, %v", vol, err)
+	}
+	if _, err := parseVolume(make([]byte, 8), [3]int{}, 1); err == nil {
+		t.Errorf("expected an error for a raw volume without a size")
+	}
+}
+
+func TestParseVolumeValue(t *testing.T) {
+	cfg, err := parseVolumeValue("noise.raw;size=32x16x8;channels=4")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.path != "noise.raw" || cfg.size != [3]int{32, 16, 8} || cfg.channels != 4 {
+		t.Errorf("unexpected config %+v", cfg)
+	}
+	for _, value := range []string{"", "a.raw;size=32x32", "a.raw;size=0x1x1", "a.raw;channels=5", "a.raw;mipmap"} {
+		if _, err := parseVolumeValue(value); err == nil {
+			t.Errorf("%q: expected an error", value)
+		}
+	}
+}
+
+func TestStackSlices(t *testing.T) {
+	a := image.NewRGBA(image.Rect(0, 0, 2, 2))
+	b := image.NewGray(image.Rect(0, 0, 2, 2))
+	b.Set(1, 1, color.Gray{Y: 255})
+	vol, err := stackSlices([]image.Image{a, b})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if vol.depth != 2 || len(vol.pix) != 2*2*2*4 || vol.pix[len(vol.pix)-1] != 255 || vol.pix[len(vol.pix)-2] != 255 {
+		t.Errorf("unexpected volume %+v", vol)
+	}
+	if _, err := stackSlices([]image.Image{a, image.NewRGBA(image.Rect(0, 0, 1, 1))}); err == nil {
+		t.Errorf("expected an error for slices of different sizes")
+	}
+}
+
+func TestParseSequenceValue(t *testing.T) {
+	cfg, err := parseSequenceValue("frames/%04d.png@29.97fps;loop;cache=16")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := sequenceConfig{path: "frames/%04d.png", rate: 29.97, loop: true, cache: 16}
+	if cfg != expected {
+		t.Errorf("got %+v, expected %+v", cfg, expected)
+	}
+	if cfg, err := parseSequenceValue("frames;preload"); err != nil || cfg.rate != 25 || !cfg.preload || cfg.cache != defaultSequenceCache {
+		t.Errorf("unexpected defaults %+v: %v", cfg, err)
+	}
+	for _, value := range []string{"", "@25fps", "frames@0fps", "frames;cache=0", "frames;reverse"} {
+		if _, err := parseSequenceValue(value); err == nil {
+			t.Errorf("%q: expected an error", value)
+		}
+	}
+}
+
+func TestSequenceFiles(t *testing.T) {
+	dir := t.TempDir()
+	for _, name := range []string{"f9.png", "f10.png", "f0100.png", "g1.png", "notes.txt"} {
+		if err := os.WriteFile(filepath.Join(dir, name), nil, 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	tests := map[string][]string{
+		"f%d.png":   {"f9.png", "f10.png", "f0100.png"},
+		"f%04d.png": {"f9.png", "f10.png", "f0100.png"},
+		"*.png":     {"f0100.png", "f10.png", "f9.png", "g1.png"},
+		"":          {"f0100.png", "f10.png", "f9.png", "g1.png"},
+	}
+	for pattern, expected := range tests {
+		files, err := sequenceFiles(filepath.Join(dir, pattern))
+		if err != nil {
+			t.Errorf("%q: %v", pattern, err)
+			continue
+		}
+		for i := range files {
+			files[i] = filepath.Base(files[i])
+		}
+		if strings.Join(files, ",") != strings.Join(expected, ",") {
+			t.Errorf("%q: got %v, expected %v", pattern, files, expected)
+		}
+	}
+	for _, pattern := range []string{"h%d.png", "%d_%d.png", "%d/f.png"} {
+		if _, err := sequenceFiles(filepath.Join(dir, pattern)); err == nil {
+			t.Errorf("%q: expected an error", pattern)
+		}
+	}
+}
+
+func TestSequenceFrame(t *testing.T) {
+	tests := []struct {
+		t        time.Duration
+		loop     bool
+		expected int
+	}{
+		{-time.Second, false, 0},
+		{0, false, 0},
+		{190 * time.Millisecond, false, 1},
+		{time.Second, false, 9},
+		{time.Second, true, 0},
+		{1250 * time.Millisecond, true, 2},
+	}
+	for _, test := range tests {
+		if frame := sequenceFrame(test.t, 10, 10, test.loop); frame != test.expected {
+			t.Errorf("%v (loop: %v): got frame %d, expected %d", test.t, test.loop, frame, test.expected)
+		}
+	}
+}
+
+func TestFrameCache(t *testing.T) {
+	c := frameCache{size: 2}
+	c.use(1)
+	c.use(2)
+	c.use(1)
+	if evicted, ok := c.use(3); !ok || evicted != 2 {
+		t.Errorf("evicted %d (%v), expected the least recently used frame 2", evicted, ok)
+	}
+	if _, ok := c.use(3); ok {
+		t.Errorf("a cached frame evicted another")
+	}
+}
+
+// rngEnv renders the first numbers that the RNG State draws for every pixel,
+// at the sample that is set.
+type rngEnv struct {
+	tex    *rngStateTexture
+	sample int32
+}
+
+func (env *rngEnv) Sources() (map[renderer.Stage][]renderer.Source, error) {
+	return map[renderer.Stage][]renderer.Source{
+		renderer.StageVertex: {renderer.SourceBuf(`
+			#version 330
+			in vec3 vert;
+			void main() { gl_Position = vec4(vert, 1.0); }
+		`)},
+		renderer.StageFragment: {
+			renderer.SourceBuf("#version 330\nuniform int iSample;\n"),
+			renderer.SourceBuf(env.tex.UniformSource()),
+			renderer.SourceBuf(`
+				layout(location = 0) out vec4 color;
+				void main() {
+					uint state = rngInit();
+					color = vec4(rngVec3(state), rngFloat(state));
+				}
+			`),
+		},
+	}, nil
+}
+
+func (env *rngEnv) Setup(renderer.RenderState) error { return nil }
+
+func (env *rngEnv) SubEnvironments() (map[string]renderer.SubEnvironment, error) { return nil, nil }
+
+func (env *rngEnv) PreRender(state renderer.RenderState) {
+	env.tex.PreRender(state)
+	if loc, ok := state.Uniforms["iSample"]; ok {
+		gl.Uniform1i(loc.Location, env.sample)
+	}
+}
+
+func (env *rngEnv) Outputs() []uint32 {
+	_, tex := env.tex.Output()
+	return []uint32{tex}
+}
+
+func (env *rngEnv) Close() error { return env.tex.Close() }
+
+func TestRNGState(t *testing.T) {
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+	// Like the tests of the renderer, this needs an EGL display.
+	display, err := egl.GetDisplay(egl.DefaultDisplay)
+	if err != nil {
+		t.Skip()
+	}
+	surface, err := display.CreateSurface(1, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := display.BindAPI(egl.OpenGLAPI); err != nil {
+		t.Fatal(err)
+	}
+	glctx, err := display.CreateContext(surface, 3, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	glctx.MakeCurrent()
+	ctx, err := renderer.NewContext(renderer.ContextOptions{Width: 2, Height: 2, Current: true})
+	if err != nil {
+		t.Skip(err)
+	}
+	defer ctx.Close()
+	env := &rngEnv{tex: newRNGStateTexture("rng", 0, 1, renderer.RenderState{CanvasWidth: 2, CanvasHeight: 2})}
+	p, err := ctx.Compile(env)
+	if err != nil {
+		t.Fatal(err)
+	}
+	render := func(sample int32) []uint8 {
+		env.sample = sample
+		buf := image.NewRGBA(image.Rect(0, 0, 2, 2))
+		if err := p.RenderFrame(0, buf); err != nil {
+			t.Fatal(err)
+		}
+		return buf.Pix
+	}
+	first := render(0)
+	if next := render(0); reflect.DeepEqual(first, next) {
+		t.Errorf("the state did not advance across frames: %v", first)
+	}
+	// The states start over from the seeds.
+	env.tex.resize(2, 2)
+	if again := render(0); !reflect.DeepEqual(first, again) {
+		t.Errorf("the same sample draws different numbers")
+	}
+	env.tex.resize(2, 2)
+	if second := render(1); reflect.DeepEqual(first, second) {
+		t.Errorf("two samples of a frame draw the same numbers: %v", first)
+	}
+}
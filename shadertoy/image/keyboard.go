@@ -0,0 +1,80 @@
+package image
+
+import (
+	"fmt"
+
+	"github.com/go-gl/gl/v3.3-core/gl"
+
+	"github.com/polyfloyd/shady/renderer"
+	"github.com/polyfloyd/shady/shadertoy"
+)
+
+// keyboardTexture is a mapping of the state of the keyboard of the window to
+// a texture like the keyboard input of Shadertoy. The texture remains empty
+// when rendering off-screen.
+type keyboardTexture struct {
+	uniformName string
+	id          uint32
+	index       uint32
+	// keys is the state of the keyboard that is in the texture.
+	keys [3][256]byte
+}
+
+func newKeyboardTexture(uniformName string, texID uint32) *keyboardTexture {
+	tex := &keyboardTexture{
+		uniformName: uniformName,
+		index:       texID,
+	}
+	gl.GenTextures(1, &tex.id)
+	gl.BindTexture(gl.TEXTURE_2D, tex.id)
+	gl.PixelStorei(gl.UNPACK_ALIGNMENT, 1)
+	gl.TexImage2D(gl.TEXTURE_2D, 0, gl.R8, 256, 3, 0, gl.RED, gl.UNSIGNED_BYTE, gl.Ptr(&tex.keys[0][0]))
+	gl.PixelStorei(gl.UNPACK_ALIGNMENT, 4)
+	gl.TexParameteri(gl.TEXTURE_2D, gl.TEXTURE_WRAP_S, gl.CLAMP_TO_EDGE)
+	gl.TexParameteri(gl.TEXTURE_2D, gl.TEXTURE_WRAP_T, gl.CLAMP_TO_EDGE)
+	gl.TexParameteri(gl.TEXTURE_2D, gl.TEXTURE_MAG_FILTER, gl.NEAREST)
+	gl.TexParameteri(gl.TEXTURE_2D, gl.TEXTURE_MIN_FILTER, gl.NEAREST)
+	gl.BindTexture(gl.TEXTURE_2D, 0)
+	return tex
+}
+
+func (tex *keyboardTexture) UniformSource() string {
+	return fmt.Sprintf(`
+		uniform sampler2D %s;
+		uniform vec3 %sSize;
+	`, tex.uniformName, tex.uniformName)
+}
+
+func (tex *keyboardTexture) PreRender(state renderer.RenderState) {
+	if !tex.Idle(state) {
+		tex.keys = state.Input.Keys
+		gl.BindTexture(gl.TEXTURE_2D, tex.id)
+		gl.PixelStorei(gl.UNPACK_ALIGNMENT, 1)
+		gl.TexSubImage2D(gl.TEXTURE_2D, 0, 0, 0, 256, 3, gl.RED, gl.UNSIGNED_BYTE, gl.Ptr(&tex.keys[0][0]))
+		gl.PixelStorei(gl.UNPACK_ALIGNMENT, 4)
+	}
+	if loc, ok := state.Uniforms[tex.uniformName]; ok {
+		gl.ActiveTexture(gl.TEXTURE0 + tex.index)
+		gl.BindTexture(gl.TEXTURE_2D, tex.id)
+		gl.Uniform1i(loc.Location, int32(tex.index))
+	}
+	if m := shadertoy.IchannelNumRe.FindStringSubmatch(tex.uniformName); m != nil {
+		if loc, ok := state.Uniforms[fmt.Sprintf("iChannelResolution[%s]", m[1])]; ok {
+			gl.Uniform3f(loc.Location, 256, 3, 1.0)
+		}
+	}
+	if loc, ok := state.Uniforms[fmt.Sprintf("%sSize", tex.uniformName)]; ok {
+		gl.Uniform3f(loc.Location, 256, 3, 1.0)
+	}
+}
+
+// Idle implements the shadertoy.IdleResource interface. The texture is idle
+// as long as no keys are pressed or released.
+func (tex *keyboardTexture) Idle(state renderer.RenderState) bool {
+	return state.Input == nil || state.Input.Keys == tex.keys
+}
+
+func (tex *keyboardTexture) Close() error {
+	gl.DeleteTextures(1, &tex.id)
+	return nil
+}
@@ -0,0 +1,160 @@
+package image
+
+import (
+	"fmt"
+	"math/rand"
+
+	"github.com/go-gl/gl/v3.3-core/gl"
+
+	"github.com/polyfloyd/shady/renderer"
+	"github.com/polyfloyd/shady/shadertoy"
+)
+
+// rngStateTexture is a managed texture of per-pixel states of a random number
+// generator along with helper functions for drawing random numbers. The states
+// persist across frames: the shader stores the state of every pixel through
+// an output, which the next frame reads. Two textures take turns in being read
+// and written.
+type rngStateTexture struct {
+	uniformName string
+	ids         [2]uint32
+	// read is the index of the texture that is read in the current frame,
+	// the other one is written.
+	read int
+	// rendered is set once a frame was prepared with the current textures.
+	rendered bool
+	index    uint32
+	location uint32
+	seed     int64
+	w, h     uint
+}
+
+func newRNGStateTexture(uniformName string, texID, location uint32, state renderer.RenderState) *rngStateTexture {
+	tex := &rngStateTexture{
+		uniformName: uniformName,
+		index:       texID,
+		location:    location,
+		seed:        state.Seed,
+	}
+	gl.GenTextures(2, &tex.ids[0])
+	tex.resize(state.CanvasWidth, state.CanvasHeight)
+	return tex
+}
+
+// resize sets the size of the textures, which start over from random seeds.
+func (tex *rngStateTexture) resize(w, h uint) {
+	if w == 0 || h == 0 {
+		w, h = 1, 1
+	}
+	tex.w, tex.h = w, h
+	tex.read, tex.rendered = 0, false
+
+	seeds := make([]uint32, w*h*4)
+	rng := rand.New(rand.NewSource(1337 + tex.seed))
+	for i := range seeds {
+		seeds[i] = rng.Uint32()
+	}
+	// Both textures are seeded, so pixels that do not store their state
+	// still read a random one.
+	for _, id := range tex.ids {
+		gl.BindTexture(gl.TEXTURE_2D, id)
+		gl.TexImage2D(
+			gl.TEXTURE_2D,   // target
+			0,               // level
+			gl.RGBA32UI,     // internalFormat
+			int32(w),        // width
+			int32(h),        // height
+			0,               // border
+			gl.RGBA_INTEGER, // format
+			gl.UNSIGNED_INT, // type
+			gl.Ptr(seeds),   // data
+		)
+		gl.TexParameteri(gl.TEXTURE_2D, gl.TEXTURE_WRAP_S, gl.REPEAT)
+		gl.TexParameteri(gl.TEXTURE_2D, gl.TEXTURE_WRAP_T, gl.REPEAT)
+		gl.TexParameteri(gl.TEXTURE_2D, gl.TEXTURE_MAG_FILTER, gl.NEAREST)
+		gl.TexParameteri(gl.TEXTURE_2D, gl.TEXTURE_MIN_FILTER, gl.NEAREST)
+	}
+	gl.BindTexture(gl.TEXTURE_2D, 0)
+}
+
+func (tex *rngStateTexture) UniformSource() string {
+	return fmt.Sprintf(`
+		uniform usampler2D %[1]s;
+		uniform vec3 %[1]sSize;
+		layout(location = %[2]d) out uvec4 %[1]sOut;
+
+		// PCG hash, see https://www.pcg-random.org/.
+		uint %[1]sNext(inout uint state) {
+			state = state * 747796405u + 2891336453u;
+			uint word = ((state >> ((state >> 28u) + 4u)) ^ state) * 277803737u;
+			return (word >> 22u) ^ word;
+		}
+
+		// Stores the state of the pixel for the next frame, which continues
+		// where this one left off.
+		void %[1]sStore(uint state) {
+			%[1]sOut = uvec4(state, 0u, 0u, 0u);
+		}
+
+		// Loads the state of the pixel that is rendered, which was stored by
+		// the previous frame. It is stored again right away after being
+		// advanced, so the next frame draws other numbers even if the state
+		// is not stored. Samples of a frame start from the same state and
+		// are told apart by their index.
+		uint %[1]sInit() {
+			ivec2 size = max(ivec2(%[1]sSize.xy), ivec2(1));
+			uint state = texelFetch(%[1]s, ivec2(gl_FragCoord.xy) %% size, 0).x;
+			%[1]sNext(state);
+			%[1]sStore(state);
+			state ^= uint(iSample) * 0x85ebca6bu;
+			%[1]sNext(state);
+			return state;
+		}
+
+		// Returns a uniformly distributed number in the range [0, 1).
+		float %[1]sFloat(inout uint state) {
+			return float(%[1]sNext(state) >> 8u) / 16777216.0;
+		}
+
+		vec2 %[1]sVec2(inout uint state) {
+			return vec2(%[1]sFloat(state), %[1]sFloat(state));
+		}
+
+		vec3 %[1]sVec3(inout uint state) {
+			return vec3(%[1]sFloat(state), %[1]sFloat(state), %[1]sFloat(state));
+		}
+	`, tex.uniformName, tex.location)
+}
+
+// Output implements the shadertoy.OutputResource interface.
+func (tex *rngStateTexture) Output() (uint32, uint32) {
+	return tex.location, tex.ids[1-tex.read]
+}
+
+func (tex *rngStateTexture) PreRender(state renderer.RenderState) {
+	if state.CanvasWidth != tex.w || state.CanvasHeight != tex.h {
+		tex.resize(state.CanvasWidth, state.CanvasHeight)
+	} else if tex.rendered {
+		// The states that the previous frame stored are read.
+		tex.read = 1 - tex.read
+	}
+	tex.rendered = true
+	if loc, ok := state.Uniforms[tex.uniformName]; ok {
+		gl.ActiveTexture(gl.TEXTURE0 + tex.index)
+		gl.BindTexture(gl.TEXTURE_2D, tex.ids[tex.read])
+		gl.Uniform1i(loc.Location, int32(tex.index))
+	}
+	if m := shadertoy.IchannelNumRe.FindStringSubmatch(tex.uniformName); m != nil {
+		if loc, ok := state.Uniforms[fmt.Sprintf("iChannelResolution[%s]", m[1])]; ok {
+			gl.Uniform3f(loc.Location, float32(tex.w), float32(tex.h), 1.0)
+		}
+	}
+	if loc, ok := state.Uniforms[fmt.Sprintf("%sSize", tex.uniformName)]; ok {
+		gl.Uniform3f(loc.Location, float32(tex.w), float32(tex.h), 1.0)
+	}
+}
+
+func (tex *rngStateTexture) Close() error {
+	gl.DeleteTextures(2, &tex.ids[0])
+	return nil
+}
@@ -0,0 +1,337 @@
+package image
+
+import (
+	"fmt"
+	"image"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-gl/gl/v3.3-core/gl"
+
+	"github.com/polyfloyd/shady/renderer"
+	"github.com/polyfloyd/shady/shadertoy"
+)
+
+// defaultSequenceCache is the number of frames of a sequence of which the
+// texture is kept, unless set with the cache option.
+const defaultSequenceCache = 8
+
+func init() {
+	shadertoy.RegisterResourceType("imageseq", func(m shadertoy.Mapping, genTexID shadertoy.GenTexFunc, _ renderer.RenderState) (shadertoy.Resource, error) {
+		cfg, err := parseSequenceValue(m.Value)
+		if err != nil {
+			return nil, err
+		}
+		path, err := shadertoy.ResolvePath(m.PWD, cfg.path)
+		if err != nil {
+			return nil, err
+		}
+		files, err := sequenceFiles(path)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+		return newSequenceTexture(files, cfg, m.Name, genTexID())
+	})
+}
+
+var sequenceRateRe = regexp.MustCompile(`@(\d+(?:\.\d+)?)fps$`)
+
+type sequenceConfig struct {
+	path    string
+	rate    float64
+	loop    bool
+	preload bool
+	cache   int
+}
+
+// parseSequenceValue parses the value of an imageseq mapping as
+// "<files>[@<rate>fps][;loop][;preload][;cache=<n>]". The files are a
+// directory of images, a pattern like frames/*.png or a pattern with a number
+// like frames/%04d.png.
+func parseSequenceValue(value string) (sequenceConfig, error) {
+	parts := strings.Split(value, ";")
+	cfg := sequenceConfig{path: parts[0], rate: 25, cache: defaultSequenceCache}
+	if m := sequenceRateRe.FindStringSubmatch(cfg.path); m != nil {
+		cfg.path = strings.TrimSuffix(cfg.path, m[0])
+		cfg.rate, _ = strconv.ParseFloat(m[1], 64)
+		if cfg.rate <= 0 {
+			return sequenceConfig{}, fmt.Errorf("the frame rate of an image sequence must be positive")
+		}
+	}
+	if cfg.path == "" {
+		return sequenceConfig{}, fmt.Errorf("no image sequence")
+	}
+	for _, opt := range parts[1:] {
+		key, arg := opt, ""
+		if i := strings.IndexByte(opt, '='); i >= 0 {
+			key, arg = opt[:i], opt[i+1:]
+		}
+		switch key {
+		case "loop":
+			cfg.loop = true
+		case "preload":
+			cfg.preload = true
+		case "cache":
+			n, err := strconv.Atoi(arg)
+			if err != nil || n < 1 {
+				return sequenceConfig{}, fmt.Errorf("invalid image sequence option %q: expected a positive number of frames", opt)
+			}
+			cfg.cache = n
+		default:
+			return sequenceConfig{}, fmt.Errorf("unknown image sequence option %q", opt)
+		}
+	}
+	return cfg, nil
+}
+
+var sequenceVerbRe = regexp.MustCompile(`%0?(\d*)d`)
+
+// sequenceFiles returns the images of a sequence in the order they are shown.
+// Numbered files are ordered by their number, others by their name.
+func sequenceFiles(path string) ([]string, error) {
+	var files []string
+	if verbs := sequenceVerbRe.FindAllStringIndex(path, -1); len(verbs) > 0 {
+		if len(verbs) > 1 {
+			return nil, fmt.Errorf("a pattern of an image sequence can only hold one number")
+		}
+		dir, name := filepath.Split(path)
+		if strings.Contains(dir, "%") {
+			return nil, fmt.Errorf("the number of an image sequence must be in the name of the files")
+		}
+		v := sequenceVerbRe.FindStringIndex(name)
+		nameRe := regexp.MustCompile("^" + regexp.QuoteMeta(name[:v[0]]) + `(\d+)` + regexp.QuoteMeta(name[v[1]:]) + "$")
+		entries, err := os.ReadDir(filepath.Clean(dir))
+		if err != nil {
+			return nil, err
+		}
+		numbers := map[string]int{}
+		for _, e := range entries {
+			m := nameRe.FindStringSubmatch(e.Name())
+			if m == nil || e.IsDir() {
+				continue
+			}
+			numbers[e.Name()], _ = strconv.Atoi(m[1])
+			files = append(files, filepath.Join(dir, e.Name()))
+		}
+		sort.Slice(files, func(i, j int) bool {
+			return numbers[filepath.Base(files[i])] < numbers[filepath.Base(files[j])]
+		})
+	} else if info, err := os.Stat(path); err == nil && info.IsDir() {
+		entries, err := os.ReadDir(path)
+		if err != nil {
+			return nil, err
+		}
+		for _, e := range entries {
+			switch strings.ToLower(filepath.Ext(e.Name())) {
+			case ".png", ".jpg", ".jpeg", ".gif":
+				if !e.IsDir() {
+					files = append(files, filepath.Join(path, e.Name()))
+				}
+			}
+		}
+	} else {
+		var err error
+		if files, err = filepath.Glob(path); err != nil {
+			return nil, err
+		}
+		sort.Strings(files)
+	}
+	if len(files) == 0 {
+		return nil, fmt.Errorf("no images found")
+	}
+	return files, nil
+}
+
+// sequenceFrame returns the frame of a sequence of n frames that is shown at
+// the time. After the last frame, the sequence starts over if it loops and it
+// holds the last frame otherwise.
+func sequenceFrame(t time.Duration, rate float64, n int, loop bool) int {
+	if t < 0 {
+		return 0
+	}
+	i := int(t.Seconds() * rate)
+	if loop {
+		return i % n
+	}
+	if i >= n {
+		return n - 1
+	}
+	return i
+}
+
+// frameCache tracks the frames of which a texture is kept, the least recently
+// used frame is evicted first.
+type frameCache struct {
+	size int
+	// frames is ordered from least to most recently used.
+	frames []int
+}
+
+// use marks the frame as most recently used. If it was not cached and the
+// cache is full, it returns the frame that is evicted.
+func (c *frameCache) use(frame int) (evicted int, ok bool) {
+	for i, f := range c.frames {
+		if f == frame {
+			c.frames = append(append(c.frames[:i:i], c.frames[i+1:]...), frame)
+			return 0, false
+		}
+	}
+	if len(c.frames) == c.size {
+		evicted, ok = c.frames[0], true
+		c.frames = c.frames[1:]
+	}
+	c.frames = append(c.frames, frame)
+	return evicted, ok
+}
+
+// decodedFrame is a frame that is decoded ahead of the time it is shown.
+type decodedFrame struct {
+	frame int
+	img   image.Image
+	err   error
+	done  chan struct{}
+}
+
+// sequenceTexture is a mapping of a sequence of images, of which the frame
+// advances with the time. The textures of recent frames are cached and the
+// frame that follows is decoded in the background.
+type sequenceTexture struct {
+	uniformName string
+	index       uint32
+	files       []string
+	cfg         sequenceConfig
+
+	cache    frameCache
+	textures map[int]*imageTexture
+	next     *decodedFrame
+	current  int
+}
+
+func newSequenceTexture(files []string, cfg sequenceConfig, uniformName string, texID uint32) (*sequenceTexture, error) {
+	tex := &sequenceTexture{
+		uniformName: uniformName,
+		index:       texID,
+		files:       files,
+		cfg:         cfg,
+		cache:       frameCache{size: cfg.cache},
+		textures:    map[int]*imageTexture{},
+		current:     -1,
+	}
+	if cfg.preload {
+		// All frames are kept, so the sequence plays without decoding.
+		tex.cache.size = len(files)
+		for i := range files {
+			if _, err := tex.texture(i); err != nil {
+				tex.Close()
+				return nil, err
+			}
+		}
+	}
+	return tex, nil
+}
+
+// decode starts decoding the frame in the background.
+func (tex *sequenceTexture) decode(frame int) *decodedFrame {
+	df := &decodedFrame{frame: frame, done: make(chan struct{})}
+	go func() {
+		defer close(df.done)
+		df.img, df.err = decodeImage(tex.files[frame])
+	}()
+	return df
+}
+
+// texture returns the texture of the frame, which is uploaded if it is not
+// cached.
+func (tex *sequenceTexture) texture(frame int) (*imageTexture, error) {
+	if t, ok := tex.textures[frame]; ok {
+		tex.cache.use(frame)
+		return t, nil
+	}
+	df := tex.next
+	if df == nil || df.frame != frame {
+		df = tex.decode(frame)
+	}
+	tex.next = nil
+	<-df.done
+	if df.err != nil {
+		return nil, df.err
+	}
+	path := tex.files[frame]
+	b := df.img.Bounds()
+	if err := renderer.CheckTextureSize(path, b.Dx(), b.Dy()); err != nil {
+		return nil, err
+	}
+	mem, err := renderer.ReserveMemory(path, int64(b.Dx())*int64(b.Dy())*4)
+	if err != nil {
+		return nil, err
+	}
+	if evicted, ok := tex.cache.use(frame); ok {
+		tex.textures[evicted].free()
+		delete(tex.textures, evicted)
+	}
+	t := newImageTexture(df.img, tex.uniformName, tex.index, gl.RGBA)
+	t.memory = mem
+	tex.textures[frame] = t
+	return t, nil
+}
+
+func (tex *sequenceTexture) UniformSource() string {
+	return fmt.Sprintf(`
+		uniform sampler2D %[1]s;
+		uniform vec3 %[1]sSize;
+		uniform float %[1]sFrame;
+		uniform float %[1]sFrames;
+	`, tex.uniformName)
+}
+
+// Idle implements the shadertoy.IdleResource interface. The sequence is idle
+// while the same frame is shown.
+func (tex *sequenceTexture) Idle(state renderer.RenderState) bool {
+	return sequenceFrame(state.Time, tex.cfg.rate, len(tex.files), tex.cfg.loop) == tex.current
+}
+
+func (tex *sequenceTexture) PreRender(state renderer.RenderState) {
+	frame := sequenceFrame(state.Time, tex.cfg.rate, len(tex.files), tex.cfg.loop)
+	if _, ok := tex.textures[frame]; !ok && frame == tex.current {
+		// The frame could not be decoded, which is not tried again.
+		return
+	}
+	t, err := tex.texture(frame)
+	if err != nil {
+		if frame != tex.current {
+			log.Printf("Could not show frame %d of %s: %v", frame, tex.uniformName, err)
+		}
+		tex.current = frame
+		return
+	}
+	tex.current = frame
+	if next := sequenceFrame(state.Time+time.Duration(float64(time.Second)/tex.cfg.rate), tex.cfg.rate, len(tex.files), tex.cfg.loop); next != frame && tex.next == nil {
+		if _, ok := tex.textures[next]; !ok {
+			tex.next = tex.decode(next)
+		}
+	}
+
+	t.PreRender(state)
+	if loc, ok := state.Uniforms[tex.uniformName+"Frame"]; ok {
+		gl.Uniform1f(loc.Location, float32(frame))
+	}
+	if loc, ok := state.Uniforms[tex.uniformName+"Frames"]; ok {
+		gl.Uniform1f(loc.Location, float32(len(tex.files)))
+	}
+}
+
+func (tex *sequenceTexture) Close() error {
+	if tex.next != nil {
+		<-tex.next.done
+	}
+	for _, t := range tex.textures {
+		t.free()
+	}
+	return nil
+}
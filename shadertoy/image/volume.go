@@ -0,0 +1,262 @@
+package image
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"image"
+	"image/draw"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/go-gl/gl/v3.3-core/gl"
+
+	"github.com/polyfloyd/shady/renderer"
+	"github.com/polyfloyd/shady/shadertoy"
+)
+
+// volumeMagic starts the volume files of Shadertoy, which are followed by the
+// size, the number of channels, the layout and the format of the texels.
+var volumeMagic = []byte("BIN\x00")
+
+const volumeHeaderSize = 20
+
+func init() {
+	shadertoy.RegisterResourceType("volume", func(m shadertoy.Mapping, genTexID shadertoy.GenTexFunc, _ renderer.RenderState) (shadertoy.Resource, error) {
+		cfg, err := parseVolumeValue(m.Value)
+		if err != nil {
+			return nil, err
+		}
+		path, err := shadertoy.ResolvePath(m.PWD, cfg.path)
+		if err != nil {
+			return nil, err
+		}
+		var vol volume
+		if strings.Contains(cfg.path, "*") {
+			vol, err = loadVolumeSlices(path)
+		} else {
+			var data []byte
+			if data, err = os.ReadFile(path); err == nil {
+				vol, err = parseVolume(data, cfg.size, cfg.channels)
+			}
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+		if err := renderer.CheckTextureSize(path, vol.width, vol.height); err != nil {
+			return nil, err
+		}
+		mem, err := renderer.ReserveMemory(path, int64(len(vol.pix)))
+		if err != nil {
+			return nil, err
+		}
+		tex := newVolumeTexture(vol, m.Name, genTexID())
+		tex.memory = mem
+		return tex, nil
+	})
+}
+
+type volumeConfig struct {
+	path     string
+	size     [3]int
+	channels int
+}
+
+// parseVolumeValue parses the value of a volume mapping as
+// "<file>[;size=<w>x<h>x<d>][;channels=<n>]". The file is a volume of
+// Shadertoy, raw 8-bit texels of which the size must be set, or a pattern
+// like slices/*.png of which the matching images are the slices.
+func parseVolumeValue(value string) (volumeConfig, error) {
+	parts := strings.Split(value, ";")
+	cfg := volumeConfig{path: parts[0], channels: 1}
+	if cfg.path == "" {
+		return volumeConfig{}, fmt.Errorf("no volume file")
+	}
+	for _, opt := range parts[1:] {
+		key, arg := opt, ""
+		if i := strings.IndexByte(opt, '='); i >= 0 {
+			key, arg = opt[:i], opt[i+1:]
+		}
+		var err error
+		switch key {
+		case "size":
+			dims := strings.Split(arg, "x")
+			if len(dims) != 3 {
+				err = fmt.Errorf("expected <w>x<h>x<d>")
+				break
+			}
+			for i, d := range dims {
+				if cfg.size[i], err = strconv.Atoi(d); err == nil && cfg.size[i] < 1 {
+					err = fmt.Errorf("the size must be positive")
+				}
+				if err != nil {
+					break
+				}
+			}
+		case "channels":
+			if cfg.channels, err = strconv.Atoi(arg); err == nil && (cfg.channels < 1 || cfg.channels > 4) {
+				err = fmt.Errorf("expected 1 to 4 channels")
+			}
+		default:
+			return volumeConfig{}, fmt.Errorf("unknown volume option %q", opt)
+		}
+		if err != nil {
+			return volumeConfig{}, fmt.Errorf("invalid volume option %q: %w", opt, err)
+		}
+	}
+	return cfg, nil
+}
+
+// volume holds the 8-bit texels of a 3D texture, of which the slices are
+// stored one after the other.
+type volume struct {
+	width, height, depth int
+	channels             int
+	pix                  []byte
+}
+
+// parseVolume parses a volume of Shadertoy, or raw texels of the size and
+// number of channels if the data does not start with the header.
+func parseVolume(data []byte, size [3]int, channels int) (volume, error) {
+	if bytes.HasPrefix(data, volumeMagic) {
+		if len(data) < volumeHeaderSize {
+			return volume{}, fmt.Errorf("truncated volume header")
+		}
+		le := binary.LittleEndian
+		size = [3]int{int(le.Uint32(data[4:])), int(le.Uint32(data[8:])), int(le.Uint32(data[12:]))}
+		channels = int(data[16])
+		if format := le.Uint16(data[18:]); format != 0 {
+			return volume{}, fmt.Errorf("unsupported volume format %d, only 8-bit texels are supported", format)
+		}
+		if channels < 1 || channels > 4 {
+			return volume{}, fmt.Errorf("unsupported number of channels %d", channels)
+		}
+		data = data[volumeHeaderSize:]
+	} else if size[0] == 0 {
+		return volume{}, fmt.Errorf("the size of a raw volume must be set with ;size=<w>x<h>x<d>")
+	}
+	vol := volume{width: size[0], height: size[1], depth: size[2], channels: channels}
+	n := vol.width * vol.height * vol.depth * vol.channels
+	if len(data) < n {
+		return volume{}, fmt.Errorf("a volume of %dx%dx%d with %d channels is %d bytes, got %d", vol.width, vol.height, vol.depth, channels, n, len(data))
+	}
+	vol.pix = data[:n]
+	return vol, nil
+}
+
+// loadVolumeSlices stacks the images that match a pattern in the order of
+// their names.
+func loadVolumeSlices(pattern string) (volume, error) {
+	files, err := filepath.Glob(pattern)
+	if err != nil {
+		return volume{}, err
+	}
+	if len(files) == 0 {
+		return volume{}, fmt.Errorf("no slices found")
+	}
+	sort.Strings(files)
+	slices := make([]image.Image, len(files))
+	for i, file := range files {
+		if slices[i], err = decodeImage(file); err != nil {
+			return volume{}, err
+		}
+	}
+	return stackSlices(slices)
+}
+
+// stackSlices returns the RGBA texels of images of the same size.
+func stackSlices(slices []image.Image) (volume, error) {
+	b := slices[0].Bounds()
+	vol := volume{width: b.Dx(), height: b.Dy(), depth: len(slices), channels: 4}
+	vol.pix = make([]byte, 0, vol.width*vol.height*vol.depth*4)
+	for i, img := range slices {
+		if img.Bounds().Size() != b.Size() {
+			return volume{}, fmt.Errorf("slice %d is %dx%d, but the first is %dx%d", i, img.Bounds().Dx(), img.Bounds().Dy(), b.Dx(), b.Dy())
+		}
+		rgba := image.NewRGBA(image.Rect(0, 0, b.Dx(), b.Dy()))
+		draw.Draw(rgba, rgba.Bounds(), img, img.Bounds().Min, draw.Src)
+		vol.pix = append(vol.pix, rgba.Pix...)
+	}
+	return vol, nil
+}
+
+// volumeTexture is a mapping of a volume to a sampler3D.
+type volumeTexture struct {
+	uniformName          string
+	id                   uint32
+	index                uint32
+	width, height, depth int
+
+	memory *renderer.MemoryReservation
+}
+
+func newVolumeTexture(vol volume, uniformName string, texID uint32) *volumeTexture {
+	tex := &volumeTexture{
+		uniformName: uniformName,
+		index:       texID,
+		width:       vol.width,
+		height:      vol.height,
+		depth:       vol.depth,
+	}
+	formats := [...]struct {
+		internal int32
+		format   uint32
+	}{
+		{gl.R8, gl.RED},
+		{gl.RG8, gl.RG},
+		{gl.RGB8, gl.RGB},
+		{gl.RGBA8, gl.RGBA},
+	}
+	f := formats[vol.channels-1]
+	gl.GenTextures(1, &tex.id)
+	gl.BindTexture(gl.TEXTURE_3D, tex.id)
+	gl.PixelStorei(gl.UNPACK_ALIGNMENT, 1)
+	gl.TexImage3D(gl.TEXTURE_3D, 0, f.internal, int32(vol.width), int32(vol.height), int32(vol.depth), 0, f.format, gl.UNSIGNED_BYTE, gl.Ptr(vol.pix))
+	gl.PixelStorei(gl.UNPACK_ALIGNMENT, 4)
+	// Volume noise is sampled in between texels and tiles, like the volumes
+	// of Shadertoy.
+	gl.TexParameteri(gl.TEXTURE_3D, gl.TEXTURE_WRAP_S, gl.REPEAT)
+	gl.TexParameteri(gl.TEXTURE_3D, gl.TEXTURE_WRAP_T, gl.REPEAT)
+	gl.TexParameteri(gl.TEXTURE_3D, gl.TEXTURE_WRAP_R, gl.REPEAT)
+	gl.TexParameteri(gl.TEXTURE_3D, gl.TEXTURE_MAG_FILTER, gl.LINEAR)
+	gl.TexParameteri(gl.TEXTURE_3D, gl.TEXTURE_MIN_FILTER, gl.LINEAR)
+	gl.BindTexture(gl.TEXTURE_3D, 0)
+	return tex
+}
+
+func (tex *volumeTexture) UniformSource() string {
+	return fmt.Sprintf(`
+		uniform sampler3D %s;
+		uniform vec3 %sSize;
+	`, tex.uniformName, tex.uniformName)
+}
+
+func (tex *volumeTexture) PreRender(state renderer.RenderState) {
+	if loc, ok := state.Uniforms[tex.uniformName]; ok {
+		gl.ActiveTexture(gl.TEXTURE0 + tex.index)
+		gl.BindTexture(gl.TEXTURE_3D, tex.id)
+		gl.Uniform1i(loc.Location, int32(tex.index))
+	}
+	w, h, d := float32(tex.width), float32(tex.height), float32(tex.depth)
+	if m := shadertoy.IchannelNumRe.FindStringSubmatch(tex.uniformName); m != nil {
+		if loc, ok := state.Uniforms[fmt.Sprintf("iChannelResolution[%s]", m[1])]; ok {
+			gl.Uniform3f(loc.Location, w, h, d)
+		}
+	}
+	if loc, ok := state.Uniforms[fmt.Sprintf("%sSize", tex.uniformName)]; ok {
+		gl.Uniform3f(loc.Location, w, h, d)
+	}
+}
+
+// Idle implements the shadertoy.IdleResource interface, volumes do not
+// change.
+func (tex *volumeTexture) Idle(renderer.RenderState) bool { return true }
+
+func (tex *volumeTexture) Close() error {
+	gl.DeleteTextures(1, &tex.id)
+	tex.memory.Release()
+	return nil
+}
@@ -0,0 +1,398 @@
+// Package importer converts shaders from the Shadertoy API to files that can
+// be rendered by shady.
+package importer
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// BaseURL is the location of Shadertoy, which serves the API and the media of
+// shaders.
+const BaseURL = "https://www.shadertoy.com"
+
+var (
+	idRe  = regexp.MustCompile(`^\w+$`)
+	urlRe = regexp.MustCompile(`^(?:shadertoy://|https?://(?:www\.)?shadertoy\.com/(?:view|embed)/)(\w+)/?(?:[?#].*)?$`)
+)
+
+// ParseID returns the ID of a shader from a plain ID, the URL of its page on
+// Shadertoy or a shadertoy://<id> URL.
+func ParseID(s string) (string, error) {
+	if idRe.MatchString(s) {
+		return s, nil
+	}
+	if m := urlRe.FindStringSubmatch(s); m != nil {
+		return m[1], nil
+	}
+	return "", fmt.Errorf("invalid Shadertoy shader %q, expected an ID or a URL like %s/view/<id>", s, BaseURL)
+}
+
+// Shader is a shader as returned by the Shadertoy API.
+type Shader struct {
+	Info struct {
+		ID          string `json:"id"`
+		Name        string `json:"name"`
+		Username    string `json:"username"`
+		Description string `json:"description"`
+	} `json:"info"`
+	RenderPasses []RenderPass `json:"renderpass"`
+}
+
+// RenderPass is a pass of a Shader, like the image or a buffer.
+type RenderPass struct {
+	Name    string   `json:"name"`
+	Type    string   `json:"type"`
+	Code    string   `json:"code"`
+	Inputs  []Input  `json:"inputs"`
+	Outputs []Output `json:"outputs"`
+}
+
+// Input is a channel of a RenderPass.
+type Input struct {
+	ID      flexibleID `json:"id"`
+	Src     string     `json:"src"`
+	Type    string     `json:"ctype"`
+	Channel int        `json:"channel"`
+	Sampler struct {
+		Filter string `json:"filter"`
+		Wrap   string `json:"wrap"`
+		VFlip  string `json:"vflip"`
+		SRGB   string `json:"srgb"`
+	} `json:"sampler"`
+}
+
+// Output is the texture a RenderPass renders to, which is referred to by the
+// ID of the inputs of other passes.
+type Output struct {
+	ID      flexibleID `json:"id"`
+	Channel int        `json:"channel"`
+}
+
+// flexibleID is an ID that is encoded as either a JSON number or a string,
+// which differs between versions of the API.
+type flexibleID string
+
+func (id *flexibleID) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err == nil {
+		*id = flexibleID(s)
+		return nil
+	}
+	var n json.Number
+	if err := json.Unmarshal(b, &n); err != nil {
+		return err
+	}
+	*id = flexibleID(n.String())
+	return nil
+}
+
+// Fetch downloads a shader from the Shadertoy API, which requires an API key.
+// Only shaders that are published as "public + API" can be fetched.
+func Fetch(ctx context.Context, client *http.Client, id, key string) (*Shader, error) {
+	if key == "" {
+		return nil, fmt.Errorf("fetching shaders from Shadertoy requires an API key, see %s/howto", BaseURL)
+	}
+	if client == nil {
+		client = http.DefaultClient
+	}
+	u := fmt.Sprintf("%s/api/v1/shaders/%s?key=%s", BaseURL, url.PathEscape(id), url.QueryEscape(key))
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("could not fetch shader %s: %s", id, resp.Status)
+	}
+	return decodeResponse(resp.Body, id)
+}
+
+func decodeResponse(r io.Reader, id string) (*Shader, error) {
+	var body struct {
+		Shader *Shader `json:"Shader"`
+		Error  string  `json:"Error"`
+	}
+	if err := json.NewDecoder(r).Decode(&body); err != nil {
+		return nil, fmt.Errorf("could not decode shader %s: %w", id, err)
+	}
+	if body.Error != "" {
+		return nil, fmt.Errorf("could not fetch shader %s: %s", id, body.Error)
+	}
+	if body.Shader == nil {
+		return nil, fmt.Errorf("could not fetch shader %s: empty response", id)
+	}
+	return body.Shader, nil
+}
+
+// Project is a shader converted to files.
+type Project struct {
+	// Files maps the names of the source files to their contents.
+	Files map[string]string
+	// Media maps the names of the files of the inputs, like textures, to the
+	// URLs they are downloaded from.
+	Media map[string]string
+	// Image is the name of the file to render.
+	Image string
+	// Sound is the name of the file of the sound pass, which is rendered
+	// with -sound. It is empty if the shader has no sound.
+	Sound string
+	// Warnings describes the parts of the shader that could not be converted.
+	Warnings []string
+}
+
+// bufferPass is the shady name of a buffer pass of Shadertoy.
+type bufferPass struct {
+	name, file string
+}
+
+var bufferPasses = map[string]bufferPass{
+	"Buffer A": {"BufA", "bufa.glsl"},
+	"Buffer B": {"BufB", "bufb.glsl"},
+	"Buffer C": {"BufC", "bufc.glsl"},
+	"Buffer D": {"BufD", "bufd.glsl"},
+}
+
+// previzBufferRe matches the placeholder image of buffer inputs, which refers
+// to the buffer by its index.
+var previzBufferRe = regexp.MustCompile(`/buffer0(\d)\.png$`)
+
+// Convert converts a shader to the files of a project. The buffers are
+// declared as passes of the image with the buffer pragma and the inputs of
+// every pass are mapped to their channels, so the code of the passes is used
+// as is.
+func Convert(sh *Shader) (*Project, error) {
+	proj := &Project{Files: map[string]string{}, Media: map[string]string{}, Image: "image.glsl"}
+
+	var image, sound *RenderPass
+	var common bool
+	var buffers []RenderPass
+	// outputs maps the IDs of the outputs of the buffers to their names.
+	outputs := map[flexibleID]string{}
+	for i, pass := range sh.RenderPasses {
+		switch pass.Type {
+		case "image":
+			image = &sh.RenderPasses[i]
+		case "common":
+			common = true
+			proj.Files["common.glsl"] = pass.Code
+		case "sound":
+			sound = &sh.RenderPasses[i]
+		case "buffer":
+			b, ok := bufferPasses[pass.Name]
+			if !ok {
+				return nil, fmt.Errorf("unknown buffer %q", pass.Name)
+			}
+			buffers = append(buffers, pass)
+			for _, out := range pass.Outputs {
+				outputs[out.ID] = b.name
+			}
+		default:
+			proj.Warnings = append(proj.Warnings, fmt.Sprintf("%s passes are not supported, %q is left out", pass.Type, pass.Name))
+		}
+	}
+	if image == nil {
+		return nil, fmt.Errorf("shader %s has no image pass", sh.Info.ID)
+	}
+	// Passes render in the order of Shadertoy, buffer A to D.
+	sort.SliceStable(buffers, func(i, j int) bool { return buffers[i].Name < buffers[j].Name })
+
+	var header strings.Builder
+	fmt.Fprintf(&header, "// %s by %s\n", sh.Info.Name, sh.Info.Username)
+	fmt.Fprintf(&header, "// %s/view/%s\n", BaseURL, sh.Info.ID)
+
+	convertPass := func(pass RenderPass, extra string) string {
+		var src strings.Builder
+		src.WriteString(header.String())
+		if extra != "" {
+			src.WriteString("\n" + extra)
+		}
+		if common {
+			src.WriteString("\n#pragma use \"common.glsl\"\n")
+		}
+		src.WriteString("\n")
+		for _, line := range proj.channels(pass, outputs) {
+			src.WriteString(line + "\n")
+		}
+		src.WriteString("\n" + pass.Code)
+		if !strings.HasSuffix(pass.Code, "\n") {
+			src.WriteString("\n")
+		}
+		return src.String()
+	}
+
+	var passes strings.Builder
+	for _, pass := range buffers {
+		b := bufferPasses[pass.Name]
+		// Buffers of Shadertoy store half floats.
+		fmt.Fprintf(&passes, "#pragma buffer %q as %s rgba16f\n", b.file, b.name)
+		proj.Files[b.file] = convertPass(pass, "")
+	}
+	proj.Files[proj.Image] = convertPass(*image, passes.String())
+	if sound != nil {
+		proj.Sound = "sound.glsl"
+		proj.Files[proj.Sound] = convertPass(*sound, "")
+	}
+	return proj, nil
+}
+
+// channelUseRe matches the channels that are used by the code of a pass.
+var channelUseRe = regexp.MustCompile(`\biChannel([0-3])\b`)
+
+// channels returns the lines that map the inputs of a pass to its channels.
+func (proj *Project) channels(pass RenderPass, outputs map[flexibleID]string) []string {
+	var lines []string
+	// undeclared maps the channels that are not mapped to the type they are
+	// declared with.
+	undeclared := map[int]string{}
+	for _, m := range channelUseRe.FindAllStringSubmatch(pass.Code, -1) {
+		undeclared[int(m[1][0]-'0')] = "sampler2D"
+	}
+
+	inputs := append([]Input{}, pass.Inputs...)
+	sort.Slice(inputs, func(i, j int) bool { return inputs[i].Channel < inputs[j].Channel })
+	for _, in := range inputs {
+		channel := fmt.Sprintf("iChannel%d", in.Channel)
+		var line string
+		switch in.Type {
+		case "buffer":
+			name, ok := outputs[in.ID]
+			if m := previzBufferRe.FindStringSubmatch(in.Src); !ok && m != nil {
+				name = "Buf" + string(rune('A'+m[1][0]-'0'))
+			}
+			if name == "" {
+				proj.warnf("%s: %s reads an unknown buffer", pass.Name, channel)
+				break
+			}
+			// The passes are declared by their name. The define makes
+			// them available by the channel the code expects.
+			line = fmt.Sprintf("#define %s %s", channel, name)
+		case "texture":
+			line = fmt.Sprintf("#pragma map %s=image:%s", channel, proj.addMedia("textures", in.Src))
+			if in.Sampler.SRGB == "true" {
+				line += ";srgb"
+			}
+		case "video":
+			line = fmt.Sprintf("#pragma map %s=video:%s", channel, proj.addMedia("media", in.Src))
+		case "music":
+			line = fmt.Sprintf("#pragma map %s=audio:%s", channel, proj.addMedia("media", in.Src))
+		case "webcam":
+			line = fmt.Sprintf("#pragma map %s=video:/dev/video0", channel)
+		case "keyboard":
+			line = fmt.Sprintf("#pragma map %s=builtin:Keyboard", channel)
+		case "cubemap":
+			proj.warnf("%s: %s is a cubemap, which is not supported", pass.Name, channel)
+			undeclared[in.Channel] = "samplerCube"
+		case "volume":
+			proj.warnf("%s: %s is a volume, which is not supported", pass.Name, channel)
+			undeclared[in.Channel] = "sampler3D"
+		default:
+			proj.warnf("%s: %s is a %s input, which is not supported", pass.Name, channel, in.Type)
+		}
+		if line != "" {
+			lines = append(lines, line)
+			delete(undeclared, in.Channel)
+		}
+	}
+
+	// Shadertoy declares every channel, so the code may use channels without
+	// a supported input. They are declared as empty textures so the code
+	// still compiles.
+	for ch := 0; ch < 4; ch++ {
+		if typ, ok := undeclared[ch]; ok {
+			lines = append(lines, fmt.Sprintf("uniform %s iChannel%d;", typ, ch))
+		}
+	}
+	return lines
+}
+
+// addMedia adds the file of an input to the media of the project and returns
+// its path relative to the sources.
+func (proj *Project) addMedia(dir, src string) string {
+	file := path.Join(dir, path.Base(src))
+	u := src
+	if !strings.HasPrefix(src, "http://") && !strings.HasPrefix(src, "https://") {
+		u = BaseURL + "/" + strings.TrimPrefix(src, "/")
+	}
+	proj.Media[file] = u
+	return file
+}
+
+func (proj *Project) warnf(format string, args ...interface{}) {
+	proj.Warnings = append(proj.Warnings, fmt.Sprintf(format, args...))
+}
+
+// Write writes the files of the project to the directory and downloads its
+// media. Media that already exists is not downloaded again.
+func (proj *Project) Write(ctx context.Context, client *http.Client, dir string) error {
+	if client == nil {
+		client = http.DefaultClient
+	}
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return err
+	}
+	for name, contents := range proj.Files {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(contents), 0o644); err != nil {
+			return err
+		}
+	}
+	for name, u := range proj.Media {
+		filename := filepath.Join(dir, filepath.FromSlash(name))
+		if _, err := os.Stat(filename); err == nil {
+			continue
+		}
+		if err := download(ctx, client, u, filename); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func download(ctx context.Context, client *http.Client, u, filename string) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("could not download %s: %s", u, resp.Status)
+	}
+	if err := os.MkdirAll(filepath.Dir(filename), 0o755); err != nil {
+		return err
+	}
+	// Download to a temporary file first, so an interrupted download is
+	// not mistaken for a complete file.
+	tmp := filename + ".part"
+	fd, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(fd, resp.Body); err != nil {
+		fd.Close()
+		os.Remove(tmp)
+		return fmt.Errorf("could not download %s: %w", u, err)
+	}
+	if err := fd.Close(); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, filename)
+}
@@ -0,0 +1,136 @@
+package importer
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestParseID(t *testing.T) {
+	valid := map[string]string{
+		"XsXXDn":                                   "XsXXDn",
+		"shadertoy://XsXXDn":                       "XsXXDn",
+		"https://www.shadertoy.com/view/XsXXDn":    "XsXXDn",
+		"https://shadertoy.com/embed/XsXXDn?gui=1": "XsXXDn",
+	}
+	for input, expected := range valid {
+		id, err := ParseID(input)
+		if err != nil {
+			t.Errorf("%q: %v", input, err)
+		} else if id != expected {
+			t.Errorf("%q: got %q, expected %q", input, id, expected)
+		}
+	}
+	for _, input := range []string{"", "https://example.com/view/XsXXDn", "../etc"} {
+		if _, err := ParseID(input); err == nil {
+			t.Errorf("%q: expected an error", input)
+		}
+	}
+}
+
+const testResponse = `{"Shader": {
+	"ver": "0.1",
+	"info": {"id": "abcdef", "name": "Test", "username": "someone"},
+	"renderpass": [
+		{
+			"name": "Image", "type": "image",
+			"inputs": [
+				{"id": 257, "src": "/media/previz/buffer00.png", "ctype": "buffer", "channel": 0},
+				{"id": 17, "src": "/media/a/noise.png", "ctype": "texture", "channel": 1, "sampler": {"srgb": "true"}},
+				{"id": 33, "src": "/media/a/keyboard.png", "ctype": "keyboard", "channel": 3}
+			],
+			"outputs": [{"id": 37, "channel": 0}],
+			"code": "void mainImage(out vec4 c, in vec2 p) { c = texture(iChannel0, p) + texture(iChannel3, p); }"
+		},
+		{
+			"name": "Buffer A", "type": "buffer",
+			"inputs": [{"id": "4dXGR8", "src": "/media/previz/buffer00.png", "ctype": "buffer", "channel": 0}],
+			"outputs": [{"id": "4dXGR8", "channel": 0}],
+			"code": "void mainImage(out vec4 c, in vec2 p) { c = texture(iChannel0, p) * texture(iChannel2, p); }"
+		},
+		{"name": "Common", "type": "common", "inputs": [], "outputs": [], "code": "float f() { return 1.0; }"},
+		{"name": "Sound", "type": "sound", "inputs": [], "outputs": [], "code": "vec2 mainSound(int s, float t) { return vec2(sin(t)); }"},
+		{"name": "Cubemap A", "type": "cubemap", "inputs": [], "outputs": [], "code": ""}
+	]
+}}`
+
+func TestConvert(t *testing.T) {
+	sh, err := decodeResponse(strings.NewReader(testResponse), "abcdef")
+	if err != nil {
+		t.Fatal(err)
+	}
+	proj, err := Convert(sh)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	image := proj.Files["image.glsl"]
+	for _, line := range []string{
+		`#pragma buffer "bufa.glsl" as BufA rgba16f`,
+		`#pragma use "common.glsl"`,
+		`#define iChannel0 BufA`,
+		`#pragma map iChannel1=image:textures/noise.png;srgb`,
+		`#pragma map iChannel3=builtin:Keyboard`,
+	} {
+		if !strings.Contains(image, line+"\n") {
+			t.Errorf("image.glsl does not contain %q:\n%s", line, image)
+		}
+	}
+	bufa := proj.Files["bufa.glsl"]
+	if !strings.Contains(bufa, "#define iChannel0 BufA\n") || !strings.Contains(bufa, "uniform sampler2D iChannel2;\n") {
+		t.Errorf("unexpected bufa.glsl:\n%s", bufa)
+	}
+	if strings.Contains(bufa, "#pragma buffer") {
+		t.Errorf("buffers should only be declared by the image:\n%s", bufa)
+	}
+	if proj.Files["common.glsl"] != "float f() { return 1.0; }" {
+		t.Errorf("unexpected common.glsl: %q", proj.Files["common.glsl"])
+	}
+	if u := proj.Media["textures/noise.png"]; u != BaseURL+"/media/a/noise.png" {
+		t.Errorf("unexpected media URL %q", u)
+	}
+	if sound := proj.Files["sound.glsl"]; proj.Sound != "sound.glsl" || !strings.Contains(sound, "#pragma use \"common.glsl\"\n") || !strings.Contains(sound, "vec2 mainSound(") {
+		t.Errorf("unexpected sound %q:\n%s", proj.Sound, sound)
+	}
+	if len(proj.Warnings) != 1 {
+		t.Errorf("expected a warning for the cubemap pass, got %q", proj.Warnings)
+	}
+}
+
+func TestDecodeResponseError(t *testing.T) {
+	_, err := decodeResponse(strings.NewReader(`{"Error": "Shader not found"}`), "abcdef")
+	if err == nil || !strings.Contains(err.Error(), "Shader not found") {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestWrite(t *testing.T) {
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		w.Write([]byte("png"))
+	}))
+	defer server.Close()
+
+	dir := t.TempDir()
+	proj := &Project{
+		Files: map[string]string{"image.glsl": "void mainImage(out vec4 c, in vec2 p) {}\n"},
+		Media: map[string]string{"textures/noise.png": server.URL + "/media/a/noise.png"},
+		Image: "image.glsl",
+	}
+	for i := 0; i < 2; i++ {
+		if err := proj.Write(context.Background(), server.Client(), dir); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if b, err := os.ReadFile(filepath.Join(dir, "textures", "noise.png")); err != nil || string(b) != "png" {
+		t.Errorf("unexpected texture %q: %v", b, err)
+	}
+	if requests != 1 {
+		t.Errorf("media should only be downloaded once, got %d requests", requests)
+	}
+}
@@ -37,6 +37,17 @@ import (
 var (
 	resolution = image.Rect(0, 0, 640, 480)
 	gamma      [2048]uint8
+	// depthMeters maps raw 11-bit disparity values to distances in meters.
+	// Invalid readings are mapped to 0.
+	depthMeters [2048]float32
+)
+
+// Intrinsics of the Kinect's RGB and depth cameras as (fx, fy, cx, cy) in
+// pixels. These are the commonly used calibration values by Nicolas Burrus,
+// individual devices may deviate slightly.
+var (
+	rgbIntrinsics   = [4]float32{5.2921508098293293e+02, 5.2556393630057437e+02, 3.2894272028759258e+02, 2.6748068171871557e+02}
+	depthIntrinsics = [4]float32{5.9421434211923247e+02, 5.9104053696870778e+02, 3.3930780975300314e+02, 2.4273913761751615e+02}
 )
 
 var instances sync.Map
@@ -46,10 +57,16 @@ func init() {
 		a := float64(i) / float64(len(gamma))
 		b := math.Pow(a, 3) * 6
 		gamma[i] = 255 - uint8(b*256)
+
+		if i < len(depthMeters)-1 {
+			if d := 1.0 / (float64(i)*-0.0030711016 + 3.3309495161); d > 0 {
+				depthMeters[i] = float32(d)
+			}
+		}
 	}
 
 	shadertoy.RegisterResourceType("kinect", func(m shadertoy.Mapping, genTexID shadertoy.GenTexFunc, state renderer.RenderState) (shadertoy.Resource, error) {
-		kin, err := open(m.Name, genTexID())
+		kin, err := open(m.Name, genTexID(), genTexID())
 		if err != nil {
 			return nil, err
 		}
@@ -65,21 +82,26 @@ type kinect struct {
 	closed, loopClosed chan struct{}
 
 	currentImage     *image.RGBA
+	currentDepth     []float32
 	currentImageLock sync.Mutex
 
-	uniformName  string
-	textureIndex uint32
-	textureID    uint32
+	uniformName       string
+	textureIndex      uint32
+	textureID         uint32
+	depthTextureIndex uint32
+	depthTextureID    uint32
 }
 
-func open(uniformName string, textureIndex uint32) (*kinect, error) {
+func open(uniformName string, textureIndex, depthTextureIndex uint32) (*kinect, error) {
 	kin := &kinect{
-		instanceHandle: &struct{}{},
-		closed:         make(chan struct{}),
-		loopClosed:     make(chan struct{}),
-		currentImage:   image.NewRGBA(resolution),
-		uniformName:    uniformName,
-		textureIndex:   textureIndex,
+		instanceHandle:    &struct{}{},
+		closed:            make(chan struct{}),
+		loopClosed:        make(chan struct{}),
+		currentImage:      image.NewRGBA(resolution),
+		currentDepth:      make([]float32, resolution.Dx()*resolution.Dy()),
+		uniformName:       uniformName,
+		textureIndex:      textureIndex,
+		depthTextureIndex: depthTextureIndex,
 	}
 
 	if C.freenect_init(&kin.ctx, C.NULL) < 0 {
@@ -124,6 +146,25 @@ func open(uniformName string, textureIndex uint32) (*kinect, error) {
 	gl.TexParameteri(gl.TEXTURE_2D, gl.TEXTURE_MAG_FILTER, gl.NEAREST)
 	gl.TexParameteri(gl.TEXTURE_2D, gl.TEXTURE_MIN_FILTER, gl.NEAREST)
 
+	gl.GenTextures(1, &kin.depthTextureID)
+	gl.BindTexture(gl.TEXTURE_2D, kin.depthTextureID)
+	gl.TexImage2D(
+		gl.TEXTURE_2D,            // target
+		0,                        // level
+		gl.R32F,                  // internalFormat
+		int32(resolution.Dx()),   // width
+		int32(resolution.Dy()),   // height
+		0,                        // border
+		gl.RED,                   // format
+		gl.FLOAT,                 // type
+		gl.Ptr(kin.currentDepth), // data
+	)
+	gl.TexParameteri(gl.TEXTURE_2D, gl.TEXTURE_WRAP_S, gl.CLAMP_TO_EDGE)
+	gl.TexParameteri(gl.TEXTURE_2D, gl.TEXTURE_WRAP_T, gl.CLAMP_TO_EDGE)
+	gl.TexParameteri(gl.TEXTURE_2D, gl.TEXTURE_MAG_FILTER, gl.NEAREST)
+	gl.TexParameteri(gl.TEXTURE_2D, gl.TEXTURE_MIN_FILTER, gl.NEAREST)
+	gl.BindTexture(gl.TEXTURE_2D, 0)
+
 	go kin.freenectLoop()
 
 	return kin, nil
@@ -134,6 +175,7 @@ func (kin *kinect) Close() error {
 	<-kin.loopClosed
 	instances.Delete(kin.instanceHandle)
 	gl.DeleteTextures(1, &kin.textureID)
+	gl.DeleteTextures(1, &kin.depthTextureID)
 	return nil
 }
 
@@ -142,7 +184,10 @@ func (kin *kinect) UniformSource() string {
 		uniform sampler2D %s;
 		uniform vec3 %sSize;
 		uniform float %sCurTime;
-	`, kin.uniformName, kin.uniformName, kin.uniformName)
+		uniform sampler2D %sDepth;
+		uniform vec4 %sIntrinsics;
+		uniform vec4 %sDepthIntrinsics;
+	`, kin.uniformName, kin.uniformName, kin.uniformName, kin.uniformName, kin.uniformName, kin.uniformName)
 }
 
 func (kin *kinect) PreRender(state renderer.RenderState) {
@@ -173,6 +218,28 @@ func (kin *kinect) PreRender(state renderer.RenderState) {
 	if loc, ok := state.Uniforms[fmt.Sprintf("%sSize", kin.uniformName)]; ok {
 		gl.Uniform3f(loc.Location, float32(resolution.Dx()), float32(resolution.Dy()), 1.0)
 	}
+	if loc, ok := state.Uniforms[fmt.Sprintf("%sDepth", kin.uniformName)]; ok {
+		gl.ActiveTexture(gl.TEXTURE0 + kin.depthTextureIndex)
+		gl.BindTexture(gl.TEXTURE_2D, kin.depthTextureID)
+		gl.TexSubImage2D(
+			gl.TEXTURE_2D,            // target,
+			0,                        // level,
+			0,                        // xoffset,
+			0,                        // yoffset,
+			int32(resolution.Dx()),   // width,
+			int32(resolution.Dy()),   // height,
+			gl.RED,                   // format,
+			gl.FLOAT,                 // type,
+			gl.Ptr(kin.currentDepth), // data
+		)
+		gl.Uniform1i(loc.Location, int32(kin.depthTextureIndex))
+	}
+	if loc, ok := state.Uniforms[fmt.Sprintf("%sIntrinsics", kin.uniformName)]; ok {
+		gl.Uniform4fv(loc.Location, 1, &rgbIntrinsics[0])
+	}
+	if loc, ok := state.Uniforms[fmt.Sprintf("%sDepthIntrinsics", kin.uniformName)]; ok {
+		gl.Uniform4fv(loc.Location, 1, &depthIntrinsics[0])
+	}
 }
 
 func (kin *kinect) freenectLoop() {
@@ -227,9 +294,12 @@ func (kin *kinect) depthCallback(depthPtr *uint8) {
 	defer kin.currentImageLock.Unlock()
 
 	length := resolution.Dx() * resolution.Dy()
-	depth := unsafe.Slice((*uint8)(depthPtr), length)
+	// The 11-bit depth mode packs each sample in a 16-bit word.
+	depth := unsafe.Slice((*uint16)(unsafe.Pointer(depthPtr)), length)
 
 	for i, value := range depth {
+		value &= 0x7ff
 		kin.currentImage.Pix[i*4+3] = gamma[value]
+		kin.currentDepth[i] = depthMeters[value]
 	}
 }
@@ -0,0 +1,252 @@
+package midi
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/go-gl/gl/v3.3-core/gl"
+
+	"github.com/polyfloyd/shady/renderer"
+	"github.com/polyfloyd/shady/shadertoy"
+)
+
+// numControls is the number of controllers and notes of a MIDI channel.
+const numControls = 128
+
+func init() {
+	shadertoy.RegisterResourceType("midi", func(m shadertoy.Mapping, _ shadertoy.GenTexFunc, _ renderer.RenderState) (shadertoy.Resource, error) {
+		path, channel, err := parseValue(m.Value)
+		if err != nil {
+			return nil, err
+		}
+		fd, err := os.Open(path)
+		if err != nil {
+			return nil, fmt.Errorf("could not open midi port: %w", err)
+		}
+		return newMidiInput(m.Name, fd, channel), nil
+	})
+}
+
+// parseValue parses the value of a midi mapping as "<port>[;channel=<n>]". The
+// port is a raw MIDI device like /dev/snd/midiC1D0, or an ALSA hardware port
+// like hw:1,0 as listed by `amidi -l`. A channel of 0 receives all channels.
+func parseValue(value string) (string, int, error) {
+	parts := strings.Split(value, ";")
+	path, err := portPath(parts[0])
+	if err != nil {
+		return "", 0, err
+	}
+	channel := 0
+	for _, opt := range parts[1:] {
+		key, arg := opt, ""
+		if i := strings.IndexByte(opt, '='); i >= 0 {
+			key, arg = opt[:i], opt[i+1:]
+		}
+		if key != "channel" {
+			return "", 0, fmt.Errorf("unknown midi option %q", opt)
+		}
+		if channel, err = strconv.Atoi(arg); err != nil || channel < 1 || channel > 16 {
+			return "", 0, fmt.Errorf("invalid midi option %q: the channel must be between 1 and 16", opt)
+		}
+	}
+	return path, channel, nil
+}
+
+// portPath returns the device of a port.
+func portPath(port string) (string, error) {
+	if !strings.HasPrefix(port, "hw:") {
+		if port == "" {
+			return "", fmt.Errorf("no midi port")
+		}
+		return port, nil
+	}
+	nums := strings.Split(strings.TrimPrefix(port, "hw:"), ",")
+	if len(nums) < 2 || len(nums) > 3 {
+		return "", fmt.Errorf("invalid midi port %q, expected hw:<card>,<device>", port)
+	}
+	for _, n := range nums {
+		if _, err := strconv.ParseUint(n, 10, 8); err != nil {
+			return "", fmt.Errorf("invalid midi port %q, expected hw:<card>,<device>", port)
+		}
+	}
+	// The raw device receives all subdevices of a port.
+	return fmt.Sprintf("/dev/snd/midiC%sD%s", nums[0], nums[1]), nil
+}
+
+// message is a channel message, of which the channel starts at 1.
+type message struct {
+	status   byte
+	channel  int
+	data1    byte
+	data2    byte
+	dataSize int
+}
+
+// parser splits a stream of MIDI bytes into channel messages. It keeps the
+// running status and skips system messages, which may be sent in between the
+// bytes of a message.
+type parser struct {
+	status byte
+	data   []byte
+	sysex  bool
+}
+
+// feed adds a byte and returns true with the message that it completes.
+func (p *parser) feed(b byte) (message, bool) {
+	switch {
+	case b >= 0xf8:
+		// Real time messages, like the clock, do not interrupt others.
+		return message{}, false
+	case b == 0xf0:
+		p.status, p.sysex = 0, true
+		return message{}, false
+	case b >= 0xf0:
+		// Other system messages end a system exclusive message and clear
+		// the running status.
+		p.status, p.sysex, p.data = 0, false, p.data[:0]
+		return message{}, false
+	case b >= 0x80:
+		p.status, p.sysex, p.data = b, false, p.data[:0]
+		return message{}, false
+	case p.sysex || p.status == 0:
+		return message{}, false
+	}
+	p.data = append(p.data, b)
+	size := 2
+	if kind := p.status & 0xf0; kind == 0xc0 || kind == 0xd0 {
+		size = 1
+	}
+	if len(p.data) < size {
+		return message{}, false
+	}
+	msg := message{status: p.status & 0xf0, channel: int(p.status&0x0f) + 1, data1: p.data[0], dataSize: size}
+	if size == 2 {
+		msg.data2 = p.data[1]
+	}
+	p.data = p.data[:0]
+	return msg, true
+}
+
+// state holds the last values that were received.
+type state struct {
+	channel int
+
+	lock     sync.Mutex
+	cc       [numControls]float32
+	notes    [numControls]float32
+	bend     float32
+	pressure float32
+	changed  bool
+}
+
+func (s *state) handle(msg message) {
+	if s.channel != 0 && msg.channel != s.channel {
+		return
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	switch msg.status {
+	case 0x80:
+		s.notes[msg.data1] = 0
+	case 0x90:
+		// A note on with a velocity of 0 is a note off.
+		s.notes[msg.data1] = float32(msg.data2) / 127
+	case 0xb0:
+		s.cc[msg.data1] = float32(msg.data2) / 127
+	case 0xd0:
+		s.pressure = float32(msg.data1) / 127
+	case 0xe0:
+		// The center of the wheel is 0, the ends -1 and about 1.
+		s.bend = float32((int(msg.data2)<<7|int(msg.data1))-0x2000) / 0x2000
+	default:
+		return
+	}
+	s.changed = true
+}
+
+// midiInput is a mapping of the controllers and notes of a MIDI port to
+// uniform arrays.
+type midiInput struct {
+	uniformName string
+	port        io.ReadCloser
+	state       *state
+	loopClosed  chan struct{}
+
+	cc, notes [numControls]float32
+}
+
+func newMidiInput(uniformName string, port io.ReadCloser, channel int) *midiInput {
+	mi := &midiInput{
+		uniformName: uniformName,
+		port:        port,
+		state:       &state{channel: channel},
+		loopClosed:  make(chan struct{}),
+	}
+	go func() {
+		defer close(mi.loopClosed)
+		var p parser
+		buf := make([]byte, 256)
+		for {
+			n, err := port.Read(buf)
+			for _, b := range buf[:n] {
+				if msg, ok := p.feed(b); ok {
+					mi.state.handle(msg)
+				}
+			}
+			if err != nil {
+				// The port was closed or unplugged.
+				return
+			}
+		}
+	}()
+	return mi
+}
+
+func (mi *midiInput) UniformSource() string {
+	return fmt.Sprintf(`
+		uniform float %[1]sCC[%[2]d];
+		uniform float %[1]sNote[%[2]d];
+		uniform float %[1]sBend;
+		uniform float %[1]sPressure;
+	`, mi.uniformName, numControls)
+}
+
+// Idle implements the shadertoy.IdleResource interface. The port is idle as
+// long as nothing was received since the previous frame.
+func (mi *midiInput) Idle(renderer.RenderState) bool {
+	mi.state.lock.Lock()
+	defer mi.state.lock.Unlock()
+	return !mi.state.changed
+}
+
+func (mi *midiInput) PreRender(state renderer.RenderState) {
+	s := mi.state
+	s.lock.Lock()
+	mi.cc, mi.notes = s.cc, s.notes
+	bend, pressure := s.bend, s.pressure
+	s.changed = false
+	s.lock.Unlock()
+
+	if loc, ok := state.Uniforms[mi.uniformName+"CC[0]"]; ok {
+		gl.Uniform1fv(loc.Location, numControls, &mi.cc[0])
+	}
+	if loc, ok := state.Uniforms[mi.uniformName+"Note[0]"]; ok {
+		gl.Uniform1fv(loc.Location, numControls, &mi.notes[0])
+	}
+	if loc, ok := state.Uniforms[mi.uniformName+"Bend"]; ok {
+		gl.Uniform1f(loc.Location, bend)
+	}
+	if loc, ok := state.Uniforms[mi.uniformName+"Pressure"]; ok {
+		gl.Uniform1f(loc.Location, pressure)
+	}
+}
+
+func (mi *midiInput) Close() error {
+	err := mi.port.Close()
+	<-mi.loopClosed
+	return err
+}
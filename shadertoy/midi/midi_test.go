@@ -0,0 +1,83 @@
+package midi
+
+import (
+	"testing"
+)
+
+func TestParseValue(t *testing.T) {
+	cases := []struct {
+		value   string
+		path    string
+		channel int
+	}{
+		{"/dev/snd/midiC1D0", "/dev/snd/midiC1D0", 0},
+		{"hw:2,0", "/dev/snd/midiC2D0", 0},
+		{"hw:1,1,0;channel=10", "/dev/snd/midiC1D1", 10},
+	}
+	for _, c := range cases {
+		path, channel, err := parseValue(c.value)
+		if err != nil {
+			t.Errorf("%q: %v", c.value, err)
+			continue
+		}
+		if path != c.path || channel != c.channel {
+			t.Errorf("%q: exp %q, %d, got %q, %d", c.value, c.path, c.channel, path, channel)
+		}
+	}
+	for _, value := range []string{"", "hw:1", "hw:a,0", "/dev/midi1;channel=0", "/dev/midi1;channel=17", "/dev/midi1;velocity"} {
+		if _, _, err := parseValue(value); err == nil {
+			t.Errorf("%q: expected an error", value)
+		}
+	}
+}
+
+func TestParser(t *testing.T) {
+	stream := []byte{
+		0xb0, 7, 100, // Control change.
+		8, 64, // Running status.
+		0x91, 60, 0xf8, 127, // A note on, interrupted by the clock.
+		0xf0, 0x7e, 1, 2, 0xf7, // Ignored system exclusive.
+		0xc2, 5, // Program change.
+		0xf6, 1, 2, // Tune request, which clears the running status.
+	}
+	exp := []message{
+		{status: 0xb0, channel: 1, data1: 7, data2: 100, dataSize: 2},
+		{status: 0xb0, channel: 1, data1: 8, data2: 64, dataSize: 2},
+		{status: 0x90, channel: 2, data1: 60, data2: 127, dataSize: 2},
+		{status: 0xc0, channel: 3, data1: 5, dataSize: 1},
+	}
+	var p parser
+	var got []message
+	for _, b := range stream {
+		if msg, ok := p.feed(b); ok {
+			got = append(got, msg)
+		}
+	}
+	if len(got) != len(exp) {
+		t.Fatalf("unexpected messages: exp %v, got %v", exp, got)
+	}
+	for i := range exp {
+		if got[i] != exp[i] {
+			t.Errorf("message %d: exp %v, got %v", i, exp[i], got[i])
+		}
+	}
+}
+
+func TestStateHandle(t *testing.T) {
+	s := &state{channel: 2}
+	s.handle(message{status: 0xb0, channel: 1, data1: 1, data2: 127})
+	if s.changed {
+		t.Fatalf("expected a message of another channel to be ignored")
+	}
+	s.handle(message{status: 0xb0, channel: 2, data1: 1, data2: 127})
+	s.handle(message{status: 0x90, channel: 2, data1: 60, data2: 127})
+	s.handle(message{status: 0xe0, channel: 2, data1: 0, data2: 0x40})
+	if s.cc[1] != 1 || s.notes[60] != 1 || s.bend != 0 {
+		t.Errorf("unexpected state: cc %v, note %v, bend %v", s.cc[1], s.notes[60], s.bend)
+	}
+	s.handle(message{status: 0x90, channel: 2, data1: 60, data2: 0})
+	s.handle(message{status: 0xe0, channel: 2, data1: 0, data2: 0})
+	if s.notes[60] != 0 || s.bend != -1 {
+		t.Errorf("unexpected state after note off: note %v, bend %v", s.notes[60], s.bend)
+	}
+}
@@ -0,0 +1,142 @@
+package nowplaying
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+const lastfmKeyEnv = "LASTFM_API_KEY"
+
+// lastfmURL is the endpoint of the API of last.fm, which is a variable so it
+// can be replaced in tests.
+var lastfmURL = "https://ws.audioscrobbler.com/2.0/"
+
+// lastfmInterval is the time between requests of the track that a user is
+// playing, last.fm asks clients not to poll more often.
+const lastfmInterval = 15 * time.Second
+
+// lastfmWatcher follows what a user of last.fm is playing, on any player that
+// scrobbles. last.fm does not know the position, so it counts from the time
+// the track was first seen.
+type lastfmWatcher struct {
+	user, key string
+	update    func(track)
+	client    *http.Client
+
+	// ctx is canceled when the watcher is closed, which also interrupts a
+	// request.
+	ctx    context.Context
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+func newLastfmWatcher(user, key string, update func(track)) *lastfmWatcher {
+	ctx, cancel := context.WithCancel(context.Background())
+	w := &lastfmWatcher{
+		user:   user,
+		key:    key,
+		update: update,
+		client: &http.Client{Timeout: 10 * time.Second},
+		ctx:    ctx,
+		cancel: cancel,
+		done:   make(chan struct{}),
+	}
+	go w.run()
+	return w
+}
+
+func (w *lastfmWatcher) run() {
+	defer close(w.done)
+	var current track
+	failures := errorLog{prefix: "lastfm"}
+	for {
+		t, err := w.poll(current, time.Now())
+		if w.ctx.Err() != nil {
+			return
+		}
+		if err != nil {
+			failures.log(err)
+		} else {
+			failures.reset()
+			if t != current {
+				current = t
+				w.update(t)
+			}
+		}
+		select {
+		case <-w.ctx.Done():
+			return
+		case <-time.After(lastfmInterval):
+		}
+	}
+}
+
+func (w *lastfmWatcher) poll(current track, now time.Time) (track, error) {
+	query := url.Values{
+		"method":  {"user.getrecenttracks"},
+		"user":    {w.user},
+		"api_key": {w.key},
+		"format":  {"json"},
+		"limit":   {"1"},
+	}
+	req, err := http.NewRequestWithContext(w.ctx, http.MethodGet, lastfmURL+"?"+query.Encode(), nil)
+	if err != nil {
+		return track{}, err
+	}
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return track{}, err
+	}
+	defer resp.Body.Close()
+	var body lastfmRecentTracks
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return track{}, fmt.Errorf("%s: %w", resp.Status, err)
+	}
+	if body.Error != 0 {
+		return track{}, fmt.Errorf("%s", body.Message)
+	}
+	return lastfmTrack(body, current, now), nil
+}
+
+// lastfmRecentTracks is the response of user.getrecenttracks.
+type lastfmRecentTracks struct {
+	Error   int    `json:"error"`
+	Message string `json:"message"`
+
+	RecentTracks struct {
+		Track []struct {
+			Name   string `json:"name"`
+			Artist struct {
+				Text string `json:"#text"`
+			} `json:"artist"`
+			Attr struct {
+				NowPlaying string `json:"nowplaying"`
+			} `json:"@attr"`
+		} `json:"track"`
+	} `json:"recenttracks"`
+}
+
+// lastfmTrack returns the track that is playing according to the response at
+// now. If it is still the current track, it keeps its position.
+func lastfmTrack(body lastfmRecentTracks, current track, now time.Time) track {
+	for _, t := range body.RecentTracks.Track {
+		if t.Attr.NowPlaying != "true" {
+			continue
+		}
+		if t.Artist.Text == current.artist && t.Name == current.title {
+			return current
+		}
+		return track{artist: t.Artist.Text, title: t.Name, playing: true, at: now}
+	}
+	return track{}
+}
+
+func (w *lastfmWatcher) Close() error {
+	w.cancel()
+	<-w.done
+	return nil
+}
@@ -0,0 +1,192 @@
+package nowplaying
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// reconnectInterval is the time between attempts to connect to a player that
+// is not running.
+const reconnectInterval = 5 * time.Second
+
+// mpdWatcher follows the player of an MPD server with the idle command, so it
+// is notified of changes instead of polling.
+type mpdWatcher struct {
+	address  string
+	password string
+	update   func(track)
+
+	lock   sync.Mutex
+	conn   net.Conn
+	closed chan struct{}
+	done   chan struct{}
+}
+
+// newMPDWatcher connects to the server at address, which is a host and port
+// or the path of a unix socket. It keeps trying to connect in the background
+// until it is closed.
+func newMPDWatcher(address, password string, update func(track)) *mpdWatcher {
+	w := &mpdWatcher{
+		address:  address,
+		password: password,
+		update:   update,
+		closed:   make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+	go w.run()
+	return w
+}
+
+func (w *mpdWatcher) run() {
+	defer close(w.done)
+	failures := errorLog{prefix: "mpd"}
+	for {
+		err := w.watch()
+		select {
+		case <-w.closed:
+			return
+		default:
+		}
+		failures.log(fmt.Errorf("%w, reconnecting every %v", err, reconnectInterval))
+		w.update(track{})
+		select {
+		case <-w.closed:
+			return
+		case <-time.After(reconnectInterval):
+		}
+	}
+}
+
+// watch connects and reports the state of the player each time it changes,
+// until the connection fails.
+func (w *mpdWatcher) watch() error {
+	network := "tcp"
+	if strings.HasPrefix(w.address, "/") {
+		network = "unix"
+	}
+	conn, err := net.DialTimeout(network, w.address, reconnectInterval)
+	if err != nil {
+		return err
+	}
+	w.lock.Lock()
+	select {
+	case <-w.closed:
+		w.lock.Unlock()
+		conn.Close()
+		return nil
+	default:
+	}
+	w.conn = conn
+	w.lock.Unlock()
+	defer conn.Close()
+
+	br := bufio.NewReader(conn)
+	greeting, err := br.ReadString('\n')
+	if err != nil {
+		return err
+	}
+	if !strings.HasPrefix(greeting, "OK MPD ") {
+		return fmt.Errorf("%s is not an MPD server", w.address)
+	}
+	if w.password != "" {
+		if _, err := fmt.Fprintf(conn, "password %s\n", quoteArgument(w.password)); err != nil {
+			return err
+		}
+		if _, err := readResponse(br); err != nil {
+			return err
+		}
+	}
+	for {
+		if _, err := fmt.Fprint(conn, "command_list_begin\nstatus\ncurrentsong\ncommand_list_end\n"); err != nil {
+			return err
+		}
+		resp, err := readResponse(br)
+		if err != nil {
+			return err
+		}
+		w.update(mpdTrack(resp, time.Now()))
+		// Blocks until the player changes, like when a track starts or a
+		// seek.
+		if _, err := fmt.Fprint(conn, "idle player\n"); err != nil {
+			return err
+		}
+		if _, err := readResponse(br); err != nil {
+			return err
+		}
+	}
+}
+
+// readResponse reads the "key: value" lines of a response up to its OK.
+func readResponse(br *bufio.Reader) (map[string]string, error) {
+	resp := map[string]string{}
+	for {
+		line, err := br.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		line = strings.TrimSuffix(line, "\n")
+		if line == "OK" {
+			return resp, nil
+		}
+		if strings.HasPrefix(line, "ACK ") {
+			return nil, fmt.Errorf("%s", strings.TrimPrefix(line, "ACK "))
+		}
+		if i := strings.Index(line, ": "); i >= 0 {
+			resp[line[:i]] = line[i+2:]
+		}
+	}
+}
+
+// mpdTrack returns the track of the responses of the status and currentsong
+// commands, which were received at the time at.
+func mpdTrack(resp map[string]string, at time.Time) track {
+	if resp["state"] == "stop" {
+		return track{}
+	}
+	t := track{
+		artist:   resp["Artist"],
+		title:    resp["Title"],
+		elapsed:  mpdSeconds(resp["elapsed"]),
+		duration: mpdSeconds(resp["duration"]),
+		playing:  resp["state"] == "play",
+		at:       at,
+	}
+	if t.title == "" {
+		// Streams only have a name, files at least have a filename.
+		if t.title = resp["Name"]; t.title == "" && resp["file"] != "" {
+			t.title = path.Base(resp["file"])
+		}
+	}
+	return t
+}
+
+func mpdSeconds(s string) time.Duration {
+	f, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return 0
+	}
+	return time.Duration(f * float64(time.Second))
+}
+
+// quoteArgument quotes an argument of a command.
+func quoteArgument(s string) string {
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(s) + `"`
+}
+
+func (w *mpdWatcher) Close() error {
+	w.lock.Lock()
+	close(w.closed)
+	if w.conn != nil {
+		// Interrupts the idle command.
+		w.conn.Close()
+	}
+	w.lock.Unlock()
+	<-w.done
+	return nil
+}
@@ -0,0 +1,119 @@
+package nowplaying
+
+import (
+	"bufio"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// playerctlFormat is the format of the lines that playerctl prints each time
+// the player changes. The position and length are in microseconds.
+const playerctlFormat = "{{status}}\t{{position}}\t{{mpris:length}}\t{{mpris:trackid}}\t{{xesam:audioBPM}}\t{{artist}}\t{{title}}"
+
+// mprisWatcher follows an MPRIS player on the session bus, like Spotify or VLC,
+// with playerctl, which must be installed.
+type mprisWatcher struct {
+	player string
+	update func(track)
+
+	lock   sync.Mutex
+	cmd    *exec.Cmd
+	closed chan struct{}
+	done   chan struct{}
+}
+
+// newMPRISWatcher follows the named player, or the first player that is
+// found if the name is empty.
+func newMPRISWatcher(player string, update func(track)) *mprisWatcher {
+	w := &mprisWatcher{
+		player: player,
+		update: update,
+		closed: make(chan struct{}),
+		done:   make(chan struct{}),
+	}
+	go w.run()
+	return w
+}
+
+func (w *mprisWatcher) run() {
+	defer close(w.done)
+	for {
+		w.watch()
+		w.update(track{})
+		// playerctl waits for players that are not running by itself, but
+		// exits when the session bus is gone.
+		select {
+		case <-w.closed:
+			return
+		case <-time.After(reconnectInterval):
+		}
+	}
+}
+
+func (w *mprisWatcher) watch() {
+	args := []string{"--follow", "metadata", "--format", playerctlFormat}
+	if w.player != "" {
+		args = append([]string{"--player", w.player}, args...)
+	}
+	cmd := exec.Command("playerctl", args...)
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return
+	}
+	w.lock.Lock()
+	select {
+	case <-w.closed:
+		w.lock.Unlock()
+		return
+	default:
+	}
+	if err := cmd.Start(); err != nil {
+		w.lock.Unlock()
+		return
+	}
+	w.cmd = cmd
+	w.lock.Unlock()
+	scanner := bufio.NewScanner(stdout)
+	for scanner.Scan() {
+		w.update(playerctlTrack(scanner.Text(), time.Now()))
+	}
+	cmd.Wait()
+}
+
+// playerctlTrack parses a line of playerctlFormat that was printed at the
+// time at. An empty line is printed when the player quits.
+func playerctlTrack(line string, at time.Time) track {
+	fields := strings.SplitN(line, "\t", 7)
+	if len(fields) < 7 || fields[0] == "Stopped" {
+		return track{}
+	}
+	microseconds := func(s string) time.Duration {
+		us, _ := strconv.ParseInt(s, 10, 64)
+		return time.Duration(us) * time.Microsecond
+	}
+	bpm, _ := strconv.ParseFloat(fields[4], 64)
+	return track{
+		artist:   fields[5],
+		title:    fields[6],
+		elapsed:  microseconds(fields[1]),
+		duration: microseconds(fields[2]),
+		playing:  fields[0] == "Playing",
+		at:       at,
+		id:       fields[3],
+		bpm:      bpm,
+	}
+}
+
+func (w *mprisWatcher) Close() error {
+	w.lock.Lock()
+	close(w.closed)
+	if w.cmd != nil {
+		w.cmd.Process.Kill()
+	}
+	w.lock.Unlock()
+	<-w.done
+	return nil
+}
@@ -0,0 +1,303 @@
+package nowplaying
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-gl/gl/v3.3-core/gl"
+
+	"github.com/polyfloyd/shady/renderer"
+	"github.com/polyfloyd/shady/shadertoy"
+	"github.com/polyfloyd/shady/shadertoy/audio"
+)
+
+func init() {
+	shadertoy.RegisterResourceType("mpd", func(m shadertoy.Mapping, genTexID shadertoy.GenTexFunc, _ renderer.RenderState) (shadertoy.Resource, error) {
+		v, err := parseValue(m.Value, "localhost:6600", "password")
+		if err != nil {
+			return nil, err
+		}
+		return newPlayer(m, v, genTexID, func(p *player) watcher {
+			return newMPDWatcher(v.address, v.options["password"], p.update)
+		})
+	})
+	shadertoy.RegisterResourceType("mpris", func(m shadertoy.Mapping, genTexID shadertoy.GenTexFunc, _ renderer.RenderState) (shadertoy.Resource, error) {
+		v, err := parseValue(m.Value, "", "spotify")
+		if err != nil {
+			return nil, err
+		}
+		var features *spotifyFeatures
+		if _, ok := v.options["spotify"]; ok {
+			if features, err = newSpotifyFeatures(os.Getenv(spotifyClientIDEnv), os.Getenv(spotifyClientSecretEnv)); err != nil {
+				return nil, err
+			}
+		}
+		return newPlayer(m, v, genTexID, func(p *player) watcher {
+			update := p.update
+			if features != nil {
+				update = features.annotate(update)
+			}
+			return newMPRISWatcher(v.address, update)
+		})
+	})
+	shadertoy.RegisterResourceType("lastfm", func(m shadertoy.Mapping, genTexID shadertoy.GenTexFunc, _ renderer.RenderState) (shadertoy.Resource, error) {
+		v, err := parseValue(m.Value, "")
+		if err != nil {
+			return nil, err
+		}
+		if v.address == "" {
+			return nil, fmt.Errorf("the lastfm loader needs the name of a user")
+		}
+		key := os.Getenv(lastfmKeyEnv)
+		if key == "" {
+			return nil, fmt.Errorf("the lastfm loader needs an API key in $%s", lastfmKeyEnv)
+		}
+		return newPlayer(m, v, genTexID, func(p *player) watcher {
+			return newLastfmWatcher(v.address, key, p.update)
+		})
+	})
+}
+
+// value is the parsed value of a mapping, "[address][;<option>=<value>...]".
+// The address is the server of MPD, the name of an MPRIS player or a user of
+// last.fm. The audio option takes the value of an audio mapping, which may
+// hold semicolons, so it is the last option.
+type value struct {
+	address string
+	options map[string]string
+	audio   string
+}
+
+func parseValue(s, defaultAddress string, options ...string) (value, error) {
+	v := value{options: map[string]string{}}
+	parts := strings.Split(s, ";")
+	if v.address = parts[0]; v.address == "" {
+		v.address = defaultAddress
+	}
+	for i, opt := range parts[1:] {
+		key, arg := opt, ""
+		if j := strings.IndexByte(opt, '='); j >= 0 {
+			key, arg = opt[:j], opt[j+1:]
+		}
+		if key == "audio" {
+			v.audio = strings.Join(append([]string{arg}, parts[i+2:]...), ";")
+			if v.audio == "" {
+				return value{}, fmt.Errorf("the audio option of %q is empty", s)
+			}
+			break
+		}
+		known := false
+		for _, o := range options {
+			if o == key {
+				known = true
+			}
+		}
+		if !known {
+			return value{}, fmt.Errorf("unknown option %q", opt)
+		}
+		v.options[key] = arg
+	}
+	return v, nil
+}
+
+// track is the state of a player.
+type track struct {
+	artist, title string
+	// elapsed is the position at the time the state was received.
+	elapsed  time.Duration
+	duration time.Duration
+	playing  bool
+	at       time.Time
+	// id identifies the track for the player, like the trackid of MPRIS.
+	id string
+	// bpm is the tempo and energy is the intensity from 0 to 1, or 0 if
+	// they are not known.
+	bpm, energy float64
+}
+
+// label returns the text that is shown of the track.
+func (t track) label() string {
+	if t.artist == "" {
+		return t.title
+	}
+	return t.artist + " - " + t.title
+}
+
+// position returns the position of the track at now, of which the player
+// keeps time.
+func (t track) position(now time.Time) time.Duration {
+	pos := t.elapsed
+	if t.playing {
+		pos += now.Sub(t.at)
+	}
+	if t.duration > 0 && pos > t.duration {
+		pos = t.duration
+	}
+	return pos
+}
+
+// errorLog logs the errors of a watcher that keeps retrying, of which an error
+// is only logged again after a different one occurred.
+type errorLog struct {
+	prefix string
+	prev   string
+}
+
+func (l *errorLog) log(err error) {
+	if err.Error() != l.prev {
+		log.Printf("%s: %v", l.prefix, err)
+		l.prev = err.Error()
+	}
+}
+
+// reset is called after a success, so the next error is logged.
+func (l *errorLog) reset() {
+	l.prev = ""
+}
+
+// A watcher follows a player until it is closed.
+type watcher interface {
+	Close() error
+}
+
+// player is a mapping of what a music player is playing: the artist and title
+// as a texture of text, the position, tempo and energy of the track and, if
+// the audio option is set, the audio that the player outputs.
+type player struct {
+	uniformName string
+	id          uint32
+	index       uint32
+	audio       shadertoy.Resource
+	watcher     watcher
+
+	lock    sync.Mutex
+	current track
+	changed bool
+
+	label         string
+	width, height int
+}
+
+func newPlayer(m shadertoy.Mapping, v value, genTexID shadertoy.GenTexFunc, watch func(*player) watcher) (*player, error) {
+	p := &player{
+		uniformName: m.Name,
+		index:       genTexID(),
+		changed:     true,
+	}
+	if v.audio != "" {
+		var err error
+		if p.audio, err = audio.NewTexture(m.Name+"Audio", m.PWD, v.audio, genTexID()); err != nil {
+			return nil, err
+		}
+	}
+	gl.GenTextures(1, &p.id)
+	gl.BindTexture(gl.TEXTURE_2D, p.id)
+	p.upload("")
+	gl.TexParameteri(gl.TEXTURE_2D, gl.TEXTURE_WRAP_S, gl.CLAMP_TO_EDGE)
+	gl.TexParameteri(gl.TEXTURE_2D, gl.TEXTURE_WRAP_T, gl.CLAMP_TO_EDGE)
+	gl.TexParameteri(gl.TEXTURE_2D, gl.TEXTURE_MAG_FILTER, gl.NEAREST)
+	gl.TexParameteri(gl.TEXTURE_2D, gl.TEXTURE_MIN_FILTER, gl.LINEAR)
+	p.watcher = watch(p)
+	return p, nil
+}
+
+// update is called by the watcher with the state of the player.
+func (p *player) update(t track) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.current, p.changed = t, true
+}
+
+// upload replaces the texture with the text, which is then bound.
+func (p *player) upload(text string) {
+	pix, w, h := renderText(text)
+	gl.ActiveTexture(gl.TEXTURE0 + p.index)
+	gl.BindTexture(gl.TEXTURE_2D, p.id)
+	gl.PixelStorei(gl.UNPACK_ALIGNMENT, 1)
+	gl.TexImage2D(gl.TEXTURE_2D, 0, gl.R8, int32(w), int32(h), 0, gl.RED, gl.UNSIGNED_BYTE, gl.Ptr(pix))
+	gl.PixelStorei(gl.UNPACK_ALIGNMENT, 4)
+	p.label, p.width, p.height = text, w, h
+}
+
+func (p *player) UniformSource() string {
+	src := fmt.Sprintf(`
+		uniform sampler2D %[1]s;
+		uniform vec3 %[1]sSize;
+		uniform float %[1]sPosition;
+		uniform float %[1]sDuration;
+		uniform float %[1]sPlaying;
+		uniform float %[1]sBPM;
+		uniform float %[1]sEnergy;
+	`, p.uniformName)
+	if p.audio != nil {
+		src += p.audio.UniformSource()
+	}
+	return src
+}
+
+// Idle implements the shadertoy.IdleResource interface. The player is idle
+// while it is paused or stopped and nothing changed since the previous frame.
+func (p *player) Idle(renderer.RenderState) bool {
+	if p.audio != nil {
+		return false
+	}
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	return !p.changed && !p.current.playing
+}
+
+func (p *player) PreRender(state renderer.RenderState) {
+	p.lock.Lock()
+	t := p.current
+	p.changed = false
+	p.lock.Unlock()
+
+	if label := t.label(); label != p.label {
+		p.upload(label)
+	}
+	if loc, ok := state.Uniforms[p.uniformName]; ok {
+		gl.ActiveTexture(gl.TEXTURE0 + p.index)
+		gl.BindTexture(gl.TEXTURE_2D, p.id)
+		gl.Uniform1i(loc.Location, int32(p.index))
+	}
+	if loc, ok := state.Uniforms[p.uniformName+"Size"]; ok {
+		gl.Uniform3f(loc.Location, float32(p.width), float32(p.height), 1.0)
+	}
+	if loc, ok := state.Uniforms[p.uniformName+"Position"]; ok {
+		gl.Uniform1f(loc.Location, float32(t.position(time.Now()).Seconds()))
+	}
+	if loc, ok := state.Uniforms[p.uniformName+"Duration"]; ok {
+		gl.Uniform1f(loc.Location, float32(t.duration.Seconds()))
+	}
+	if loc, ok := state.Uniforms[p.uniformName+"Playing"]; ok {
+		playing := float32(0)
+		if t.playing {
+			playing = 1
+		}
+		gl.Uniform1f(loc.Location, playing)
+	}
+	if loc, ok := state.Uniforms[p.uniformName+"BPM"]; ok {
+		gl.Uniform1f(loc.Location, float32(t.bpm))
+	}
+	if loc, ok := state.Uniforms[p.uniformName+"Energy"]; ok {
+		gl.Uniform1f(loc.Location, float32(t.energy))
+	}
+	if p.audio != nil {
+		p.audio.PreRender(state)
+	}
+}
+
+func (p *player) Close() error {
+	err := p.watcher.Close()
+	if p.audio != nil {
+		if aerr := p.audio.Close(); err == nil {
+			err = aerr
+		}
+	}
+	gl.DeleteTextures(1, &p.id)
+	return err
+}
@@ -0,0 +1,337 @@
+package nowplaying
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseValue(t *testing.T) {
+	tests := []struct {
+		value    string
+		expected value
+		err      bool
+	}{
+		{"", value{address: "localhost:6600", options: map[string]string{}}, false},
+		{"/run/mpd/socket", value{address: "/run/mpd/socket", options: map[string]string{}}, false},
+		{"music:6600;password=secret", value{address: "music:6600", options: map[string]string{"password": "secret"}}, false},
+		{
+			";audio=~/.mpd/mpd.fifo;22000:1:s16le",
+			value{address: "localhost:6600", options: map[string]string{}, audio: "~/.mpd/mpd.fifo;22000:1:s16le"},
+			false,
+		},
+		{";audio=", value{}, true},
+		{";volume=1", value{}, true},
+	}
+	for _, test := range tests {
+		v, err := parseValue(test.value, "localhost:6600", "password")
+		if (err != nil) != test.err {
+			t.Errorf("%q: unexpected error: %v", test.value, err)
+			continue
+		}
+		if !test.err && !reflect.DeepEqual(v, test.expected) {
+			t.Errorf("%q: got %+v, expected %+v", test.value, v, test.expected)
+		}
+	}
+}
+
+func TestTrackPosition(t *testing.T) {
+	at := time.Unix(1000, 0)
+	tr := track{elapsed: 10 * time.Second, duration: 12 * time.Second, playing: true, at: at}
+	if pos := tr.position(at.Add(time.Second)); pos != 11*time.Second {
+		t.Errorf("the position is %v while playing, expected 11s", pos)
+	}
+	if pos := tr.position(at.Add(time.Minute)); pos != 12*time.Second {
+		t.Errorf("the position is %v after the end, expected 12s", pos)
+	}
+	tr.playing = false
+	if pos := tr.position(at.Add(time.Second)); pos != 10*time.Second {
+		t.Errorf("the position is %v while paused, expected 10s", pos)
+	}
+}
+
+func TestMPDTrack(t *testing.T) {
+	resp, err := readResponse(bufio.NewReader(strings.NewReader(strings.Join([]string{
+		"volume: 100",
+		"state: play",
+		"elapsed: 61.500",
+		"duration: 245.000",
+		"file: music/song.flac",
+		"Artist: Artist",
+		"Title: Song",
+		"OK",
+		"",
+	}, "\n"))))
+	if err != nil {
+		t.Fatal(err)
+	}
+	at := time.Unix(1000, 0)
+	expected := track{artist: "Artist", title: "Song", elapsed: 61500 * time.Millisecond, duration: 245 * time.Second, playing: true, at: at}
+	if tr := mpdTrack(resp, at); tr != expected {
+		t.Errorf("got %+v, expected %+v", tr, expected)
+	}
+	if tr := mpdTrack(map[string]string{"state": "pause", "file": "music/untitled.mp3"}, at); tr.title != "untitled.mp3" || tr.playing {
+		t.Errorf("a paused file without tags is %+v", tr)
+	}
+	if tr := mpdTrack(map[string]string{"state": "stop", "Title": "Song"}, at); tr != (track{}) {
+		t.Errorf("a stopped player is %+v", tr)
+	}
+
+	if _, err := readResponse(bufio.NewReader(strings.NewReader("ACK [4@0] {status} you don't have permission\n"))); err == nil {
+		t.Errorf("an ACK is not an error")
+	}
+}
+
+func TestMPDWatcher(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Skip(err)
+	}
+	defer ln.Close()
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		br := bufio.NewReader(conn)
+		conn.Write([]byte("OK MPD 0.23.5\n"))
+		for {
+			line, err := br.ReadString('\n')
+			if err != nil {
+				return
+			}
+			switch strings.TrimSpace(line) {
+			case `password "se\"cret"`:
+				conn.Write([]byte("OK\n"))
+			case "command_list_end":
+				conn.Write([]byte("state: play\nArtist: Artist\nTitle: Song\nOK\n"))
+			case "idle player":
+				// The player never changes.
+			}
+		}
+	}()
+
+	updates := make(chan track, 1)
+	w := newMPDWatcher(ln.Addr().String(), `se"cret`, func(tr track) {
+		select {
+		case updates <- tr:
+		default:
+		}
+	})
+	select {
+	case tr := <-updates:
+		if tr.label() != "Artist - Song" || !tr.playing {
+			t.Errorf("got %+v", tr)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("no update")
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestPlayerctlTrack(t *testing.T) {
+	at := time.Unix(1000, 0)
+	tests := []struct {
+		line     string
+		expected track
+	}{
+		{
+			"Playing\t1500000\t180000000\t/com/spotify/track/abc\t128\tArtist\tSong",
+			track{artist: "Artist", title: "Song", elapsed: 1500 * time.Millisecond, duration: 3 * time.Minute, playing: true, at: at, id: "/com/spotify/track/abc", bpm: 128},
+		},
+		{
+			"Paused\t0\t\t\t\t\tRadio",
+			track{title: "Radio", at: at},
+		},
+		{"Stopped\t0\t\t\t\t\t", track{}},
+		{"", track{}},
+	}
+	for _, test := range tests {
+		if tr := playerctlTrack(test.line, at); tr != test.expected {
+			t.Errorf("%q: got %+v, expected %+v", test.line, tr, test.expected)
+		}
+	}
+}
+
+func TestSpotifyTrackID(t *testing.T) {
+	for mprisID, expected := range map[string]string{
+		"/com/spotify/track/4uLU6hMCjMI75M1A2tKUQC": "4uLU6hMCjMI75M1A2tKUQC",
+		"spotify:track:4uLU6hMCjMI75M1A2tKUQC":      "4uLU6hMCjMI75M1A2tKUQC",
+		"/com/spotify/ad/123":                       "",
+		"/org/mpris/MediaPlayer2/Track/1":           "",
+	} {
+		if id := spotifyTrackID(mprisID); id != expected {
+			t.Errorf("%q: got %q, expected %q", mprisID, id, expected)
+		}
+	}
+}
+
+func TestSpotifyFeatures(t *testing.T) {
+	var tokens int
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/token":
+			if id, secret, _ := r.BasicAuth(); id != "id" || secret != "secret" {
+				http.Error(w, "invalid client", http.StatusBadRequest)
+				return
+			}
+			tokens++
+			fmt.Fprint(w, `{"access_token": "token", "token_type": "Bearer", "expires_in": 3600}`)
+		case "/audio-features/abc":
+			if r.Header.Get("Authorization") != "Bearer token" {
+				http.Error(w, "no token", http.StatusUnauthorized)
+				return
+			}
+			json.NewEncoder(w).Encode(map[string]float64{"tempo": 120.5, "energy": 0.8})
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer srv.Close()
+	defer func(tokenURL, featuresURL string) {
+		spotifyTokenURL, spotifyFeaturesURL = tokenURL, featuresURL
+	}(spotifyTokenURL, spotifyFeaturesURL)
+	spotifyTokenURL, spotifyFeaturesURL = srv.URL+"/token", srv.URL+"/audio-features/"
+
+	if _, err := newSpotifyFeatures("", ""); err == nil {
+		t.Fatal("no error without credentials")
+	}
+	sf, err := newSpotifyFeatures("id", "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	updates := make(chan track, 4)
+	update := sf.annotate(func(tr track) { updates <- tr })
+	update(track{title: "Song", id: "spotify:track:abc"})
+	if tr := <-updates; tr.bpm != 0 {
+		t.Errorf("the features are known before they were looked up: %+v", tr)
+	}
+	select {
+	case tr := <-updates:
+		if tr.bpm != 120.5 || tr.energy != 0.8 || tr.title != "Song" {
+			t.Errorf("got %+v", tr)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the features were not looked up")
+	}
+	// The features are cached.
+	update(track{title: "Song", id: "spotify:track:abc", playing: true})
+	if tr := <-updates; tr.bpm != 120.5 || !tr.playing {
+		t.Errorf("got %+v", tr)
+	}
+	if _, err := sf.fetch("abc"); err != nil || tokens != 1 {
+		t.Errorf("the token was requested %d times: %v", tokens, err)
+	}
+	if _, err := sf.fetch("unknown"); err == nil {
+		t.Errorf("no error for an unknown track")
+	}
+}
+
+func TestSpotifyFeaturesForbidden(t *testing.T) {
+	var requests int
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/token" {
+			fmt.Fprint(w, `{"access_token": "token", "token_type": "Bearer", "expires_in": 3600}`)
+			return
+		}
+		requests++
+		http.Error(w, `{"error": {"status": 403}}`, http.StatusForbidden)
+	}))
+	defer srv.Close()
+	defer func(tokenURL, featuresURL string) {
+		spotifyTokenURL, spotifyFeaturesURL = tokenURL, featuresURL
+	}(spotifyTokenURL, spotifyFeaturesURL)
+	spotifyTokenURL, spotifyFeaturesURL = srv.URL+"/token", srv.URL+"/audio-features/"
+
+	sf, err := newSpotifyFeatures("id", "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := sf.fetch("abc"); !errors.Is(err, errForbidden) {
+		t.Fatalf("a 403 is not reported as forbidden: %v", err)
+	}
+	requests = 0
+	updates := make(chan track, 8)
+	update := sf.annotate(func(tr track) { updates <- tr })
+	update(track{title: "Song", id: "spotify:track:abc"})
+	<-updates
+	// Wait for the lookup to fail.
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+		sf.lock.Lock()
+		forbidden := sf.forbidden
+		sf.lock.Unlock()
+		if forbidden {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("the lookup did not fail")
+		}
+	}
+	update(track{title: "Song", id: "spotify:track:abc", playing: true})
+	update(track{title: "Other", id: "spotify:track:def"})
+	for i := 0; i < 2; i++ {
+		if tr := <-updates; tr.bpm != 0 || tr.energy != 0 {
+			t.Errorf("got features of a forbidden lookup: %+v", tr)
+		}
+	}
+	if requests != 1 {
+		t.Errorf("the features were requested %d times, expected once", requests)
+	}
+}
+
+func TestLastfmTrack(t *testing.T) {
+	var body lastfmRecentTracks
+	err := json.Unmarshal([]byte(`{"recenttracks": {"track": [
+		{"artist": {"#text": "Artist"}, "name": "Song", "@attr": {"nowplaying": "true"}},
+		{"artist": {"#text": "Artist"}, "name": "Previous", "date": {"uts": "1000"}}
+	]}}`), &body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	at := time.Unix(1000, 0)
+	tr := lastfmTrack(body, track{}, at)
+	if expected := (track{artist: "Artist", title: "Song", playing: true, at: at}); tr != expected {
+		t.Fatalf("got %+v, expected %+v", tr, expected)
+	}
+	if again := lastfmTrack(body, tr, at.Add(time.Minute)); again != tr {
+		t.Errorf("the position of the current track is not kept: %+v", again)
+	}
+	body.RecentTracks.Track = body.RecentTracks.Track[1:]
+	if tr := lastfmTrack(body, tr, at); tr != (track{}) {
+		t.Errorf("nothing is playing, but got %+v", tr)
+	}
+}
+
+func TestRenderText(t *testing.T) {
+	pix, w, h := renderText("I")
+	if w != advance+1 || h != textHeight {
+		t.Fatalf("the size is %dx%d", w, h)
+	}
+	// The stem of the I is the middle column, the padding is a row at the
+	// bottom and the top.
+	for y := 0; y < h; y++ {
+		on := pix[y*w+3] != 0
+		if expected := y > 0 && y < h-1; on != expected {
+			t.Errorf("row %d of the stem is %v, expected %v", y, on, expected)
+		}
+	}
+
+	question, _, _ := renderText("?")
+	if accent, _, _ := renderText("é"); !reflect.DeepEqual(accent, question) {
+		t.Errorf("characters without a glyph are not drawn as a question mark")
+	}
+	if _, w, _ := renderText(""); w != 1 {
+		t.Errorf("the width of no text is %d", w)
+	}
+}
@@ -0,0 +1,191 @@
+package nowplaying
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	spotifyClientIDEnv     = "SPOTIFY_CLIENT_ID"
+	spotifyClientSecretEnv = "SPOTIFY_CLIENT_SECRET"
+)
+
+// The endpoints of Spotify, which are variables so they can be replaced in
+// tests.
+var (
+	spotifyTokenURL    = "https://accounts.spotify.com/api/token"
+	spotifyFeaturesURL = "https://api.spotify.com/v1/audio-features/"
+)
+
+// spotifyTrackID returns the ID of a track of Spotify from the trackid that
+// its MPRIS player reports, like /com/spotify/track/<id> or
+// spotify:track:<id>, or an empty string for other tracks.
+func spotifyTrackID(mprisID string) string {
+	for _, prefix := range []string{"/com/spotify/track/", "spotify:track:"} {
+		if strings.HasPrefix(mprisID, prefix) {
+			return strings.TrimPrefix(mprisID, prefix)
+		}
+	}
+	return ""
+}
+
+// errForbidden is returned if Spotify refuses a request of the app.
+var errForbidden = errors.New("403 Forbidden")
+
+// features are the audio features of a track.
+type features struct {
+	Tempo  float64 `json:"tempo"`
+	Energy float64 `json:"energy"`
+}
+
+// spotifyFeatures looks up the tempo and energy of tracks with the Web API of
+// Spotify, which it authenticates to with the credentials of an app.
+type spotifyFeatures struct {
+	clientID, clientSecret string
+	client                 *http.Client
+
+	lock    sync.Mutex
+	token   string
+	expires time.Time
+	cache   map[string]features
+	// latest is the most recent state of the player, which is reported again
+	// once the features of its track are known.
+	latest track
+	// forbidden is set once Spotify refused the audio features to the app,
+	// after which they are not requested again.
+	forbidden bool
+	errors    errorLog
+}
+
+func newSpotifyFeatures(clientID, clientSecret string) (*spotifyFeatures, error) {
+	if clientID == "" || clientSecret == "" {
+		return nil, fmt.Errorf("the spotify option needs the credentials of an app in $%s and $%s", spotifyClientIDEnv, spotifyClientSecretEnv)
+	}
+	return &spotifyFeatures{
+		clientID:     clientID,
+		clientSecret: clientSecret,
+		client:       &http.Client{Timeout: 10 * time.Second},
+		cache:        map[string]features{},
+		errors:       errorLog{prefix: "spotify"},
+	}, nil
+}
+
+// annotate returns an update function that adds the features of the track
+// before passing it on. Features that are not known yet are looked up in the
+// background, the track is passed on without them in the meantime.
+func (sf *spotifyFeatures) annotate(update func(track)) func(track) {
+	return func(t track) {
+		id := spotifyTrackID(t.id)
+		// Updates are passed on while locked, so an update of a lookup is
+		// not overtaken by an older one.
+		sf.lock.Lock()
+		defer sf.lock.Unlock()
+		sf.latest = t
+		f, ok := sf.cache[id]
+		if !ok && id != "" && !sf.forbidden {
+			// Marks the lookup as started, so it is only done once, also if
+			// it fails.
+			sf.cache[id] = features{}
+			go sf.lookup(id, update)
+		}
+		update(withFeatures(t, f))
+	}
+}
+
+func (sf *spotifyFeatures) lookup(id string, update func(track)) {
+	f, err := sf.fetch(id)
+	sf.lock.Lock()
+	defer sf.lock.Unlock()
+	if errors.Is(err, errForbidden) {
+		sf.forbidden = true
+		log.Printf("spotify: the app may not read audio features, which Spotify only allows to apps that were registered before November 27 2024")
+		return
+	} else if err != nil {
+		sf.errors.log(err)
+		return
+	}
+	sf.cache[id] = f
+	if spotifyTrackID(sf.latest.id) == id {
+		update(withFeatures(sf.latest, f))
+	}
+}
+
+func withFeatures(t track, f features) track {
+	if f.Tempo != 0 {
+		t.bpm = f.Tempo
+	}
+	t.energy = f.Energy
+	return t
+}
+
+// fetch requests the features of the track.
+func (sf *spotifyFeatures) fetch(id string) (features, error) {
+	token, err := sf.accessToken()
+	if err != nil {
+		return features{}, err
+	}
+	req, err := http.NewRequest(http.MethodGet, spotifyFeaturesURL+url.PathEscape(id), nil)
+	if err != nil {
+		return features{}, err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	var f features
+	if err := sf.do(req, &f); err != nil {
+		return features{}, fmt.Errorf("audio features of %s: %w", id, err)
+	}
+	return f, nil
+}
+
+// accessToken returns a token of the app, which is requested again when it
+// expires.
+func (sf *spotifyFeatures) accessToken() (string, error) {
+	sf.lock.Lock()
+	if sf.token != "" && time.Now().Before(sf.expires) {
+		defer sf.lock.Unlock()
+		return sf.token, nil
+	}
+	sf.lock.Unlock()
+
+	req, err := http.NewRequest(http.MethodPost, spotifyTokenURL, strings.NewReader(url.Values{"grant_type": {"client_credentials"}}.Encode()))
+	if err != nil {
+		return "", err
+	}
+	req.SetBasicAuth(sf.clientID, sf.clientSecret)
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	var resp struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int    `json:"expires_in"`
+	}
+	if err := sf.do(req, &resp); err != nil {
+		return "", fmt.Errorf("authenticating: %v", err)
+	}
+	sf.lock.Lock()
+	defer sf.lock.Unlock()
+	sf.token = resp.AccessToken
+	// A token that is about to expire is not used for new requests.
+	sf.expires = time.Now().Add(time.Duration(resp.ExpiresIn)*time.Second - time.Minute)
+	return sf.token, nil
+}
+
+// do sends the request and decodes the JSON of the response into v.
+func (sf *spotifyFeatures) do(req *http.Request, v interface{}) error {
+	resp, err := sf.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusForbidden {
+		return errForbidden
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s", resp.Status)
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
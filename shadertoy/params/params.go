@@ -0,0 +1,185 @@
+package params
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/polyfloyd/shady/renderer"
+	"github.com/polyfloyd/shady/shadertoy"
+)
+
+func init() {
+	shadertoy.RegisterResourceType("params", func(m shadertoy.Mapping, _ shadertoy.GenTexFunc, _ renderer.RenderState) (shadertoy.Resource, error) {
+		path, err := shadertoy.ResolvePath(m.PWD, m.Value)
+		if err != nil {
+			return nil, err
+		}
+		binding, err := m.GenBinding()
+		if err != nil {
+			return nil, err
+		}
+		return newParamBlock(m.Name, path, binding)
+	})
+}
+
+// checkInterval is the interval at which the file is checked for changes.
+const checkInterval = time.Second / 10
+
+var paramLineRe = regexp.MustCompile(`^(\w+)\s+(\w+)\s*=\s*(.+)$`)
+
+// paramBlock is a mapping of a file of parameters to a uniform block.
+type paramBlock struct {
+	filename string
+	modTime  time.Time
+	block    renderer.UniformBlock
+
+	// checked is the time the file was last checked for changes, changed is
+	// set if it was modified at nextModTime.
+	checked     time.Time
+	changed     bool
+	nextModTime time.Time
+}
+
+func newParamBlock(blockName, filename string, binding uint32) (*paramBlock, error) {
+	info, err := os.Stat(filename)
+	if err != nil {
+		return nil, err
+	}
+	fields, err := readParamFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	return &paramBlock{
+		filename: filename,
+		modTime:  info.ModTime(),
+		block: renderer.UniformBlock{
+			Name:    blockName,
+			Fields:  fields,
+			Binding: binding,
+		},
+	}, nil
+}
+
+func readParamFile(filename string) ([]renderer.BlockField, error) {
+	fd, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer fd.Close()
+	fields, err := ParseParams(fd)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", filename, err)
+	}
+	return fields, nil
+}
+
+// ParseParams reads parameter definitions with one definition per line in the
+// format "<type> <name> = <value>[, <value>...]". Empty lines and lines
+// starting with "//" or "#" are ignored.
+func ParseParams(r io.Reader) ([]renderer.BlockField, error) {
+	var fields []renderer.BlockField
+	scanner := bufio.NewScanner(r)
+	lineno := 0
+	for scanner.Scan() {
+		lineno++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "//") || strings.HasPrefix(line, "#") {
+			continue
+		}
+		match := paramLineRe.FindStringSubmatch(strings.TrimSuffix(line, ";"))
+		if match == nil {
+			return nil, fmt.Errorf("line %d: could not parse parameter %q", lineno, line)
+		}
+		var value []float32
+		for _, v := range strings.Split(match[3], ",") {
+			v = strings.TrimSpace(v)
+			switch v {
+			case "true":
+				value = append(value, 1)
+				continue
+			case "false":
+				value = append(value, 0)
+				continue
+			}
+			f, err := strconv.ParseFloat(v, 32)
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %w", lineno, err)
+			}
+			value = append(value, float32(f))
+		}
+		field := renderer.BlockField{Type: match[1], Name: match[2], Value: value}
+		// Verify the type by packing the field.
+		if _, err := (&renderer.UniformBlock{Fields: []renderer.BlockField{field}}).Pack(); err != nil {
+			return nil, fmt.Errorf("line %d: %w", lineno, err)
+		}
+		fields = append(fields, field)
+	}
+	return fields, scanner.Err()
+}
+
+func (pb *paramBlock) UniformSource() string {
+	return pb.block.Declaration()
+}
+
+// reload reads the parameter file again if it was modified. Only values are
+// updated, changes to the names or types of the fields require the shader to
+// be recompiled.
+func (pb *paramBlock) reload() {
+	if !pb.modified() {
+		return
+	}
+	pb.modTime, pb.changed = pb.nextModTime, false
+	fields, err := readParamFile(pb.filename)
+	if err != nil {
+		log.Printf("Error reloading parameters: %v", err)
+		return
+	}
+	if len(fields) != len(pb.block.Fields) {
+		log.Printf("The layout of %s has changed, reload the shader to apply", pb.filename)
+		return
+	}
+	for i, f := range fields {
+		if f.Name != pb.block.Fields[i].Name || f.Type != pb.block.Fields[i].Type {
+			log.Printf("The layout of %s has changed, reload the shader to apply", pb.filename)
+			return
+		}
+	}
+	pb.block.Fields = fields
+}
+
+// modified reports whether the file was modified since it was read. The file
+// is checked at most once per checkInterval.
+func (pb *paramBlock) modified() bool {
+	if time.Since(pb.checked) < checkInterval {
+		return pb.changed
+	}
+	pb.checked = time.Now()
+	if info, err := os.Stat(pb.filename); err == nil && info.ModTime().After(pb.modTime) {
+		pb.changed, pb.nextModTime = true, info.ModTime()
+	}
+	return pb.changed
+}
+
+// Idle implements the shadertoy.IdleResource interface. The parameters are
+// idle until the file is modified.
+func (pb *paramBlock) Idle(renderer.RenderState) bool {
+	return !pb.modified()
+}
+
+func (pb *paramBlock) PreRender(state renderer.RenderState) {
+	pb.reload()
+	if err := pb.block.Update(state.Program); err != nil {
+		log.Printf("Error updating parameters: %v", err)
+	}
+}
+
+func (pb *paramBlock) Close() error {
+	return pb.block.Close()
+}
@@ -0,0 +1,316 @@
+package pointcloud
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// Cloud holds the points of a point cloud.
+//
+// Both slices are laid out as consecutive RGBA32F texels. The W component of
+// each position is always 1. Points without color information are white.
+type Cloud struct {
+	Positions []float32
+	Colors    []float32
+}
+
+func (c *Cloud) add(x, y, z float32, r, g, b, a float32) {
+	c.Positions = append(c.Positions, x, y, z, 1)
+	c.Colors = append(c.Colors, r, g, b, a)
+}
+
+// Decode reads a point cloud. The format is determined by the extension of the
+// filename, PLY and CSV are supported.
+func Decode(r io.Reader, filename string) (*Cloud, error) {
+	switch strings.ToLower(filepath.Ext(filename)) {
+	case ".ply":
+		return DecodePLY(r)
+	case ".csv", ".txt", ".xyz":
+		return DecodeCSV(r)
+	default:
+		return nil, fmt.Errorf("unknown point cloud format %q", filepath.Ext(filename))
+	}
+}
+
+// DecodeCSV reads points from lines formatted as "x,y,z[,r,g,b[,a]]".
+//
+// Whitespace may be used instead of commas. Lines that do not start with a
+// number, such as headers and comments, are skipped. Colors are interpreted as
+// 0-255 when any component exceeds 1, otherwise as 0-1.
+func DecodeCSV(r io.Reader) (*Cloud, error) {
+	cloud := &Cloud{}
+	eightBit := false
+	scanner := bufio.NewScanner(r)
+	lineno := 0
+	for scanner.Scan() {
+		lineno++
+		fields := strings.FieldsFunc(scanner.Text(), func(r rune) bool {
+			return r == ',' || r == ';' || r == ' ' || r == '\t'
+		})
+		if len(fields) == 0 {
+			continue
+		}
+		if _, err := strconv.ParseFloat(fields[0], 32); err != nil {
+			continue
+		}
+		if len(fields) != 3 && len(fields) != 6 && len(fields) != 7 {
+			return nil, fmt.Errorf("line %d: expected 3, 6 or 7 values, got %d", lineno, len(fields))
+		}
+		// Missing color components are marked as negative and set to their
+		// defaults once the color range is known.
+		v := [7]float32{0, 0, 0, -1, -1, -1, -1}
+		for i, f := range fields {
+			n, err := strconv.ParseFloat(f, 32)
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %w", lineno, err)
+			}
+			v[i] = float32(n)
+			if i >= 3 && n > 1 {
+				eightBit = true
+			}
+		}
+		cloud.add(v[0], v[1], v[2], v[3], v[4], v[5], v[6])
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	for i, c := range cloud.Colors {
+		if c < 0 {
+			cloud.Colors[i] = 1
+		} else if eightBit {
+			cloud.Colors[i] = c / 255
+		}
+	}
+	return cloud, nil
+}
+
+type plyProperty struct {
+	name   string
+	typ    string
+	isList bool
+}
+
+type plyElement struct {
+	name       string
+	count      int
+	properties []plyProperty
+}
+
+// DecodePLY reads the vertex element of a PLY file. ASCII as well as little
+// and big endian binary encodings are supported.
+func DecodePLY(r io.Reader) (*Cloud, error) {
+	br := bufio.NewReader(r)
+	format, elements, err := readPLYHeader(br)
+	if err != nil {
+		return nil, err
+	}
+
+	cloud := &Cloud{}
+	for _, elem := range elements {
+		var readRow func() ([]float64, error)
+		switch format {
+		case "ascii":
+			readRow = func() ([]float64, error) { return readPLYRowASCII(br, elem) }
+		case "binary_little_endian":
+			readRow = func() ([]float64, error) { return readPLYRowBinary(br, elem, binary.LittleEndian) }
+		case "binary_big_endian":
+			readRow = func() ([]float64, error) { return readPLYRowBinary(br, elem, binary.BigEndian) }
+		default:
+			return nil, fmt.Errorf("unsupported PLY format %q", format)
+		}
+
+		if elem.name != "vertex" {
+			// Skip other elements, such as faces, that precede the vertices.
+			for i := 0; i < elem.count; i++ {
+				if _, err := readRow(); err != nil {
+					return nil, err
+				}
+			}
+			continue
+		}
+
+		index := map[string]int{}
+		for i, p := range elem.properties {
+			index[p.name] = i
+		}
+		for _, n := range []string{"x", "y", "z"} {
+			if _, ok := index[n]; !ok {
+				return nil, fmt.Errorf("PLY vertex element has no %q property", n)
+			}
+		}
+		colorScale := func(name string) float64 {
+			for _, p := range elem.properties {
+				if p.name == name && (p.typ == "uchar" || p.typ == "uint8") {
+					return 255
+				}
+			}
+			return 1
+		}
+		color := func(row []float64, name string) float32 {
+			if i, ok := index[name]; ok {
+				return float32(row[i] / colorScale(name))
+			}
+			return 1
+		}
+		for i := 0; i < elem.count; i++ {
+			row, err := readRow()
+			if err != nil {
+				return nil, err
+			}
+			cloud.add(
+				float32(row[index["x"]]), float32(row[index["y"]]), float32(row[index["z"]]),
+				color(row, "red"), color(row, "green"), color(row, "blue"), color(row, "alpha"),
+			)
+		}
+		return cloud, nil
+	}
+	return nil, fmt.Errorf("PLY file has no vertex element")
+}
+
+func readPLYHeader(br *bufio.Reader) (string, []plyElement, error) {
+	line, err := br.ReadString('\n')
+	if err != nil || strings.TrimSpace(line) != "ply" {
+		return "", nil, fmt.Errorf("not a PLY file")
+	}
+	var format string
+	var elements []plyElement
+	for {
+		line, err := br.ReadString('\n')
+		if err != nil {
+			return "", nil, fmt.Errorf("unterminated PLY header: %w", err)
+		}
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		switch fields[0] {
+		case "format":
+			if len(fields) < 2 {
+				return "", nil, fmt.Errorf("invalid PLY format line")
+			}
+			format = fields[1]
+		case "element":
+			if len(fields) != 3 {
+				return "", nil, fmt.Errorf("invalid PLY element line: %q", strings.TrimSpace(line))
+			}
+			count, err := strconv.Atoi(fields[2])
+			if err != nil {
+				return "", nil, fmt.Errorf("invalid PLY element count: %w", err)
+			}
+			elements = append(elements, plyElement{name: fields[1], count: count})
+		case "property":
+			if len(elements) == 0 {
+				return "", nil, fmt.Errorf("PLY property declared before any element")
+			}
+			elem := &elements[len(elements)-1]
+			if len(fields) == 5 && fields[1] == "list" {
+				elem.properties = append(elem.properties, plyProperty{name: fields[4], typ: fields[2] + " " + fields[3], isList: true})
+			} else if len(fields) == 3 {
+				elem.properties = append(elem.properties, plyProperty{name: fields[2], typ: fields[1]})
+			} else {
+				return "", nil, fmt.Errorf("invalid PLY property line: %q", strings.TrimSpace(line))
+			}
+		case "end_header":
+			return format, elements, nil
+		}
+	}
+}
+
+func readPLYRowASCII(br *bufio.Reader, elem plyElement) ([]float64, error) {
+	line, err := br.ReadString('\n')
+	if err != nil && (err != io.EOF || line == "") {
+		return nil, fmt.Errorf("unexpected end of PLY %s data: %w", elem.name, err)
+	}
+	fields := strings.Fields(line)
+	row := make([]float64, len(elem.properties))
+	i := 0
+	for j, p := range elem.properties {
+		if i >= len(fields) {
+			return nil, fmt.Errorf("short PLY %s row", elem.name)
+		}
+		if p.isList {
+			n, err := strconv.Atoi(fields[i])
+			if err != nil {
+				return nil, err
+			}
+			i += 1 + n
+			continue
+		}
+		v, err := strconv.ParseFloat(fields[i], 64)
+		if err != nil {
+			return nil, err
+		}
+		row[j] = v
+		i++
+	}
+	return row, nil
+}
+
+func readPLYRowBinary(br *bufio.Reader, elem plyElement, order binary.ByteOrder) ([]float64, error) {
+	row := make([]float64, len(elem.properties))
+	for j, p := range elem.properties {
+		if p.isList {
+			types := strings.SplitN(p.typ, " ", 2)
+			n, err := readPLYScalar(br, types[0], order)
+			if err != nil {
+				return nil, err
+			}
+			for k := 0; k < int(n); k++ {
+				if _, err := readPLYScalar(br, types[1], order); err != nil {
+					return nil, err
+				}
+			}
+			continue
+		}
+		v, err := readPLYScalar(br, p.typ, order)
+		if err != nil {
+			return nil, err
+		}
+		row[j] = v
+	}
+	return row, nil
+}
+
+func readPLYScalar(r io.Reader, typ string, order binary.ByteOrder) (float64, error) {
+	var size int
+	switch typ {
+	case "char", "int8", "uchar", "uint8":
+		size = 1
+	case "short", "int16", "ushort", "uint16":
+		size = 2
+	case "int", "int32", "uint", "uint32", "float", "float32":
+		size = 4
+	case "double", "float64":
+		size = 8
+	default:
+		return 0, fmt.Errorf("unknown PLY type %q", typ)
+	}
+	var buf [8]byte
+	if _, err := io.ReadFull(r, buf[:size]); err != nil {
+		return 0, fmt.Errorf("unexpected end of PLY data: %w", err)
+	}
+	switch typ {
+	case "char", "int8":
+		return float64(int8(buf[0])), nil
+	case "uchar", "uint8":
+		return float64(buf[0]), nil
+	case "short", "int16":
+		return float64(int16(order.Uint16(buf[:]))), nil
+	case "ushort", "uint16":
+		return float64(order.Uint16(buf[:])), nil
+	case "int", "int32":
+		return float64(int32(order.Uint32(buf[:]))), nil
+	case "uint", "uint32":
+		return float64(order.Uint32(buf[:])), nil
+	case "float", "float32":
+		return float64(math.Float32frombits(order.Uint32(buf[:]))), nil
+	default:
+		return math.Float64frombits(order.Uint64(buf[:])), nil
+	}
+}
@@ -0,0 +1,82 @@
+package pointcloud
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math"
+	"strings"
+	"testing"
+)
+
+func TestDecodeCSV(t *testing.T) {
+	cloud, err := DecodeCSV(strings.NewReader(`x,y,z,r,g,b
+0,1,2,255,0,0
+3 4 5 0 255 0
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cloud.Positions) != 8 {
+		t.Fatalf("unexpected number of points: exp %v, got %v", 2, len(cloud.Positions)/4)
+	}
+	if cloud.Positions[4] != 3 || cloud.Positions[7] != 1 {
+		t.Fatalf("unexpected position: %v", cloud.Positions[4:8])
+	}
+	if cloud.Colors[0] != 1 || cloud.Colors[5] != 1 || cloud.Colors[3] != 1 {
+		t.Fatalf("unexpected colors: %v", cloud.Colors)
+	}
+}
+
+func TestDecodePLYASCII(t *testing.T) {
+	cloud, err := DecodePLY(strings.NewReader(`ply
+format ascii 1.0
+comment a triangle
+element vertex 3
+property float x
+property float y
+property float z
+property uchar red
+property uchar green
+property uchar blue
+element face 1
+property list uchar int vertex_indices
+end_header
+0 0 0 255 255 255
+1 0 0 255 0 0
+0 1 0 0 0 255
+3 0 1 2
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cloud.Positions) != 12 {
+		t.Fatalf("unexpected number of points: exp %v, got %v", 3, len(cloud.Positions)/4)
+	}
+	if cloud.Positions[4] != 1 || cloud.Colors[5] != 0 || cloud.Colors[10] != 1 {
+		t.Fatalf("unexpected point data: %v %v", cloud.Positions, cloud.Colors)
+	}
+}
+
+func TestDecodePLYBinary(t *testing.T) {
+	var buf bytes.Buffer
+	buf.WriteString("ply\nformat binary_little_endian 1.0\nelement vertex 2\nproperty float x\nproperty float y\nproperty double z\nend_header\n")
+	for _, p := range [][3]float64{{1, 2, 3}, {-1, -2, -3}} {
+		binary.Write(&buf, binary.LittleEndian, math.Float32bits(float32(p[0])))
+		binary.Write(&buf, binary.LittleEndian, math.Float32bits(float32(p[1])))
+		binary.Write(&buf, binary.LittleEndian, math.Float64bits(p[2]))
+	}
+
+	cloud, err := DecodePLY(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	exp := []float32{1, 2, 3, 1, -1, -2, -3, 1}
+	for i, v := range exp {
+		if cloud.Positions[i] != v {
+			t.Fatalf("unexpected positions: exp %v, got %v", exp, cloud.Positions)
+		}
+	}
+	if cloud.Colors[0] != 1 {
+		t.Fatalf("expected default white color, got %v", cloud.Colors[:4])
+	}
+}
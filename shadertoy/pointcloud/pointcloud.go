@@ -0,0 +1,106 @@
+package pointcloud
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/go-gl/gl/v3.3-core/gl"
+
+	"github.com/polyfloyd/shady/renderer"
+	"github.com/polyfloyd/shady/shadertoy"
+)
+
+func init() {
+	shadertoy.RegisterResourceType("pointcloud", func(m shadertoy.Mapping, genTexID shadertoy.GenTexFunc, _ renderer.RenderState) (shadertoy.Resource, error) {
+		path, err := shadertoy.ResolvePath(m.PWD, m.Value)
+		if err != nil {
+			return nil, err
+		}
+		fd, err := os.Open(path)
+		if err != nil {
+			return nil, err
+		}
+		defer fd.Close()
+		cloud, err := Decode(fd, path)
+		if err != nil {
+			return nil, fmt.Errorf("could not load point cloud %q: %w", path, err)
+		}
+		return newPointCloudBuffer(m.Name, cloud, genTexID(), genTexID()), nil
+	})
+}
+
+// pointCloudBuffer is a mapping of a set of points to a pair of buffer
+// textures.
+type pointCloudBuffer struct {
+	uniformName string
+	count       int
+
+	posIndex, colorIndex uint32
+	posBuf, colorBuf     uint32
+	posTex, colorTex     uint32
+}
+
+func newPointCloudBuffer(uniformName string, cloud *Cloud, posIndex, colorIndex uint32) *pointCloudBuffer {
+	pb := &pointCloudBuffer{
+		uniformName: uniformName,
+		count:       len(cloud.Positions) / 4,
+		posIndex:    posIndex,
+		colorIndex:  colorIndex,
+	}
+	pb.posBuf, pb.posTex = createBufferTexture(cloud.Positions)
+	pb.colorBuf, pb.colorTex = createBufferTexture(cloud.Colors)
+	return pb
+}
+
+func createBufferTexture(data []float32) (buf, tex uint32) {
+	gl.GenBuffers(1, &buf)
+	gl.BindBuffer(gl.TEXTURE_BUFFER, buf)
+	if len(data) > 0 {
+		gl.BufferData(gl.TEXTURE_BUFFER, len(data)*4, gl.Ptr(data), gl.STATIC_DRAW)
+	} else {
+		// Ensure that a valid, albeit empty, data store is attached.
+		gl.BufferData(gl.TEXTURE_BUFFER, 16, nil, gl.STATIC_DRAW)
+	}
+	gl.GenTextures(1, &tex)
+	gl.BindTexture(gl.TEXTURE_BUFFER, tex)
+	gl.TexBuffer(gl.TEXTURE_BUFFER, gl.RGBA32F, buf)
+	gl.BindTexture(gl.TEXTURE_BUFFER, 0)
+	gl.BindBuffer(gl.TEXTURE_BUFFER, 0)
+	return
+}
+
+func (pb *pointCloudBuffer) UniformSource() string {
+	return fmt.Sprintf(`
+		uniform samplerBuffer %s;
+		uniform samplerBuffer %sColor;
+		uniform int %sCount;
+	`, pb.uniformName, pb.uniformName, pb.uniformName)
+}
+
+// Idle implements the shadertoy.IdleResource interface, the points are loaded
+// once.
+func (pb *pointCloudBuffer) Idle(renderer.RenderState) bool { return true }
+
+func (pb *pointCloudBuffer) PreRender(state renderer.RenderState) {
+	if loc, ok := state.Uniforms[pb.uniformName]; ok {
+		gl.ActiveTexture(gl.TEXTURE0 + pb.posIndex)
+		gl.BindTexture(gl.TEXTURE_BUFFER, pb.posTex)
+		gl.Uniform1i(loc.Location, int32(pb.posIndex))
+	}
+	if loc, ok := state.Uniforms[fmt.Sprintf("%sColor", pb.uniformName)]; ok {
+		gl.ActiveTexture(gl.TEXTURE0 + pb.colorIndex)
+		gl.BindTexture(gl.TEXTURE_BUFFER, pb.colorTex)
+		gl.Uniform1i(loc.Location, int32(pb.colorIndex))
+	}
+	if loc, ok := state.Uniforms[fmt.Sprintf("%sCount", pb.uniformName)]; ok {
+		gl.Uniform1i(loc.Location, int32(pb.count))
+	}
+}
+
+func (pb *pointCloudBuffer) Close() error {
+	gl.DeleteTextures(1, &pb.posTex)
+	gl.DeleteTextures(1, &pb.colorTex)
+	gl.DeleteBuffers(1, &pb.posBuf)
+	gl.DeleteBuffers(1, &pb.colorBuf)
+	return nil
+}
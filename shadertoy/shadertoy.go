@@ -5,6 +5,7 @@ import (
 	"os"
 	"path/filepath"
 	"regexp"
+	"sort"
 	"strings"
 	"time"
 
@@ -16,6 +17,7 @@ import (
 var (
 	inputMappingSourceRe = regexp.MustCompile(`(?m)^#pragma\s+map\s+(\w+)=([^:]+):(.+)$`)
 	inputMappingRe       = regexp.MustCompile(`^(\w+)=([^:]+):(.+)$`)
+	bufferPassSourceRe   = regexp.MustCompile(`(?m)^#pragma\s+buffer\s+"([^"]+)"\s+as\s+(\w+)((?:[ \t]+\w+)*)[ \t]*$`)
 	IchannelNumRe        = regexp.MustCompile(`^iChannel(\d+)$`)
 )
 
@@ -31,6 +33,14 @@ var texIndexEnum uint32
 var resourceBuilders = map[string]ResourceBuildFunc{}
 
 type GenTexFunc func() uint32
+
+// GenBindingFunc allocates a binding point of a uniform buffer.
+type GenBindingFunc func() (uint32, error)
+
+// GenOutputFunc allocates the location of an output of the fragment shader
+// besides the image, which is at location 0.
+type GenOutputFunc func() (uint32, error)
+
 type ResourceBuildFunc func(Mapping, GenTexFunc, renderer.RenderState) (Resource, error)
 
 func RegisterResourceType(name string, fn ResourceBuildFunc) {
@@ -40,18 +50,32 @@ func RegisterResourceType(name string, fn ResourceBuildFunc) {
 	resourceBuilders[name] = fn
 }
 
+// ResourceTypes returns the sorted names of all registered resource types.
+func ResourceTypes() []string {
+	names := make([]string, 0, len(resourceBuilders))
+	for name := range resourceBuilders {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
 // ShaderToy implements a shader environment similar to the one on
 // shadertoy.com.
 type ShaderToy struct {
-	shaderSources []renderer.SourceFile
+	shaderSources []renderer.Source
 	mappings      []Mapping
+	resolver      renderer.Resolver
 	glslVersion   string
+	// passes are the buffer passes of the parent environment if this
+	// environment renders one of them.
+	passes []*bufferImage
 
 	resources []Resource
 }
 
 func NewShaderToy(
-	shaderSources []renderer.SourceFile,
+	shaderSources []renderer.Source,
 	overrideMappings []Mapping,
 	glslVersion string,
 ) (*ShaderToy, error) {
@@ -85,36 +109,85 @@ func (st ShaderToy) Sources() (map[renderer.Stage][]renderer.Source, error) {
 				uniform vec3 iResolution;
 				uniform float iTime;
 				uniform float iTimeDelta;
-				uniform float iFrame;
+				uniform float iLoopTime;
+				uniform int iFrame;
+				uniform int iSample;
 				uniform float iChannelTime[4];
 				uniform vec4 iMouse;
 				uniform vec4 iDate;
 				uniform float iSampleRate;
 				uniform vec3 iChannelResolution[4];
+				uniform vec2 iTileOffset;
 			`, st.glslVersion)))
+			for _, pass := range st.passes {
+				ss = append(ss, renderer.SourceBuf(pass.UniformSource()))
+			}
 			for _, res := range st.resources {
 				ss = append(ss, renderer.SourceBuf(res.UniformSource()))
 			}
 			for _, s := range st.shaderSources {
 				ss = append(ss, s)
 			}
-			ss = append(ss, renderer.SourceBuf(`
+			// gl_FragColor can not be combined with the outputs of
+			// resources.
+			output, fragColor := "", "gl_FragColor"
+			if len(st.Outputs()) > 0 {
+				output, fragColor = "layout(location = 0) out vec4 shadyFragColor;", "shadyFragColor"
+			}
+			ss = append(ss, renderer.SourceBuf(fmt.Sprintf(`
+				%s
 				void main(void) {
-					vec2 pos = gl_FragCoord.xy;
+					vec2 pos = gl_FragCoord.xy + iTileOffset;
 					pos.y = iResolution.y - pos.y - 1;
-					mainImage(gl_FragColor, pos);
+					mainImage(%s, pos);
 				}
-			`))
+			`, output, fragColor)))
 			return ss
 		}(),
 	}, nil
 }
 
+// SetResolver sets the resolver of the includes of the shaders that are loaded
+// by mappings, like buffers. It must be called before Setup.
+func (st *ShaderToy) SetResolver(resolver renderer.Resolver) {
+	st.resolver = resolver
+}
+
 func (st *ShaderToy) Setup(state renderer.RenderState) error {
 	if st.resources != nil {
 		return fmt.Errorf("double call to ShaderToy.Setup")
 	}
+	var numBindings uint32
+	genBinding := func() (uint32, error) {
+		var maxBindings int32
+		gl.GetIntegerv(gl.MAX_UNIFORM_BUFFER_BINDINGS, &maxBindings)
+		if numBindings >= uint32(maxBindings) {
+			return 0, fmt.Errorf("no more than %d uniform blocks can be mapped", maxBindings)
+		}
+		numBindings++
+		return numBindings - 1, nil
+	}
+	numOutputs := uint32(1)
+	genOutput := func() (uint32, error) {
+		var maxBuffers int32
+		gl.GetIntegerv(gl.MAX_DRAW_BUFFERS, &maxBuffers)
+		if numOutputs >= uint32(maxBuffers) {
+			return 0, fmt.Errorf("no more than %d outputs can be mapped", maxBuffers-1)
+		}
+		numOutputs++
+		return numOutputs - 1, nil
+	}
+mappings:
 	for _, mapping := range st.mappings {
+		// Passes can not redeclare the passes they are a part of.
+		for _, pass := range st.passes {
+			if mapping.Name == pass.name {
+				continue mappings
+			}
+		}
+		mapping.Resolver = st.resolver
+		mapping.GenBinding = genBinding
+		mapping.GenOutput = genOutput
 		res, err := mapping.resource(state)
 		if err != nil {
 			return err
@@ -127,6 +200,15 @@ func (st *ShaderToy) Setup(state renderer.RenderState) error {
 }
 
 func (st ShaderToy) SubEnvironments() (map[string]renderer.SubEnvironment, error) {
+	var passes []*bufferImage
+	var passNames []string
+	for _, res := range st.resources {
+		if bi, ok := res.(*bufferImage); ok && bi.pass {
+			passes = append(passes, bi)
+			passNames = append(passNames, bi.name)
+		}
+	}
+
 	envs := map[string]renderer.SubEnvironment{}
 	for _, res := range st.resources {
 		if bi, ok := res.(*bufferImage); ok {
@@ -134,11 +216,25 @@ func (st ShaderToy) SubEnvironments() (map[string]renderer.SubEnvironment, error
 			if err != nil {
 				return nil, err
 			}
-			envs[bi.name] = renderer.SubEnvironment{
+			env.resolver = st.resolver
+			sub := renderer.SubEnvironment{
 				Environment: env,
 				Width:       bi.width,
 				Height:      bi.height,
+				Format:      bi.format,
+			}
+			if bi.pass {
+				// Passes are rendered in the order they are declared in
+				// and can read each other, like the buffers of Shadertoy.
+				env.passes = passes
+				sub.Inputs = passNames
+				for i, pass := range passes {
+					if pass == bi {
+						sub.Order = i
+					}
+				}
 			}
+			envs[bi.name] = sub
 		}
 	}
 	return envs, nil
@@ -146,8 +242,18 @@ func (st ShaderToy) SubEnvironments() (map[string]renderer.SubEnvironment, error
 
 func (st ShaderToy) PreRender(state renderer.RenderState) {
 	// https://shadertoyunofficial.wordpress.com/2016/07/20/special-shadertoy-features/
+	// When rendering in tiles, the shader renders a part of the whole image.
+	width, height := state.CanvasWidth, state.CanvasHeight
+	var tileX, tileY uint
+	if state.Tile != nil {
+		width, height = state.Tile.ImageWidth, state.Tile.ImageHeight
+		tileX, tileY = state.Tile.X, state.Tile.Y
+	}
 	if loc, ok := state.Uniforms["iResolution"]; ok {
-		gl.Uniform3f(loc.Location, float32(state.CanvasWidth), float32(state.CanvasHeight), 0.0)
+		gl.Uniform3f(loc.Location, float32(width), float32(height), 0.0)
+	}
+	if loc, ok := state.Uniforms["iTileOffset"]; ok {
+		gl.Uniform2f(loc.Location, float32(tileX), float32(tileY))
 	}
 	if loc, ok := state.Uniforms["iTime"]; ok {
 		gl.Uniform1f(loc.Location, float32(state.Time)/float32(time.Second))
@@ -155,8 +261,14 @@ func (st ShaderToy) PreRender(state renderer.RenderState) {
 	if loc, ok := state.Uniforms["iTimeDelta"]; ok {
 		gl.Uniform1f(loc.Location, float32(state.Interval)/float32(time.Second))
 	}
+	if loc, ok := state.Uniforms["iLoopTime"]; ok {
+		gl.Uniform1f(loc.Location, float32(loopTime(state.Time, state.Loop)))
+	}
 	if loc, ok := state.Uniforms["iDate"]; ok {
-		t := time.Now()
+		t := state.Date
+		if t.IsZero() {
+			t = time.Now()
+		}
 		sinceMidnight := t.Sub(t.Truncate(time.Hour * 24))
 		gl.Uniform4f(loc.Location,
 			float32(t.Year()-1),
@@ -166,13 +278,99 @@ func (st ShaderToy) PreRender(state renderer.RenderState) {
 		)
 	}
 	if loc, ok := state.Uniforms["iFrame"]; ok {
-		gl.Uniform1f(loc.Location, float32(state.FramesProcessed))
+		gl.Uniform1i(loc.Location, int32(state.FramesProcessed))
+	}
+	if loc, ok := state.Uniforms["iSample"]; ok {
+		gl.Uniform1i(loc.Location, int32(state.Sample))
+	}
+	if loc, ok := state.Uniforms["iMouse"]; ok && state.Input != nil {
+		m := state.Input.Mouse
+		gl.Uniform4f(loc.Location, m[0], m[1], m[2], m[3])
+	}
+	for name, t := range state.Clocks {
+		if loc, ok := state.Uniforms[name]; ok {
+			gl.Uniform1f(loc.Location, float32(t)/float32(time.Second))
+		}
+	}
+	for _, pass := range st.passes {
+		pass.PreRender(state)
 	}
 	for _, resource := range st.resources {
 		resource.PreRender(state)
 	}
 }
 
+// loopTime returns the progress through the loop at time t, from 0 up to 1.
+// It is 0 if the animation does not loop.
+func loopTime(t, loop time.Duration) float64 {
+	if loop <= 0 {
+		return 0
+	}
+	t %= loop
+	if t < 0 {
+		t += loop
+	}
+	return float64(t) / float64(loop)
+}
+
+// Idle implements the renderer.IdleEnvironment interface. Frames are idle if
+// the program does not use any of the uniforms that change every frame and all
+// resources are idle.
+func (st ShaderToy) Idle(state renderer.RenderState) bool {
+	for _, name := range []string{"iTime", "iTimeDelta", "iLoopTime", "iFrame", "iDate"} {
+		if _, ok := state.Uniforms[name]; ok {
+			return false
+		}
+	}
+	for name := range state.Clocks {
+		if _, ok := state.Uniforms[name]; ok {
+			return false
+		}
+	}
+	if _, ok := state.Uniforms["iMouse"]; ok && state.Input != nil && state.Input.MouseChanged() {
+		return false
+	}
+	for _, res := range st.resources {
+		if r, ok := res.(IdleResource); !ok || !r.Idle(state) {
+			return false
+		}
+	}
+	return true
+}
+
+// Outputs implements the renderer.OutputEnvironment interface with the outputs
+// of the resources that implement OutputResource.
+func (st ShaderToy) Outputs() []uint32 {
+	var outputs []uint32
+	for _, res := range st.resources {
+		if r, ok := res.(OutputResource); ok {
+			location, tex := r.Output()
+			for uint32(len(outputs)) < location {
+				outputs = append(outputs, 0)
+			}
+			outputs[location-1] = tex
+		}
+	}
+	return outputs
+}
+
+// Resume implements the renderer.ResumeEnvironment interface by resuming the
+// resources that implement ResumeResource.
+func (st *ShaderToy) Resume() {
+	for _, res := range st.resources {
+		if r, ok := res.(ResumeResource); ok {
+			r.Resume()
+		}
+	}
+}
+
+// PreRenderSample implements the renderer.SamplePreRenderer interface.
+func (st ShaderToy) PreRenderSample(state renderer.RenderState) {
+	if loc, ok := state.Uniforms["iSample"]; ok {
+		gl.Uniform1i(loc.Location, int32(state.Sample))
+	}
+}
+
 func (st *ShaderToy) Close() error {
 	var errors []string
 	for _, res := range st.resources {
@@ -192,6 +390,35 @@ type Resource interface {
 	Close() error
 }
 
+// An IdleResource is a Resource that can tell whether it changed since the
+// previous frame. Resources that do not implement it are assumed to change
+// every frame.
+type IdleResource interface {
+	Resource
+	// Idle reports whether the values of the resource are the same as for
+	// the previous frame.
+	Idle(state renderer.RenderState) bool
+}
+
+// An OutputResource is a Resource that the fragment shader also writes to,
+// through an output that its UniformSource declares at a location allocated
+// with Mapping.GenOutput.
+type OutputResource interface {
+	Resource
+	// Output returns the location of the output and the texture that it
+	// writes to in the frame that PreRender prepared.
+	Output() (location, tex uint32)
+}
+
+// A ResumeResource is a Resource with an input that may not survive a suspend
+// of the system, like a webcam.
+type ResumeResource interface {
+	Resource
+	// Resume reinitializes the input after the system resumed from a
+	// suspend. It is called from the thread of the OpenGL context.
+	Resume()
+}
+
 // A Mapping is a parsed representation of a "map <name>=<namespace>:<value>"
 // directive.
 type Mapping struct {
@@ -199,6 +426,18 @@ type Mapping struct {
 	Namespace string
 	Value     string
 	PWD       string
+	// Pass is set for buffers that are declared with a buffer pragma, see
+	// extractMappings.
+	Pass bool
+	// Resolver resolves the includes of shaders that are loaded by the
+	// mapping, like buffers. If nil, includes are resolved on disk.
+	Resolver renderer.Resolver
+	// GenBinding allocates the binding points of uniform blocks of the
+	// mapping, which are unique within the environment. It is set by Setup.
+	GenBinding GenBindingFunc
+	// GenOutput allocates the locations of outputs of the fragment shader,
+	// see OutputResource. It is set by Setup.
+	GenOutput GenOutputFunc
 }
 
 func ParseMapping(str, pwd string) (Mapping, error) {
@@ -214,7 +453,7 @@ func ParseMapping(str, pwd string) (Mapping, error) {
 	return Mapping{}, fmt.Errorf("unable to parse mapping from %q", str)
 }
 
-func extractMappings(shaderSources []renderer.SourceFile) ([]Mapping, error) {
+func extractMappings(shaderSources []renderer.Source) ([]Mapping, error) {
 	mappings := []Mapping{}
 	for _, s := range shaderSources {
 		src, err := s.Contents()
@@ -230,6 +469,21 @@ func extractMappings(shaderSources []renderer.SourceFile) ([]Mapping, error) {
 				PWD:       s.Dir(),
 			})
 		}
+		// `#pragma buffer "file.glsl" as Name [WxH] [format]` is a buffer
+		// mapping of which the size defaults to that of the canvas.
+		for _, match := range bufferPassSourceRe.FindAllSubmatch(src, -1) {
+			value := string(match[1])
+			for _, option := range strings.Fields(string(match[3])) {
+				value += ";" + option
+			}
+			mappings = append(mappings, Mapping{
+				Name:      string(match[2]),
+				Namespace: "buffer",
+				Value:     value,
+				PWD:       s.Dir(),
+				Pass:      true,
+			})
+		}
 	}
 	return deduplicateMappings(mappings...), nil
 }
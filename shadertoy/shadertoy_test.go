@@ -0,0 +1,151 @@
+package shadertoy
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/polyfloyd/shady/renderer"
+)
+
+func TestExtractBufferPasses(t *testing.T) {
+	dir := t.TempDir()
+	filename := filepath.Join(dir, "image.glsl")
+	src := `#pragma buffer "feedback.glsl" as BufA
+#pragma buffer "sim.glsl" as BufB 256x128 rgba32f
+#pragma map iChannel0=buffer:other.glsl;64x64
+#pragma buffer "feedback.glsl" as BufA
+void mainImage(out vec4 fragColor, in vec2 fragCoord) {}
+`
+	if err := ioutil.WriteFile(filename, []byte(src), 0644); err != nil {
+		t.Fatal(err)
+	}
+	mappings, err := extractMappings(renderer.SourceFiles(filename))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []Mapping{
+		{Name: "iChannel0", Namespace: "buffer", Value: "other.glsl;64x64", PWD: dir},
+		{Name: "BufA", Namespace: "buffer", Value: "feedback.glsl", PWD: dir, Pass: true},
+		{Name: "BufB", Namespace: "buffer", Value: "sim.glsl;256x128;rgba32f", PWD: dir, Pass: true},
+	}
+	if !reflect.DeepEqual(mappings, expected) {
+		t.Errorf("mappings = %+v, expected %+v", mappings, expected)
+	}
+
+	for value, ok := range map[string]bool{
+		"feedback.glsl":                true,
+		"feedback.glsl;rgba16f":        true,
+		"feedback.glsl;512x512":        true,
+		"feedback.glsl;512x512;rgba8":  true,
+		"feedback.glsl;rgba16f;512x52": false,
+	} {
+		if bufferValueRe.MatchString(value) != ok {
+			t.Errorf("buffer value %q matches: %v, expected %v", value, !ok, ok)
+		}
+	}
+}
+
+func TestExtractMappingsFromIncludes(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string]string{
+		"image.glsl":      "#pragma use \"lib/common.glsl\"\n#pragma map iChannel0=image:noise.png\n",
+		"lib/common.glsl": "#pragma map myTex=image:foo.png\n",
+	}
+	for name, src := range files {
+		filename := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(filename), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(filename, []byte(src), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	sources, err := renderer.Includes(filepath.Join(dir, "image.glsl"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	mappings, err := extractMappings(renderer.SourceFiles(sources...))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Paths are relative to the file that declares the mapping.
+	expected := []Mapping{
+		{Name: "myTex", Namespace: "image", Value: "foo.png", PWD: filepath.Join(dir, "lib")},
+		{Name: "iChannel0", Namespace: "image", Value: "noise.png", PWD: dir},
+	}
+	if !reflect.DeepEqual(mappings, expected) {
+		t.Errorf("mappings = %+v, expected %+v", mappings, expected)
+	}
+}
+
+type changingResource struct{ bufferImage }
+
+func (changingResource) Idle(renderer.RenderState) bool { return false }
+
+func TestIdle(t *testing.T) {
+	uniforms := func(names ...string) map[string]renderer.Uniform {
+		m := map[string]renderer.Uniform{}
+		for _, name := range names {
+			m[name] = renderer.Uniform{}
+		}
+		return m
+	}
+	still := ShaderToy{resources: []Resource{&bufferImage{}}}
+	cases := []struct {
+		env   ShaderToy
+		state renderer.RenderState
+		idle  bool
+	}{
+		{still, renderer.RenderState{Uniforms: uniforms("iResolution", "iChannel0")}, true},
+		{still, renderer.RenderState{Uniforms: uniforms("iResolution", "iTime")}, false},
+		{still, renderer.RenderState{Uniforms: uniforms("iDate")}, false},
+		{still, renderer.RenderState{Uniforms: uniforms("iLoopTime")}, false},
+		{still, renderer.RenderState{Uniforms: uniforms("beat"), Clocks: map[string]time.Duration{"beat": 0}}, false},
+		{still, renderer.RenderState{Uniforms: uniforms(), Clocks: map[string]time.Duration{"beat": 0}}, true},
+		{ShaderToy{resources: []Resource{&changingResource{}}}, renderer.RenderState{Uniforms: uniforms()}, false},
+	}
+	for i, c := range cases {
+		if idle := c.env.Idle(c.state); idle != c.idle {
+			t.Errorf("%d: idle = %v, expected %v", i, idle, c.idle)
+		}
+	}
+}
+
+type resumingResource struct {
+	bufferImage
+	resumed int
+}
+
+func (r *resumingResource) Resume() { r.resumed++ }
+
+func TestResume(t *testing.T) {
+	res := &resumingResource{}
+	st := &ShaderToy{resources: []Resource{&bufferImage{}, res}}
+	st.Resume()
+	if res.resumed != 1 {
+		t.Fatalf("resumed %d times, expected 1", res.resumed)
+	}
+}
+
+func TestLoopTime(t *testing.T) {
+	cases := []struct {
+		t, loop  time.Duration
+		expected float64
+	}{
+		{time.Second, 0, 0},
+		{0, 4 * time.Second, 0},
+		{time.Second, 4 * time.Second, 0.25},
+		{4 * time.Second, 4 * time.Second, 0},
+		{9 * time.Second, 4 * time.Second, 0.25},
+		{-time.Second, 4 * time.Second, 0.75},
+	}
+	for _, c := range cases {
+		if v := loopTime(c.t, c.loop); v != c.expected {
+			t.Errorf("loopTime(%v, %v) = %v, expected %v", c.t, c.loop, v, c.expected)
+		}
+	}
+}
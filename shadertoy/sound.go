@@ -0,0 +1,88 @@
+package shadertoy
+
+import (
+	"fmt"
+
+	"github.com/go-gl/gl/v3.3-core/gl"
+
+	"github.com/polyfloyd/shady/renderer"
+)
+
+// Sound is an environment for sound shaders of Shadertoy, which compute
+// samples instead of pixels with:
+//
+//	vec2 mainSound(int samp, float time)
+//
+// The function returns the left and right sample at the index samp, which is
+// at time seconds. Every frame renders a block of consecutive samples, one
+// per pixel, to a float render target. Samples are ordered by gl_FragCoord,
+// row by row, so the block of frame N starts at sample N*width*height.
+type Sound struct {
+	shaderSources []renderer.Source
+	glslVersion   string
+	sampleRate    int
+	// startSample is the index of the sample of the first frame.
+	startSample int
+}
+
+func NewSound(shaderSources []renderer.Source, glslVersion string, sampleRate, startSample int) *Sound {
+	return &Sound{
+		shaderSources: shaderSources,
+		glslVersion:   glslVersion,
+		sampleRate:    sampleRate,
+		startSample:   startSample,
+	}
+}
+
+func (s *Sound) Sources() (map[renderer.Stage][]renderer.Source, error) {
+	fragment := []renderer.Source{renderer.SourceBuf(fmt.Sprintf(`
+		#version %s
+		uniform int iSampleOffset;
+		uniform float iSampleRate;
+		uniform int iBlockWidth;
+	`, s.glslVersion))}
+	fragment = append(fragment, s.shaderSources...)
+	fragment = append(fragment, renderer.SourceBuf(`
+		void main(void) {
+			ivec2 pos = ivec2(gl_FragCoord.xy);
+			int samp = iSampleOffset + pos.y * iBlockWidth + pos.x;
+			vec2 v = mainSound(samp, float(samp) / iSampleRate);
+			gl_FragColor = vec4(clamp(v, -1.0, 1.0), 0.0, 1.0);
+		}
+	`))
+	return map[renderer.Stage][]renderer.Source{
+		renderer.StageVertex: {renderer.SourceBuf(fmt.Sprintf(`
+			#version %s
+			attribute vec3 vert;
+			void main(void) {
+				gl_Position = vec4(vert, 1.0);
+			}
+		`, s.glslVersion))},
+		renderer.StageFragment: fragment,
+	}, nil
+}
+
+func (s *Sound) Setup(renderer.RenderState) error {
+	return nil
+}
+
+func (s *Sound) SubEnvironments() (map[string]renderer.SubEnvironment, error) {
+	return nil, nil
+}
+
+func (s *Sound) PreRender(state renderer.RenderState) {
+	blockSize := int(state.CanvasWidth * state.CanvasHeight)
+	if loc, ok := state.Uniforms["iSampleOffset"]; ok {
+		gl.Uniform1i(loc.Location, int32(s.startSample+int(state.FramesProcessed)*blockSize))
+	}
+	if loc, ok := state.Uniforms["iSampleRate"]; ok {
+		gl.Uniform1f(loc.Location, float32(s.sampleRate))
+	}
+	if loc, ok := state.Uniforms["iBlockWidth"]; ok {
+		gl.Uniform1i(loc.Location, int32(state.CanvasWidth))
+	}
+}
+
+func (s *Sound) Close() error {
+	return nil
+}
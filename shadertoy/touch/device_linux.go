@@ -0,0 +1,85 @@
+package touch
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+// inputEvent is struct input_event of linux/input.h.
+type inputEvent struct {
+	Time  syscall.Timeval
+	Type  uint16
+	Code  uint16
+	Value int32
+}
+
+// inputAbsinfo is struct input_absinfo of linux/input.h.
+type inputAbsinfo struct {
+	Value, Minimum, Maximum, Fuzz, Flat, Resolution int32
+}
+
+// eviocgabs returns the EVIOCGABS ioctl request for an axis.
+func eviocgabs(code uint16) uintptr {
+	const iocRead = 2
+	return iocRead<<30 | unsafe.Sizeof(inputAbsinfo{})<<16 | 'E'<<8 | uintptr(0x40+code)
+}
+
+// device is an evdev device, like /dev/input/event0.
+type device struct {
+	fd             *os.File
+	multitouch     bool
+	x, y, pressure axis
+}
+
+func openDevice(path string) (*device, error) {
+	fd, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	dev := &device{fd: fd}
+	if dev.x, err = dev.axis(absMTPositionX); err == nil && dev.x.valid() {
+		dev.multitouch = true
+		dev.y, _ = dev.axis(absMTPositionY)
+		dev.pressure, _ = dev.axis(absMTPressure)
+	} else {
+		dev.x, _ = dev.axis(absX)
+		dev.y, _ = dev.axis(absY)
+		dev.pressure, _ = dev.axis(absPressure)
+	}
+	if !dev.x.valid() || !dev.y.valid() {
+		fd.Close()
+		return nil, fmt.Errorf("%s is not a touch device", path)
+	}
+	return dev, nil
+}
+
+func (dev *device) axis(code uint16) (axis, error) {
+	var info inputAbsinfo
+	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, dev.fd.Fd(), eviocgabs(code), uintptr(unsafe.Pointer(&info)))
+	if errno != 0 {
+		return axis{}, errno
+	}
+	return axis{min: info.Minimum, max: info.Maximum}, nil
+}
+
+func (dev *device) readEvent() (event, error) {
+	var ev inputEvent
+	buf := (*[unsafe.Sizeof(inputEvent{})]byte)(unsafe.Pointer(&ev))[:]
+	if _, err := io.ReadFull(dev.fd, buf); err != nil {
+		return event{}, err
+	}
+	return event{
+		time:  time.Unix(ev.Time.Unix()),
+		typ:   ev.Type,
+		code:  ev.Code,
+		value: ev.Value,
+	}, nil
+}
+
+func (dev *device) Close() error {
+	return dev.fd.Close()
+}
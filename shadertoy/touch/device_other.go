@@ -0,0 +1,25 @@
+//go:build !linux
+
+package touch
+
+import (
+	"fmt"
+)
+
+// device is a stub for platforms without evdev.
+type device struct {
+	multitouch     bool
+	x, y, pressure axis
+}
+
+func openDevice(path string) (*device, error) {
+	return nil, fmt.Errorf("touch input is only supported on Linux")
+}
+
+func (dev *device) readEvent() (event, error) {
+	return event{}, fmt.Errorf("touch input is only supported on Linux")
+}
+
+func (dev *device) Close() error {
+	return nil
+}
@@ -0,0 +1,180 @@
+package touch
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"time"
+
+	"github.com/go-gl/gl/v3.3-core/gl"
+
+	"github.com/polyfloyd/shady/renderer"
+	"github.com/polyfloyd/shady/shadertoy"
+)
+
+const (
+	// defaultPoints is the number of touch points that are tracked if the
+	// mapping does not specify it.
+	defaultPoints = 10
+	maxPoints     = 64
+	// historyLength is the number of frames of which the touches are kept in
+	// the history texture.
+	historyLength = 64
+)
+
+func init() {
+	shadertoy.RegisterResourceType("touch", func(m shadertoy.Mapping, genTexID shadertoy.GenTexFunc, _ renderer.RenderState) (shadertoy.Resource, error) {
+		path, numPoints, err := parseValue(m.Value)
+		if err != nil {
+			return nil, err
+		}
+		dev, err := openDevice(path)
+		if err != nil {
+			return nil, err
+		}
+		return newTouchInput(m.Name, dev, numPoints, genTexID()), nil
+	})
+}
+
+var touchValueRe = regexp.MustCompile(`^([^;]+)(?:;(\d+))?$`)
+
+// parseValue parses the value of a touch mapping as "<device>[;<points>]".
+func parseValue(value string) (string, int, error) {
+	match := touchValueRe.FindStringSubmatch(value)
+	if match == nil {
+		return "", 0, fmt.Errorf("invalid touch mapping %q, expected <device>[;<points>]", value)
+	}
+	numPoints := defaultPoints
+	if match[2] != "" {
+		numPoints, _ = strconv.Atoi(match[2])
+		if numPoints < 1 || numPoints > maxPoints {
+			return "", 0, fmt.Errorf("the number of touch points must be between 1 and %d, got %d", maxPoints, numPoints)
+		}
+	}
+	return match[1], numPoints, nil
+}
+
+// touchInput is a mapping of the touches of a touchscreen to a uniform array
+// and a texture of their recent history.
+type touchInput struct {
+	uniformName string
+	dev         *device
+	tracker     *tracker
+	loopClosed  chan struct{}
+
+	values     []float32
+	history    []float32
+	idleFrames int
+	texID      uint32
+	index      uint32
+}
+
+func newTouchInput(uniformName string, dev *device, numPoints int, index uint32) *touchInput {
+	ti := &touchInput{
+		uniformName: uniformName,
+		dev:         dev,
+		tracker:     newTracker(numPoints, dev.multitouch, dev.x, dev.y, dev.pressure),
+		loopClosed:  make(chan struct{}),
+		values:      make([]float32, numPoints*4),
+		history:     make([]float32, numPoints*historyLength*4),
+		index:       index,
+	}
+
+	gl.GenTextures(1, &ti.texID)
+	gl.BindTexture(gl.TEXTURE_2D, ti.texID)
+	gl.TexImage2D(
+		gl.TEXTURE_2D,      // target
+		0,                  // level
+		gl.RGBA32F,         // internalFormat
+		historyLength,      // width
+		int32(numPoints),   // height
+		0,                  // border
+		gl.RGBA,            // format
+		gl.FLOAT,           // type
+		gl.Ptr(ti.history), // data
+	)
+	gl.TexParameteri(gl.TEXTURE_2D, gl.TEXTURE_WRAP_S, gl.CLAMP_TO_EDGE)
+	gl.TexParameteri(gl.TEXTURE_2D, gl.TEXTURE_WRAP_T, gl.CLAMP_TO_EDGE)
+	gl.TexParameteri(gl.TEXTURE_2D, gl.TEXTURE_MAG_FILTER, gl.NEAREST)
+	gl.TexParameteri(gl.TEXTURE_2D, gl.TEXTURE_MIN_FILTER, gl.NEAREST)
+	gl.BindTexture(gl.TEXTURE_2D, 0)
+
+	go func() {
+		defer close(ti.loopClosed)
+		for {
+			ev, err := dev.readEvent()
+			if err != nil {
+				// The device was closed or unplugged.
+				return
+			}
+			ti.tracker.handle(ev)
+		}
+	}()
+	return ti
+}
+
+func (ti *touchInput) UniformSource() string {
+	return fmt.Sprintf(`
+		uniform vec4 %[1]s[%[2]d];
+		uniform int %[1]sCount;
+		uniform sampler2D %[1]sHistory;
+	`, ti.uniformName, len(ti.values)/4)
+}
+
+// Idle implements the shadertoy.IdleResource interface. The touches are idle
+// once nothing is touched and the history has been cleared of old touches.
+func (ti *touchInput) Idle(renderer.RenderState) bool {
+	return ti.idleFrames >= historyLength && !ti.tracker.active()
+}
+
+func (ti *touchInput) PreRender(state renderer.RenderState) {
+	points, changed := ti.tracker.snapshot()
+	w, h := float32(state.CanvasWidth), float32(state.CanvasHeight)
+	now := time.Now()
+
+	var count int32
+	active := changed
+	for i, p := range points {
+		// Convert to pixels with the origin at the bottom left, like
+		// fragCoord.
+		x, y := p.x*w, (1-p.y)*h
+		held := float32(-1)
+		down := float32(0)
+		if p.down {
+			held = float32(now.Sub(p.since).Seconds())
+			down = 1
+			count++
+			active = true
+		}
+		copy(ti.values[i*4:], []float32{x, y, p.pressure, held})
+
+		row := ti.history[i*historyLength*4 : (i+1)*historyLength*4]
+		copy(row[4:], row[:len(row)-4])
+		copy(row, []float32{x, y, p.pressure, down})
+	}
+	if active {
+		ti.idleFrames = 0
+	} else {
+		ti.idleFrames++
+	}
+
+	gl.ActiveTexture(gl.TEXTURE0 + ti.index)
+	gl.BindTexture(gl.TEXTURE_2D, ti.texID)
+	gl.TexSubImage2D(gl.TEXTURE_2D, 0, 0, 0, historyLength, int32(len(points)), gl.RGBA, gl.FLOAT, gl.Ptr(ti.history))
+	if loc, ok := state.Uniforms[ti.uniformName+"History"]; ok {
+		gl.Uniform1i(loc.Location, int32(ti.index))
+	}
+	if loc, ok := state.Uniforms[ti.uniformName+"[0]"]; ok {
+		gl.Uniform4fv(loc.Location, int32(len(points)), &ti.values[0])
+	}
+	if loc, ok := state.Uniforms[ti.uniformName+"Count"]; ok {
+		gl.Uniform1i(loc.Location, count)
+	}
+}
+
+func (ti *touchInput) Close() error {
+	err := ti.dev.Close()
+	<-ti.loopClosed
+	gl.DeleteTextures(1, &ti.texID)
+	return err
+}
@@ -0,0 +1,191 @@
+package touch
+
+import (
+	"sync"
+	"time"
+)
+
+// Event types and codes of the Linux input subsystem, see
+// linux/input-event-codes.h.
+const (
+	evSyn = 0x00
+	evKey = 0x01
+	evAbs = 0x03
+
+	synReport  = 0x00
+	synDropped = 0x03
+
+	btnTouch = 0x14a
+
+	absX            = 0x00
+	absY            = 0x01
+	absPressure     = 0x18
+	absMTSlot       = 0x2f
+	absMTPositionX  = 0x35
+	absMTPositionY  = 0x36
+	absMTTrackingID = 0x39
+	absMTPressure   = 0x3a
+)
+
+type event struct {
+	time      time.Time
+	typ, code uint16
+	value     int32
+}
+
+// axis is the range of the values of an absolute axis of a device.
+type axis struct {
+	min, max int32
+}
+
+func (a axis) valid() bool {
+	return a.max > a.min
+}
+
+func (a axis) normalize(v int32) float32 {
+	if !a.valid() {
+		return 0
+	}
+	return float32(v-a.min) / float32(a.max-a.min)
+}
+
+// point is the state of a single touch.
+type point struct {
+	down bool
+	// x and y are normalized to [0, 1] with the origin at the top left, like
+	// the device reports them.
+	x, y     float32
+	pressure float32
+	// since is the time the point was touched.
+	since time.Time
+}
+
+// tracker keeps the state of the touches of a device from its events.
+//
+// Multitouch devices are expected to use the slot based protocol B, single
+// touch devices report their only point as slot 0.
+type tracker struct {
+	multitouch     bool
+	x, y, pressure axis
+
+	slot    int
+	dropped bool
+	pending []point
+
+	lock    sync.Mutex
+	points  []point
+	changed bool
+}
+
+func newTracker(numPoints int, multitouch bool, x, y, pressure axis) *tracker {
+	return &tracker{
+		multitouch: multitouch,
+		x:          x,
+		y:          y,
+		pressure:   pressure,
+		pending:    make([]point, numPoints),
+		points:     make([]point, numPoints),
+	}
+}
+
+// handle updates the touches with an event. The touches are committed at the
+// end of every report, so a frame never sees a partial update.
+func (t *tracker) handle(ev event) {
+	switch ev.typ {
+	case evSyn:
+		switch ev.code {
+		case synReport:
+			if t.dropped {
+				// Events were lost, so the state of the touches is unknown.
+				// Release them rather than leaving any stuck.
+				t.dropped = false
+				for i := range t.pending {
+					t.pending[i].down = false
+				}
+			}
+			t.lock.Lock()
+			copy(t.points, t.pending)
+			t.changed = true
+			t.lock.Unlock()
+		case synDropped:
+			t.dropped = true
+		}
+
+	case evKey:
+		if ev.code == btnTouch && !t.multitouch && !t.dropped && len(t.pending) > 0 {
+			t.setDown(&t.pending[0], ev.value != 0, ev.time)
+		}
+
+	case evAbs:
+		if t.dropped {
+			return
+		}
+		if ev.code == absMTSlot {
+			t.slot = int(ev.value)
+			return
+		}
+		var p *point
+		if t.multitouch {
+			if t.slot < 0 || t.slot >= len(t.pending) {
+				return
+			}
+			p = &t.pending[t.slot]
+		} else if len(t.pending) > 0 {
+			p = &t.pending[0]
+		} else {
+			return
+		}
+
+		switch code := ev.code; {
+		case t.multitouch && code == absMTTrackingID:
+			t.setDown(p, ev.value >= 0, ev.time)
+		case t.multitouch && code == absMTPositionX, !t.multitouch && code == absX:
+			p.x = t.x.normalize(ev.value)
+		case t.multitouch && code == absMTPositionY, !t.multitouch && code == absY:
+			p.y = t.y.normalize(ev.value)
+		case t.multitouch && code == absMTPressure, !t.multitouch && code == absPressure:
+			p.pressure = t.pressure.normalize(ev.value)
+		}
+	}
+}
+
+func (t *tracker) setDown(p *point, down bool, at time.Time) {
+	if down && !p.down {
+		p.since = at
+	}
+	p.down = down
+	if !t.pressure.valid() {
+		// Devices without pressure sensitivity report full pressure while
+		// they are touched.
+		p.pressure = 0
+		if down {
+			p.pressure = 1
+		}
+	}
+}
+
+// snapshot returns a copy of the touches and whether they changed since the
+// previous snapshot.
+func (t *tracker) snapshot() ([]point, bool) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	changed := t.changed
+	t.changed = false
+	return append([]point{}, t.points...), changed
+}
+
+// active reports whether the touches changed since the previous snapshot or
+// any point is touched.
+func (t *tracker) active() bool {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if t.changed {
+		return true
+	}
+	for _, p := range t.points {
+		if p.down {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,98 @@
+package touch
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTrackerMultitouch(t *testing.T) {
+	tr := newTracker(2, true, axis{0, 1000}, axis{0, 500}, axis{})
+	t0 := time.Unix(100, 0)
+	for _, ev := range []event{
+		{t0, evAbs, absMTSlot, 0},
+		{t0, evAbs, absMTTrackingID, 7},
+		{t0, evAbs, absMTPositionX, 250},
+		{t0, evAbs, absMTPositionY, 500},
+		{t0, evAbs, absMTSlot, 1},
+		{t0, evAbs, absMTTrackingID, 8},
+		{t0, evAbs, absMTPositionX, 1000},
+	} {
+		tr.handle(ev)
+	}
+	if points, changed := tr.snapshot(); changed || points[0].down {
+		t.Fatalf("touches were committed before the end of the report")
+	}
+
+	tr.handle(event{t0, evSyn, synReport, 0})
+	points, changed := tr.snapshot()
+	if !changed {
+		t.Fatalf("expected the touches to have changed")
+	}
+	expected := []point{
+		{down: true, x: 0.25, y: 1, pressure: 1, since: t0},
+		{down: true, x: 1, y: 0, pressure: 1, since: t0},
+	}
+	for i, p := range points {
+		if p != expected[i] {
+			t.Errorf("point %d: got %+v, expected %+v", i, p, expected[i])
+		}
+	}
+
+	t1 := t0.Add(time.Second)
+	for _, ev := range []event{
+		{t1, evAbs, absMTSlot, 0},
+		{t1, evAbs, absMTTrackingID, -1},
+		{t1, evAbs, absMTSlot, 5},
+		{t1, evAbs, absMTTrackingID, 9},
+		{t1, evSyn, synReport, 0},
+	} {
+		tr.handle(ev)
+	}
+	points, _ = tr.snapshot()
+	if points[0].down || !points[1].down || points[1].since != t0 {
+		t.Errorf("unexpected touches after release: %+v", points)
+	}
+	if _, changed := tr.snapshot(); changed {
+		t.Errorf("expected no changes since the previous snapshot")
+	}
+}
+
+func TestTrackerDropped(t *testing.T) {
+	tr := newTracker(1, false, axis{0, 100}, axis{0, 100}, axis{0, 255})
+	for _, ev := range []event{
+		{typ: evKey, code: btnTouch, value: 1},
+		{typ: evAbs, code: absX, value: 50},
+		{typ: evAbs, code: absPressure, value: 255},
+		{typ: evSyn, code: synReport},
+	} {
+		tr.handle(ev)
+	}
+	if points, _ := tr.snapshot(); !points[0].down || points[0].x != 0.5 || points[0].pressure != 1 {
+		t.Fatalf("unexpected single touch: %+v", points[0])
+	}
+
+	for _, ev := range []event{
+		{typ: evSyn, code: synDropped},
+		{typ: evAbs, code: absX, value: 10},
+		{typ: evSyn, code: synReport},
+	} {
+		tr.handle(ev)
+	}
+	if points, _ := tr.snapshot(); points[0].down || points[0].x != 0.5 {
+		t.Errorf("expected the touch to be released after dropped events: %+v", points[0])
+	}
+}
+
+func TestParseValue(t *testing.T) {
+	if path, n, err := parseValue("/dev/input/event3"); err != nil || path != "/dev/input/event3" || n != defaultPoints {
+		t.Errorf("got %q, %d, %v", path, n, err)
+	}
+	if path, n, err := parseValue("/dev/input/event3;4"); err != nil || path != "/dev/input/event3" || n != 4 {
+		t.Errorf("got %q, %d, %v", path, n, err)
+	}
+	for _, value := range []string{"", "/dev/input/event3;0", "/dev/input/event3;1000", "/dev/input/event3;x"} {
+		if _, _, err := parseValue(value); err == nil {
+			t.Errorf("%q: expected an error", value)
+		}
+	}
+}
@@ -7,7 +7,9 @@ import (
 	"fmt"
 	"image"
 	"io"
+	"log"
 	"os/exec"
+	"regexp"
 	"strconv"
 	"strings"
 	"time"
@@ -20,32 +22,95 @@ import (
 
 func init() {
 	shadertoy.RegisterResourceType("video", func(m shadertoy.Mapping, genTexID shadertoy.GenTexFunc, state renderer.RenderState) (shadertoy.Resource, error) {
-		path, err := shadertoy.ResolvePath(m.PWD, m.Value)
+		src, err := parseMappingValue(m.PWD, m.Value)
 		if err != nil {
 			return nil, err
 		}
-		r, err := newVideoTexture(m.Name, path, genTexID(), state.Time)
+		r, err := newVideoTexture(m.Name, src, genTexID(), state.Time)
 		return r, err
 	})
 }
 
+var valueRe = regexp.MustCompile(`^([^;]+)(?:;(\d+)x(\d+))?$`)
+
+// source is a video file or a capture device like a webcam.
+type source struct {
+	path string
+	// size is the resolution requested from capture devices. If zero, the
+	// device picks one.
+	size image.Point
+}
+
+func parseMappingValue(pwd, value string) (source, error) {
+	match := valueRe.FindStringSubmatch(value)
+	if match == nil {
+		return source{}, fmt.Errorf("could not parse video value: %q (format: %s)", value, valueRe)
+	}
+	path, err := shadertoy.ResolvePath(pwd, match[1])
+	if err != nil {
+		return source{}, err
+	}
+	src := source{path: path}
+	if match[2] != "" {
+		if !src.live() {
+			return source{}, fmt.Errorf("a size can only be set for capture devices, not for %q", path)
+		}
+		w, _ := strconv.Atoi(match[2])
+		h, _ := strconv.Atoi(match[3])
+		src.size = image.Pt(w, h)
+	}
+	return src, nil
+}
+
+// live reports whether the source is a capture device, which are the devices
+// in /dev. They are opened with Video4Linux.
+func (src source) live() bool {
+	return strings.HasPrefix(src.path, "/dev/")
+}
+
+// inputArgs are the arguments of FFmpeg and FFprobe that open the source.
+func (src source) inputArgs() []string {
+	if !src.live() {
+		return []string{"-i", src.path}
+	}
+	args := []string{"-f", "v4l2"}
+	if src.size != (image.Point{}) {
+		args = append(args, "-video_size", fmt.Sprintf("%dx%d", src.size.X, src.size.Y))
+	}
+	return append(args, "-i", src.path)
+}
+
 type videoTexture struct {
 	uniformName string
 	id          uint32
 	index       uint32
+	src         source
 
 	resolution        image.Rectangle
 	frameInterval     time.Duration
 	stream            <-chan interface{}
 	currentVideoFrame int
+	// live is set for capture devices, of which the most recent frame is
+	// shown regardless of the animation time.
+	live bool
 
 	cancel func()
+	memory *renderer.MemoryReservation
 }
 
-func newVideoTexture(uniformName, filename string, texIndex uint32, currentTime time.Duration) (*videoTexture, error) {
+func newVideoTexture(uniformName string, src source, texIndex uint32, currentTime time.Duration) (*videoTexture, error) {
 	ctx, cancel := context.WithCancel(context.Background())
 
-	resolution, interval, stream, err := decodeVideoFile(ctx, filename, currentTime)
+	decode := decodeVideoFile
+	if src.live() {
+		decode = captureVideo
+	}
+	resolution, interval, stream, err := decode(ctx, src, currentTime)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	mem, err := renderer.ReserveMemory(src.path, int64(resolution.Dx())*int64(resolution.Dy())*4)
 	if err != nil {
 		cancel()
 		return nil, err
@@ -54,34 +119,74 @@ func newVideoTexture(uniformName, filename string, texIndex uint32, currentTime
 	vt := &videoTexture{
 		uniformName: uniformName,
 		index:       texIndex,
+		src:         src,
 
 		resolution:        resolution,
 		frameInterval:     interval,
 		stream:            stream,
 		currentVideoFrame: int(currentTime/interval) - 1,
+		live:              src.live(),
 
 		cancel: cancel,
+		memory: mem,
 	}
 	gl.GenTextures(1, &vt.id)
-	gl.BindTexture(gl.TEXTURE_2D, vt.id)
+	vt.allocTexture()
+	return vt, nil
+}
 
-	initialData := make([]byte, resolution.Dx()*resolution.Dy()*3)
+// allocTexture sets the storage of the texture to the resolution, filled with
+// black.
+func (vt *videoTexture) allocTexture() {
+	gl.BindTexture(gl.TEXTURE_2D, vt.id)
+	initialData := make([]byte, vt.resolution.Dx()*vt.resolution.Dy()*3)
 	gl.TexImage2D(
-		gl.TEXTURE_2D,          // target
-		0,                      // level
-		gl.RGBA,                // internalFormat
-		int32(resolution.Dx()), // width
-		int32(resolution.Dy()), // height
-		0,                      // border
-		gl.RGB,                 // format
-		gl.UNSIGNED_BYTE,       // type
-		gl.Ptr(initialData[:]), // data
+		gl.TEXTURE_2D,             // target
+		0,                         // level
+		gl.RGBA,                   // internalFormat
+		int32(vt.resolution.Dx()), // width
+		int32(vt.resolution.Dy()), // height
+		0,                         // border
+		gl.RGB,                    // format
+		gl.UNSIGNED_BYTE,          // type
+		gl.Ptr(initialData[:]),    // data
 	)
 	gl.TexParameteri(gl.TEXTURE_2D, gl.TEXTURE_WRAP_S, gl.REPEAT)
 	gl.TexParameteri(gl.TEXTURE_2D, gl.TEXTURE_WRAP_T, gl.REPEAT)
 	gl.TexParameteri(gl.TEXTURE_2D, gl.TEXTURE_MAG_FILTER, gl.NEAREST)
 	gl.TexParameteri(gl.TEXTURE_2D, gl.TEXTURE_MIN_FILTER, gl.NEAREST)
-	return vt, nil
+}
+
+// Resume implements the shadertoy.ResumeResource interface. Capture devices
+// are usually reset by a suspend, which stops FFmpeg, so capturing is started
+// again. The previous capture is kept if that fails.
+func (vt *videoTexture) Resume() {
+	if !vt.live {
+		return
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	resolution, interval, stream, err := captureVideo(ctx, vt.src, 0)
+	if err != nil {
+		cancel()
+		log.Printf("Could not restart capturing %s: %v", vt.src.path, err)
+		return
+	}
+	if resolution != vt.resolution {
+		mem, err := renderer.ReserveMemory(vt.src.path, int64(resolution.Dx())*int64(resolution.Dy())*4)
+		if err != nil {
+			cancel()
+			log.Printf("Could not restart capturing %s: %v", vt.src.path, err)
+			return
+		}
+		vt.memory.Release()
+		vt.memory = mem
+		vt.resolution = resolution
+		vt.allocTexture()
+	}
+	vt.cancel()
+	vt.cancel = cancel
+	vt.stream = stream
+	vt.frameInterval = interval
 }
 
 func (vt *videoTexture) UniformSource() string {
@@ -93,14 +198,24 @@ func (vt *videoTexture) UniformSource() string {
 }
 
 func (vt *videoTexture) PreRender(state renderer.RenderState) {
-	nextFrameTime := time.Duration(vt.currentVideoFrame+1) * vt.frameInterval
-	if state.Time < nextFrameTime {
-		return
+	var val interface{}
+	if vt.live {
+		select {
+		case val = <-vt.stream:
+		default:
+			return // No new frame was captured.
+		}
+	} else {
+		nextFrameTime := time.Duration(vt.currentVideoFrame+1) * vt.frameInterval
+		if state.Time < nextFrameTime {
+			return
+		}
+		vt.currentVideoFrame++
+		val = <-vt.stream
 	}
-	vt.currentVideoFrame++
 
 	var frame []byte
-	switch val := <-vt.stream; t := val.(type) {
+	switch t := val.(type) {
 	case error:
 		return // TODO: Maybe do something with the error?
 	case []byte:
@@ -148,11 +263,13 @@ func (vt *videoTexture) PreRender(state renderer.RenderState) {
 func (vt *videoTexture) Close() error {
 	vt.cancel()
 	gl.DeleteTextures(1, &vt.id)
+	vt.memory.Release()
 	return nil
 }
 
-func decodeVideoFile(ctx context.Context, filename string, currentTime time.Duration) (image.Rectangle, time.Duration, <-chan interface{}, error) {
-	info, err := ffprobe(ctx, filename)
+func decodeVideoFile(ctx context.Context, src source, currentTime time.Duration) (image.Rectangle, time.Duration, <-chan interface{}, error) {
+	filename := src.path
+	info, err := ffprobe(ctx, src)
 	if err != nil {
 		return image.Rectangle{}, 0, nil, err
 	}
@@ -216,6 +333,63 @@ func decodeVideoFile(ctx context.Context, filename string, currentTime time.Dura
 	return resolution, interval, out, nil
 }
 
+// captureVideo starts capturing frames from a device. Only the most recent
+// frame is kept, so the texture does not lag behind if rendering is slower
+// than the camera.
+func captureVideo(ctx context.Context, src source, _ time.Duration) (image.Rectangle, time.Duration, <-chan interface{}, error) {
+	info, err := ffprobe(ctx, src)
+	if err != nil {
+		return image.Rectangle{}, 0, nil, err
+	}
+	resolution, err := info.VideoResolution()
+	if err != nil {
+		return image.Rectangle{}, 0, nil, err
+	}
+	interval := time.Second / 30
+	if iv, err := info.VideoFrameInterval(); err == nil {
+		interval = iv
+	}
+
+	args := append([]string{"-loglevel", "error", "-fflags", "nobuffer", "-flags", "low_delay"}, src.inputArgs()...)
+	cmd := exec.CommandContext(ctx, "ffmpeg", append(args,
+		"-f", "rawvideo",
+		"-pix_fmt", "rgb24",
+		"-",
+	)...)
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return image.Rectangle{}, 0, nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return image.Rectangle{}, 0, nil, fmt.Errorf("could not start ffmpeg: %w", err)
+	}
+
+	out := make(chan interface{}, 1)
+	replace := func(v interface{}) {
+		// This is the only sender, so the send does not block after
+		// the stale value has been taken out.
+		select {
+		case <-out:
+		default:
+		}
+		out <- v
+	}
+	go func() {
+		defer close(out)
+		for {
+			imgBuf := make([]byte, resolution.Dx()*resolution.Dy()*3)
+			if _, err := io.ReadFull(stdout, imgBuf); err != nil {
+				break
+			}
+			replace(imgBuf)
+		}
+		if err := cmd.Wait(); err != nil && ctx.Err() == nil {
+			replace(fmt.Errorf("capturing %s: %w", src.path, err))
+		}
+	}()
+	return resolution, interval, out, nil
+}
+
 type mediaInfo struct {
 	Streams []struct {
 		CodecType    string `json:"codec_type"`
@@ -228,13 +402,15 @@ type mediaInfo struct {
 	} `json:"format"`
 }
 
-func ffprobe(ctx context.Context, filename string) (*mediaInfo, error) {
-	cmd := exec.CommandContext(
-		ctx,
-		"ffprobe", filename,
+func ffprobe(ctx context.Context, src source) (*mediaInfo, error) {
+	args := src.inputArgs()
+	if !src.live() {
+		args = []string{src.path}
+	}
+	cmd := exec.CommandContext(ctx, "ffprobe", append(args,
 		"-print_format", "json",
 		"-show_format", "-show_streams",
-	)
+	)...)
 	stdout, err := cmd.StdoutPipe()
 	if err != nil {
 		return nil, fmt.Errorf("unable to get media info: %w", err)
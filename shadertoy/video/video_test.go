@@ -0,0 +1,42 @@
+package video
+
+import (
+	"image"
+	"reflect"
+	"testing"
+)
+
+func TestParseMappingValue(t *testing.T) {
+	tests := []struct {
+		value string
+		src   source
+		args  []string
+	}{
+		{"clip.mp4", source{path: "/shaders/clip.mp4"}, []string{"-i", "/shaders/clip.mp4"}},
+		{"/dev/video0", source{path: "/dev/video0"}, []string{"-f", "v4l2", "-i", "/dev/video0"}},
+		{
+			"/dev/video2;1280x720",
+			source{path: "/dev/video2", size: image.Pt(1280, 720)},
+			[]string{"-f", "v4l2", "-video_size", "1280x720", "-i", "/dev/video2"},
+		},
+	}
+	for _, test := range tests {
+		src, err := parseMappingValue("/shaders", test.value)
+		if err != nil {
+			t.Errorf("%q: %v", test.value, err)
+			continue
+		}
+		if src != test.src {
+			t.Errorf("%q: unexpected source %+v, expected %+v", test.value, src, test.src)
+		}
+		if args := src.inputArgs(); !reflect.DeepEqual(args, test.args) {
+			t.Errorf("%q: unexpected arguments %q, expected %q", test.value, args, test.args)
+		}
+	}
+
+	for _, value := range []string{"clip.mp4;640x480", "/dev/video0;640"} {
+		if _, err := parseMappingValue("/shaders", value); err == nil {
+			t.Errorf("%q is accepted", value)
+		}
+	}
+}
@@ -0,0 +1,294 @@
+package sink
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// s3PartSize is the size of the parts of a multipart upload. All parts except
+// the last must be at least 5MiB.
+const s3PartSize = 8 << 20
+
+type s3Client struct {
+	endpoint     *url.URL
+	pathStyle    bool
+	region       string
+	accessKey    string
+	secretKey    string
+	sessionToken string
+	http         *http.Client
+	now          func() time.Time
+}
+
+func newS3ClientFromEnv() (*s3Client, error) {
+	c := &s3Client{
+		region:       os.Getenv("AWS_REGION"),
+		accessKey:    os.Getenv("AWS_ACCESS_KEY_ID"),
+		secretKey:    os.Getenv("AWS_SECRET_ACCESS_KEY"),
+		sessionToken: os.Getenv("AWS_SESSION_TOKEN"),
+		http:         http.DefaultClient,
+		now:          time.Now,
+	}
+	if c.accessKey == "" || c.secretKey == "" {
+		return nil, fmt.Errorf("AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY must be set to upload to S3")
+	}
+	if c.region == "" {
+		c.region = os.Getenv("AWS_DEFAULT_REGION")
+	}
+	if c.region == "" {
+		c.region = "us-east-1"
+	}
+	endpoint := os.Getenv("AWS_ENDPOINT_URL_S3")
+	if endpoint == "" {
+		endpoint = os.Getenv("AWS_ENDPOINT_URL")
+	}
+	if endpoint == "" {
+		endpoint = fmt.Sprintf("https://s3.%s.amazonaws.com", c.region)
+	} else {
+		// S3 compatible services generally do not support virtual hosted
+		// buckets.
+		c.pathStyle = true
+	}
+	var err error
+	if c.endpoint, err = url.Parse(endpoint); err != nil {
+		return nil, fmt.Errorf("invalid S3 endpoint: %w", err)
+	}
+	return c, nil
+}
+
+func (c *s3Client) objectURL(bucket, key string, query url.Values) *url.URL {
+	u := *c.endpoint
+	if c.pathStyle {
+		u.Path = strings.TrimSuffix(u.Path, "/") + "/" + bucket + "/" + key
+	} else {
+		u.Host = bucket + "." + u.Host
+		u.Path = "/" + key
+	}
+	// The path is sent as it is signed, see uriEncodePath.
+	u.RawPath = uriEncodePath(u.Path)
+	u.RawQuery = query.Encode()
+	return &u
+}
+
+func (c *s3Client) do(method string, u *url.URL, header http.Header, payload []byte, respBody *[]byte) error {
+	req, err := http.NewRequest(method, u.String(), bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	c.sign(req, payload)
+	return doRequest(c.http, req, respBody)
+}
+
+func (c *s3Client) putObject(bucket, key, contentType string, data []byte) error {
+	header := http.Header{}
+	header.Set("Content-Type", contentType)
+	return c.do(http.MethodPut, c.objectURL(bucket, key, nil), header, data, nil)
+}
+
+// s3MultipartWriter uploads everything written to it as a multipart upload so
+// the size of the object does not need to be known in advance.
+type s3MultipartWriter struct {
+	client      *s3Client
+	bucket, key string
+	uploadID    string
+	buf         []byte
+	etags       []string
+	err         error
+}
+
+func (c *s3Client) openMultipart(bucket, key, contentType string) (*s3MultipartWriter, error) {
+	header := http.Header{}
+	header.Set("Content-Type", contentType)
+	var body []byte
+	if err := c.do(http.MethodPost, c.objectURL(bucket, key, url.Values{"uploads": {""}}), header, nil, &body); err != nil {
+		return nil, err
+	}
+	var result struct {
+		UploadID string `xml:"UploadId"`
+	}
+	if err := xml.Unmarshal(body, &result); err != nil {
+		return nil, fmt.Errorf("could not parse multipart upload response: %w", err)
+	}
+	return &s3MultipartWriter{
+		client:   c,
+		bucket:   bucket,
+		key:      key,
+		uploadID: result.UploadID,
+	}, nil
+}
+
+func (w *s3MultipartWriter) Write(p []byte) (int, error) {
+	if w.err != nil {
+		return 0, w.err
+	}
+	w.buf = append(w.buf, p...)
+	for len(w.buf) >= s3PartSize {
+		if err := w.uploadPart(w.buf[:s3PartSize]); err != nil {
+			return 0, err
+		}
+		w.buf = append(w.buf[:0], w.buf[s3PartSize:]...)
+	}
+	return len(p), nil
+}
+
+func (w *s3MultipartWriter) uploadPart(data []byte) error {
+	query := url.Values{
+		"partNumber": {fmt.Sprint(len(w.etags) + 1)},
+		"uploadId":   {w.uploadID},
+	}
+	req, err := http.NewRequest(http.MethodPut, w.client.objectURL(w.bucket, w.key, query).String(), bytes.NewReader(data))
+	if err != nil {
+		w.err = err
+		return err
+	}
+	w.client.sign(req, data)
+	resp, err := w.client.http.Do(req)
+	if err != nil {
+		w.err = err
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		w.err = fmt.Errorf("could not upload part %d: %s", len(w.etags)+1, resp.Status)
+		return w.err
+	}
+	w.etags = append(w.etags, resp.Header.Get("ETag"))
+	return nil
+}
+
+// Close uploads the remaining data and completes the upload. The upload is
+// aborted if any part failed.
+func (w *s3MultipartWriter) Close() error {
+	if w.err == nil && (len(w.buf) > 0 || len(w.etags) == 0) {
+		w.uploadPart(w.buf)
+		w.buf = nil
+	}
+	query := url.Values{"uploadId": {w.uploadID}}
+	if w.err != nil {
+		w.client.do(http.MethodDelete, w.client.objectURL(w.bucket, w.key, query), nil, nil, nil)
+		return w.err
+	}
+
+	type part struct {
+		PartNumber int
+		ETag       string
+	}
+	complete := struct {
+		XMLName xml.Name `xml:"CompleteMultipartUpload"`
+		Parts   []part   `xml:"Part"`
+	}{}
+	for i, etag := range w.etags {
+		complete.Parts = append(complete.Parts, part{PartNumber: i + 1, ETag: etag})
+	}
+	body, err := xml.Marshal(complete)
+	if err != nil {
+		return err
+	}
+	header := http.Header{}
+	header.Set("Content-Type", "application/xml")
+	return w.client.do(http.MethodPost, w.client.objectURL(w.bucket, w.key, query), header, body, nil)
+}
+
+// sign adds an AWS Signature Version 4 to the request. All headers that are set
+// at this point are signed.
+//
+// See https://docs.aws.amazon.com/AmazonS3/latest/API/sig-v4-header-based-auth.html
+func (c *s3Client) sign(req *http.Request, payload []byte) {
+	now := c.now().UTC()
+	amzDate := now.Format("20060102T150405Z")
+	date := now.Format("20060102")
+	payloadHash := sha256.Sum256(payload)
+
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", hex.EncodeToString(payloadHash[:]))
+	if c.sessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", c.sessionToken)
+	}
+
+	headers := map[string]string{"host": req.URL.Host}
+	for k, v := range req.Header {
+		headers[strings.ToLower(k)] = strings.TrimSpace(strings.Join(v, ","))
+	}
+	names := make([]string, 0, len(headers))
+	for k := range headers {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	var canonicalHeaders strings.Builder
+	for _, k := range names {
+		fmt.Fprintf(&canonicalHeaders, "%s:%s\n", k, headers[k])
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		uriEncodePath(req.URL.Path),
+		canonicalQuery(req.URL.Query()),
+		canonicalHeaders.String(),
+		signedHeaders,
+		hex.EncodeToString(payloadHash[:]),
+	}, "\n")
+	canonicalHash := sha256.Sum256([]byte(canonicalRequest))
+
+	scope := fmt.Sprintf("%s/%s/s3/aws4_request", date, c.region)
+	stringToSign := strings.Join([]string{
+		"AWS4-HMAC-SHA256",
+		amzDate,
+		scope,
+		hex.EncodeToString(canonicalHash[:]),
+	}, "\n")
+
+	key := hmacSHA256([]byte("AWS4"+c.secretKey), date)
+	key = hmacSHA256(key, c.region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf(
+		"AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		c.accessKey, scope, signedHeaders, signature,
+	))
+}
+
+// uriEncodePath encodes every byte of the path except for unreserved
+// characters and slashes, like the canonical URI of a signature. This is
+// stricter than url.URL, which keeps characters like ':' and '+'.
+func uriEncodePath(path string) string {
+	var b strings.Builder
+	for i := 0; i < len(path); i++ {
+		c := path[i]
+		if 'A' <= c && c <= 'Z' || 'a' <= c && c <= 'z' || '0' <= c && c <= '9' || strings.IndexByte("-._~/", c) >= 0 {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+// canonicalQuery encodes the query parameters sorted by key with spaces
+// encoded as %20 instead of +.
+func canonicalQuery(query url.Values) string {
+	return strings.ReplaceAll(query.Encode(), "+", "%20")
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
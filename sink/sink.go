@@ -0,0 +1,147 @@
+// Package sink implements outputs that upload rendered results to remote
+// storage instead of writing them to local files.
+//
+// Supported destinations are:
+//
+//	http://host/path, https://host/path: uploaded with a PUT request
+//	s3://bucket/key: uploaded to S3 or an S3 compatible service
+//
+// S3 credentials and settings are read from the standard AWS_ACCESS_KEY_ID,
+// AWS_SECRET_ACCESS_KEY, AWS_SESSION_TOKEN, AWS_REGION and AWS_ENDPOINT_URL
+// environment variables.
+package sink
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+)
+
+// IsRemote reports whether the output name refers to a remote destination.
+func IsRemote(name string) bool {
+	for _, scheme := range []string{"http://", "https://", "s3://"} {
+		if strings.HasPrefix(name, scheme) {
+			return true
+		}
+	}
+	return false
+}
+
+// Open returns a writer that streams everything written to it to the remote
+// destination. The upload is completed when the writer is closed, which
+// returns any error that occurred.
+func Open(dest string) (io.WriteCloser, error) {
+	u, err := url.Parse(dest)
+	if err != nil {
+		return nil, err
+	}
+	switch u.Scheme {
+	case "http", "https":
+		return openHTTP(u), nil
+	case "s3":
+		client, err := newS3ClientFromEnv()
+		if err != nil {
+			return nil, err
+		}
+		return client.openMultipart(u.Host, strings.TrimPrefix(u.Path, "/"), contentType(u.Path))
+	default:
+		return nil, fmt.Errorf("unsupported sink: %q", dest)
+	}
+}
+
+// Put uploads a single object to the remote destination.
+func Put(dest string, data []byte) error {
+	u, err := url.Parse(dest)
+	if err != nil {
+		return err
+	}
+	switch u.Scheme {
+	case "http", "https":
+		req, err := http.NewRequest(http.MethodPut, u.String(), bytes.NewReader(data))
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Content-Type", contentType(u.Path))
+		return doRequest(http.DefaultClient, req, nil)
+	case "s3":
+		client, err := newS3ClientFromEnv()
+		if err != nil {
+			return err
+		}
+		return client.putObject(u.Host, strings.TrimPrefix(u.Path, "/"), contentType(u.Path), data)
+	default:
+		return fmt.Errorf("unsupported sink: %q", dest)
+	}
+}
+
+func contentType(p string) string {
+	if t := mime.TypeByExtension(path.Ext(p)); t != "" {
+		return t
+	}
+	return "application/octet-stream"
+}
+
+// httpWriter streams data to an HTTP server using a chunked PUT request.
+type httpWriter struct {
+	pw   *io.PipeWriter
+	done chan error
+}
+
+func openHTTP(u *url.URL) *httpWriter {
+	pr, pw := io.Pipe()
+	w := &httpWriter{pw: pw, done: make(chan error, 1)}
+	go func() {
+		req, err := http.NewRequest(http.MethodPut, u.String(), pr)
+		if err != nil {
+			pr.CloseWithError(err)
+			w.done <- err
+			return
+		}
+		req.Header.Set("Content-Type", contentType(u.Path))
+		err = doRequest(http.DefaultClient, req, nil)
+		// Unblock pending writes if the request failed early.
+		pr.CloseWithError(fmt.Errorf("upload ended: %v", err))
+		w.done <- err
+	}()
+	return w
+}
+
+func (w *httpWriter) Write(p []byte) (int, error) {
+	return w.pw.Write(p)
+}
+
+func (w *httpWriter) Close() error {
+	w.pw.Close()
+	return <-w.done
+}
+
+// doRequest performs the request and returns an error if the server does not
+// respond with a 2xx status. If body is not nil, the response body is read
+// into it.
+func doRequest(client *http.Client, req *http.Request, body *[]byte) error {
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		msg := strings.TrimSpace(string(data))
+		if len(msg) > 200 {
+			msg = msg[:200]
+		}
+		return fmt.Errorf("%s %s: %s: %s", req.Method, req.URL.Redacted(), resp.Status, msg)
+	}
+	if body != nil {
+		*body = data
+	}
+	return nil
+}